@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NodeACL enforces the access rules of the organization owning this private
+// node (ENFORCE_ACLS). Each rule lets some users reach some internal
+// networks: a destination a rule names is reserved for that rule's users,
+// and internal destinations no rule names are denied. Public destinations
+// no rule names stay open to everyone, as without ACLs.
+//
+// Rules come from the sync server, which only hands them to the node holding
+// PRIVATE_NODE_TOKEN. Hostnames in rules are resolved on every poll.
+type NodeACL struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+type aclRule struct {
+	users map[string]struct{}
+	nets  []*net.IPNet
+	ports map[int]struct{}
+}
+
+// The rule as the sync server sends it
+type aclRuleJSON struct {
+	Users []string `json:"users"`
+	Cidrs []string `json:"cidrs"`
+	Hosts []string `json:"hosts"`
+	Ports []int    `json:"ports"`
+}
+
+// nodeACL is nil unless ENFORCE_ACLS is set
+var nodeACL *NodeACL
+
+// Check reports whether any rule names ip and port, and if so whether one
+// of them grants subject access.
+func (a *NodeACL) Check(subject string, ip net.IP, port int) (matched, allowed bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if !rule.covers(ip, port) {
+			continue
+		}
+		matched = true
+		if _, ok := rule.users[subject]; ok {
+			return true, true
+		}
+	}
+	return matched, false
+}
+
+func (r *aclRule) covers(ip net.IP, port int) bool {
+	if len(r.ports) > 0 {
+		if _, ok := r.ports[port]; !ok {
+			return false
+		}
+	}
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileACLRule(rule aclRuleJSON) aclRule {
+	compiled := aclRule{
+		users: make(map[string]struct{}, len(rule.Users)),
+		ports: make(map[int]struct{}, len(rule.Ports)),
+	}
+	for _, user := range rule.Users {
+		compiled.users[user] = struct{}{}
+	}
+	for _, port := range rule.Ports {
+		compiled.ports[port] = struct{}{}
+	}
+	for _, cidr := range rule.Cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			compiled.nets = append(compiled.nets, n)
+		} else if ip := net.ParseIP(cidr); ip != nil {
+			compiled.nets = append(compiled.nets, hostNet(ip))
+		} else {
+			slog.Warn("Ignoring invalid ACL network", "value", cidr)
+		}
+	}
+	for _, host := range rule.Hosts {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			slog.Warn("Failed to resolve ACL host", "host", host, "err", err)
+			continue
+		}
+		for _, ip := range ips {
+			compiled.nets = append(compiled.nets, hostNet(ip))
+		}
+	}
+	return compiled
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (a *NodeACL) fetch(syncServerURL, serverID, token string) ([]aclRuleJSON, error) {
+	req, err := http.NewRequest(http.MethodGet, syncServerURL+"/servers/"+serverID+"/acls", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body struct {
+		Rules []aclRuleJSON `json:"rules"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Rules, nil
+}
+
+func aclPollIntervalFromEnv() time.Duration {
+	if v := os.Getenv("ACL_POLL_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid ACL_POLL_INTERVAL value", "value", v)
+	}
+	return time.Minute
+}
+
+// Poll refreshes the rules from the sync server forever. A failed poll keeps
+// the previous rules; until the first one succeeds, every internal
+// destination is denied.
+func (a *NodeACL) Poll(syncServerURL, serverID string, interval time.Duration) {
+	for {
+		if _, err := a.Refresh(syncServerURL, serverID); err != nil {
+			slog.Warn("Failed to fetch ACLs", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Refresh fetches the rules from the sync server once, returning how many
+// there are now. A failed fetch keeps the previous rules.
+func (a *NodeACL) Refresh(syncServerURL, serverID string) (int, error) {
+	rules, err := a.fetch(syncServerURL, serverID, nodeToken)
+	if err != nil {
+		return 0, err
+	}
+	compiled := make([]aclRule, 0, len(rules))
+	for _, rule := range rules {
+		compiled = append(compiled, compileACLRule(rule))
+	}
+	a.mu.Lock()
+	a.rules = compiled
+	a.mu.Unlock()
+	return len(compiled), nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin API for managing a running node, on its own port so it never shares
+// a listener with tunnels. ADMIN_PORT turns it on; it listens on
+// ADMIN_ADDRESS (default: 127.0.0.1) and needs a bearer token from
+// ADMIN_TOKENS or ADMIN_TOKEN on every request. Tokens carry the sync
+// server's roles: viewer may read, and closing tunnels and reloading take
+// operator or admin.
+//
+//	GET    /tunnels         connections being relayed, with byte counts
+//	DELETE /tunnels/<id>    close one, with reason "closed by operator"
+//	POST   /reload/auth     rebuild authentication from the environment
+//	POST   /reload/acls     fetch ENFORCE_ACLS rules from the sync server now
+//	GET    /registration    registration and cloudflared state
+//	GET    /blocklists      BLOCKLIST_FEEDS and MALWARE_FEEDS, with sizes, hits and errors
+//	POST   /reload/blocklists  fetch every blocklist and malware feed now
+//
+// A relayed connection is a plain tunnel or one stream of a multiplexed or
+// QUIC tunnel; UDP relays and IP tunnels aren't listed.
+type adminAPI struct {
+	tokens     []adminToken
+	serverID   string
+	syncServer string
+}
+
+// adminRole is what an admin token may do; each role can do everything the
+// ones below it can
+type adminRole int
+
+const (
+	adminViewer adminRole = iota
+	adminOperator
+	adminAdmin
+)
+
+var adminRoles = map[string]adminRole{"viewer": adminViewer, "operator": adminOperator, "admin": adminAdmin}
+
+func (r adminRole) String() string {
+	for name, role := range adminRoles {
+		if role == r {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// adminToken is one of ADMIN_TOKENS; only its hash is kept
+type adminToken struct {
+	name string
+	role adminRole
+	hash [32]byte
+}
+
+// adminTokensFromEnv reads ADMIN_TOKENS, "name:role:token" entries
+// separated by commas, as the sync server does. A plain ADMIN_TOKEN is a
+// token named admin with the admin role.
+func adminTokensFromEnv() ([]adminToken, error) {
+	var tokens []adminToken
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		tokens = append(tokens, adminToken{name: "admin", role: adminAdmin, hash: sha256.Sum256([]byte(token))})
+	}
+	for i, entry := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("ADMIN_TOKENS entry %d: expected name:role:token", i+1)
+		}
+		role, ok := adminRoles[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("ADMIN_TOKENS entry %d: unknown role %q", i+1, parts[1])
+		}
+		tokens = append(tokens, adminToken{name: parts[0], role: role, hash: sha256.Sum256([]byte(parts[2]))})
+	}
+	return tokens, nil
+}
+
+// find returns the token matching the request's bearer token, comparing
+// against every one in constant time
+func (a *adminAPI) find(r *http.Request) *adminToken {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(token))
+	var found *adminToken
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], a.tokens[i].hash[:]) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	return found
+}
+
+// requiredAdminRole is the role a request needs: reading takes viewer and
+// anything else operator
+func requiredAdminRole(r *http.Request) adminRole {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return adminViewer
+	}
+	return adminOperator
+}
+
+// Set when ADMIN_PORT is; relays only keep counts for the API then
+var adminEnabled bool
+
+var tunnelsClosedByAdmin = registry.Counter("admin_tunnels_closed_total", "Connections closed through the admin API")
+
+// activeTunnel is a relayed connection as the admin API sees it
+type activeTunnel struct {
+	id       string
+	t        *Tunnel
+	up, down Metric
+}
+
+var activeTunnels = struct {
+	mu   sync.Mutex
+	byID map[string]*activeTunnel
+}{byID: make(map[string]*activeTunnel)}
+
+// trackTunnel lists t for the admin API until the returned function is
+// called, or returns nil when the API is off
+func trackTunnel(t *Tunnel) (*activeTunnel, func()) {
+	if !adminEnabled {
+		return nil, nil
+	}
+	a := &activeTunnel{id: newConnID(), t: t}
+	activeTunnels.mu.Lock()
+	activeTunnels.byID[a.id] = a
+	activeTunnels.mu.Unlock()
+	return a, func() {
+		activeTunnels.mu.Lock()
+		delete(activeTunnels.byID, a.id)
+		activeTunnels.mu.Unlock()
+	}
+}
+
+type adminTunnelView struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Opened      time.Time `json:"opened"`
+	LastActive  time.Time `json:"lastActive"`
+	BytesUp     int64     `json:"bytesUp"`
+	BytesDown   int64     `json:"bytesDown"`
+}
+
+type remoteAddresser interface {
+	RemoteAddr() net.Addr
+}
+
+func (a *activeTunnel) view() adminTunnelView {
+	v := adminTunnelView{
+		ID:         a.id,
+		Opened:     a.t.usage.opened,
+		LastActive: time.Unix(0, a.t.usage.lastActive.Load()),
+		BytesUp:    a.up.Value(),
+		BytesDown:  a.down.Value(),
+	}
+	if a.t.id != nil {
+		v.User = a.t.id.Subject
+	}
+	if c, ok := a.t.localConn.(remoteAddresser); ok {
+		v.Client = c.RemoteAddr().String()
+	}
+	if a.t.remoteConn != a.t.localConn {
+		if c, ok := a.t.remoteConn.(remoteAddresser); ok {
+			v.Destination = c.RemoteAddr().String()
+		}
+	}
+	return v
+}
+
+func adminAPIFromEnv(serverID, syncServer string) (*adminAPI, string, error) {
+	port := os.Getenv("ADMIN_PORT")
+	if port == "" {
+		return nil, "", nil
+	}
+	tokens, err := adminTokensFromEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(tokens) == 0 {
+		return nil, "", errors.New("ADMIN_PORT needs ADMIN_TOKENS or ADMIN_TOKEN")
+	}
+	address := os.Getenv("ADMIN_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1"
+	}
+	return &adminAPI{tokens: tokens, serverID: serverID, syncServer: syncServer}, net.JoinHostPort(address, port), nil
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", a.handleTunnels)
+	mux.HandleFunc("/tunnels/", a.handleTunnel)
+	mux.HandleFunc("/reload/auth", a.handleReloadAuth)
+	mux.HandleFunc("/reload/acls", a.handleReloadACLs)
+	mux.HandleFunc("/registration", a.handleRegistration)
+	mux.HandleFunc("/blocklists", a.handleBlocklists)
+	mux.HandleFunc("/reload/blocklists", a.handleReloadBlocklists)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := a.find(r)
+		if token == nil {
+			writeAdminError(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+		if role := requiredAdminRole(r); token.role < role {
+			writeAdminError(w, http.StatusForbidden, "Requires "+role.String()+" role")
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, token)))
+	})
+}
+
+type adminTokenKey struct{}
+
+// adminTokenFrom returns the token an admin request was let in with
+func adminTokenFrom(r *http.Request) *adminToken {
+	return r.Context().Value(adminTokenKey{}).(*adminToken)
+}
+
+// serve answers admin requests on addr until the listener fails
+func (a *adminAPI) serve(addr string) error {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      a.handler(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func (a *adminAPI) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	activeTunnels.mu.Lock()
+	tunnels := make([]adminTunnelView, 0, len(activeTunnels.byID))
+	for _, t := range activeTunnels.byID {
+		tunnels = append(tunnels, t.view())
+	}
+	activeTunnels.mu.Unlock()
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Opened.Before(tunnels[j].Opened) })
+	writeAdminJSON(w, map[string]any{"tunnels": tunnels})
+}
+
+func (a *adminAPI) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/tunnels/")
+	activeTunnels.mu.Lock()
+	t := activeTunnels.byID[id]
+	activeTunnels.mu.Unlock()
+	if t == nil {
+		writeAdminError(w, http.StatusNotFound, "No such tunnel")
+		return
+	}
+	t.t.log.Info("Closing tunnel", "reason", "closed by operator", "by", adminTokenFrom(r).name, "after", time.Since(t.t.usage.opened).Round(time.Second), "bytes", t.t.usage.bytes.Load())
+	tunnelsClosedByAdmin.Inc()
+	if lc, ok := t.t.localConn.(limitCloser); ok {
+		lc.CloseLimit("closed by operator")
+	} else {
+		t.t.localConn.Close()
+	}
+	writeAdminJSON(w, map[string]string{"status": "closed"})
+}
+
+func (a *adminAPI) handleReloadAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := reloadAuth(a.serverID); err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, "Keeping the current authentication: "+err.Error())
+		return
+	}
+	slog.Info("Reloaded authentication through the admin API", "by", adminTokenFrom(r).name)
+	writeAdminJSON(w, map[string]string{"status": "reloaded"})
+}
+
+func (a *adminAPI) handleReloadACLs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if nodeACL == nil {
+		writeAdminError(w, http.StatusConflict, "ENFORCE_ACLS is off")
+		return
+	}
+	rules, err := nodeACL.Refresh(a.syncServer, a.serverID)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, "Failed to fetch ACLs: "+err.Error())
+		return
+	}
+	writeAdminJSON(w, map[string]any{"status": "reloaded", "rules": rules})
+}
+
+func (a *adminAPI) handleRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeAdminJSON(w, nodeRegistration.view())
+}
+
+func (a *adminAPI) handleBlocklists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeAdminJSON(w, map[string]any{"feeds": blocklists.view(), "malwareFeeds": malwareFeeds.view()})
+}
+
+func (a *adminAPI) handleReloadBlocklists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if blocklists == nil && malwareFeeds == nil {
+		writeAdminError(w, http.StatusConflict, "Neither BLOCKLIST_FEEDS nor MALWARE_FEEDS is set")
+		return
+	}
+	var errs []error
+	for _, b := range []*Blocklists{blocklists, malwareFeeds} {
+		if b != nil {
+			errs = append(errs, b.Refresh())
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		writeAdminError(w, http.StatusBadGateway, "Failed to fetch blocklist feeds: "+err.Error())
+		return
+	}
+	writeAdminJSON(w, map[string]any{"status": "reloaded", "feeds": blocklists.view(), "malwareFeeds": malwareFeeds.view()})
+}
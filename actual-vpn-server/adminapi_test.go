@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPIRoles(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("ADMIN_TOKENS", "grafana:viewer:v-secret, oncall:operator:o-secret:with-colon")
+	tokens, err := adminTokensFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := (&adminAPI{tokens: tokens}).handler()
+
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/tunnels", "", http.StatusUnauthorized},
+		{http.MethodGet, "/tunnels", "v-secret-wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/tunnels", "v-secret", http.StatusOK},
+		{http.MethodGet, "/registration", "v-secret", http.StatusOK},
+		{http.MethodDelete, "/tunnels/nope", "v-secret", http.StatusForbidden},
+		{http.MethodPost, "/reload/auth", "v-secret", http.StatusForbidden},
+		{http.MethodPost, "/reload/blocklists", "v-secret", http.StatusForbidden},
+		{http.MethodGet, "/tunnels", "o-secret:with-colon", http.StatusOK},
+		{http.MethodDelete, "/tunnels/nope", "o-secret:with-colon", http.StatusNotFound},
+		{http.MethodPost, "/reload/blocklists", "o-secret:with-colon", http.StatusConflict},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s with %q: %d, want %d", tc.method, tc.path, tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminTokensFromEnv(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "legacy")
+	t.Setenv("ADMIN_TOKENS", "")
+	tokens, err := adminTokensFromEnv()
+	if err != nil || len(tokens) != 1 || tokens[0].role != adminAdmin {
+		t.Errorf("ADMIN_TOKEN alone: %+v, %v", tokens, err)
+	}
+
+	for _, spec := range []string{"nameonly", "ci:operator", "ci:root:secret", ":viewer:secret", "ci:viewer:"} {
+		t.Setenv("ADMIN_TOKENS", spec)
+		if _, err := adminTokensFromEnv(); err == nil {
+			t.Errorf("ADMIN_TOKENS=%q was accepted", spec)
+		}
+	}
+}
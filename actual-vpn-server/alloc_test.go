@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/e2e"
+	"horse-vpn-server/mux"
+)
+
+// Allocation budget for the data path. Once a tunnel is running, moving a
+// frame through it should not allocate: garbage there turns into GC pauses
+// on a busy node. Each case echoes payloads through an in-process node and
+// counts allocations per round trip, across the test client and the node
+// together, so the client side of e2e and mux is held to the same budget.
+// The one allocation allowed is gorilla/websocket's reader for each message
+// the node receives.
+const allocPayload = 1024
+
+var allocCases = []struct {
+	name   string
+	header http.Header
+	// Wraps the raw tunnel in the layers under test
+	wrap   func(tb testing.TB, conn io.ReadWriteCloser) io.ReadWriter
+	budget float64
+}{
+	{"ws", http.Header{"X-Traffic-Class": {"interactive"}}, nil, 1},
+	{"ws-coalesced", nil, nil, 1},
+	{"e2e", http.Header{"X-Traffic-Class": {"interactive"}, e2e.Header: {e2e.Version}}, wrapE2E, 1},
+	{"mux", http.Header{"X-Traffic-Class": {"interactive"}, mux.Header: {mux.Version}}, wrapMux, 1},
+}
+
+func TestDataPathAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeE2EKey = key
+	defer func() { nodeE2EKey = nil }()
+	node := startTestNode(t)
+
+	for _, c := range allocCases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := dialRawWS(t, node, c.header)
+			defer conn.Close()
+			var rw io.ReadWriter = conn
+			if c.wrap != nil {
+				rw = c.wrap(t, conn)
+			}
+			out := make([]byte, allocPayload)
+			in := make([]byte, allocPayload)
+			roundTrip := func() {
+				if _, err := rw.Write(out); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(rw, in); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Let buffers and timers reach their steady state first
+			for i := 0; i < 100; i++ {
+				roundTrip()
+			}
+			if allocs := testing.AllocsPerRun(500, roundTrip); allocs > c.budget {
+				t.Errorf("%.2f allocations per round trip, budget %.0f", allocs, c.budget)
+			}
+		})
+	}
+}
+
+func wrapE2E(tb testing.TB, conn io.ReadWriteCloser) io.ReadWriter {
+	sealed, err := e2e.Client(conn, nodeE2EKey.PublicKey(), e2e.ChaCha20Poly1305)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return sealed
+}
+
+func wrapMux(tb testing.TB, conn io.ReadWriteCloser) io.ReadWriter {
+	session := mux.Client(conn, mux.Config{})
+	tb.Cleanup(func() { session.Close() })
+	stream, err := session.Open()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return stream
+}
+
+// rawWSConn is a WebSocket client that reuses its buffers, unlike
+// gorilla/websocket's, whose client side allocates for every message it
+// writes. It masks with an all-zero key, which leaves the payload as it is.
+type rawWSConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	head    [4]byte
+	wbuf    []byte
+	rbuf    []byte
+	pending []byte
+}
+
+func dialRawWS(tb testing.TB, node *testNode, header http.Header) *rawWSConn {
+	tb.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(node.http.URL, "http://"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, node.http.URL+"/ws", nil)
+	req.Header.Set("Origin", "http://localhost")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "vpn-protocol")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(conn); err != nil {
+		tb.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		tb.Fatalf("upgrade refused with status %d", resp.StatusCode)
+	}
+	return &rawWSConn{conn: conn, br: br, wbuf: make([]byte, 0, 8+64<<10), rbuf: make([]byte, 64<<10)}
+}
+
+func (c *rawWSConn) Write(b []byte) (int, error) {
+	if len(b) >= 1<<16 {
+		return 0, errors.New("rawWSConn: message too large")
+	}
+	frame := append(c.wbuf[:0], 0x82, 0x80|126, byte(len(b)>>8), byte(len(b)), 0, 0, 0, 0)
+	frame = append(frame, b...)
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *rawWSConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if _, err := io.ReadFull(c.br, c.head[:2]); err != nil {
+			return 0, err
+		}
+		n := int(c.head[1] & 0x7f)
+		switch n {
+		case 126:
+			if _, err := io.ReadFull(c.br, c.head[2:4]); err != nil {
+				return 0, err
+			}
+			n = int(binary.BigEndian.Uint16(c.head[2:4]))
+		case 127:
+			return 0, errors.New("rawWSConn: message too large")
+		}
+		if _, err := io.ReadFull(c.br, c.rbuf[:n]); err != nil {
+			return 0, err
+		}
+		switch int(c.head[0] & 0x0f) {
+		case websocket.CloseMessage:
+			return 0, io.EOF
+		case websocket.BinaryMessage:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			c.pending = c.rbuf[:n]
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *rawWSConn) Close() error {
+	return c.conn.Close()
+}
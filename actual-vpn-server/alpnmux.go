@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// serveTLSMux serves every transport on one TLS port, picking by the ALPN
+// protocol the client negotiates: rawTLSProto goes to the raw TLS
+// transport, and everything else (h2, http/1.1 or none) to the HTTP server,
+// which carries the WebSocket, polling and HTTP/2 CONNECT transports and
+// shows the decoy site to anyone else. To a scanner the port looks like an
+// ordinary HTTPS server.
+func serveTLSMux(addr string, config *tls.Config, server *http.Server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serveTLSMuxListener(ln, config, server)
+}
+
+// serveTLSMuxListener is serveTLSMux on a listener the caller opened. It
+// returns when ln is closed.
+func serveTLSMuxListener(ln net.Listener, config *tls.Config, server *http.Server) error {
+	// Serve only sets up HTTP/2 when the config offers h2
+	server.TLSConfig = config
+	httpConns := newConnListener(ln.Addr())
+	go server.Serve(httpConns)
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			httpConns.Close()
+			return err
+		}
+		if err != nil {
+			slog.Warn("TLS accept failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go dispatchTLS(tls.Server(conn, config), httpConns)
+	}
+}
+
+func dispatchTLS(conn *tls.Conn, httpConns *connListener) {
+	conn.SetDeadline(time.Now().Add(rawTLSPreambleTimeout))
+	if err := conn.Handshake(); err != nil {
+		handshakeFailures.Inc()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch conn.ConnectionState().NegotiatedProtocol {
+	case rawTLSProto:
+		handleRawTLS(conn)
+	case acme.ALPNProto:
+		// The challenge was answered during the handshake
+		conn.Close()
+	default:
+		httpConns.push(conn)
+	}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// connListener hands connections that were accepted elsewhere to
+// http.Server.Serve.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
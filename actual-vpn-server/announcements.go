@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operator announcements: a message of the day or incident banner set on
+// the sync server. A WebSocket tunnel request with X-Tunnel-Announcements: 1
+// gets the current one as a text message once the tunnel is up, and each
+// change after that while it lasts:
+//
+//	{"type": "announcement", "message": "Maintenance tonight from 22:00 UTC",
+//	 "severity": "maintenance", "updatedAt": 1760500000000}
+//
+// severity is info, maintenance or incident, and expiresAt, in
+// milliseconds like updatedAt, is there when the operator set one. A
+// message with an empty message says the announcement was taken down.
+const announcementsHeader = "X-Tunnel-Announcements"
+
+type announcement struct {
+	Message   string `json:"message"`
+	Severity  string `json:"severity,omitempty"`
+	UpdatedAt int64  `json:"updatedAt,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+// Announcements mirrors the sync server's announcement
+type Announcements struct {
+	mu      sync.Mutex
+	current *announcement
+	// Closed and replaced on every change
+	changed chan struct{}
+}
+
+var announcements = &Announcements{changed: make(chan struct{})}
+
+// Current returns the announcement, nil for none, and a channel closed
+// when it changes
+func (a *Announcements) Current() (*announcement, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current, a.changed
+}
+
+func (a *Announcements) set(next *announcement) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current == next || (a.current != nil && next != nil && *a.current == *next) {
+		return
+	}
+	a.current = next
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func announcementPollIntervalFromEnv() time.Duration {
+	if v := os.Getenv("ANNOUNCEMENT_POLL_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid ANNOUNCEMENT_POLL_INTERVAL value", "value", v)
+	}
+	return 60 * time.Second
+}
+
+// Poll refreshes the announcement from the sync server forever. A failed
+// poll keeps the previous one.
+func (a *Announcements) Poll(syncServerURL string, interval time.Duration) {
+	for {
+		var resp struct {
+			Announcement *announcement `json:"announcement"`
+		}
+		if err := getJSON(syncServerURL+"/announcement", &resp); err != nil {
+			slog.Warn("Failed to fetch announcement", "err", err)
+		} else {
+			a.set(resp.Announcement)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sendAnnouncements sends the current announcement, if any, and then every
+// change until stop is closed or the client can't take them
+func (t *Tunnel) sendAnnouncements(stop <-chan struct{}) {
+	current, changed := announcements.Current()
+	for {
+		if current != nil {
+			msg, _ := json.Marshal(struct {
+				Type string `json:"type"`
+				announcement
+			}{"announcement", *current})
+			if err := t.announcements.WriteText(msg); err != nil {
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-changed:
+		}
+		if current, changed = announcements.Current(); current == nil {
+			// Taken down
+			current = &announcement{}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyProvider accepts API keys issued by the sync server (hvk_...),
+// checking each with the sync server named by API_KEYS_URL. Answers are
+// cached for a minute and refusals for ten seconds, so a key revoked on the
+// sync server stops opening tunnels within a minute, and open tunnels using
+// it are closed at their next credential check. If the sync server can't be
+// reached, keys it accepted recently keep working until their cached answer
+// runs out.
+type APIKeyProvider struct {
+	url string
+
+	mu    sync.Mutex
+	cache map[[32]byte]apiKeyAnswer
+}
+
+type apiKeyAnswer struct {
+	user    string
+	expires time.Time
+	// Why the key was refused; empty if it was accepted
+	refused string
+	until   time.Time
+}
+
+const (
+	apiKeyPrefix     = "hvk_"
+	apiKeyCacheTTL   = time.Minute
+	apiKeyRefusalTTL = 10 * time.Second
+	apiKeyCacheMax   = 10000
+)
+
+func newAPIKeyProvider(syncServerURL string) *APIKeyProvider {
+	return &APIKeyProvider{
+		url:   strings.TrimSuffix(syncServerURL, "/") + "/api-keys/verify",
+		cache: make(map[[32]byte]apiKeyAnswer),
+	}
+}
+
+func (p *APIKeyProvider) Name() string {
+	return "apikey"
+}
+
+func (p *APIKeyProvider) Authenticate(token string) (*Identity, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, errTokenNotRecognized
+	}
+	sum := sha256.Sum256([]byte(token))
+	answer, err := p.check(sum, token)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{Subject: answer.user, Provider: p.Name(), Expires: answer.expires}
+	id.recheck = func() error {
+		_, err := p.check(sum, token)
+		return err
+	}
+	return id, nil
+}
+
+// check answers from the cache, or asks the sync server
+func (p *APIKeyProvider) check(sum [32]byte, token string) (apiKeyAnswer, error) {
+	now := time.Now()
+	p.mu.Lock()
+	answer, ok := p.cache[sum]
+	p.mu.Unlock()
+	if !ok || now.After(answer.until) {
+		fresh, err := p.verify(token)
+		if err != nil {
+			if ok && answer.refused == "" && now.Before(answer.until.Add(apiKeyCacheTTL)) {
+				// Ride out a short sync server outage
+				return answer, nil
+			}
+			return apiKeyAnswer{}, fmt.Errorf("can't verify API key: %w", err)
+		}
+		answer = fresh
+		p.mu.Lock()
+		if len(p.cache) >= apiKeyCacheMax {
+			for k, a := range p.cache {
+				if now.After(a.until) {
+					delete(p.cache, k)
+				}
+			}
+		}
+		p.cache[sum] = answer
+		p.mu.Unlock()
+	}
+	if answer.refused != "" {
+		return apiKeyAnswer{}, errors.New(answer.refused)
+	}
+	if !answer.expires.IsZero() && now.After(answer.expires) {
+		return apiKeyAnswer{}, errors.New("API key has expired")
+	}
+	return answer, nil
+}
+
+func (p *APIKeyProvider) verify(token string) (apiKeyAnswer, error) {
+	body, _ := json.Marshal(map[string]string{"key": token})
+	resp, err := authHTTPClient.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return apiKeyAnswer{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		User      string `json:"user"`
+		ExpiresAt *int64 `json:"expiresAt"`
+		Error     string `json:"error"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusUnauthorized:
+	default:
+		return apiKeyAnswer{}, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return apiKeyAnswer{}, err
+	}
+	now := time.Now()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if result.Error == "" {
+			result.Error = "API key refused"
+		}
+		return apiKeyAnswer{refused: result.Error, until: now.Add(apiKeyRefusalTTL)}, nil
+	}
+	if result.User == "" {
+		return apiKeyAnswer{}, errors.New("sync server named no user for the key")
+	}
+	answer := apiKeyAnswer{user: result.User, until: now.Add(apiKeyCacheTTL)}
+	if result.ExpiresAt != nil {
+		answer.expires = time.UnixMilli(*result.ExpiresAt)
+		if answer.expires.Before(answer.until) {
+			answer.until = answer.expires
+		}
+	}
+	return answer, nil
+}
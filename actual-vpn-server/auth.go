@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is who a presented credential belongs to.
+type Identity struct {
+	Subject  string
+	Provider string
+	// Identifies the client the credential was issued to (e.g. a device),
+	// if the credential says; used to count concurrent sessions
+	Session string
+	// Zero if the credential doesn't expire
+	Expires time.Time
+
+	// Set for identities from a tenant's realm; see tenants.go
+	tenant *Tenant
+	// Checks that the credential is still good, for tunnels that outlive
+	// the handshake; nil if there's nothing to check
+	recheck func() error
+}
+
+// Recheck reports whether the credential the identity came from has since
+// been revoked, expired or suspended
+func (id *Identity) Recheck() error {
+	if id == nil || id.recheck == nil {
+		return nil
+	}
+	return id.recheck()
+}
+
+// credentialCheckInterval is how often open tunnels check that the
+// credential they were opened with is still good
+const credentialCheckInterval = 30 * time.Second
+
+// watchCredential closes the tunnel once its credential is revoked,
+// suspended or expired, until stop is closed
+func (t *Tunnel) watchCredential(stop <-chan struct{}) {
+	if t.id == nil || t.id.recheck == nil {
+		return
+	}
+	ticker := time.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+	// A credential that runs out between checks is cut off on the dot
+	var expired <-chan time.Time
+	if !t.id.Expires.IsZero() {
+		timer := time.NewTimer(time.Until(t.id.Expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-expired:
+			t.log.Warn("Credential expired", "expires", t.id.Expires)
+			t.closeLimited("credential expired")
+			return
+		case <-ticker.C:
+			if err := t.id.Recheck(); err != nil {
+				t.log.Warn("Credential no longer valid", "err", err)
+				t.closeLimited("credential revoked")
+				return
+			}
+		}
+	}
+}
+
+// errTokenNotRecognized is returned by a provider when a token isn't one of
+// its own, so the next provider in the chain gets a chance to check it.
+var errTokenNotRecognized = errors.New("token not recognized")
+
+type AuthProvider interface {
+	Name() string
+	Authenticate(token string) (*Identity, error)
+}
+
+// AuthChain asks each provider in turn. Any error other than
+// errTokenNotRecognized rejects the token outright, so a JWT with a bad
+// signature isn't given a second chance as a static token.
+type AuthChain struct {
+	mu        sync.RWMutex
+	providers []AuthProvider
+}
+
+func (c *AuthChain) Enabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.providers) > 0
+}
+
+// Replace swaps in the providers of another chain, for config reloads
+func (c *AuthChain) Replace(other *AuthChain) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.providers = other.providers
+}
+
+func (c *AuthChain) Authenticate(token string) (*Identity, error) {
+	if token == "" {
+		return nil, errors.New("no credentials presented")
+	}
+	c.mu.RLock()
+	providers := c.providers
+	c.mu.RUnlock()
+	for _, p := range providers {
+		id, err := p.Authenticate(token)
+		if errors.Is(err, errTokenNotRecognized) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+		if revokedDevices.UserRevoked(id.Subject) {
+			return nil, fmt.Errorf("%s: user %s has been suspended", p.Name(), id.Subject)
+		}
+		name, subject, expires, check := p.Name(), id.Subject, id.Expires, id.recheck
+		id.recheck = func() error {
+			if revokedDevices.UserRevoked(subject) {
+				return fmt.Errorf("%s: user %s has been suspended", name, subject)
+			}
+			if !expires.IsZero() && time.Now().After(expires) {
+				return fmt.Errorf("%s: credential expired at %s", name, expires.Format(time.RFC3339))
+			}
+			if check != nil {
+				if err := check(); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			return nil
+		}
+		return id, nil
+	}
+	return nil, errTokenNotRecognized
+}
+
+// AuthSettings configures the providers of a chain, from the environment
+// or a tenant's entry in TENANTS_FILE.
+type AuthSettings struct {
+	SessionTokenPublicKeys string `json:"sessionTokenPublicKeys"`
+	AuthTokens             string `json:"authTokens"`
+	AuthTokensFile         string `json:"authTokensFile"`
+	APIKeysURL             string `json:"apiKeysUrl"`
+	JWTJWKSURL             string `json:"jwtJwksUrl"`
+	JWTIssuer              string `json:"jwtIssuer"`
+	JWTAudience            string `json:"jwtAudience"`
+	OIDCIssuer             string `json:"oidcIssuer"`
+	OIDCAudience           string `json:"oidcAudience"`
+}
+
+// authChainFromEnv builds the provider chain from the environment. With
+// none configured, authentication is disabled.
+func authChainFromEnv(serverID string) (*AuthChain, error) {
+	return newAuthChain(AuthSettings{
+		SessionTokenPublicKeys: os.Getenv("SESSION_TOKEN_PUBLIC_KEYS"),
+		AuthTokens:             os.Getenv("AUTH_TOKENS"),
+		AuthTokensFile:         os.Getenv("AUTH_TOKENS_FILE"),
+		APIKeysURL:             os.Getenv("API_KEYS_URL"),
+		JWTJWKSURL:             os.Getenv("JWT_JWKS_URL"),
+		JWTIssuer:              os.Getenv("JWT_ISSUER"),
+		JWTAudience:            os.Getenv("JWT_AUDIENCE"),
+		OIDCIssuer:             os.Getenv("OIDC_ISSUER"),
+		OIDCAudience:           os.Getenv("OIDC_AUDIENCE"),
+	}, serverID)
+}
+
+// newAuthChain builds a provider chain. Providers are tried in the order
+// sync server session tokens, static tokens, the token file, sync server API
+// keys, JWT, OIDC.
+func newAuthChain(s AuthSettings, serverID string) (*AuthChain, error) {
+	chain := &AuthChain{}
+
+	if s.SessionTokenPublicKeys != "" {
+		p, err := newSessionTokenProvider(s.SessionTokenPublicKeys, serverID)
+		if err != nil {
+			return nil, err
+		}
+		chain.providers = append(chain.providers, p)
+	}
+
+	if s.AuthTokens != "" {
+		chain.providers = append(chain.providers, newStaticTokenProvider(s.AuthTokens))
+	}
+
+	if s.AuthTokensFile != "" {
+		p, err := newFileTokenProvider(s.AuthTokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_TOKENS_FILE: %w", err)
+		}
+		chain.providers = append(chain.providers, p)
+	}
+
+	if s.APIKeysURL != "" {
+		chain.providers = append(chain.providers, newAPIKeyProvider(s.APIKeysURL))
+	}
+
+	if s.JWTJWKSURL != "" {
+		chain.providers = append(chain.providers, newJWTProvider("jwt",
+			s.JWTIssuer, s.JWTAudience, staticJWKSURL(s.JWTJWKSURL)))
+	}
+
+	if s.OIDCIssuer != "" {
+		if s.OIDCAudience == "" {
+			return nil, errors.New("OIDC_AUDIENCE must be set with OIDC_ISSUER")
+		}
+		chain.providers = append(chain.providers, newJWTProvider("oidc",
+			s.OIDCIssuer, s.OIDCAudience, discoverJWKSURL(s.OIDCIssuer)))
+	}
+
+	return chain, nil
+}
+
+// bearerToken extracts the credential from a request. Browsers can't set
+// headers on a WebSocket handshake, so a "bearer.<token>" subprotocol is
+// accepted as well.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(h[len("Bearer "):])
+	}
+	for _, proto := range websocketSubprotocols(r) {
+		if strings.HasPrefix(proto, "bearer.") {
+			return proto[len("bearer."):]
+		}
+	}
+	return ""
+}
+
+func websocketSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, h := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+	return protocols
+}
+
+var authChain = &AuthChain{}
+
+// authenticate checks the request's credentials and answers 401 if they are
+// missing or invalid. It returns a nil identity and true when auth is
+// disabled.
+func authenticate(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	tenant := tenantFor(r.Host)
+	chain := tenant.authChain()
+	if !chain.Enabled() {
+		return nil, true
+	}
+
+	id, err := tenant.authenticate(chain, bearerToken(r))
+	if err != nil {
+		logFor(r).Warn("Rejected unauthenticated connection", "err", err)
+		authFailures.Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer realm="horsevpn"`)
+		refuse(w, http.StatusUnauthorized, noticeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	// A user over the monthly quota may not open anything; see ratelimit.go
+	if userUsage.Exceeded(id) {
+		withUser(logFor(r), id).Warn("Refusing tunnel", "err", errQuotaReached)
+		quotaRefusals.Inc()
+		refuse(w, http.StatusTooManyRequests, noticeQuota, "Monthly data quota exceeded")
+		return nil, false
+	}
+	return id, true
+}
+
+// StaticTokenProvider accepts a fixed list of tokens from AUTH_TOKENS, given
+// as "name:token" pairs (or bare tokens) separated by commas. Only hashes are
+// kept in memory.
+type StaticTokenProvider struct {
+	tokens map[[32]byte]string
+}
+
+func newStaticTokenProvider(spec string) *StaticTokenProvider {
+	p := &StaticTokenProvider{tokens: make(map[[32]byte]string)}
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name := fmt.Sprintf("token-%d", i+1)
+		if n, token, ok := strings.Cut(entry, ":"); ok {
+			name, entry = n, token
+		}
+		p.tokens[sha256.Sum256([]byte(entry))] = name
+	}
+	return p
+}
+
+func (p *StaticTokenProvider) Name() string {
+	return "static"
+}
+
+func (p *StaticTokenProvider) Authenticate(token string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	for known, name := range p.tokens {
+		if subtle.ConstantTimeCompare(sum[:], known[:]) == 1 {
+			return &Identity{Subject: name, Provider: p.Name()}, nil
+		}
+	}
+	return nil, errTokenNotRecognized
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expiringProvider accepts any token as alice's, good for ttl
+type expiringProvider struct{ ttl time.Duration }
+
+func (p expiringProvider) Name() string { return "expiring" }
+
+func (p expiringProvider) Authenticate(token string) (*Identity, error) {
+	return &Identity{Subject: "alice", Provider: p.Name(), Expires: time.Now().Add(p.ttl)}, nil
+}
+
+// A tunnel is closed when its credential expires, not at the next check
+func TestTunnelClosedAtCredentialExpiry(t *testing.T) {
+	saved := authChain
+	authChain = &AuthChain{providers: []AuthProvider{expiringProvider{ttl: 500 * time.Millisecond}}}
+	defer func() { authChain = saved }()
+	node := startTestNode(t)
+
+	h := http.Header{"Origin": {"http://localhost"}, "Authorization": {"Bearer anything"}}
+	d := websocket.Dialer{Subprotocols: []string{"vpn-protocol"}}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(node.http.URL, "http")+"/ws", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	opened := time.Now()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code != websocket.ClosePolicyViolation || closed.Text != "credential expired" {
+		t.Fatalf("tunnel ended with %v, want close 1008 credential expired", err)
+	}
+	if elapsed := time.Since(opened); elapsed >= credentialCheckInterval {
+		t.Errorf("tunnel closed after %v, waited for the periodic check", elapsed)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"horse-vpn-server/e2e"
+)
+
+// Window auto-tuning. A tunnel can't move more than one window per round
+// trip, so fixed buffers that are plenty on a 20ms path hold a 200ms one to
+// a few Mbps. Once a second each tunnel looks at its TCP connection's round
+// trip time and delivery rate (Linux only) and, while the data in flight
+// fills the socket buffers, doubles them, up to MAX_SOCKET_BUFFER_KB. The
+// buffer each copy loop reads into grows the same way, so fast tunnels
+// move data in fewer, larger messages. Buffers only grow: the kernel tunes
+// its own until we first set one. Poll sessions double their unacknowledged
+// data limit while acknowledgements are what holds the writer back.
+const (
+	copyBufferMin = 4 << 10
+	copyBufferMax = 64 << 10
+)
+
+var socketBufferMax = 16 << 20
+
+var windowResizes = registry.Counter("window_resizes_total", "Tunnel socket buffers and poll session windows grown to fit the path")
+
+func socketBufferMaxFromEnv() int {
+	if v := os.Getenv("MAX_SOCKET_BUFFER_KB"); v != "" {
+		kb, err := strconv.Atoi(v)
+		if err == nil && kb >= 0 && kb <= 1<<20 {
+			return kb << 10
+		}
+		slog.Warn("Ignoring invalid MAX_SOCKET_BUFFER_KB value", "value", v)
+	}
+	return 16 << 20
+}
+
+// pathStats is what the kernel knows about a TCP connection's path
+type pathStats struct {
+	minRTT time.Duration
+	// Recent delivery rate in bytes per second
+	rate float64
+	// Current socket buffer sizes
+	sndbuf, rcvbuf int
+}
+
+func (p pathStats) bdp() int {
+	return int(p.rate * p.minRTT.Seconds())
+}
+
+// netConnKey holds the connection a request arrived on; see withNetConn
+type netConnKey struct{}
+
+// withNetConn is an http.Server ConnContext that lets handlers find their
+// connection, for HTTP/2 streams whose tunnels tune its buffers
+func withNetConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, netConnKey{}, c)
+}
+
+func netConnFrom(r *http.Request) net.Conn {
+	c, _ := r.Context().Value(netConnKey{}).(net.Conn)
+	return c
+}
+
+// socketOf returns the network connection under a tunnel's Conn, if there
+// is a single one
+func socketOf(c Conn) net.Conn {
+	switch c := c.(type) {
+	case *WSConn:
+		return c.UnderlyingConn()
+	case *H2StreamConn:
+		return c.netConn
+	case *e2e.Conn:
+		if inner, ok := c.Inner().(Conn); ok {
+			return socketOf(inner)
+		}
+	case net.Conn:
+		return c
+	}
+	return nil
+}
+
+// tcpConnOf unwraps TLS to reach the TCP connection
+func tcpConnOf(c net.Conn) *net.TCPConn {
+	for c != nil {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// copyBuffer is the size copy loops read in, grown by tuneWindows
+type copyBuffer struct {
+	size atomic.Int64
+}
+
+func (b *copyBuffer) get() int {
+	if n := b.size.Load(); n > 0 {
+		return int(n)
+	}
+	return copyBufferMin
+}
+
+// tuneWindows grows the tunnel's socket and copy buffers to fit its path
+// until stop is closed
+func (t *Tunnel) tuneWindows(stop <-chan struct{}) {
+	if socketBufferMax == 0 {
+		return
+	}
+	tcp := tcpConnOf(socketOf(t.localConn))
+	if tcp == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	// Sizes asked for so far; the kernel caps them at net.core.wmem_max and
+	// rmem_max, and there is no point asking again
+	var sndAsked, rcvAsked int
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		stats, ok := readPathStats(tcp)
+		if !ok {
+			return
+		}
+		bdp := stats.bdp()
+
+		if copySize := min(copyBufferMax, max(copyBufferMin, bdp/16)); copySize > t.copyBuf.get() {
+			t.copyBuf.size.Store(int64(copySize))
+		}
+
+		// In flight data close to filling a buffer means the buffer is the
+		// limit, not the path
+		if bdp*2 > stats.sndbuf {
+			size := min(max(stats.sndbuf*2, bdp*2), socketBufferMax)
+			if size > sndAsked && tcp.SetWriteBuffer(size) == nil {
+				sndAsked = size
+				windowResizes.Inc()
+			}
+		}
+		if bdp*2 > stats.rcvbuf {
+			size := min(max(stats.rcvbuf*2, bdp*2), socketBufferMax)
+			if size > rcvAsked && tcp.SetReadBuffer(size) == nil {
+				rcvAsked = size
+				windowResizes.Inc()
+			}
+		}
+	}
+}
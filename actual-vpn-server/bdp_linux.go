@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPathStats asks the kernel for the connection's TCP_INFO and buffer
+// sizes
+func readPathStats(c *net.TCPConn) (pathStats, bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return pathStats{}, false
+	}
+	var stats pathStats
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		stats.minRTT = time.Duration(info.Min_rtt) * time.Microsecond
+		if stats.minRTT == 0 {
+			stats.minRTT = time.Duration(info.Rtt) * time.Microsecond
+		}
+		stats.rate = float64(info.Delivery_rate)
+		if stats.sndbuf, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+			sockErr = err
+			return
+		}
+		stats.rcvbuf, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	return stats, err == nil && sockErr == nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// readPathStats has nothing to go on outside Linux, so buffers keep the
+// kernel's sizes
+func readPathStats(c *net.TCPConn) (pathStats, bool) {
+	return pathStats{}, false
+}
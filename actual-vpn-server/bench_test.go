@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Throughput and latency of each transport through an in-process node. The
+// node echoes, so every byte crosses loopback twice; MB/s counts it once.
+//
+//   go test -run '^$' -bench . -benchmem
+//
+// Allocations are counted across client and node together and reported per
+// GB moved, which is the figure buffer pooling and similar changes should
+// bring down.
+
+var minThroughput = flag.Float64("min-throughput", 0, "MB/s each transport must reach in TestThroughput; 0 only checks the data")
+
+const (
+	throughputChunk = 32 * 1024
+	latencyPayload  = 64
+)
+
+func BenchmarkThroughput(b *testing.B) {
+	node := startTestNode(b)
+	for _, transport := range testTransports {
+		b.Run(transport.name, func(b *testing.B) {
+			conn := mustDial(b, node, transport)
+			defer conn.Close()
+
+			b.SetBytes(throughputChunk)
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			if err := echo(conn, b.N*throughputChunk, throughputChunk, false); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+
+			gb := float64(b.N) * throughputChunk / 1e9
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/gb, "allocs/GB")
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/gb, "B/GB")
+		})
+	}
+}
+
+// BenchmarkLatency times round trips of a small payload, one at a time
+func BenchmarkLatency(b *testing.B) {
+	node := startTestNode(b)
+	for _, transport := range testTransports {
+		b.Run(transport.name, func(b *testing.B) {
+			conn := mustDial(b, node, transport)
+			defer conn.Close()
+
+			buf := make([]byte, latencyPayload)
+			rtts := make([]time.Duration, 0, b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+				rtts = append(rtts, time.Since(start))
+			}
+			b.StopTimer()
+
+			slices.Sort(rtts)
+			b.ReportMetric(float64(rtts[len(rtts)/2].Microseconds()), "p50-µs")
+			b.ReportMetric(float64(rtts[len(rtts)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
+
+// TestThroughput checks that data comes back intact over every transport,
+// and with -min-throughput that it comes back fast enough:
+//
+//	go test -run TestThroughput -min-throughput 100
+func TestThroughput(t *testing.T) {
+	total := 64 << 20
+	if testing.Short() {
+		total = 4 << 20
+	}
+	node := startTestNode(t)
+	for _, transport := range testTransports {
+		t.Run(transport.name, func(t *testing.T) {
+			conn := mustDial(t, node, transport)
+			defer conn.Close()
+
+			start := time.Now()
+			if err := echo(conn, total, throughputChunk, true); err != nil {
+				t.Fatal(err)
+			}
+			mbps := float64(total) / 1e6 / time.Since(start).Seconds()
+			t.Logf("%.0f MB/s", mbps)
+			if mbps < *minThroughput {
+				t.Errorf("%.0f MB/s is below the %.0f MB/s floor", mbps, *minThroughput)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blocklist feeds: threat and abuse lists of addresses and domains that the
+// node refuses to relay to. BLOCKLIST_FEEDS names them as "name=url" pairs;
+// each is fetched at start and every BLOCKLIST_REFRESH_INTERVAL seconds
+// (default: 3600), conditionally when the feed sends an ETag or
+// Last-Modified. A feed that fails to fetch keeps its last good list, and
+// blocks nothing until its first fetch succeeds.
+//
+// Feeds are plain text, one entry per line: an address, a network in CIDR
+// notation, a domain, which blocks its subdomains too, or a hosts file line
+// such as "0.0.0.0 bad.example". Anything after # or ; is a comment and
+// lines starting with ! are skipped. Other lines, and networks wider than
+// /8 (/16 for IPv6) that would block half the internet over one bad line,
+// are counted as invalid and ignored.
+//
+// Addresses are checked in destinationAllowed, so they apply to every kind
+// of tunnel. Domains apply where the client names the destination: SOCKS
+// and X-Destination requests, hop chains and UDP datagrams.
+type Blocklists struct {
+	feeds []*blocklistFeed
+	// One refresh at a time, so a slow one can't replace a newer list
+	refreshMu sync.Mutex
+}
+
+type blocklistFeed struct {
+	name, url string
+	list      atomic.Pointer[blocklist]
+
+	mu                 sync.Mutex
+	etag, lastModified string
+	updated            time.Time
+	lastErr            error
+
+	entries, hits, failures, updatedAt *Metric
+}
+
+// blocklist is one fetch of a feed; it never changes once parsed
+type blocklist struct {
+	// Networks by prefix length, single addresses being /32 or /128, and the
+	// lengths there are, longest first
+	prefixes map[int]map[netip.Prefix]struct{}
+	lengths  []int
+	domains  map[string]struct{}
+}
+
+const maxBlocklistSize = 64 << 20
+
+var errBlocklisted = errors.New("destination blocklisted")
+
+// Feeds can be large and slow to serve
+var blocklistHTTPClient = &http.Client{Timeout: time.Minute}
+
+// Names hosts files map to themselves, which aren't entries
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true,
+}
+
+// blocklists is nil unless BLOCKLIST_FEEDS is set
+var blocklists *Blocklists
+
+func blocklistsFromEnv() (*Blocklists, error) {
+	return feedsFromEnv("BLOCKLIST_FEEDS", nil)
+}
+
+// feedsFromEnv reads the name=url pairs in variable, or returns nil if it
+// isn't set. The names label the same metrics as those in taken, so they
+// must differ from them.
+func feedsFromEnv(variable string, taken *Blocklists) (*Blocklists, error) {
+	v := os.Getenv(variable)
+	if v == "" {
+		return nil, nil
+	}
+	b := &Blocklists{}
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(v, ",") {
+		name, feedURL, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		u, err := url.Parse(feedURL)
+		if !ok || name == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s entry %q", variable, pair)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s names %q twice", variable, name)
+		}
+		if taken.has(name) {
+			return nil, fmt.Errorf("%s names %q, which BLOCKLIST_FEEDS already does", variable, name)
+		}
+		seen[name] = true
+		b.feeds = append(b.feeds, newBlocklistFeed(name, feedURL))
+	}
+	return b, nil
+}
+
+func (b *Blocklists) has(name string) bool {
+	if b == nil {
+		return false
+	}
+	for _, f := range b.feeds {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func blocklistRefreshIntervalFromEnv() time.Duration {
+	if v := os.Getenv("BLOCKLIST_REFRESH_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid BLOCKLIST_REFRESH_INTERVAL value", "value", v)
+	}
+	return time.Hour
+}
+
+func newBlocklistFeed(name, feedURL string) *blocklistFeed {
+	f := &blocklistFeed{
+		name:      name,
+		url:       feedURL,
+		entries:   registry.GaugeWith("blocklist_entries", "Addresses, networks and domains in each blocklist feed", "feed", name),
+		hits:      registry.CounterWith("blocklist_hits_total", "Destinations refused because a blocklist feed lists them", "feed", name),
+		failures:  registry.CounterWith("blocklist_refresh_failures_total", "Blocklist feed fetches that failed", "feed", name),
+		updatedAt: registry.GaugeWith("blocklist_updated_timestamp_seconds", "When each blocklist feed was last fetched successfully", "feed", name),
+	}
+	f.list.Store(&blocklist{})
+	return f
+}
+
+// ipBlockedBy returns the name of the first feed listing ip, counting the
+// hit, or "" if none does
+func (b *Blocklists) ipBlockedBy(ip net.IP) string {
+	if b == nil {
+		return ""
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	addr = addr.Unmap()
+	for _, f := range b.feeds {
+		if f.list.Load().hasAddr(addr) {
+			f.hits.Inc()
+			return f.name
+		}
+	}
+	return ""
+}
+
+// hostBlockedBy is ipBlockedBy for a name the client gave; addresses are
+// left to destinationAllowed
+func (b *Blocklists) hostBlockedBy(host string) string {
+	if b == nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	for _, f := range b.feeds {
+		if f.list.Load().hasDomain(host) {
+			f.hits.Inc()
+			return f.name
+		}
+	}
+	return ""
+}
+
+func (l *blocklist) hasAddr(addr netip.Addr) bool {
+	for _, bits := range l.lengths {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if _, ok := l.prefixes[bits][p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDomain reports whether the list has host or a domain above it
+func (l *blocklist) hasDomain(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for {
+		if _, ok := l.domains[host]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return false
+		}
+		host = parent
+	}
+}
+
+func (l *blocklist) size() int {
+	n := len(l.domains)
+	for _, prefixes := range l.prefixes {
+		n += len(prefixes)
+	}
+	return n
+}
+
+// parseBlocklist reads a feed, returning its entries and how many it
+// ignored as invalid
+func parseBlocklist(r io.Reader) (*blocklist, int, error) {
+	l := &blocklist{prefixes: make(map[int]map[netip.Prefix]struct{}), domains: make(map[string]struct{})}
+	invalid := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+		entries := fields[:1]
+		if _, err := netip.ParseAddr(fields[0]); err == nil && len(fields) > 1 {
+			// A hosts file line; the address is where the names are sent
+			entries = fields[1:]
+		}
+		for _, entry := range entries {
+			if !l.add(entry) {
+				invalid++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	for bits := range l.prefixes {
+		l.lengths = append(l.lengths, bits)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(l.lengths)))
+	return l, invalid, nil
+}
+
+func (l *blocklist) add(entry string) bool {
+	var prefix netip.Prefix
+	if p, err := netip.ParsePrefix(entry); err == nil {
+		prefix = p.Masked()
+		if p.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96).Masked()
+		}
+	} else if addr, err := netip.ParseAddr(entry); err == nil && addr.Zone() == "" {
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else {
+		return l.addDomain(entry)
+	}
+	if !prefix.IsValid() || (prefix.Addr().Is4() && prefix.Bits() < 8) || (prefix.Addr().Is6() && prefix.Bits() < 16) {
+		return false
+	}
+	if l.prefixes[prefix.Bits()] == nil {
+		l.prefixes[prefix.Bits()] = make(map[netip.Prefix]struct{})
+	}
+	l.prefixes[prefix.Bits()][prefix] = struct{}{}
+	return true
+}
+
+func (l *blocklist) addDomain(entry string) bool {
+	domain := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(entry), "*."), ".")
+	if hostsFileNames[domain] {
+		return true
+	}
+	// At least two labels, so one bad line can't block a whole TLD
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	l.domains[domain] = struct{}{}
+	return true
+}
+
+// diffBlocklists counts the entries next has that prev didn't, and those it
+// dropped
+func diffBlocklists(prev, next *blocklist) (added, removed int) {
+	missing := func(from, in *blocklist) int {
+		n := 0
+		for bits, prefixes := range from.prefixes {
+			for p := range prefixes {
+				if _, ok := in.prefixes[bits][p]; !ok {
+					n++
+				}
+			}
+		}
+		for d := range from.domains {
+			if _, ok := in.domains[d]; !ok {
+				n++
+			}
+		}
+		return n
+	}
+	return missing(next, prev), missing(prev, next)
+}
+
+// refresh fetches the feed, replacing its list only with a complete new one
+func (f *blocklistFeed) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	f.mu.Unlock()
+	resp, err := blocklistHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		f.fetched(resp)
+		return nil
+	default:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlocklistSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxBlocklistSize {
+		return fmt.Errorf("larger than %d MiB", maxBlocklistSize>>20)
+	}
+	next, invalid, err := parseBlocklist(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	prev := f.list.Swap(next)
+	f.entries.Set(int64(next.size()))
+	f.fetched(resp)
+	if added, removed := diffBlocklists(prev, next); added > 0 || removed > 0 {
+		slog.Info("Updated blocklist feed", "feed", f.name, "entries", next.size(), "added", added, "removed", removed, "invalid", invalid)
+	}
+	return nil
+}
+
+// fetched notes a successful fetch and the validators for the next one
+func (f *blocklistFeed) fetched(resp *http.Response) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if resp.StatusCode == http.StatusOK {
+		f.etag, f.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	}
+	f.updated, f.lastErr = now, nil
+	f.updatedAt.Set(now.Unix())
+}
+
+// Refresh fetches every feed once. Feeds that fail keep their lists; the
+// error names each of them.
+func (b *Blocklists) Refresh() error {
+	b.refreshMu.Lock()
+	defer b.refreshMu.Unlock()
+	var errs []error
+	for _, f := range b.feeds {
+		if err := f.refresh(); err != nil {
+			f.failures.Inc()
+			f.mu.Lock()
+			f.lastErr = err
+			f.mu.Unlock()
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Poll refreshes the feeds forever
+func (b *Blocklists) Poll(interval time.Duration) {
+	for {
+		if err := b.Refresh(); err != nil {
+			slog.Warn("Failed to refresh blocklist feeds", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+type blocklistFeedView struct {
+	Name    string     `json:"name"`
+	URL     string     `json:"url"`
+	Entries int64      `json:"entries"`
+	Hits    int64      `json:"hits"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func (b *Blocklists) view() []blocklistFeedView {
+	if b == nil {
+		return []blocklistFeedView{}
+	}
+	views := make([]blocklistFeedView, 0, len(b.feeds))
+	for _, f := range b.feeds {
+		v := blocklistFeedView{Name: f.name, URL: f.url, Entries: f.entries.Value(), Hits: f.hits.Value()}
+		f.mu.Lock()
+		if !f.updated.IsZero() {
+			updated := f.updated
+			v.Updated = &updated
+		}
+		if f.lastErr != nil {
+			v.Error = f.lastErr.Error()
+		}
+		f.mu.Unlock()
+		views = append(views, v)
+	}
+	return views
+}
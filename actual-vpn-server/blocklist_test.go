@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Blocklist feeds come in several plain text dialects; every entry they
+// name must block, and nothing else.
+
+const testFeed = `# Addresses and networks
+198.51.100.7
+203.0.113.0/24 ; SBL123
+2001:db8:bad::/48
+::ffff:192.0.2.128/121
+! adblock style comment
+bad.example
+*.wild.example.
+0.0.0.0 tracker.example ads.example
+127.0.0.1 localhost
+0.0.0.0/0
+10.0.0.0/7
+||not-a-domain^
+com
+`
+
+func TestParseBlocklist(t *testing.T) {
+	l, invalid, err := parseBlocklist(strings.NewReader(testFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0.0.0.0/0, 10.0.0.0/7, the adblock rule and the bare TLD
+	if invalid != 4 {
+		t.Errorf("%d invalid entries, want 4", invalid)
+	}
+	if l.size() != 8 {
+		t.Errorf("%d entries, want 8", l.size())
+	}
+
+	b := &Blocklists{feeds: []*blocklistFeed{newBlocklistFeed("test", "https://feeds.example/test")}}
+	b.feeds[0].list.Store(l)
+	for ip, blocked := range map[string]bool{
+		"198.51.100.7":       true,
+		"198.51.100.8":       false,
+		"203.0.113.200":      true,
+		"::ffff:203.0.113.1": true,
+		"2001:db8:bad:1::1":  true,
+		"2001:db8:bade::1":   false,
+		"192.0.2.130":        true,
+		"192.0.2.1":          false,
+		"10.1.2.3":           false,
+	} {
+		if got := b.ipBlockedBy(net.ParseIP(ip)) != ""; got != blocked {
+			t.Errorf("%s blocked = %v, want %v", ip, got, blocked)
+		}
+	}
+	for host, blocked := range map[string]bool{
+		"bad.example":      true,
+		"www.BAD.example.": true,
+		"notbad.example":   false,
+		"wild.example":     true,
+		"a.b.wild.example": true,
+		"ads.example":      true,
+		"localhost":        false,
+		"example":          false,
+		"198.51.100.7":     false,
+	} {
+		if got := b.hostBlockedBy(host) != ""; got != blocked {
+			t.Errorf("%s blocked = %v, want %v", host, got, blocked)
+		}
+	}
+	if hits := b.feeds[0].hits.Value(); hits != 10 {
+		t.Errorf("%d hits, want 10", hits)
+	}
+}
+
+func TestBlocklistRefresh(t *testing.T) {
+	feed := "198.51.100.7\nbad.example\n"
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		etag := `"` + strconv.Itoa(len(feed)) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+
+	b := &Blocklists{feeds: []*blocklistFeed{newBlocklistFeed("test", srv.URL)}}
+	f := b.feeds[0]
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	first := f.list.Load()
+	if first.size() != 2 {
+		t.Fatalf("%d entries, want 2", first.size())
+	}
+
+	// Unchanged: the same list stays
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if f.list.Load() != first || fetches != 2 {
+		t.Errorf("list replaced on 304, or the feed wasn't asked (%d fetches)", fetches)
+	}
+
+	feed = "198.51.100.7\nworse.example\n203.0.113.0/24\n"
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if added, removed := diffBlocklists(first, f.list.Load()); added != 2 || removed != 1 {
+		t.Errorf("diff added %d and removed %d, want 2 and 1", added, removed)
+	}
+	if f.entries.Value() != 3 {
+		t.Errorf("entries gauge %d, want 3", f.entries.Value())
+	}
+
+	// A failed fetch keeps the last good list
+	srv.Close()
+	last := f.list.Load()
+	if err := b.Refresh(); err == nil {
+		t.Fatal("refresh from a closed server succeeded")
+	}
+	if f.list.Load() != last || f.failures.Value() != 1 || b.view()[0].Error == "" {
+		t.Error("failed refresh replaced the list or went unrecorded")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// First-boot bootstrap: a freshly provisioned node started with JOIN_TOKEN
+// trades it with the sync server for its server ID, location, tags, a
+// long-term node token and the session token public key, and saves them to
+// NODE_STATE_FILE. Later boots read the file and don't need the (single-use)
+// join token any more.
+type NodeState struct {
+	ServerID              string   `json:"serverId"`
+	Location              string   `json:"location"`
+	Tags                  []string `json:"tags"`
+	NodeToken             string   `json:"nodeToken"`
+	SessionTokenPublicKey string   `json:"sessionTokenPublicKey"`
+}
+
+// nodeToken proves which node this is to the sync server: PRIVATE_NODE_TOKEN
+// for self-hosted private nodes, or the token from bootstrap. Set in main.
+var nodeToken string
+
+func nodeStateFile() string {
+	if v := os.Getenv("NODE_STATE_FILE"); v != "" {
+		return v
+	}
+	return "./node-state.json"
+}
+
+// bootstrapNode returns the node's saved state, bootstrapping first if
+// there is none and JOIN_TOKEN is set. It returns nil if neither applies.
+func bootstrapNode(syncServerURL string) (*NodeState, error) {
+	path := nodeStateFile()
+	if data, err := os.ReadFile(path); err == nil {
+		var state NodeState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		return &state, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	joinToken := os.Getenv("JOIN_TOKEN")
+	if joinToken == "" {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"token": joinToken})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(syncServerURL+"/bootstrap", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("bootstrap failed with status %d: %s", resp.StatusCode, e.Error)
+	}
+	var state NodeState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// The join token is spent, so losing this file means enrolling again
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("saving node state: %w", err)
+	}
+	slog.Info("Bootstrapped", "server_id", state.ServerID, "location", state.Location, "path", path)
+	return &state, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Soak mode: clients open tunnels over every transport for a while, moving
+// random amounts of data, through connections that add delays, cut out
+// partway or inject garbage towards the node. It checks that
+//
+//   - tunnels that were only delayed deliver their data intact
+//   - tampering on TLS transports ends the connection, never shows up as data
+//   - a client can always reconnect after its connection was cut
+//   - the node ends up with no tunnels, slots or goroutines left over
+//
+// Without -soak it runs briefly as part of go test; for a real soak:
+//
+//   go test -run TestSoak -soak 30m
+
+var soakDuration = flag.Duration("soak", 0, "how long TestSoak runs; 0 runs a short pass")
+
+const (
+	soakWorkersPerTransport = 4
+	soakAttemptTimeout      = 15 * time.Second
+	soakMaxDelay            = 5 * time.Millisecond
+)
+
+type chaosFate int
+
+const (
+	fateDelay chaosFate = iota
+	fateDisconnect
+	fateCorrupt
+)
+
+func (f chaosFate) String() string {
+	return [...]string{"delay", "disconnect", "corrupt"}[f]
+}
+
+var errChaosDisconnect = errors.New("chaos: connection cut")
+
+// chaosConn is the client's TCP connection to the node. Reads and writes are
+// sometimes delayed; once strikeAt bytes have been written it either cuts
+// the connection or writes a burst of garbage and carries on.
+type chaosConn struct {
+	net.Conn
+	fate     chaosFate
+	strikeAt int
+
+	// Guards rng only: holding it across a blocked write would stall reads
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	writeMu sync.Mutex
+	written int
+	struck  bool
+}
+
+func (c *chaosConn) random(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Intn(n)
+}
+
+func (c *chaosConn) delay() {
+	if c.random(10) == 0 {
+		time.Sleep(time.Duration(c.random(int(soakMaxDelay))))
+	}
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	c.delay()
+	return c.Conn.Read(b)
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	c.delay()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.fate == fateDelay || c.struck || c.written+len(b) <= c.strikeAt {
+		n, err := c.Conn.Write(b)
+		c.written += n
+		return n, err
+	}
+
+	before := c.strikeAt - c.written
+	n, err := c.Conn.Write(b[:before])
+	c.written += n
+	if err != nil {
+		return n, err
+	}
+	c.struck = true
+	if c.fate == fateDisconnect {
+		c.Conn.Close()
+		return n, errChaosDisconnect
+	}
+	garbage := make([]byte, 1+c.random(64))
+	for i := range garbage {
+		garbage[i] = byte(c.random(256))
+	}
+	if _, err := c.Conn.Write(garbage); err != nil {
+		return n, err
+	}
+	m, err := c.Conn.Write(b[before:])
+	c.written += m
+	return n + m, err
+}
+
+type soakStats struct {
+	mu                                    sync.Mutex
+	attempts, failures, reconnects, bytes int
+	byFate                                [3]int
+}
+
+func TestSoak(t *testing.T) {
+	duration := *soakDuration
+	if duration == 0 {
+		if testing.Short() {
+			t.Skip("skipping soak in short mode")
+		}
+		duration = 2 * time.Second
+	}
+
+	node := startTestNode(t)
+	// Count goroutines once the node's listeners are all running
+	for _, transport := range testTransports {
+		conn := mustDial(t, node, transport)
+		if err := echo(conn, 1024, 1024, true); err != nil {
+			t.Fatalf("%s: %v", transport.name, err)
+		}
+		conn.Close()
+	}
+	waitFor(func() bool { return tunnelsActive.Value() == 0 })
+	baseline := runtime.NumGoroutine()
+	deadline := time.Now().Add(duration)
+
+	var stats soakStats
+	var wg sync.WaitGroup
+	for _, transport := range testTransports {
+		for i := 0; i < soakWorkersPerTransport; i++ {
+			wg.Add(1)
+			go func(transport testTransport, seed int64) {
+				defer wg.Done()
+				soakWorker(t, node, transport, deadline, rand.New(rand.NewSource(seed)), &stats)
+			}(transport, time.Now().UnixNano()+int64(i))
+		}
+	}
+	wg.Wait()
+
+	t.Logf("%d attempts (%d delayed, %d cut, %d corrupted), %d failed, %d reconnects, %d MB echoed",
+		stats.attempts, stats.byFate[fateDelay], stats.byFate[fateDisconnect], stats.byFate[fateCorrupt],
+		stats.failures, stats.reconnects, stats.bytes>>20)
+
+	// The node notices closed clients on its next read, so give it a moment
+	if waitFor(func() bool {
+		return tunnelsActive.Value() == 0 && shedder.active.Load() == 0 && runtime.NumGoroutine() <= baseline
+	}) {
+		return
+	}
+	if n := tunnelsActive.Value(); n != 0 {
+		t.Errorf("%d tunnels still counted as active", n)
+	}
+	if n := shedder.active.Load(); n != 0 {
+		t.Errorf("%d load shedder slots still held", n)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		var stacks bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+		t.Errorf("%d goroutines running, %d before the soak:\n%s", n, baseline, stacks.String())
+	}
+}
+
+// waitFor polls cond for up to 10 seconds and reports whether it came true
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return cond()
+}
+
+func soakWorker(t *testing.T, node *testNode, transport testTransport, deadline time.Time, rng *rand.Rand, stats *soakStats) {
+	lastFailed := false
+	for time.Now().Before(deadline) {
+		total := 1 + rng.Intn(256<<10)
+		fate := fateDelay
+		switch r := rng.Intn(10); {
+		case r < 2:
+			fate = fateDisconnect
+		case r < 4:
+			fate = fateCorrupt
+		}
+		// Strike anywhere from the handshake to the end of the data
+		strikeAt := rng.Intn(total + 1024)
+
+		var mu sync.Mutex
+		var conns []*chaosConn
+		dial := func(network, addr string) (net.Conn, error) {
+			raw, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			c := &chaosConn{Conn: raw, fate: fate, strikeAt: strikeAt, rng: rand.New(rand.NewSource(rng.Int63()))}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			return c, nil
+		}
+		// Nothing may hang, whatever was done to the connection
+		timedOut := false
+		timer := time.AfterFunc(soakAttemptTimeout, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			timedOut = true
+			for _, c := range conns {
+				c.Conn.Close()
+			}
+		})
+
+		err := func() error {
+			conn, err := transport.dial(node, dial)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			return echo(conn, total, 1+rng.Intn(throughputChunk), true)
+		}()
+		timer.Stop()
+
+		mu.Lock()
+		hung := timedOut
+		mu.Unlock()
+		name := fmt.Sprintf("%s %s attempt (%d bytes, strike at %d)", transport.name, fate, total, strikeAt)
+		switch {
+		case hung:
+			t.Errorf("%s hung: %v", name, err)
+		case err != nil && fate == fateDelay:
+			if lastFailed {
+				t.Errorf("%s failed to reconnect: %v", name, err)
+			} else {
+				t.Errorf("%s failed: %v", name, err)
+			}
+		case errors.Is(err, errEchoMismatch) && transport.authenticated:
+			t.Errorf("%s delivered tampered data", name)
+		}
+
+		stats.mu.Lock()
+		stats.attempts++
+		stats.byFate[fate]++
+		if err != nil {
+			stats.failures++
+		} else {
+			stats.bytes += total
+			if lastFailed {
+				stats.reconnects++
+			}
+		}
+		stats.mu.Unlock()
+		lastFailed = err != nil
+	}
+}
@@ -0,0 +1,15 @@
+package client
+
+const announcementsHeader = "X-Tunnel-Announcements"
+
+// Announcement is a message of the day or incident banner the node's
+// operator has set, sent to clients that set Config.OnAnnouncement.
+type Announcement struct {
+	// Empty when the operator took the announcement down
+	Message string `json:"message"`
+	// info, maintenance or incident
+	Severity string `json:"severity"`
+	// Milliseconds since the epoch; ExpiresAt is 0 without an expiry
+	UpdatedAt int64 `json:"updatedAt"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
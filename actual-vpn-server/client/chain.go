@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"horse-vpn-server/e2e"
+)
+
+// Hop is one node of a chain; see Config.Chain
+type Hop struct {
+	// The node's WebSocket endpoint, e.g. wss://node.example.com/ws
+	URL string
+	// Token is the bearer token for this node, if it requires one. The hop
+	// before it sees it, since it opens the tunnel to this one.
+	Token string
+	// ServerKey is the node's end-to-end encryption key in base64, as the
+	// sync server lists it in e2eKey
+	ServerKey string
+}
+
+// Chains have at least two hops, or there is nothing to hide, and at most
+// maxChainHops, since each one adds its round trips and latency
+const maxChainHops = 3
+
+// The node's request header and instruction framing; see hopchain.go in the
+// node
+const (
+	chainHeader  = "X-Tunnel-Chain"
+	chainVersion = "1"
+)
+
+var errChainTCPOnly = errors.New("client: chains only carry connections from Dial")
+
+type hopInstruction struct {
+	Next  string `json:"next,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+func parseChain(hops []Hop) ([]*ecdh.PublicKey, error) {
+	if len(hops) < 2 || len(hops) > maxChainHops {
+		return nil, fmt.Errorf("client: a chain has 2 to %d hops, not %d", maxChainHops, len(hops))
+	}
+	keys := make([]*ecdh.PublicKey, len(hops))
+	for i, hop := range hops {
+		if hop.URL == "" || hop.ServerKey == "" {
+			return nil, fmt.Errorf("client: hop %d needs URL and ServerKey", i+1)
+		}
+		key, err := e2e.ParsePublicKey(hop.ServerKey)
+		if err != nil {
+			return nil, fmt.Errorf("client: hop %d: %w", i+1, err)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// dialChain opens a tunnel through every hop of the chain. Each hop's
+// encryption runs inside the previous one's, so a hop can only read its own
+// instruction.
+func (c *Client) dialChain(ctx context.Context, remote net.Addr) (*Conn, error) {
+	first := c.config.Chain[0]
+	header := http.Header{}
+	header.Set(e2e.Header, e2e.Version)
+	header.Set(chainHeader, chainVersion)
+	if first.Token != "" {
+		header.Set("Authorization", "Bearer "+first.Token)
+	}
+	ws, resp, err := c.dialWebSocketHeader(ctx, first.URL, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get(e2e.Header) != e2e.Version {
+		ws.Close()
+		return nil, errors.New("connecting to node: node does not support end-to-end encryption")
+	}
+	conn := &Conn{ws: ws, remote: remote}
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	sealed, err := c.openHops(conn)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	conn.sealed = sealed
+	return conn, nil
+}
+
+func (c *Client) openHops(conn *Conn) (*e2e.Conn, error) {
+	hops := c.config.Chain
+	var stream io.ReadWriteCloser = wsStream{conn}
+	var sealed *e2e.Conn
+	for i := range hops {
+		var err error
+		// Relays don't pass on cipher choices, so hops keep to the default
+		if sealed, err = e2e.Client(stream, c.chainKeys[i], e2e.ChaCha20Poly1305); err != nil {
+			return nil, fmt.Errorf("hop %d: end-to-end encryption handshake: %w", i+1, err)
+		}
+		var hop hopInstruction
+		if i+1 < len(hops) {
+			hop = hopInstruction{Next: hops[i+1].URL, Token: hops[i+1].Token}
+		}
+		data, _ := json.Marshal(hop)
+		if _, err := sealed.Write(binary.BigEndian.AppendUint16(nil, uint16(len(data)))); err != nil {
+			return nil, err
+		}
+		if _, err := sealed.Write(data); err != nil {
+			return nil, err
+		}
+		var reply [1]byte
+		if _, err := io.ReadFull(sealed, reply[:]); err != nil {
+			return nil, fmt.Errorf("hop %d: %w", i+1, err)
+		}
+		if reply[0] != socksSucceeded {
+			msg, ok := socksReplies[reply[0]]
+			if !ok {
+				msg = fmt.Sprintf("reply %d", reply[0])
+			}
+			return nil, fmt.Errorf("hop %d can't relay to hop %d: %s", i+1, i+2, msg)
+		}
+		stream = sealed
+	}
+	return sealed, nil
+}
@@ -0,0 +1,594 @@
+// Package client opens connections through a HorseVPN node from Go
+// programs, without a local SOCKS listener:
+//
+//	c, err := client.New(client.Config{Location: "Netherlands", Token: token})
+//	...
+//	httpClient := &http.Client{Transport: &http.Transport{DialContext: c.DialContext}}
+//
+// Each connection is its own WebSocket tunnel to the node, carrying a SOCKS5
+// CONNECT to the destination just as the desktop client's tunnels carry the
+// conversation of the application using its proxy. With Config.Multiplex
+// set, connections are instead streams in one long-lived tunnel (see
+// package mux), which saves a handshake per connection; when that tunnel's
+// connection breaks, the client reconnects and the node resumes it, so the
+// connections in it carry on. With Config.ServerKey set, the tunnels are encrypted end to end (see package
+// e2e), so proxies in front of the node see only ciphertext. A quic:// URL,
+// or Config.QUIC with a lookup, makes connections QUIC streams instead,
+// falling back to WebSocket where UDP is blocked.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+
+	"horse-vpn-server/e2e"
+	"horse-vpn-server/mux"
+)
+
+// DefaultRoutingURL picks a node for a location
+const DefaultRoutingURL = "https://horse.0x409.nl/route"
+
+// How long a shared tunnel that lost its connection keeps trying to resume,
+// as long as nodes keep one by default, and how long it waits at most
+// between attempts
+const (
+	resumeTimeout    = 30 * time.Second
+	maxResumeBackoff = 5 * time.Second
+)
+
+var errTunnelGone = errors.New("node no longer has the tunnel")
+
+// Config says which node to use and how to authenticate to it.
+type Config struct {
+	// URL is the node's WebSocket endpoint, e.g. wss://node.example.com/ws,
+	// or its QUIC endpoint, e.g. quic://node.example.com:443, which falls
+	// back to WebSocket at wss://node.example.com/ws when UDP doesn't get
+	// through. If empty, a node is looked up for Location at RoutingURL.
+	// That may be the routing server, which answers with one node, or the
+	// sync server's /route, which also lists fallbacks; when a node fails,
+	// the client moves on to the next one before looking up again.
+	URL        string
+	Location   string
+	RoutingURL string
+	// QUIC connects over QUIC to the nodes a lookup finds when the sync
+	// server lists a quic:// endpoint for them. Every connection is a
+	// stream in one QUIC connection per node, so a lost packet only holds
+	// up its own connection. When a node can't be reached over UDP, the
+	// client uses its WebSocket for the next 10 minutes.
+	QUIC bool
+
+	// Token is sent as a bearer token, for nodes that require one
+	Token string
+	// Origin must be one the node allows (default
+	// https://horsevpn-client.localhost)
+	Origin string
+	// ServerKey is the node's end-to-end encryption key in base64, as the
+	// sync server lists it in e2eKey. If set, every tunnel is encrypted
+	// between this client and the node that holds the key. It needs URL,
+	// since the key belongs to one node.
+	ServerKey string
+	// Cipher is the end-to-end encryption cipher to ask for first; the node
+	// has the last word. Empty picks the faster on this machine.
+	Cipher e2e.Cipher
+	// Multiplex opens every connection as a stream in one shared tunnel to
+	// the node instead of a tunnel of its own. The node must support it.
+	// If the tunnel's connection breaks, the client reconnects with
+	// exponential backoff and, if the node supports it, resumes the tunnel
+	// with its connections intact; otherwise they fail and the next dial
+	// opens a new tunnel.
+	Multiplex bool
+	// Logger reports the shared tunnel losing its connection and
+	// reconnecting; nil logs nothing
+	Logger *log.Logger
+	// TLSConfig for wss:// URLs; nil uses the system roots
+	TLSConfig *tls.Config
+	// HTTPClient for the route lookup; nil uses http.DefaultClient
+	HTTPClient *http.Client
+	// Chain bounces every connection through two or three nodes in order,
+	// instead of the one URL or Location picks. The first hop sees who the
+	// client is but not where the connection goes, and the last the other
+	// way round. Every hop needs its ServerKey, and all but the last must
+	// relay with CHAIN_RELAY. It can't be combined with Multiplex, and
+	// ListenPacket and OpenPacketTunnel refuse a client with a chain rather
+	// than go around it.
+	Chain []Hop
+	// OnStats, if set, gets each tunnel's statistics from the node every 5
+	// seconds, for showing live numbers. It is called from the goroutine
+	// reading the tunnel and must not block. Tunnels through a Chain don't
+	// get them.
+	OnStats func(Stats)
+	// OnAnnouncement, if set, gets the operator's announcement when a tunnel
+	// comes up and each change to it while the tunnel lasts, for showing a
+	// maintenance or incident banner. Every tunnel passes it on, so the same
+	// one can arrive more than once. Like OnStats it must not block, and
+	// tunnels through a Chain don't get them.
+	OnAnnouncement func(Announcement)
+}
+
+// Client dials connections through one node. It is safe for concurrent use.
+type Client struct {
+	config    Config
+	serverKey *ecdh.PublicKey
+	chainKeys []*ecdh.PublicKey
+
+	mu    sync.Mutex
+	route string
+	// Candidates from the last lookup to try after route, in order
+	fallbacks []string
+
+	// The shared tunnel with Multiplex, and the route it goes to. muxMu is
+	// held while dialing it, so concurrent dials wait for one tunnel.
+	muxMu        sync.Mutex
+	session      *mux.Session
+	sessionRoute string
+	sessionLocal net.Addr
+
+	// QUIC connections by their quic:// URL; see quic.go. quicMu is held
+	// while connecting, like muxMu.
+	quicMu      sync.Mutex
+	quicURLs    map[string]string
+	quicBlocked map[string]time.Time
+	quicConns   map[string]quic.Connection
+}
+
+func New(config Config) (*Client, error) {
+	if len(config.Chain) > 0 {
+		// Route and its callers only see the first hop
+		config.URL, config.Location = config.Chain[0].URL, ""
+	}
+	if config.URL == "" && config.Location == "" {
+		return nil, errors.New("client: set URL or Location")
+	}
+	if config.RoutingURL == "" {
+		config.RoutingURL = DefaultRoutingURL
+	}
+	if config.Origin == "" {
+		config.Origin = "https://horsevpn-client.localhost"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	c := &Client{
+		config:      config,
+		quicURLs:    make(map[string]string),
+		quicBlocked: make(map[string]time.Time),
+		quicConns:   make(map[string]quic.Connection),
+	}
+	if strings.HasPrefix(config.URL, "quic://") {
+		if config.ServerKey != "" {
+			// QUIC's TLS ends at the node itself, but the key isn't checked
+			return nil, errors.New("client: ServerKey can't be combined with a quic:// URL")
+		}
+		fallback, err := quicFallback(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		c.quicURLs[fallback] = config.URL
+		c.config.URL = fallback
+	}
+	c.route = c.config.URL
+	if config.ServerKey != "" {
+		if config.URL == "" {
+			return nil, errors.New("client: ServerKey needs URL")
+		}
+		key, err := e2e.ParsePublicKey(config.ServerKey)
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+		c.serverKey = key
+	}
+	if config.Cipher != "" {
+		if _, err := e2e.ParseCipher(string(config.Cipher)); err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+	if len(config.Chain) > 0 {
+		if config.Multiplex {
+			return nil, errors.New("client: Chain can't be combined with Multiplex")
+		}
+		keys, err := parseChain(config.Chain)
+		if err != nil {
+			return nil, err
+		}
+		c.chainKeys = keys
+	}
+	return c, nil
+}
+
+// DialContext connects to addr through the node. network must be tcp, tcp4
+// or tcp6; addr is host:port, and host names are resolved by the node.
+// ctx bounds the tunnel setup only, not the returned connection.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	route, err := c.Route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote := tunnelAddr{network: network, addr: addr}
+	var conn net.Conn
+	if c.chainKeys != nil {
+		conn, err = c.dialChain(ctx, remote)
+	} else {
+		conn, err = c.dialRoute(ctx, route, remote)
+	}
+	if err != nil {
+		// The node may be gone; try another next time
+		c.forgetRoute(route)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	// Give up on the handshake when ctx ends
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = socksConnect(conn, host, port)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: err}
+	}
+	return conn, nil
+}
+
+// Dial is DialContext without a context.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// Route returns the node's WebSocket URL, looking it up if needed.
+func (c *Client) Route(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	route := c.route
+	c.mu.Unlock()
+	if route != "" {
+		return route, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"location": c.config.Location})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.RoutingURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("client: route lookup: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("client: route lookup: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("client: route lookup failed with status %d", resp.StatusCode)
+	}
+	routes := parseRoutes(data)
+	if len(routes) == 0 {
+		return "", fmt.Errorf("client: no WebSocket node for %s", c.config.Location)
+	}
+
+	if c.config.QUIC {
+		c.quicMu.Lock()
+		for route, endpoint := range parseQUICEndpoints(data) {
+			c.quicURLs[route] = endpoint
+		}
+		c.quicMu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.route, c.fallbacks = routes[0], routes[1:]
+	c.mu.Unlock()
+	return routes[0], nil
+}
+
+// dialRoute opens a tunnel for a connection to route's node: a QUIC stream
+// if the node has a QUIC endpoint that works, else over WebSocket
+func (c *Client) dialRoute(ctx context.Context, route string, remote net.Addr) (net.Conn, error) {
+	if endpoint := c.quicEndpoint(route); endpoint != "" {
+		conn, err := c.dialQUIC(ctx, endpoint, remote)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, errQUICUnreachable) || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	if c.config.Multiplex {
+		return c.openStream(ctx, route, remote)
+	}
+	return c.dialTunnel(ctx, route, remote)
+}
+
+// parseRoutes reads the WebSocket URLs from a route answer: the sync
+// server's JSON, with its candidates in order, or the routing server's bare
+// URL
+func parseRoutes(data []byte) []string {
+	var answer struct {
+		URL        string `json:"url"`
+		Candidates []struct {
+			URL string `json:"url"`
+		} `json:"candidates"`
+	}
+	var urls []string
+	if json.Unmarshal(data, &answer) == nil {
+		urls = append(urls, answer.URL)
+		for _, candidate := range answer.Candidates {
+			if candidate.URL != answer.URL {
+				urls = append(urls, candidate.URL)
+			}
+		}
+	} else {
+		urls = append(urls, strings.TrimSpace(string(data)))
+	}
+	var routes []string
+	for _, u := range urls {
+		if strings.HasPrefix(u, "ws://") || strings.HasPrefix(u, "wss://") {
+			routes = append(routes, u)
+		}
+	}
+	return routes
+}
+
+// forgetRoute moves on from a route that failed, to the next candidate or,
+// when there are none left, to a new lookup
+func (c *Client) forgetRoute(route string) {
+	if c.config.URL != "" {
+		return
+	}
+	c.mu.Lock()
+	if c.route == route {
+		c.route = ""
+		if len(c.fallbacks) > 0 {
+			c.route, c.fallbacks = c.fallbacks[0], c.fallbacks[1:]
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Close closes the shared tunnel of a client with Multiplex, and its QUIC
+// connections, and with them every connection in them. The next dial opens
+// a new one.
+func (c *Client) Close() error {
+	c.closeQUIC()
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.session == nil {
+		return nil
+	}
+	err := c.session.Close()
+	c.session = nil
+	return err
+}
+
+// openStream opens a stream in the shared tunnel to route, dialing the
+// tunnel first if there is none or it has ended
+func (c *Client) openStream(ctx context.Context, route string, remote net.Addr) (*streamConn, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.session != nil && c.sessionRoute == route {
+		if stream, err := c.session.Open(); err == nil {
+			return &streamConn{Stream: stream, local: c.sessionLocal, remote: remote}, nil
+		}
+	}
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+	header := http.Header{}
+	header.Set(mux.ResumeHeader, "new")
+	conn, resp, err := c.dialTunnelHeader(ctx, route, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	// Nodes that can't resume tunnels don't answer with a token
+	token := resp.Get(mux.ResumeHeader)
+	session := mux.Client(conn, mux.Config{Resumable: token != ""})
+	stream, err := session.Open()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if token != "" {
+		go c.keepResuming(session, route, token)
+	}
+	c.session, c.sessionRoute, c.sessionLocal = session, route, conn.LocalAddr()
+	return &streamConn{Stream: stream, local: c.sessionLocal, remote: remote}, nil
+}
+
+// keepResuming reconnects the shared tunnel whenever its connection breaks,
+// until the session ends. If it can't be resumed, the session is closed,
+// which fails its streams, and the next dial opens a new one.
+func (c *Client) keepResuming(session *mux.Session, route, token string) {
+	for {
+		select {
+		case <-session.Detached():
+		case <-session.Done():
+			return
+		}
+		session.Detach()
+		c.logf("client: shared tunnel to %s lost its connection, reconnecting", route)
+		if err := c.resume(session, route, token); err != nil {
+			c.logf("client: can't resume shared tunnel to %s, closing its %d connections: %v", route, session.NumStreams(), err)
+			session.Close()
+			return
+		}
+		c.logf("client: resumed shared tunnel to %s with %d connections", route, session.NumStreams())
+	}
+}
+
+// resume dials the node again, backing off exponentially, until it takes
+// the session back, resumeTimeout passes or the node says the session is
+// gone
+func (c *Client) resume(session *mux.Session, route, token string) error {
+	deadline := time.Now().Add(resumeTimeout)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		header := http.Header{}
+		header.Set(mux.ResumeHeader, token)
+		header.Set(mux.ReceivedHeader, strconv.FormatUint(session.Received(), 10))
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		conn, resp, err := c.dialTunnelHeader(ctx, route, nil, header)
+		cancel()
+		if err == nil {
+			received, perr := strconv.ParseUint(resp.Get(mux.ReceivedHeader), 10, 64)
+			if perr != nil || resp.Get(mux.ResumeHeader) != token {
+				conn.Close()
+				return errors.New("node did not resume the tunnel")
+			}
+			// The new connection can break too before it is taken over
+			if err = session.Resume(conn, received); err == nil || errors.Is(err, mux.ErrResumeMismatch) {
+				return err
+			}
+		}
+		if errors.Is(err, errTunnelGone) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		c.logf("client: reconnecting to %s failed (attempt %d), retrying in %s: %v", route, attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-session.Done():
+			return session.Err()
+		}
+		backoff = min(2*backoff, maxResumeBackoff)
+	}
+}
+
+func (c *Client) logf(format string, args ...any) {
+	if c.config.Logger != nil {
+		c.config.Logger.Printf(format, args...)
+	}
+}
+
+func (c *Client) dialTunnel(ctx context.Context, route string, remote net.Addr) (*Conn, error) {
+	conn, _, err := c.dialTunnelHeader(ctx, route, remote, http.Header{})
+	return conn, err
+}
+
+// cipher is the end-to-end encryption cipher to ask for first
+func (c *Client) cipher() e2e.Cipher {
+	if c.config.Cipher != "" {
+		return c.config.Cipher
+	}
+	return e2e.Preferred()
+}
+
+// dialTunnelHeader dials a tunnel with header added to the request, and
+// returns the response's header too
+func (c *Client) dialTunnelHeader(ctx context.Context, route string, remote net.Addr, header http.Header) (*Conn, http.Header, error) {
+	if c.serverKey != nil {
+		header.Set(e2e.Header, e2e.Version)
+		header.Set(e2e.CipherHeader, e2e.Offer(c.cipher()))
+	}
+	if c.config.Multiplex {
+		header.Set(mux.Header, mux.Version)
+	}
+	if c.config.OnStats != nil {
+		header.Set(statsHeader, strconv.Itoa(int(statsInterval/time.Second)))
+	}
+	if c.config.OnAnnouncement != nil {
+		header.Set(announcementsHeader, "1")
+	}
+	ws, resp, err := c.dialWebSocketHeader(ctx, route, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := &Conn{ws: ws, remote: remote, onStats: c.config.OnStats, onAnnouncement: c.config.OnAnnouncement}
+	if c.config.Multiplex && resp.Header.Get(mux.Header) != mux.Version {
+		ws.Close()
+		return nil, nil, errors.New("connecting to node: node does not support multiplexing")
+	}
+	if c.serverKey == nil {
+		return conn, resp.Header, nil
+	}
+	if resp.Header.Get(e2e.Header) != e2e.Version {
+		ws.Close()
+		return nil, nil, errors.New("connecting to node: node does not support end-to-end encryption")
+	}
+	// Nodes from before the choice don't answer it
+	aead := e2e.ChaCha20Poly1305
+	if picked := resp.Header.Get(e2e.CipherHeader); picked != "" {
+		if aead, err = e2e.ParseCipher(picked); err != nil {
+			ws.Close()
+			return nil, nil, fmt.Errorf("connecting to node: %w", err)
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	sealed, err := e2e.Client(wsStream{conn}, c.serverKey, aead)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		ws.Close()
+		return nil, nil, fmt.Errorf("end-to-end encryption handshake: %w", err)
+	}
+	conn.sealed = sealed
+	return conn, resp.Header, nil
+}
+
+func (c *Client) dialWebSocket(ctx context.Context, url string) (*websocket.Conn, error) {
+	ws, _, err := c.dialWebSocketHeader(ctx, url, http.Header{})
+	return ws, err
+}
+
+func (c *Client) dialWebSocketHeader(ctx context.Context, url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	header.Set("Origin", c.config.Origin)
+	if c.config.Token != "" && header.Get("Authorization") == "" {
+		header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	d := websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: c.config.TLSConfig,
+		Subprotocols:    []string{"vpn-protocol"},
+	}
+	ws, resp, err := d.DialContext(ctx, url, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusGone {
+			return nil, nil, fmt.Errorf("connecting to node: %w", errTunnelGone)
+		}
+		if resp != nil {
+			return nil, nil, fmt.Errorf("connecting to node: %w (status %d)", err, resp.StatusCode)
+		}
+		return nil, nil, fmt.Errorf("connecting to node: %w", err)
+	}
+	return ws, resp, nil
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return "", 0, fmt.Errorf("invalid host %q", host)
+	}
+	return host, uint16(port), nil
+}
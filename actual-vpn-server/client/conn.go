@@ -0,0 +1,179 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/e2e"
+	"horse-vpn-server/mux"
+)
+
+// Largest message written to the tunnel; the node refuses messages over
+// 1 MB
+const maxMessage = 64 << 10
+
+var errWriteClosed = errors.New("client: write side closed")
+
+// Conn is a connection through the tunnel. It carries the stream in binary
+// WebSocket messages; an empty message ends one direction, so CloseWrite
+// works like TCP's half-close. An encrypted tunnel carries the e2e stream
+// in the messages instead.
+type Conn struct {
+	ws     *websocket.Conn
+	remote net.Addr
+	// Set once the tunnel is encrypted
+	sealed *e2e.Conn
+
+	// gorilla/websocket allows one writer at a time
+	mu          sync.Mutex
+	writeClosed bool
+
+	pending    []byte
+	readClosed bool
+	// Get the node's statistics and announcements, if the client asked for
+	// them
+	onStats        func(Stats)
+	onAnnouncement func(Announcement)
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.sealed != nil {
+		return c.sealed.Read(b)
+	}
+	return c.readMessages(b)
+}
+
+func (c *Conn) readMessages(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.readClosed {
+			return 0, io.EOF
+		}
+		msgType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if msgType == websocket.TextMessage {
+			c.handleText(data)
+			continue
+		}
+		if len(data) == 0 {
+			c.readClosed = true
+			return 0, io.EOF
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.sealed != nil {
+		return c.sealed.Write(b)
+	}
+	return c.writeMessages(b)
+}
+
+func (c *Conn) writeMessages(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return 0, errWriteClosed
+	}
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), maxMessage)
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the far end we are done sending; reading goes on.
+func (c *Conn) CloseWrite() error {
+	if c.sealed != nil {
+		return c.sealed.CloseWrite()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	return c.ws.WriteMessage(websocket.BinaryMessage, nil)
+}
+
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+// LocalAddr is the local end of the connection to the node.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr is the address the connection was dialed to, not the node's.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// wsStream is the tunnel's own stream, which an encrypted Conn runs the
+// e2e stream over
+type wsStream struct {
+	c *Conn
+}
+
+func (s wsStream) Read(b []byte) (int, error)  { return s.c.readMessages(b) }
+func (s wsStream) Write(b []byte) (int, error) { return s.c.writeMessages(b) }
+func (s wsStream) Close() error                { return s.c.ws.Close() }
+
+// streamConn is a connection carried as a stream in a shared tunnel
+type streamConn struct {
+	*mux.Stream
+	local, remote net.Addr
+}
+
+var _ net.Conn = (*streamConn)(nil)
+
+// LocalAddr is the local end of the shared tunnel's connection to the node.
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr is the address the connection was dialed to, not the node's.
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// tunnelAddr is a destination as it was given to DialContext
+type tunnelAddr struct {
+	network, addr string
+}
+
+func (a tunnelAddr) Network() string { return a.network }
+func (a tunnelAddr) String() string  { return a.addr }
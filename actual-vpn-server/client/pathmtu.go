@@ -0,0 +1,131 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/tun"
+)
+
+// Path MTU tuning. The node's MTU suits a 1500 byte path, but PPPoE, mobile
+// networks and other tunnels have less. Every packet the tunnel carries is
+// then split over two segments on the way to the node, and packets coming
+// back through the node are larger than the client's network takes. Sites
+// whose ICMP is filtered never hear "fragmentation needed", so connections
+// to them open and then hang.
+//
+// Forward therefore probes the path to the node: it sends a few messages as
+// large as a tunnel packet, waits for the node to answer a ping sent behind
+// them, and by then the kernel's path MTU for the connection reflects any
+// hop that couldn't take them. The tunnel's MTU becomes what fits in one
+// segment of that, the device gets it, and the node is told, so it clamps
+// the MSS of TCP handshakes in both directions to match. The kernel's path
+// MTU is checked every few seconds and the path probed again when it
+// changes, as it does when the system moves to another network, and every
+// minute besides.
+const (
+	pathCheckInterval = 5 * time.Second
+	pathProbeInterval = time.Minute
+	pathProbeTimeout  = 5 * time.Second
+	pathProbeMessages = 4
+	// The least an IPv4 host must take
+	minTunnelMTU = 576
+	// What the tunnel adds to each packet on the way to the node: TCP with
+	// timestamps, a TLS record and a masked WebSocket frame header
+	tunnelOverhead = 32 + 29 + 8
+)
+
+// underlyingTCP returns the TCP connection under ws, if it has one
+func underlyingTCP(ws *websocket.Conn) (*net.TCPConn, bool) {
+	conn := ws.UnderlyingConn()
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	return tcp, ok
+}
+
+// tunnelMTU is the largest packet that fits in one segment on a path of
+// pathMTU, up to what the node allows
+func (pt *PacketTunnel) tunnelMTU(pathMTU int, ipv6 bool) int {
+	header := 20
+	if ipv6 {
+		header = 40
+	}
+	return min(max(pathMTU-header-tunnelOverhead, minTunnelMTU), pt.MTU)
+}
+
+// probePath sends messages the size of a tunnel packet and waits for the
+// node to answer a ping behind them. They are text, which the node reads
+// as an MTU report and ignores.
+func (pt *PacketTunnel) probePath(pongs <-chan struct{}) bool {
+	padding := strings.Repeat(" ", max(pt.MTU-len(`{}`), 0))
+	for i := 0; i < pathProbeMessages; i++ {
+		pt.mu.Lock()
+		err := pt.ws.WriteMessage(websocket.TextMessage, []byte("{"+padding+"}"))
+		pt.mu.Unlock()
+		if err != nil {
+			return false
+		}
+	}
+	// Drain a pong left over from a probe that timed out
+	select {
+	case <-pongs:
+	default:
+	}
+	if err := pt.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(pathProbeTimeout)); err != nil {
+		return false
+	}
+	select {
+	case <-pongs:
+		return true
+	case <-time.After(pathProbeTimeout):
+		return false
+	}
+}
+
+// tunePathMTU keeps dev's MTU, and the node's idea of it, to what the path
+// to the node carries in one segment, until stop is closed
+func (pt *PacketTunnel) tunePathMTU(dev *tun.Device, pongs <-chan struct{}, stop <-chan struct{}) {
+	tcp, ok := underlyingTCP(pt.ws)
+	if !ok {
+		return
+	}
+	ipv6 := tcp.RemoteAddr().(*net.TCPAddr).IP.To4() == nil
+	current := dev.MTU()
+	lastPath, lastProbe := 0, time.Time{}
+	ticker := time.NewTicker(pathCheckInterval)
+	defer ticker.Stop()
+	for {
+		path, err := pathMTU(tcp, ipv6)
+		if err != nil {
+			return
+		}
+		if path != lastPath || time.Since(lastProbe) >= pathProbeInterval {
+			lastProbe = time.Now()
+			if pt.probePath(pongs) {
+				if path, err = pathMTU(tcp, ipv6); err != nil {
+					return
+				}
+			}
+			lastPath = path
+			if mtu := pt.tunnelMTU(path, ipv6); mtu != current && dev.SetMTU(mtu) == nil {
+				current = mtu
+				report, _ := json.Marshal(map[string]int{"mtu": mtu})
+				pt.mu.Lock()
+				pt.ws.WriteMessage(websocket.TextMessage, report)
+				pt.mu.Unlock()
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// pathMTU returns the kernel's path MTU for conn's destination
+func pathMTU(conn *net.TCPConn, ipv6 bool) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			mtu, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return mtu, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+// pathMTU returns the kernel's path MTU for conn's destination; see
+// pathmtu_linux.go
+func pathMTU(conn *net.TCPConn, ipv6 bool) (int, error) {
+	return 0, errors.New("client: path MTU is only known on Linux")
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The node's QUIC transport; see quictransport.go in the node
+const (
+	quicProto = "horsevpn-quic/1"
+
+	// UDP that doesn't get through shows as a handshake that never
+	// finishes; this is how long to give it
+	quicHandshakeTimeout = 5 * time.Second
+	// How long the client sticks to WebSocket after QUIC to a node failed
+	quicRetryAfter = 10 * time.Minute
+)
+
+// errQUICUnreachable wraps failures to reach a node over QUIC at all, which
+// the client falls back to WebSocket for
+var errQUICUnreachable = errors.New("node unreachable over QUIC")
+
+// The node's answers to the control stream's preamble, as on raw TLS
+var quicStatusErrors = map[byte]error{
+	1: errors.New("connecting to node: unauthorized"),
+	2: errors.New("connecting to node: node overloaded"),
+	3: errors.New("connecting to node: too many sessions"),
+}
+
+// quicFallback returns the WebSocket URL to use for a quic:// URL when UDP
+// doesn't get through: wss:// on the same host, at /ws
+func quicFallback(quicURL string) (string, error) {
+	u, err := url.Parse(quicURL)
+	if err != nil || u.Scheme != "quic" || u.Hostname() == "" || u.Port() == "" {
+		return "", fmt.Errorf("client: invalid QUIC URL %q, want quic://host:port", quicURL)
+	}
+	return (&url.URL{Scheme: "wss", Host: u.Hostname(), Path: "/ws"}).String(), nil
+}
+
+// parseQUICEndpoints reads the quic:// endpoints of the candidates in the
+// sync server's route answer, by their WebSocket URL
+func parseQUICEndpoints(data []byte) map[string]string {
+	type candidate struct {
+		URL       string   `json:"url"`
+		Endpoints []string `json:"endpoints"`
+	}
+	var answer struct {
+		candidate
+		Candidates []candidate `json:"candidates"`
+	}
+	endpoints := make(map[string]string)
+	if json.Unmarshal(data, &answer) != nil {
+		return endpoints
+	}
+	for _, c := range append([]candidate{answer.candidate}, answer.Candidates...) {
+		for _, e := range c.Endpoints {
+			if _, err := quicFallback(e); err == nil && c.URL != "" {
+				endpoints[c.URL] = e
+				break
+			}
+		}
+	}
+	return endpoints
+}
+
+// quicEndpoint returns the quic:// URL to reach route's node on, or "" to
+// use WebSocket because it has none or QUIC to it failed lately
+func (c *Client) quicEndpoint(route string) string {
+	c.quicMu.Lock()
+	defer c.quicMu.Unlock()
+	endpoint := c.quicURLs[route]
+	if endpoint == "" || time.Now().Before(c.quicBlocked[endpoint]) {
+		return ""
+	}
+	return endpoint
+}
+
+// dialQUIC opens a stream for a connection in the QUIC connection to
+// endpoint, connecting first if there is none or it has ended
+func (c *Client) dialQUIC(ctx context.Context, endpoint string, remote net.Addr) (*quicConn, error) {
+	c.quicMu.Lock()
+	defer c.quicMu.Unlock()
+	if conn := c.quicConns[endpoint]; conn != nil && conn.Context().Err() == nil {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &quicConn{Stream: stream, local: conn.LocalAddr(), remote: remote}, nil
+	}
+	delete(c.quicConns, endpoint)
+	conn, err := c.connectQUIC(ctx, endpoint)
+	if errors.Is(err, errQUICUnreachable) && ctx.Err() == nil {
+		c.logf("client: can't reach %s over QUIC, using WebSocket for %s: %v", endpoint, quicRetryAfter, err)
+		c.quicBlocked[endpoint] = time.Now().Add(quicRetryAfter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	c.quicConns[endpoint] = conn
+	return &quicConn{Stream: stream, local: conn.LocalAddr(), remote: remote}, nil
+}
+
+// connectQUIC connects to endpoint and authenticates on the control stream
+func (c *Client) connectQUIC(ctx context.Context, endpoint string) (quic.Connection, error) {
+	u, _ := url.Parse(endpoint)
+	tlsConfig := &tls.Config{}
+	if c.config.TLSConfig != nil {
+		tlsConfig = c.config.TLSConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{quicProto}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := quic.DialAddr(ctx, u.Host, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		MaxIdleTimeout:       60 * time.Second,
+		KeepAlivePeriod:      15 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to node: %w: %v", errQUICUnreachable, err)
+	}
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("connecting to node: %w", err)
+	}
+	preamble := binary.BigEndian.AppendUint16(nil, uint16(len(c.config.Token)))
+	preamble = append(preamble, c.config.Token...)
+	status := make([]byte, 1)
+	stop := context.AfterFunc(ctx, func() { conn.CloseWithError(0, "") })
+	_, err = control.Write(preamble)
+	if err == nil {
+		_, err = io.ReadFull(control, status)
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err == nil && status[0] != 0 {
+		err = quicStatusErrors[status[0]]
+		if err == nil {
+			err = fmt.Errorf("connecting to node: status %d", status[0])
+		}
+	}
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// closeQUIC closes the client's QUIC connections, and every connection in
+// them
+func (c *Client) closeQUIC() {
+	c.quicMu.Lock()
+	defer c.quicMu.Unlock()
+	for endpoint, conn := range c.quicConns {
+		conn.CloseWithError(0, "")
+		delete(c.quicConns, endpoint)
+	}
+}
+
+// quicConn is a connection carried as a stream in a QUIC connection
+type quicConn struct {
+	quic.Stream
+	local, remote net.Addr
+}
+
+var _ net.Conn = (*quicConn)(nil)
+
+// CloseWrite tells the far end we are done sending; reading goes on.
+func (c *quicConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// LocalAddr is the local end of the QUIC connection to the node.
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr is the address the connection was dialed to, not the node's.
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The client half of a SOCKS5 CONNECT (RFC 1928) without authentication,
+// which is what the desktop client's local proxy passes through its tunnels.
+
+const (
+	socksVersion    = 5
+	socksNoAuth     = 0
+	socksCmdConnect = 1
+	socksAtypIPv4   = 1
+	socksAtypName   = 3
+	socksAtypIPv6   = 4
+	socksSucceeded  = 0
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socksConnect(rw io.ReadWriter, host string, port uint16) error {
+	if _, err := rw.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(rw, choice[:]); err != nil {
+		return fmt.Errorf("SOCKS greeting: %w", err)
+	}
+	if choice[0] != socksVersion || choice[1] != socksNoAuth {
+		return fmt.Errorf("node refused SOCKS5 without authentication")
+	}
+
+	req := appendSocksAddr([]byte{socksVersion, socksCmdConnect, 0}, host, port)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which we don't need
+	var reply [4]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return fmt.Errorf("SOCKS reply: %w", err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("SOCKS reply has version %d", reply[0])
+	}
+	if reply[1] != socksSucceeded {
+		if msg, ok := socksReplies[reply[1]]; ok {
+			return fmt.Errorf("node: %s", msg)
+		}
+		return fmt.Errorf("node refused the connection (SOCKS reply %d)", reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len
+	case socksAtypIPv6:
+		skip = net.IPv6len
+	case socksAtypName:
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS reply has address type %d", reply[3])
+	}
+	_, err := io.ReadFull(rw, make([]byte, skip+2))
+	return err
+}
+
+// appendSocksAddr appends ATYP DST.ADDR DST.PORT for host, which may be a
+// name for the node to resolve
+func appendSocksAddr(dst []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip == nil {
+		dst = append(dst, socksAtypName, byte(len(host)))
+		dst = append(dst, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		dst = append(dst, socksAtypIPv4)
+		dst = append(dst, ip4...)
+	} else {
+		dst = append(dst, socksAtypIPv6)
+		dst = append(dst, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(dst, port)
+}
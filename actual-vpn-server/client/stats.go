@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The node sends a tunnel's statistics this often when Config.OnStats is set
+const (
+	statsHeader   = "X-Tunnel-Stats"
+	statsInterval = 5 * time.Second
+)
+
+// Stats are a tunnel's numbers as the node sees them, sent every few
+// seconds to clients that set Config.OnStats.
+type Stats struct {
+	// Bytes the node has relayed for the tunnel so far, for a shared tunnel
+	// across all its connections
+	BytesUp   int64 `json:"bytesUp"`
+	BytesDown int64 `json:"bytesDown"`
+	// Throttled says whether a rate limit slowed the tunnel down since the
+	// last Stats, and RateLimit is the tightest one in bytes a second, 0
+	// for none
+	Throttled bool  `json:"throttled"`
+	RateLimit int64 `json:"rateLimit"`
+	// The user's data this month and their monthly quota; both 0 without a
+	// quota
+	QuotaUsed int64 `json:"quotaUsed"`
+	Quota     int64 `json:"quota"`
+	// How busy the node is, from 0 to 1, and whether it is turning new
+	// tunnels away
+	Load       float64 `json:"load"`
+	Overloaded bool    `json:"overloaded"`
+}
+
+// handleText passes a text message from the node to onStats or
+// onAnnouncement, by its type, and drops anything else
+func (c *Conn) handleText(data []byte) {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(data, &msg) != nil {
+		return
+	}
+	switch {
+	case msg.Type == "stats" && c.onStats != nil:
+		var stats Stats
+		if json.Unmarshal(data, &stats) == nil {
+			c.onStats(stats)
+		}
+	case msg.Type == "announcement" && c.onAnnouncement != nil:
+		var a Announcement
+		if json.Unmarshal(data, &a) == nil {
+			c.onAnnouncement(a)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type locationKey struct{}
+
+// WithLocation returns a context whose requests through a Transport leave
+// from a node in location instead of the Transport's default.
+func WithLocation(ctx context.Context, location string) context.Context {
+	return context.WithValue(ctx, locationKey{}, location)
+}
+
+// LocationFrom returns the location set by WithLocation, if any.
+func LocationFrom(ctx context.Context) (string, bool) {
+	location, ok := ctx.Value(locationKey{}).(string)
+	return location, ok && location != ""
+}
+
+// Transport is an http.RoundTripper that sends requests through HorseVPN:
+//
+//	httpClient := &http.Client{Transport: client.NewTransport(client.Config{Location: "Netherlands"})}
+//	req = req.WithContext(client.WithLocation(ctx, "Germany"))
+//
+// Requests leave through the node Config names unless their context picks
+// another location. Connections are kept alive and reused, but only for
+// requests to the same location, so a request never goes out through an
+// exit it didn't ask for.
+type Transport struct {
+	config Config
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// NewTransport returns a Transport whose default exit is the one config
+// names, as for New.
+func NewTransport(config Config) *Transport {
+	return &Transport{config: config, transports: make(map[string]*http.Transport)}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := t.transportFor(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes kept-alive connections for every location.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// transportFor returns the pool for the context's location, "" being the
+// default exit
+func (t *Transport) transportFor(ctx context.Context) (*http.Transport, error) {
+	config := t.config
+	location, ok := LocationFrom(ctx)
+	if ok {
+		config.URL = ""
+		config.Location = location
+	} else {
+		location = ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transport := t.transports[location]; transport != nil {
+		return transport, nil
+	}
+	c, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The tunnel is the proxy
+	transport.Proxy = nil
+	transport.DialContext = c.DialContext
+	t.transports[location] = transport
+	return transport, nil
+}
@@ -0,0 +1,280 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/tun"
+)
+
+// PacketTunnel carries IP packets to and from a node started with
+// TUN_SUBNET, for routing a whole system's traffic through it:
+//
+//	pt, err := c.OpenPacketTunnel(ctx)
+//	...
+//	dev, err := tun.Open("horse0", pt.MTU)
+//	...
+//	err = pt.Forward(dev, netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1"))
+//
+// The node only accepts packets from Address. Keep a route to the node
+// itself outside the device, or the tunnel would carry its own traffic.
+type PacketTunnel struct {
+	ws *websocket.Conn
+
+	// The client's address on the node's tunnel network
+	Address netip.Prefix
+	Gateway netip.Addr
+	MTU     int
+	// What Forward does with mDNS and LLMNR; set it before calling Forward
+	Discovery DiscoveryPolicy
+
+	// gorilla/websocket allows one writer at a time
+	mu sync.Mutex
+}
+
+var errNotPacket = errors.New("client: unexpected message on packet tunnel")
+
+// DiscoveryPolicy decides where link-local discovery goes while the whole
+// system is routed through the tunnel: mDNS (224.0.0.251 and ff02::fb, port
+// 5353) and LLMNR (224.0.0.252 and ff02::1:3, port 5355). Printers, casting
+// and file sharing find each other with them, and they also announce the
+// device's name and services to everyone on the network.
+type DiscoveryPolicy int
+
+const (
+	// DiscoveryLAN keeps discovery on the local network, routed around
+	// the device, so printers and casting keep working
+	DiscoveryLAN DiscoveryPolicy = iota
+	// DiscoveryBlock drops discovery the device gets, so the local network
+	// doesn't hear it
+	DiscoveryBlock
+	// DiscoveryTunnel sends discovery to the node like any other packet.
+	// It keeps it off the local network, but nothing there answers either.
+	DiscoveryTunnel
+)
+
+// ParseDiscoveryPolicy reads a policy by name: lan, block or tunnel
+func ParseDiscoveryPolicy(s string) (DiscoveryPolicy, error) {
+	switch s {
+	case "lan":
+		return DiscoveryLAN, nil
+	case "block":
+		return DiscoveryBlock, nil
+	case "tunnel":
+		return DiscoveryTunnel, nil
+	}
+	return 0, fmt.Errorf("client: unknown discovery policy %q", s)
+}
+
+func (p DiscoveryPolicy) String() string {
+	switch p {
+	case DiscoveryBlock:
+		return "block"
+	case DiscoveryTunnel:
+		return "tunnel"
+	}
+	return "lan"
+}
+
+// Where mDNS and LLMNR queries and announcements go
+var discoveryGroups = []netip.AddrPort{
+	netip.MustParseAddrPort("224.0.0.251:5353"),
+	netip.MustParseAddrPort("[ff02::fb]:5353"),
+	netip.MustParseAddrPort("224.0.0.252:5355"),
+	netip.MustParseAddrPort("[ff02::1:3]:5355"),
+}
+
+func isDiscovery(packet []byte) bool {
+	h, err := tun.ParseHeader(packet)
+	if err != nil || h.Protocol != tun.ProtocolUDP {
+		return false
+	}
+	dst, ok := netip.AddrFromSlice(h.Dst)
+	if !ok {
+		return false
+	}
+	dst = dst.Unmap()
+	for _, group := range discoveryGroups {
+		if dst == group.Addr() && h.DstPort == int(group.Port()) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenPacketTunnel connects to the node's /tun endpoint and reads the
+// address it assigns.
+func (c *Client) OpenPacketTunnel(ctx context.Context) (*PacketTunnel, error) {
+	if c.chainKeys != nil {
+		return nil, errChainTCPOnly
+	}
+	route, err := c.Route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(route)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid route %q: %w", route, err)
+	}
+	u.Path = "/tun"
+	ws, err := c.dialWebSocket(ctx, u.String())
+	if err != nil {
+		c.forgetRoute(route)
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	pt, err := readTunnelConfig(ws)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return pt, nil
+}
+
+func readTunnelConfig(ws *websocket.Conn) (*PacketTunnel, error) {
+	msgType, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != websocket.TextMessage {
+		return nil, errNotPacket
+	}
+	var config struct {
+		Address string `json:"address"`
+		Gateway string `json:"gateway"`
+		MTU     int    `json:"mtu"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("client: invalid tunnel configuration: %w", err)
+	}
+	pt := &PacketTunnel{ws: ws, MTU: config.MTU}
+	if pt.Address, err = netip.ParsePrefix(config.Address); err != nil {
+		return nil, fmt.Errorf("client: invalid tunnel address: %w", err)
+	}
+	if pt.Gateway, err = netip.ParseAddr(config.Gateway); err != nil {
+		return nil, fmt.Errorf("client: invalid tunnel gateway: %w", err)
+	}
+	return pt, nil
+}
+
+// ReadPacket returns the next IP packet from the node
+func (pt *PacketTunnel) ReadPacket() ([]byte, error) {
+	for {
+		msgType, data, err := pt.ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msgType == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+// WritePacket sends one IP packet to the node
+func (pt *PacketTunnel) WritePacket(packet []byte) error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.ws.WriteMessage(websocket.BinaryMessage, packet)
+}
+
+func (pt *PacketTunnel) Close() error {
+	return pt.ws.Close()
+}
+
+// Forward gives dev the tunnel's address, routes the given prefixes through
+// it and copies packets between dev and the node until either fails. It
+// closes the tunnel but not dev. Discovery packets are handled as
+// pt.Discovery says; with DiscoveryLAN, their groups get routes out of the
+// default route's interface in each family the prefixes cover, and any that
+// reach dev anyway are dropped. While it runs, dev's MTU follows the path
+// to the node; see pathmtu.go.
+func (pt *PacketTunnel) Forward(dev *tun.Device, routes ...netip.Prefix) error {
+	defer pt.Close()
+	if err := dev.Configure(pt.Address); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := dev.AddRoute(route); err != nil {
+			return err
+		}
+	}
+	if pt.Discovery == DiscoveryLAN {
+		if err := addDiscoveryLANRoutes(routes); err != nil {
+			return err
+		}
+	}
+
+	pongs := make(chan struct{}, 1)
+	pt.ws.SetPongHandler(func(string) error {
+		select {
+		case pongs <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go pt.tunePathMTU(dev, pongs, stop)
+
+	done := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			if pt.Discovery != DiscoveryTunnel && isDiscovery(buf[:n]) {
+				continue
+			}
+			if err := pt.WritePacket(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			packet, err := pt.ReadPacket()
+			if err != nil {
+				done <- err
+				return
+			}
+			if _, err := dev.Write(packet); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return <-done
+}
+
+// addDiscoveryLANRoutes keeps the discovery groups that routes would send
+// through the device on the local network. A family without a default route
+// has no local network to keep them on.
+func addDiscoveryLANRoutes(routes []netip.Prefix) error {
+	for _, group := range discoveryGroups {
+		for _, route := range routes {
+			if route.Contains(group.Addr()) {
+				err := tun.AddLANRoute(netip.PrefixFrom(group.Addr(), group.Addr().BitLen()))
+				if err != nil && !errors.Is(err, tun.ErrNoDefaultRoute) {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PacketConn sends and receives UDP datagrams through the node's UDP relay,
+// for DNS, QUIC and the like:
+//
+//	pc, err := c.ListenPacket(ctx)
+//	...
+//	_, err = pc.WriteTo(query, &net.UDPAddr{IP: net.IPv4(9, 9, 9, 9), Port: 53})
+//	n, from, err := pc.ReadFrom(buf)
+//
+// The node gives it one UDP port for every destination, and any host may
+// answer on it, until nothing has been sent for the node's mapping timeout.
+// Each datagram is one WebSocket message with a SOCKS5 UDP header, as the
+// desktop client's UDP ASSOCIATE passes them through.
+type PacketConn struct {
+	ws *websocket.Conn
+
+	// gorilla/websocket allows one writer at a time
+	mu   sync.Mutex
+	wbuf []byte
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+var errMalformedDatagram = errors.New("client: malformed datagram from node")
+
+// ListenPacket connects to the node's /udp endpoint.
+func (c *Client) ListenPacket(ctx context.Context) (*PacketConn, error) {
+	if c.chainKeys != nil {
+		return nil, errChainTCPOnly
+	}
+	route, err := c.Route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(route)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid route %q: %w", route, err)
+	}
+	u.Path = "/udp"
+	ws, err := c.dialWebSocket(ctx, u.String())
+	if err != nil {
+		c.forgetRoute(route)
+		return nil, err
+	}
+	return &PacketConn{ws: ws}, nil
+}
+
+// ReadFrom reads the next datagram. As with UDP, whatever doesn't fit in b
+// is lost.
+func (p *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		msgType, data, err := p.ws.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		addr, payload, err := parseDatagram(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// WriteTo sends b to addr. addr may be a *net.UDPAddr or any address whose
+// String is host:port; host names are resolved by the node.
+func (p *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var host string
+	var port uint16
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		host, port = ua.IP.String(), uint16(ua.Port)
+	} else {
+		var err error
+		if host, port, err = splitHostPort(addr.String()); err != nil {
+			return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// RSV(2) FRAG(1)
+	msg := appendSocksAddr(append(p.wbuf[:0], 0, 0, 0), host, port)
+	msg = append(msg, b...)
+	p.wbuf = msg
+	if err := p.ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *PacketConn) Close() error {
+	return p.ws.Close()
+}
+
+// LocalAddr is the local end of the connection to the node, not the UDP
+// port the node sends from.
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.ws.LocalAddr()
+}
+
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	if err := p.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.ws.SetWriteDeadline(t)
+}
+
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	return p.ws.SetReadDeadline(t)
+}
+
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return p.ws.SetWriteDeadline(t)
+}
+
+// parseDatagram splits a datagram from the node into its source and
+// payload. The node always names the source by IP address.
+func parseDatagram(b []byte) (*net.UDPAddr, []byte, error) {
+	// RSV(2) FRAG(1) ATYP(1)
+	if len(b) < 4 || b[2] != 0 {
+		return nil, nil, errMalformedDatagram
+	}
+	var n int
+	switch b[3] {
+	case socksAtypIPv4:
+		n = net.IPv4len
+	case socksAtypIPv6:
+		n = net.IPv6len
+	default:
+		return nil, nil, errMalformedDatagram
+	}
+	rest := b[4:]
+	if len(rest) < n+2 {
+		return nil, nil, errMalformedDatagram
+	}
+	addr := &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), rest[:n]...)),
+		Port: int(binary.BigEndian.Uint16(rest[n:])),
+	}
+	return addr, rest[n+2:], nil
+}
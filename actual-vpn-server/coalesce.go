@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Write coalescing: small writes to a WebSocket tunnel within
+// WRITE_COALESCE_DELAY_MS of each other go out as one message instead of
+// one message each, like Nagle's algorithm. A write that fills
+// coalesceMaxBytes goes out at once. Tunnels opened with
+// "X-Traffic-Class: interactive" are never delayed, for SSH and the like.
+// 0 turns coalescing off.
+const coalesceMaxBytes = 16 * 1024
+
+var writeCoalesceDelay time.Duration
+
+var writesCoalesced = registry.Counter("writes_coalesced_total", "Tunnel writes merged into an earlier WebSocket message")
+
+func writeCoalesceDelayFromEnv() time.Duration {
+	if v := os.Getenv("WRITE_COALESCE_DELAY_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err == nil && ms >= 0 && ms <= 100 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		slog.Warn("Ignoring invalid WRITE_COALESCE_DELAY_MS value", "value", v)
+	}
+	return 2 * time.Millisecond
+}
+
+// coalesceDelayFor returns the delay for a tunnel opened by r
+func coalesceDelayFor(r *http.Request) time.Duration {
+	if strings.EqualFold(r.Header.Get("X-Traffic-Class"), "interactive") {
+		return 0
+	}
+	return writeCoalesceDelay
+}
+
+// writeCoalesced buffers b, to be sent when the delay runs out or the buffer
+// fills. An error from an earlier background flush is returned instead.
+// Callers hold w.mu.
+func (w *WSConn) writeCoalesced(b []byte) error {
+	if w.flushErr != nil {
+		return w.flushErr
+	}
+	if len(w.pending) > 0 {
+		writesCoalesced.Inc()
+	}
+	w.pending = append(w.pending, b...)
+	if len(w.pending) >= coalesceMaxBytes {
+		return w.flushLocked()
+	}
+	if !w.flushArmed {
+		// One timer per connection, rearmed, rather than one per message
+		w.flushArmed = true
+		if w.flushTimer == nil {
+			w.flushTimer = time.AfterFunc(w.coalesce, w.flushDelayed)
+		} else {
+			w.flushTimer.Reset(w.coalesce)
+		}
+	}
+	return nil
+}
+
+func (w *WSConn) flushDelayed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.flushArmed {
+		// Flushed while this call waited for the lock
+		return
+	}
+	if err := w.flushLocked(); err != nil && w.flushErr == nil {
+		w.flushErr = err
+	}
+}
+
+// flushLocked sends whatever is buffered. Callers hold w.mu.
+func (w *WSConn) flushLocked() error {
+	if w.flushArmed {
+		w.flushTimer.Stop()
+		w.flushArmed = false
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.writeMessage(w.pending)
+	w.pending = w.pending[:0]
+	return err
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config file: -config (or CONFIG_FILE) names a YAML or TOML file, told
+// apart by its extension, with the node's settings in one place:
+//
+//	location: Netherlands
+//	sync_server: https://sync.example.com
+//	tags: [canary]
+//	log_level: info
+//	listen:
+//	  port: 443
+//	  raw_tls_port: 8443
+//	tls:
+//	  enabled: true
+//	  cert_file: /etc/horsevpn/cert.pem
+//	  key_file: /etc/horsevpn/key.pem
+//	auth:
+//	  tokens: ["alice:s3cret"]
+//	env:
+//	  MAX_TUNNELS: "5000"
+//
+// Each setting stands for a flag or an environment variable, and env sets
+// any other environment variable. Flags win over the environment, and the
+// environment, CONFIG_DIR included, wins over the file, so a deployment can
+// share one file and override a setting or two per node. The file is read
+// once at startup; a mistake in it, such as an unknown key or a malformed
+// URL, stops the node with the file's name and what is wrong.
+type fileConfig struct {
+	Location      string   `yaml:"location"`
+	ID            string   `yaml:"id"`
+	Tags          []string `yaml:"tags"`
+	SyncServer    string   `yaml:"sync_server"`
+	NoCloudflared *bool    `yaml:"no_cloudflared"`
+	LogLevel      string   `yaml:"log_level"`
+	LogFormat     string   `yaml:"log_format"`
+
+	Listen struct {
+		Port          int    `yaml:"port"`
+		RawTLSPort    int    `yaml:"raw_tls_port"`
+		RawTLSAddress string `yaml:"raw_tls_address"`
+		QUICPort      int    `yaml:"quic_port"`
+		QUICAddress   string `yaml:"quic_address"`
+	} `yaml:"listen"`
+
+	TLS struct {
+		Enabled     *bool    `yaml:"enabled"`
+		CertFile    string   `yaml:"cert_file"`
+		KeyFile     string   `yaml:"key_file"`
+		ACMEDomains []string `yaml:"acme_domains"`
+		ACMEEmail   string   `yaml:"acme_email"`
+	} `yaml:"tls"`
+
+	Auth struct {
+		// name:token, or just the token
+		Tokens     []string `yaml:"tokens"`
+		TokensFile string   `yaml:"tokens_file"`
+		NodeToken  string   `yaml:"node_token"`
+	} `yaml:"auth"`
+
+	Env map[string]string `yaml:"env"`
+}
+
+var (
+	envName      = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	unknownField = regexp.MustCompile(`field (\S+) not found in type .*`)
+)
+
+// loadConfigFile reads and checks the config file at path
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+	case ".toml":
+		tree, err := parseTOML(data)
+		if err != nil {
+			return nil, err
+		}
+		// Decoding the TOML's tree as YAML checks it against the same keys
+		if data, err = yaml.Marshal(tree); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q, use .yaml, .yml or .toml", ext)
+	}
+
+	var cfg fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			// yaml.v3 names Go types in these; say which key is wrong instead
+			for i, msg := range typeErr.Errors {
+				typeErr.Errors[i] = unknownField.ReplaceAllString(msg, `unknown key "$1"`)
+			}
+			return nil, errors.New(strings.Join(typeErr.Errors, "; "))
+		}
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *fileConfig) validate() error {
+	if c.SyncServer != "" {
+		u, err := url.Parse(c.SyncServer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("sync_server: %q is not an http:// or https:// URL", c.SyncServer)
+		}
+	}
+	if c.LogLevel != "" {
+		if _, ok := logLevels[c.LogLevel]; !ok {
+			return fmt.Errorf("log_level: %q is not one of debug, info, warn or error", c.LogLevel)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format: %q is not one of text or json", c.LogFormat)
+	}
+	for name, port := range map[string]int{"listen.port": c.Listen.Port, "listen.raw_tls_port": c.Listen.RawTLSPort, "listen.quic_port": c.Listen.QUICPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("%s: %d is not a port number", name, port)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls: cert_file and key_file must be set together")
+	}
+	for name, file := range map[string]string{"tls.cert_file": c.TLS.CertFile, "tls.key_file": c.TLS.KeyFile, "auth.tokens_file": c.Auth.TokensFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for _, token := range c.Auth.Tokens {
+		if token == "" || strings.Contains(token, ",") {
+			return fmt.Errorf("auth.tokens: %q is empty or has a comma", token)
+		}
+	}
+	for _, tag := range c.Tags {
+		if tag == "" || strings.Contains(tag, ",") {
+			return fmt.Errorf("tags: %q is empty or has a comma", tag)
+		}
+	}
+	for name := range c.Env {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("env: %q is not an environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// environment is the environment variables the file sets
+func (c *fileConfig) environment() map[string]string {
+	env := make(map[string]string)
+	for name, value := range c.Env {
+		env[name] = value
+	}
+	set := func(name, value string) {
+		if value != "" {
+			env[name] = value
+		}
+	}
+	set("LOG_LEVEL", c.LogLevel)
+	set("LOG_FORMAT", c.LogFormat)
+	if c.Listen.Port != 0 {
+		set("PORT", strconv.Itoa(c.Listen.Port))
+	}
+	if c.Listen.RawTLSPort != 0 {
+		set("RAW_TLS_PORT", strconv.Itoa(c.Listen.RawTLSPort))
+	}
+	set("RAW_TLS_ADDRESS", c.Listen.RawTLSAddress)
+	if c.Listen.QUICPort != 0 {
+		set("QUIC_PORT", strconv.Itoa(c.Listen.QUICPort))
+	}
+	set("QUIC_ADDRESS", c.Listen.QUICAddress)
+	if c.TLS.Enabled != nil {
+		set("USE_TLS", strconv.FormatBool(*c.TLS.Enabled))
+	}
+	set("TLS_CERT_FILE", c.TLS.CertFile)
+	set("TLS_KEY_FILE", c.TLS.KeyFile)
+	set("ACME_DOMAINS", strings.Join(c.TLS.ACMEDomains, ","))
+	set("ACME_EMAIL", c.TLS.ACMEEmail)
+	set("AUTH_TOKENS", strings.Join(c.Auth.Tokens, ","))
+	set("AUTH_TOKENS_FILE", c.Auth.TokensFile)
+	set("PRIVATE_NODE_TOKEN", c.Auth.NodeToken)
+	return env
+}
+
+// flags is the command line flags the file sets
+func (c *fileConfig) flags() map[string]string {
+	flags := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			flags[name] = value
+		}
+	}
+	set("location", c.Location)
+	set("id", c.ID)
+	set("tags", strings.Join(c.Tags, ","))
+	set("sync-server", c.SyncServer)
+	if c.NoCloudflared != nil {
+		set("no-cloudflared", strconv.FormatBool(*c.NoCloudflared))
+	}
+	return flags
+}
+
+// apply sets the environment variables and flags the file sets and nothing
+// else has
+func (c *fileConfig) apply(fs *flag.FlagSet) {
+	for name, value := range c.environment() {
+		if _, ok := os.LookupEnv(name); !ok {
+			os.Setenv(name, value)
+		}
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range c.flags() {
+		if !given[name] {
+			fs.Set(name, value)
+		}
+	}
+}
+
+// parseTOML reads the part of TOML a config file needs: [tables] and
+// key = value pairs whose values are strings, integers, booleans or arrays
+// of those. An array may run over several lines.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: unsupported table header %s", n, line)
+			}
+			table = root
+			for _, part := range strings.Split(strings.Trim(line, "[]"), ".") {
+				part = strings.TrimSpace(part)
+				next, ok := table[part].(map[string]interface{})
+				if !ok {
+					if _, taken := table[part]; taken {
+						return nil, fmt.Errorf("line %d: %s is already a value", n, part)
+					}
+					next = make(map[string]interface{})
+					table[part] = next
+				}
+				table = next
+			}
+			continue
+		}
+		eq := -1
+		outsideTOMLStrings(line, func(i int, c byte) bool {
+			if c == '=' {
+				eq = i
+			}
+			return eq < 0
+		})
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		raw := strings.TrimSpace(line[eq+1:])
+		// An array continues until its brackets balance
+		start := n
+		for tomlDepth(raw) > 0 {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("line %d: %s: unterminated array", start, key)
+			}
+			n++
+			raw += " " + strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		}
+		value, err := parseTOMLValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", start, key, err)
+		}
+		if _, taken := table[key]; taken {
+			return nil, fmt.Errorf("line %d: %s is set twice", start, key)
+		}
+		table[key] = value
+	}
+	return root, scanner.Err()
+}
+
+func parseTOMLValue(raw string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`), strings.HasPrefix(raw, "'"):
+		if strings.HasPrefix(raw, "'") {
+			if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+				return nil, errors.New("unterminated string")
+			}
+			return raw[1 : len(raw)-1], nil
+		}
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") || tomlDepth(raw) != 0 {
+			return nil, errors.New("unterminated array")
+		}
+		items := []interface{}{}
+		for _, item := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case raw == "true", raw == "false":
+		return raw == "true", nil
+	}
+	if i, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64); err == nil {
+		return i, nil
+	}
+	return nil, fmt.Errorf("unsupported value %s", raw)
+}
+
+// splitTOMLArray splits an array's contents at the commas outside strings
+// and nested arrays
+func splitTOMLArray(s string) []string {
+	var items []string
+	depth, start := 0, 0
+	outsideTOMLStrings(s, func(i int, c byte) bool {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
+		return true
+	})
+	items = append(items, s[start:])
+	var trimmed []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
+
+// stripTOMLComment drops a # comment that isn't inside a string
+func stripTOMLComment(line string) string {
+	end := len(line)
+	outsideTOMLStrings(line, func(i int, c byte) bool {
+		if c == '#' {
+			end = i
+		}
+		return end == len(line)
+	})
+	return line[:end]
+}
+
+// tomlDepth is how many of s's arrays are still open at its end
+func tomlDepth(s string) int {
+	depth := 0
+	outsideTOMLStrings(s, func(_ int, c byte) bool {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		return true
+	})
+	return depth
+}
+
+// outsideTOMLStrings calls f with each byte of s, and its index, that isn't
+// part of a string, until f returns false. Basic strings ("...") take
+// backslash escapes, so \" doesn't end one but \\" does; literal strings
+// ('...') take none.
+func outsideTOMLStrings(s string, f func(i int, c byte) bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			// Skip what it escapes
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		default:
+			if !f(i, c) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The TOML reader must keep # inside strings, take escaped quotes and
+// backslashes, and read arrays that run over several lines.
+
+func TestParseTOML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		toml string
+		want map[string]interface{}
+	}{
+		{
+			name: "comment after a value",
+			toml: `location = "Netherlands" # where it is`,
+			want: map[string]interface{}{"location": "Netherlands"},
+		},
+		{
+			name: "hash in basic and literal strings",
+			toml: "a = \"x#y\" # comment\nb = 'p#q'",
+			want: map[string]interface{}{"a": "x#y", "b": "p#q"},
+		},
+		{
+			name: "escaped quote and hash",
+			toml: `a = "say \"#1\"" # comment`,
+			want: map[string]interface{}{"a": `say "#1"`},
+		},
+		{
+			name: "escaped backslash before the closing quote",
+			toml: `a = "C:\\" # comment`,
+			want: map[string]interface{}{"a": `C:\`},
+		},
+		{
+			name: "backslash in a literal string",
+			toml: `a = 'C:\' # comment`,
+			want: map[string]interface{}{"a": `C:\`},
+		},
+		{
+			name: "equals sign in a quoted key",
+			toml: `"a=b" = 1`,
+			want: map[string]interface{}{"a=b": int64(1)},
+		},
+		{
+			name: "one-line array with hashes and commas in strings",
+			toml: `tokens = ["alice:s#1", "bob:a,b"] # two`,
+			want: map[string]interface{}{"tokens": []interface{}{"alice:s#1", "bob:a,b"}},
+		},
+		{
+			name: "multi-line array with comments and a trailing comma",
+			toml: "[auth]\ntokens = [\n  \"alice:s#1\", # first\n  # nobody\n  'bob:x]y',\n]\n",
+			want: map[string]interface{}{"auth": map[string]interface{}{"tokens": []interface{}{"alice:s#1", "bob:x]y"}}},
+		},
+		{
+			name: "nested arrays",
+			toml: "a = [[1, 2],\n  [3]]",
+			want: map[string]interface{}{"a": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(3)}}},
+		},
+		{
+			name: "tables, integers and booleans",
+			toml: "[listen]\nport = 8_443\n[tls]\nenabled = true",
+			want: map[string]interface{}{
+				"listen": map[string]interface{}{"port": int64(8443)},
+				"tls":    map[string]interface{}{"enabled": true},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tc.toml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		toml string
+		want string
+	}{
+		{"tokens = [\n  \"a\",\n", "line 1: tokens: unterminated array"},
+		{"a = \"open # not a comment", "line 1: a:"},
+		{"a = [1]]", "line 1: a:"},
+		{"a = 1\na = 2", "line 2: a is set twice"},
+		{"[[servers]]", "line 1: unsupported table header"},
+		{"just a line", "line 1: expected key = value"},
+		{"a = [\n1,\n2\n]\nb = nope", "line 5: b: unsupported value"},
+	} {
+		_, err := parseTOML([]byte(tc.toml))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseTOML(%q) = %v, want an error with %q", tc.toml, err, tc.want)
+		}
+	}
+}
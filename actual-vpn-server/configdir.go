@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config files: CONFIG_DIR names directories of files named after environment
+// variables, the layout a Kubernetes ConfigMap or Secret mounted as a volume
+// produces. Several directories can be given separated by commas, so a
+// ConfigMap and a Secret can both be mounted; later ones win. The files are
+// applied over the environment at startup.
+//
+// Kubernetes rewrites mounted files when the ConfigMap or Secret changes. The
+// node rereads them every CONFIG_RELOAD_INTERVAL seconds and applies changes
+// to the settings that can change at runtime: authentication providers,
+// handshake variation and ALLOW_PRIVATE_DESTINATIONS. Changes to anything
+// else are logged and take effect on the next restart.
+
+// Settings applied by reloadSettings; everything else is read once at startup
+var reloadableSettings = map[string]bool{
+	"AUTH_TOKENS":                true,
+	"AUTH_TOKENS_FILE":           true,
+	"API_KEYS_URL":               true,
+	"JWT_JWKS_URL":               true,
+	"JWT_ISSUER":                 true,
+	"JWT_AUDIENCE":               true,
+	"OIDC_ISSUER":                true,
+	"OIDC_AUDIENCE":              true,
+	"SESSION_TOKEN_PUBLIC_KEYS":  true,
+	"HANDSHAKE_JITTER_MS":        true,
+	"HANDSHAKE_PADDING":          true,
+	"ALLOW_PRIVATE_DESTINATIONS": true,
+	"LOG_LEVEL":                  true,
+}
+
+type ConfigDir struct {
+	dirs     []string
+	interval time.Duration
+	// Values last read from the files
+	values map[string]string
+}
+
+func configDirFromEnv() *ConfigDir {
+	v := os.Getenv("CONFIG_DIR")
+	if v == "" {
+		return nil
+	}
+	c := &ConfigDir{interval: 30 * time.Second}
+	for _, dir := range strings.Split(v, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			c.dirs = append(c.dirs, dir)
+		}
+	}
+	if v := os.Getenv("CONFIG_RELOAD_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			c.interval = time.Duration(secs) * time.Second
+		} else {
+			slog.Warn("Ignoring invalid CONFIG_RELOAD_INTERVAL value", "value", v)
+		}
+	}
+	return c
+}
+
+// read returns the variables set by the files. Kubernetes keeps its own
+// bookkeeping in entries starting with "..", which are skipped.
+func (c *ConfigDir) read() map[string]string {
+	values := map[string]string{}
+	for _, dir := range c.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			slog.Warn("Failed to read config directory", "dir", dir, "err", err)
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			// Mounted keys are symlinks into the current ..data directory
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			values[name] = strings.TrimRight(string(data), "\r\n")
+		}
+	}
+	return values
+}
+
+// Load applies the files over the environment. It runs before anything
+// reads its settings.
+func (c *ConfigDir) Load() {
+	c.values = c.read()
+	for name, value := range c.values {
+		os.Setenv(name, value)
+	}
+	slog.Info("Loaded settings from config directories", "settings", len(c.values), "dirs", strings.Join(c.dirs, ","))
+}
+
+// Watch applies changes to the files forever. serverID is needed to rebuild
+// the authentication chain.
+func (c *ConfigDir) Watch(serverID string) {
+	for {
+		time.Sleep(c.interval)
+		values := c.read()
+
+		var changed, needRestart []string
+		for name, value := range values {
+			if old, ok := c.values[name]; !ok || old != value {
+				changed = append(changed, name)
+			}
+		}
+		for name := range c.values {
+			if _, ok := values[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		// Try the change on a new authentication chain first; a bad change is
+		// rolled back and leaves the running config alone
+		previous := map[string]string{}
+		var unset []string
+		for _, name := range changed {
+			if value, ok := os.LookupEnv(name); ok {
+				previous[name] = value
+			} else {
+				unset = append(unset, name)
+			}
+			if value, ok := values[name]; ok {
+				os.Setenv(name, value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+		if err := reloadAuth(serverID); err != nil {
+			slog.Warn("Not applying config change", "settings", strings.Join(changed, ","), "err", err)
+			for name, value := range previous {
+				os.Setenv(name, value)
+			}
+			for _, name := range unset {
+				os.Unsetenv(name)
+			}
+			continue
+		}
+
+		c.values = values
+		reloadSettings()
+		for _, name := range changed {
+			if !reloadableSettings[name] {
+				needRestart = append(needRestart, name)
+			}
+		}
+		slog.Info("Applied config change", "settings", strings.Join(changed, ","))
+		if len(needRestart) > 0 {
+			slog.Warn("Changes take effect after a restart", "settings", strings.Join(needRestart, ","))
+		}
+		configReloads.Inc()
+	}
+}
+
+var errDisablesAuth = errors.New("it would turn authentication off")
+
+// reloadAuth rebuilds the authentication chain from the environment,
+// rereading token files on the way. The running chain stays if the new one
+// fails to build or would turn authentication off.
+func reloadAuth(serverID string) error {
+	chain, err := authChainFromEnv(serverID)
+	if err == nil && authChain.Enabled() && !chain.Enabled() {
+		err = errDisablesAuth
+	}
+	if err != nil {
+		return err
+	}
+	authChain.Replace(chain)
+	return nil
+}
+
+var configReloads = registry.Counter("config_reloads_total", "Config file changes applied")
+
+// reloadSettings rereads the runtime-changeable settings other than
+// authentication from the environment
+func reloadSettings() {
+	allowPrivateDestinations.Store(os.Getenv("ALLOW_PRIVATE_DESTINATIONS") == "true")
+	handshakeJitter.Store(int64(handshakeJitterFromEnv()))
+	handshakePadding.Store(os.Getenv("HANDSHAKE_PADDING") == "true")
+	logLevel.Set(logLevelFromEnv())
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dashboards and alerts. "horse-vpn-server metrics bootstrap" writes a
+// Grafana dashboard and a Prometheus rule file for the metrics in the
+// registry, so they always match what this build pushes. Metrics reach
+// Prometheus through the StatsD sink and a statsd_exporter, which turns
+// "horsevpn.tunnels_active|#location:ams" into
+// horsevpn_tunnels_active{location="ams"}. Counters are graphed as rates,
+// gauges as they are. Alerts follow the metric names: counters ending in
+// _shed_total fire while anything is being shed, and _failures_total
+// counters fire when most attempts of the matching counter fail. With
+// TENANTS_FILE set, each tenant gets a row of its own. A last row, and an
+// alert, cover the sync server's synthetic probes through the nodes, which
+// Prometheus scrapes from the sync server's /metrics.
+const (
+	dashboardUID       = "horsevpn-node"
+	dashboardRateRange = "5m"
+
+	// Exported by the sync server; see sync-server/src/synthetic.ts
+	syntheticProbes  = "horsevpn_sync_synthetic_probes_total"
+	syntheticLatency = "horsevpn_sync_synthetic_latency_seconds"
+)
+
+type dashboardPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Datasource  map[string]string      `json:"datasource,omitempty"`
+	Targets     []map[string]string    `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+}
+
+type alertRule struct {
+	Alert       string
+	Expr        string
+	For         string
+	Severity    string
+	Summary     string
+	Description string
+}
+
+func runMetricsCommand(args []string) {
+	if len(args) == 0 || args[0] != "bootstrap" {
+		fmt.Fprintln(os.Stderr, "usage: horse-vpn-server metrics bootstrap [-out dir] [-prefix horsevpn_]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("metrics bootstrap", flag.ExitOnError)
+	out := fs.String("out", ".", "Directory to write horsevpn-dashboard.json and horsevpn-alerts.yml to")
+	prefix := fs.String("prefix", prometheusPrefix(), "Prefix of the metric names in Prometheus")
+	fs.Parse(args[1:])
+
+	// Tenant metrics are registered as tenants load
+	tenants, err := loadTenantsFromEnv("metrics-bootstrap")
+	if err != nil {
+		log.Fatal("Invalid tenant configuration: ", err)
+	}
+	var tenantNames []string
+	seen := make(map[string]bool)
+	for _, t := range tenants {
+		if !seen[t.Name] {
+			seen[t.Name] = true
+			tenantNames = append(tenantNames, t.Name)
+		}
+	}
+	sort.Strings(tenantNames)
+
+	files := map[string][]byte{
+		"horsevpn-dashboard.json": marshalJSON(buildDashboard(registry, *prefix, tenantNames), "  "),
+		"horsevpn-alerts.yml":     renderAlertRules(buildAlertRules(registry, *prefix)),
+	}
+	for name, data := range files {
+		path := filepath.Join(*out, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Wrote", path)
+	}
+}
+
+// marshalJSON encodes v without escaping the <, > and & of PromQL
+func marshalJSON(v interface{}, indent string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	enc.Encode(v)
+	return b.Bytes()
+}
+
+// prometheusPrefix is STATSD_PREFIX as statsd_exporter renders it
+func prometheusPrefix() string {
+	prefix := "horsevpn."
+	if v, ok := os.LookupEnv("STATSD_PREFIX"); ok {
+		prefix = v
+	}
+	return strings.NewReplacer(".", "_", "-", "_").Replace(prefix)
+}
+
+// metricQuery is what a panel plots for m
+func metricQuery(m *Metric, prefix string) string {
+	name := prefix + m.Name
+	switch m.Kind {
+	case kindCounter:
+		return fmt.Sprintf("sum by (location) (rate(%s{location=~\"$location\"}[%s]))", name, dashboardRateRange)
+	case kindHistogram:
+		return fmt.Sprintf("histogram_quantile(0.95, sum by (le, location) (rate(%s_bucket{location=~\"$location\"}[%s])))", name, dashboardRateRange)
+	}
+	return fmt.Sprintf("sum by (location) (%s{location=~\"$location\"})", name)
+}
+
+func metricUnit(m *Metric) string {
+	switch {
+	case strings.Contains(m.Name, "bytes"):
+		if m.Kind == kindCounter {
+			return "Bps"
+		}
+		return "bytes"
+	case m.Kind == kindCounter:
+		return "ops"
+	}
+	return "short"
+}
+
+func buildDashboard(r *Registry, prefix string, tenants []string) map[string]interface{} {
+	datasource := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+	var panels []dashboardPanel
+	y := 0
+	addRow := func(title string) {
+		panels = append(panels, dashboardPanel{
+			ID: len(panels) + 1, Type: "row", Title: title,
+			GridPos: map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+		})
+		y++
+	}
+	col := 0
+	addQueryPanel := func(title, description, expr, legend, unit string) {
+		panels = append(panels, dashboardPanel{
+			ID:          len(panels) + 1,
+			Type:        "timeseries",
+			Title:       title,
+			Description: description,
+			GridPos:     map[string]int{"h": 8, "w": 12, "x": col * 12, "y": y},
+			Datasource:  datasource,
+			Targets: []map[string]string{{
+				"refId":        "A",
+				"expr":         expr,
+				"legendFormat": legend,
+			}},
+			FieldConfig: map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": unit},
+				"overrides": []interface{}{},
+			},
+		})
+		if col++; col == 2 {
+			col = 0
+			y += 8
+		}
+	}
+	addPanel := func(m *Metric) {
+		if m.Kind == kindHistogram {
+			addQueryPanel(m.Help+", 95th percentile", prefix+m.Name, metricQuery(m, prefix), "{{location}}", "s")
+			return
+		}
+		addQueryPanel(m.Help, prefix+m.Name, metricQuery(m, prefix), "{{location}}", metricUnit(m))
+	}
+	endRow := func() {
+		if col != 0 {
+			col = 0
+			y += 8
+		}
+	}
+
+	// Gauges come first in each row, then counters, then histograms, each in
+	// registration order. A histogram family gets one panel.
+	rows := map[string][]*Metric{}
+	seen := make(map[string]bool)
+	r.Each(func(m *Metric) {
+		if seen[m.Name] {
+			return
+		}
+		seen[m.Name] = true
+		row := "Node"
+		for _, name := range tenants {
+			if strings.HasPrefix(m.Name, "tenant_"+name+"_") {
+				row = "Tenant " + name
+			}
+		}
+		rows[row] = append(rows[row], m)
+	})
+	titles := []string{"Node"}
+	for _, name := range tenants {
+		titles = append(titles, "Tenant "+name)
+	}
+	for _, title := range titles {
+		addRow(title)
+		for _, kind := range []metricKind{kindGauge, kindCounter, kindHistogram} {
+			for _, m := range rows[title] {
+				if m.Kind == kind {
+					addPanel(m)
+				}
+			}
+		}
+		endRow()
+	}
+	addRow("Synthetic probes")
+	addQueryPanel("Synthetic probes succeeding", syntheticProbes,
+		fmt.Sprintf("sum by (location) (rate(%s{result=\"success\",location=~\"$location\"}[%s])) / sum by (location) (rate(%s{location=~\"$location\"}[%s]))",
+			syntheticProbes, dashboardRateRange, syntheticProbes, dashboardRateRange),
+		"{{location}}", "percentunit")
+	addQueryPanel("Synthetic probe latency, 50th and 95th percentile", syntheticLatency,
+		fmt.Sprintf("histogram_quantile(0.95, sum by (le) (rate(%s_bucket[%s])))", syntheticLatency, dashboardRateRange),
+		"p95", "s")
+	panels[len(panels)-1].Targets = append(panels[len(panels)-1].Targets, map[string]string{
+		"refId":        "B",
+		"expr":         fmt.Sprintf("histogram_quantile(0.5, sum by (le) (rate(%s_bucket[%s])))", syntheticLatency, dashboardRateRange),
+		"legendFormat": "p50",
+	})
+	endRow()
+
+	return map[string]interface{}{
+		"uid":           dashboardUID,
+		"title":         "HorseVPN nodes",
+		"tags":          []string{"horsevpn"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{
+				{"name": "datasource", "label": "Data source", "type": "datasource", "query": "prometheus"},
+				{
+					"name":       "location",
+					"label":      "Location",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      fmt.Sprintf("label_values(%stunnels_active, location)", prefix),
+					"multi":      true,
+					"includeAll": true,
+					"allValue":   ".*",
+					"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+					"refresh":    2,
+				},
+			},
+		},
+		"panels": panels,
+	}
+}
+
+// alertName turns "relay_dial_failures_total" into
+// "HorseVPNRelayDialFailures"
+func alertName(metric string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(strings.TrimSuffix(metric, "_total"), "_") {
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return "HorseVPN" + b.String()
+}
+
+func buildAlertRules(r *Registry, prefix string) []alertRule {
+	names := make(map[string]*Metric)
+	r.Each(func(m *Metric) { names[m.Name] = m })
+
+	var rules []alertRule
+	r.Each(func(m *Metric) {
+		if m.Kind != kindCounter {
+			return
+		}
+		name := prefix + m.Name
+		switch {
+		case strings.HasSuffix(m.Name, "_shed_total"):
+			rules = append(rules, alertRule{
+				Alert:       alertName(m.Name),
+				Expr:        fmt.Sprintf("sum by (server_id, location) (rate(%s[%s])) > 0", name, dashboardRateRange),
+				For:         "10m",
+				Severity:    "warning",
+				Summary:     "{{ $labels.server_id }} is refusing tunnels",
+				Description: m.Help + " on {{ $labels.server_id }} ({{ $labels.location }}) for 10 minutes.",
+			})
+		case strings.HasSuffix(m.Name, "_failures_total"):
+			// registration_failures_total goes with registrations_total
+			attempts := names[strings.TrimSuffix(m.Name, "_failures_total")+"s_total"]
+			if attempts == nil {
+				return
+			}
+			rules = append(rules, alertRule{
+				Alert: alertName(m.Name),
+				Expr: fmt.Sprintf("sum by (server_id, location) (rate(%s[%s])) / sum by (server_id, location) (rate(%s[%s])) > 0.5",
+					name, dashboardRateRange, prefix+attempts.Name, dashboardRateRange),
+				For:         "15m",
+				Severity:    "warning",
+				Summary:     "Most attempts failing on {{ $labels.server_id }}",
+				Description: m.Help + ": {{ $value | humanizePercentage }} of attempts on {{ $labels.server_id }} ({{ $labels.location }}).",
+			})
+		}
+	})
+	rules = append(rules, alertRule{
+		Alert: "HorseVPNSyntheticProbesFailing",
+		Expr: fmt.Sprintf("sum by (location) (rate(%s{result=\"success\"}[%s])) / sum by (location) (rate(%s[%s])) < 0.8",
+			syntheticProbes, dashboardRateRange, syntheticProbes, dashboardRateRange),
+		For:         "15m",
+		Severity:    "critical",
+		Summary:     "Tunnels through {{ $labels.location }} are failing",
+		Description: "Only {{ $value | humanizePercentage }} of the sync server's synthetic probes through nodes in {{ $labels.location }} reached the target.",
+	})
+	return rules
+}
+
+// renderAlertRules writes a Prometheus rule file. Strings are written as
+// JSON strings, which YAML reads as double-quoted scalars.
+func renderAlertRules(rules []alertRule) []byte {
+	quote := func(s string) string {
+		return strings.TrimSuffix(string(marshalJSON(s, "")), "\n")
+	}
+	var b bytes.Buffer
+	b.WriteString("# Generated by horse-vpn-server metrics bootstrap; regenerate rather than edit\n")
+	b.WriteString("groups:\n  - name: horsevpn\n    rules:\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "      - alert: %s\n", r.Alert)
+		fmt.Fprintf(&b, "        expr: %s\n", quote(r.Expr))
+		fmt.Fprintf(&b, "        for: %s\n", r.For)
+		fmt.Fprintf(&b, "        labels:\n          severity: %s\n", r.Severity)
+		fmt.Fprintf(&b, "        annotations:\n          summary: %s\n          description: %s\n",
+			quote(r.Summary), quote(r.Description))
+	}
+	return b.Bytes()
+}
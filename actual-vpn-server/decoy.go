@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// The decoy site is what anyone who isn't a client sees at paths no
+// transport uses, so a node looks like an ordinary web server rather than a
+// VPN. With DECOY_SITE_DIR set it serves the files there; otherwise a bland
+// placeholder page.
+const decoyPlaceholder = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body>
+<h1>Welcome</h1>
+<p>This site is under construction.</p>
+</body>
+</html>
+`
+
+const decoyNotFound = `<!DOCTYPE html>
+<html>
+<head><title>404 Not Found</title></head>
+<body>
+<h1>Not Found</h1>
+<p>The requested URL was not found on this server.</p>
+</body>
+</html>
+`
+
+func decoyHandler() http.Handler {
+	if dir := os.Getenv("DECOY_SITE_DIR"); dir != "" {
+		return http.FileServer(http.Dir(dir))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(decoyNotFound))
+			return
+		}
+		w.Write([]byte(decoyPlaceholder))
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// allowPrivateDestinations lets tunnels reach loopback and private networks
+// on the node itself (ALLOW_PRIVATE_DESTINATIONS). Off by default so an exit
+// node can't be used to poke at its own host or the provider's internal
+// network. Set by reloadSettings.
+var allowPrivateDestinations atomic.Bool
+
+// destinationAllowed reports whether id's traffic may be relayed to ip and
+// port. id is nil when authentication is off.
+func destinationAllowed(id *Identity, ip net.IP, port int) bool {
+	if blocklists.ipBlockedBy(ip) != "" {
+		return false
+	}
+	if nodeACL != nil {
+		subject := ""
+		if id != nil {
+			subject = id.Subject
+		}
+		if matched, allowed := nodeACL.Check(subject, ip, port); matched {
+			return allowed
+		}
+		return !internalDestination(ip)
+	}
+	return allowPrivateDestinations.Load() || !internalDestination(ip)
+}
+
+func internalDestination(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
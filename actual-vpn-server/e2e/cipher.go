@@ -0,0 +1,142 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Cipher is the AEAD that seals records. A client lists the ones it takes
+// in CipherHeader on the tunnel request, the one it prefers first, and the
+// node answers with its pick in the same header. Without the header both
+// ends use ChaCha20-Poly1305. The cipher, ChaCha20-Poly1305 included, is
+// mixed into the key derivation, so a proxy that rewrites the headers breaks
+// the handshake instead of changing the cipher.
+type Cipher string
+
+const (
+	ChaCha20Poly1305 Cipher = "chacha20-poly1305"
+	AES256GCM        Cipher = "aes-256-gcm"
+)
+
+// CipherHeader is the tunnel request header listing the client's ciphers,
+// and the response header naming the node's pick
+const CipherHeader = "X-Tunnel-Cipher"
+
+// Ciphers are the ciphers there are
+var Ciphers = []Cipher{AES256GCM, ChaCha20Poly1305}
+
+// ParseCipher reads a cipher name as CipherHeader carries it
+func ParseCipher(s string) (Cipher, error) {
+	for _, c := range Ciphers {
+		if strings.EqualFold(strings.TrimSpace(s), string(c)) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("e2e: unknown cipher %q", s)
+}
+
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	if c == AES256GCM {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// HardwareAES reports whether the CPU has instructions for AES and for
+// GCM's multiplication. Without them AES-GCM is slow and its table lookups
+// leak timing, so it is never picked.
+func HardwareAES() bool {
+	return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+		cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+		cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+}
+
+const (
+	// benchmarkTime is how long Preferred seals records with each cipher
+	benchmarkTime = 20 * time.Millisecond
+	// benchmarkRecord is the size of the records it seals, a full record
+	benchmarkRecord = 16 << 10
+)
+
+var (
+	preferOnce sync.Once
+	preferred  Cipher
+)
+
+// Preferred returns the faster cipher on this machine, measured on first
+// use: ChaCha20-Poly1305 without hardware AES, and otherwise whichever
+// seals full records faster.
+func Preferred() Cipher {
+	preferOnce.Do(func() {
+		preferred = ChaCha20Poly1305
+		if HardwareAES() && Benchmark(AES256GCM, benchmarkTime) > Benchmark(ChaCha20Poly1305, benchmarkTime) {
+			preferred = AES256GCM
+		}
+	})
+	return preferred
+}
+
+// Benchmark seals full records with c for about d and returns how many
+// bytes a second it managed
+func Benchmark(c Cipher, d time.Duration) float64 {
+	aead, err := c.aead(make([]byte, chacha20poly1305.KeySize))
+	if err != nil {
+		return 0
+	}
+	buf := make([]byte, benchmarkRecord, benchmarkRecord+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+	sealed := 0
+	start := time.Now()
+	for seq := uint64(0); time.Since(start) < d; seq++ {
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+		aead.Seal(buf[:0], nonce, buf, nil)
+		sealed += len(buf)
+	}
+	return float64(sealed) / time.Since(start).Seconds()
+}
+
+// Offer is the CipherHeader value of a client that prefers first
+func Offer(first Cipher) string {
+	names := []string{string(first)}
+	for _, c := range Ciphers {
+		if c != first {
+			names = append(names, string(c))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Choose picks the cipher for a tunnel from a client's CipherHeader: prefer
+// if the client offers it, else the first offered one this package knows,
+// and ChaCha20-Poly1305 if it offers none.
+func Choose(offer string, prefer Cipher) Cipher {
+	var first Cipher
+	for _, name := range strings.Split(offer, ",") {
+		c, err := ParseCipher(name)
+		if err != nil {
+			continue
+		}
+		if c == prefer {
+			return c
+		}
+		if first == "" {
+			first = c
+		}
+	}
+	if first == "" {
+		return ChaCha20Poly1305
+	}
+	return first
+}
@@ -0,0 +1,81 @@
+package e2e
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCipher(t *testing.T) {
+	for _, c := range Ciphers {
+		got, err := ParseCipher(" " + string(c) + " ")
+		if err != nil || got != c {
+			t.Errorf("ParseCipher(%q) = %q, %v", c, got, err)
+		}
+	}
+	if got, err := ParseCipher("AES-256-GCM"); err != nil || got != AES256GCM {
+		t.Errorf("ParseCipher is case-sensitive: %q, %v", got, err)
+	}
+	if _, err := ParseCipher("aes-128-cbc"); err == nil {
+		t.Error("ParseCipher took an unknown cipher")
+	}
+}
+
+func TestChoose(t *testing.T) {
+	for _, tc := range []struct {
+		offer  string
+		prefer Cipher
+		want   Cipher
+	}{
+		{"", AES256GCM, ChaCha20Poly1305},
+		{"aes-128-cbc", AES256GCM, ChaCha20Poly1305},
+		{"chacha20-poly1305", AES256GCM, ChaCha20Poly1305},
+		{"aes-256-gcm, chacha20-poly1305", ChaCha20Poly1305, ChaCha20Poly1305},
+		{"chacha20-poly1305, aes-256-gcm", AES256GCM, AES256GCM},
+		{"aes-128-cbc, aes-256-gcm", ChaCha20Poly1305, AES256GCM},
+	} {
+		if got := Choose(tc.offer, tc.prefer); got != tc.want {
+			t.Errorf("Choose(%q, %q) = %q, want %q", tc.offer, tc.prefer, got, tc.want)
+		}
+	}
+}
+
+// A client offering every cipher gets the node's preferred one, whichever
+// it prefers itself, so both ends agree on what the node picked
+func TestOfferChooseAgree(t *testing.T) {
+	for _, client := range Ciphers {
+		offer := Offer(client)
+		if first, _ := ParseCipher(strings.Split(offer, ",")[0]); first != client {
+			t.Errorf("Offer(%q) = %q, doesn't list it first", client, offer)
+		}
+		for _, node := range Ciphers {
+			if got := Choose(offer, node); got != node {
+				t.Errorf("node preferring %q picked %q from %q", node, got, offer)
+			}
+		}
+	}
+	// Two ends on the same machine prefer the same cipher
+	if got := Choose(Offer(Preferred()), Preferred()); got != Preferred() {
+		t.Errorf("Choose(Offer(Preferred())) = %q, want %q", got, Preferred())
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	c := Preferred()
+	if _, err := ParseCipher(string(c)); err != nil {
+		t.Fatal(err)
+	}
+	if !HardwareAES() && c != ChaCha20Poly1305 {
+		t.Errorf("Preferred() = %q without hardware AES", c)
+	}
+	if Preferred() != c {
+		t.Error("Preferred() changed between calls")
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	for _, c := range Ciphers {
+		if rate := Benchmark(c, benchmarkTime); rate <= 0 {
+			t.Errorf("Benchmark(%q) = %v", c, rate)
+		}
+	}
+}
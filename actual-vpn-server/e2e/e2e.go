@@ -0,0 +1,340 @@
+// Package e2e encrypts a tunnel's byte stream between the client and the
+// node, whatever carries it. Cloudflare and other proxies in front of a node
+// terminate TLS and see the tunnel in the clear, and ws:// has no TLS at all;
+// with e2e they only see ciphertext.
+//
+// The handshake takes one round trip. The client knows the node's static
+// X25519 public key, which nodes register with the sync server:
+//
+//	client: e                     (32 bytes, ephemeral public key)
+//	node:   e', confirm record    (32 bytes, then a sealed empty record)
+//
+// Both sides derive one key per direction with HKDF-SHA256 from
+// DH(e, static) and DH(e, e'), so only the holder of the node's private key
+// can produce the confirm record, and the session keys are forgotten with
+// the ephemeral keys. After that the stream is a sequence of records:
+//
+//	length (2 bytes, big endian) | AEAD(type | data)
+//
+// with a per-direction counter as the nonce. The AEAD is ChaCha20-Poly1305,
+// or AES-256-GCM where both ends agree on it (see Cipher), and its name goes
+// into the key derivation. A record of type end is the authenticated end of
+// one direction, so a proxy can't truncate the stream unnoticed.
+package e2e
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Header is the tunnel request header that asks for encryption, and the
+// response header that agrees to it
+const Header = "X-Tunnel-Encryption"
+
+// Version is the only value of Header there is so far
+const Version = "e2e1"
+
+// MaxRecord is the most data one record carries
+const MaxRecord = 16 << 10
+
+const (
+	recordData byte = iota
+	recordEnd
+	recordConfirm
+)
+
+const (
+	keySize = 32
+	kdfSalt = "horsevpn e2e1"
+)
+
+var (
+	ErrWriteClosed  = errors.New("e2e: write side closed")
+	errBadRecord    = errors.New("e2e: record failed authentication")
+	errUnexpected   = errors.New("e2e: unexpected record type")
+	errNotConfirmed = errors.New("e2e: node did not prove its key")
+)
+
+// GenerateKey returns a new static key for a node
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParsePrivateKey reads a static key as written by EncodePrivateKey
+func ParsePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: invalid private key: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+func EncodePrivateKey(k *ecdh.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(k.Bytes())
+}
+
+// ParsePublicKey reads a node's public key in base64, as the sync server
+// lists it
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: invalid public key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func EncodePublicKey(k *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(k.Bytes())
+}
+
+// Conn is an encrypted stream over another. Reads and writes may happen
+// concurrently, as on a net.Conn. Records are sealed and opened in place in
+// one buffer per direction, so a running stream doesn't allocate.
+type Conn struct {
+	inner io.ReadWriteCloser
+
+	readMu    sync.Mutex
+	open      cipher.AEAD
+	readSeq   uint64
+	readHead  [2]byte
+	readBuf   []byte
+	readNonce [chacha20poly1305.NonceSize]byte
+	// Opened data not yet read, in readBuf
+	pending []byte
+	readEnd bool
+
+	writeMu     sync.Mutex
+	seal        cipher.AEAD
+	writeSeq    uint64
+	writeBuf    []byte
+	writeNonce  [chacha20poly1305.NonceSize]byte
+	writeClosed bool
+}
+
+// Client runs the client's side of the handshake over inner with the node
+// whose static key is node, sealing records with the cipher the node picked
+func Client(inner io.ReadWriteCloser, node *ecdh.PublicKey, aead Cipher) (*Conn, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFull(inner, e.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	peer := make([]byte, keySize)
+	if _, err := io.ReadFull(inner, peer); err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	static, err := e.ECDH(node)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := e.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c, err := deriveKeys(aead, static, shared, e.PublicKey(), ephemeral, node)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{inner: inner, seal: c2s, open: s2c}
+	kind, _, err := c.readRecord()
+	if err != nil || kind != recordConfirm {
+		return nil, errNotConfirmed
+	}
+	return c, nil
+}
+
+// Server runs the node's side of the handshake over inner with its static
+// key, sealing records with the cipher it picked
+func Server(inner io.ReadWriteCloser, key *ecdh.PrivateKey, aead Cipher) (*Conn, error) {
+	peer := make([]byte, keySize)
+	if _, err := io.ReadFull(inner, peer); err != nil {
+		return nil, err
+	}
+	client, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	static, err := key.ECDH(client)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := e.ECDH(client)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c, err := deriveKeys(aead, static, shared, client, e.PublicKey(), key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{inner: inner, seal: s2c, open: c2s}
+	if err := writeFull(inner, e.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	if err := c.writeRecord(recordConfirm, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func deriveKeys(aead Cipher, static, shared []byte, client, node, nodeStatic *ecdh.PublicKey) (c2s, s2c cipher.AEAD, err error) {
+	secret := append(append([]byte(nil), static...), shared...)
+	var info []byte
+	info = append(info, client.Bytes()...)
+	info = append(info, node.Bytes()...)
+	info = append(info, nodeStatic.Bytes()...)
+	info = append(info, aead...)
+	keys := make([]byte, 2*keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, []byte(kdfSalt), info), keys); err != nil {
+		return nil, nil, err
+	}
+	if c2s, err = aead.aead(keys[:keySize]); err != nil {
+		return nil, nil, err
+	}
+	if s2c, err = aead.aead(keys[keySize:]); err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+// nonce fills n with the nonce for record seq
+func nonce(n *[chacha20poly1305.NonceSize]byte, seq uint64) []byte {
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n[:]
+}
+
+func writeFull(w io.Writer, b []byte) error {
+	_, err := w.Write(b)
+	return err
+}
+
+// writeRecord seals and writes one record; callers hold writeMu or have the
+// connection to themselves
+func (c *Conn) writeRecord(kind byte, data []byte) error {
+	if need := 2 + 1 + len(data) + c.seal.Overhead(); cap(c.writeBuf) < need {
+		c.writeBuf = make([]byte, max(need, 2+1+MaxRecord+c.seal.Overhead()))
+	}
+	buf := c.writeBuf[:2+1+len(data)]
+	buf[2] = kind
+	copy(buf[3:], data)
+	// Sealed over the plaintext, which starts where the output does
+	record := c.seal.Seal(buf[:2], nonce(&c.writeNonce, c.writeSeq), buf[2:], nil)
+	binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+	c.writeSeq++
+	return writeFull(c.inner, record)
+}
+
+// readRecord reads and opens one record; callers hold readMu or have the
+// connection to themselves
+func (c *Conn) readRecord() (byte, []byte, error) {
+	head := c.readHead[:]
+	if _, err := io.ReadFull(c.inner, head); err != nil {
+		if err == io.EOF {
+			// The far end never said it was done
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	// The previous record's data has all been read by now, so its buffer
+	// can be reused
+	n := int(binary.BigEndian.Uint16(head))
+	if cap(c.readBuf) < n {
+		c.readBuf = make([]byte, max(n, 1+MaxRecord+c.open.Overhead()))
+	}
+	record := c.readBuf[:n]
+	if _, err := io.ReadFull(c.inner, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	plain, err := c.open.Open(record[:0], nonce(&c.readNonce, c.readSeq), record, nil)
+	if err != nil || len(plain) == 0 {
+		return 0, nil, errBadRecord
+	}
+	c.readSeq++
+	return plain[0], plain[1:], nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		if c.readEnd {
+			return 0, io.EOF
+		}
+		kind, data, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case recordData:
+			c.pending = data
+		case recordEnd:
+			c.readEnd = true
+		default:
+			return 0, errUnexpected
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), MaxRecord)
+		if err := c.writeRecord(recordData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite ends the stream in this direction; reading goes on.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	return c.writeRecord(recordEnd, nil)
+}
+
+// Inner returns the stream the records travel over.
+func (c *Conn) Inner() io.ReadWriteCloser {
+	return c.inner
+}
+
+func (c *Conn) Close() error {
+	return c.inner.Close()
+}
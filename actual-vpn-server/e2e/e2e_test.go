@@ -0,0 +1,101 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshake runs both sides over a pipe with the ciphers each end picked
+func handshake(t *testing.T, client, node Cipher) (*Conn, *Conn, error) {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	t.Cleanup(func() { c.Close(); s.Close() })
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Server(s, key, node)
+		done <- result{conn, err}
+	}()
+	cc, err := Client(c, key.PublicKey(), client)
+	if err != nil {
+		c.Close()
+	}
+	r := <-done
+	if err == nil {
+		err = r.err
+	}
+	return cc, r.conn, err
+}
+
+func TestHandshake(t *testing.T) {
+	for _, cipher := range Ciphers {
+		t.Run(string(cipher), func(t *testing.T) {
+			client, node, err := handshake(t, cipher, cipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				client.Write([]byte("hello"))
+				client.CloseWrite()
+			}()
+			got, err := io.ReadAll(node)
+			if err != nil || string(got) != "hello" {
+				t.Errorf("node read %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// Ends that disagree on the cipher fail the handshake rather than talk
+func TestHandshakeCipherMismatch(t *testing.T) {
+	if _, _, err := handshake(t, ChaCha20Poly1305, AES256GCM); err == nil {
+		t.Error("handshake with different ciphers succeeded")
+	}
+}
+
+// The cipher's name goes into the keys, so two ciphers never share keys;
+// an unknown name seals with ChaCha20-Poly1305 like ChaCha20-Poly1305
+// itself, and still must not open its records
+func TestKeysBindCipher(t *testing.T) {
+	static := make([]byte, keySize)
+	shared := make([]byte, keySize)
+	rand.Read(static)
+	rand.Read(shared)
+	client, _ := GenerateKey()
+	node, _ := GenerateKey()
+	nodeStatic, _ := GenerateKey()
+	seal := func(c Cipher) []byte {
+		c2s, _, err := deriveKeys(c, static, shared, client.PublicKey(), node.PublicKey(), nodeStatic.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c2s.Seal(nil, make([]byte, c2s.NonceSize()), []byte("record"), nil)
+	}
+	open := func(c Cipher, sealed []byte) error {
+		c2s, _, err := deriveKeys(c, static, shared, client.PublicKey(), node.PublicKey(), nodeStatic.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c2s.Open(nil, make([]byte, c2s.NonceSize()), sealed, nil)
+		return err
+	}
+	sealed := seal(ChaCha20Poly1305)
+	if err := open(ChaCha20Poly1305, sealed); err != nil {
+		t.Fatalf("same cipher: %v", err)
+	}
+	if err := open("chacha20-poly1305-other", sealed); err == nil {
+		t.Error("keys for another cipher name opened a ChaCha20-Poly1305 record")
+	}
+	if err := open(AES256GCM, sealed); err == nil {
+		t.Error("AES-256-GCM keys opened a ChaCha20-Poly1305 record")
+	}
+}
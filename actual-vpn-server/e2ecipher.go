@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+
+	"horse-vpn-server/e2e"
+)
+
+// The cipher the node prefers for end-to-end encrypted tunnels: the one
+// -e2e-cipher or E2E_CIPHER names, or else whichever of AES-256-GCM and
+// ChaCha20-Poly1305 was faster in a benchmark at startup. It is picked
+// whenever the client offers it.
+var nodeE2ECipher = e2e.ChaCha20Poly1305
+
+// e2eCipherFromFlag returns the cipher the node prefers: the one named by
+// the -e2e-cipher flag or E2E_CIPHER, or else the faster on this machine
+func e2eCipherFromFlag(name string) e2e.Cipher {
+	if name == "" {
+		name = os.Getenv("E2E_CIPHER")
+	}
+	if name != "" {
+		c, err := e2e.ParseCipher(name)
+		if err != nil {
+			log.Fatal("Invalid end-to-end encryption cipher: ", err)
+		}
+		return c
+	}
+	c := e2e.Preferred()
+	slog.Info("Picked the end-to-end encryption cipher", "cipher", c, "hardwareAES", e2e.HardwareAES())
+	return c
+}
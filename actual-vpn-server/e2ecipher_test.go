@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/e2e"
+)
+
+// The node answers with the cipher e2e.Choose picks from the client's
+// offer, and a client sealing with that cipher completes the handshake
+func TestE2ECipherNegotiation(t *testing.T) {
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeE2EKey = key
+	defer func() { nodeE2EKey, nodeE2ECipher = nil, e2e.ChaCha20Poly1305 }()
+	node := startTestNode(t)
+
+	for _, tc := range []struct {
+		name   string
+		prefer e2e.Cipher
+		offer  string
+		want   e2e.Cipher
+	}{
+		{"no offer", e2e.AES256GCM, "", e2e.ChaCha20Poly1305},
+		{"node's preference offered second", e2e.AES256GCM, e2e.Offer(e2e.ChaCha20Poly1305), e2e.AES256GCM},
+		{"node's preference not offered", e2e.ChaCha20Poly1305, string(e2e.AES256GCM), e2e.AES256GCM},
+		{"unknown ciphers ignored", e2e.AES256GCM, "aes-128-cbc", e2e.ChaCha20Poly1305},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeE2ECipher = tc.prefer
+			h := http.Header{"Origin": {"http://localhost"}, e2e.Header: {e2e.Version}}
+			if tc.offer != "" {
+				h.Set(e2e.CipherHeader, tc.offer)
+			}
+			d := websocket.Dialer{Subprotocols: []string{"vpn-protocol"}}
+			ws, resp, err := d.Dial("ws"+strings.TrimPrefix(node.http.URL, "http")+"/ws", h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &wsClientConn{conn: ws}
+			defer conn.Close()
+			picked, err := e2e.ParseCipher(resp.Header.Get(e2e.CipherHeader))
+			if err != nil || picked != tc.want {
+				t.Fatalf("node picked %q, %v; want %q", picked, err, tc.want)
+			}
+			sealed, err := e2e.Client(conn, key.PublicKey(), picked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sealed.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(sealed, got); err != nil || string(got) != "ping" {
+				t.Errorf("echo %q, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Egress addresses. On a node with several public addresses, EGRESS_IPS
+// lists the ones tunnels may leave from and EGRESS_POLICY says how a tunnel
+// gets one: "rotate" (default) takes them in turn, one per connection to a
+// destination, and "sticky" keeps each user on one address. EGRESS_USER_IPS
+// pins users to an address, as "subject=ip" pairs. A client can ask for a
+// particular address of the pool with the X-Egress-Ip header on the tunnel
+// request, and a client with a multiplexed tunnel can move it to the next
+// address with a rotate control frame (see tunnelmux.go). Tenants have
+// pools of their own; see tenants.go. The node binds
+// each outbound socket to the chosen address before connecting. Addresses
+// only serve destinations of their own family; with none of the right
+// family, the system picks as usual.
+const (
+	egressRotate = "rotate"
+	egressSticky = "sticky"
+)
+
+// EgressPool is a set of local addresses and the policy for choosing among
+// them. A nil pool chooses nothing.
+type EgressPool struct {
+	ips    []net.IP
+	sticky bool
+	users  map[string]net.IP
+
+	// Rotation positions for IPv4 and IPv6
+	next [2]atomic.Uint64
+}
+
+var egressPool *EgressPool
+
+var egressRotations = registry.Counter("egress_rotations_total", "Multiplexed tunnels moved to another egress address at the client's request")
+
+func egressPoolFromEnv() (*EgressPool, error) {
+	users := make(map[string]string)
+	if v := os.Getenv("EGRESS_USER_IPS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			user, ip, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("invalid EGRESS_USER_IPS entry %q", pair)
+			}
+			users[user] = ip
+		}
+	}
+	var ips []string
+	if v := os.Getenv("EGRESS_IPS"); v != "" {
+		ips = strings.Split(v, ",")
+	}
+	return newEgressPool(ips, os.Getenv("EGRESS_POLICY"), users)
+}
+
+// newEgressPool returns nil when no addresses are given
+func newEgressPool(ips []string, policy string, users map[string]string) (*EgressPool, error) {
+	if len(ips) == 0 && len(users) == 0 {
+		return nil, nil
+	}
+	p := &EgressPool{users: make(map[string]net.IP)}
+	switch policy {
+	case "", egressRotate:
+	case egressSticky:
+		p.sticky = true
+	default:
+		return nil, fmt.Errorf("unknown egress policy %q", policy)
+	}
+	for _, s := range ips {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address %q", s)
+		}
+		p.ips = append(p.ips, ip)
+	}
+	for user, s := range users {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address %q for %s", s, user)
+		}
+		p.users[user] = ip
+	}
+	return p, nil
+}
+
+// has reports whether ip is one of the pool's addresses, pinned ones
+// included
+func (p *EgressPool) has(ip net.IP) bool {
+	for _, a := range p.ips {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	for _, a := range p.users {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses the address for a connection of user's to a destination of
+// the given family
+func (p *EgressPool) pick(user string, hint net.IP, v4 bool) net.IP {
+	if p == nil {
+		return nil
+	}
+	if hint != nil && (hint.To4() != nil) == v4 && p.has(hint) {
+		return hint
+	}
+	if ip := p.users[user]; ip != nil && (ip.To4() != nil) == v4 {
+		return ip
+	}
+	family := p.family(v4)
+	if len(family) == 0 {
+		return nil
+	}
+	if p.sticky {
+		h := fnv.New32a()
+		h.Write([]byte(user))
+		return family[h.Sum32()%uint32(len(family))]
+	}
+	next := &p.next[0]
+	if !v4 {
+		next = &p.next[1]
+	}
+	return family[(next.Add(1)-1)%uint64(len(family))]
+}
+
+// family returns the pool's unpinned addresses of one family
+func (p *EgressPool) family(v4 bool) []net.IP {
+	var family []net.IP
+	for _, ip := range p.ips {
+		if (ip.To4() != nil) == v4 {
+			family = append(family, ip)
+		}
+	}
+	return family
+}
+
+// Egress chooses the local addresses a tunnel's connections leave from
+type Egress struct {
+	pool *EgressPool
+	// Pins in a tenant's pool name users without the tenant prefix
+	user string
+	hint net.IP
+	// Set for a multiplexed tunnel, whose streams share it
+	rotation *egressRotation
+}
+
+// egressRotation is where a multiplexed tunnel's connections leave from
+// after the client asked to rotate, by family as in EgressPool.next. It
+// wins over the hint and the policy, but not over a pin.
+type egressRotation struct {
+	mu  sync.Mutex
+	ips [2]net.IP
+}
+
+// egressFor returns the egress for a tunnel of id's opened with r, which
+// is nil on transports without headers
+func egressFor(id *Identity, r *http.Request) Egress {
+	e := Egress{pool: egressPool}
+	if id != nil {
+		e.user = id.Subject
+		if tenant := id.tenantOf(); tenant != nil {
+			e.pool = tenant.egress
+			e.user = strings.TrimPrefix(id.Subject, tenant.Name+"/")
+		}
+	}
+	if r != nil {
+		e.hint = net.ParseIP(r.Header.Get("X-Egress-Ip"))
+	}
+	return e
+}
+
+// pick chooses the address for a connection to a destination of the given
+// family
+func (e Egress) pick(v4 bool) net.IP {
+	if e.rotation != nil && e.pool != nil && e.pool.users[e.user] == nil {
+		f := 0
+		if !v4 {
+			f = 1
+		}
+		e.rotation.mu.Lock()
+		ip := e.rotation.ips[f]
+		e.rotation.mu.Unlock()
+		if ip != nil {
+			return ip
+		}
+	}
+	return e.pool.pick(e.user, e.hint, v4)
+}
+
+// rotate moves the tunnel to the address after the one it leaves from, in
+// each family with another address to go to, and returns the new ones.
+// It returns none for a pinned user.
+func (e Egress) rotate() []net.IP {
+	if e.rotation == nil || e.pool == nil || e.pool.users[e.user] != nil {
+		return nil
+	}
+	e.rotation.mu.Lock()
+	defer e.rotation.mu.Unlock()
+	var moved []net.IP
+	for f, v4 := range []bool{true, false} {
+		family := e.pool.family(v4)
+		if len(family) < 2 {
+			continue
+		}
+		current := e.rotation.ips[f]
+		if current == nil {
+			current = e.pool.pick(e.user, e.hint, v4)
+		}
+		next := family[0]
+		for i, ip := range family {
+			if ip.Equal(current) {
+				next = family[(i+1)%len(family)]
+			}
+		}
+		e.rotation.ips[f] = next
+		moved = append(moved, next)
+	}
+	return moved
+}
+
+// dialer returns a dialer for connecting to dst
+func (e Egress) dialer(dst net.IP) *net.Dialer {
+	ip := e.pick(dst.To4() != nil)
+	if ip == nil {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+}
+
+// egressLabel names the address dialer dials from in metrics: the egress
+// address, or "system" when the system picks
+func egressLabel(dialer *net.Dialer) string {
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "system"
+}
+
+// udpAddr returns the address a UDP relay's socket is bound to. One socket
+// serves every destination, so an IPv4 address is preferred; nil lets the
+// system choose.
+func (e Egress) udpAddr() *net.UDPAddr {
+	ip := e.pick(true)
+	if ip == nil {
+		ip = e.pick(false)
+	}
+	if ip == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// Rotating a multiplexed tunnel moves it to the next address of each family
+// with another to go to, round the pool, and leaves pinned users alone.
+
+func TestEgressRotate(t *testing.T) {
+	pool, err := newEgressPool([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"}, egressSticky,
+		map[string]string{"pinned": "192.0.2.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Egress{pool: pool, user: "alice", hint: net.ParseIP("192.0.2.3"), rotation: &egressRotation{}}
+	if got := e.pick(true); !got.Equal(net.ParseIP("192.0.2.3")) {
+		t.Fatalf("before rotating: %s, want the hint", got)
+	}
+	for _, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		moved := e.rotate()
+		// The only IPv6 address stays
+		if len(moved) != 1 || !moved[0].Equal(net.ParseIP(want)) {
+			t.Fatalf("rotate = %v, want [%s]", moved, want)
+		}
+		if got := e.pick(true); !got.Equal(net.ParseIP(want)) {
+			t.Fatalf("after rotating: %s, want %s", got, want)
+		}
+		if got := e.pick(false); !got.Equal(net.ParseIP("2001:db8::1")) {
+			t.Fatalf("IPv6 after rotating: %s", got)
+		}
+	}
+
+	pinned := Egress{pool: pool, user: "pinned", rotation: &egressRotation{}}
+	if moved := pinned.rotate(); len(moved) != 0 {
+		t.Errorf("pinned user rotated to %v", moved)
+	}
+	if moved := (Egress{user: "alice", rotation: &egressRotation{}}).rotate(); len(moved) != 0 {
+		t.Errorf("no pool rotated to %v", moved)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// IPv4-only exits. A node whose host has no IPv6 route to the internet
+// can't reach IPv6 destinations, and clients would wait for every such dial
+// to fail before trying IPv4. EXIT_IPV6 says whether the exit has IPv6:
+// "auto" (default) checks for a route at startup, "on" and "off" say so.
+// Without it the relay looks up only A records and answers IPv6
+// destinations with "network unreachable" at once, so clients move on to
+// IPv4 straight away.
+var exitIPv6 = true
+
+var errNoExitIPv6 = errors.New("this node's exit has no IPv6")
+
+func exitIPv6FromEnv() bool {
+	switch v := os.Getenv("EXIT_IPV6"); v {
+	case "on":
+		return true
+	case "off":
+		return false
+	case "", "auto":
+	default:
+		slog.Warn("Ignoring invalid EXIT_IPV6 value", "value", v)
+	}
+	return hasIPv6Route()
+}
+
+// hasIPv6Route reports whether the host would route to a public IPv6
+// address. Connecting a UDP socket sends nothing.
+func hasIPv6Route() bool {
+	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53")
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake variation makes nodes answer tunnel handshakes a little
+// differently each time, so the fleet doesn't share one timing and size
+// fingerprint a censor can block wholesale. HANDSHAKE_JITTER_MS delays each
+// handshake by a random amount up to that many milliseconds, and
+// HANDSHAKE_PADDING pads handshake responses with a cookie of random
+// length. Both are off by default, and set by reloadSettings.
+var (
+	// A time.Duration
+	handshakeJitter  atomic.Int64
+	handshakePadding atomic.Bool
+)
+
+func handshakeJitterFromEnv() time.Duration {
+	if v := os.Getenv("HANDSHAKE_JITTER_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		slog.Warn("Ignoring invalid HANDSHAKE_JITTER_MS value", "value", v)
+	}
+	return 0
+}
+
+// varyHandshake waits out the jitter and returns headers to send with the
+// handshake response, or nil if padding is off.
+func varyHandshake() http.Header {
+	if jitter := time.Duration(handshakeJitter.Load()); jitter > 0 {
+		time.Sleep(randomDuration(jitter))
+	}
+	if !handshakePadding.Load() {
+		return nil
+	}
+
+	// 8 to 192 bytes of padding, as a cookie like any site might set
+	n, _ := rand.Int(rand.Reader, big.NewInt(185))
+	pad := make([]byte, 8+n.Int64())
+	rand.Read(pad)
+	h := http.Header{}
+	h.Set("Set-Cookie", "_s="+base64.RawURLEncoding.EncodeToString(pad)+"; Path=/; Secure; HttpOnly")
+	return h
+}
+
+func randomDuration(max time.Duration) time.Duration {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n.Int64())
+}
+
+// addHeaders copies h into the response headers of w.
+func addHeaders(w http.ResponseWriter, h http.Header) {
+	for k, v := range h {
+		w.Header()[k] = v
+	}
+}
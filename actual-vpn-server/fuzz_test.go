@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// Fuzz targets for what the node parses from clients before or without
+// authenticating them. Each runs its seeds under go test; to fuzz one:
+//
+//   go test -run '^$' -fuzz FuzzParseUDPDatagram -fuzztime 1m
+//
+// FuzzTunnelFraming opens a tunnel per input, so keep minimizing short or
+// each new input stalls fuzzing for a minute: add -fuzzminimizetime 2s.
+
+// FuzzTunnelFraming sends data to the node as WebSocket messages of the
+// given size, ends with the empty message that closes the client's
+// direction, and expects the same bytes echoed back followed by the node's
+// own empty message.
+func FuzzTunnelFraming(f *testing.F) {
+	f.Add([]byte("hello"), uint32(1))
+	f.Add(bytes.Repeat([]byte{0xff}, 10000), uint32(4096))
+	f.Add(bytes.Repeat([]byte("horse"), 20000), uint32(65536))
+	f.Add([]byte{}, uint32(0))
+
+	node := startTestNode(f)
+	ws := testTransports[1]
+	f.Fuzz(func(t *testing.T, data []byte, size uint32) {
+		// At most a few hundred messages, or large inputs crawl
+		size = max(1+size%uint32(maxTunnelMessage), uint32(len(data)/256+1))
+		conn := mustDial(t, node, ws).(*wsClientConn)
+		defer conn.Close()
+
+		go func() {
+			for rest := data; len(rest) > 0; {
+				n := min(len(rest), int(size))
+				if err := conn.conn.WriteMessage(websocket.BinaryMessage, rest[:n]); err != nil {
+					return
+				}
+				rest = rest[n:]
+			}
+			conn.conn.WriteMessage(websocket.BinaryMessage, nil)
+		}()
+
+		conn.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		echoed, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("after %d of %d bytes: %v", len(echoed), len(data), err)
+		}
+		if !bytes.Equal(echoed, data) {
+			t.Fatalf("echoed %d bytes differ from the %d sent", len(echoed), len(data))
+		}
+	})
+}
+
+func FuzzParseUDPDatagram(f *testing.F) {
+	f.Add([]byte{0, 0, 0, atypIPv4, 127, 0, 0, 1, 0, 53, 'x'})
+	f.Add([]byte{0, 0, 0, atypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187})
+	f.Add([]byte{0, 0, 0, atypDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80, 'h', 'i'})
+	f.Add([]byte{0, 0, 0, atypDomain, 255})
+	f.Add([]byte{0, 0, 1, atypIPv4, 127, 0, 0, 1, 0, 53})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		host, port, payload, err := parseUDPDatagram(b)
+		if err != nil {
+			return
+		}
+		if port < 0 || port > 65535 {
+			t.Fatalf("port %d out of range", port)
+		}
+		if !bytes.HasSuffix(b, payload) {
+			t.Fatal("payload is not the end of the datagram")
+		}
+
+		// Addresses the node sends back must parse to the same thing
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return
+		}
+		header := appendUDPHeader(nil, &net.UDPAddr{IP: ip, Port: port})
+		host2, port2, payload2, err := parseUDPDatagram(append(header, payload...))
+		if err != nil || host2 != host || port2 != port || !bytes.Equal(payload2, payload) {
+			t.Fatalf("%s:%d does not round trip: %s:%d, %v", host, port, host2, port2, err)
+		}
+	})
+}
+
+// FuzzRawTLSToken covers the preamble raw TLS clients send after the
+// handshake.
+func FuzzRawTLSToken(f *testing.F) {
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0, 5, 't', 'o', 'k', 'e', 'n'})
+	f.Add([]byte{0xff, 0xff, 'x'})
+	f.Add([]byte{0x20, 0x00})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		token, err := readRawTLSToken(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(token) > rawTLSMaxToken {
+			t.Fatalf("accepted a %d byte token", len(token))
+		}
+		if int(binary.BigEndian.Uint16(b)) != len(token) || token != string(b[2:2+len(token)]) {
+			t.Fatal("token does not match its length prefix")
+		}
+	})
+}
+
+// FuzzSessionToken feeds mangled session tokens to the provider, which must
+// neither panic nor accept a token without a subject.
+func FuzzSessionToken(f *testing.F) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	provider, err := newSessionTokenProvider(base64.StdEncoding.EncodeToString(pub), "node-1")
+	if err != nil {
+		f.Fatal(err)
+	}
+	valid, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"iss": sessionTokenIssuer,
+		"aud": "node-1",
+		"sub": "user-1",
+		"did": "device-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(priv)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add("a.b.c")
+	f.Add("eyJhbGciOiJub25lIn0.eyJpc3MiOiJob3JzZXZwbi1zeW5jIn0.")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, token string) {
+		id, err := provider.Authenticate(token)
+		if err == nil && (id == nil || id.Subject == "") {
+			t.Fatalf("accepted %q without a subject", token)
+		}
+	})
+}
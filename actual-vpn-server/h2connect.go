@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTP/2 CONNECT transport. Each CONNECT request is one tunnel carried on its
+// own HTTP/2 stream, so a client keeps a single TLS connection to the node
+// and multiplexes all of its tunnels over it. It gets through corporate
+// proxies that allow CONNECT to port 443 but break WebSocket upgrades: the
+// client CONNECTs to the node through the proxy, speaks TLS and HTTP/2 to the
+// node inside that, and opens tunnels as CONNECT streams.
+//
+// The :authority of the stream names the node; the stream carries the same
+// tunnel protocol as /ws. HTTP/2 is only negotiated over TLS, so this needs
+// USE_TLS with a certificate on the node.
+
+var errH2StreamClosed = errors.New("stream closed")
+
+// withConnect sends CONNECT requests to handleConnect and everything else to
+// next. ServeMux can't route CONNECT itself: an HTTP/2 CONNECT has no path.
+func withConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			handleConnect(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// H2StreamConn adapts a CONNECT stream to Conn: reads come from the request
+// body, writes go to the response and are flushed right away.
+type H2StreamConn struct {
+	body io.ReadCloser
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	// The connection the stream is on, shared with the client's other
+	// tunnels
+	netConn net.Conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *H2StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *H2StreamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errH2StreamClosed
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *H2StreamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// Unblocks a pending Read; the stream ends when the handler returns
+	return c.body.Close()
+}
+
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "CONNECT tunnels need HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	r = withConnLogger(r, "h2")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+	defer shedder.Release()
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		return
+	}
+	defer tenant.Release()
+
+	// Relays like the WebSocket tunnel
+	tunnel := &Tunnel{id: id, egress: egressFor(id, r), log: withUser(logFor(r), id)}
+	if !tunnel.negotiateEncryption(w, r) || !tunnel.negotiateMux(w, r) || !tunnel.negotiatePolicies(w, r) ||
+		!tunnel.dialNamedDestination(w, r) {
+		return
+	}
+
+	lease, err := sessionTracker.Open(id, r)
+	if err != nil {
+		rejectTooManySessions(w, r, id)
+		if tunnel.remoteConn != nil {
+			tunnel.remoteConn.Close()
+		}
+		return
+	}
+	defer lease.Close()
+
+	// The tunnel outlives the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	addHeaders(w, tunnel.handshakeHeader())
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		tunnel.log.Warn("CONNECT stream failed", "err", err)
+		if tunnel.remoteConn != nil {
+			tunnel.remoteConn.Close()
+		}
+		return
+	}
+
+	conn := &H2StreamConn{body: r.Body, w: w, rc: rc, netConn: netConnFrom(r)}
+	lease.Attach(conn)
+
+	tunnel.log.Info("New tunnel")
+	connectionsTotal.Inc()
+
+	// The stream lives as long as this handler, so run the tunnel here
+	// rather than in a goroutine
+	tunnel.localConn = conn
+	if tunnel.remoteConn == nil {
+		tunnel.remoteConn = conn
+	}
+	tunnelsActive.Add(1)
+	defer tunnelsActive.Add(-1)
+	tunnel.handleConnection()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// An in-process node for tests and benchmarks: the real handlers behind a
+// plain HTTP server for WebSocket tunnels and a TLS listener that picks the
+// transport by ALPN, as USE_TLS does. Clients dial it over loopback through
+// the same code paths as in production.
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Every tunnel logs; keep the output readable unless asked for
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	shedder = NewLoadShedder(0, 30*time.Second)
+	writeCoalesceDelay = writeCoalesceDelayFromEnv()
+	// The transports are tested against an echo, not real destinations
+	relayMode = relayEcho
+	os.Exit(m.Run())
+}
+
+type testNode struct {
+	http  *httptest.Server
+	tlsLn net.Listener
+	roots *x509.CertPool
+}
+
+func startTestNode(tb testing.TB) *testNode {
+	tb.Helper()
+
+	cert, roots := selfSignedCert(tb)
+	certs := &CertSource{getCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWebSocket)
+	mux.HandleFunc("/health", handleHealth)
+	handler := withConnect(mux)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go serveTLSMuxListener(ln, certs.TLSConfig("h2", "http/1.1", rawTLSProto), &http.Server{Handler: handler})
+
+	node := &testNode{http: httptest.NewServer(handler), tlsLn: ln, roots: roots}
+	tb.Cleanup(func() {
+		node.http.Close()
+		ln.Close()
+	})
+	return node
+}
+
+func selfSignedCert(tb testing.TB) (*tls.Certificate, *x509.CertPool) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// dialFunc opens the TCP connection a transport runs over
+type dialFunc func(network, addr string) (net.Conn, error)
+
+// A transport clients can open tunnels over
+type testTransport struct {
+	name string
+	// Whether the transport detects tampering, so corrupted bytes end the
+	// connection rather than arriving as data
+	authenticated bool
+	dial          func(node *testNode, dial dialFunc) (io.ReadWriteCloser, error)
+}
+
+var testTransports = []testTransport{
+	{"ws", false, func(node *testNode, dial dialFunc) (io.ReadWriteCloser, error) {
+		return dialTestWS(node, dial, nil)
+	}},
+	{"ws-interactive", false, func(node *testNode, dial dialFunc) (io.ReadWriteCloser, error) {
+		return dialTestWS(node, dial, http.Header{"X-Traffic-Class": {"interactive"}})
+	}},
+	{"tls", true, dialTestRawTLS},
+	{"h2", true, dialTestH2},
+}
+
+// mustDial opens a tunnel straight to node
+func mustDial(tb testing.TB, node *testNode, transport testTransport) io.ReadWriteCloser {
+	tb.Helper()
+	conn, err := transport.dial(node, net.Dial)
+	if err != nil {
+		tb.Fatalf("dialing %s: %v", transport.name, err)
+	}
+	return conn
+}
+
+func dialTestWS(node *testNode, dial dialFunc, header http.Header) (io.ReadWriteCloser, error) {
+	h := http.Header{"Origin": {"http://localhost"}}
+	for k, v := range header {
+		h[k] = v
+	}
+	d := websocket.Dialer{Subprotocols: []string{"vpn-protocol"}, NetDial: dial}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(node.http.URL, "http")+"/ws", h)
+	if err != nil {
+		return nil, err
+	}
+	return &wsClientConn{conn: conn}, nil
+}
+
+// wsClientConn is the client end of a WebSocket tunnel as a byte stream
+type wsClientConn struct {
+	conn    *websocket.Conn
+	pending []byte
+}
+
+func (c *wsClientConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			return 0, io.EOF
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b in messages no larger than the node's read buffer
+func (c *wsClientConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), 4096)
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *wsClientConn) Close() error {
+	return c.conn.Close()
+}
+
+func dialTestRawTLS(node *testNode, dial dialFunc) (io.ReadWriteCloser, error) {
+	raw, err := dial("tcp", node.tlsLn.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{
+		RootCAs:    node.roots,
+		ServerName: "localhost",
+		NextProtos: []string{rawTLSProto},
+	})
+	// No token
+	if err := binary.Write(conn, binary.BigEndian, uint16(0)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if status[0] != rawTLSOK {
+		conn.Close()
+		return nil, fmt.Errorf("raw TLS status %d", status[0])
+	}
+	return conn, nil
+}
+
+// h2ClientConn is the client end of a CONNECT stream: writes feed the
+// request body, reads come from the response body
+type h2ClientConn struct {
+	io.ReadCloser
+	w *io.PipeWriter
+	// Each tunnel has its own HTTP/2 connection
+	raw net.Conn
+}
+
+func (c *h2ClientConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *h2ClientConn) Close() error {
+	c.w.Close()
+	c.ReadCloser.Close()
+	return c.raw.Close()
+}
+
+func dialTestH2(node *testNode, dial dialFunc) (io.ReadWriteCloser, error) {
+	var raw net.Conn
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			raw = conn
+			return conn, err
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: node.roots, ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+	}
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: node.tlsLn.Addr().String()},
+		Host:   node.tlsLn.Addr().String(),
+		Header: http.Header{},
+		Body:   pr,
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		if raw != nil {
+			raw.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		raw.Close()
+		return nil, fmt.Errorf("CONNECT answered %s over %s", resp.Status, resp.Proto)
+	}
+	return &h2ClientConn{ReadCloser: resp.Body, w: pw, raw: raw}, nil
+}
+
+// testPattern fills b with bytes that depend on their offset in the stream,
+// so reordered or lost data doesn't match
+func testPattern(b []byte, offset int) {
+	for i := range b {
+		b[i] = byte((offset + i) * 7 % 251)
+	}
+}
+
+var errEchoMismatch = errors.New("echoed data differs from what was sent")
+
+// echo sends total bytes through conn in writes of chunk bytes while reading
+// them back from the node, and checks the data when verify is set.
+func echo(conn io.ReadWriter, total, chunk int, verify bool) error {
+	writeErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, chunk)
+		for sent := 0; sent < total; {
+			n := min(chunk, total-sent)
+			if verify {
+				testPattern(buf[:n], sent)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				writeErr <- err
+				return
+			}
+			sent += n
+		}
+		writeErr <- nil
+	}()
+
+	buf := make([]byte, 32*1024)
+	want := make([]byte, len(buf))
+	for received := 0; received < total; {
+		n, err := conn.Read(buf[:min(len(buf), total-received)])
+		if verify && n > 0 {
+			testPattern(want[:n], received)
+			if string(buf[:n]) != string(want[:n]) {
+				return fmt.Errorf("at offset %d: %w", received, errEchoMismatch)
+			}
+		}
+		received += n
+		if err != nil {
+			return fmt.Errorf("after %d of %d bytes: %w", received, total, err)
+		}
+	}
+	return <-writeErr
+}
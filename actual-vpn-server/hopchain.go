@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/e2e"
+)
+
+// Multi-hop tunnels. A client can bounce a tunnel through a chain of nodes,
+// so the first one sees who the client is but not where the tunnel goes, and
+// the last one sees the destination but not the client. The client asks
+// each hop for a chain with an X-Tunnel-Chain: 1 header next to end-to-end
+// encryption, which a chain can't go without. Inside the encrypted stream
+// its first message is the hop's instruction:
+//
+//	length (2 bytes, big endian) | {"next": "wss://hop2.example.com/ws", "token": "..."}
+//
+// A relay hop dials next as a WebSocket tunnel of the same kind, with token
+// as its bearer token, and answers with one byte, a SOCKS5 reply code: 0
+// once the next hop has accepted the tunnel, 2 if it may not relay there,
+// or why the next hop couldn't be reached. From then on it relays the
+// tunnel's stream to the next hop, where the client runs the encryption
+// handshake again, with that hop's key, inside it. Each layer only opens at
+// its own hop, so a hop learns the next hop and nothing past it. The last
+// hop gets an instruction without next, answers 0 and relays the tunnel as
+// usual. Only nodes with CHAIN_RELAY=true relay to another hop, and only to
+// addresses destinationAllowed lets the client reach; any node can be the
+// last hop.
+const (
+	chainHeader  = "X-Tunnel-Chain"
+	chainVersion = "1"
+
+	maxHopInstruction = 4096
+)
+
+var (
+	chainRelay bool
+
+	chainHopsRelayed = registry.Counter("chain_hops_relayed_total", "Multi-hop tunnels relayed on to their next hop")
+	chainHopsFailed  = registry.Counter("chain_hop_failures_total", "Multi-hop tunnels whose next hop was refused or unreachable")
+)
+
+var (
+	errChainRelayOff  = errors.New("relaying to another hop is off on this node")
+	errHopInstruction = errors.New("invalid hop instruction")
+)
+
+// hopInstruction tells a hop of a chain where the tunnel goes next
+type hopInstruction struct {
+	// The next hop's WebSocket URL; empty on the last hop
+	Next  string `json:"next,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+func chainRelayFromEnv() bool {
+	return os.Getenv("CHAIN_RELAY") == "true"
+}
+
+// negotiateChain reads the client's request to make the tunnel a hop of a
+// chain, which must be end-to-end encrypted and can't be multiplexed
+func (t *Tunnel) negotiateChain(w http.ResponseWriter, r *http.Request) bool {
+	switch v := r.Header.Get(chainHeader); v {
+	case "":
+	case chainVersion:
+		if !t.encrypt || t.mux || r.Header.Get("X-Destination") != "" {
+			http.Error(w, chainHeader+" needs "+e2e.Header+" and no multiplexing or X-Destination", http.StatusBadRequest)
+			return false
+		}
+		t.chain = true
+		t.chainOrigin = r.Header.Get("Origin")
+	default:
+		http.Error(w, "Unsupported "+chainHeader, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// followChain reads the hop's instruction from the encrypted stream and,
+// on a relay hop, makes the next hop the tunnel's remote end
+func (t *Tunnel) followChain() error {
+	timer := time.AfterFunc(e2eHandshakeTimeout, func() { t.localConn.Close() })
+	hop, err := readHopInstruction(t.localConn)
+	if !timer.Stop() {
+		return errors.New("hop instruction timed out")
+	}
+	if err != nil {
+		return err
+	}
+	if hop.Next == "" {
+		_, err := t.localConn.Write([]byte{socksSucceeded})
+		return err
+	}
+
+	code, err := byte(socksNotAllowed), error(errChainRelayOff)
+	var next *websocket.Conn
+	if chainRelay {
+		next, code, err = t.dialNextHop(hop)
+	}
+	if err != nil {
+		chainHopsFailed.Inc()
+		t.localConn.Write([]byte{code})
+		return fmt.Errorf("next hop %s: %w", hop.Next, err)
+	}
+	next.SetReadLimit(maxTunnelMessage)
+	if _, err := t.localConn.Write([]byte{socksSucceeded}); err != nil {
+		next.Close()
+		return err
+	}
+	t.remoteConn = &WSConn{Conn: next}
+	chainHopsRelayed.Inc()
+	t.log.Info("Relaying tunnel to the next hop", "next", hostOf(hop.Next))
+	return nil
+}
+
+func readHopInstruction(r io.Reader) (hopInstruction, error) {
+	var hop hopInstruction
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return hop, err
+	}
+	n := binary.BigEndian.Uint16(length[:])
+	if n == 0 || n > maxHopInstruction {
+		return hop, errHopInstruction
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return hop, err
+	}
+	if err := json.Unmarshal(data, &hop); err != nil {
+		return hop, fmt.Errorf("%w: %v", errHopInstruction, err)
+	}
+	return hop, nil
+}
+
+// dialNextHop opens the tunnel to the next hop through the same checks and
+// egress address as any destination, returning the SOCKS reply code for a
+// failure
+func (t *Tunnel) dialNextHop(hop hopInstruction) (*websocket.Conn, byte, error) {
+	u, err := url.Parse(hop.Next)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Hostname() == "" {
+		return nil, socksGeneralFailure, errHopInstruction
+	}
+	port := 80
+	if u.Scheme == "wss" {
+		port = 443
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, socksGeneralFailure, errHopInstruction
+		}
+	}
+
+	relayDials.Inc()
+	conn, code, err := t.dialDestination(u.Hostname(), port)
+	if err != nil {
+		relayDialsFailed.Inc()
+		return nil, code, err
+	}
+	d := websocket.Dialer{
+		NetDialContext:   func(context.Context, string, string) (net.Conn, error) { return conn, nil },
+		Subprotocols:     []string{"vpn-protocol"},
+		HandshakeTimeout: relayDialTimeout,
+	}
+	header := http.Header{}
+	header.Set(e2e.Header, e2e.Version)
+	header.Set(chainHeader, chainVersion)
+	if t.chainOrigin != "" {
+		header.Set("Origin", t.chainOrigin)
+	}
+	if hop.Token != "" {
+		header.Set("Authorization", "Bearer "+hop.Token)
+	}
+	ws, resp, err := d.Dial(hop.Next, header)
+	if err != nil {
+		conn.Close()
+		if resp != nil {
+			err = fmt.Errorf("%w (status %d)", err, resp.StatusCode)
+		}
+		return nil, socksHostUnreachable, err
+	}
+	if resp.Header.Get(e2e.Header) != e2e.Version {
+		ws.Close()
+		return nil, socksGeneralFailure, errors.New("next hop does not support end-to-end encryption")
+	}
+	return ws, socksSucceeded, nil
+}
+
+// hostOf returns a URL's host for logging, without its path or query
+func hostOf(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Host resource telemetry for load reports. Tunnel counts say nothing of a
+// host whose CPU is taken by a noisy neighbour, that is short of memory or
+// whose NIC is full, so each report also carries the host's CPU, memory and
+// NIC utilization, as fractions of 1, and the sync server steers new
+// tunnels away from saturated hosts. CPU and NIC are averaged over the
+// interval since the previous report. NIC utilization is the busier
+// direction of the busiest interface against its link speed; virtual
+// interfaces often don't know theirs, so NIC_SPEED (Mbit/s) sets it for
+// every interface but loopback.
+type HostLoad struct {
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+	// Unset when no interface has a known speed
+	NIC *float64 `json:"nic,omitempty"`
+}
+
+var (
+	hostCPUPercent    = registry.Gauge("host_cpu_percent", "Host CPU busy over the last load report interval, in percent")
+	hostMemoryPercent = registry.Gauge("host_memory_percent", "Host memory in use, not counting reclaimable caches, in percent")
+	hostNICPercent    = registry.Gauge("host_nic_percent", "Busiest NIC direction over the last load report interval, in percent of link speed")
+)
+
+// hostCounters are the kernel's cumulative counters at one moment
+type hostCounters struct {
+	cpuBusy, cpuTotal uint64
+	memoryUsed        float64
+	nics              map[string]nicCounters
+}
+
+type nicCounters struct {
+	rx, tx uint64
+	// Link speed in bits per second, 0 if unknown
+	speed float64
+}
+
+// hostSampler turns counters into utilization since the previous sample
+type hostSampler struct {
+	// Link speed for every interface in bits per second, from NIC_SPEED
+	nicSpeed float64
+
+	last   hostCounters
+	lastAt time.Time
+}
+
+func newHostSampler() *hostSampler {
+	s := &hostSampler{}
+	if v := os.Getenv("NIC_SPEED"); v != "" {
+		mbps, err := strconv.ParseFloat(v, 64)
+		if err == nil && mbps > 0 {
+			s.nicSpeed = mbps * 1e6
+		} else {
+			slog.Warn("Ignoring invalid NIC_SPEED value", "value", v)
+		}
+	}
+	// The first report then covers its whole interval
+	s.sample()
+	return s
+}
+
+// sample returns the host's load since the previous call, or nil if the
+// host's counters can't be read or this is the first call
+func (s *hostSampler) sample() *HostLoad {
+	now := time.Now()
+	counters, ok := readHostCounters()
+	if !ok {
+		return nil
+	}
+	prev, prevAt := s.last, s.lastAt
+	s.last, s.lastAt = counters, now
+	if prevAt.IsZero() {
+		return nil
+	}
+
+	load := &HostLoad{Memory: counters.memoryUsed}
+	if counters.cpuTotal > prev.cpuTotal {
+		load.CPU = float64(counters.cpuBusy-prev.cpuBusy) / float64(counters.cpuTotal-prev.cpuTotal)
+	}
+	secs := now.Sub(prevAt).Seconds()
+	for name, nic := range counters.nics {
+		old, ok := prev.nics[name]
+		speed := nic.speed
+		if s.nicSpeed > 0 {
+			speed = s.nicSpeed
+		}
+		if !ok || speed == 0 || nic.rx < old.rx || nic.tx < old.tx {
+			continue
+		}
+		util := float64(max(nic.rx-old.rx, nic.tx-old.tx)) * 8 / secs / speed
+		if load.NIC == nil || util > *load.NIC {
+			load.NIC = &util
+		}
+	}
+
+	hostCPUPercent.Set(int64(load.CPU * 100))
+	hostMemoryPercent.Set(int64(load.Memory * 100))
+	if load.NIC != nil {
+		hostNICPercent.Set(int64(*load.NIC * 100))
+	}
+	return load
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readHostCounters reads /proc/stat, /proc/meminfo and /proc/net/dev, and
+// link speeds from /sys/class/net
+func readHostCounters() (hostCounters, bool) {
+	var c hostCounters
+	var ok bool
+	if c.cpuBusy, c.cpuTotal, ok = readCPUTimes(); !ok {
+		return c, false
+	}
+	if c.memoryUsed, ok = readMemoryUsed(); !ok {
+		return c, false
+	}
+	c.nics = readNICCounters()
+	return c, true
+}
+
+func readCPUTimes() (busy, total uint64, ok bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	// user nice system idle iowait irq softirq steal; guest time is already
+	// counted in user
+	var idle uint64
+	for i, f := range fields[1:9] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += n
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return total - idle, total, true
+}
+
+func readMemoryUsed() (float64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var total, available float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = n
+		case "MemAvailable:":
+			available = n
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return 1 - available/total, true
+}
+
+func readNICCounters() map[string]nicCounters {
+	nics := make(map[string]nicCounters)
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nics
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, found := strings.Cut(scanner.Text(), ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "lo" {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, err1 := strconv.ParseUint(fields[0], 10, 64)
+		tx, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		nics[name] = nicCounters{rx: rx, tx: tx, speed: linkSpeed(name)}
+	}
+	return nics
+}
+
+// linkSpeed returns an interface's speed in bits per second, or 0 if the
+// driver doesn't say, as virtual ones mostly don't
+func linkSpeed(name string) float64 {
+	data, err := os.ReadFile("/sys/class/net/" + name + "/speed")
+	if err != nil {
+		return 0
+	}
+	mbps, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil || mbps <= 0 {
+		return 0
+	}
+	return mbps * 1e6
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// readHostCounters has nothing portable to read, so load reports go
+// without host telemetry outside Linux
+func readHostCounters() (hostCounters, bool) {
+	return hostCounters{}, false
+}
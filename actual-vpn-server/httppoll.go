@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP polling transport for networks whose middleboxes break WebSockets.
+// A tunnel is a session on the node:
+//
+//	POST   /poll/open             start a session, answers {"sessionId": ...}
+//	POST   /poll/<id>/up?seq=N    upstream chunk N (the raw request body)
+//	POST   /poll/<id>/up?ack=N    acknowledge downstream chunks below N
+//	GET    /poll/<id>/down?ack=N  downstream chunks from N on
+//	GET    /poll/<id>/ws?ack=N    carry the session over a WebSocket instead
+//	DELETE /poll/<id>             close the session
+//
+// Both directions carry sequence numbers so a request lost by a proxy can
+// simply be retried: duplicate upstream chunks are ignored, and downstream
+// chunks are kept until a later request acknowledges them. Downstream is a
+// long poll answering JSON, or a server-sent event stream when the client
+// asks for text/event-stream (the event ID is the sequence number, so
+// Last-Event-ID acknowledges on reconnect).
+const (
+	// How long a long-poll down request waits for data
+	pollHoldTime = 20 * time.Second
+	// How long an SSE down stream stays open before the client must reconnect
+	pollStreamTime = 60 * time.Second
+	// Sessions without any request for this long are closed
+	pollSessionIdle = 60 * time.Second
+	// Unacknowledged downstream data beyond this blocks the tunnel, at
+	// first; see growWindow
+	pollMaxUnacked = 1 << 20
+	pollMaxChunk   = 64 << 10
+)
+
+var errPollSessionClosed = errors.New("poll session closed")
+
+var pollSessionsActive = registry.Gauge("poll_sessions_active", "HTTP polling tunnels currently open")
+
+type pollChunk struct {
+	seq  uint64
+	data []byte
+}
+
+// PollSession adapts a series of HTTP requests to Conn.
+type PollSession struct {
+	id string
+
+	mu       sync.Mutex
+	notify   chan struct{}
+	upNext   uint64
+	in       []byte
+	out      []pollChunk
+	outBytes int
+	downNext uint64
+	closed   bool
+	lastSeen time.Time
+	log      *slog.Logger
+
+	// Unacknowledged downstream data allowed, and whether a write has
+	// waited for it since the last acknowledgement
+	window        int
+	windowLimited bool
+
+	// Carriers; see migrate.go. carrier counts WebSocket attachments, so a
+	// WebSocket knows when another has taken over.
+	carried   bool
+	wsCarried bool
+	carrier   uint64
+}
+
+var (
+	pollSessionsMu sync.Mutex
+	pollSessions   = make(map[string]*PollSession)
+)
+
+// newPollSession opens a session for the tunnel that logs through log
+func newPollSession(log *slog.Logger) *PollSession {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	s := &PollSession{
+		id:       id,
+		notify:   make(chan struct{}),
+		lastSeen: time.Now(),
+		window:   pollMaxUnacked,
+		// The session ID is the client's key to it, so only part of it is logged
+		log: log.With("session", id[:8]),
+	}
+
+	pollSessionsMu.Lock()
+	pollSessions[s.id] = s
+	pollSessionsMu.Unlock()
+	pollSessionsActive.Add(1)
+
+	go s.expire()
+	return s
+}
+
+func findPollSession(id string) *PollSession {
+	pollSessionsMu.Lock()
+	defer pollSessionsMu.Unlock()
+	return pollSessions[id]
+}
+
+// changed wakes everything waiting on the session. Called with mu held.
+func (s *PollSession) changed() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *PollSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *PollSession) expire() {
+	ticker := time.NewTicker(pollSessionIdle / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		closed := s.closed
+		idle := time.Since(s.lastSeen)
+		s.mu.Unlock()
+
+		if closed {
+			return
+		}
+		if idle >= pollSessionIdle {
+			s.log.Info("Poll session idle, closing", "idle", idle.Round(time.Second))
+			s.Close()
+			return
+		}
+	}
+}
+
+func (s *PollSession) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.in) > 0 {
+			n := copy(b, s.in)
+			s.in = s.in[n:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		ch := s.notify
+		s.mu.Unlock()
+		<-ch
+	}
+}
+
+func (s *PollSession) Write(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, errPollSessionClosed
+		}
+		if s.outBytes == 0 || s.outBytes+len(b) <= s.window {
+			s.out = append(s.out, pollChunk{seq: s.downNext, data: append([]byte(nil), b...)})
+			s.outBytes += len(b)
+			s.downNext++
+			s.changed()
+			s.mu.Unlock()
+			return len(b), nil
+		}
+		s.windowLimited = true
+		ch := s.notify
+		s.mu.Unlock()
+		<-ch
+	}
+}
+
+func (s *PollSession) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.changed()
+	s.mu.Unlock()
+
+	pollSessionsMu.Lock()
+	delete(pollSessions, s.id)
+	pollSessionsMu.Unlock()
+	pollSessionsActive.Add(-1)
+	return nil
+}
+
+// ack drops downstream chunks below next. Called with mu held.
+func (s *PollSession) ack(next uint64) {
+	dropped := 0
+	for dropped < len(s.out) && s.out[dropped].seq < next {
+		s.outBytes -= len(s.out[dropped].data)
+		dropped++
+	}
+	if dropped > 0 {
+		s.out = s.out[dropped:]
+		s.growWindow()
+		s.changed()
+	}
+}
+
+// growWindow doubles the window, up to MAX_SOCKET_BUFFER_KB, when the
+// writer had to wait for this acknowledgement: the window, not the path, is
+// what limits the session. Called with mu held.
+func (s *PollSession) growWindow() {
+	if !s.windowLimited {
+		return
+	}
+	s.windowLimited = false
+	if s.window < socketBufferMax {
+		s.window = min(s.window*2, socketBufferMax)
+		windowResizes.Inc()
+	}
+}
+
+// up accepts upstream chunk seq. It reports false for a chunk from the
+// future, which means the client skipped one.
+func (s *PollSession) up(seq uint64, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = time.Now()
+
+	switch {
+	case seq < s.upNext:
+		// A retry of something we already have
+		return true
+	case seq > s.upNext:
+		return false
+	}
+	s.in = append(s.in, data...)
+	s.upNext++
+	s.changed()
+	return true
+}
+
+// pending drops chunks below ack, then waits until there are downstream
+// chunks from seq from on, the session closes, or the deadline passes, and
+// returns what there is.
+func (s *PollSession) pending(ack, from uint64, deadline <-chan time.Time, done <-chan struct{}) ([]pollChunk, bool) {
+	for {
+		s.mu.Lock()
+		s.lastSeen = time.Now()
+		s.ack(ack)
+		var chunks []pollChunk
+		for _, c := range s.out {
+			if c.seq >= from {
+				chunks = append(chunks, c)
+			}
+		}
+		if len(chunks) > 0 || s.closed {
+			closed := s.closed
+			s.mu.Unlock()
+			return chunks, closed
+		}
+		ch := s.notify
+		s.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-deadline:
+			return nil, false
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/poll/")
+	if path == "open" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handlePollOpen(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	s := findPollSession(id)
+	if s == nil {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "up" && r.Method == http.MethodPost:
+		s.polled()
+		handlePollUp(w, r, s)
+	case action == "down" && r.Method == http.MethodGet:
+		s.polled()
+		handlePollDown(w, r, s)
+	case action == "ws" && r.Method == http.MethodGet:
+		handlePollCarrier(w, r, s)
+	case action == "" && r.Method == http.MethodDelete:
+		s.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handlePollOpen(w http.ResponseWriter, r *http.Request) {
+	r = withConnLogger(r, "poll")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		shedder.Release()
+		return
+	}
+
+	// Relays to the destination the client names, like the WebSocket tunnel
+	tunnel := &Tunnel{id: id, egress: egressFor(id, r), log: withUser(logFor(r), id)}
+	if !tunnel.negotiateEncryption(w, r) || !tunnel.negotiateMux(w, r) || !tunnel.negotiatePolicies(w, r) ||
+		!tunnel.dialNamedDestination(w, r) {
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	lease, err := sessionTracker.Open(id, r)
+	if err != nil {
+		rejectTooManySessions(w, r, id)
+		if tunnel.remoteConn != nil {
+			tunnel.remoteConn.Close()
+		}
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	s := newPollSession(tunnel.log)
+	lease.Attach(s)
+	tunnel.log = s.log
+	tunnel.log.Info("New tunnel")
+	connectionsTotal.Inc()
+
+	tunnel.localConn = s
+	if tunnel.remoteConn == nil {
+		tunnel.remoteConn = s
+	}
+
+	tunnelsActive.Add(1)
+	go func() {
+		defer shedder.Release()
+		defer tenant.Release()
+		defer lease.Close()
+		defer tunnelsActive.Add(-1)
+		tunnel.handleConnection()
+	}()
+
+	addHeaders(w, tunnel.handshakeHeader())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"sessionId": s.id})
+}
+
+func handlePollUp(w http.ResponseWriter, r *http.Request, s *PollSession) {
+	s.touch()
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pollMaxChunk))
+	if err != nil {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Upstream requests may acknowledge downstream data too
+	if v := r.URL.Query().Get("ack"); v != "" {
+		if ack, err := strconv.ParseUint(v, 10, 64); err == nil {
+			s.mu.Lock()
+			s.ack(ack)
+			s.mu.Unlock()
+		}
+	}
+
+	// Without seq the request only acknowledges
+	if v := r.URL.Query().Get("seq"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seq", http.StatusBadRequest)
+			return
+		}
+		if !s.up(seq, data) {
+			http.Error(w, "Out of order chunk", http.StatusConflict)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePollDown(w http.ResponseWriter, r *http.Request, s *PollSession) {
+	s.touch()
+
+	var ack uint64
+	if v := r.URL.Query().Get("ack"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ack", http.StatusBadRequest)
+			return
+		}
+		ack = n
+	} else if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			ack = n + 1
+		}
+	}
+
+	// The server's write timeout is shorter than a poll
+	rc := http.NewResponseController(w)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		rc.SetWriteDeadline(time.Now().Add(pollStreamTime + 5*time.Second))
+		streamPollDown(w, r, rc, s, ack)
+		return
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(pollHoldTime + 5*time.Second))
+	timer := time.NewTimer(pollHoldTime)
+	defer timer.Stop()
+	chunks, closed := s.pending(ack, ack, timer.C, r.Context().Done())
+
+	type jsonChunk struct {
+		Seq  uint64 `json:"seq"`
+		Data []byte `json:"data"`
+	}
+	resp := struct {
+		Chunks []jsonChunk `json:"chunks"`
+		Closed bool        `json:"closed"`
+	}{Chunks: []jsonChunk{}, Closed: closed}
+	for _, c := range chunks {
+		resp.Chunks = append(resp.Chunks, jsonChunk{Seq: c.seq, Data: c.data})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// streamPollDown sends downstream chunks as server-sent events. Chunks stay
+// buffered until a later request acknowledges them, since we can't tell
+// what a proxy swallowed; clients ack with up?ack=N as they go.
+func streamPollDown(w http.ResponseWriter, r *http.Request, rc *http.ResponseController, s *PollSession, ack uint64) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	deadline := time.NewTimer(pollStreamTime)
+	defer deadline.Stop()
+
+	next := ack
+	for {
+		chunks, closed := s.pending(ack, next, deadline.C, r.Context().Done())
+		for _, c := range chunks {
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", c.seq, base64.StdEncoding.EncodeToString(c.data))
+			next = c.seq + 1
+		}
+		if closed {
+			fmt.Fprint(w, "event: close\ndata:\n\n")
+			rc.Flush()
+			return
+		}
+		if len(chunks) == 0 {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
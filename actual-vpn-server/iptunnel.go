@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/tun"
+)
+
+// IP tunnels. Besides relaying the connections an application opens through
+// the client's proxy, a node with TUN_SUBNET set carries whole IP packets,
+// so a client can route all of its system's traffic through it. /tun is a
+// WebSocket whose first message, a text message from the node, gives the
+// client its address:
+//
+//	{"address": "10.88.0.2/24", "gateway": "10.88.0.1", "mtu": 1400, "ipv6": false}
+//
+// IP tunnels carry IPv4 only, which "ipv6": false in the message spells
+// out: clients should keep their system's IPv6 off the internet while the
+// tunnel is up, or it goes around the tunnel.
+//
+// After that every binary message in either direction is one IP packet. The
+// node writes the client's packets to its TUN device, and the kernel
+// forwards and masquerades them like any router's; packets the kernel
+// routes back into the device go to the client that holds their
+// destination address. A client can only send from its own address, and
+// only to destinations destinationAllowed lets it reach.
+//
+// The client can measure its own path and tell the node a smaller MTU with
+// a text message, {"mtu": 1280}, at any time; the node never goes above its
+// device's. TCP handshakes in both directions have their MSS clamped to the
+// smaller of the two, so sites whose ICMP is filtered don't hang on packets
+// too large for the client's network.
+const tunMessageOverhead = 64
+
+// Room for the IPv4 and TCP headers in an MTU
+const tunTCPHeaders = 40
+
+var (
+	tunClientsActive   = registry.Gauge("tun_clients_active", "IP tunnels currently open")
+	tunPacketsOut      = registry.Counter("tun_packets_sent_total", "IP packets relayed from clients to the TUN device")
+	tunPacketsIn       = registry.Counter("tun_packets_received_total", "IP packets relayed from the TUN device to clients")
+	tunPacketsRejected = registry.Counter("tun_packets_rejected_total", "IP packets from clients dropped as malformed, spoofed or to forbidden destinations")
+	tunPacketsDropped  = registry.Counter("tun_packets_dropped_total", "IP packets for clients dropped because no client holds the address or its queue was full")
+	tunMSSClamped      = registry.Counter("tun_mss_clamped_total", "TCP handshakes through IP tunnels whose MSS was lowered to fit the tunnel")
+)
+
+var errTUNPoolExhausted = errors.New("no tunnel addresses left")
+
+// TUNRouter owns the node's TUN device and the addresses handed to clients
+type TUNRouter struct {
+	dev *tun.Device
+	// The node's own address, with the pool's prefix length
+	gateway netip.Prefix
+
+	mu    sync.Mutex
+	peers map[netip.Addr]*tunPeer
+}
+
+// tunPeer is one client's IP tunnel
+type tunPeer struct {
+	ws   *websocket.Conn
+	addr netip.Addr
+	// Whose traffic this is, for ACLs; nil when authentication is off
+	id  *Identity
+	log *slog.Logger
+	// The largest packet the client's network carries, from its device's
+	// MTU down to what the client reports
+	mtu atomic.Int32
+	// Packets from the device waiting to be written to the client
+	out  chan []byte
+	done chan struct{}
+}
+
+var tunRouter *TUNRouter
+
+func tunRouterFromEnv() (*TUNRouter, error) {
+	subnet := os.Getenv("TUN_SUBNET")
+	if subnet == "" {
+		return nil, nil
+	}
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUN_SUBNET: %w", err)
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return nil, fmt.Errorf("TUN_SUBNET must be an IPv4 network of at least 4 addresses: %s", subnet)
+	}
+
+	name := os.Getenv("TUN_NAME")
+	if name == "" {
+		name = "horse0"
+	}
+	mtu := tun.DefaultMTU
+	if v := os.Getenv("TUN_MTU"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 576 && n <= 65535 {
+			mtu = n
+		} else {
+			slog.Warn("Ignoring invalid TUN_MTU value", "value", v)
+		}
+	}
+
+	dev, err := tun.Open(name, mtu)
+	if err != nil {
+		return nil, err
+	}
+	gateway := netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits())
+	if err := dev.Configure(gateway); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	slog.Info("IP tunnels enabled", "device", dev.Name(), "gateway", gateway)
+
+	r := &TUNRouter{dev: dev, gateway: gateway, peers: make(map[netip.Addr]*tunPeer)}
+	go r.run()
+	return r, nil
+}
+
+// lease hands out the lowest free address in the pool
+func (r *TUNRouter) lease(p *tunPeer) error {
+	prefix := r.gateway.Masked()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for a := r.gateway.Addr().Next(); prefix.Contains(a); a = a.Next() {
+		// The last address is the broadcast address
+		if !prefix.Contains(a.Next()) {
+			break
+		}
+		if r.peers[a] == nil {
+			p.addr = a
+			r.peers[a] = p
+			return nil
+		}
+	}
+	return errTUNPoolExhausted
+}
+
+func (r *TUNRouter) release(p *tunPeer) {
+	r.mu.Lock()
+	if r.peers[p.addr] == p {
+		delete(r.peers, p.addr)
+	}
+	r.mu.Unlock()
+}
+
+// run hands the packets the kernel routes into the device to their clients
+func (r *TUNRouter) run() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := r.dev.Read(buf)
+		if err != nil {
+			slog.Error("TUN device failed", "device", r.dev.Name(), "err", err)
+			return
+		}
+		h, err := tun.ParseHeader(buf[:n])
+		if err != nil || h.Version != 4 {
+			continue
+		}
+		dst, _ := netip.AddrFromSlice(h.Dst.To4())
+		r.mu.Lock()
+		p := r.peers[dst]
+		r.mu.Unlock()
+		if p == nil {
+			tunPacketsDropped.Inc()
+			continue
+		}
+		select {
+		case p.out <- append([]byte(nil), buf[:n]...):
+		default:
+			// Like a router's full queue; TCP backs off
+			tunPacketsDropped.Inc()
+		}
+	}
+}
+
+func handleTUN(w http.ResponseWriter, r *http.Request) {
+	if tunRouter == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	r = withConnLogger(r, "tun")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		shedder.Release()
+		return
+	}
+
+	peer := &tunPeer{id: id, log: withUser(logFor(r), id), out: make(chan []byte, 256), done: make(chan struct{})}
+	if err := tunRouter.lease(peer); err != nil {
+		peer.log.Warn("Refusing IP tunnel", "err", err)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	lease, err := sessionTracker.Open(id, r)
+	if err != nil {
+		rejectTooManySessions(w, r, id)
+		tunRouter.release(peer)
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	upgrader := newUpgrader()
+	conn, err := upgrader.Upgrade(w, r, varyHandshake())
+	if err != nil {
+		peer.log.Warn("WebSocket upgrade failed", "err", err)
+		handshakeFailures.Inc()
+		tunRouter.release(peer)
+		shedder.Release()
+		tenant.Release()
+		lease.Close()
+		return
+	}
+	lease.Attach(conn)
+	conn.SetReadLimit(int64(tunRouter.dev.MTU() + tunMessageOverhead))
+	peer.ws = conn
+	peer.mtu.Store(int32(tunRouter.dev.MTU()))
+
+	peer.log = peer.log.With("address", peer.addr)
+	peer.log.Info("New IP tunnel")
+	connectionsTotal.Inc()
+
+	tunClientsActive.Add(1)
+	go func() {
+		defer shedder.Release()
+		defer tenant.Release()
+		defer lease.Close()
+		defer tunClientsActive.Add(-1)
+		defer tunRouter.release(peer)
+		peer.run(tunRouter)
+	}()
+}
+
+func (p *tunPeer) run(router *TUNRouter) {
+	defer p.ws.Close()
+	defer close(p.done)
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"address": netip.PrefixFrom(p.addr, router.gateway.Bits()).String(),
+		"gateway": router.gateway.Addr().String(),
+		"mtu":     router.dev.MTU(),
+		"ipv6":    false,
+	})
+	if err := p.ws.WriteMessage(websocket.TextMessage, config); err != nil {
+		return
+	}
+
+	go p.writeToClient()
+	p.readFromClient(router)
+}
+
+func (p *tunPeer) readFromClient(router *TUNRouter) {
+	tenant := p.id.tenantOf()
+	for {
+		msgType, data, err := p.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType == websocket.TextMessage {
+			p.setMTU(data, router)
+			continue
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+
+		h, err := tun.ParseHeader(data)
+		if err != nil || h.Version != 4 || !h.Src.Equal(net.IP(p.addr.AsSlice())) ||
+			!destinationAllowed(p.id, h.Dst, h.DstPort) {
+			tunPacketsRejected.Inc()
+			if debugLogging() {
+				p.log.Debug("Rejected packet", "direction", dirUp, "bytes", len(data), "err", err)
+			}
+			continue
+		}
+
+		if !countUsage(p.id, len(data), p.ws) {
+			return
+		}
+		p.clampMSS(data)
+		if _, err := router.dev.Write(data); err != nil {
+			continue
+		}
+		if debugLogging() {
+			p.log.Debug("Packet", "direction", dirUp, "bytes", len(data), "protocol", h.Protocol, "dst", h.Dst, "dst_port", h.DstPort)
+		}
+		tunPacketsOut.Inc()
+		bytesFromClients.Add(int64(len(data)))
+		if tenant != nil {
+			tenant.bytesFromClients.Add(int64(len(data)))
+		}
+	}
+}
+
+func (p *tunPeer) writeToClient() {
+	tenant := p.id.tenantOf()
+	for {
+		select {
+		case <-p.done:
+			return
+		case packet := <-p.out:
+			if !countUsage(p.id, len(packet), p.ws) {
+				return
+			}
+			p.clampMSS(packet)
+			if err := p.ws.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+				p.ws.Close()
+				return
+			}
+			tunPacketsIn.Inc()
+			if debugLogging() {
+				if h, err := tun.ParseHeader(packet); err == nil {
+					p.log.Debug("Packet", "direction", dirDown, "bytes", len(packet), "protocol", h.Protocol, "src", h.Src)
+				}
+			}
+			bytesToClients.Add(int64(len(packet)))
+			if tenant != nil {
+				tenant.bytesToClients.Add(int64(len(packet)))
+			}
+		}
+	}
+}
+
+// setMTU takes the MTU a client measured for its network, as
+// {"mtu": 1280}, keeping it between the minimum IPv4 hosts must take and
+// the device's
+func (p *tunPeer) setMTU(msg []byte, router *TUNRouter) {
+	var report struct {
+		MTU int `json:"mtu"`
+	}
+	if err := json.Unmarshal(msg, &report); err != nil || report.MTU == 0 {
+		return
+	}
+	mtu := min(max(report.MTU, 576), router.dev.MTU())
+	if old := p.mtu.Swap(int32(mtu)); int(old) != mtu {
+		p.log.Info("Client path MTU", "mtu", mtu)
+	}
+}
+
+func (p *tunPeer) clampMSS(packet []byte) {
+	if tun.ClampMSS(packet, int(p.mtu.Load())-tunTCPHeaders) {
+		tunMSSClamped.Inc()
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTProvider validates signed JWTs against keys published as a JWKS. OIDC
+// is the same thing with the JWKS location discovered from the issuer.
+type JWTProvider struct {
+	name     string
+	issuer   string
+	audience string
+	keys     *JWKSCache
+}
+
+func newJWTProvider(name, issuer, audience string, jwksURL func() (string, error)) *JWTProvider {
+	return &JWTProvider{
+		name:     name,
+		issuer:   issuer,
+		audience: audience,
+		keys:     &JWKSCache{resolveURL: jwksURL},
+	}
+}
+
+func (p *JWTProvider) Name() string {
+	return p.name
+}
+
+func (p *JWTProvider) Authenticate(token string) (*Identity, error) {
+	// Anything that isn't a JWT, or is a JWT from another issuer, belongs to
+	// some other provider
+	if strings.Count(token, ".") != 2 {
+		return nil, errTokenNotRecognized
+	}
+	unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, errTokenNotRecognized
+	}
+	if p.issuer != "" {
+		if iss, _ := unverified.Claims.GetIssuer(); iss != p.issuer {
+			return nil, errTokenNotRecognized
+		}
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if p.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(p.issuer))
+	}
+	if p.audience != "" {
+		opts = append(opts, jwt.WithAudience(p.audience))
+	}
+
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.Key(kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := parsed.Claims.GetSubject()
+	if sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	id := &Identity{Subject: sub, Provider: p.name}
+	if exp, _ := parsed.Claims.GetExpirationTime(); exp != nil {
+		id.Expires = exp.Time
+	}
+	return id, nil
+}
+
+// JWKSCache holds the keys from a JWKS endpoint. Keys are refreshed hourly,
+// and early when a token names a key we haven't seen (rotation), but never
+// more than once a minute so bogus kids can't be used to hammer the IdP.
+type JWKSCache struct {
+	resolveURL func() (string, error)
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+const (
+	jwksMaxAge          = time.Hour
+	jwksMinRefreshDelay = time.Minute
+)
+
+func (c *JWKSCache) Key(kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[kid]
+	stale := time.Since(c.fetchedAt) > jwksMaxAge
+	if (!ok || stale) && time.Since(c.lastAttempt) > jwksMinRefreshDelay {
+		c.lastAttempt = time.Now()
+		if err := c.refresh(); err != nil && len(c.keys) == 0 {
+			return nil, err
+		}
+		key, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (c *JWKSCache) refresh() error {
+	url, err := c.resolveURL()
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(url, &set); err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func staticJWKSURL(url string) func() (string, error) {
+	return func() (string, error) { return url, nil }
+}
+
+// discoverJWKSURL looks up jwks_uri from the issuer's OpenID configuration,
+// caching it once found.
+func discoverJWKSURL(issuer string) func() (string, error) {
+	var (
+		mu  sync.Mutex
+		url string
+	)
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if url != "" {
+			return url, nil
+		}
+
+		var config struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+			return "", fmt.Errorf("OIDC discovery: %w", err)
+		}
+		if config.Issuer != issuer || config.JWKSURI == "" {
+			return "", errors.New("OIDC discovery returned mismatched issuer or no jwks_uri")
+		}
+		url = config.JWKSURI
+		return url, nil
+	}
+}
+
+var authHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := authHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
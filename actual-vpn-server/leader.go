@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leader election for nodes run as a multi-replica Kubernetes Deployment
+// behind one Service. Every replica serves tunnels, but the replicas share
+// one server ID and URL, so only the leader registers with the sync server.
+// Leadership is held through a coordination.k8s.io Lease named by
+// LEADER_ELECTION_LEASE, talking to the API server with the pod's service
+// account; the service account needs get, create and update on leases.
+const (
+	leaseDuration = 15 * time.Second
+	leaseRetry    = 5 * time.Second
+	// Kubernetes MicroTime
+	leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+	serviceAccount  = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+type LeaderElector struct {
+	// The namespace's leases collection, and ours in it
+	leases   string
+	name     string
+	identity string
+	token    string
+	client   *http.Client
+
+	leader atomic.Bool
+	// Closed the first time this replica becomes leader
+	elected     chan struct{}
+	electedOnce sync.Once
+}
+
+var leaderGauge = registry.Gauge("leader", "1 while this replica holds the leader election lease")
+
+type lease struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Metadata   leaseMeta `json:"metadata"`
+	Spec       leaseSpec `json:"spec"`
+}
+
+// Only the metadata an update needs
+type leaseMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaderElectorFromEnv returns nil unless LEADER_ELECTION_LEASE is set. The
+// replica identifies itself by POD_NAME, falling back to the hostname.
+func leaderElectorFromEnv() (*LeaderElector, error) {
+	name := os.Getenv("LEADER_ELECTION_LEASE")
+	if name == "" {
+		return nil, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	token, err := os.ReadFile(serviceAccount + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccount + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account CA bundle")
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccount + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LeaderElector{
+		leases: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+			net.JoinHostPort(host, port), namespace),
+		name:     name,
+		identity: identity,
+		token:    strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		elected: make(chan struct{}),
+	}, nil
+}
+
+// Elected is closed once this replica first becomes leader
+func (e *LeaderElector) Elected() <-chan struct{} {
+	return e.elected
+}
+
+// Run campaigns for the lease forever, renewing it while leader
+func (e *LeaderElector) Run() {
+	slog.Info("Leader election enabled", "identity", e.identity)
+	var lastRenewed time.Time
+	for {
+		err := e.tryAcquireOrRenew()
+		if err == nil {
+			lastRenewed = time.Now()
+			if !e.leader.Swap(true) {
+				slog.Info("Became leader")
+				leaderGauge.Set(1)
+				e.electedOnce.Do(func() { close(e.elected) })
+			}
+		} else {
+			if err != errNotLeader {
+				slog.Warn("Leader election failed", "err", err)
+			}
+			// Another replica may take over once the lease runs out, so stop
+			// acting as leader before then
+			if e.leader.Load() && (err == errNotLeader || time.Since(lastRenewed) > leaseDuration-leaseRetry) {
+				slog.Warn("Lost leadership")
+				e.leader.Store(false)
+				leaderGauge.Set(0)
+			}
+		}
+		time.Sleep(leaseRetry)
+	}
+}
+
+var errNotLeader = errors.New("lease held by another replica")
+
+func (e *LeaderElector) tryAcquireOrRenew() error {
+	now := time.Now()
+	current, err := e.get()
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		return e.write(http.MethodPost, e.leases, &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMeta{Name: e.name},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(leaseDuration / time.Second),
+				AcquireTime:          now.UTC().Format(leaseTimeFormat),
+				RenewTime:            now.UTC().Format(leaseTimeFormat),
+			},
+		})
+	}
+
+	spec := &current.Spec
+	if spec.HolderIdentity != e.identity {
+		renewed, err := time.Parse(leaseTimeFormat, spec.RenewTime)
+		duration := time.Duration(spec.LeaseDurationSeconds) * time.Second
+		if spec.HolderIdentity != "" && err == nil && now.Before(renewed.Add(duration)) {
+			return errNotLeader
+		}
+		// Expired: take it over
+		spec.HolderIdentity = e.identity
+		spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+	// The update carries the resourceVersion we read, so the API server
+	// rejects it if another replica got there first
+	return e.write(http.MethodPut, e.leases+"/"+e.name, current)
+}
+
+// get returns the lease, or nil if it doesn't exist yet
+func (e *LeaderElector) get() (*lease, error) {
+	resp, err := e.do(http.MethodGet, e.leases+"/"+e.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading lease: status %d", resp.StatusCode)
+	}
+	var l lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (e *LeaderElector) write(method, url string, l *lease) error {
+	resp, err := e.do(method, url, l)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errNotLeader
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("writing lease: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+func (e *LeaderElector) do(method, url string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	req.Header.Set("Content-Type", "application/json")
+	return e.client.Do(req)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Load reports tell the sync server how busy this node is, for its
+// autoscaling API and for routing around saturated hosts. Replicas sharing
+// a server ID each report under their own instance name.
+type LoadReport struct {
+	Instance   string    `json:"instance"`
+	Tunnels    int64     `json:"tunnels"`
+	MaxTunnels int64     `json:"maxTunnels"`
+	Overloaded bool      `json:"overloaded"`
+	Host       *HostLoad `json:"host,omitempty"`
+}
+
+func loadReportIntervalFromEnv() time.Duration {
+	if v := os.Getenv("LOAD_REPORT_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid LOAD_REPORT_INTERVAL value", "value", v)
+	}
+	return 30 * time.Second
+}
+
+// reportLoad sends a load report every interval forever, starting one
+// interval in so the node has registered by then
+func reportLoad(syncServerURL, serverID string, interval time.Duration) {
+	instance := loadReportInstance()
+	host := newHostSampler()
+	for {
+		time.Sleep(interval)
+		report := LoadReport{
+			Instance:   instance,
+			Tunnels:    shedder.Active(),
+			MaxTunnels: shedder.maxTunnels,
+			Overloaded: shedder.Overloaded(),
+			Host:       host.sample(),
+		}
+		if err := sendLoadReport(syncServerURL, serverID, report); err != nil {
+			slog.Warn("Failed to report load", "err", err)
+		}
+	}
+}
+
+// loadReportInstance names this replica in reports: the Kubernetes pod, or
+// else the host
+func loadReportInstance() string {
+	instance := os.Getenv("POD_NAME")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return instance
+}
+
+func sendLoadReport(syncServerURL, serverID string, report LoadReport) error {
+	return postAsNode(syncServerURL+"/servers/"+serverID+"/load", report)
+}
+
+// postAsNode posts v to the sync server as JSON, with the node's credential
+func postAsNode(url string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := nodeCredential(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Logging. Every line goes through log/slog, as text or, with
+// LOG_FORMAT=json, one JSON object per line for log shippers. Lines about a
+// connection come from its own logger and carry a connection ID, the
+// client's address and the transport, so one tunnel's lines can be picked
+// out of a busy node's log; lines about data add the direction it went.
+//
+// LOG_LEVEL picks what is logged: "info" (default) logs everything but the
+// per-packet and per-read lines "debug" adds, "warn" leaves out the lines
+// logged for each new tunnel or relay, which on a busy node are most of the
+// log, and "error" keeps only failures. Lines from the standard log
+// package, such as log.Fatal's, are logged at info. LOG_LEVEL can change
+// through CONFIG_DIR without a restart.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var logLevel = new(slog.LevelVar)
+
+// Data directions, for lines about a tunnel's traffic
+const (
+	dirUp   = "up"   // from the client towards the destination
+	dirDown = "down" // from the destination back to the client
+)
+
+func logLevelFromEnv() slog.Level {
+	v := os.Getenv("LOG_LEVEL")
+	if v == "" {
+		return slog.LevelInfo
+	}
+	level, ok := logLevels[v]
+	if !ok {
+		slog.Warn("Ignoring invalid LOG_LEVEL value", "value", v)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// setupLogging makes the LOG_FORMAT handler the default, for slog and for
+// the standard log package alike
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		if v != "" && v != "text" {
+			slog.Warn("Ignoring invalid LOG_FORMAT value", "value", v)
+		}
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// debugLogging reports whether debug lines are logged, for hot paths to
+// check before building one
+func debugLogging() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+// connLogger returns the logger for a new connection over transport from
+// remote, which tags its lines with a fresh connection ID
+func connLogger(transport, remote string) *slog.Logger {
+	return slog.Default().With("conn", newConnID(), "remote", remote, "transport", transport)
+}
+
+type connLoggerKey struct{}
+
+// withConnLogger returns r carrying a new connection's logger, for the
+// handlers and the tunnel that serve it to log through
+func withConnLogger(r *http.Request, transport string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), connLoggerKey{}, connLogger(transport, r.RemoteAddr)))
+}
+
+// logFor returns r's connection logger, or one that tags lines with the
+// client's address for requests without one
+func logFor(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(connLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default().With("remote", r.RemoteAddr)
+}
+
+// withUser adds who opened a connection to its logger, once they are known
+func withUser(l *slog.Logger, id *Identity) *slog.Logger {
+	if id == nil {
+		return l
+	}
+	return l.With("user", id.Subject)
+}
+
+func newConnID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
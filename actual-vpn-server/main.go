@@ -2,17 +2,24 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"horse-vpn-server/e2e"
 )
 
 type Conn interface {
@@ -21,117 +28,444 @@ type Conn interface {
 	Close() error
 }
 
+// closeWriter is implemented by connections that can signal end of stream
+// in one direction while still reading the other, like TCP's half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// WSConn carries the tunnel in binary messages. An empty message marks the
+// end of the sender's direction, the tunnel's half-close.
 type WSConn struct {
 	*websocket.Conn
+
+	// gorilla/websocket allows one writer at a time
+	mu          sync.Mutex
+	writeClosed bool
+	readClosed  atomic.Bool
+	// The message being read, straight into the caller's buffer a piece at
+	// a time, so a message larger than the buffer carries over to the next
+	// Read; and whether it has had any data yet
+	reader    io.Reader
+	readEmpty bool
+
+	// Write coalescing; see coalesce.go
+	coalesce   time.Duration
+	pending    []byte
+	flushTimer *time.Timer
+	flushArmed bool
+	flushErr   error
 }
 
+var errWriteClosed = errors.New("write side closed")
+
+// Largest tunnel message a client may send, MAX_MESSAGE_KB. Clients send
+// what they read from a socket, far less than this; the limit keeps a
+// hostile client from making the node read an arbitrarily large message
+// before the tunnel sees any of it. A client that goes over it gets a close
+// frame with code 1009.
+var maxTunnelMessage int64 = 1 << 20
+
+func maxTunnelMessageFromEnv() int64 {
+	if v := os.Getenv("MAX_MESSAGE_KB"); v != "" {
+		kb, err := strconv.ParseInt(v, 10, 64)
+		// Clients' copy buffers go up to 64 KB
+		if err == nil && kb >= 64 && kb <= 1<<20 {
+			return kb << 10
+		}
+		slog.Warn("Ignoring invalid MAX_MESSAGE_KB value", "value", v)
+	}
+	return 1 << 20
+}
+
+// Read takes messages a reader at a time rather than with ReadMessage, which
+// would allocate a buffer for each one on the tunnel's hot path. A message
+// may arrive over several Reads, as much of it as fits in b each time;
+// message boundaries mean nothing to the tunnel, except that an empty one
+// ends the stream.
 func (w *WSConn) Read(b []byte) (int, error) {
-	_, data, err := w.Conn.ReadMessage()
-	if err != nil {
-		return 0, err
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if w.reader == nil {
+			if w.readClosed.Load() {
+				return 0, io.EOF
+			}
+			_, r, err := w.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.reader, w.readEmpty = r, true
+		}
+		n, err := w.reader.Read(b)
+		if n > 0 {
+			w.readEmpty = false
+		}
+		if err == io.EOF {
+			w.reader = nil
+			if w.readEmpty {
+				w.readClosed.Store(true)
+				return 0, io.EOF
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
 	}
-	copy(b, data)
-	return len(data), nil
 }
 
 func (w *WSConn) Write(b []byte) (int, error) {
-	err := w.Conn.WriteMessage(websocket.BinaryMessage, b)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writeClosed {
+		return 0, errWriteClosed
+	}
+	var err error
+	if w.coalesce > 0 {
+		err = w.writeCoalesced(b)
+	} else {
+		err = w.writeMessage(b)
+	}
 	if err != nil {
 		return 0, err
 	}
 	return len(b), nil
 }
 
+func (w *WSConn) writeMessage(b []byte) error {
+	return w.Conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (w *WSConn) CloseWrite() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writeClosed {
+		return nil
+	}
+	w.writeClosed = true
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	return w.writeMessage(nil)
+}
+
 func (w *WSConn) Close() error {
+	w.mu.Lock()
+	w.flushLocked()
+	w.mu.Unlock()
 	return w.Conn.Close()
 }
 
 type Tunnel struct {
 	localConn  Conn
 	remoteConn Conn
+	// Who opened the tunnel; nil when authentication is off
+	id      *Identity
+	usage   streamUsage
+	copyBuf copyBuffer
+	// Where connections to destinations leave from
+	egress Egress
+	// Tags the tunnel's lines with its connection ID; see logging.go
+	log *slog.Logger
+	// Whether the client asked for end-to-end encryption, and the cipher
+	// the node picked; see tunnelcrypto.go
+	encrypt bool
+	cipher  e2e.Cipher
+	mux     bool
+	// For a resumable multiplexed tunnel; see tunnelmux.go
+	muxResume *muxResumption
+	// Whether the tunnel is a hop of a chain, and the origin to give the
+	// next hop; see hopchain.go
+	chain       bool
+	chainOrigin string
+	// Set when the client asked for live statistics; see tunnelstats.go
+	stats *tunnelStats
+	// Where operator announcements go, when the client asked for them; see
+	// announcements.go
+	announcements *WSConn
+	// The policy plugins the client asked for, and where to say when one
+	// blocks a destination; see policy.go
+	policies []*registeredPolicy
+	control  *WSConn
 }
 
+// handleConnection runs the tunnel until it ends, relaying it or, for a
+// multiplexed tunnel, the streams in it
 func (t *Tunnel) handleConnection() {
 	defer t.localConn.Close()
 	defer t.remoteConn.Close()
-	go t.copyData(t.localConn, t.remoteConn)
-	t.copyData(t.remoteConn, t.localConn)
+	if t.encrypt {
+		if err := t.startEncryption(); err != nil {
+			t.log.Warn("End-to-end encryption handshake failed", "err", err)
+			handshakeFailures.Inc()
+			return
+		}
+	}
+	if t.chain {
+		if err := t.followChain(); err != nil {
+			t.log.Warn("Multi-hop tunnel failed", "err", err)
+			return
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.tuneWindows(stop)
+	go t.watchCredential(stop)
+	if t.stats != nil {
+		go t.sendStats(stop)
+	}
+	if t.announcements != nil {
+		go t.sendAnnouncements(stop)
+	}
+	if t.mux {
+		t.serveMux()
+		return
+	}
+	t.relay(stop)
 }
 
-func (t *Tunnel) copyData(src, dst Conn) {
-	buf := make([]byte, 4096)
-	for {
-		n, err := src.Read(buf)
+// relay copies both directions until both have finished. A side that
+// reaches end of stream is half-closed on the other connection, so
+// protocols that send a request, shut down writing and then read the reply
+// keep working; any other error tears down both directions at once.
+func (t *Tunnel) relay(stop <-chan struct{}) {
+	t.usage.start(streamLimits)
+	go t.enforceLimits(stop)
+	if privateTelemetry != nil {
+		defer func() { privateTelemetry.record(t.id, t.usage.bytes.Load()) }()
+	}
+	if t.localConn == t.remoteConn && relayMode == relaySOCKS {
+		remote, err := t.connectDestination()
 		if err != nil {
 			return
 		}
-		_, err = dst.Write(buf[:n])
-		if err != nil {
+		defer remote.Close()
+		t.remoteConn = remote
+	}
+	up, down := []*Metric{bytesFromClients}, []*Metric{bytesToClients}
+	if tenant := t.id.tenantOf(); tenant != nil {
+		up = append(up, tenant.bytesFromClients)
+		down = append(down, tenant.bytesToClients)
+	}
+	if t.stats != nil {
+		up = append(up, &t.stats.up)
+		down = append(down, &t.stats.down)
+	}
+	if tracked, untrack := trackTunnel(t); tracked != nil {
+		defer untrack()
+		up = append(up, &tracked.up)
+		down = append(down, &tracked.down)
+	}
+	// Writes in each direction, held to the tunnel's rate limits
+	toRemote, toLocal, release := t.limitConns()
+	defer release()
+	if t.localConn == t.remoteConn {
+		// An echo tunnel: two copies would race for the connection's reads
+		// and reorder the data, so one loop carries it both ways
+		t.copyData(t.localConn, toLocal, "echo", append(up, down...)...)
+		return
+	}
+	var fromLocal Conn = t.localConn
+	if len(t.activePolicies()) > 0 {
+		fromLocal = &inspectedConn{Conn: t.localConn, t: t}
+	}
+	done := make(chan error, 2)
+	go func() { done <- t.copyData(fromLocal, toRemote, dirUp, up...) }()
+	go func() { done <- t.copyData(t.remoteConn, toLocal, dirDown, down...) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
 			return
 		}
 	}
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// Allow connections from trusted domains only
-			origin := r.Header.Get("Origin")
-			if origin == "" {
-				return false // Reject requests without Origin header
+// copyData returns nil once src ended cleanly and the end was passed on to
+// dst, and an error otherwise. direction only labels debug lines.
+func (t *Tunnel) copyData(src, dst Conn, direction string, counters ...*Metric) error {
+	buf := make([]byte, t.copyBuf.get())
+	for {
+		if size := t.copyBuf.get(); size > len(buf) {
+			buf = make([]byte, size)
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
 			}
-
-			// Allow localhost for development and trusted domains
-			allowedOrigins := []string{
-				"http://localhost",
-				"https://localhost",
-				"http://127.0.0.1",
-				"https://127.0.0.1",
+			if debugLogging() {
+				t.log.Debug("Relayed", "direction", direction, "bytes", n)
 			}
-
-			// Add production domains if set via environment
-			if trustedDomains := os.Getenv("TRUSTED_DOMAINS"); trustedDomains != "" {
-				domains := strings.Split(trustedDomains, ",")
-				allowedOrigins = append(allowedOrigins, domains...)
+			for _, counter := range counters {
+				counter.Add(int64(n))
 			}
-
-			for _, allowed := range allowedOrigins {
-				if strings.TrimSpace(allowed) == origin {
-					return true
-				}
+			if !t.usage.record(n) {
+				t.closeLimited("stream byte limit")
+				return errStreamLimit
 			}
+		}
+		if err == io.EOF {
+			cw, ok := dst.(closeWriter)
+			if !ok {
+				// dst can't carry a half-close, so finish the whole tunnel
+				return err
+			}
+			return cw.CloseWrite()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-			log.Printf("Rejected WebSocket connection from untrusted origin: %s", origin)
-			return false
-		},
-		Subprotocols: []string{"vpn-protocol"}, // Enforce specific subprotocol
+var shedder *LoadShedder
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	r = withConnLogger(r, "websocket")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Refuse new tunnels while overloaded so existing ones keep their share
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		shedder.Release()
+		return
+	}
+
+	// The tunnel relays to the destination the request names, or else to
+	// the one the client's CONNECT names; see relay.go
+	tunnel := &Tunnel{id: id, egress: egressFor(id, r), log: withUser(logFor(r), id)}
+	if !tunnel.negotiateEncryption(w, r) || !tunnel.negotiateMux(w, r) || !tunnel.negotiateChain(w, r) ||
+		!tunnel.negotiateStats(w, r) || !tunnel.negotiatePolicies(w, r) || !tunnel.dialNamedDestination(w, r) {
+		shedder.Release()
+		tenant.Release()
+		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Only a tunnel about to open counts as a session, so a refused one
+	// never takes the place of one the user has
+	lease, err := sessionTracker.Open(id, r)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		rejectTooManySessions(w, r, id)
+		if tunnel.remoteConn != nil {
+			tunnel.remoteConn.Close()
+		}
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	upgrader := newUpgrader()
+	conn, err := upgrader.Upgrade(w, r, tunnel.handshakeHeader())
+	if err != nil {
+		tunnel.log.Warn("WebSocket upgrade failed", "err", err)
+		handshakeFailures.Inc()
+		if tunnel.remoteConn != nil {
+			tunnel.remoteConn.Close()
+		}
+		shedder.Release()
+		tenant.Release()
+		lease.Close()
 		return
 	}
+	lease.Attach(conn)
+	conn.SetReadLimit(maxTunnelMessage)
 
-	log.Printf("New WebSocket connection from %s", r.RemoteAddr)
+	tunnel.log.Info("New tunnel")
+	connectionsTotal.Inc()
 
 	// Create WebSocket connection wrapper
-	wsConn := &WSConn{conn}
+	wsConn := &WSConn{Conn: conn, coalesce: coalesceDelayFor(r)}
+	if tunnel.stats != nil {
+		tunnel.stats.ws.Store(wsConn)
+	}
+	if r.Header.Get(announcementsHeader) != "" {
+		tunnel.announcements = wsConn
+	}
+	if len(tunnel.activePolicies()) > 0 && !tunnel.mux {
+		tunnel.control = wsConn
+	}
+
+	tunnel.localConn = wsConn
+	if tunnel.remoteConn == nil {
+		tunnel.remoteConn = wsConn // Until the client names a destination
+	}
+
+	tunnelsActive.Add(1)
+	go func() {
+		defer shedder.Release()
+		defer tenant.Release()
+		defer lease.Close()
+		defer tunnelsActive.Add(-1)
+		tunnel.handleConnection()
+	}()
+}
+
+// newUpgrader returns the upgrader shared by all WebSocket endpoints, which
+// enforces the origin allow-list and the vpn-protocol subprotocol.
+func newUpgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin:  originAllowed,
+		Subprotocols: []string{"vpn-protocol"}, // Enforce specific subprotocol
+	}
+}
+
+func originAllowed(r *http.Request) bool {
+	// Allow connections from trusted domains only
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false // Reject requests without Origin header
+	}
+
+	// Allow localhost for development and trusted domains
+	allowedOrigins := []string{
+		"http://localhost",
+		"https://localhost",
+		"http://127.0.0.1",
+		"https://127.0.0.1",
+	}
+
+	// Add production domains if set via environment
+	if trustedDomains := os.Getenv("TRUSTED_DOMAINS"); trustedDomains != "" {
+		domains := strings.Split(trustedDomains, ",")
+		allowedOrigins = append(allowedOrigins, domains...)
+	}
 
-	// For now, we'll create a simple echo server (tunnel to itself)
-	// In a real implementation, this would parse IP packets and route them
-	tunnel := &Tunnel{
-		localConn:  wsConn,
-		remoteConn: wsConn, // Echo back for now
+	for _, allowed := range allowedOrigins {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
 	}
 
-	go tunnel.handleConnection()
+	logFor(r).Warn("Rejected connection from untrusted origin", "origin", origin)
+	return false
 }
 
 type ServerRegistration struct {
 	ID      string `json:"id"`
 	Location string `json:"location"`
 	URL     string `json:"url"`
+	Tags    []string `json:"tags,omitempty"`
+	// Other transports the node serves, e.g. tls://host:port
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Public key for end-to-end encrypted tunnels, in base64
+	E2EKey string `json:"e2eKey,omitempty"`
+	// From the previous registration, to replace it without a node token
+	RegistrationToken string `json:"registrationToken,omitempty"`
 }
 
 func getCloudflaredDomain() (string, error) {
@@ -168,11 +502,31 @@ func getCloudflaredDomain() (string, error) {
 	return "", fmt.Errorf("no cloudflared tunnel found")
 }
 
-func registerWithSyncServer(serverID, location, url, syncServerURL string) error {
+// cloudflaredURL is the node's WebSocket URL through its cloudflared tunnel
+func cloudflaredURL() (string, error) {
+	d, err := getCloudflaredDomain()
+	if err != nil {
+		return "", err
+	}
+	d = strings.Replace(d, "https://", "wss://", 1)
+	d = strings.Replace(d, "http://", "ws://", 1)
+	return d + "/ws", nil
+}
+
+func registerWithSyncServer(serverID, location, url string, tags, endpoints []string, syncServerURL string) error {
+	registrationTokenMu.Lock()
+	token := registrationToken
+	registrationTokenMu.Unlock()
 	reg := ServerRegistration{
-		ID:       serverID,
-		Location: location,
-		URL:      url,
+		ID:                serverID,
+		Location:          location,
+		URL:               url,
+		Tags:              tags,
+		Endpoints:         endpoints,
+		RegistrationToken: token,
+	}
+	if nodeE2EKey != nil {
+		reg.E2EKey = e2e.EncodePublicKey(nodeE2EKey.PublicKey())
 	}
 
 	data, err := json.Marshal(reg)
@@ -180,7 +534,17 @@ func registerWithSyncServer(serverID, location, url, syncServerURL string) error
 		return err
 	}
 
-	resp, err := http.Post(syncServerURL+"/register", "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequest(http.MethodPost, syncServerURL+"/register", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Private and bootstrapped nodes prove which enrolled node they are
+	if nodeToken != "" {
+		req.Header.Set("Authorization", "Bearer "+nodeToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -189,31 +553,105 @@ func registerWithSyncServer(serverID, location, url, syncServerURL string) error
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("registration failed with status: %d", resp.StatusCode)
 	}
+	var result struct {
+		RegistrationToken string `json:"registrationToken"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil {
+		registrationTokenMu.Lock()
+		registrationToken = result.RegistrationToken
+		registrationTokenMu.Unlock()
+	}
 
-	log.Printf("Successfully registered with sync server: %s at %s", serverID, location)
+	slog.Info("Successfully registered with sync server", "server_id", serverID, "location", location)
+	nodeRegistration.registered(url)
 	return nil
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Stay 200 while overloaded: the node is alive, it just isn't taking
+	// new tunnels, and the sync server must not drop it from the catalog
 	w.WriteHeader(http.StatusOK)
+	if shedder.Overloaded() {
+		w.Write([]byte("OVERLOADED"))
+		return
+	}
 	w.Write([]byte("OK"))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "metrics" {
+		runMetricsCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelftestCommand(os.Args[2:])
+		return
+	}
+
 	var noCloudflared = flag.Bool("no-cloudflared", false, "Skip waiting for cloudflared domain")
 	var location = flag.String("location", "unknown", "Server location")
 	var syncServer = flag.String("sync-server", "https://vpnmanager.0x409.nl", "Sync server URL")
 	var serverID = flag.String("id", "", "Server ID (auto-generated if empty)")
+	var tagList = flag.String("tags", "", "Comma-separated tags to register with, e.g. canary")
+	var configFile = flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	var e2eCipher = flag.String("e2e-cipher", "", "End-to-end encryption cipher to prefer: aes-256-gcm or chacha20-poly1305 (default: E2E_CIPHER, else the faster here)")
 	flag.Parse()
 
+	if *configFile != "" {
+		cfg, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("Invalid config file %s: %v", *configFile, err)
+		}
+		cfg.apply(flag.CommandLine)
+	}
+	configDir := configDirFromEnv()
+	if configDir != nil {
+		configDir.Load()
+	}
+	setupLogging()
+	reloadSettings()
+
+	var tags []string
+	for _, tag := range strings.Split(*tagList, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	// Flags and the environment win over what bootstrap handed out
+	nodeToken = os.Getenv("PRIVATE_NODE_TOKEN")
+	state, err := bootstrapNode(*syncServer)
+	if err != nil {
+		log.Fatal("Node bootstrap failed: ", err)
+	}
+	if state != nil {
+		if *serverID == "" {
+			*serverID = state.ServerID
+		}
+		if *location == "unknown" {
+			*location = state.Location
+		}
+		if *tagList == "" {
+			tags = state.Tags
+		}
+		if nodeToken == "" {
+			nodeToken = state.NodeToken
+		}
+		if os.Getenv("SESSION_TOKEN_PUBLIC_KEYS") == "" && state.SessionTokenPublicKey != "" {
+			os.Setenv("SESSION_TOKEN_PUBLIC_KEYS", state.SessionTokenPublicKey)
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
 	useTLS := os.Getenv("USE_TLS") == "true"
-	certFile := os.Getenv("TLS_CERT_FILE")
-	keyFile := os.Getenv("TLS_KEY_FILE")
+	certs, err := certSourceFromEnv()
+	if err != nil {
+		log.Fatal("Invalid TLS certificate configuration: ", err)
+	}
 
 	// Generate server ID if not provided
 	if *serverID == "" {
@@ -224,44 +662,175 @@ func main() {
 		*serverID = fmt.Sprintf("%s-%d", hostname, time.Now().Unix())
 	}
 
+	// Session tokens from the sync server are scoped to this server's ID
+	chain, err := authChainFromEnv(*serverID)
+	if err != nil {
+		log.Fatal("Invalid authentication configuration: ", err)
+	}
+	authChain = chain
+	if tenantsByHost, err = loadTenantsFromEnv(*serverID); err != nil {
+		log.Fatal("Invalid tenant configuration: ", err)
+	}
+	var telemetryInterval time.Duration
+	if privateTelemetry, telemetryInterval, err = usageTelemetryFromEnv(); err != nil {
+		log.Fatal("Invalid usage telemetry configuration: ", err)
+	}
+	if authChain.Enabled() {
+		go revokedDevices.Poll(*syncServer, revocationPollIntervalFromEnv())
+	}
+	go announcements.Poll(*syncServer, announcementPollIntervalFromEnv())
+	if os.Getenv("ENFORCE_SESSION_LIMITS") == "true" {
+		if !authChain.Enabled() {
+			log.Fatal("ENFORCE_SESSION_LIMITS needs an authentication provider to know who sessions belong to")
+		}
+		sessionTracker = newSessionTracker(*syncServer, *serverID)
+		go sessionTracker.PollEvictions()
+	}
+	if os.Getenv("ENFORCE_ACLS") == "true" {
+		if !authChain.Enabled() || nodeToken == "" {
+			log.Fatal("ENFORCE_ACLS needs an authentication provider and PRIVATE_NODE_TOKEN")
+		}
+		nodeACL = &NodeACL{}
+		go nodeACL.Poll(*syncServer, *serverID, aclPollIntervalFromEnv())
+	}
+	if os.Getenv("ENFORCE_PARENTAL_CONTROLS") == "true" {
+		if !authChain.Enabled() || nodeToken == "" {
+			log.Fatal("ENFORCE_PARENTAL_CONTROLS needs an authentication provider and PRIVATE_NODE_TOKEN")
+		}
+		nodeParental = newNodeParentalControls()
+		go nodeParental.Poll(*syncServer, *serverID, aclPollIntervalFromEnv())
+	}
+	if os.Getenv("PORT_FORWARDS") == "true" {
+		if !authChain.Enabled() {
+			log.Fatal("PORT_FORWARDS needs an authentication provider to tell whose tunnel a port is for")
+		}
+		portForwards = newPortForwards()
+		go portForwards.Poll(*syncServer, *serverID, portForwardPollIntervalFromEnv())
+	}
+	if !authChain.Enabled() {
+		slog.Warn("No authentication providers configured, anyone can open a tunnel")
+	}
+	if configDir != nil {
+		go configDir.Watch(*serverID)
+	}
+
+	elector, err := leaderElectorFromEnv()
+	if err != nil {
+		log.Fatal("Invalid leader election configuration: ", err)
+	}
+	if elector != nil {
+		go elector.Run()
+	}
+
+	shedder = loadShedderFromEnv()
+	writeCoalesceDelay = writeCoalesceDelayFromEnv()
+	maxTunnelMessage = maxTunnelMessageFromEnv()
+	streamLimits = streamLimitsFromEnv()
+	rateLimits = rateLimitsFromEnv()
+	if userUsage, err = usageStoreFromEnv(rateLimits.MonthlyQuota); err != nil {
+		log.Fatal("Failed to load usage: ", err)
+	}
+	if userUsage != nil {
+		go userUsage.Persist()
+	}
+	relayMode = relayModeFromEnv()
+	chainRelay = chainRelayFromEnv()
+	if nodeE2EKey, err = e2eKeyFromEnv(); err != nil {
+		log.Fatal("Failed to load the end-to-end encryption key: ", err)
+	}
+	slog.Info("End-to-end encryption public key", "key", e2e.EncodePublicKey(nodeE2EKey.PublicKey()))
+	requireE2E = os.Getenv("REQUIRE_E2E") == "true"
+	muxMaxStreams = muxMaxStreamsFromEnv()
+	muxResumeTimeout = muxResumeTimeoutFromEnv()
+	socketBufferMax = socketBufferMaxFromEnv()
+	nodeE2ECipher = e2eCipherFromFlag(*e2eCipher)
+	if egressPool, err = egressPoolFromEnv(); err != nil {
+		log.Fatal("Invalid egress configuration: ", err)
+	}
+	if blocklists, err = blocklistsFromEnv(); err != nil {
+		log.Fatal("Invalid blocklist configuration: ", err)
+	}
+	if malwareFeeds, err = feedsFromEnv("MALWARE_FEEDS", blocklists); err != nil {
+		log.Fatal("Invalid malware feed configuration: ", err)
+	}
+	blocklistInterval := blocklistRefreshIntervalFromEnv()
+	if blocklists != nil {
+		go blocklists.Poll(blocklistInterval)
+	}
+	if malwareFeeds != nil {
+		registerPolicy("malware", malwarePolicy{malwareFeeds})
+		go malwareFeeds.Poll(blocklistInterval)
+	}
+	if exitIPv6 = exitIPv6FromEnv(); !exitIPv6 {
+		slog.Info("No IPv6 on the exit, relaying to IPv4 destinations only")
+	}
+	if tunRouter, err = tunRouterFromEnv(); err != nil {
+		log.Fatal("Failed to set up IP tunnels: ", err)
+	}
+	watchdog := watchdogFromEnv(shedder)
+	if watchdog != nil {
+		go watchdog.Run()
+	}
+	registerProbes(certs, watchdog)
+	addReadinessCheck("shutdown", shutdownCheck)
+
+	if sink := statsdSinkFromEnv(registry, *serverID, *location); sink != nil {
+		go sink.Run()
+	}
+	decoy := decoyHandler()
+
+	admin, adminAddr, err := adminAPIFromEnv(*serverID, *syncServer)
+	if err != nil {
+		log.Fatal("Invalid admin API configuration: ", err)
+	}
+	if admin != nil {
+		adminEnabled = true
+		go func() {
+			slog.Info("Admin API listening", "address", adminAddr)
+			if err := admin.serve(adminAddr); err != nil {
+				log.Fatal("Admin API failed:", err)
+			}
+		}()
+	}
+
 	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/udp", handleUDP)
+	http.HandleFunc("/tun", handleTUN)
+	http.HandleFunc("/webrtc/offer", handleWebRTCOffer)
+	http.HandleFunc("/poll/", handlePoll)
 	http.HandleFunc("/health", handleHealth)
+	http.Handle("/metrics", prometheusHandlerFromEnv(registry, *serverID, *location, decoy))
+	http.Handle("/", decoy)
 
 	server := &http.Server{
-		Addr: ":" + port,
+		Addr:    ":" + port,
+		Handler: withConnect(http.DefaultServeMux),
+		// Lets tunnels on HTTP/2 streams tune their connection's buffers
+		ConnContext: withNetConn,
 		// Security headers
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
-		TLSConfig: &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			},
-		},
 	}
 
 	// Start server in background
 	go func() {
-		if useTLS && certFile != "" && keyFile != "" {
-			log.Printf("HorseVPN WebSocket server starting on port %s with TLS", port)
-			log.Printf("WebSocket endpoint: wss://localhost:%s/ws", port)
-			log.Printf("Health check: https://localhost:%s/health", port)
-
-			if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		if useTLS && certs != nil {
+			slog.Info("HorseVPN WebSocket server starting with TLS", "port", port)
+			slog.Info("WebSocket endpoint", "url", "wss://localhost:"+port+"/ws")
+			slog.Info("Health check", "url", "https://localhost:"+port+"/health")
+			slog.Info("HTTP/2 CONNECT tunnels", "url", "https://localhost:"+port)
+			slog.Info("Raw TLS tunnels", "url", "tls://localhost:"+port, "alpn", rawTLSProto)
+
+			// One port for every transport, chosen by ALPN
+			config := certs.TLSConfig("h2", "http/1.1", rawTLSProto)
+			if err := serveTLSMux(":"+port, config, server); err != nil {
 				log.Fatal("HTTPS server failed to start:", err)
 			}
 		} else {
-			log.Printf("HorseVPN WebSocket server starting on port %s", port)
-			log.Printf("WebSocket endpoint: ws://localhost:%s/ws", port)
-			log.Printf("Health check: http://localhost:%s/health", port)
+			slog.Info("HorseVPN WebSocket server starting", "port", port)
+			slog.Info("WebSocket endpoint", "url", "ws://localhost:"+port+"/ws")
+			slog.Info("Health check", "url", "http://localhost:"+port+"/health")
 
 			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Fatal("HTTP server failed to start:", err)
@@ -269,43 +838,103 @@ func main() {
 		}
 	}()
 
+	// Only a node that registered, and holds its server ID alone, unregisters
+	var registered atomic.Bool
+	go shutdownOnSignal(server, shutdownDrainTimeoutFromEnv(), func() {
+		if registered.Load() && elector == nil {
+			unregister(*syncServer, *serverID)
+		}
+	})
+
+	var endpoints []string
+	rawTLSPort := os.Getenv("RAW_TLS_PORT")
+	if rawTLSPort != "" {
+		if certs == nil {
+			log.Fatal("RAW_TLS_PORT needs a certificate: set ACME_DOMAINS, or TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		go func() {
+			slog.Info("Raw TLS tunnels listening", "port", rawTLSPort)
+			if err := serveRawTLS(":"+rawTLSPort, certs.TLSConfig(rawTLSProto)); err != nil {
+				log.Fatal("Raw TLS listener failed to start:", err)
+			}
+		}()
+	} else if useTLS && certs != nil {
+		// Served on the main port alongside everything else
+		rawTLSPort = port
+	}
+	if rawTLSPort != "" {
+		if endpoint := rawTLSEndpoint(rawTLSPort, certs); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		} else {
+			slog.Warn("Not registering the raw TLS transport: set RAW_TLS_ADDRESS to the host:port clients should use")
+		}
+	}
+	if quicPort := os.Getenv("QUIC_PORT"); quicPort != "" {
+		if certs == nil {
+			log.Fatal("QUIC_PORT needs a certificate: set ACME_DOMAINS, or TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		go func() {
+			slog.Info("QUIC tunnels listening", "port", quicPort, "alpn", quicProto)
+			if err := serveQUIC(":"+quicPort, certs.TLSConfig(quicProto)); err != nil {
+				log.Fatal("QUIC listener failed:", err)
+			}
+		}()
+		if endpoint := quicEndpoint(quicPort, certs); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		} else {
+			slog.Warn("Not registering the QUIC transport: set QUIC_ADDRESS to the host:port clients should use")
+		}
+	}
+
 	// Wait for server to be ready
 	time.Sleep(2 * time.Second)
 
 	var domain string
+	// Set when the URL can change while the node runs
+	var discoverURL func() (string, error)
 	if *noCloudflared {
 		// Use localhost if no cloudflared
 		domain = fmt.Sprintf("ws://localhost:%s/ws", port)
-		log.Printf("Skipping cloudflared, using localhost domain: %s", domain)
+		slog.Info("Skipping cloudflared, using localhost domain", "domain", domain)
+		nodeRegistration.setURL(domain, false)
 	} else {
 		// Wait for cloudflared domain
-		log.Printf("Waiting for cloudflared domain...")
+		slog.Info("Waiting for cloudflared domain")
+		nodeRegistration.setPhase(phaseWaitingForCloudflared)
 		for {
-			d, err := getCloudflaredDomain()
+			d, err := cloudflaredURL()
 			if err != nil {
-				log.Printf("Waiting for cloudflared tunnel: %v", err)
+				slog.Info("Waiting for cloudflared tunnel", "err", err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
-			domain = strings.Replace(d, "https://", "wss://", 1)
-			domain = strings.Replace(domain, "http://", "ws://", 1)
-			domain += "/ws"
-			log.Printf("Cloudflared domain detected: %s", domain)
+			domain = d
+			slog.Info("Cloudflared domain detected", "domain", domain)
+			nodeRegistration.setURL(domain, true)
 			break
 		}
+		discoverURL = cloudflaredURL
 	}
 
-	// Register with sync server
-	for {
-		err := registerWithSyncServer(*serverID, *location, domain, *syncServer)
-		if err != nil {
-			log.Printf("Failed to register with sync server: %v, retrying...", err)
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		break
+	// Every replica reports its own load, leader or not
+	if interval := loadReportIntervalFromEnv(); interval > 0 {
+		go reportLoad(*syncServer, *serverID, interval)
+	}
+	if privateTelemetry != nil {
+		go reportUsageTelemetry(*syncServer, *serverID, privateTelemetry, telemetryInterval)
+	}
+
+	// Replicas behind one Service register as one server, through the leader
+	if elector != nil {
+		slog.Info("Waiting to be elected leader before registering with the sync server")
+		nodeRegistration.setPhase(phaseWaitingForLeader)
+		<-elector.Elected()
 	}
 
+	// Register with sync server
+	registerUntilDone(*serverID, *location, domain, tags, endpoints, *syncServer)
+	registered.Store(true)
+
 	// Keep server running
-	select {}
+	keepRegistered(*serverID, *location, domain, tags, endpoints, *syncServer, heartbeatIntervalFromEnv(), discoverURL)
 }
@@ -42,7 +42,7 @@ start_server() {
     SERVER_ARGS=""
     while [[ $# -gt 0 ]]; do
         case $1 in
-            --no-cloudflared|--location=*|--sync-server=*|--id=*)
+            --no-cloudflared|--location=*|--sync-server=*|--id=*|--tags=*)
                 SERVER_ARGS="$SERVER_ARGS $1"
                 shift
                 ;;
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metricKind int
+
+const (
+	kindCounter metricKind = iota
+	kindGauge
+	kindHistogram
+)
+
+// Metric is a single named value. Sinks read every registered metric through
+// Registry.Each, so adding a metric here makes it show up everywhere.
+type Metric struct {
+	Name string
+	Help string
+	Kind metricKind
+	// Set on metrics registered once per value of a label, such as a
+	// HistogramFamily's
+	Label, LabelValue string
+	// Upper bounds of a histogram's buckets, in seconds
+	Buckets []float64
+
+	// For histograms, the number of observations
+	value    atomic.Int64
+	counts   []atomic.Int64
+	sumNanos atomic.Int64
+}
+
+func (m *Metric) Add(n int64) {
+	m.value.Add(n)
+}
+
+func (m *Metric) Inc() {
+	m.value.Add(1)
+}
+
+// Set is only meaningful for gauges.
+func (m *Metric) Set(n int64) {
+	m.value.Store(n)
+}
+
+func (m *Metric) Value() int64 {
+	return m.value.Load()
+}
+
+// Observe is only meaningful for histograms.
+func (m *Metric) Observe(d time.Duration) {
+	secs := d.Seconds()
+	for i, le := range m.Buckets {
+		if secs <= le {
+			m.counts[i].Add(1)
+		}
+	}
+	m.sumNanos.Add(int64(d))
+	m.value.Add(1)
+}
+
+// BucketCounts returns how many observations fell at or under each of
+// Buckets, cumulatively, and their sum in seconds.
+func (m *Metric) BucketCounts() ([]int64, float64) {
+	counts := make([]int64, len(m.counts))
+	for i := range m.counts {
+		counts[i] = m.counts[i].Load()
+	}
+	return counts, time.Duration(m.sumNanos.Load()).Seconds()
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Counter(name, help string) *Metric {
+	return r.register(name, help, kindCounter)
+}
+
+func (r *Registry) Gauge(name, help string) *Metric {
+	return r.register(name, help, kindGauge)
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kindHistogram, Buckets: buckets, counts: make([]atomic.Int64, len(buckets))}
+	r.add(m)
+	return m
+}
+
+// CounterWith and GaugeWith register the metric for one value of label,
+// for labels whose values are known up front, like configured feeds
+func (r *Registry) CounterWith(name, help, label, value string) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kindCounter, Label: label, LabelValue: value}
+	r.add(m)
+	return m
+}
+
+func (r *Registry) GaugeWith(name, help, label, value string) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kindGauge, Label: label, LabelValue: value}
+	r.add(m)
+	return m
+}
+
+func (r *Registry) register(name, help string, kind metricKind) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kind}
+	r.add(m)
+	return m
+}
+
+func (r *Registry) add(m *Metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// Each calls fn for every registered metric in registration order.
+func (r *Registry) Each(fn func(m *Metric)) {
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+	for _, m := range metrics {
+		fn(m)
+	}
+}
+
+// HistogramFamily is a histogram per value of a label, registered as the
+// values come up. Values should be few, like a node's egress addresses. The
+// histogram for the default value is registered at once, so the family
+// shows up in dashboards before anything is observed.
+type HistogramFamily struct {
+	registry   *Registry
+	name, help string
+	label      string
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*Metric
+}
+
+func (r *Registry) HistogramFamily(name, help, label, defaultValue string, buckets []float64) *HistogramFamily {
+	f := &HistogramFamily{registry: r, name: name, help: help, label: label, buckets: buckets, histograms: make(map[string]*Metric)}
+	f.With(defaultValue)
+	return f
+}
+
+// With returns the histogram for value, registering it the first time
+func (f *HistogramFamily) With(value string) *Metric {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.histograms[value]
+	if !ok {
+		m = &Metric{Name: f.name, Help: f.help, Kind: kindHistogram, Label: f.label, LabelValue: value,
+			Buckets: f.buckets, counts: make([]atomic.Int64, len(f.buckets))}
+		f.histograms[value] = m
+		f.registry.add(m)
+	}
+	return m
+}
+
+// Buckets for network round trips, from a LAN to across the world and a
+// retry
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	registry = NewRegistry()
+
+	tunnelsActive       = registry.Gauge("tunnels_active", "Tunnels currently open")
+	connectionsTotal    = registry.Counter("connections_total", "WebSocket connections accepted")
+	connectionsShed     = registry.Counter("connections_shed_total", "WebSocket connections refused while overloaded")
+	bytesFromClients    = registry.Counter("bytes_received_total", "Bytes received from clients")
+	bytesToClients      = registry.Counter("bytes_sent_total", "Bytes sent to clients")
+	registrationsTotal  = registry.Counter("registrations_total", "Registration attempts with the sync server")
+	registrationsFailed = registry.Counter("registration_failures_total", "Failed registration attempts with the sync server")
+	handshakeFailures   = registry.Counter("handshake_failures_total", "Tunnels lost during the WebSocket upgrade, the raw TLS handshake or the end-to-end encryption handshake")
+	authFailures        = registry.Counter("auth_failures_total", "Tunnel requests refused for a missing, invalid or expired token")
+	upstreamConnect     = registry.HistogramFamily("upstream_connect_seconds", "Time to connect to tunnel destinations, by the egress address they were dialed from", "egress", "system", latencyBuckets)
+)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session carriers: a poll session (see httppoll.go) outlives the requests
+// that carry it, so a client can move it to another transport mid-stream,
+// say when the current one degrades, without the application noticing.
+// Besides the polling requests, a WebSocket can carry the session:
+//
+//	GET /poll/<id>/ws?ack=N
+//
+// Each binary message is a type byte, a big-endian uint64 and for chunks the
+// data:
+//
+//	0 seq data   a chunk, upstream from the client or downstream from us
+//	1 next       acknowledges the other side's chunks below next
+//
+// On attaching we acknowledge what we have, so the client knows which
+// upstream chunks to resend, and send downstream chunks from ack on. A
+// session has one carrier at a time: attaching another, or a polling
+// request, ends the earlier WebSocket with close code 1001. When the session
+// closes the carrier gets a normal close frame (1000); when only the carrier
+// breaks, the session waits for the next one until it has been idle for
+// pollSessionIdle.
+const (
+	carrierChunk = 0
+	carrierAck   = 1
+	// type byte and uint64
+	carrierHeader = 9
+)
+
+var sessionMigrations = registry.Counter("session_migrations_total", "Poll sessions moved to another carrier")
+
+// attach makes a WebSocket the session's carrier, acknowledging downstream
+// chunks below ack, and returns its generation. It reports whether the
+// session was carried before, which makes this a migration.
+func (s *PollSession) attach(ack uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	migrated := s.carried
+	s.carried = true
+	s.carrier++
+	s.wsCarried = true
+	s.lastSeen = time.Now()
+	s.ack(ack)
+	s.changed()
+	return s.carrier, migrated
+}
+
+// polled notes a polling request, which takes the session over from a
+// WebSocket carrier
+func (s *PollSession) polled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.carried = true
+	if s.wsCarried {
+		s.wsCarried = false
+		s.carrier++
+		s.changed()
+		sessionMigrations.Inc()
+		s.log.Info("Poll session moved to polling")
+	}
+}
+
+func handlePollCarrier(w http.ResponseWriter, r *http.Request, s *PollSession) {
+	var ack uint64
+	if v := r.URL.Query().Get("ack"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ack", http.StatusBadRequest)
+			return
+		}
+		ack = n
+	}
+
+	upgrader := newUpgrader()
+	conn, err := upgrader.Upgrade(w, r, varyHandshake())
+	if err != nil {
+		s.log.Warn("Carrier upgrade failed", "carrier", r.RemoteAddr, "err", err)
+		handshakeFailures.Inc()
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(carrierHeader + pollMaxChunk)
+
+	gen, migrated := s.attach(ack)
+	if migrated {
+		sessionMigrations.Inc()
+		s.log.Info("Poll session moved to a WebSocket", "carrier", r.RemoteAddr)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readCarrier(conn, s)
+	}()
+	writeCarrier(conn, s, gen, ack, done)
+}
+
+// readCarrier passes the client's chunks and acknowledgements to the
+// session until the WebSocket fails
+func readCarrier(conn *websocket.Conn, s *PollSession) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(msg) < carrierHeader {
+			return
+		}
+		n := binary.BigEndian.Uint64(msg[1:carrierHeader])
+		switch msg[0] {
+		case carrierChunk:
+			if !s.up(n, msg[carrierHeader:]) {
+				// The client skipped a chunk; it has to reattach and resend
+				return
+			}
+		case carrierAck:
+			s.mu.Lock()
+			s.lastSeen = time.Now()
+			s.ack(n)
+			s.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+// writeCarrier sends downstream chunks from next on and acknowledges
+// upstream ones, until the session closes, another carrier takes over or
+// the reader is done
+func writeCarrier(conn *websocket.Conn, s *PollSession, gen, next uint64, done <-chan struct{}) {
+	// Wake up now and then so an idle session stays alive while carried
+	ticker := time.NewTicker(pollHoldTime)
+	defer ticker.Stop()
+
+	acked := ^uint64(0)
+	for {
+		s.mu.Lock()
+		s.lastSeen = time.Now()
+		if s.carrier != gen {
+			s.mu.Unlock()
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "carrier replaced")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+		var chunks []pollChunk
+		for _, c := range s.out {
+			if c.seq >= next {
+				chunks = append(chunks, c)
+			}
+		}
+		upNext := s.upNext
+		closed := s.closed
+		ch := s.notify
+		s.mu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(pollHoldTime))
+		if upNext != acked {
+			if err := conn.WriteMessage(websocket.BinaryMessage, carrierFrame(carrierAck, upNext, nil)); err != nil {
+				return
+			}
+			acked = upNext
+		}
+		for _, c := range chunks {
+			if err := conn.WriteMessage(websocket.BinaryMessage, carrierFrame(carrierChunk, c.seq, c.data)); err != nil {
+				return
+			}
+			next = c.seq + 1
+		}
+		if closed && len(chunks) == 0 {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session closed")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+		if len(chunks) > 0 {
+			continue
+		}
+
+		select {
+		case <-ch:
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func carrierFrame(kind byte, n uint64, data []byte) []byte {
+	b := make([]byte, carrierHeader, carrierHeader+len(data))
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], n)
+	return append(b, data...)
+}
@@ -0,0 +1,881 @@
+// Package mux carries many logical streams over one tunnel, so a client can
+// keep a single long-lived connection to a node and open a stream in it per
+// application connection instead of a new tunnel each time. That saves a
+// TLS and WebSocket handshake, and the authentication behind it, per
+// connection.
+//
+// The tunnel carries frames:
+//
+//	type (1 byte) | stream ID (4 bytes) | length (2 bytes) | payload
+//
+// all big endian. The client numbers its streams with odd IDs and the node
+// with even ones. A stream starts with an open frame and ends when both
+// sides have sent a close frame, like TCP's half-close, or when either sends
+// a reset. Each side may have at most Window bytes of a stream's data in
+// flight, unread by the other; window frames (a 4 byte increment) give
+// credit back as the data is read, so one stream that isn't read can't
+// stall the others.
+//
+// A resumable session outlives its connection. Each side counts the frames
+// it receives and acknowledges them now and then with an ack frame (an 8
+// byte count, stream ID 0), and keeps what it sends until the peer has
+// acknowledged it. When the connection fails the streams stay open and
+// writes are kept for later; Resume carries on over a new connection,
+// given how many frames the peer had received, by sending the rest again.
+// Ack frames aren't counted or kept. How the two sides swap their counts
+// is up to the caller, since it depends on how the new connection is made.
+//
+// Control frames (stream ID 0) carry messages about the session as a whole
+// rather than a stream, such as a request to change its exit address. The
+// session only delivers them, to Config.OnControl; what they say is up to
+// the caller.
+// End of stream on the connection still ends the session: Close sends it
+// with CloseWrite, if the connection has that, so the peer can tell a
+// session that was closed from a connection that broke.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Header is the tunnel request header that asks for multiplexing, and the
+// response header that agrees to it
+const Header = "X-Tunnel-Mux"
+
+// Version is the only value of Header there is so far
+const Version = "mux1"
+
+// ResumeHeader asks for a resumable session with the value "new", and the
+// answer carries the session's token; a request to resume a session gives
+// the token. ReceivedHeader carries the sender's Received count for the
+// other side's Resume, with a request to resume and its answer.
+const (
+	ResumeHeader   = "X-Tunnel-Mux-Resume"
+	ReceivedHeader = "X-Tunnel-Mux-Received"
+)
+
+// ControlHeader in the answer to a tunnel request lists the control
+// messages the node takes, comma-separated. A peer that doesn't know
+// control frames ends the session at the first one, so clients only send
+// what it lists.
+const ControlHeader = "X-Tunnel-Mux-Control"
+
+// Window is how much of a stream's data may be in flight at once
+const Window = 256 << 10
+
+// DefaultMaxStreams is used when Config.MaxStreams is zero
+const DefaultMaxStreams = 256
+
+// DefaultReplayBuffer is used when Config.ReplayBuffer is zero
+const DefaultReplayBuffer = 4 << 20
+
+const (
+	frameOpen byte = iota
+	frameData
+	frameWindow
+	frameClose
+	frameReset
+	frameAck
+	frameControl
+)
+
+const (
+	headerSize = 7
+	maxPayload = 32 << 10
+	// Streams opened by the peer and not yet accepted; more are reset
+	acceptBacklog = 64
+	// A resumable session acknowledges every this many frames, or bytes of
+	// frames, whichever comes first; the peer's replay buffer must hold
+	// well over ackBytes, or it could fill up waiting for an ack
+	ackEvery        = 16
+	ackBytes        = 128 << 10
+	minReplayBuffer = 4 * ackBytes
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	ErrWriteClosed   = errors.New("mux: write side closed")
+	// The peer's count of received frames doesn't fit what was sent
+	ErrResumeMismatch = errors.New("mux: peer can't resume from here")
+	errNotResumable   = errors.New("mux: session is not resumable")
+	errProtocol       = errors.New("mux: protocol error")
+)
+
+type Config struct {
+	// MaxStreams caps the streams open in the session at once; streams the
+	// peer opens beyond it are reset
+	MaxStreams int
+	// Resumable keeps the session open when its connection fails, so that
+	// Resume can carry it on over another. Both sides must set it.
+	Resumable bool
+	// ReplayBuffer caps the bytes of a resumable session's frames kept
+	// until the peer acknowledges them; writes wait while it is full. It
+	// is at least 512 KB.
+	ReplayBuffer int
+	// OnControl gets the payload of each control frame from the peer, on
+	// the goroutine reading the connection, so it must not block on the
+	// session; the payload is its own to keep. Without it control frames
+	// are dropped.
+	OnControl func(payload []byte)
+}
+
+// Session is one side of a multiplexed tunnel.
+type Session struct {
+	maxStreams int
+	resumable  bool
+	onControl  func([]byte)
+
+	// The connection the session runs over, or last ran over
+	connMu sync.Mutex
+	att    *attachment
+
+	// Frames are built in writeBuf, under writeMu
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	// Resumable sessions keep the frames sent since acked in replay[head:],
+	// replayLens long each, oldest first
+	replayMu    sync.Mutex
+	replay      []byte
+	replayHead  int
+	replayLens  []int
+	maxReplay   int
+	acked, sent uint64
+	// Closed and replaced when an ack frees replay space
+	replaySpace chan struct{}
+
+	// Frames, and bytes of them, received and acknowledged
+	received, receivedBytes atomic.Uint64
+	ackedUpTo, ackedBytes   atomic.Uint64
+	ackNeeded               chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// attachment is one connection a session runs over
+type attachment struct {
+	conn io.ReadWriteCloser
+	// Closed when conn is dropped, with dropped set under connMu
+	detached chan struct{}
+	dropped  bool
+	// Closed when the reader of conn has stopped
+	readerDone chan struct{}
+}
+
+func newAttachment(conn io.ReadWriteCloser) *attachment {
+	return &attachment{conn: conn, detached: make(chan struct{}), readerDone: make(chan struct{})}
+}
+
+// Client starts the client's side of a session over conn.
+func Client(conn io.ReadWriteCloser, config Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts the node's side of a session over conn.
+func Server(conn io.ReadWriteCloser, config Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, config Config, firstID uint32) *Session {
+	if config.MaxStreams <= 0 {
+		config.MaxStreams = DefaultMaxStreams
+	}
+	if config.ReplayBuffer <= 0 {
+		config.ReplayBuffer = DefaultReplayBuffer
+	}
+	config.ReplayBuffer = max(config.ReplayBuffer, minReplayBuffer)
+	s := &Session{
+		att:        newAttachment(conn),
+		maxStreams: config.MaxStreams,
+		resumable:  config.Resumable,
+		onControl:  config.OnControl,
+		streams:    make(map[uint32]*Stream),
+		nextID:     firstID,
+		accept:     make(chan *Stream, acceptBacklog),
+		done:       make(chan struct{}),
+	}
+	if s.resumable {
+		s.maxReplay = config.ReplayBuffer
+		s.replaySpace = make(chan struct{})
+		s.ackNeeded = make(chan struct{}, 1)
+		go s.ackLoop()
+	}
+	go s.readLoop(s.att)
+	return s
+}
+
+// Open starts a new stream. The peer learns of it with the first frame, so
+// Open doesn't wait for a round trip.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(frameOpen, id, nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Control sends the peer a control frame with msg, which must fit in one
+// frame.
+func (s *Session) Control(msg []byte) error {
+	if len(msg) > maxPayload {
+		return errors.New("mux: control message too long")
+	}
+	return s.writeFrame(frameControl, 0, msg)
+}
+
+// Accept waits for the peer to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns how many streams are open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, or nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Detached is closed when the session's current connection fails or is
+// detached, and for a session that isn't resumable, when it ends.
+func (s *Session) Detached() <-chan struct{} {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.att.detached
+}
+
+// Detach drops the session's connection, if it still has one, and waits
+// until nothing more is read from it, so Received stays put until Resume.
+func (s *Session) Detach() {
+	s.connMu.Lock()
+	a := s.att
+	s.connMu.Unlock()
+	s.drop(a)
+	<-a.readerDone
+}
+
+// Received returns how many frames of a resumable session have come from
+// the peer, for the peer's Resume.
+func (s *Session) Received() uint64 {
+	return s.received.Load()
+}
+
+// Resume carries a resumable session on over conn, sending again every
+// frame after the first peerReceived. A connection the session still has
+// is dropped first. It fails with ErrResumeMismatch if the peer claims to
+// have received frames the session never sent or has already forgotten,
+// after which the session can't go on.
+func (s *Session) Resume(conn io.ReadWriteCloser, peerReceived uint64) error {
+	if !s.resumable {
+		return errNotResumable
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.Detach()
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+
+	s.replayMu.Lock()
+	err := s.ackLocked(peerReceived)
+	// A copy, since acks coming in over conn move the buffer
+	pending := append([]byte(nil), s.replay[s.replayHead:]...)
+	s.replayMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Read before writing: the peer may be resending too, and neither side
+	// would get its frames through if both waited for the other
+	a := newAttachment(conn)
+	s.connMu.Lock()
+	s.att = a
+	s.connMu.Unlock()
+	go s.readLoop(a)
+	if len(pending) > 0 {
+		if _, err := conn.Write(pending); err != nil {
+			s.drop(a)
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the session and every stream in it.
+func (s *Session) Close() error {
+	if s.resumable {
+		s.connMu.Lock()
+		a := s.att
+		s.connMu.Unlock()
+		if cw, ok := a.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	s.closeWith(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWith(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+		s.connMu.Lock()
+		a := s.att
+		s.connMu.Unlock()
+		s.drop(a)
+	})
+}
+
+// drop closes a's connection and marks it detached
+func (s *Session) drop(a *attachment) {
+	a.conn.Close()
+	s.connMu.Lock()
+	if !a.dropped {
+		a.dropped = true
+		close(a.detached)
+	}
+	s.connMu.Unlock()
+}
+
+// connFailed ends the session, or for a resumable one whose connection
+// broke rather than ended, only a's part in it
+func (s *Session) connFailed(a *attachment, err error) {
+	if s.resumable && err != io.EOF {
+		s.drop(a)
+		return
+	}
+	if err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.closeWith(err)
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame sends a frame. A resumable session keeps it for Resume, and
+// while it has no connection, only keeps it.
+func (s *Session) writeFrame(kind byte, id uint32, payload []byte) error {
+	keep := s.resumable && kind != frameAck
+	if keep {
+		if err := s.waitReplaySpace(headerSize + len(payload)); err != nil {
+			return err
+		}
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	if s.writeBuf == nil {
+		s.writeBuf = make([]byte, headerSize+maxPayload)
+	}
+	frame := s.writeBuf[:headerSize+len(payload)]
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	copy(frame[headerSize:], payload)
+	if keep {
+		s.replayMu.Lock()
+		s.replay = append(s.replay, frame...)
+		s.replayLens = append(s.replayLens, len(frame))
+		s.sent++
+		s.replayMu.Unlock()
+	}
+
+	s.connMu.Lock()
+	a := s.att
+	dropped := a.dropped
+	s.connMu.Unlock()
+	if dropped {
+		return nil
+	}
+	if _, err := a.conn.Write(frame); err != nil {
+		s.connFailed(a, err)
+		if !s.resumable {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitReplaySpace waits until the replay buffer has room for n more bytes.
+// Concurrent writers may overshoot it by a frame each.
+func (s *Session) waitReplaySpace(n int) error {
+	for {
+		s.replayMu.Lock()
+		if len(s.replay)-s.replayHead+n <= s.maxReplay {
+			s.replayMu.Unlock()
+			return nil
+		}
+		space := s.replaySpace
+		s.replayMu.Unlock()
+		select {
+		case <-space:
+		case <-s.done:
+			return s.Err()
+		}
+	}
+}
+
+// ackLocked forgets the frames the peer says it has received, n in all.
+// Called with replayMu held.
+func (s *Session) ackLocked(n uint64) error {
+	if n < s.acked || n > s.sent {
+		return ErrResumeMismatch
+	}
+	if n == s.acked {
+		return nil
+	}
+	for ; s.acked < n; s.acked++ {
+		s.replayHead += s.replayLens[0]
+		s.replayLens = s.replayLens[1:]
+	}
+	if s.replayHead == len(s.replay) {
+		s.replay, s.replayHead = s.replay[:0], 0
+	} else if s.replayHead > len(s.replay)/2 {
+		s.replay = append(s.replay[:0], s.replay[s.replayHead:]...)
+		s.replayHead = 0
+	}
+	close(s.replaySpace)
+	s.replaySpace = make(chan struct{})
+	return nil
+}
+
+// ackLoop acknowledges received frames when readLoop asks it to, so that
+// readLoop never waits on a write
+func (s *Session) ackLoop() {
+	var count [8]byte
+	for {
+		select {
+		case <-s.ackNeeded:
+		case <-s.done:
+			return
+		}
+		n := s.received.Load()
+		s.ackedUpTo.Store(n)
+		s.ackedBytes.Store(s.receivedBytes.Load())
+		binary.BigEndian.PutUint64(count[:], n)
+		s.writeFrame(frameAck, 0, count[:])
+	}
+}
+
+func (s *Session) readLoop(a *attachment) {
+	defer close(a.readerDone)
+	// Streams copy what they receive, so one buffer does for every frame
+	buf := make([]byte, headerSize+1<<16)
+	head := buf[:headerSize]
+	for {
+		if _, err := io.ReadFull(a.conn, head); err != nil {
+			s.connFailed(a, err)
+			return
+		}
+		payload := buf[headerSize : headerSize+int(binary.BigEndian.Uint16(head[5:]))]
+		if _, err := io.ReadFull(a.conn, payload); err != nil {
+			s.connFailed(a, err)
+			return
+		}
+		if err := s.handle(head[0], binary.BigEndian.Uint32(head[1:]), payload); err != nil {
+			s.closeWith(err)
+			return
+		}
+		if s.resumable && head[0] != frameAck {
+			bytes := s.receivedBytes.Add(uint64(headerSize + len(payload)))
+			if s.received.Add(1)-s.ackedUpTo.Load() >= ackEvery || bytes-s.ackedBytes.Load() >= ackBytes {
+				notify(s.ackNeeded)
+			}
+		}
+	}
+}
+
+func (s *Session) handle(kind byte, id uint32, payload []byte) error {
+	switch kind {
+	case frameOpen:
+		return s.opened(id)
+	case frameAck:
+		if !s.resumable || len(payload) != 8 {
+			return errProtocol
+		}
+		n := binary.BigEndian.Uint64(payload)
+		s.replayMu.Lock()
+		defer s.replayMu.Unlock()
+		if n < s.acked {
+			// Counted before a Resume that has acknowledged more
+			return nil
+		}
+		return s.ackLocked(n)
+	case frameControl:
+		if id != 0 {
+			return errProtocol
+		}
+		if s.onControl != nil {
+			s.onControl(append([]byte(nil), payload...))
+		}
+		return nil
+	}
+	st := s.stream(id)
+	if st == nil {
+		// Frames that were in flight when the stream ended
+		return nil
+	}
+	switch kind {
+	case frameData:
+		return st.receive(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return errProtocol
+		}
+		st.grow(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		st.remoteClosed()
+	case frameReset:
+		st.remoteReset()
+	default:
+		return errProtocol
+	}
+	return nil
+}
+
+// opened handles a stream the peer opened
+func (s *Session) opened(id uint32) error {
+	s.mu.Lock()
+	if id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return errProtocol
+	}
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return errProtocol
+	}
+	if len(s.streams) >= s.maxStreams {
+		s.mu.Unlock()
+		// Not from this goroutine: a peer that doesn't read would stall it
+		go s.writeFrame(frameReset, id, nil)
+		return nil
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.forget(id)
+		go s.writeFrame(frameReset, id, nil)
+	}
+	return nil
+}
+
+// Stream is one logical connection in a session. Reads and writes may
+// happen concurrently, as on a net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	// Held for the whole of a Write, so concurrent writes don't interleave
+	// and a close frame can't overtake data
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// Received data not yet read is buf[off:]; the buffer is reused once
+	// it has all been read
+	buf        []byte
+	off        int
+	unacked    uint32
+	sendWindow uint32
+	// The peer sent its close frame, and we ours
+	readDone  bool
+	writeDone bool
+	reset     bool
+	closed    bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		sendWindow: Window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's number in its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if st.off < len(st.buf) {
+			n := copy(b, st.buf[st.off:])
+			st.off += n
+			if st.off == len(st.buf) {
+				st.buf, st.off = st.buf[:0], 0
+			}
+			st.unacked += uint32(n)
+			var credit uint32
+			if st.unacked >= Window/2 && !st.readDone {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if credit > 0 {
+				var inc [4]byte
+				binary.BigEndian.PutUint32(inc[:], credit)
+				// An error ends the session, which the next read reports
+				st.sess.writeFrame(frameWindow, st.id, inc[:])
+			}
+			return n, nil
+		}
+		if st.readDone {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.writeDone:
+			st.mu.Unlock()
+			return written, ErrWriteClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), maxPayload, int(st.sendWindow))
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+		if err := st.sess.writeFrame(frameData, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer we are done sending; reading goes on.
+func (st *Stream) CloseWrite() error {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	st.mu.Lock()
+	if st.writeDone || st.reset || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeDone = true
+	finished := st.readDone
+	st.mu.Unlock()
+	if finished {
+		st.sess.forget(st.id)
+	}
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}
+
+// Close ends the stream. Unless both sides had finished sending, the peer
+// gets a reset, as TCP does when data is left unread.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf, st.off = nil, 0
+	graceful := st.reset || st.readDone && st.writeDone
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.sess.forget(st.id)
+	if graceful {
+		return nil
+	}
+	return st.sess.writeFrame(frameReset, st.id, nil)
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+// wait blocks until ch is signalled, the deadline passes or the session
+// ends
+func (st *Stream) wait(ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.sess.done:
+		return st.sess.Err()
+	}
+}
+
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	if st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	if st.readDone || len(st.buf)-st.off+int(st.unacked)+len(data) > Window {
+		st.mu.Unlock()
+		return errProtocol
+	}
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.readDone = true
+	finished := st.writeDone
+	st.mu.Unlock()
+	notify(st.readable)
+	if finished {
+		st.sess.forget(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.buf, st.off = nil, 0
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.sess.forget(st.id)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "net/http"
+
+// Notice keys: refusals the client should explain to its user carry a
+// stable key in an X-Notice header beside the English text, and the client
+// shows its own translation of the key. The reasons of stream limit close
+// frames are keys too, with spaces for underscores. Keys never change
+// meaning; a new kind of refusal gets a new key.
+const (
+	noticeUnauthorized = "unauthorized"
+	noticeOverloaded   = "overloaded"
+	noticeSessionLimit = "session_limit"
+	noticeTenantQuota  = "tenant_quota"
+	noticeE2ERequired  = "e2e_required"
+	noticeQuota        = "quota_exceeded"
+)
+
+// refuse answers a tunnel request with status, text and notice key
+func refuse(w http.ResponseWriter, status int, notice, text string) {
+	w.Header().Set("X-Notice", notice)
+	http.Error(w, text, status)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LoadShedder protects tunnels that are already established by refusing new
+// upgrades once the node is at capacity. Shedding starts when the number of
+// active tunnels reaches maxTunnels and stops again once it has dropped to
+// resumeAt, so the node doesn't flap around the limit.
+type LoadShedder struct {
+	maxTunnels int64
+	resumeAt   int64
+	retryAfter time.Duration
+
+	active   atomic.Int64
+	shedding atomic.Bool
+	held     atomic.Bool
+}
+
+func NewLoadShedder(maxTunnels int64, retryAfter time.Duration) *LoadShedder {
+	// Resume accepting at 90% of the limit
+	resumeAt := maxTunnels - maxTunnels/10
+	if resumeAt >= maxTunnels {
+		resumeAt = maxTunnels - 1
+	}
+	return &LoadShedder{
+		maxTunnels: maxTunnels,
+		resumeAt:   resumeAt,
+		retryAfter: retryAfter,
+	}
+}
+
+// loadShedderFromEnv builds a LoadShedder from MAX_TUNNELS and
+// OVERLOAD_RETRY_AFTER. A MAX_TUNNELS of 0 (the default) disables shedding.
+func loadShedderFromEnv() *LoadShedder {
+	var maxTunnels int64
+	if v := os.Getenv("MAX_TUNNELS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			slog.Warn("Ignoring invalid MAX_TUNNELS value", "value", v)
+		} else {
+			maxTunnels = n
+		}
+	}
+
+	retryAfter := 30 * time.Second
+	if v := os.Getenv("OVERLOAD_RETRY_AFTER"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			slog.Warn("Ignoring invalid OVERLOAD_RETRY_AFTER value", "value", v)
+		} else {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+	}
+
+	return NewLoadShedder(maxTunnels, retryAfter)
+}
+
+// Acquire reserves a tunnel slot. It returns false if the node is shedding
+// load, in which case the caller must not start a tunnel.
+func (s *LoadShedder) Acquire() bool {
+	if s.held.Load() {
+		return false
+	}
+
+	if s.maxTunnels <= 0 {
+		s.active.Add(1)
+		return true
+	}
+
+	if s.shedding.Load() {
+		return false
+	}
+
+	n := s.active.Add(1)
+	if n > s.maxTunnels {
+		s.active.Add(-1)
+		s.enterOverload()
+		return false
+	}
+	if n == s.maxTunnels {
+		s.enterOverload()
+	}
+	return true
+}
+
+// Release frees a slot reserved by Acquire.
+func (s *LoadShedder) Release() {
+	n := s.active.Add(-1)
+	if s.maxTunnels > 0 && n <= s.resumeAt && s.shedding.CompareAndSwap(true, false) {
+		slog.Info("Load back down, accepting new connections again", "tunnels", n, "max_tunnels", s.maxTunnels)
+	}
+}
+
+func (s *LoadShedder) enterOverload() {
+	if s.shedding.CompareAndSwap(false, true) {
+		slog.Warn("Reached the tunnel limit, shedding new connections", "max_tunnels", s.maxTunnels)
+	}
+}
+
+// Hold refuses all new tunnels regardless of the tunnel count, for callers
+// such as the resource watchdog that detect overload by other means.
+func (s *LoadShedder) Hold() {
+	s.held.Store(true)
+}
+
+// Unhold undoes Hold.
+func (s *LoadShedder) Unhold() {
+	s.held.Store(false)
+}
+
+// Overloaded reports whether new tunnels are currently being refused.
+func (s *LoadShedder) Overloaded() bool {
+	return s.shedding.Load() || s.held.Load()
+}
+
+// Active returns the number of tunnels currently holding a slot.
+func (s *LoadShedder) Active() int64 {
+	return s.active.Load()
+}
+
+// Reject answers a refused upgrade with 503 and a Retry-After hint so
+// clients back off or pick another node instead of hammering this one.
+func (s *LoadShedder) Reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.retryAfter/time.Second)))
+	refuse(w, http.StatusServiceUnavailable, noticeOverloaded, "Server overloaded")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Time zones for profiles, which the container image doesn't have
+	_ "time/tzdata"
+)
+
+// NodeParentalControls enforces the parental controls profiles of the
+// organization owning this private node (ENFORCE_PARENTAL_CONTROLS). A
+// profile's rules block domains, listed or by category, during time windows
+// in the profile's time zone, for the members the profile lists. It works
+// as a policy plugin that those members' tunnels get whether they ask or
+// not, so it sees the names in their first bytes too; nobody else's
+// traffic is looked at.
+//
+// Profiles come from the sync server, which only hands them to the node
+// holding PRIVATE_NODE_TOKEN, every ACL_POLL_INTERVAL.
+type NodeParentalControls struct {
+	mu sync.RWMutex
+	// By user; a user listed by several profiles gets the first
+	profiles map[string]*parentalProfile
+	blocks   *Metric
+}
+
+type parentalProfile struct {
+	name  string
+	loc   *time.Location
+	rules []scheduleRule
+}
+
+type scheduleRule struct {
+	// Bit n for time.Weekday n, the days a window starts on; 0 for every day
+	days uint8
+	// Minutes after midnight; the window ends before to, wraps past
+	// midnight when to is earlier, and lasts all day when they are equal
+	from, to int
+	domains  []string
+}
+
+// The profile as the sync server sends it
+type parentalProfileJSON struct {
+	Name       string              `json:"name"`
+	Users      []string            `json:"users"`
+	Timezone   string              `json:"timezone"`
+	Categories map[string][]string `json:"categories"`
+	Rules      []scheduleRuleJSON  `json:"rules"`
+}
+
+type scheduleRuleJSON struct {
+	Days       []string `json:"days"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Domains    []string `json:"domains"`
+	Categories []string `json:"categories"`
+}
+
+// nodeParental is nil unless ENFORCE_PARENTAL_CONTROLS is set
+var nodeParental *NodeParentalControls
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func newNodeParentalControls() *NodeParentalControls {
+	return &NodeParentalControls{
+		blocks: registry.CounterWith("policy_blocks_total", "Destinations refused by each policy plugin", "policy", "parental"),
+	}
+}
+
+// covers reports whether a profile applies to subject
+func (p *NodeParentalControls) covers(subject string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.profiles[subject]
+	return ok
+}
+
+// Check returns why subject may not reach host at now, or "" if they may
+func (p *NodeParentalControls) Check(subject, host string, now time.Time) string {
+	p.mu.RLock()
+	profile := p.profiles[subject]
+	p.mu.RUnlock()
+	if profile == nil {
+		return ""
+	}
+	return profile.check(host, now)
+}
+
+func (p *parentalProfile) check(host string, now time.Time) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	now = now.In(p.loc)
+	for _, rule := range p.rules {
+		if !rule.active(now) {
+			continue
+		}
+		for _, domain := range rule.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return fmt.Sprintf("%s profile, %s-%s", p.name, clock(rule.from), clock(rule.to))
+			}
+		}
+	}
+	return ""
+}
+
+func (r *scheduleRule) active(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	startsOn := func(day time.Weekday) bool { return r.days == 0 || r.days&(1<<day) != 0 }
+	switch {
+	case r.from == r.to:
+		return startsOn(today)
+	case r.from < r.to:
+		return startsOn(today) && minute >= r.from && minute < r.to
+	default:
+		return startsOn(today) && minute >= r.from || startsOn(yesterday) && minute < r.to
+	}
+}
+
+func clock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// parseClock reads HH:MM as minutes after midnight
+func parseClock(v string) (int, error) {
+	h, m, ok := strings.Cut(v, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || hours > 23 || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %q", v)
+	}
+	return hours*60 + minutes, nil
+}
+
+func compileParentalProfile(profile parentalProfileJSON) (*parentalProfile, error) {
+	loc := time.UTC
+	if profile.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(profile.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	compiled := &parentalProfile{name: profile.Name, loc: loc}
+	for _, rule := range profile.Rules {
+		var r scheduleRule
+		var err error
+		if r.from, err = parseClock(rule.From); err != nil {
+			return nil, err
+		}
+		if r.to, err = parseClock(rule.To); err != nil {
+			return nil, err
+		}
+		for _, day := range rule.Days {
+			d, ok := weekdays[day]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", day)
+			}
+			r.days |= 1 << d
+		}
+		r.domains = append(r.domains, rule.Domains...)
+		for _, category := range rule.Categories {
+			r.domains = append(r.domains, profile.Categories[category]...)
+		}
+		compiled.rules = append(compiled.rules, r)
+	}
+	return compiled, nil
+}
+
+func (p *NodeParentalControls) fetch(syncServerURL, serverID, token string) ([]parentalProfileJSON, error) {
+	req, err := http.NewRequest(http.MethodGet, syncServerURL+"/servers/"+serverID+"/parental-controls", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body struct {
+		Profiles []parentalProfileJSON `json:"profiles"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Profiles, nil
+}
+
+// Poll refreshes the profiles from the sync server forever. A failed poll
+// keeps the previous profiles.
+func (p *NodeParentalControls) Poll(syncServerURL, serverID string, interval time.Duration) {
+	for {
+		if err := p.Refresh(syncServerURL, serverID); err != nil {
+			slog.Warn("Failed to fetch parental controls", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Refresh fetches the profiles from the sync server once. A profile the node
+// can't read is skipped, so its users aren't restricted by it.
+func (p *NodeParentalControls) Refresh(syncServerURL, serverID string) error {
+	profiles, err := p.fetch(syncServerURL, serverID, nodeToken)
+	if err != nil {
+		return err
+	}
+	byUser := make(map[string]*parentalProfile)
+	for _, profile := range profiles {
+		compiled, err := compileParentalProfile(profile)
+		if err != nil {
+			slog.Warn("Ignoring invalid parental controls profile", "profile", profile.Name, "err", err)
+			continue
+		}
+		for _, user := range profile.Users {
+			if _, ok := byUser[user]; !ok {
+				byUser[user] = compiled
+			}
+		}
+	}
+	p.mu.Lock()
+	p.profiles = byUser
+	p.mu.Unlock()
+	return nil
+}
+
+// parentalPolicy is the plugin for one user's tunnels
+type parentalPolicy struct {
+	subject string
+}
+
+func (p parentalPolicy) check(host string) string {
+	return nodeParental.Check(p.subject, host, time.Now())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Parental controls windows must block in the profile's time zone, across
+// midnight on the days they start, and for subdomains of what they list.
+
+func TestParentalProfileWindows(t *testing.T) {
+	compiled, err := compileParentalProfile(parentalProfileJSON{
+		Name:       "kids",
+		Timezone:   "Europe/Amsterdam",
+		Categories: map[string][]string{"social": {"social.example"}},
+		Rules: []scheduleRuleJSON{
+			// School nights
+			{Days: []string{"sun", "mon", "tue", "wed", "thu"}, From: "22:00", To: "07:00", Categories: []string{"social"}},
+			{From: "00:00", To: "00:00", Domains: []string{"casino.example"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amsterdam, _ := time.LoadLocation("Europe/Amsterdam")
+	at := func(day, clock string) time.Time {
+		now, err := time.ParseInLocation("2006-01-02 15:04", day+" "+clock, amsterdam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+	// 2026-10-15 is a Thursday
+	for _, tc := range []struct {
+		host    string
+		now     time.Time
+		blocked bool
+	}{
+		{"social.example", at("2026-10-15", "21:59"), false},
+		{"social.example", at("2026-10-15", "22:00"), true},
+		{"www.Social.example.", at("2026-10-15", "23:30"), true},
+		{"social.example", at("2026-10-16", "06:59"), true},
+		{"social.example", at("2026-10-16", "07:00"), false},
+		// Friday night starts no window, but Thursday's reaches Friday morning
+		{"social.example", at("2026-10-16", "23:00"), false},
+		{"social.example", at("2026-10-17", "03:00"), false},
+		{"antisocial.example", at("2026-10-15", "23:00"), false},
+		{"casino.example", at("2026-10-17", "12:00"), true},
+		// 20:30 UTC is 22:30 in Amsterdam in summer time
+		{"social.example", time.Date(2026, 6, 15, 20, 30, 0, 0, time.UTC), true},
+	} {
+		if got := compiled.check(tc.host, tc.now) != ""; got != tc.blocked {
+			t.Errorf("%s at %s blocked = %v, want %v", tc.host, tc.now, got, tc.blocked)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Policy plugins: checks on where a tunnel goes that clients opt into, per
+// tunnel, with X-Tunnel-Policies: <name>[,<name>...]. Tunnels that don't
+// ask get none of them, so users who would rather nothing looked at their
+// traffic keep it that way; every tunnel still gets destinationAllowed and
+// BLOCKLIST_FEEDS. A request for a plugin the node doesn't have is refused
+// with 400, and X-Tunnel-Policies-Available lists those it does, so a
+// client never believes it is protected when it isn't. Parental controls
+// are the exception: a user their org gave a profile gets that plugin
+// without asking; see parental.go.
+//
+// A plugin sees the destination the client names and, on tunnels relayed
+// one destination each, the name in the first bytes the client sends: the
+// server name of a TLS ClientHello, or the Host header of a plain HTTP
+// request. Those bytes are held back until the plugins have seen them,
+// and nothing after them is looked at. A blocked destination gets SOCKS
+// reply 2 (or 403 for X-Destination), or the tunnel is closed before the
+// first byte reaches it, and a plain WebSocket tunnel's client first gets a
+// text message saying why:
+//
+//	{"type": "blocked", "policy": "malware", "host": "bad.example",
+//	 "reason": "listed by urlhaus"}
+const policiesHeader = "X-Tunnel-Policies"
+
+type policyPlugin interface {
+	// check returns why the tunnel may not reach host, a name or an
+	// address, or "" if it may
+	check(host string) string
+}
+
+type registeredPolicy struct {
+	name   string
+	plugin policyPlugin
+	blocks *Metric
+}
+
+// Registered at startup by the plugins that are configured
+var policyPlugins = map[string]*registeredPolicy{}
+
+var errPolicyBlocked = errors.New("destination blocked by policy")
+
+func registerPolicy(name string, plugin policyPlugin) {
+	policyPlugins[name] = &registeredPolicy{
+		name:   name,
+		plugin: plugin,
+		blocks: registry.CounterWith("policy_blocks_total", "Destinations refused by each policy plugin", "policy", name),
+	}
+}
+
+// malwarePolicy refuses names and addresses listed in MALWARE_FEEDS, which
+// take the same format as BLOCKLIST_FEEDS
+type malwarePolicy struct {
+	feeds *Blocklists
+}
+
+// Set when MALWARE_FEEDS is
+var malwareFeeds *Blocklists
+
+func (p malwarePolicy) check(host string) string {
+	var feed string
+	if ip := net.ParseIP(host); ip != nil {
+		feed = p.feeds.ipBlockedBy(ip)
+	} else {
+		feed = p.feeds.hostBlockedBy(host)
+	}
+	if feed == "" {
+		return ""
+	}
+	return "listed by " + feed
+}
+
+func availablePolicies() []string {
+	names := make([]string, 0, len(policyPlugins))
+	for name := range policyPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// negotiatePolicies turns on the plugins the request asks for. It answers
+// the request and returns false if any of them isn't available.
+func (t *Tunnel) negotiatePolicies(w http.ResponseWriter, r *http.Request) bool {
+	v := r.Header.Get(policiesHeader)
+	if v == "" {
+		return true
+	}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		p := policyPlugins[name]
+		if p == nil {
+			w.Header().Set(policiesHeader+"-Available", strings.Join(availablePolicies(), ","))
+			http.Error(w, fmt.Sprintf("Policy %q is not available on this node", name), http.StatusBadRequest)
+			return false
+		}
+		if !slices.Contains(t.policies, p) {
+			t.policies = append(t.policies, p)
+		}
+	}
+	return true
+}
+
+// activePolicies returns the plugins the tunnel asked for, and parental
+// controls if its user has a profile
+func (t *Tunnel) activePolicies() []*registeredPolicy {
+	if nodeParental == nil || t.id == nil || !nodeParental.covers(t.id.Subject) {
+		return t.policies
+	}
+	parental := &registeredPolicy{name: "parental", plugin: parentalPolicy{t.id.Subject}, blocks: nodeParental.blocks}
+	return append(slices.Clip(t.policies), parental)
+}
+
+// blockedByPolicy checks host against the tunnel's plugins, telling the
+// client when one of them blocks it
+func (t *Tunnel) blockedByPolicy(host string) error {
+	for _, p := range t.activePolicies() {
+		reason := p.plugin.check(host)
+		if reason == "" {
+			continue
+		}
+		p.blocks.Inc()
+		t.log.Debug("Destination blocked by policy", "policy", p.name, "dst", host, "reason", reason)
+		if t.control != nil {
+			msg, _ := json.Marshal(map[string]string{"type": "blocked", "policy": p.name, "host": host, "reason": reason})
+			t.control.WriteText(msg)
+		}
+		return fmt.Errorf("%w %s: %s", errPolicyBlocked, p.name, reason)
+	}
+	return nil
+}
+
+// inspectedConn holds back the first bytes the client sends until the
+// tunnel's plugins have seen the name in them
+type inspectedConn struct {
+	Conn
+	t       *Tunnel
+	checked bool
+	pending []byte
+	err     error
+}
+
+func (c *inspectedConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		if err := c.check(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *inspectedConn) check() error {
+	var buf []byte
+	host, more := sniffHost(buf)
+	for more {
+		buf = slices.Grow(buf, 4096)
+		n, err := c.Conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			// Passed on once the bytes before it are
+			c.err = err
+			break
+		}
+		host, more = sniffHost(buf)
+	}
+	c.pending = buf
+	if host == "" {
+		return nil
+	}
+	return c.t.blockedByPolicy(host)
+}
+
+// As much as the largest TLS record
+const maxSniff = 5 + 1<<14
+
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH "}
+
+// sniffHost returns the name a connection's first bytes are for, and
+// whether more bytes are needed to tell
+func sniffHost(data []byte) (string, bool) {
+	if len(data) == 0 {
+		return "", true
+	}
+	// A TLS handshake record: type, version, length
+	if data[0] == 0x16 {
+		if len(data) < 5 {
+			return "", true
+		}
+		end := 5 + int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < end {
+			return "", true
+		}
+		return clientHelloServerName(data[5:end]), false
+	}
+	isHTTP := false
+	for _, method := range httpMethods {
+		n := min(len(data), len(method))
+		if string(data[:n]) != method[:n] {
+			continue
+		}
+		if n < len(method) {
+			return "", true
+		}
+		isHTTP = true
+	}
+	if !isHTTP {
+		return "", false
+	}
+	head, _, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !found && len(data) < maxSniff {
+		return "", true
+	}
+	return httpHost(head), false
+}
+
+// clientHelloServerName returns the server name in a ClientHello
+// handshake message, or "" if it has none. With Encrypted Client Hello
+// that is the outer, public name.
+func clientHelloServerName(msg []byte) string {
+	s := cryptobyte.String(msg)
+	var typ uint8
+	var hello, skip, exts cryptobyte.String
+	if !s.ReadUint8(&typ) || typ != 1 || !s.ReadUint24LengthPrefixed(&hello) {
+		return ""
+	}
+	// Version and random, then session ID, cipher suites and compression
+	// methods
+	if !hello.Skip(2+32) || !hello.ReadUint8LengthPrefixed(&skip) || !hello.ReadUint16LengthPrefixed(&skip) ||
+		!hello.ReadUint8LengthPrefixed(&skip) || !hello.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var extType uint16
+		var ext, names cryptobyte.String
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		// server_name (RFC 6066)
+		if extType != 0 || !ext.ReadUint16LengthPrefixed(&names) {
+			continue
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// httpHost returns the host of an HTTP request's Host header, without the
+// port
+func httpHost(head []byte) string {
+	lines := strings.Split(string(head), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			return host
+		}
+		return strings.Trim(value, "[]")
+	}
+	return ""
+}
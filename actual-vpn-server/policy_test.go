@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A policy plugin must see the name in a ClientHello or HTTP request
+// however the client's first bytes are split, and hold them back until it
+// has.
+
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	defer client.Close()
+	defer server.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestSniffHost(t *testing.T) {
+	hello := clientHello(t, "bad.example")
+	for _, tc := range []struct {
+		name string
+		data []byte
+		host string
+		more bool
+	}{
+		{"ClientHello", hello, "bad.example", false},
+		{"partial ClientHello", hello[:len(hello)-1], "", true},
+		{"record header only", hello[:3], "", true},
+		{"HTTP", []byte("GET / HTTP/1.1\r\nhost: bad.example:8080\r\nAccept: */*\r\n\r\n"), "bad.example", false},
+		{"partial HTTP", []byte("GET / HTTP/1.1\r\nHost: bad.example\r\n"), "", true},
+		{"partial method", []byte("DEL"), "", true},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "", false},
+	} {
+		host, more := sniffHost(tc.data)
+		if host != tc.host || more != tc.more {
+			t.Errorf("%s: got %q, more %v; want %q, more %v", tc.name, host, more, tc.host, tc.more)
+		}
+	}
+}
+
+// chunkConn returns its data a few bytes per read
+type chunkConn struct {
+	Conn
+	data []byte
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 7)], c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestInspectedConn(t *testing.T) {
+	l, _, err := parseBlocklist(strings.NewReader("bad.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := &Blocklists{feeds: []*blocklistFeed{newBlocklistFeed("malware-test", "https://feeds.example/malware")}}
+	feeds.feeds[0].list.Store(l)
+	tunnel := &Tunnel{
+		log:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		policies: []*registeredPolicy{{name: "malware", plugin: malwarePolicy{feeds}, blocks: &Metric{}}},
+	}
+
+	blocked := &inspectedConn{Conn: &chunkConn{data: clientHello(t, "www.bad.example")}, t: tunnel}
+	if _, err := io.ReadAll(blocked); err == nil || !strings.Contains(err.Error(), "listed by malware-test") {
+		t.Errorf("blocked ClientHello read gave %v", err)
+	}
+	if tunnel.policies[0].blocks.Value() != 1 {
+		t.Errorf("%d blocks counted, want 1", tunnel.policies[0].blocks.Value())
+	}
+	if err := tunnel.blockedByPolicy("198.51.100.7"); err != nil {
+		t.Errorf("unlisted address blocked: %v", err)
+	}
+
+	// Everything the plugin looked at still reaches the destination
+	hello := clientHello(t, "good.example")
+	allowed := &inspectedConn{Conn: &chunkConn{data: append(hello, "after"...)}, t: tunnel}
+	got, err := io.ReadAll(allowed)
+	if err != nil || string(got) != string(hello)+"after" {
+		t.Errorf("allowed connection read %d bytes, %v", len(got), err)
+	}
+}
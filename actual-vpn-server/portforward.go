@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"horse-vpn-server/mux"
+)
+
+// Port forwarding (PORT_FORWARDS=true). Users with a dedicated IP reserve
+// inbound ports on their node through the sync server, and the node
+// listens on each. A connection it accepts goes to the reserving user's
+// multiplexed tunnel (see tunnelmux.go) as a stream the node opens, which
+// starts with the reserved port, 2 bytes big endian, so the client knows
+// which of its forwards it is for, and is relayed like any other stream
+// from then on. Connections for a user without a multiplexed tunnel open
+// are closed.
+//
+// The reservations come from the sync server every
+// PORT_FORWARD_POLL_INTERVAL seconds (default 30). A failed poll keeps the
+// ports open; an expired or deleted reservation closes its port, but not
+// the connections already made through it.
+type PortForwards struct {
+	mu        sync.Mutex
+	listeners map[int]*portListener
+
+	accepted *Metric
+	refused  *Metric
+}
+
+type portListener struct {
+	user string
+	ln   *net.TCPListener
+}
+
+// A reservation as the sync server sends it
+type portForwardJSON struct {
+	ID        string `json:"id"`
+	User      string `json:"user"`
+	Port      int    `json:"port"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// portForwards is nil unless PORT_FORWARDS is set
+var portForwards *PortForwards
+
+func newPortForwards() *PortForwards {
+	return &PortForwards{
+		listeners: make(map[int]*portListener),
+		accepted:  registry.Counter("port_forward_connections_total", "Inbound connections on reserved ports carried to their user's tunnel"),
+		refused:   registry.Counter("port_forward_refused_total", "Inbound connections on reserved ports whose user had no multiplexed tunnel open"),
+	}
+}
+
+func portForwardPollIntervalFromEnv() time.Duration {
+	if v := os.Getenv("PORT_FORWARD_POLL_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid PORT_FORWARD_POLL_INTERVAL value", "value", v)
+	}
+	return 30 * time.Second
+}
+
+func (p *PortForwards) fetch(syncServerURL, serverID string) ([]portForwardJSON, error) {
+	req, err := http.NewRequest(http.MethodGet, syncServerURL+"/servers/"+serverID+"/port-forwards", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := nodeCredential(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var forwards []portForwardJSON
+	if err := json.NewDecoder(resp.Body).Decode(&forwards); err != nil {
+		return nil, err
+	}
+	return forwards, nil
+}
+
+// Poll refreshes the reservations from the sync server forever
+func (p *PortForwards) Poll(syncServerURL, serverID string, interval time.Duration) {
+	for {
+		if err := p.Refresh(syncServerURL, serverID); err != nil {
+			slog.Warn("Failed to fetch port forwards", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Refresh fetches the reservations once, opening the ports that are new
+// and closing those that are gone. A port the node can't listen on is
+// tried again at the next refresh.
+func (p *PortForwards) Refresh(syncServerURL, serverID string) error {
+	forwards, err := p.fetch(syncServerURL, serverID)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[int]string)
+	for _, f := range forwards {
+		if f.Port > 0 && f.Port < 1<<16 && f.User != "" {
+			wanted[f.Port] = f.User
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for port, l := range p.listeners {
+		if wanted[port] != l.user {
+			l.ln.Close()
+			delete(p.listeners, port)
+			slog.Info("Closed forwarded port", "port", port, "user", l.user)
+		}
+	}
+	for port, user := range wanted {
+		if _, ok := p.listeners[port]; ok {
+			continue
+		}
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			slog.Warn("Can't listen on forwarded port", "port", port, "err", err)
+			continue
+		}
+		l := &portListener{user: user, ln: ln}
+		p.listeners[port] = l
+		slog.Info("Forwarding port", "port", port, "user", user)
+		go p.serve(port, l)
+	}
+	return nil
+}
+
+func (p *PortForwards) serve(port int, l *portListener) {
+	for {
+		conn, err := l.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go p.forward(port, l.user, conn)
+	}
+}
+
+// forward carries conn to user's multiplexed tunnel
+func (p *PortForwards) forward(port int, user string, conn *net.TCPConn) {
+	defer conn.Close()
+	session := userMuxSession(user)
+	if session == nil {
+		p.refused.Inc()
+		return
+	}
+	stream, err := session.Open()
+	if err != nil {
+		p.refused.Inc()
+		return
+	}
+	defer stream.Close()
+	var head [2]byte
+	binary.BigEndian.PutUint16(head[:], uint16(port))
+	if _, err := stream.Write(head[:]); err != nil {
+		return
+	}
+	p.accepted.Inc()
+	muxStreamsActive.Add(1)
+	defer muxStreamsActive.Add(-1)
+	done := make(chan error, 2)
+	go func() { done <- copyHalf(stream, conn, bytesToClients) }()
+	go func() { done <- copyHalf(conn, stream, bytesFromClients) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			return
+		}
+	}
+}
+
+// copyHalf copies src to dst and passes the end of src on as a half-close
+func copyHalf(dst interface {
+	io.Writer
+	CloseWrite() error
+}, src io.Reader, counter *Metric) error {
+	n, err := io.Copy(dst, src)
+	counter.Add(n)
+	if err != nil {
+		return err
+	}
+	return dst.CloseWrite()
+}
+
+// userMuxSession returns user's latest open multiplexed tunnel, or nil
+func userMuxSession(user string) *mux.Session {
+	userMuxesMu.Lock()
+	defer userMuxesMu.Unlock()
+	return userMuxes[user]
+}
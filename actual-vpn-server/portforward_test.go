@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"horse-vpn-server/mux"
+)
+
+// A connection to a reserved port must reach the reserving user's
+// multiplexed tunnel as a stream the node opens, tagged with the port, and
+// the port must close once the reservation is gone.
+
+func TestPortForwardToMuxTunnel(t *testing.T) {
+	free, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	reservations := []portForwardJSON{{ID: "f1", User: "alice", Port: port}}
+	sync := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(reservations)
+	}))
+	defer sync.Close()
+
+	nodeSide, clientSide := net.Pipe()
+	node := mux.Server(nodeSide, mux.Config{})
+	client := mux.Client(clientSide, mux.Config{})
+	defer node.Close()
+	defer client.Close()
+	trackUserMux("alice", node)
+
+	p := newPortForwards()
+	if err := p.Refresh(sync.URL, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+
+	stream, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if p := binary.BigEndian.Uint16(got); int(p) != port || string(got[2:]) != "ping" {
+		t.Fatalf("stream started with %q", got)
+	}
+	stream.Write([]byte("pong"))
+	stream.CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "pong" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+
+	reservations = nil
+	if err := p.Refresh(sync.URL, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+		c.Close()
+		t.Fatal("port still open after its reservation went away")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Differentially private usage telemetry, for operators who want to know
+// how the fleet is used without any node reporting what one user did. With
+// USAGE_TELEMETRY=private the node tallies, per user, the tunnels opened and
+// bytes carried in each USAGE_TELEMETRY_INTERVAL, and at the end of it sends
+// the sync server two histograms of those tallies and nothing else: how
+// many users fell in each bucket of telemetryByteBuckets and of
+// telemetryTunnelBuckets. The tallies are then dropped.
+//
+// Each user is in exactly one bucket of each histogram, so adding or
+// removing one user changes the two by at most 2 in total. Every bucket
+// gets two-sided geometric noise (the discrete Laplace mechanism) with
+// P(k) proportional to exp(-ε|k|/2), which makes each report
+// ε-differentially private for every user, whatever else is known about
+// the others. The noise is whole numbers drawn with crypto/rand, so the
+// report has no floating-point low bits that could give the true counts
+// away.
+// Counts can come out negative; they are sent that way so sums across
+// nodes and periods stay unbiased. Without authentication each tunnel
+// counts as a user of its own.
+type usageTelemetry struct {
+	epsilon float64
+	// Uniform on [0, 1); crypto/rand outside tests
+	uniform func() float64
+
+	mu          sync.Mutex
+	periodStart time.Time
+	users       map[string]*usageTally
+	anonymous   []usageTally
+}
+
+type usageTally struct {
+	tunnels, bytes int64
+}
+
+// Upper bounds of the histograms' buckets; each has one more bucket, for
+// everything above the last bound
+var (
+	telemetryByteBuckets   = []int64{1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30}
+	telemetryTunnelBuckets = []int64{1, 5, 20, 100}
+)
+
+// TelemetryReport is what a node sends at the end of each period. Bytes and
+// Tunnels hold a count per bucket, noise included.
+type TelemetryReport struct {
+	Instance    string  `json:"instance"`
+	PeriodStart int64   `json:"periodStart"`
+	PeriodEnd   int64   `json:"periodEnd"`
+	Epsilon     float64 `json:"epsilon"`
+	Bytes       []int64 `json:"bytes"`
+	Tunnels     []int64 `json:"tunnels"`
+}
+
+// Set when USAGE_TELEMETRY is private
+var privateTelemetry *usageTelemetry
+
+func newUsageTelemetry(epsilon float64) *usageTelemetry {
+	return &usageTelemetry{epsilon: epsilon, uniform: cryptoUniform, periodStart: time.Now(), users: make(map[string]*usageTally)}
+}
+
+// usageTelemetryFromEnv returns the telemetry to keep and how often to
+// report it, or nil when USAGE_TELEMETRY isn't private
+func usageTelemetryFromEnv() (*usageTelemetry, time.Duration, error) {
+	switch mode := os.Getenv("USAGE_TELEMETRY"); mode {
+	case "", "off":
+		return nil, 0, nil
+	case "private":
+	default:
+		return nil, 0, fmt.Errorf("USAGE_TELEMETRY must be private or off, not %q", mode)
+	}
+	epsilon := 1.0
+	if v := os.Getenv("USAGE_TELEMETRY_EPSILON"); v != "" {
+		e, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(e > 0) || math.IsInf(e, 0) {
+			return nil, 0, fmt.Errorf("invalid USAGE_TELEMETRY_EPSILON %q", v)
+		}
+		epsilon = e
+	}
+	interval := time.Hour
+	if v := os.Getenv("USAGE_TELEMETRY_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 60 {
+			interval = time.Duration(secs) * time.Second
+		} else {
+			slog.Warn("Ignoring invalid USAGE_TELEMETRY_INTERVAL value", "value", v)
+		}
+	}
+	return newUsageTelemetry(epsilon), interval, nil
+}
+
+// record counts a tunnel that carried n bytes for id's user
+func (u *usageTelemetry) record(id *Identity, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if id == nil {
+		u.anonymous = append(u.anonymous, usageTally{tunnels: 1, bytes: n})
+		return
+	}
+	tally := u.users[id.Subject]
+	if tally == nil {
+		tally = &usageTally{}
+		u.users[id.Subject] = tally
+	}
+	tally.tunnels++
+	tally.bytes += n
+}
+
+// report ends the period, returning its noisy histograms and starting the
+// next one from scratch
+func (u *usageTelemetry) report(now time.Time) TelemetryReport {
+	u.mu.Lock()
+	users, anonymous, start := u.users, u.anonymous, u.periodStart
+	u.users, u.anonymous, u.periodStart = make(map[string]*usageTally), nil, now
+	u.mu.Unlock()
+
+	bytes := make([]int64, len(telemetryByteBuckets)+1)
+	tunnels := make([]int64, len(telemetryTunnelBuckets)+1)
+	add := func(t usageTally) {
+		bytes[telemetryBucket(telemetryByteBuckets, t.bytes)]++
+		tunnels[telemetryBucket(telemetryTunnelBuckets, t.tunnels)]++
+	}
+	for _, t := range users {
+		add(*t)
+	}
+	for _, t := range anonymous {
+		add(t)
+	}
+
+	// Two histograms with one count each per user
+	alpha := math.Exp(-u.epsilon / 2)
+	for i := range bytes {
+		bytes[i] += geometricNoise(alpha, u.uniform)
+	}
+	for i := range tunnels {
+		tunnels[i] += geometricNoise(alpha, u.uniform)
+	}
+	return TelemetryReport{
+		PeriodStart: start.UnixMilli(),
+		PeriodEnd:   now.UnixMilli(),
+		Epsilon:     u.epsilon,
+		Bytes:       bytes,
+		Tunnels:     tunnels,
+	}
+}
+
+// telemetryBucket returns the index of the first bound v doesn't exceed,
+// or len(bounds) for none
+func telemetryBucket(bounds []int64, v int64) int {
+	for i, bound := range bounds {
+		if v <= bound {
+			return i
+		}
+	}
+	return len(bounds)
+}
+
+// geometricNoise draws from the two-sided geometric distribution, with
+// P(k) proportional to alpha^|k|, as the difference of two geometric draws
+func geometricNoise(alpha float64, uniform func() float64) int64 {
+	return geometric(alpha, uniform) - geometric(alpha, uniform)
+}
+
+// geometric draws k >= 0 with P(k) = (1-alpha) alpha^k, by inverting
+// P(K >= k) = alpha^k
+func geometric(alpha float64, uniform func() float64) int64 {
+	// In (0, 1], so the log is finite
+	u := 1 - uniform()
+	return int64(math.Floor(math.Log(u) / math.Log(alpha)))
+}
+
+func cryptoUniform() float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// reportUsageTelemetry sends the period's report every interval forever
+func reportUsageTelemetry(syncServerURL, serverID string, u *usageTelemetry, interval time.Duration) {
+	instance := loadReportInstance()
+	for {
+		time.Sleep(interval)
+		report := u.report(time.Now())
+		report.Instance = instance
+		if err := postAsNode(syncServerURL+"/servers/"+serverID+"/usage-telemetry", report); err != nil {
+			// Not retried; that period's tallies are gone for good
+			slog.Warn("Failed to send usage telemetry", "err", err)
+		}
+	}
+}
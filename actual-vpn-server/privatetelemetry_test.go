@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Usage telemetry reports only noisy histograms: every user lands in one
+// bucket of each, and the noise follows the two-sided geometric
+// distribution that ε calls for.
+
+func TestTelemetryBuckets(t *testing.T) {
+	// Large enough that the noise is always 0
+	u := newUsageTelemetry(1000)
+	alice, bob := &Identity{Subject: "alice"}, &Identity{Subject: "bob"}
+	for i := 0; i < 3; i++ {
+		u.record(alice, 1<<20)
+	}
+	u.record(bob, 0)
+	u.record(nil, 20<<30)
+	u.record(nil, 1)
+
+	r := u.report(time.Now())
+	// alice's 3 MiB in 3 tunnels, bob's nothing in 1, and two anonymous
+	// tunnels on their own
+	if want := []int64{2, 1, 0, 0, 0, 1}; !slices.Equal(r.Bytes, want) {
+		t.Errorf("bytes histogram %v, want %v", r.Bytes, want)
+	}
+	if want := []int64{3, 1, 0, 0, 0}; !slices.Equal(r.Tunnels, want) {
+		t.Errorf("tunnels histogram %v, want %v", r.Tunnels, want)
+	}
+
+	// The tallies go with the report
+	r = u.report(time.Now())
+	if !slices.Equal(r.Bytes, make([]int64, len(r.Bytes))) || !slices.Equal(r.Tunnels, make([]int64, len(r.Tunnels))) {
+		t.Errorf("second report has %v and %v, want all zeros", r.Bytes, r.Tunnels)
+	}
+}
+
+func TestTelemetryBucketBounds(t *testing.T) {
+	for _, c := range []struct {
+		v    int64
+		want int
+	}{{0, 0}, {1, 0}, {2, 1}, {5, 1}, {6, 2}, {100, 3}, {101, 4}} {
+		if got := telemetryBucket(telemetryTunnelBuckets, c.v); got != c.want {
+			t.Errorf("telemetryBucket(%d) = %d, want %d", c.v, got, c.want)
+		}
+	}
+}
+
+func TestGeometricNoiseDistribution(t *testing.T) {
+	const samples = 200000
+	for _, epsilon := range []float64{0.5, 1, 4} {
+		alpha := math.Exp(-epsilon / 2)
+		uniform := rand.New(rand.NewSource(1)).Float64
+		counts := make(map[int64]int)
+		var sum, sumSquares float64
+		for i := 0; i < samples; i++ {
+			k := geometricNoise(alpha, uniform)
+			counts[k]++
+			sum += float64(k)
+			sumSquares += float64(k * k)
+		}
+
+		// Mean 0 and variance 2α/(1-α)², to within a few standard errors
+		variance := 2 * alpha / ((1 - alpha) * (1 - alpha))
+		mean := sum / samples
+		if math.Abs(mean) > 5*math.Sqrt(variance/samples) {
+			t.Errorf("ε=%v: mean %v, want about 0", epsilon, mean)
+		}
+		if got := sumSquares/samples - mean*mean; math.Abs(got-variance) > 0.05*variance {
+			t.Errorf("ε=%v: variance %v, want about %v", epsilon, got, variance)
+		}
+
+		// P(k) = (1-α)/(1+α) α^|k|
+		for k := int64(-2); k <= 2; k++ {
+			want := (1 - alpha) / (1 + alpha) * math.Pow(alpha, math.Abs(float64(k)))
+			got := float64(counts[k]) / samples
+			if math.Abs(got-want) > 5*math.Sqrt(want*(1-want)/samples) {
+				t.Errorf("ε=%v: P(%d) = %v, want %v", epsilon, k, got, want)
+			}
+		}
+
+		// Neighbouring counts differ in likelihood by at most exp(ε/2)
+		// per histogram, so by at most exp(ε) for the two together
+		for k := int64(-2); k < 2; k++ {
+			if counts[k] < 1000 || counts[k+1] < 1000 {
+				continue
+			}
+			ratio := float64(counts[k]) / float64(counts[k+1])
+			if bound := math.Exp(epsilon/2) * 1.1; ratio > bound || 1/ratio > bound {
+				t.Errorf("ε=%v: P(%d)/P(%d) = %v, beyond exp(ε/2)", epsilon, k, k+1, ratio)
+			}
+		}
+	}
+}
+
+func TestTelemetryReportIsNoisy(t *testing.T) {
+	u := newUsageTelemetry(1)
+	u.uniform = rand.New(rand.NewSource(1)).Float64
+	// Nobody used the node, yet most reports say otherwise somewhere
+	noisy := 0
+	for i := 0; i < 100; i++ {
+		r := u.report(time.Now())
+		if !slices.Equal(r.Bytes, make([]int64, len(r.Bytes))) {
+			noisy++
+		}
+	}
+	if noisy < 90 {
+		t.Errorf("%d of 100 empty reports had noise, want nearly all", noisy)
+	}
+}
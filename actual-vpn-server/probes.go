@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Kubernetes probes. /readyz fails while the node shouldn't be sent new
+// clients, so a Service routes them to other replicas; /livez fails only when
+// the node won't get better by itself and should be restarted. /health keeps
+// answering 200 for the sync server either way.
+
+type probeCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	readinessChecks []probeCheck
+	livenessChecks  []probeCheck
+)
+
+func addReadinessCheck(name string, check func() error) {
+	readinessChecks = append(readinessChecks, probeCheck{name, check})
+}
+
+func addLivenessCheck(name string, check func() error) {
+	livenessChecks = append(livenessChecks, probeCheck{name, check})
+}
+
+// probeHandler runs the checks and answers 503 naming the ones that failed.
+// With ?verbose every check is listed.
+func probeHandler(checks *[]probeCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report strings.Builder
+		failed := false
+		for _, c := range *checks {
+			if err := c.check(); err != nil {
+				failed = true
+				fmt.Fprintf(&report, "[-] %s: %v\n", c.name, err)
+			} else if r.URL.Query().Has("verbose") {
+				fmt.Fprintf(&report, "[+] %s\n", c.name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(report.String()))
+		if !failed {
+			w.Write([]byte("OK"))
+		}
+	}
+}
+
+// registerProbes sets up the checks that apply to this node's configuration
+func registerProbes(certs *CertSource, watchdog *Watchdog) {
+	addReadinessCheck("capacity", func() error {
+		if shedder.Overloaded() {
+			return errors.New("refusing new tunnels")
+		}
+		return nil
+	})
+	// ACME certificates are fetched on demand, so only files can be checked
+	if certs != nil && certs.acme == nil {
+		addReadinessCheck("certificate", func() error {
+			_, err := certs.getCertificate(&tls.ClientHelloInfo{})
+			return err
+		})
+	}
+	if watchdog != nil {
+		addLivenessCheck("watchdog", watchdog.Healthy)
+	}
+
+	http.HandleFunc("/readyz", probeHandler(&readinessChecks))
+	http.HandleFunc("/livez", probeHandler(&livenessChecks))
+}
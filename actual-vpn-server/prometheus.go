@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Prometheus scrape endpoint. /metrics serves every metric in the registry
+// in the Prometheus text format, under the same names statsd_exporter gives
+// the StatsD sink's (horsevpn_tunnels_active), with server_id and location
+// labels, so the dashboards from "metrics bootstrap" work with either.
+// Histograms, which StatsD can't carry, are only here. With METRICS_TOKEN
+// set, a scrape must bear it; anyone else gets the decoy site, as for any
+// other path the node doesn't use.
+type PrometheusHandler struct {
+	registry *Registry
+	prefix   string
+	labels   string
+	token    string
+	decoy    http.Handler
+}
+
+func prometheusHandlerFromEnv(registry *Registry, serverID, location string, decoy http.Handler) *PrometheusHandler {
+	return &PrometheusHandler{
+		registry: registry,
+		prefix:   prometheusPrefix(),
+		labels:   fmt.Sprintf(`server_id="%s",location="%s"`, escapeLabel(serverID), escapeLabel(location)),
+		token:    os.Getenv("METRICS_TOKEN"),
+		decoy:    decoy,
+	}
+}
+
+func (p *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(p.token)) != 1 {
+		p.decoy.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.render())
+}
+
+// render writes the exposition. Metrics of one name, like a histogram
+// family's, are grouped under a single HELP and TYPE in the order their
+// names were first registered.
+func (p *PrometheusHandler) render() []byte {
+	var names []string
+	byName := make(map[string][]*Metric)
+	p.registry.Each(func(m *Metric) {
+		if _, ok := byName[m.Name]; !ok {
+			names = append(names, m.Name)
+		}
+		byName[m.Name] = append(byName[m.Name], m)
+	})
+
+	var b bytes.Buffer
+	for _, name := range names {
+		metrics := byName[name]
+		full := p.prefix + name
+		fmt.Fprintf(&b, "# HELP %s %s\n", full, metrics[0].Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", full, prometheusType(metrics[0].Kind))
+		for _, m := range metrics {
+			labels := p.labels
+			if m.Label != "" {
+				labels += fmt.Sprintf(`,%s="%s"`, m.Label, escapeLabel(m.LabelValue))
+			}
+			if m.Kind != kindHistogram {
+				fmt.Fprintf(&b, "%s{%s} %d\n", full, labels, m.Value())
+				continue
+			}
+			counts, sum := m.BucketCounts()
+			for i, le := range m.Buckets {
+				fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", full, labels, strconv.FormatFloat(le, 'g', -1, 64), counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", full, labels, m.Value())
+			fmt.Fprintf(&b, "%s_sum{%s} %s\n", full, labels, strconv.FormatFloat(sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", full, labels, m.Value())
+		}
+	}
+	return b.Bytes()
+}
+
+func prometheusType(kind metricKind) string {
+	switch kind {
+	case kindCounter:
+		return "counter"
+	case kindHistogram:
+		return "histogram"
+	}
+	return "gauge"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
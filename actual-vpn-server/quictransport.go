@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC transport: tunnels as QUIC streams on a UDP port of their own
+// (QUIC_PORT). A WebSocket carries every stream of a multiplexed tunnel in
+// one TCP connection, where a lost packet holds all of them up until it is
+// sent again; QUIC streams are delivered independently, so a loss only
+// stalls its own stream. Clients must negotiate the ALPN protocol quicProto.
+//
+// The client's first stream is the control stream. It carries the same
+// preamble as raw TLS, the bearer token as a 2-byte big-endian length and
+// the token, and the node answers with one of the raw TLS status bytes.
+// After rawTLSOK, every further stream the client opens is a tunnel
+// carrying the same tunnel protocol as /ws, and ending a stream's send side
+// is a half-close. The connection counts as one tunnel towards MAX_TUNNELS
+// and sessions, like a multiplexed WebSocket, and takes up to
+// MAX_MUX_STREAMS streams at once. The node closes the connection with
+// application error 1008 and the reason as its message when the credential
+// is revoked, mirroring the WebSocket close.
+const quicProto = "horsevpn-quic/1"
+
+const (
+	quicClosed          quic.ApplicationErrorCode = 0
+	quicPolicyViolation quic.ApplicationErrorCode = 1008
+)
+
+var (
+	quicConnections = registry.Counter("quic_connections_total", "QUIC connections admitted")
+	quicStreamsOpen = registry.Gauge("quic_streams_active", "Tunnels open as QUIC streams")
+)
+
+// quicEndpoint is the quic:// URL registered with the sync server:
+// QUIC_ADDRESS (host:port) if set, else the first ACME domain on QUIC_PORT.
+// Empty if neither says where clients can reach us.
+func quicEndpoint(port string, certs *CertSource) string {
+	if addr := os.Getenv("QUIC_ADDRESS"); addr != "" {
+		return "quic://" + addr
+	}
+	if len(certs.domains) > 0 {
+		return "quic://" + net.JoinHostPort(certs.domains[0], port)
+	}
+	return ""
+}
+
+func serveQUIC(addr string, config *tls.Config) error {
+	ln, err := quic.ListenAddr(addr, config, &quic.Config{
+		HandshakeIdleTimeout: rawTLSPreambleTimeout,
+		MaxIdleTimeout:       60 * time.Second,
+		KeepAlivePeriod:      15 * time.Second,
+		MaxIncomingStreams:   int64(muxMaxStreams) + 1,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go handleQUIC(conn)
+	}
+}
+
+func handleQUIC(conn quic.Connection) {
+	logger := connLogger("quic", conn.RemoteAddr().String())
+	ctx, cancel := context.WithTimeout(conn.Context(), rawTLSPreambleTimeout)
+	control, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		handshakeFailures.Inc()
+		conn.CloseWithError(quicClosed, "")
+		return
+	}
+	control.SetReadDeadline(time.Now().Add(rawTLSPreambleTimeout))
+	token, err := readRawTLSToken(control)
+	if err != nil {
+		logger.Warn("Connection sent no token", "err", err)
+		conn.CloseWithError(quicClosed, "")
+		return
+	}
+	control.SetReadDeadline(time.Time{})
+
+	admission, status := admitRaw(logger, token, conn.ConnectionState().TLS.ServerName, conn.RemoteAddr().String())
+	if status == rawTLSOK {
+		varyHandshake()
+	}
+	if _, err := control.Write([]byte{status}); err != nil || status != rawTLSOK {
+		if admission != nil {
+			admission.release()
+		}
+		// Give the status a moment to get there before the connection goes
+		time.AfterFunc(time.Second, func() { conn.CloseWithError(quicClosed, "") })
+		return
+	}
+	session := &quicControl{Stream: control, conn: conn}
+	admission.lease.Attach(session)
+
+	admission.log.Info("New tunnel")
+	connectionsTotal.Inc()
+	quicConnections.Inc()
+	tunnelsActive.Add(1)
+	defer tunnelsActive.Add(-1)
+	defer admission.release()
+
+	// The connection's own tunnel, which streams come and go in; it only
+	// watches the credential
+	t := &Tunnel{localConn: session, remoteConn: session, id: admission.id, egress: egressFor(admission.id, nil), log: admission.log}
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.watchCredential(stop)
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		s := &Tunnel{id: t.id, egress: t.egress, localConn: quicStream{stream}, remoteConn: quicStream{stream}, log: t.log.With("stream", int64(stream.StreamID()))}
+		quicStreamsOpen.Add(1)
+		go func() {
+			defer quicStreamsOpen.Add(-1)
+			defer s.localConn.Close()
+			stop := make(chan struct{})
+			defer close(stop)
+			s.relay(stop)
+		}()
+	}
+}
+
+// quicControl is the control stream of a QUIC connection; closing it
+// closes the connection and every stream in it
+type quicControl struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicControl) Close() error {
+	return c.conn.CloseWithError(quicClosed, "")
+}
+
+func (c *quicControl) CloseLimit(reason string) error {
+	return c.conn.CloseWithError(quicPolicyViolation, reason)
+}
+
+// quicStream is one tunnel in a QUIC connection. Closing its send side is
+// a half-close; closing it as a whole stops reading too.
+type quicStream struct {
+	quic.Stream
+}
+
+func (s quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s quicStream) Close() error {
+	s.Stream.CancelRead(quic.StreamErrorCode(quicClosed))
+	return s.Stream.Close()
+}
+
+// CloseLimit resets the stream both ways; a stream has no room for a reason
+func (s quicStream) CloseLimit(string) error {
+	s.Stream.CancelRead(quic.StreamErrorCode(quicPolicyViolation))
+	s.Stream.CancelWrite(quic.StreamErrorCode(quicPolicyViolation))
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bandwidth limits and monthly quotas. TUNNEL_RATE_LIMIT_KB caps each
+// tunnel at that many kilobytes a second in each direction, and
+// USER_RATE_LIMIT_KB caps all of one user's tunnels together, so opening
+// more tunnels doesn't get around it. Both are token buckets holding a
+// second's worth: a write that takes more than the bucket has waits until
+// it has refilled, and TCP's flow control passes the wait back to the
+// sender. USER_MONTHLY_QUOTA_MB caps what each user moves in a calendar
+// month (UTC), both directions together, counted in USAGE_FILE so a restart
+// doesn't reset it. A user over the quota gets 429 with notice key
+// quota_exceeded for new tunnels, and open tunnels close with that reason.
+// Per-user limits need authentication to know who a tunnel belongs to.
+// UDP relays and IP tunnels count towards the quota but aren't slowed.
+type RateLimits struct {
+	// Bytes a second; 0 is no limit
+	Tunnel int64
+	User   int64
+	// Bytes a month; 0 is no quota
+	MonthlyQuota int64
+}
+
+var (
+	rateLimits RateLimits
+	userUsage  *UsageStore
+
+	rateLimitWaits  = registry.Counter("rate_limit_waits_total", "Writes delayed by a tunnel or user rate limit")
+	quotaRefusals   = registry.Counter("quota_refusals_total", "Tunnels refused or closed because their user is over the monthly quota")
+	errNoHalfClose  = errors.New("connection can't half-close")
+	errQuotaReached = errors.New("monthly quota exceeded")
+)
+
+const usageSaveInterval = 30 * time.Second
+
+func rateLimitsFromEnv() RateLimits {
+	var limits RateLimits
+	for _, s := range []struct {
+		name  string
+		unit  int64
+		limit *int64
+	}{
+		{"TUNNEL_RATE_LIMIT_KB", 1 << 10, &limits.Tunnel},
+		{"USER_RATE_LIMIT_KB", 1 << 10, &limits.User},
+		{"USER_MONTHLY_QUOTA_MB", 1 << 20, &limits.MonthlyQuota},
+	} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err == nil && n >= 0 {
+				*s.limit = n * s.unit
+			} else {
+				slog.Warn("Ignoring invalid "+s.name+" value", "value", v)
+			}
+		}
+	}
+	return limits
+}
+
+// tokenBucket lets rate bytes a second through, in bursts of up to a
+// second's worth. A write larger than what is left runs the bucket into
+// debt and waits it off, so writers sharing a bucket queue behind it.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes' worth of tokens, sleeping until they are paid for,
+// and reports whether it had to
+func (b *tokenBucket) wait(n int) bool {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mu.Unlock()
+	if debt < 0 {
+		rateLimitWaits.Inc()
+		time.Sleep(time.Duration(-debt / b.rate * float64(time.Second)))
+		return true
+	}
+	return false
+}
+
+// The buckets of users with tunnels open, shared by their tunnels
+var (
+	userBucketsMu sync.Mutex
+	userBuckets   = make(map[string]*userBucket)
+)
+
+type userBucket struct {
+	up, down *tokenBucket
+	tunnels  int
+}
+
+func acquireUserBucket(subject string) *userBucket {
+	userBucketsMu.Lock()
+	defer userBucketsMu.Unlock()
+	b := userBuckets[subject]
+	if b == nil {
+		b = &userBucket{up: newTokenBucket(rateLimits.User), down: newTokenBucket(rateLimits.User)}
+		userBuckets[subject] = b
+	}
+	b.tunnels++
+	return b
+}
+
+func releaseUserBucket(subject string) {
+	userBucketsMu.Lock()
+	defer userBucketsMu.Unlock()
+	if b := userBuckets[subject]; b != nil {
+		if b.tunnels--; b.tunnels == 0 {
+			delete(userBuckets, subject)
+		}
+	}
+}
+
+// limitedConn holds writes to a Conn to its buckets, and counts them
+// against its user's quota
+type limitedConn struct {
+	Conn
+	buckets []*tokenBucket
+	// The user whose quota the bytes count against; empty for none
+	subject string
+	// Called once the quota runs out
+	exceeded func()
+	// The tunnel's statistics, if the client asked for them
+	stats *tunnelStats
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	for _, bucket := range c.buckets {
+		if bucket.wait(len(b)) && c.stats != nil {
+			c.stats.throttled.Store(true)
+		}
+	}
+	if c.subject != "" && !userUsage.Add(c.subject, int64(len(b))) {
+		c.exceeded()
+		return 0, errQuotaReached
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// limitConns returns what the tunnel's relay should write to in each
+// direction, and a function to call once it has finished
+func (t *Tunnel) limitConns() (up, down Conn, done func()) {
+	up, down, done = t.remoteConn, t.localConn, func() {}
+	var subject string
+	if t.id != nil && userUsage != nil {
+		subject = t.id.Subject
+	}
+	var upBuckets, downBuckets []*tokenBucket
+	if rateLimits.Tunnel > 0 {
+		upBuckets = append(upBuckets, newTokenBucket(rateLimits.Tunnel))
+		downBuckets = append(downBuckets, newTokenBucket(rateLimits.Tunnel))
+	}
+	if rateLimits.User > 0 && t.id != nil {
+		b := acquireUserBucket(t.id.Subject)
+		upBuckets = append(upBuckets, b.up)
+		downBuckets = append(downBuckets, b.down)
+		done = func() { releaseUserBucket(t.id.Subject) }
+	}
+	if len(upBuckets) == 0 && subject == "" {
+		return up, down, done
+	}
+	var once sync.Once
+	exceeded := func() {
+		once.Do(func() {
+			quotaRefusals.Inc()
+			t.closeLimited("quota exceeded")
+		})
+	}
+	up = &limitedConn{Conn: up, buckets: upBuckets, subject: subject, exceeded: exceeded, stats: t.stats}
+	down = &limitedConn{Conn: down, buckets: downBuckets, subject: subject, exceeded: exceeded, stats: t.stats}
+	return up, down, done
+}
+
+// countUsage counts n bytes a UDP relay or IP tunnel carried for id, and
+// closes ws with the quota's reason once they don't fit in it
+func countUsage(id *Identity, n int, ws *websocket.Conn) bool {
+	if userUsage == nil || id == nil || userUsage.Add(id.Subject, int64(n)) {
+		return true
+	}
+	quotaRefusals.Inc()
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "quota exceeded")
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	ws.Close()
+	return false
+}
+
+// UsageStore counts each user's bytes this month, kept in a file
+type UsageStore struct {
+	path  string
+	quota int64
+
+	mu    sync.Mutex
+	month string
+	users map[string]int64
+	dirty bool
+}
+
+type usageFile struct {
+	Month string           `json:"month"`
+	Users map[string]int64 `json:"users"`
+}
+
+func usageStoreFromEnv(quota int64) (*UsageStore, error) {
+	if quota == 0 {
+		return nil, nil
+	}
+	path := os.Getenv("USAGE_FILE")
+	if path == "" {
+		path = "./usage.json"
+	}
+	s := &UsageStore{path: path, quota: quota, month: usageMonth(time.Now()), users: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Month == s.month && f.Users != nil {
+		s.users = f.Users
+	}
+	return s, nil
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// rollOver starts a new month's count once the month has changed. Callers
+// hold s.mu.
+func (s *UsageStore) rollOver() {
+	if month := usageMonth(time.Now()); month != s.month {
+		s.month = month
+		s.users = make(map[string]int64)
+		s.dirty = true
+	}
+}
+
+// Add counts n bytes for subject and reports whether they fit in the quota
+func (s *UsageStore) Add(subject string, n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollOver()
+	used := s.users[subject] + n
+	s.users[subject] = used
+	s.dirty = true
+	return used <= s.quota
+}
+
+// Used returns what id's user has moved this month, and false when there is
+// no quota to count against
+func (s *UsageStore) Used(id *Identity) (int64, bool) {
+	if s == nil || id == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollOver()
+	return s.users[id.Subject], true
+}
+
+// Exceeded reports whether id's user has used up the month's quota
+func (s *UsageStore) Exceeded(id *Identity) bool {
+	if s == nil || id == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollOver()
+	return s.users[id.Subject] >= s.quota
+}
+
+// Save writes the counts to the file if they changed since the last save
+func (s *UsageStore) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(usageFile{Month: s.month, Users: s.users})
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		// Written aside and renamed, so a crash mid-write leaves the old counts
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Persist saves the counts every usageSaveInterval, forever
+func (s *UsageStore) Persist() {
+	for range time.Tick(usageSaveInterval) {
+		if err := s.Save(); err != nil {
+			slog.Warn("Failed to save usage", "path", s.path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Raw TLS transport: tunnels straight over TLS with no HTTP or WebSocket
+// framing, on its own port (RAW_TLS_PORT). Clients must negotiate the ALPN
+// protocol rawTLSProto; any other handshake, such as a browser or a scanner
+// speaking HTTPS, is closed without a word.
+//
+// After the handshake the client sends its bearer token as a 2-byte
+// big-endian length followed by the token (length 0 when it has none), and
+// the server answers with one status byte. On rawTLSOK the connection
+// carries the same tunnel protocol as /ws; on anything else it is closed.
+const rawTLSProto = "horsevpn/1"
+
+const (
+	rawTLSOK              byte = 0
+	rawTLSUnauthorized    byte = 1
+	rawTLSOverloaded      byte = 2
+	rawTLSTooManySessions byte = 3
+)
+
+// Clients must finish the handshake and send their token within this long
+const rawTLSPreambleTimeout = 10 * time.Second
+
+const rawTLSMaxToken = 8 << 10
+
+// rawTLSEndpoint is the tls:// URL registered with the sync server:
+// RAW_TLS_ADDRESS (host:port) if set, else the first ACME domain on
+// RAW_TLS_PORT. Empty if neither says where clients can reach us.
+func rawTLSEndpoint(port string, certs *CertSource) string {
+	if addr := os.Getenv("RAW_TLS_ADDRESS"); addr != "" {
+		return "tls://" + addr
+	}
+	if len(certs.domains) > 0 {
+		return "tls://" + net.JoinHostPort(certs.domains[0], port)
+	}
+	return ""
+}
+
+func serveRawTLS(addr string, config *tls.Config) error {
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Warn("Raw TLS accept failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleRawTLS(conn.(*tls.Conn))
+	}
+}
+
+func handleRawTLS(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(rawTLSPreambleTimeout))
+	if err := conn.Handshake(); err != nil {
+		handshakeFailures.Inc()
+		conn.Close()
+		return
+	}
+	if conn.ConnectionState().NegotiatedProtocol != rawTLSProto {
+		conn.Close()
+		return
+	}
+
+	logger := connLogger("rawtls", conn.RemoteAddr().String())
+	token, err := readRawTLSToken(conn)
+	if err != nil {
+		logger.Warn("Connection sent no token", "err", err)
+		conn.Close()
+		return
+	}
+
+	// The server name stands in for the Host header when picking the tenant
+	admission, status := admitRaw(logger, token, conn.ConnectionState().ServerName, conn.RemoteAddr().String())
+	if status != rawTLSOK {
+		conn.Write([]byte{status})
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	// The status byte can't be padded, but its timing can vary
+	varyHandshake()
+	if _, err := conn.Write([]byte{rawTLSOK}); err != nil {
+		conn.Close()
+		admission.release()
+		return
+	}
+	admission.lease.Attach(conn)
+
+	admission.log.Info("New tunnel")
+	connectionsTotal.Inc()
+
+	// Relays to the destination the client names, like the WebSocket tunnel
+	tunnel := &Tunnel{localConn: conn, remoteConn: conn, id: admission.id, egress: egressFor(admission.id, nil), log: admission.log}
+
+	tunnelsActive.Add(1)
+	go func() {
+		defer admission.release()
+		defer tunnelsActive.Add(-1)
+		tunnel.handleConnection()
+	}()
+}
+
+// rawAdmission is the place a tunnel without HTTP holds on the node while
+// it is open: its user's session, and its share of the node and tenant
+type rawAdmission struct {
+	id     *Identity
+	tenant *Tenant
+	lease  *SessionLease
+	log    *slog.Logger
+}
+
+// admitRaw runs the checks /ws makes on a request on a tunnel that only has
+// a token from its preamble and the TLS server name to go by. It returns
+// the status byte to answer with, and for rawTLSOK the admission to release
+// once the tunnel ends.
+func admitRaw(logger *slog.Logger, token, serverName, remoteAddr string) (*rawAdmission, byte) {
+	tenant := tenantFor(serverName)
+	var id *Identity
+	if chain := tenant.authChain(); chain.Enabled() {
+		var err error
+		id, err = tenant.authenticate(chain, token)
+		if err != nil {
+			logger.Warn("Rejected unauthenticated connection", "err", err)
+			authFailures.Inc()
+			return nil, rawTLSUnauthorized
+		}
+	}
+
+	logger = withUser(logger, id)
+	if userUsage.Exceeded(id) {
+		logger.Warn("Refusing tunnel", "err", errQuotaReached)
+		quotaRefusals.Inc()
+		return nil, rawTLSTooManySessions
+	}
+
+	if !shedder.Acquire() {
+		logger.Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		return nil, rawTLSOverloaded
+	}
+	if !tenant.Acquire() {
+		logger.Warn("Refusing tunnel", "err", errTenantQuota)
+		shedder.Release()
+		return nil, rawTLSTooManySessions
+	}
+
+	// There are no headers on this transport; sessions go by address
+	lease, err := sessionTracker.Open(id, &http.Request{RemoteAddr: remoteAddr})
+	if err != nil {
+		logger.Warn("Refusing tunnel: session limit reached")
+		shedder.Release()
+		tenant.Release()
+		return nil, rawTLSTooManySessions
+	}
+	return &rawAdmission{id: id, tenant: tenant, lease: lease, log: logger}, rawTLSOK
+}
+
+func (a *rawAdmission) release() {
+	shedder.Release()
+	a.tenant.Release()
+	a.lease.Close()
+}
+
+func readRawTLSToken(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if length > rawTLSMaxToken {
+		return "", fmt.Errorf("token of %d bytes is too long", length)
+	}
+	token := make([]byte, length)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Staying in the sync server's catalog. After registering, the node sends a
+// heartbeat every HEARTBEAT_INTERVAL seconds, so the sync server knows it
+// is alive between health probes and drops it soon after it stops. If the
+// sync server has dropped it anyway, say after a failed probe, the node
+// registers again. Heartbeats that go unanswered are logged once when they
+// start and once when they stop, and counted. A node behind cloudflared
+// also checks its public URL at each heartbeat, and registers the new one
+// when the tunnel gets a new hostname. On shutdown it unregisters; see
+// shutdown.go.
+var errNotRegistered = errors.New("not registered with the sync server")
+
+var (
+	heartbeatsTotal     = registry.Counter("heartbeats_total", "Heartbeats sent to the sync server")
+	heartbeatsFailed    = registry.Counter("heartbeat_failures_total", "Heartbeats the sync server didn't answer or refused")
+	syncServerReachable = registry.Gauge("sync_server_reachable", "1 while the sync server answers heartbeats, 0 while it doesn't")
+)
+
+var (
+	// registrationToken is what the sync server gave a node without a
+	// node token to authenticate heartbeats and unregistering with
+	registrationToken   string
+	registrationTokenMu sync.Mutex
+)
+
+func heartbeatIntervalFromEnv() time.Duration {
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid HEARTBEAT_INTERVAL value", "value", v)
+	}
+	return 60 * time.Second
+}
+
+// registerUntilDone registers with the sync server, retrying until it works
+func registerUntilDone(serverID, location, url string, tags, endpoints []string, syncServerURL string) {
+	nodeRegistration.setPhase(phaseRegistering)
+	for {
+		registrationsTotal.Inc()
+		err := registerWithSyncServer(serverID, location, url, tags, endpoints, syncServerURL)
+		if err == nil {
+			return
+		}
+		registrationsFailed.Inc()
+		nodeRegistration.failed(err)
+		slog.Warn("Failed to register with sync server, retrying", "err", err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// keepRegistered sends heartbeats forever, registering again whenever the
+// sync server no longer knows the node or discoverURL, if set, finds that
+// its URL has changed
+func keepRegistered(serverID, location, url string, tags, endpoints []string, syncServerURL string, interval time.Duration, discoverURL func() (string, error)) {
+	if interval == 0 {
+		select {}
+	}
+	syncServerReachable.Set(1)
+	failures := 0
+	for {
+		time.Sleep(interval)
+		// The node has unregistered and is about to exit
+		if shuttingDown.Load() {
+			continue
+		}
+		reregister := false
+		wantURL := url
+		if discoverURL != nil {
+			if current, err := discoverURL(); err != nil {
+				slog.Warn("Failed to check the cloudflared URL", "err", err)
+			} else if current != url {
+				slog.Info("Public URL changed, updating the registration", "from", url, "to", current)
+				wantURL, reregister = current, true
+			}
+		}
+
+		if !reregister {
+			heartbeatsTotal.Inc()
+			err := sendNodeRequest(syncServerURL+"/servers/"+serverID+"/heartbeat", nil)
+			nodeRegistration.heartbeat(err)
+			switch {
+			case errors.Is(err, errNotRegistered):
+				slog.Warn("Sync server no longer lists this node, registering again")
+				reregister = true
+			case err != nil:
+				heartbeatsFailed.Inc()
+				if failures == 0 {
+					slog.Warn("Sync server unreachable", "err", err)
+					syncServerReachable.Set(0)
+				}
+				failures++
+				continue
+			}
+			if failures > 0 {
+				slog.Info("Sync server reachable again", "failed_heartbeats", failures)
+				syncServerReachable.Set(1)
+				failures = 0
+			}
+		}
+
+		if reregister {
+			registrationsTotal.Inc()
+			if err := registerWithSyncServer(serverID, location, wantURL, tags, endpoints, syncServerURL); err != nil {
+				registrationsFailed.Inc()
+				nodeRegistration.failed(err)
+				slog.Warn("Failed to register with sync server, retrying at the next heartbeat", "err", err)
+			} else {
+				url = wantURL
+			}
+		}
+	}
+}
+
+// unregister takes the node out of the sync server's catalog
+func unregister(syncServerURL, serverID string) {
+	slog.Info("Unregistering from the sync server")
+	nodeRegistration.setPhase(phaseUnregistered)
+	if err := sendNodeRequest(syncServerURL+"/unregister", map[string]string{"id": serverID}); err != nil {
+		slog.Warn("Failed to unregister", "err", err)
+	}
+}
+
+// nodeCredential is what the node proves itself to the sync server with:
+// its node token, or else the token its registration got, if either
+func nodeCredential() string {
+	if nodeToken != "" {
+		return nodeToken
+	}
+	registrationTokenMu.Lock()
+	defer registrationTokenMu.Unlock()
+	return registrationToken
+}
+
+// sendNodeRequest POSTs body to the sync server with the node's credential
+func sendNodeRequest(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := nodeCredential(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		return errNotRegistered
+	case http.StatusNotFound:
+		// A sync server too old to know the endpoint answers in HTML
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return errNotRegistered
+		}
+	}
+	return fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// Registration phases, as the admin API reports them
+const (
+	phaseStarting              = "starting"
+	phaseWaitingForCloudflared = "waiting_for_cloudflared"
+	phaseWaitingForLeader      = "waiting_for_leader"
+	phaseRegistering           = "registering"
+	phaseRegistered            = "registered"
+	phaseUnregistered          = "unregistered"
+)
+
+// registrationState is where the node stands with the sync server
+type registrationState struct {
+	mu            sync.Mutex
+	phase         string
+	url           string
+	cloudflared   bool
+	registeredAt  time.Time
+	lastHeartbeat time.Time
+	lastError     string
+}
+
+var nodeRegistration = &registrationState{phase: phaseStarting}
+
+type registrationView struct {
+	Phase string `json:"phase"`
+	// The URL registered, or about to be
+	URL           string     `json:"url,omitempty"`
+	Cloudflared   bool       `json:"cloudflared"`
+	Reachable     bool       `json:"syncServerReachable"`
+	RegisteredAt  *time.Time `json:"registeredAt,omitempty"`
+	LastHeartbeat *time.Time `json:"lastHeartbeat,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+func (s *registrationState) setPhase(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phase
+}
+
+// setURL records the URL to register, and whether cloudflared gave it
+func (s *registrationState) setURL(url string, cloudflared bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.url, s.cloudflared = url, cloudflared
+}
+
+func (s *registrationState) registered(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase, s.url, s.registeredAt, s.lastError = phaseRegistered, url, time.Now(), ""
+}
+
+func (s *registrationState) heartbeat(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+	s.lastHeartbeat, s.lastError = time.Now(), ""
+}
+
+func (s *registrationState) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+}
+
+func (s *registrationState) view() registrationView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := registrationView{
+		Phase:       s.phase,
+		URL:         s.url,
+		Cloudflared: s.cloudflared,
+		Reachable:   syncServerReachable.Value() == 1,
+		LastError:   s.lastError,
+	}
+	if !s.registeredAt.IsZero() {
+		v.RegisteredAt = &s.registeredAt
+	}
+	if !s.lastHeartbeat.IsZero() {
+		v.LastHeartbeat = &s.lastHeartbeat
+	}
+	return v
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Relaying to destinations. Every tunnel opens with a SOCKS5 (RFC 1928)
+// CONNECT without authentication, which the desktop client forwards from the
+// application's own handshake with its local proxy:
+//
+//	client: VER=5 NMETHODS METHODS...   node: VER=5 METHOD=0
+//	client: VER=5 CMD=1 RSV ATYP DST.ADDR DST.PORT
+//	node:   VER=5 REP RSV ATYP BND.ADDR BND.PORT
+//
+// The node resolves names itself, checks the destination against
+// destinationAllowed, dials it and relays the rest of the tunnel to it.
+// Failures are answered with the matching SOCKS reply code before the
+// tunnel closes. A client that knows the destination up front can name it
+// in an X-Destination: host:port header on the tunnel request instead; the
+// node dials it before accepting the tunnel, answers failures with an HTTP
+// status, and the tunnel carries the connection from its first byte with no
+// SOCKS exchange. RELAY_MODE=echo keeps the old behaviour of echoing
+// everything back, for tests and benchmarks.
+const (
+	relaySOCKS = "socks"
+	relayEcho  = "echo"
+
+	relayDialTimeout = 10 * time.Second
+)
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksNetUnreachable     = 3
+	socksHostUnreachable    = 4
+	socksConnRefused        = 5
+	socksCmdNotSupported    = 7
+	socksAtypNotSupported   = 8
+	socksNoAcceptableMethod = 0xff
+)
+
+var relayMode = relaySOCKS
+
+var (
+	relayDials       = registry.Counter("relay_dials_total", "Destinations dialed for tunnels")
+	relayDialsFailed = registry.Counter("relay_dial_failures_total", "Tunnel destinations that were refused or could not be reached")
+)
+
+var (
+	errRelayRefused = errors.New("destination refused")
+	errSocksAddress = errors.New("unsupported SOCKS address")
+)
+
+func relayModeFromEnv() string {
+	if v := os.Getenv("RELAY_MODE"); v != "" {
+		if v == relaySOCKS || v == relayEcho {
+			return v
+		}
+		slog.Warn("Ignoring invalid RELAY_MODE value", "value", v)
+	}
+	return relaySOCKS
+}
+
+// connectDestination reads the tunnel's CONNECT request, dials the
+// destination and answers the client
+func (t *Tunnel) connectDestination() (net.Conn, error) {
+	c := t.localConn
+
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 5 {
+		return nil, fmt.Errorf("not SOCKS5 (version %d)", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(methods, []byte{0}) {
+		c.Write([]byte{5, socksNoAcceptableMethod})
+		return nil, errors.New("client offers no acceptable SOCKS method")
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return nil, err
+	}
+
+	// VER CMD RSV ATYP
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return nil, err
+	}
+	if req[0] != 5 {
+		return nil, fmt.Errorf("not SOCKS5 (version %d)", req[0])
+	}
+	host, port, err := readSocksAddr(c, req[3])
+	if err != nil {
+		if errors.Is(err, errSocksAddress) {
+			t.socksReply(socksAtypNotSupported, nil)
+		}
+		return nil, err
+	}
+	if req[1] != 1 {
+		// UDP goes through /udp
+		t.socksReply(socksCmdNotSupported, nil)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+
+	relayDials.Inc()
+	conn, code, err := t.dialDestination(host, port)
+	if err != nil {
+		relayDialsFailed.Inc()
+		t.log.Debug("Destination unreachable", "dst", net.JoinHostPort(host, strconv.Itoa(port)), "err", err)
+		t.socksReply(code, nil)
+		return nil, err
+	}
+	t.log.Debug("Connected to destination", "dst", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err := t.socksReply(socksSucceeded, conn.LocalAddr()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialNamedDestination dials the destination named by the request's
+// X-Destination header, if there is one, as the tunnel's remote end. It
+// answers the request and returns false if that fails.
+func (t *Tunnel) dialNamedDestination(w http.ResponseWriter, r *http.Request) bool {
+	dest := r.Header.Get("X-Destination")
+	if dest == "" || relayMode != relaySOCKS {
+		return true
+	}
+	host, portStr, err := net.SplitHostPort(dest)
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || portErr != nil || host == "" || len(host) > 255 || port < 1 || port > 65535 {
+		http.Error(w, "Invalid X-Destination", http.StatusBadRequest)
+		return false
+	}
+
+	relayDials.Inc()
+	conn, code, err := t.dialDestination(host, port)
+	if err != nil {
+		relayDialsFailed.Inc()
+		t.log.Warn("Refusing tunnel", "dst", dest, "err", err)
+		status := http.StatusBadGateway
+		if code == socksNotAllowed {
+			status = http.StatusForbidden
+		}
+		http.Error(w, http.StatusText(status), status)
+		return false
+	}
+	t.remoteConn = conn
+	return true
+}
+
+// readSocksAddr reads DST.ADDR and DST.PORT of address type atyp
+func readSocksAddr(r io.Reader, atyp byte) (string, int, error) {
+	var host string
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		if len(name) == 0 {
+			return "", 0, errSocksAddress
+		}
+		host = string(name)
+	default:
+		return "", 0, errSocksAddress
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// dialDestination connects to the first of host's addresses the tunnel may
+// reach, returning the SOCKS reply code for a failure
+func (t *Tunnel) dialDestination(host string, port int) (net.Conn, byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), relayDialTimeout)
+	defer cancel()
+
+	if feed := blocklists.hostBlockedBy(host); feed != "" {
+		return nil, socksNotAllowed, fmt.Errorf("%w by %s", errBlocklisted, feed)
+	}
+	if err := t.blockedByPolicy(host); err != nil {
+		return nil, socksNotAllowed, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil && !exitIPv6 {
+			return nil, socksNetUnreachable, errNoExitIPv6
+		}
+		ips = []net.IP{ip}
+	} else {
+		network := "ip"
+		if !exitIPv6 {
+			network = "ip4"
+		}
+		var err error
+		if ips, err = net.DefaultResolver.LookupIP(ctx, network, host); err != nil {
+			return nil, socksHostUnreachable, err
+		}
+	}
+
+	code, err := byte(socksNotAllowed), error(errRelayRefused)
+	for _, ip := range ips {
+		if !destinationAllowed(t.id, ip, port) {
+			continue
+		}
+		dialer := t.egress.dialer(ip)
+		start := time.Now()
+		conn, dialErr := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if dialErr == nil {
+			upstreamConnect.With(egressLabel(dialer)).Observe(time.Since(start))
+			return conn, socksSucceeded, nil
+		}
+		code, err = dialErrorCode(dialErr), dialErr
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, code, err
+}
+
+func dialErrorCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, context.DeadlineExceeded):
+		return socksHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksReply answers the CONNECT request; bound is the node's end of the
+// connection to the destination, if there is one
+func (t *Tunnel) socksReply(code byte, bound net.Addr) error {
+	reply := []byte{5, code, 0}
+	ip, port := net.IPv4zero, 0
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, atypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, atypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := t.localConn.Write(reply)
+	return err
+}
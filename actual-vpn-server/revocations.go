@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeviceRevocations mirrors the sync server's list of revoked devices so
+// session tokens minted for a lost device stop working on this node within
+// one poll interval, rather than when they expire. It also holds the users an
+// org's identity provider has suspended or deprovisioned, whatever
+// credential they present.
+type DeviceRevocations struct {
+	mu  sync.RWMutex
+	ids map[string]struct{}
+	// SHA-256 hashes of user names, as the sync server sends them
+	users map[string]struct{}
+}
+
+var revokedDevices = &DeviceRevocations{}
+
+func (d *DeviceRevocations) Revoked(deviceID string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.ids[deviceID]
+	return ok
+}
+
+func (d *DeviceRevocations) UserRevoked(subject string) bool {
+	sum := sha256.Sum256([]byte(subject))
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.users[hex.EncodeToString(sum[:])]
+	return ok
+}
+
+func revocationPollIntervalFromEnv() time.Duration {
+	if v := os.Getenv("REVOCATION_POLL_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid REVOCATION_POLL_INTERVAL value", "value", v)
+	}
+	return 30 * time.Second
+}
+
+// Poll refreshes the list from the sync server forever. A failed poll keeps
+// the previous list.
+func (d *DeviceRevocations) Poll(syncServerURL string, interval time.Duration) {
+	for {
+		var list struct {
+			DeviceIDs []string `json:"deviceIds"`
+			Users     []string `json:"users"`
+		}
+		if err := getJSON(syncServerURL+"/revoked-devices", &list); err != nil {
+			slog.Warn("Failed to fetch revoked devices", "err", err)
+		} else {
+			ids := make(map[string]struct{}, len(list.DeviceIDs))
+			for _, id := range list.DeviceIDs {
+				ids[id] = struct{}{}
+			}
+			users := make(map[string]struct{}, len(list.Users))
+			for _, user := range list.Users {
+				users[user] = struct{}{}
+			}
+			d.mu.Lock()
+			d.ids = ids
+			d.users = users
+			d.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
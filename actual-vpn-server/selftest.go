@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connection churn load test. "horse-vpn-server selftest" keeps -conns
+// tunnels open against a node, closing each after -hold and opening
+// another in its place, for -duration, then reports how long the node took
+// to accept tunnels and how many it failed. It is for sizing hardware
+// before going live, so point it at a node of your own: the default is one
+// on this host. Accept latency runs from dialing to the end of the
+// WebSocket handshake, which covers authentication and admission but not
+// the relay. A tunnel the node closes before its hold is up counts as
+// dropped, and as a failure.
+type selftestResult struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	failures  map[string]int
+
+	opened, failed, dropped atomic.Int64
+	open, peak              atomic.Int64
+}
+
+func runSelftestCommand(args []string) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	url := fs.String("url", "ws://127.0.0.1:"+port+"/ws", "Tunnel endpoint of the node to test")
+	conns := fs.Int("conns", 1000, "Tunnels to keep open at once")
+	duration := fs.Duration("duration", 30*time.Second, "How long to keep cycling tunnels")
+	hold := fs.Duration("hold", time.Second, "How long each tunnel stays open before it is replaced")
+	rate := fs.Int("rate", 1000, "Most tunnels to open per second, 0 for no limit")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for the node to accept a tunnel")
+	token := fs.String("token", os.Getenv("SELFTEST_TOKEN"), "Bearer token to authenticate with, if the node requires one")
+	insecure := fs.Bool("insecure", false, "Skip TLS certificate verification for wss:// URLs")
+	maxFailures := fs.Float64("max-failure-rate", 0.01, "Exit with status 1 if more than this fraction of tunnels fail")
+	fs.Parse(args)
+	if *conns < 1 || *hold <= 0 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "selftest: -conns, -hold and -duration must be positive")
+		os.Exit(2)
+	}
+
+	header := http.Header{"Origin": {"http://localhost"}}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: *timeout,
+		Subprotocols:     []string{"vpn-protocol"},
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: *insecure},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	fmt.Printf("Cycling %d tunnels against %s for %s\n", *conns, *url, *duration)
+	res := &selftestResult{failures: make(map[string]int)}
+	start := time.Now()
+	done := make(chan struct{})
+	go res.progress(done, start)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				res.cycle(dialer, *url, header, *hold)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if !res.report(time.Since(start), *maxFailures) {
+		os.Exit(1)
+	}
+}
+
+// cycle opens one tunnel and holds it open
+func (res *selftestResult) cycle(dialer *websocket.Dialer, url string, header http.Header, hold time.Duration) {
+	began := time.Now()
+	ws, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		res.fail(selftestFailure(resp, err))
+		return
+	}
+	accepted := time.Since(began)
+	res.opened.Add(1)
+	for n := res.open.Add(1); ; {
+		peak := res.peak.Load()
+		if n <= peak || res.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	res.mu.Lock()
+	res.latencies = append(res.latencies, accepted)
+	res.mu.Unlock()
+
+	// Nothing is sent, so the node has nothing to say until the hold is up
+	ws.SetReadDeadline(time.Now().Add(hold))
+	_, _, err = ws.ReadMessage()
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	} else {
+		res.dropped.Add(1)
+		res.fail("dropped by the node before the hold was up")
+	}
+	ws.Close()
+	res.open.Add(-1)
+}
+
+func (res *selftestResult) fail(reason string) {
+	res.failed.Add(1)
+	res.mu.Lock()
+	res.failures[reason]++
+	res.mu.Unlock()
+}
+
+// selftestFailure names why a tunnel couldn't be opened, coarsely enough
+// that failures add up
+func selftestFailure(resp *http.Response, err error) string {
+	var netErr net.Error
+	switch {
+	case resp != nil:
+		return fmt.Sprintf("refused with status %d", resp.StatusCode)
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return "out of file descriptors (raise ulimit -n)"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "out of local ports"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timed out"
+	}
+	return err.Error()
+}
+
+func (res *selftestResult) progress(done <-chan struct{}, start time.Time) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fmt.Printf("%6.0fs  opened %d  failed %d  open now %d\n",
+				time.Since(start).Seconds(), res.opened.Load(), res.failed.Load(), res.open.Load())
+		}
+	}
+}
+
+// report prints the results and returns whether the failure rate was
+// within maxRate
+func (res *selftestResult) report(elapsed time.Duration, maxRate float64) bool {
+	opened, failed := res.opened.Load(), res.failed.Load()
+	attempts := opened + failed - res.dropped.Load()
+	rate := 0.0
+	if attempts > 0 {
+		rate = float64(failed) / float64(attempts)
+	}
+
+	fmt.Println()
+	fmt.Printf("Tunnels opened:   %d (%.1f/s)\n", opened, float64(opened)/elapsed.Seconds())
+	fmt.Printf("Peak open:        %d\n", res.peak.Load())
+	fmt.Printf("Failed:           %d (%.2f%%)\n", failed, rate*100)
+	reasons := make([]string, 0, len(res.failures))
+	for reason := range res.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return res.failures[reasons[i]] > res.failures[reasons[j]] })
+	for _, reason := range reasons {
+		fmt.Printf("  %8d  %s\n", res.failures[reason], reason)
+	}
+
+	if len(res.latencies) > 0 {
+		l := res.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		at := func(q float64) time.Duration { return l[int(q*float64(len(l)-1))].Round(time.Microsecond) }
+		fmt.Printf("Accept latency:   p50 %s  p90 %s  p99 %s  max %s\n", at(0.5), at(0.9), at(0.99), at(1))
+	}
+
+	if rate > maxRate {
+		fmt.Printf("\nFAIL: failure rate %.2f%% is over %.2f%%\n", rate*100, maxRate*100)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const sessionEvictionPollInterval = 10 * time.Second
+
+var errTooManySessions = errors.New("too many concurrent sessions")
+
+// SessionTracker reports client sessions to the sync server, which enforces
+// the per-user session limit across the fleet. A session is one client of
+// one user on this node; all the tunnels it opens share it. The sync server
+// answers a new session with a refusal (reject policy) or by evicting the
+// user's oldest session, which the owning node picks up when it polls.
+type SessionTracker struct {
+	syncServerURL string
+	serverID      string
+
+	mu       sync.Mutex
+	sessions map[string]*trackedSession
+}
+
+type trackedSession struct {
+	id    string
+	key   string
+	user  string
+	refs  int
+	conns map[io.Closer]struct{}
+
+	// Closed once the sync server has answered the start report
+	ready chan struct{}
+	err   error
+}
+
+// SessionLease is one tunnel's hold on its session. A nil lease (session
+// tracking disabled) is valid and does nothing.
+type SessionLease struct {
+	t *SessionTracker
+	s *trackedSession
+
+	closeOnce sync.Once
+}
+
+func newSessionTracker(syncServerURL, serverID string) *SessionTracker {
+	return &SessionTracker{
+		syncServerURL: syncServerURL,
+		serverID:      serverID,
+		sessions:      make(map[string]*trackedSession),
+	}
+}
+
+var sessionTracker *SessionTracker
+
+// sessionClient names the client a tunnel belongs to: the session the
+// credential names, or else the client's address. Behind cloudflared the
+// connection comes from loopback and the address is in Cf-Connecting-Ip.
+func sessionClient(id *Identity, r *http.Request) string {
+	if id.Session != "" {
+		return id.Session
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if cf := r.Header.Get("Cf-Connecting-Ip"); cf != "" {
+			return cf
+		}
+	}
+	return host
+}
+
+// Open joins the tunnel to its client's session, starting the session if it
+// is new. It returns errTooManySessions if the sync server refuses it. When
+// tracking is disabled or the request is unauthenticated it returns nil.
+func (t *SessionTracker) Open(id *Identity, r *http.Request) (*SessionLease, error) {
+	if t == nil || id == nil {
+		return nil, nil
+	}
+
+	key := id.Subject + "\x00" + sessionClient(id, r)
+
+	t.mu.Lock()
+	s := t.sessions[key]
+	if s == nil {
+		s = &trackedSession{
+			id:    newSessionID(),
+			key:   key,
+			user:  id.Subject,
+			conns: make(map[io.Closer]struct{}),
+			ready: make(chan struct{}),
+		}
+		t.sessions[key] = s
+		t.mu.Unlock()
+
+		s.err = t.start(s)
+		if s.err != nil {
+			t.mu.Lock()
+			delete(t.sessions, key)
+			t.mu.Unlock()
+		}
+		close(s.ready)
+	} else {
+		t.mu.Unlock()
+	}
+
+	<-s.ready
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[key] != s {
+		// Evicted or ended while we waited
+		return nil, errTooManySessions
+	}
+	s.refs++
+	return &SessionLease{t: t, s: s}, nil
+}
+
+// Attach registers c to be closed if the session is evicted.
+func (l *SessionLease) Attach(c io.Closer) {
+	if l == nil {
+		return
+	}
+	l.t.mu.Lock()
+	live := l.t.sessions[l.s.key] == l.s
+	if live {
+		l.s.conns[c] = struct{}{}
+	}
+	l.t.mu.Unlock()
+
+	if !live {
+		c.Close()
+	}
+}
+
+// Close releases the lease. The session ends with its last tunnel.
+func (l *SessionLease) Close() {
+	if l == nil {
+		return
+	}
+	l.closeOnce.Do(func() {
+		t, s := l.t, l.s
+		t.mu.Lock()
+		s.refs--
+		ended := s.refs == 0 && t.sessions[s.key] == s
+		if ended {
+			delete(t.sessions, s.key)
+		}
+		t.mu.Unlock()
+
+		if ended {
+			go t.stop(s)
+		}
+	})
+}
+
+func (t *SessionTracker) start(s *trackedSession) error {
+	var result struct {
+		Allowed *bool `json:"allowed"`
+	}
+	err := t.post("/sessions/start", map[string]string{
+		"serverId":  t.serverID,
+		"sessionId": s.id,
+		"user":      s.user,
+	}, &result)
+	// Only an explicit refusal counts; a 429 from the sync server's rate
+	// limiter carries no verdict
+	if result.Allowed != nil && !*result.Allowed {
+		return errTooManySessions
+	}
+	if err != nil {
+		// Don't lock everyone out while the sync server is unreachable,
+		// failing or rate limiting us
+		slog.Warn("Failed to report session start, allowing it", "err", err)
+	}
+	return nil
+}
+
+func (t *SessionTracker) stop(s *trackedSession) {
+	if err := t.post("/sessions/stop", map[string]string{
+		"serverId":  t.serverID,
+		"sessionId": s.id,
+	}, nil); err != nil {
+		slog.Warn("Failed to report session stop", "err", err)
+	}
+}
+
+// post sends a JSON report with the node's credential and decodes the reply
+// into v. Non-2xx answers are errors, but a JSON body that comes with one is
+// still decoded.
+func (t *SessionTracker) post(path string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.syncServerURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return t.do(req, v)
+}
+
+// do sends req with the node's credential and decodes the reply into v
+func (t *SessionTracker) do(req *http.Request, v interface{}) error {
+	if token := nodeCredential(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// PollEvictions closes the tunnels of sessions the sync server evicted to
+// make room for newer ones.
+func (t *SessionTracker) PollEvictions() {
+	for {
+		time.Sleep(sessionEvictionPollInterval)
+
+		var evictions struct {
+			SessionIDs []string `json:"sessionIds"`
+		}
+		req, err := http.NewRequest(http.MethodGet, t.syncServerURL+"/servers/"+t.serverID+"/evictions", nil)
+		if err != nil {
+			slog.Warn("Failed to fetch session evictions", "err", err)
+			continue
+		}
+		if err := t.do(req, &evictions); err != nil {
+			slog.Warn("Failed to fetch session evictions", "err", err)
+			continue
+		}
+		if len(evictions.SessionIDs) > 0 {
+			t.evict(evictions.SessionIDs)
+		}
+	}
+}
+
+func (t *SessionTracker) evict(ids []string) {
+	evicted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		evicted[id] = true
+	}
+
+	var conns []io.Closer
+	t.mu.Lock()
+	for key, s := range t.sessions {
+		if !evicted[s.id] {
+			continue
+		}
+		slog.Info("Session evicted by the session limit", "session", s.id, "user", s.user, "tunnels", len(s.conns))
+		delete(t.sessions, key)
+		for c := range s.conns {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rejectTooManySessions answers a tunnel request refused by the session limit
+func rejectTooManySessions(w http.ResponseWriter, r *http.Request, id *Identity) {
+	withUser(logFor(r), id).Warn("Refusing tunnel: session limit reached")
+	refuse(w, http.StatusTooManyRequests, noticeSessionLimit, "Too many concurrent sessions")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A tunnel the node sheds never reaches the sync server as a session, so it
+// can't take the place of one the user already has
+func TestShedTunnelOpensNoSession(t *testing.T) {
+	var starts atomic.Int32
+	syncServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sessions/start" {
+			starts.Add(1)
+			w.Write([]byte(`{"allowed": true}`))
+		}
+	}))
+	defer syncServer.Close()
+
+	savedChain, savedShedder := authChain, shedder
+	authChain = &AuthChain{providers: []AuthProvider{newStaticTokenProvider("alice:secret")}}
+	sessionTracker = newSessionTracker(syncServer.URL, "node-1")
+	shedder = NewLoadShedder(1, time.Second)
+	defer func() { authChain, shedder, sessionTracker = savedChain, savedShedder, nil }()
+	node := startTestNode(t)
+
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		h := http.Header{"Origin": {"http://localhost"}, "Authorization": {"Bearer secret"}}
+		d := websocket.Dialer{Subprotocols: []string{"vpn-protocol"}}
+		return d.Dial("ws"+strings.TrimPrefix(node.http.URL, "http")+"/ws", h)
+	}
+
+	shedder.held.Store(true)
+	if _, resp, err := dial(); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial while shedding: %v, %v", resp, err)
+	}
+	if n := starts.Load(); n != 0 {
+		t.Fatalf("shed tunnel reported %d session starts", n)
+	}
+
+	shedder.held.Store(false)
+	conn, _, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := starts.Load(); n != 1 {
+		t.Errorf("admitted tunnel reported %d session starts, want 1", n)
+	}
+	// The tunnel releases the shedder it took before it is swapped back
+	for deadline := time.Now().Add(5 * time.Second); shedder.active.Load() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
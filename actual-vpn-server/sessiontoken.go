@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// sessionTokenIssuer is the iss claim of tokens minted by the sync server
+const sessionTokenIssuer = "horsevpn-sync"
+
+// SessionTokenProvider accepts the short-lived tokens the sync server mints
+// for one node and one client session. They are Ed25519-signed JWTs checked
+// against public keys from SESSION_TOKEN_PUBLIC_KEYS, so validation needs no
+// call to the sync server, and a token is useless on any other node.
+type SessionTokenProvider struct {
+	serverID string
+	keys     jwt.VerificationKeySet
+}
+
+// newSessionTokenProvider parses a comma-separated list of base64 Ed25519
+// public keys. Several keys can be listed while the signing key is rotated.
+func newSessionTokenProvider(spec, serverID string) (*SessionTokenProvider, error) {
+	p := &SessionTokenProvider{serverID: serverID}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid session token public key %q", entry)
+		}
+		p.keys.Keys = append(p.keys.Keys, ed25519.PublicKey(raw))
+	}
+	if len(p.keys.Keys) == 0 {
+		return nil, errors.New("no session token public keys given")
+	}
+	return p, nil
+}
+
+func (p *SessionTokenProvider) Name() string {
+	return "session"
+}
+
+func (p *SessionTokenProvider) Authenticate(token string) (*Identity, error) {
+	if strings.Count(token, ".") != 2 {
+		return nil, errTokenNotRecognized
+	}
+	unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, errTokenNotRecognized
+	}
+	if iss, _ := unverified.Claims.GetIssuer(); iss != sessionTokenIssuer {
+		return nil, errTokenNotRecognized
+	}
+
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		return p.keys, nil
+	},
+		jwt.WithValidMethods([]string{"EdDSA"}),
+		jwt.WithIssuer(sessionTokenIssuer),
+		jwt.WithAudience(p.serverID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := parsed.Claims.GetSubject()
+	if sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	if did, _ := claims["did"].(string); did != "" && revokedDevices.Revoked(did) {
+		return nil, fmt.Errorf("device %s has been revoked", did)
+	}
+
+	id := &Identity{Subject: sub, Provider: p.Name()}
+	// Tokens are re-minted every few minutes with a new sid, so the device
+	// is what stays the same for the length of a session
+	if did, _ := claims["did"].(string); did != "" {
+		id.Session = did
+	}
+	if exp, _ := parsed.Claims.GetExpirationTime(); exp != nil {
+		id.Expires = exp.Time
+	}
+	// Besides its expiry (see watchCredential), a revoked device ends a
+	// tunnel opened with the token
+	if did, _ := claims["did"].(string); did != "" {
+		id.recheck = func() error {
+			if revokedDevices.Revoked(did) {
+				return fmt.Errorf("device %s has been revoked", did)
+			}
+			return nil
+		}
+	}
+	return id, nil
+}
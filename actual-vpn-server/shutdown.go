@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown. On SIGTERM or SIGINT the node refuses new tunnels on
+// every transport, fails /readyz, and unregisters from the sync server so
+// clients are told it is gone instead of timing out. Replicas sharing a
+// server ID through leader election leave the ID registered, since the
+// others still serve it. Tunnels already open carry on, for up to
+// SHUTDOWN_DRAIN_TIMEOUT seconds; the HTTP server keeps running meanwhile so
+// poll sessions and HTTP/2 streams can finish. Then the node exits. A second
+// signal exits at once.
+var (
+	shuttingDown     atomic.Bool
+	tunnelsDrained   = registry.Counter("shutdown_tunnels_drained_total", "Tunnels that finished while the node was shutting down")
+	tunnelsAbandoned = registry.Counter("shutdown_tunnels_abandoned_total", "Tunnels still open when the shutdown drain timed out")
+)
+
+func shutdownDrainTimeoutFromEnv() time.Duration {
+	if v := os.Getenv("SHUTDOWN_DRAIN_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid SHUTDOWN_DRAIN_TIMEOUT value", "value", v)
+	}
+	return 25 * time.Second
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT and shuts the node down.
+// unregister, if set, takes the node out of the sync server's catalog.
+func shutdownOnSignal(server *http.Server, drainTimeout time.Duration, unregister func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	go func() {
+		sig := <-signals
+		slog.Warn("Received signal again, exiting", "signal", sig.String(), "tunnels", shedder.Active())
+		os.Exit(1)
+	}()
+
+	slog.Info("Received signal, refusing new tunnels and draining open ones", "signal", sig.String(), "tunnels", shedder.Active(), "timeout", drainTimeout)
+	shuttingDown.Store(true)
+	shedder.Hold()
+	server.SetKeepAlivesEnabled(false)
+	if unregister != nil {
+		unregister()
+	}
+
+	start := shedder.Active()
+	deadline := time.Now().Add(drainTimeout)
+	lastLog := time.Now()
+	for shedder.Active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+		if time.Since(lastLog) >= 5*time.Second {
+			slog.Info("Waiting for tunnels to finish", "tunnels", shedder.Active())
+			lastLog = time.Now()
+		}
+	}
+	left := shedder.Active()
+	if left < start {
+		tunnelsDrained.Add(start - left)
+	}
+	if left > 0 {
+		tunnelsAbandoned.Add(left)
+		slog.Warn("Drain timed out, closing tunnels", "tunnels", left)
+	} else {
+		slog.Info("All tunnels finished")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("Server shutdown failed", "err", err)
+	}
+	if err := userUsage.Save(); err != nil {
+		slog.Warn("Failed to save usage", "err", err)
+	}
+	os.Exit(0)
+}
+
+// shutdownCheck fails /readyz once shutdown has begun
+func shutdownCheck() error {
+	if shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stay under a typical path MTU so packets aren't fragmented
+const statsdMaxPacket = 1432
+
+// StatsdSink periodically pushes every metric in a Registry to a StatsD or
+// DogStatsD agent over UDP. Counters are sent as deltas since the previous
+// flush, gauges as absolute values. Tags use the DogStatsD "|#k:v" extension,
+// which plain StatsD servers ignore.
+type StatsdSink struct {
+	addr     string
+	prefix   string
+	tags     []string
+	interval time.Duration
+	registry *Registry
+
+	last map[*Metric]int64
+}
+
+// statsdSinkFromEnv builds a sink from STATSD_ADDR, STATSD_PREFIX, STATSD_TAGS
+// and STATSD_INTERVAL. It returns nil if STATSD_ADDR is not set.
+func statsdSinkFromEnv(registry *Registry, serverID, location string) *StatsdSink {
+	addr := os.Getenv("STATSD_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	s := &StatsdSink{
+		addr:     addr,
+		prefix:   "horsevpn.",
+		interval: 10 * time.Second,
+		registry: registry,
+		tags:     []string{"server_id:" + serverID, "location:" + location},
+		last:     make(map[*Metric]int64),
+	}
+
+	if v, ok := os.LookupEnv("STATSD_PREFIX"); ok {
+		s.prefix = v
+	}
+	if v := os.Getenv("STATSD_TAGS"); v != "" {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				s.tags = append(s.tags, tag)
+			}
+		}
+	}
+	if v := os.Getenv("STATSD_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			slog.Warn("Ignoring invalid STATSD_INTERVAL value", "value", v)
+		} else {
+			s.interval = time.Duration(secs) * time.Second
+		}
+	}
+
+	return s
+}
+
+func (s *StatsdSink) Run() {
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		slog.Warn("StatsD sink disabled", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	slog.Info("Pushing metrics to StatsD", "addr", s.addr, "interval", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, packet := range s.packets() {
+			// UDP is fire-and-forget; an absent agent shouldn't spam the log
+			conn.Write(packet)
+		}
+	}
+}
+
+// packets renders the current metric values, split into UDP-sized packets.
+func (s *StatsdSink) packets() [][]byte {
+	var tagSuffix string
+	if len(s.tags) > 0 {
+		tagSuffix = "|#" + strings.Join(s.tags, ",")
+	}
+
+	var packets [][]byte
+	var buf bytes.Buffer
+
+	s.registry.Each(func(m *Metric) {
+		value := m.Value()
+		tags := tagSuffix
+		if m.Label != "" {
+			// Metrics of one name tell their label values apart by tag
+			tag := m.Label + ":" + m.LabelValue
+			if tags == "" {
+				tags = "|#" + tag
+			} else {
+				tags += "," + tag
+			}
+		}
+		var line string
+		switch m.Kind {
+		case kindCounter:
+			delta := value - s.last[m]
+			s.last[m] = value
+			if delta == 0 {
+				return
+			}
+			line = fmt.Sprintf("%s%s:%d|c%s", s.prefix, m.Name, delta, tags)
+		case kindGauge:
+			line = fmt.Sprintf("%s%s:%d|g%s", s.prefix, m.Name, value, tags)
+		default:
+			// Histograms need buckets, which only /metrics has
+			return
+		}
+
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	})
+
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Per-stream limits, so one runaway tunnel can't hold a shared exit node's
+// resources forever. A tunnel that has carried nothing for
+// STREAM_IDLE_TIMEOUT seconds, has been open for STREAM_MAX_LIFETIME seconds
+// or has carried STREAM_MAX_BYTES in total is closed; WebSocket tunnels get
+// a close frame with code 1008 and the limit as the reason, so the client
+// can tell a limit from a broken connection. Every limit is off by default.
+type StreamLimits struct {
+	Idle     time.Duration
+	Lifetime time.Duration
+	MaxBytes int64
+}
+
+var streamLimits StreamLimits
+
+var streamsLimited = registry.Counter("streams_limited_total", "Tunnels closed for reaching a per-stream limit")
+
+var errStreamLimit = errors.New("stream limit reached")
+
+// limitCloser is implemented by connections that can tell the client why
+// they are being closed
+type limitCloser interface {
+	CloseLimit(reason string) error
+}
+
+func streamLimitsFromEnv() StreamLimits {
+	var limits StreamLimits
+	if v := os.Getenv("STREAM_IDLE_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 0 {
+			limits.Idle = time.Duration(secs) * time.Second
+		} else {
+			slog.Warn("Ignoring invalid STREAM_IDLE_TIMEOUT value", "value", v)
+		}
+	}
+	if v := os.Getenv("STREAM_MAX_LIFETIME"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs >= 0 {
+			limits.Lifetime = time.Duration(secs) * time.Second
+		} else {
+			slog.Warn("Ignoring invalid STREAM_MAX_LIFETIME value", "value", v)
+		}
+	}
+	if v := os.Getenv("STREAM_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && n >= 0 {
+			limits.MaxBytes = n
+		} else {
+			slog.Warn("Ignoring invalid STREAM_MAX_BYTES value", "value", v)
+		}
+	}
+	return limits
+}
+
+// streamUsage is what a tunnel has done so far, for its limits
+type streamUsage struct {
+	limits     StreamLimits
+	opened     time.Time
+	lastActive atomic.Int64
+	bytes      atomic.Int64
+	limited    atomic.Bool
+}
+
+func (u *streamUsage) start(limits StreamLimits) {
+	u.limits = limits
+	u.opened = time.Now()
+	u.lastActive.Store(u.opened.UnixNano())
+}
+
+// record counts n bytes carried and reports whether the byte limit allows
+// them
+func (u *streamUsage) record(n int) bool {
+	u.lastActive.Store(time.Now().UnixNano())
+	total := u.bytes.Add(int64(n))
+	return u.limits.MaxBytes == 0 || total <= u.limits.MaxBytes
+}
+
+// exceeded names the time limit the stream has reached, if any
+func (u *streamUsage) exceeded(now time.Time) string {
+	if u.limits.Lifetime > 0 && now.Sub(u.opened) >= u.limits.Lifetime {
+		return "stream lifetime limit"
+	}
+	if u.limits.Idle > 0 && now.Sub(time.Unix(0, u.lastActive.Load())) >= u.limits.Idle {
+		return "stream idle timeout"
+	}
+	return ""
+}
+
+// enforceLimits closes the tunnel when it reaches a time limit, until stop
+// is closed
+func (t *Tunnel) enforceLimits(stop <-chan struct{}) {
+	if t.usage.limits.Idle == 0 && t.usage.limits.Lifetime == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if reason := t.usage.exceeded(now); reason != "" {
+				t.closeLimited(reason)
+				return
+			}
+		}
+	}
+}
+
+// closeLimited ends the tunnel for reaching a limit. Closing the client's
+// connection makes the copy loops return.
+func (t *Tunnel) closeLimited(reason string) {
+	if t.usage.limited.Swap(true) {
+		return
+	}
+	t.log.Info("Closing tunnel", "reason", reason, "after", time.Since(t.usage.opened).Round(time.Second), "bytes", t.usage.bytes.Load())
+	streamsLimited.Inc()
+	if lc, ok := t.localConn.(limitCloser); ok {
+		lc.CloseLimit(reason)
+		return
+	}
+	t.localConn.Close()
+}
+
+// CloseLimit sends a close frame giving the reason before closing. Anything
+// still waiting to be coalesced is dropped; the stream is being cut anyway.
+func (w *WSConn) CloseLimit(reason string) error {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	w.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return w.Conn.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Tenants. A hosting provider can sell one node's capacity to several
+// customers, each with its own sync server or identity provider. TENANTS_FILE
+// names a JSON file listing them:
+//
+//	{"tenants": [{"name": "acme", "hosts": ["acme.vpn.example.com"],
+//	  "authTokens": "...", "maxTunnels": 200, "egressIps": ["203.0.113.7"]}]}
+//
+// A connection belongs to the tenant whose hosts include the name it asked
+// for (the Host header, or the TLS server name on raw TLS) and is checked
+// against that tenant's providers only, configured with the same fields as
+// the AUTH_TOKENS, JWT_*, OIDC_* and SESSION_TOKEN_PUBLIC_KEYS variables.
+// Subjects are prefixed with the tenant's name, so users of different
+// tenants never share sessions or per-user state. Each tenant can have its
+// own concurrent tunnel limit on top of the node's, its own metrics
+// (tenant_<name>_*) and its own pool of egress addresses, chosen like the
+// node's EGRESS_* settings; egressIp is a pool of one. Connections for other names use the environment's
+// providers, as before.
+type Tenant struct {
+	Name       string   `json:"name"`
+	Hosts      []string `json:"hosts"`
+	MaxTunnels int64    `json:"maxTunnels"`
+	AuthSettings
+
+	EgressIP     string            `json:"egressIp"`
+	EgressIPs    []string          `json:"egressIps"`
+	EgressPolicy string            `json:"egressPolicy"`
+	EgressUsers  map[string]string `json:"egressUsers"`
+
+	chain  *AuthChain
+	egress *EgressPool
+	active atomic.Int64
+
+	tunnelsActive    *Metric
+	connectionsTotal *Metric
+	connectionsShed  *Metric
+	bytesFromClients *Metric
+	bytesToClients   *Metric
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+var errTenantQuota = errors.New("tenant tunnel limit reached")
+
+// tenantsByHost maps each lower-cased host name to its tenant. It is set
+// once at startup.
+var tenantsByHost map[string]*Tenant
+
+func loadTenantsFromEnv(serverID string) (map[string]*Tenant, error) {
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tenants []*Tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	byHost := make(map[string]*Tenant)
+	names := make(map[string]bool)
+	for _, t := range file.Tenants {
+		if !tenantNamePattern.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %s listed twice", t.Name)
+		}
+		names[t.Name] = true
+
+		t.chain, err = newAuthChain(t.AuthSettings, serverID)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		// Without providers every connection would be anonymous and
+		// nothing would tell the tenants' users apart
+		if !t.chain.Enabled() {
+			return nil, fmt.Errorf("tenant %s has no auth providers", t.Name)
+		}
+		if t.MaxTunnels < 0 {
+			return nil, fmt.Errorf("tenant %s: invalid maxTunnels %d", t.Name, t.MaxTunnels)
+		}
+		if t.EgressIP != "" {
+			t.EgressIPs = append(t.EgressIPs, t.EgressIP)
+		}
+		if t.egress, err = newEgressPool(t.EgressIPs, t.EgressPolicy, t.EgressUsers); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if len(t.Hosts) == 0 {
+			return nil, fmt.Errorf("tenant %s has no hosts", t.Name)
+		}
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other := byHost[h]; other != nil {
+				return nil, fmt.Errorf("host %s belongs to both %s and %s", h, other.Name, t.Name)
+			}
+			byHost[h] = t
+		}
+
+		prefix := "tenant_" + t.Name + "_"
+		t.tunnelsActive = registry.Gauge(prefix+"tunnels_active", "Tunnels currently open for tenant "+t.Name)
+		t.connectionsTotal = registry.Counter(prefix+"connections_total", "Tunnels accepted for tenant "+t.Name)
+		t.connectionsShed = registry.Counter(prefix+"connections_shed_total", "Tunnels refused by tenant "+t.Name+"'s limit")
+		t.bytesFromClients = registry.Counter(prefix+"bytes_received_total", "Bytes received from tenant "+t.Name+"'s clients")
+		t.bytesToClients = registry.Counter(prefix+"bytes_sent_total", "Bytes sent to tenant "+t.Name+"'s clients")
+
+		slog.Info("Tenant configured", "tenant", t.Name, "hosts", strings.Join(t.Hosts, ","), "auth_providers", len(t.chain.providers))
+	}
+	return byHost, nil
+}
+
+// tenantFor returns the tenant serving host, which may carry a port, or nil
+// for the node's own realm
+func tenantFor(host string) *Tenant {
+	if len(tenantsByHost) == 0 {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return tenantsByHost[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+func (t *Tenant) authChain() *AuthChain {
+	if t == nil {
+		return authChain
+	}
+	return t.chain
+}
+
+// authenticate checks token against the tenant's chain and ties the identity
+// to the tenant
+func (t *Tenant) authenticate(chain *AuthChain, token string) (*Identity, error) {
+	id, err := chain.Authenticate(token)
+	if err != nil || t == nil {
+		return id, err
+	}
+	scoped := *id
+	scoped.Subject = t.Name + "/" + id.Subject
+	scoped.tenant = t
+	return &scoped, nil
+}
+
+// Acquire takes one of the tenant's tunnels, or reports that it has none
+// left. A nil tenant has no limit of its own.
+func (t *Tenant) Acquire() bool {
+	if t == nil {
+		return true
+	}
+	if n := t.active.Add(1); t.MaxTunnels > 0 && n > t.MaxTunnels {
+		t.active.Add(-1)
+		t.connectionsShed.Inc()
+		return false
+	}
+	t.tunnelsActive.Add(1)
+	t.connectionsTotal.Inc()
+	return true
+}
+
+func (t *Tenant) Release() {
+	if t == nil {
+		return
+	}
+	t.active.Add(-1)
+	t.tunnelsActive.Add(-1)
+}
+
+// rejectTenantQuota answers a tunnel request over its tenant's limit
+func rejectTenantQuota(w http.ResponseWriter, r *http.Request, id *Identity) {
+	withUser(logFor(r), id).Warn("Refusing tunnel", "err", errTenantQuota)
+	refuse(w, http.StatusTooManyRequests, noticeTenantQuota, "Tenant tunnel limit reached")
+}
+
+// tenantOf returns the tenant an identity belongs to; nil identities and
+// those of the node's own realm have none
+func (id *Identity) tenantOf() *Tenant {
+	if id == nil {
+		return nil
+	}
+	return id.tenant
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertSource supplies the node's TLS certificate, shared by the HTTPS
+// server and the raw TLS listener.
+type CertSource struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Set when certificates come from ACME
+	acme    *autocert.Manager
+	domains []string
+}
+
+// certSourceFromEnv returns certificates from ACME when ACME_DOMAINS is set,
+// else from TLS_CERT_FILE and TLS_KEY_FILE, or nil if neither is configured.
+//
+// ACME uses the TLS-ALPN-01 challenge, which the CA checks on port 443, so
+// one of the TLS listeners must be reachable there. Issued certificates are
+// kept in ACME_CACHE_DIR (default ./acme-cache).
+func certSourceFromEnv() (*CertSource, error) {
+	if v := os.Getenv("ACME_DOMAINS"); v != "" {
+		var domains []string
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		cacheDir := os.Getenv("ACME_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = "./acme-cache"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      os.Getenv("ACME_EMAIL"),
+		}
+		return &CertSource{getCertificate: m.GetCertificate, acme: m, domains: domains}, nil
+	}
+
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+	k := &reloadingKeyPair{certFile: certFile, keyFile: keyFile}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return &CertSource{getCertificate: k.GetCertificate}, nil
+}
+
+// TLSConfig returns the node's TLS settings offering the given ALPN
+// protocols.
+func (c *CertSource) TLSConfig(protos ...string) *tls.Config {
+	config := hardenedTLSConfig()
+	config.GetCertificate = c.getCertificate
+	config.NextProtos = protos
+	if c.acme != nil {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	return config
+}
+
+func hardenedTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+}
+
+// reloadingKeyPair serves a certificate from files, picking up a renewed
+// certificate (e.g. from certbot) within a minute without a restart.
+type reloadingKeyPair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (k *reloadingKeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if time.Since(k.checked) >= time.Minute {
+		k.checked = time.Now()
+		if err := k.load(); err != nil {
+			// A renewal may be half written; keep serving the old one
+			slog.Warn("Keeping current TLS certificate, reload failed", "err", err)
+		}
+	}
+	return k.cert, nil
+}
+
+func (k *reloadingKeyPair) load() error {
+	info, err := os.Stat(k.certFile)
+	if err != nil {
+		return err
+	}
+	if k.cert != nil && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.cert = &cert
+	k.modTime = info.ModTime()
+	k.checked = time.Now()
+	slog.Info("Loaded TLS certificate", "path", k.certFile)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileTokenProvider accepts the tokens listed in AUTH_TOKENS_FILE, one per
+// line as "name:token", optionally followed by an RFC 3339 expiry time:
+//
+//	# CI runners
+//	ci:6f1c0d7e9b...   2025-01-01T00:00:00Z
+//	alice:9a8b7c...
+//
+// The file is reread when it changes, at most every few seconds, so
+// deleting a line revokes the token: new tunnels are refused at once and
+// open ones are closed at their next credential check. Only hashes are kept
+// in memory.
+type FileTokenProvider struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	tokens  map[[32]byte]fileToken
+}
+
+type fileToken struct {
+	name string
+	// Zero if the token doesn't expire
+	expires time.Time
+}
+
+const tokenFileCheckInterval = 5 * time.Second
+
+var errTokenRevoked = errors.New("token has been revoked")
+
+func newFileTokenProvider(path string) (*FileTokenProvider, error) {
+	p := &FileTokenProvider{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.tokens, p.modTime, p.checked = tokens, info.ModTime(), time.Now()
+	return p, nil
+}
+
+func readTokenFile(path string) (map[[32]byte]fileToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[[32]byte]fileToken)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(fields[0], ":")
+		if !ok || name == "" || token == "" || len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want name:token [expiry]", path, line)
+		}
+		var expires time.Time
+		if len(fields) == 2 {
+			if expires, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid expiry: %w", path, line, err)
+			}
+		}
+		tokens[sha256.Sum256([]byte(token))] = fileToken{name: name, expires: expires}
+	}
+	return tokens, nil
+}
+
+func (p *FileTokenProvider) Name() string {
+	return "file"
+}
+
+// current returns the tokens, rereading the file if it has changed. A file
+// that can't be read keeps the tokens last read.
+func (p *FileTokenProvider) current() map[[32]byte]fileToken {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.checked) < tokenFileCheckInterval {
+		return p.tokens
+	}
+	p.checked = time.Now()
+	info, err := os.Stat(p.path)
+	if err != nil {
+		slog.Warn("Keeping previous tokens", "path", p.path, "err", err)
+		return p.tokens
+	}
+	if info.ModTime().Equal(p.modTime) {
+		return p.tokens
+	}
+	tokens, err := readTokenFile(p.path)
+	if err != nil {
+		slog.Warn("Keeping previous tokens", "path", p.path, "err", err)
+		return p.tokens
+	}
+	slog.Info("Reloaded tokens", "tokens", len(tokens), "path", p.path)
+	p.tokens, p.modTime = tokens, info.ModTime()
+	return p.tokens
+}
+
+func (p *FileTokenProvider) lookup(sum [32]byte) (fileToken, bool) {
+	for known, t := range p.current() {
+		if subtle.ConstantTimeCompare(sum[:], known[:]) == 1 {
+			return t, true
+		}
+	}
+	return fileToken{}, false
+}
+
+func (p *FileTokenProvider) Authenticate(token string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	t, ok := p.lookup(sum)
+	if !ok {
+		return nil, errTokenNotRecognized
+	}
+	if !t.expires.IsZero() && time.Now().After(t.expires) {
+		return nil, fmt.Errorf("token %s expired at %s", t.name, t.expires.Format(time.RFC3339))
+	}
+	id := &Identity{Subject: t.name, Provider: p.Name(), Expires: t.expires}
+	id.recheck = func() error {
+		t, ok := p.lookup(sum)
+		if !ok {
+			return errTokenRevoked
+		}
+		if !t.expires.IsZero() && time.Now().After(t.expires) {
+			return errors.New("token has expired")
+		}
+		return nil
+	}
+	return id, nil
+}
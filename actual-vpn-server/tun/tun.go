@@ -0,0 +1,186 @@
+// Package tun opens TUN devices and reads the headers of the IP packets
+// that pass through them. The node routes the packets of its /tun clients
+// through one; a client uses one to send the whole system's traffic through
+// the node.
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DefaultMTU leaves room for the tunnel's own headers on a 1500 byte path
+const DefaultMTU = 1400
+
+var errUnsupported = errors.New("tun: TUN devices are only supported on Linux")
+
+var errMalformed = errors.New("tun: malformed IP packet")
+
+// ErrNoDefaultRoute is returned by AddLANRoute when the system has no
+// default route in the destination's family
+var ErrNoDefaultRoute = errors.New("tun: no default route")
+
+// Header is what the tunnel needs to know about a packet
+type Header struct {
+	Version  int
+	Src, Dst net.IP
+	Protocol int
+	// Destination port for TCP and UDP, 0 otherwise
+	DstPort int
+}
+
+// IP protocol numbers
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+// ParseHeader reads the IPv4 or IPv6 header at the start of b. IPv6
+// extension headers aren't followed, so DstPort is 0 behind them.
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) == 0 {
+		return Header{}, errMalformed
+	}
+	var h Header
+	var payload []byte
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return Header{}, errMalformed
+		}
+		h = Header{Version: 4, Src: net.IP(b[12:16]), Dst: net.IP(b[16:20]), Protocol: int(b[9])}
+		// Only the first fragment carries the ports
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			payload = b[ihl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return Header{}, errMalformed
+		}
+		h = Header{Version: 6, Src: net.IP(b[8:24]), Dst: net.IP(b[24:40]), Protocol: int(b[6])}
+		payload = b[40:]
+	default:
+		return Header{}, errMalformed
+	}
+	if (h.Protocol == ProtocolTCP || h.Protocol == ProtocolUDP) && len(payload) >= 4 {
+		h.DstPort = int(binary.BigEndian.Uint16(payload[2:4]))
+	}
+	return h, nil
+}
+
+// ClampMSS lowers the maximum segment size a TCP SYN or SYN-ACK offers to
+// mss, so neither end sends segments whose packets won't fit the tunnel,
+// and reports whether it changed b. It updates the TCP checksum to match.
+// Segments that get through a tunnel don't depend on ICMP "fragmentation
+// needed" reaching the sender, which firewalls often drop, leaving
+// connections that open and then hang.
+func ClampMSS(b []byte, mss int) bool {
+	h, err := ParseHeader(b)
+	if err != nil || h.Protocol != ProtocolTCP {
+		return false
+	}
+	off := 40
+	if h.Version == 4 {
+		off = int(b[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return false
+		}
+	}
+	if len(b) < off+20 || b[off+13]&0x02 == 0 {
+		return false
+	}
+	end := off + int(b[off+12]>>4)*4
+	if end > len(b) {
+		return false
+	}
+	for i := off + 20; i < end; {
+		switch kind := b[i]; {
+		case kind == 0:
+			return false
+		case kind == 1:
+			i++
+		case i+1 >= end || b[i+1] < 2:
+			return false
+		case kind == 2 && b[i+1] == 4 && i+4 <= end:
+			old := binary.BigEndian.Uint16(b[i+2:])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(b[i+2:], uint16(mss))
+			// RFC 1624: HC' = ~(~HC + ~m + m')
+			sum := uint32(^binary.BigEndian.Uint16(b[off+16:])) + uint32(^old) + uint32(mss)
+			sum = sum&0xffff + sum>>16
+			sum = sum&0xffff + sum>>16
+			binary.BigEndian.PutUint16(b[off+16:], ^uint16(sum))
+			return true
+		default:
+			i += int(b[i+1])
+		}
+	}
+	return false
+}
+
+// Configure gives the device its address, sets its MTU and brings it up
+func (d *Device) Configure(addr netip.Prefix) error {
+	if err := ip("addr", "add", addr.String(), "dev", d.name); err != nil {
+		return err
+	}
+	return ip("link", "set", "dev", d.name, "mtu", strconv.Itoa(d.mtu), "up")
+}
+
+// SetMTU changes the device's MTU
+func (d *Device) SetMTU(mtu int) error {
+	if err := ip("link", "set", "dev", d.name, "mtu", strconv.Itoa(mtu)); err != nil {
+		return err
+	}
+	d.mtu = mtu
+	return nil
+}
+
+// AddRoute sends traffic for dst through the device
+func (d *Device) AddRoute(dst netip.Prefix) error {
+	return ip("route", "replace", dst.String(), "dev", d.name)
+}
+
+// AddLANRoute sends traffic for dst out of the interface the system's
+// default route for its family uses, so it stays on the local network even
+// where a device's routes cover it
+func AddLANRoute(dst netip.Prefix) error {
+	family := "-4"
+	if dst.Addr().Is6() {
+		family = "-6"
+	}
+	out, err := exec.Command("ip", family, "route", "show", "default").Output()
+	if err != nil {
+		return fmt.Errorf("tun: ip %s route show default: %v", family, err)
+	}
+	// default via 192.168.1.1 dev wlan0 proto dhcp metric 600
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return ip(family, "route", "replace", dst.String(), "dev", fields[i+1])
+		}
+	}
+	return ErrNoDefaultRoute
+}
+
+// ip runs iproute2, which is simpler than speaking netlink and present on
+// every system with TUN support
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tun: ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (d *Device) Name() string { return d.name }
+
+func (d *Device) MTU() int { return d.mtu }
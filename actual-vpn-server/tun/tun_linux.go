@@ -0,0 +1,51 @@
+package tun
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device is a TUN interface. Each Read returns one IP packet and each Write
+// sends one; there is no packet information header. Close unblocks reads.
+type Device struct {
+	f    *os.File
+	name string
+	mtu  int
+}
+
+// Open creates the TUN interface name, or attaches to it if it exists. An
+// empty name lets the kernel pick one (tun0, tun1, ...). It needs
+// CAP_NET_ADMIN.
+func Open(name string, mtu int) (*Device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF", err)
+	}
+	// Non-blocking, so reads go through the runtime poller and Close
+	// interrupts them
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	return &Device{f: os.NewFile(uintptr(fd), "/dev/net/tun"), name: ifr.Name(), mtu: mtu}, nil
+}
+
+func (d *Device) Read(p []byte) (int, error) { return d.f.Read(p) }
+
+func (d *Device) Write(p []byte) (int, error) { return d.f.Write(p) }
+
+func (d *Device) Close() error { return d.f.Close() }
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tun
+
+// Device is a TUN interface; see tun_linux.go
+type Device struct {
+	name string
+	mtu  int
+}
+
+func Open(name string, mtu int) (*Device, error) {
+	return nil, errUnsupported
+}
+
+func (d *Device) Read(p []byte) (int, error) { return 0, errUnsupported }
+
+func (d *Device) Write(p []byte) (int, error) { return 0, errUnsupported }
+
+func (d *Device) Close() error { return nil }
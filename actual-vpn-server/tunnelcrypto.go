@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"horse-vpn-server/e2e"
+	"horse-vpn-server/mux"
+)
+
+// End-to-end encryption of tunnels; see package e2e. The node's static key
+// lives in E2E_KEY_FILE, generated on first start, and its public half is
+// registered with the sync server, which hands it to clients along with the
+// node's URL. A client asks for encryption with an X-Tunnel-Encryption: e2e1
+// header on the tunnel request (WebSocket, polling or HTTP/2 CONNECT), and
+// the node answers with the same header before the handshake starts inside
+// the tunnel. Clients that list ciphers in X-Tunnel-Cipher get the node's
+// preferred one if they take it: the one -e2e-cipher or E2E_CIPHER names,
+// or else whichever of AES-256-GCM and ChaCha20-Poly1305 was faster in a
+// benchmark at startup. With REQUIRE_E2E=true, tunnels without it are refused. Raw TLS
+// tunnels don't need it: their TLS already ends at the node.
+const e2eHandshakeTimeout = 10 * time.Second
+
+var (
+	nodeE2EKey *ecdh.PrivateKey
+	requireE2E bool
+
+	tunnelsEncrypted = registry.Counter("tunnels_encrypted_total", "Tunnels that completed the end-to-end encryption handshake")
+)
+
+var errE2EUnavailable = errors.New("end-to-end encryption is not set up on this node")
+
+func e2eKeyFromEnv() (*ecdh.PrivateKey, error) {
+	path := os.Getenv("E2E_KEY_FILE")
+	if path == "" {
+		path = "./e2e-key"
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		key, err := e2e.ParsePrivateKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(e2e.EncodePrivateKey(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	slog.Info("Generated end-to-end encryption key", "path", path)
+	return key, nil
+}
+
+// negotiateEncryption reads the client's request for encryption, answering
+// 400 for a version the node doesn't speak and 426 when the node requires
+// encryption the client didn't ask for
+func (t *Tunnel) negotiateEncryption(w http.ResponseWriter, r *http.Request) bool {
+	switch v := r.Header.Get(e2e.Header); v {
+	case "":
+		if requireE2E {
+			w.Header().Set(e2e.Header, e2e.Version)
+			refuse(w, http.StatusUpgradeRequired, noticeE2ERequired, "This node requires end-to-end encryption")
+			return false
+		}
+	case e2e.Version:
+		if nodeE2EKey == nil {
+			http.Error(w, errE2EUnavailable.Error(), http.StatusBadRequest)
+			return false
+		}
+		t.encrypt = true
+		t.cipher = e2e.Choose(r.Header.Get(e2e.CipherHeader), nodeE2ECipher)
+	default:
+		http.Error(w, "Unsupported "+e2e.Header, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// handshakeHeader returns the headers of the response accepting the tunnel
+func (t *Tunnel) handshakeHeader() http.Header {
+	h := varyHandshake()
+	if h == nil && (t.encrypt || t.mux) {
+		h = http.Header{}
+	}
+	if t.encrypt {
+		h.Set(e2e.Header, e2e.Version)
+		h.Set(e2e.CipherHeader, string(t.cipher))
+	}
+	if t.mux {
+		h.Set(mux.Header, mux.Version)
+		h.Set(mux.ControlHeader, "rotate")
+		t.resumeHeaders(h)
+	}
+	return h
+}
+
+// startEncryption runs the node's side of the handshake on the client's
+// connection and relays through the encrypted stream from then on
+func (t *Tunnel) startEncryption() error {
+	timer := time.AfterFunc(e2eHandshakeTimeout, func() { t.localConn.Close() })
+	conn, err := e2e.Server(t.localConn, nodeE2EKey, t.cipher)
+	if !timer.Stop() {
+		return errors.New("end-to-end encryption handshake timed out")
+	}
+	if err != nil {
+		return err
+	}
+	if t.remoteConn == t.localConn {
+		t.remoteConn = conn
+	}
+	t.localConn = conn
+	tunnelsEncrypted.Inc()
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"horse-vpn-server/mux"
+)
+
+// Stream multiplexing; see package mux. A client that keeps one tunnel open
+// and opens a logical stream in it per connection asks for it with an
+// X-Tunnel-Mux: mux1 header on the tunnel request, and the node answers
+// with the same header. Each stream starts with the SOCKS5 CONNECT a plain
+// tunnel starts with and is relayed like one, with its own per-stream
+// limits. The tunnel itself counts once against the session, overload and
+// tenant limits; MUX_MAX_STREAMS (default 256) caps the streams open in it
+// at once.
+//
+// A client that also sends X-Tunnel-Mux-Resume: new gets a resumable
+// session, and a token for it in the same response header. When the
+// connection under it drops, the session and its streams wait
+// MUX_RESUME_TIMEOUT seconds (default 30) for the client to come back with
+// a new tunnel request giving the token and how many frames it had
+// received; the node answers with its own count and both sides resend the
+// rest. Each connection a session runs over counts against the limits
+// while it does, so a waiting session holds none of them. A token that is
+// unknown, expired or another user's gets 410, after which the client
+// starts over with a new session.
+//
+// The client can also send control frames, JSON messages the node answers
+// with a control frame of its own. The one there is so far moves the
+// tunnel's later connections to another egress address, the next in the
+// node's pool (see egress.go), without reconnecting:
+//
+//	{"type": "rotate"}
+//	{"type": "rotated", "egress": ["203.0.113.8"]}
+//
+// egress is empty when the node has no other address for the client, who
+// can then ask the sync server for another node instead.
+var (
+	muxMaxStreams    = mux.DefaultMaxStreams
+	muxResumeTimeout = 30 * time.Second
+
+	muxSessionsActive   = registry.Gauge("mux_sessions_active", "Open multiplexed tunnels")
+	muxSessionsDetached = registry.Gauge("mux_sessions_detached", "Resumable multiplexed tunnels waiting for their client to reconnect")
+	muxStreamsActive    = registry.Gauge("mux_streams_active", "Open streams in multiplexed tunnels")
+	muxStreamsTotal     = registry.Counter("mux_streams_total", "Streams opened in multiplexed tunnels")
+	muxResumesTotal     = registry.Counter("mux_resumes_total", "Multiplexed tunnels resumed over a new connection")
+	muxResumesFailed    = registry.Counter("mux_resumes_failed_total", "Attempts to resume a multiplexed tunnel that was gone or couldn't go on")
+	muxResumesExpired   = registry.Counter("mux_resumes_expired_total", "Resumable multiplexed tunnels closed because their client didn't come back in time")
+)
+
+// muxResumption is what a tunnel request said about resuming
+type muxResumption struct {
+	token string
+	// The session to carry on, or nil to start one
+	session      *resumableMux
+	peerReceived uint64
+}
+
+// resumableMux is a resumable session, between connections or not
+type resumableMux struct {
+	token   string
+	session *mux.Session
+	id      *Identity
+	// The logger of the tunnel that opened the session
+	log *slog.Logger
+	// The statistics its streams count in, kept across connections
+	stats *tunnelStats
+
+	mu       sync.Mutex
+	detached bool
+	// Counts attachments, so an expiry timer knows the client came back
+	generation uint64
+}
+
+var (
+	resumableMuxesMu sync.Mutex
+	resumableMuxes   = make(map[string]*resumableMux)
+
+	// Each user's latest multiplexed tunnel, for port forwarding to open
+	// streams in; see portforward.go
+	userMuxesMu sync.Mutex
+	userMuxes   = make(map[string]*mux.Session)
+)
+
+func muxResumeTimeoutFromEnv() time.Duration {
+	if v := os.Getenv("MUX_RESUME_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid MUX_RESUME_TIMEOUT value", "value", v)
+	}
+	return 30 * time.Second
+}
+
+func muxMaxStreamsFromEnv() int {
+	v := os.Getenv("MUX_MAX_STREAMS")
+	if v == "" {
+		return mux.DefaultMaxStreams
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		slog.Warn("Ignoring invalid MUX_MAX_STREAMS value", "value", v)
+		return mux.DefaultMaxStreams
+	}
+	return n
+}
+
+// negotiateMux reads the client's request for multiplexing, answering 400
+// for a version the node doesn't speak or a request that also names a
+// destination, since each stream names its own
+func (t *Tunnel) negotiateMux(w http.ResponseWriter, r *http.Request) bool {
+	switch v := r.Header.Get(mux.Header); v {
+	case "":
+	case mux.Version:
+		if r.Header.Get("X-Destination") != "" {
+			http.Error(w, "X-Destination can't be used with "+mux.Header, http.StatusBadRequest)
+			return false
+		}
+		t.mux = true
+		return t.negotiateResume(w, r)
+	default:
+		http.Error(w, "Unsupported "+mux.Header, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// negotiateResume reads a request for a resumable session or to resume
+// one. The session being resumed loses its old connection right away, so
+// its count of received frames holds until the new one takes over.
+func (t *Tunnel) negotiateResume(w http.ResponseWriter, r *http.Request) bool {
+	switch token := r.Header.Get(mux.ResumeHeader); token {
+	case "":
+	case "new":
+		b := make([]byte, 16)
+		rand.Read(b)
+		t.muxResume = &muxResumption{token: hex.EncodeToString(b)}
+	default:
+		received, err := strconv.ParseUint(r.Header.Get(mux.ReceivedHeader), 10, 64)
+		if err != nil {
+			http.Error(w, "Missing or invalid "+mux.ReceivedHeader, http.StatusBadRequest)
+			return false
+		}
+		rm := findResumableMux(token, t.id)
+		if rm == nil {
+			muxResumesFailed.Inc()
+			http.Error(w, "Unknown or expired multiplexed tunnel", http.StatusGone)
+			return false
+		}
+		rm.session.Detach()
+		t.muxResume = &muxResumption{token: token, session: rm, peerReceived: received}
+	}
+	return true
+}
+
+func findResumableMux(token string, id *Identity) *resumableMux {
+	resumableMuxesMu.Lock()
+	rm := resumableMuxes[token]
+	resumableMuxesMu.Unlock()
+	if rm == nil || rm.id != nil && (id == nil || id.Subject != rm.id.Subject) {
+		return nil
+	}
+	return rm
+}
+
+// resumeHeaders adds the resumption part of the answer to a tunnel request
+func (t *Tunnel) resumeHeaders(h http.Header) {
+	if t.muxResume == nil {
+		return
+	}
+	h.Set(mux.ResumeHeader, t.muxResume.token)
+	if rm := t.muxResume.session; rm != nil {
+		h.Set(mux.ReceivedHeader, strconv.FormatUint(rm.session.Received(), 10))
+	}
+}
+
+// serveMux relays the streams the client opens in the tunnel until the
+// tunnel ends. For a resumable session, it only lasts while the tunnel
+// carries the session, which relays its streams on its own.
+func (t *Tunnel) serveMux() {
+	if t.muxResume != nil && t.muxResume.session != nil {
+		t.resumeMux()
+		return
+	}
+	// The streams share the rotation
+	t.egress.rotation = &egressRotation{}
+	control := make(chan []byte, 4)
+	config := mux.Config{
+		MaxStreams: muxMaxStreams,
+		Resumable:  t.muxResume != nil,
+		OnControl: func(msg []byte) {
+			select {
+			case control <- msg:
+			default:
+				// A client that floods us doesn't get answers
+			}
+		},
+	}
+	session := mux.Server(t.localConn, config)
+	go t.serveControl(session, control)
+	if t.id != nil {
+		trackUserMux(t.id.Subject, session)
+	}
+	if !config.Resumable {
+		defer session.Close()
+		t.acceptStreams(session)
+		return
+	}
+
+	// The token is the client's key to the session, so only part of it is logged
+	t.log = t.log.With("mux", t.muxResume.token[:8])
+	rm := &resumableMux{token: t.muxResume.token, session: session, id: t.id, log: t.log, stats: t.stats}
+	resumableMuxesMu.Lock()
+	resumableMuxes[rm.token] = rm
+	resumableMuxesMu.Unlock()
+	go func() {
+		t.acceptStreams(session)
+		rm.closed()
+	}()
+	rm.carry(session.Detached())
+}
+
+// resumeMux carries on the session the client asked to resume over this
+// tunnel
+func (t *Tunnel) resumeMux() {
+	rm := t.muxResume.session
+	rm.attach()
+	if err := rm.session.Resume(t.localConn, t.muxResume.peerReceived); err != nil {
+		muxResumesFailed.Inc()
+		if errors.Is(err, mux.ErrResumeMismatch) {
+			t.log.Warn("Can't resume multiplexed tunnel", "mux", rm.token[:8], "err", err)
+			rm.session.Close()
+			return
+		}
+		rm.lost()
+		return
+	}
+	muxResumesTotal.Inc()
+	t.log.Info("Resumed multiplexed tunnel", "mux", rm.token[:8], "streams", rm.session.NumStreams())
+	rm.carry(rm.session.Detached())
+}
+
+// carry waits until the session loses its connection or ends
+func (rm *resumableMux) carry(detached <-chan struct{}) {
+	select {
+	case <-detached:
+		rm.lost()
+	case <-rm.session.Done():
+	}
+}
+
+func (rm *resumableMux) attach() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.generation++
+	if rm.detached {
+		rm.detached = false
+		muxSessionsDetached.Add(-1)
+	}
+}
+
+// lost gives the client muxResumeTimeout to resume the session
+func (rm *resumableMux) lost() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	select {
+	case <-rm.session.Done():
+		return
+	default:
+	}
+	if !rm.detached {
+		rm.detached = true
+		muxSessionsDetached.Add(1)
+		rm.log.Info("Multiplexed tunnel lost its connection, keeping it for the client to resume", "timeout", muxResumeTimeout)
+	}
+	generation := rm.generation
+	time.AfterFunc(muxResumeTimeout, func() {
+		rm.mu.Lock()
+		expired := rm.detached && rm.generation == generation
+		rm.mu.Unlock()
+		if expired {
+			muxResumesExpired.Inc()
+			rm.log.Info("Multiplexed tunnel wasn't resumed in time, closing it")
+			rm.session.Close()
+		}
+	})
+}
+
+// closed forgets the session once it has ended
+func (rm *resumableMux) closed() {
+	resumableMuxesMu.Lock()
+	delete(resumableMuxes, rm.token)
+	resumableMuxesMu.Unlock()
+	rm.mu.Lock()
+	if rm.detached {
+		rm.detached = false
+		muxSessionsDetached.Add(-1)
+	}
+	rm.mu.Unlock()
+}
+
+// trackUserMux makes session user's latest multiplexed tunnel until it ends
+func trackUserMux(user string, session *mux.Session) {
+	userMuxesMu.Lock()
+	userMuxes[user] = session
+	userMuxesMu.Unlock()
+	go func() {
+		<-session.Done()
+		userMuxesMu.Lock()
+		if userMuxes[user] == session {
+			delete(userMuxes, user)
+		}
+		userMuxesMu.Unlock()
+	}()
+}
+
+// serveControl answers the client's control frames until session ends
+func (t *Tunnel) serveControl(session *mux.Session, control <-chan []byte) {
+	for {
+		var msg []byte
+		select {
+		case msg = <-control:
+		case <-session.Done():
+			return
+		}
+		var req struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(msg, &req)
+		var reply []byte
+		switch req.Type {
+		case "rotate":
+			egress := []string{}
+			for _, ip := range t.egress.rotate() {
+				egress = append(egress, ip.String())
+			}
+			if len(egress) > 0 {
+				egressRotations.Inc()
+				t.log.Info("Rotated egress address", "egress", egress)
+			}
+			reply, _ = json.Marshal(map[string]any{"type": "rotated", "egress": egress})
+		default:
+			reply, _ = json.Marshal(map[string]string{"type": "error", "error": "unknown control message"})
+		}
+		if session.Control(reply) != nil {
+			return
+		}
+	}
+}
+
+// acceptStreams relays the streams the client opens in session until it
+// ends
+func (t *Tunnel) acceptStreams(session *mux.Session) {
+	muxSessionsActive.Add(1)
+	defer muxSessionsActive.Add(-1)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		muxStreamsTotal.Inc()
+		muxStreamsActive.Add(1)
+		s := &Tunnel{id: t.id, egress: t.egress, localConn: stream, remoteConn: stream, log: t.log.With("stream", stream.ID()), stats: t.stats, policies: t.policies}
+		go func() {
+			defer muxStreamsActive.Add(-1)
+			defer stream.Close()
+			stop := make(chan struct{})
+			defer close(stop)
+			s.relay(stop)
+		}()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live statistics for the client's status display. A WebSocket tunnel
+// request with X-Tunnel-Stats: <seconds>, 1 to 60, gets a text message from
+// the node that often, between the binary messages that carry the tunnel:
+//
+//	{"type": "stats", "bytesUp": 5120, "bytesDown": 1048576, "throttled": false,
+//	 "rateLimit": 524288, "quotaUsed": 734003200, "quota": 10737418240,
+//	 "load": 0.42, "overloaded": false}
+//
+// bytesUp and bytesDown are what the tunnel has relayed, for a multiplexed
+// one across all its streams. throttled says whether a rate limit delayed
+// it since the last message, and rateLimit is the tightest limit on it in
+// bytes a second. quotaUsed and quota are the user's month so far, present
+// only with a quota. load is the larger of the share of MAX_TUNNELS in use
+// and the host's CPU, from 0 to 1, and overloaded whether the node is
+// turning new tunnels away. Text messages sit outside end-to-end
+// encryption, so a proxy in between can read these numbers.
+const (
+	statsHeader      = "X-Tunnel-Stats"
+	maxStatsInterval = 60
+)
+
+// tunnelStats is what a tunnel that asked for statistics has done so far
+type tunnelStats struct {
+	interval  time.Duration
+	up, down  Metric
+	throttled atomic.Bool
+	// Where the messages go; a resumed multiplexed tunnel moves them to its
+	// new connection
+	ws atomic.Pointer[WSConn]
+}
+
+type statsMessage struct {
+	Type       string  `json:"type"`
+	BytesUp    int64   `json:"bytesUp"`
+	BytesDown  int64   `json:"bytesDown"`
+	Throttled  bool    `json:"throttled"`
+	RateLimit  int64   `json:"rateLimit"`
+	QuotaUsed  *int64  `json:"quotaUsed,omitempty"`
+	Quota      *int64  `json:"quota,omitempty"`
+	Load       float64 `json:"load"`
+	Overloaded bool    `json:"overloaded"`
+}
+
+// negotiateStats reads the client's request for statistics, answering 400
+// for an interval out of range
+func (t *Tunnel) negotiateStats(w http.ResponseWriter, r *http.Request) bool {
+	v := r.Header.Get(statsHeader)
+	if v == "" {
+		return true
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 1 || secs > maxStatsInterval {
+		http.Error(w, "Invalid "+statsHeader, http.StatusBadRequest)
+		return false
+	}
+	// A resumed session's streams go on counting where they were
+	if t.muxResume != nil && t.muxResume.session != nil && t.muxResume.session.stats != nil {
+		t.stats = t.muxResume.session.stats
+		return true
+	}
+	t.stats = &tunnelStats{interval: time.Duration(secs) * time.Second}
+	return true
+}
+
+// sendStats sends the tunnel's statistics every interval until stop is
+// closed or the client can't take them
+func (t *Tunnel) sendStats(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.stats.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		msg, _ := json.Marshal(t.statsMessage())
+		if err := t.stats.ws.Load().WriteText(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (t *Tunnel) statsMessage() statsMessage {
+	m := statsMessage{
+		Type:       "stats",
+		BytesUp:    t.stats.up.Value(),
+		BytesDown:  t.stats.down.Value(),
+		Throttled:  t.stats.throttled.Swap(false),
+		RateLimit:  rateLimits.Tunnel,
+		Load:       nodeLoad(),
+		Overloaded: shedder.Overloaded(),
+	}
+	if t.id != nil {
+		if user := rateLimits.User; user > 0 && (m.RateLimit == 0 || user < m.RateLimit) {
+			m.RateLimit = user
+		}
+		if used, ok := userUsage.Used(t.id); ok {
+			quota := rateLimits.MonthlyQuota
+			m.QuotaUsed, m.Quota = &used, &quota
+		}
+	}
+	return m
+}
+
+// nodeLoad is how busy the node is, from 0 to 1
+func nodeLoad() float64 {
+	load := float64(hostCPUPercent.Value()) / 100
+	if shedder.maxTunnels > 0 {
+		load = max(load, float64(shedder.Active())/float64(shedder.maxTunnels))
+	}
+	return min(load, 1)
+}
+
+// WriteText sends a text message between the tunnel's own messages, unless
+// the node has finished sending
+func (w *WSConn) WriteText(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writeClosed {
+		return errWriteClosed
+	}
+	return w.Conn.WriteMessage(websocket.TextMessage, b)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Address types shared with the SOCKS5 wire format (RFC 1928)
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Largest UDP payload plus the largest header (domain address)
+const maxUDPMessage = 65535 + 4 + 1 + 255 + 2
+
+var errMalformedDatagram = errors.New("malformed datagram")
+
+var (
+	udpRelaysActive      = registry.Gauge("udp_relays_active", "UDP relays currently open")
+	udpDatagramsOut      = registry.Counter("udp_datagrams_sent_total", "UDP datagrams relayed from clients to the internet")
+	udpDatagramsIn       = registry.Counter("udp_datagrams_received_total", "UDP datagrams relayed from the internet to clients")
+	udpDatagramsRejected = registry.Counter("udp_datagrams_rejected_total", "UDP datagrams dropped as malformed or to forbidden destinations")
+)
+
+// UDPRelay gives one client its own UDP socket on the node. Each binary
+// WebSocket message carries one datagram framed like a SOCKS5 UDP request
+// header (RFC 1928 section 7), so a client-side UDP ASSOCIATE can pass them
+// through unchanged.
+//
+// The socket behaves as a full-cone NAT: the client keeps one external port
+// for every destination (endpoint-independent mapping) and any host may send
+// to it (endpoint-independent filtering), which games and WebRTC rely on.
+// The mapping lives until the client has sent nothing for the idle timeout;
+// only outbound traffic refreshes it, so unsolicited inbound packets can't
+// keep it open forever.
+type UDPRelay struct {
+	ws      *websocket.Conn
+	pc      *net.UDPConn
+	timeout time.Duration
+	// Whose traffic this is, for ACLs; nil when authentication is off
+	id  *Identity
+	log *slog.Logger
+
+	lastActive atomic.Int64
+	done       chan struct{}
+}
+
+func udpMappingTimeoutFromEnv() time.Duration {
+	if v := os.Getenv("UDP_MAPPING_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+		slog.Warn("Ignoring invalid UDP_MAPPING_TIMEOUT value", "value", v)
+	}
+	return 5 * time.Minute
+}
+
+func handleUDP(w http.ResponseWriter, r *http.Request) {
+	r = withConnLogger(r, "udp")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		shedder.Release()
+		return
+	}
+
+	lease, err := sessionTracker.Open(id, r)
+	if err != nil {
+		rejectTooManySessions(w, r, id)
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+
+	upgrader := newUpgrader()
+	conn, err := upgrader.Upgrade(w, r, varyHandshake())
+	if err != nil {
+		logFor(r).Warn("WebSocket upgrade failed", "err", err)
+		handshakeFailures.Inc()
+		shedder.Release()
+		tenant.Release()
+		lease.Close()
+		return
+	}
+
+	pc, err := net.ListenUDP("udp", egressFor(id, r).udpAddr())
+	if err != nil {
+		logFor(r).Warn("Failed to open UDP socket", "err", err)
+		conn.Close()
+		shedder.Release()
+		tenant.Release()
+		lease.Close()
+		return
+	}
+	lease.Attach(conn)
+
+	logger := withUser(logFor(r), id).With("local", pc.LocalAddr())
+	logger.Info("New UDP relay")
+	connectionsTotal.Inc()
+	conn.SetReadLimit(maxUDPMessage)
+
+	relay := &UDPRelay{
+		ws:      conn,
+		pc:      pc,
+		timeout: udpMappingTimeoutFromEnv(),
+		id:      id,
+		log:     logger,
+		done:    make(chan struct{}),
+	}
+
+	udpRelaysActive.Add(1)
+	go func() {
+		defer shedder.Release()
+		defer tenant.Release()
+		defer lease.Close()
+		defer udpRelaysActive.Add(-1)
+		relay.run()
+	}()
+}
+
+func (u *UDPRelay) run() {
+	defer u.ws.Close()
+	defer u.pc.Close()
+	defer close(u.done)
+
+	u.touch()
+	go u.readFromNetwork()
+	go u.expire()
+	u.readFromClient()
+}
+
+func (u *UDPRelay) touch() {
+	u.lastActive.Store(time.Now().UnixNano())
+}
+
+func (u *UDPRelay) expire() {
+	ticker := time.NewTicker(u.timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, u.lastActive.Load()))
+			if idle >= u.timeout {
+				u.log.Info("UDP mapping idle, closing", "idle", idle.Round(time.Second))
+				u.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+func (u *UDPRelay) readFromClient() {
+	for {
+		msgType, data, err := u.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+
+		host, port, payload, err := parseUDPDatagram(data)
+		if err != nil {
+			udpDatagramsRejected.Inc()
+			continue
+		}
+
+		var addr *net.UDPAddr
+		if blocklists.hostBlockedBy(host) != "" {
+			err = errBlocklisted
+		} else {
+			addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+		if err != nil || !destinationAllowed(u.id, addr.IP, addr.Port) {
+			udpDatagramsRejected.Inc()
+			if debugLogging() {
+				u.log.Debug("Rejected datagram", "direction", dirUp, "dst", net.JoinHostPort(host, strconv.Itoa(port)), "err", err)
+			}
+			continue
+		}
+
+		if _, err := u.pc.WriteToUDP(payload, addr); err != nil {
+			continue
+		}
+		if debugLogging() {
+			u.log.Debug("Datagram", "direction", dirUp, "bytes", len(payload), "dst", addr)
+		}
+		if !countUsage(u.id, len(payload), u.ws) {
+			return
+		}
+		u.touch()
+		udpDatagramsOut.Inc()
+		bytesFromClients.Add(int64(len(payload)))
+	}
+}
+
+func (u *UDPRelay) readFromNetwork() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !countUsage(u.id, n, u.ws) {
+			return
+		}
+		msg := appendUDPHeader(make([]byte, 0, 22+n), addr)
+		msg = append(msg, buf[:n]...)
+		if err := u.ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			return
+		}
+		udpDatagramsIn.Inc()
+		bytesToClients.Add(int64(n))
+		if debugLogging() {
+			u.log.Debug("Datagram", "direction", dirDown, "bytes", n, "src", addr)
+		}
+	}
+}
+
+// parseUDPDatagram splits a SOCKS5 UDP request into destination and payload.
+// Fragmented datagrams are not supported and are rejected.
+func parseUDPDatagram(b []byte) (host string, port int, payload []byte, err error) {
+	// RSV(2) FRAG(1) ATYP(1)
+	if len(b) < 4 || b[2] != 0 {
+		return "", 0, nil, errMalformedDatagram
+	}
+
+	rest := b[4:]
+	switch b[3] {
+	case atypIPv4:
+		if len(rest) < net.IPv4len+2 {
+			return "", 0, nil, errMalformedDatagram
+		}
+		host = net.IP(rest[:net.IPv4len]).String()
+		rest = rest[net.IPv4len:]
+	case atypIPv6:
+		if len(rest) < net.IPv6len+2 {
+			return "", 0, nil, errMalformedDatagram
+		}
+		host = net.IP(rest[:net.IPv6len]).String()
+		rest = rest[net.IPv6len:]
+	case atypDomain:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 || rest[0] == 0 {
+			return "", 0, nil, errMalformedDatagram
+		}
+		host = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	default:
+		return "", 0, nil, errMalformedDatagram
+	}
+
+	port = int(binary.BigEndian.Uint16(rest))
+	return host, port, rest[2:], nil
+}
+
+// appendUDPHeader appends a SOCKS5 UDP request header naming addr as the
+// source of the datagram that follows.
+func appendUDPHeader(dst []byte, addr *net.UDPAddr) []byte {
+	dst = append(dst, 0, 0, 0)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		dst = append(dst, atypIPv4)
+		dst = append(dst, ip4...)
+	} else {
+		dst = append(dst, atypIPv6)
+		dst = append(dst, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(addr.Port))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Watchdog samples process memory and goroutine counts and puts the node into
+// self-protection before the kernel OOM killer does it for us: new tunnels are
+// refused, a GC is forced and a diagnostic dump is logged. If restarts are
+// enabled the process exits once existing tunnels have drained so the
+// container runtime can bring it back clean.
+type Watchdog struct {
+	maxRSS        uint64
+	maxGoroutines int
+	interval      time.Duration
+	restart       bool
+	drainTimeout  time.Duration
+
+	shedder   *LoadShedder
+	tripped   bool
+	trippedAt time.Time
+	// Unix nanoseconds since the watchdog tripped, 0 when it isn't; for the
+	// liveness probe
+	trippedSince atomic.Int64
+}
+
+// watchdogFromEnv builds a Watchdog from the WATCHDOG_* environment
+// variables. It returns nil if neither threshold is configured.
+func watchdogFromEnv(shedder *LoadShedder) *Watchdog {
+	w := &Watchdog{
+		interval:     15 * time.Second,
+		drainTimeout: 5 * time.Minute,
+		restart:      os.Getenv("WATCHDOG_RESTART") == "true",
+		shedder:      shedder,
+	}
+
+	if v := os.Getenv("WATCHDOG_MAX_RSS_MB"); v != "" {
+		mb, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring invalid WATCHDOG_MAX_RSS_MB value", "value", v)
+		} else {
+			w.maxRSS = mb << 20
+		}
+	}
+	if v := os.Getenv("WATCHDOG_MAX_GOROUTINES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			slog.Warn("Ignoring invalid WATCHDOG_MAX_GOROUTINES value", "value", v)
+		} else {
+			w.maxGoroutines = n
+		}
+	}
+	if v := os.Getenv("WATCHDOG_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			slog.Warn("Ignoring invalid WATCHDOG_INTERVAL value", "value", v)
+		} else {
+			w.interval = time.Duration(secs) * time.Second
+		}
+	}
+	if v := os.Getenv("WATCHDOG_DRAIN_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			slog.Warn("Ignoring invalid WATCHDOG_DRAIN_TIMEOUT value", "value", v)
+		} else {
+			w.drainTimeout = time.Duration(secs) * time.Second
+		}
+	}
+
+	if w.maxRSS == 0 && w.maxGoroutines == 0 {
+		return nil
+	}
+	return w
+}
+
+func (w *Watchdog) Run() {
+	slog.Info("Resource watchdog enabled", "max_rss_mb", w.maxRSS>>20, "max_goroutines", w.maxGoroutines, "restart", w.restart)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.check()
+	}
+}
+
+func (w *Watchdog) check() {
+	rss := readRSS()
+	goroutines := runtime.NumGoroutine()
+
+	over := (w.maxRSS > 0 && rss > w.maxRSS) ||
+		(w.maxGoroutines > 0 && goroutines > w.maxGoroutines)
+
+	if !w.tripped {
+		if over {
+			w.trip(rss, goroutines)
+		}
+		return
+	}
+
+	if w.restart {
+		w.drainAndExit()
+		return
+	}
+
+	// Recover once both readings have come back below 80% of their limits
+	if (w.maxRSS == 0 || rss < w.maxRSS/10*8) &&
+		(w.maxGoroutines == 0 || goroutines < w.maxGoroutines/10*8) {
+		slog.Info("Watchdog recovered, accepting new tunnels", "rss_mb", rss>>20, "goroutines", goroutines)
+		w.tripped = false
+		w.trippedSince.Store(0)
+		w.shedder.Unhold()
+	}
+}
+
+func (w *Watchdog) trip(rss uint64, goroutines int) {
+	slog.Warn("Watchdog tripped, refusing new tunnels", "rss_mb", rss>>20, "goroutines", goroutines)
+	w.tripped = true
+	w.trippedAt = time.Now()
+	w.trippedSince.Store(w.trippedAt.UnixNano())
+	w.shedder.Hold()
+
+	debug.FreeOSMemory()
+	logDiagnostics()
+}
+
+func (w *Watchdog) drainAndExit() {
+	active := w.shedder.Active()
+	if active > 0 && time.Since(w.trippedAt) < w.drainTimeout {
+		slog.Warn("Watchdog waiting for tunnels to drain before restart", "tunnels", active)
+		return
+	}
+	slog.Warn("Watchdog restarting server", "tunnels", active)
+	os.Exit(1)
+}
+
+// Healthy fails once the watchdog has been tripped for longer than the drain
+// timeout without recovering, so an orchestrator can restart the node even
+// when WATCHDOG_RESTART is off.
+func (w *Watchdog) Healthy() error {
+	since := w.trippedSince.Load()
+	if since == 0 {
+		return nil
+	}
+	if stuck := time.Since(time.Unix(0, since)); stuck > w.drainTimeout {
+		return fmt.Errorf("tripped %s ago and not recovering", stuck.Round(time.Second))
+	}
+	return nil
+}
+
+// readRSS returns the resident set size of the process. On Linux it is read
+// from /proc; elsewhere the memory obtained from the OS by the Go runtime is
+// used as an approximation.
+func readRSS() uint64 {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) >= 2 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys
+}
+
+func logDiagnostics() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	slog.Info("Diagnostics", "heap_alloc_mb", m.HeapAlloc>>20, "heap_sys_mb", m.HeapSys>>20,
+		"heap_objects", m.HeapObjects, "num_gc", m.NumGC, "goroutines", runtime.NumGoroutine())
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		slog.Warn("Failed to collect goroutine profile", "err", err)
+		return
+	}
+	slog.Info("Goroutine profile", "profile", buf.String())
+}
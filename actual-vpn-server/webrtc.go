@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v3"
+)
+
+// Browsers that can't keep a WebSocket open (or want better NAT traversal)
+// can tunnel over a WebRTC data channel instead. Signaling is a single HTTP
+// exchange: the browser POSTs its offer to /webrtc/offer once ICE gathering
+// is complete and gets back a complete answer. The first data channel the
+// browser opens becomes the tunnel.
+
+// Time a peer has to open its data channel after signaling
+const webrtcOpenTimeout = 30 * time.Second
+
+var webrtcAPI = newWebRTCAPI()
+
+func newWebRTCAPI() *webrtc.API {
+	settings := webrtc.SettingEngine{}
+	// Detached channels give us plain Read/Write instead of callbacks
+	settings.DetachDataChannels()
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+}
+
+// webrtcICEServers reads WEBRTC_ICE_SERVERS, a comma-separated list of
+// stun:/turn: URLs.
+func webrtcICEServers() []webrtc.ICEServer {
+	v := os.Getenv("WEBRTC_ICE_SERVERS")
+	if v == "" {
+		v = "stun:stun.l.google.com:19302"
+	}
+
+	var urls []string
+	for _, u := range strings.Split(v, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return []webrtc.ICEServer{{URLs: urls}}
+}
+
+// dataChannelConn adapts a detached data channel to Conn. Data channel reads
+// fail if the caller's buffer is smaller than the message, so whole messages
+// are read into an internal buffer and handed out in pieces.
+type dataChannelConn struct {
+	rwc     datachannel.ReadWriteCloser
+	pc      *webrtc.PeerConnection
+	buf     []byte
+	pending []byte
+}
+
+func (c *dataChannelConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.rwc.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.buf[:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *dataChannelConn) Write(b []byte) (int, error) {
+	return c.rwc.Write(b)
+}
+
+func (c *dataChannelConn) Close() error {
+	err := c.rwc.Close()
+	c.pc.Close()
+	return err
+}
+
+func handleWebRTCOffer(w http.ResponseWriter, r *http.Request) {
+	if !originAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Browsers send a CORS preflight because the offer is JSON
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	w.Header().Set("Vary", "Origin")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r = withConnLogger(r, "webrtc")
+	id, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !shedder.Acquire() {
+		logFor(r).Warn("Shedding connection: server overloaded")
+		connectionsShed.Inc()
+		shedder.Reject(w)
+		return
+	}
+
+	tenant := id.tenantOf()
+	if !tenant.Acquire() {
+		rejectTenantQuota(w, r, id)
+		shedder.Release()
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		shedder.Release()
+		tenant.Release()
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	lease, err := sessionTracker.Open(id, r)
+	if err != nil {
+		rejectTooManySessions(w, r, id)
+		shedder.Release()
+		tenant.Release()
+		return
+	}
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			shedder.Release()
+			tenant.Release()
+			lease.Close()
+		})
+	}
+
+	pc, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{ICEServers: webrtcICEServers()})
+	if err != nil {
+		logFor(r).Warn("Failed to create peer connection", "err", err)
+		release()
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	lease.Attach(pc)
+
+	var startOnce sync.Once
+	started := make(chan struct{})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() {
+			first := false
+			startOnce.Do(func() { first = true })
+			if !first {
+				// One tunnel per peer connection
+				dc.Close()
+				return
+			}
+			close(started)
+
+			rwc, err := dc.Detach()
+			if err != nil {
+				logFor(r).Warn("Failed to detach data channel", "err", err)
+				pc.Close()
+				release()
+				return
+			}
+
+			conn := &dataChannelConn{rwc: rwc, pc: pc, buf: make([]byte, 64<<10)}
+			// Relays to the destination the client names, like the WebSocket tunnel
+			tunnel := &Tunnel{localConn: conn, remoteConn: conn, id: id, egress: egressFor(id, r), log: withUser(logFor(r), id)}
+			tunnel.log.Info("New tunnel")
+			connectionsTotal.Inc()
+
+			tunnelsActive.Add(1)
+			go func() {
+				defer release()
+				defer tunnelsActive.Add(-1)
+				tunnel.handleConnection()
+			}()
+		})
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			pc.Close()
+		}
+	})
+
+	// Give up on peers that never open a channel
+	go func() {
+		select {
+		case <-started:
+		case <-time.After(webrtcOpenTimeout):
+			pc.Close()
+			release()
+		}
+	}()
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		pc.Close()
+		release()
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		release()
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		release()
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	<-gatherComplete
+
+	addHeaders(w, varyHandshake())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pc.LocalDescription())
+}
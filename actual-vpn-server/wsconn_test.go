@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSConn is a byte stream over messages: a message larger than the buffer
+// Read is given comes out over several Reads, none of it lost.
+
+// wsPair returns a WSConn reading what the returned client connection sends
+func wsPair(t *testing.T) (*WSConn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := <-accepted
+	conn.SetReadLimit(maxTunnelMessage)
+	t.Cleanup(func() { conn.Close() })
+	return &WSConn{Conn: conn}, client
+}
+
+func TestWSConnReadSmallBuffers(t *testing.T) {
+	w, client := wsPair(t)
+	sizes := []int{1, 64 << 10, 64<<10 + 1, 200 << 10, int(maxTunnelMessage)}
+	var want bytes.Buffer
+	var msgs [][]byte
+	for _, size := range sizes {
+		msg := make([]byte, size)
+		testPattern(msg, want.Len())
+		want.Write(msg)
+		msgs = append(msgs, msg)
+	}
+	go func() {
+		for _, msg := range msgs {
+			if err := client.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+		client.WriteMessage(websocket.BinaryMessage, nil)
+	}()
+
+	var got bytes.Buffer
+	buf := make([]byte, 1000)
+	for {
+		// An empty read is a no-op, not a message skipped
+		if n, err := w.Read(buf[:0]); n != 0 || err != nil {
+			t.Fatalf("empty Read returned %d, %v", n, err)
+		}
+		n, err := w.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("after %d bytes: %v", got.Len(), err)
+		}
+		if n == 0 {
+			t.Fatal("Read returned no data and no error")
+		}
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("read %d bytes that differ from the %d sent", got.Len(), want.Len())
+	}
+	if n, err := w.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read after the end returned %d, %v", n, err)
+	}
+}
+
+// Large messages go through the node's relay intact, over copy buffers far
+// smaller than they are
+func TestWSConnLargeMessagesEcho(t *testing.T) {
+	node := startTestNode(t)
+	for _, size := range []int{64 << 10, 64<<10 + 1, 256 << 10, int(maxTunnelMessage)} {
+		conn := mustDial(t, node, testTransports[1]).(*wsClientConn)
+		data := make([]byte, size)
+		testPattern(data, 0)
+		go func() {
+			if err := conn.conn.WriteMessage(websocket.BinaryMessage, data); err == nil {
+				conn.conn.WriteMessage(websocket.BinaryMessage, nil)
+			}
+		}()
+
+		conn.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		echoed, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%d byte message: after %d bytes: %v", size, len(echoed), err)
+		}
+		if !bytes.Equal(echoed, data) {
+			t.Fatalf("%d byte message: echoed %d bytes that differ", size, len(echoed))
+		}
+	}
+}
+
+func TestWSConnMessageTooLarge(t *testing.T) {
+	w, client := wsPair(t)
+	go client.WriteMessage(websocket.BinaryMessage, make([]byte, maxTunnelMessage+1))
+
+	buf := make([]byte, 32<<10)
+	var err error
+	for err == nil {
+		_, err = w.Read(buf)
+	}
+	if err != websocket.ErrReadLimit {
+		t.Fatalf("reading an oversized message returned %v, want %v", err, websocket.ErrReadLimit)
+	}
+
+	// The sender hears why
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("client got %v, want a close with code %d", err, websocket.CloseMessageTooBig)
+	}
+}
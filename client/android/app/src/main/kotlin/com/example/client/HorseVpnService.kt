@@ -1,9 +1,13 @@
 package com.example.client
 
+import android.content.Context
+import android.net.IpPrefix
 import android.net.VpnService
+import android.os.Build
 import android.os.ParcelFileDescriptor
 import java.io.FileInputStream
 import java.io.FileOutputStream
+import java.net.InetAddress
 import java.net.InetSocketAddress
 import java.nio.ByteBuffer
 import java.nio.channels.SocketChannel
@@ -11,16 +15,60 @@ import java.nio.channels.SocketChannel
 class HorseVpnService : VpnService() {
 
     private var vpnInterface: ParcelFileDescriptor? = null
+    private var discovery = "lan"
 
     override fun onStartCommand(intent: android.content.Intent?, flags: Int, startId: Int): Int {
-        val route = intent?.getStringExtra("route") ?: return START_NOT_STICKY
+        // When started as the always-on VPN (at boot or after being killed)
+        // the system sends no route, so reuse the last one the app gave us
+        val prefs = getSharedPreferences("horsevpn", Context.MODE_PRIVATE)
+        val route = intent?.getStringExtra("route")?.takeIf { it.isNotEmpty() }
+            ?.also { prefs.edit().putString("route", it).apply() }
+            ?: prefs.getString("route", null)
+        if (route == null) {
+            stopSelf()
+            return START_NOT_STICKY
+        }
+
+        // DNS settings pushed in the sync server's config bundle, saved like
+        // the route for always-on starts
+        intent?.getStringArrayListExtra("dnsServers")?.let {
+            prefs.edit()
+                .putString("dnsServers", it.joinToString(","))
+                .putString("searchDomains", intent.getStringArrayListExtra("searchDomains").orEmpty().joinToString(","))
+                .apply()
+        }
+        val dnsServers = prefs.getString("dnsServers", "").orEmpty().split(",").filter { it.isNotEmpty() }
+            .ifEmpty { listOf("8.8.8.8") }
+        val searchDomains = prefs.getString("searchDomains", "").orEmpty().split(",").filter { it.isNotEmpty() }
+        if (intent?.hasExtra("blockIpv6") == true) {
+            prefs.edit().putBoolean("blockIpv6", intent.getBooleanExtra("blockIpv6", false)).apply()
+        }
+        val blockIpv6 = prefs.getBoolean("blockIpv6", false)
+        intent?.getStringExtra("discovery")?.let { prefs.edit().putString("discovery", it).apply() }
+        discovery = prefs.getString("discovery", null) ?: "lan"
 
         // Start VPN
         val builder = Builder()
             .addAddress("10.0.0.2", 24)
             .addRoute("0.0.0.0", 0)
-            .addDnsServer("8.8.8.8")
             .setSession("HorseVPN")
+        // The tunnel carries IPv4 only. Taking IPv6 into the interface too
+        // keeps it from going around the VPN; the node drops those packets, so
+        // applications fall back to IPv4.
+        if (blockIpv6) {
+            builder.addAddress("fd68:7673:6e::2", 64)
+                .addRoute("::", 0)
+        }
+        // mDNS and LLMNR stay on the local network, for printers and casting.
+        // Before Android 13 routes can't be excluded, and they are dropped
+        // as with block.
+        if (discovery == "lan" && Build.VERSION.SDK_INT >= Build.VERSION_CODES.TIRAMISU) {
+            discoveryGroups.filter { blockIpv6 || it.size == 4 }.forEach {
+                builder.excludeRoute(IpPrefix(InetAddress.getByAddress(it), it.size * 8))
+            }
+        }
+        dnsServers.forEach { builder.addDnsServer(it) }
+        searchDomains.forEach { builder.addSearchDomain(it) }
 
         vpnInterface = builder.establish()
 
@@ -60,6 +108,9 @@ class HorseVpnService : VpnService() {
             try {
                 while (true) {
                     val length = inputStream.read(buffer.array())
+                    if (length > 0 && discovery != "tunnel" && isDiscovery(buffer.array(), length)) {
+                        continue
+                    }
                     if (length > 0) {
                         buffer.limit(length)
                         channel.write(buffer)
@@ -87,8 +138,30 @@ class HorseVpnService : VpnService() {
         }.start()
     }
 
+    // Whether packet is UDP to an mDNS or LLMNR group and port
+    private fun isDiscovery(packet: ByteArray, length: Int): Boolean {
+        val version = packet[0].toInt() shr 4
+        val (dst, payload) = when {
+            version == 4 && length >= 20 && packet[9].toInt() == 17 ->
+                packet.copyOfRange(16, 20) to (packet[0].toInt() and 0x0f) * 4
+            version == 6 && length >= 40 && packet[6].toInt() == 17 ->
+                packet.copyOfRange(24, 40) to 40
+            else -> return false
+        }
+        if (length < payload + 4) return false
+        val port = (packet[payload + 2].toInt() and 0xff) shl 8 or (packet[payload + 3].toInt() and 0xff)
+        return discoveryGroups.indexOfFirst { it.contentEquals(dst) }.let { it >= 0 && port == discoveryPorts[it] }
+    }
+
     override fun onDestroy() {
         vpnInterface?.close()
         super.onDestroy()
     }
+
+    companion object {
+        // mDNS (224.0.0.251, ff02::fb) and LLMNR (224.0.0.252, ff02::1:3)
+        private val discoveryGroups = listOf("224.0.0.251", "ff02::fb", "224.0.0.252", "ff02::1:3")
+            .map { InetAddress.getByName(it).address }
+        private val discoveryPorts = listOf(5353, 5353, 5355, 5355)
+    }
 }
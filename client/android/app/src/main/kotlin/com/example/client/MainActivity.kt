@@ -9,6 +9,13 @@ import io.flutter.plugin.common.MethodChannel
 
 class MainActivity : FlutterActivity() {
     private val CHANNEL = "horsevpn"
+    // From the sync server's config bundle, if it sets any
+    private var dnsServers: List<String> = emptyList()
+    private var searchDomains: List<String> = emptyList()
+    // HORSEVPN_IPV6=block
+    private var blockIpv6 = false
+    // HORSEVPN_DISCOVERY: lan, block or tunnel
+    private var discovery = "lan"
 
     override fun configureFlutterEngine(flutterEngine: FlutterEngine) {
         super.configureFlutterEngine(flutterEngine)
@@ -16,6 +23,10 @@ class MainActivity : FlutterActivity() {
             if (call.method == "startVPN") {
                 val route = call.argument<String>("route")
                 if (route != null) {
+                    dnsServers = call.argument<List<String>>("dnsServers") ?: emptyList()
+                    searchDomains = call.argument<List<String>>("searchDomains") ?: emptyList()
+                    blockIpv6 = call.argument<Boolean>("blockIpv6") ?: false
+                    discovery = call.argument<String>("discovery") ?: "lan"
                     startVpnService(route)
                     result.success("VPN started")
                 } else {
@@ -34,20 +45,26 @@ class MainActivity : FlutterActivity() {
             startActivityForResult(intent, 0)
         } else {
             // Permission granted, start service
-            val serviceIntent = Intent(this, HorseVpnService::class.java)
-            serviceIntent.putExtra("route", route)
-            startService(serviceIntent)
+            startService(serviceIntent(route))
         }
     }
 
+    private fun serviceIntent(route: String): Intent {
+        val serviceIntent = Intent(this, HorseVpnService::class.java)
+        serviceIntent.putExtra("route", route)
+        serviceIntent.putStringArrayListExtra("dnsServers", ArrayList(dnsServers))
+        serviceIntent.putStringArrayListExtra("searchDomains", ArrayList(searchDomains))
+        serviceIntent.putExtra("blockIpv6", blockIpv6)
+        serviceIntent.putExtra("discovery", discovery)
+        return serviceIntent
+    }
+
     override fun onActivityResult(requestCode: Int, resultCode: Int, data: Intent?) {
         super.onActivityResult(requestCode, resultCode, data)
         if (requestCode == 0 && resultCode == RESULT_OK) {
             // Permission granted, start service
             val route = data?.getStringExtra("route") ?: ""
-            val serviceIntent = Intent(this, HorseVpnService::class.java)
-            serviceIntent.putExtra("route", route)
-            startService(serviceIntent)
+            startService(serviceIntent(route))
         }
     }
 }
@@ -0,0 +1,478 @@
+import 'dart:convert';
+import 'dart:io';
+import 'package:client/companion_api.dart';
+import 'package:client/messages.dart';
+import 'package:client/preflight.dart';
+
+// Command line for a running desktop client, through its companion API:
+// on the control socket ~/.horsevpn/control.sock where there is one, and
+// otherwise on the loopback port with the token in
+// ~/.horsevpn/companion-token.
+//
+//   horsevpn status [--quiet | --json]
+//   horsevpn connect [--quiet | --json]
+//   horsevpn up [--quiet | --json]
+//   horsevpn down [--quiet | --json]
+//   horsevpn switch-server [<location> | --auto] [--quiet | --json]
+//   horsevpn rotate [--quiet | --json]
+//   horsevpn devices [--json]
+//   horsevpn devices revoke <id> [--json]
+//   horsevpn config effective [--json]
+//   horsevpn preflight [--json]
+//   horsevpn leakcheck [--json]
+//   horsevpn transparency [--json]
+//
+// Run it with `dart run client:horsevpn` from the client directory.
+//
+// The exit status is one of the codes below whatever the command, so
+// scripts and monitoring can act on it without reading the output. With
+// --quiet, status and connect print a single line that doesn't change with
+// the language: the state, then key=value pairs, e.g.
+//
+//   connected location=Netherlands route=wss://node.example/ws active=2
+const String usage = 'Usage: horsevpn status [--quiet | --json]\n'
+    '       horsevpn connect [--quiet | --json]\n'
+    '       horsevpn up [--quiet | --json]\n'
+    '       horsevpn down [--quiet | --json]\n'
+    '       horsevpn switch-server [<location> | --auto] [--quiet | --json]\n'
+    '       horsevpn rotate [--quiet | --json]\n'
+    '       horsevpn devices [--json]\n'
+    '       horsevpn devices revoke <id> [--json]\n'
+    '       horsevpn config effective [--json]\n'
+    '       horsevpn preflight [--json]\n'
+    '       horsevpn leakcheck [--json]\n'
+    '       horsevpn transparency [--json]';
+
+// Connected, or the command did what was asked
+const int exitOk = 0;
+// The command failed, e.g. connecting or preflight went wrong
+const int exitFailed = 1;
+// The client runs but has no route; it connects on next use
+const int exitDisconnected = 3;
+// The client is paused on a trusted network
+const int exitPaused = 4;
+// leakcheck found that traffic through the tunnel gives the user away
+const int exitLeak = 5;
+// The transparency statement is past the date the next one was due
+const int exitStale = 6;
+// The VPN is down after `horsevpn down`
+const int exitDown = 7;
+const int exitUsage = 64;
+// The client isn't running, or its companion API can't be reached
+const int exitUnavailable = 69;
+
+Future<void> main(List<String> args) async {
+  await Messages.load();
+  final asJson = args.contains('--json');
+  final quiet = args.contains('--quiet');
+  final words = args.where((a) => !a.startsWith('--')).toList();
+  final command = words.join(' ');
+  if (words.firstOrNull == 'switch-server') {
+    final location = words.skip(1).join(' ');
+    final auto = args.contains('--auto');
+    if (auto && location.isNotEmpty) {
+      stderr.writeln(usage);
+      exit(exitUsage);
+    }
+    return switchServer(location.isEmpty ? null : location, auto: auto, quiet: quiet, asJson: asJson);
+  }
+  if (words.length == 3 && words[0] == 'devices' && words[1] == 'revoke') {
+    return revokeDevice(words[2], asJson);
+  }
+  switch (command) {
+    case 'status':
+      return status(quiet: quiet, asJson: asJson);
+    case 'connect':
+      return connect(quiet: quiet, asJson: asJson);
+    case 'up':
+      return control('/v1/up', quiet: quiet, asJson: asJson);
+    case 'down':
+      return control('/v1/down', quiet: quiet, asJson: asJson);
+    case 'rotate':
+      return rotate(quiet: quiet, asJson: asJson);
+    case 'devices':
+      return devices(asJson);
+    case 'preflight':
+      return preflight(asJson);
+    case 'leakcheck':
+      return leakcheck(asJson);
+    case 'transparency':
+      return transparency(asJson);
+    case 'config effective':
+      return configEffective(asJson);
+  }
+  stderr.writeln(usage);
+  exit(exitUsage);
+}
+
+// Prints whether the client is connected and exits with the matching code
+Future<void> status({required bool quiet, required bool asJson}) async {
+  final Map<String, dynamic> current;
+  final Map<String, dynamic> stats;
+  try {
+    current = await _request('GET', '/v1/status');
+    stats = await _request('GET', '/v1/stats');
+  } catch (e) {
+    _failed(quiet, e);
+  }
+  _report({...current, ...stats}, quiet: quiet, asJson: asJson);
+}
+
+// Has the client connect now rather than on next use, then reports like
+// status
+Future<void> connect({required bool quiet, required bool asJson}) async {
+  final Map<String, dynamic> current;
+  final Map<String, dynamic> stats;
+  try {
+    current = await _request('POST', '/v1/connect');
+    stats = await _request('GET', '/v1/stats');
+  } catch (e) {
+    _failed(quiet, e);
+  }
+  _report({...current, ...stats}, quiet: quiet, asJson: asJson);
+}
+
+// Brings the VPN up or down without restarting the client, then reports
+// like status. down exits with 0 once the VPN is down.
+Future<void> control(String path, {required bool quiet, required bool asJson}) async {
+  final Map<String, dynamic> current;
+  final Map<String, dynamic> stats;
+  try {
+    current = await _request('POST', path);
+    stats = await _request('GET', '/v1/stats');
+  } catch (e) {
+    _failed(quiet, e);
+  }
+  _report({...current, ...stats}, quiet: quiet, asJson: asJson, downOk: path == '/v1/down');
+}
+
+// Has the client drop its tunnels and take a new route: in location from
+// now on if given, where geolocation puts it with auto, and otherwise in
+// the location it has, without looking that up again
+Future<void> switchServer(String? location, {required bool auto, required bool quiet, required bool asJson}) async {
+  final Map<String, dynamic> current;
+  final Map<String, dynamic> stats;
+  try {
+    current = await _request('POST', '/v1/switch-server', payload: {
+      if (location != null) 'location': location,
+      if (auto) 'auto': true,
+    });
+    stats = await _request('GET', '/v1/stats');
+  } catch (e) {
+    _failed(quiet, e);
+  }
+  _report({...current, ...stats}, quiet: quiet, asJson: asJson);
+}
+
+// Asks for another exit address: from the same node, which a multiplexed
+// tunnel can move to without reconnecting, or else from another server in
+// the same location. Then reports like status, with the new addresses in
+// egress, null for a new server.
+Future<void> rotate({required bool quiet, required bool asJson}) async {
+  final Map<String, dynamic> current;
+  final Map<String, dynamic> stats;
+  try {
+    current = await _request('POST', '/v1/rotate');
+    stats = await _request('GET', '/v1/stats');
+  } catch (e) {
+    _failed(quiet, e);
+  }
+  if (!quiet && !asJson) {
+    final egress = current['egress'] as List?;
+    print(egress == null ? tr('cli.rotatedServer') : tr('cli.rotated', {'egress': egress.join(', ')}));
+  }
+  _report({...current, ...stats}, quiet: quiet, asJson: asJson);
+}
+
+// Lists the devices that have used our dedicated IP reservation
+Future<void> devices(bool asJson) async {
+  final Map<String, dynamic> body;
+  try {
+    body = await _request('GET', '/v1/devices');
+  } catch (e) {
+    stderr.writeln(tr('cli.devicesFailed', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(body));
+    return;
+  }
+  final devices = body['devices'] as List;
+  if (devices.isEmpty) {
+    print(tr('cli.devices.none'));
+    return;
+  }
+  print('${tr('cli.devices.device').padRight(34)} ${tr('cli.devices.name').padRight(24)} ${tr('cli.devices.lastSeen')}');
+  for (final device in devices) {
+    final lastSeen = DateTime.fromMillisecondsSinceEpoch(device['lastSeen'] as int).toLocal().toString().substring(0, 16);
+    final note = device['revoked'] == true
+        ? tr('cli.devices.revoked')
+        : (device['current'] == true ? tr('cli.devices.current') : '');
+    print('${(device['deviceId'] as String).padRight(34)} ${(device['name'] as String).padRight(24)} $lastSeen $note'
+        .trimRight());
+  }
+}
+
+// Revokes one of our reservation's devices, e.g. a lost laptop
+Future<void> revokeDevice(String id, bool asJson) async {
+  final Map<String, dynamic> body;
+  try {
+    body = await _request('DELETE', '/v1/devices/${Uri.encodeComponent(id)}');
+  } catch (e) {
+    stderr.writeln(tr('cli.devicesFailed', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(body));
+  } else {
+    print(tr('cli.deviceRevoked', {'id': id}));
+  }
+}
+
+Never _failed(bool quiet, Object e) {
+  final unavailable = e is SocketException || e is FileSystemException;
+  if (quiet) {
+    print('${unavailable ? 'unavailable' : 'failed'} error=${jsonEncode('$e')}');
+  } else {
+    stderr.writeln(unavailable ? tr('cli.unreachable', {'error': e}) : tr('status.error', {'error': e}));
+  }
+  exit(unavailable ? exitUnavailable : exitFailed);
+}
+
+void _report(Map<String, dynamic> status, {required bool quiet, required bool asJson, bool downOk = false}) {
+  final state = status['state'] as String;
+  final code = switch (state) {
+    'connected' => exitOk,
+    'paused' => exitPaused,
+    'down' => downOk ? exitOk : exitDown,
+    _ => exitDisconnected,
+  };
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(status));
+  } else if (quiet) {
+    final server = status['server'] as Map<String, dynamic>?;
+    final fields = {
+      'location': status['location'],
+      'pinned': status['pinnedLocation'] ?? '',
+      'route': status['route'],
+      'active': status['activeConnections'],
+      'load': server == null ? '' : _percent(server['load']),
+      'throttled': server?['throttled'] == true ? 'true' : '',
+      'announcement': (status['announcement'] as Map<String, dynamic>?)?['severity'] ?? '',
+      'always-on': status['alwaysOn'] == true ? (status['firewallBlocking'] == true ? 'blocking' : 'unenforced') : '',
+    };
+    print([
+      state,
+      for (final f in fields.entries)
+        if ('${f.value}'.isNotEmpty) '${f.key}=${f.value}',
+    ].join(' '));
+  } else {
+    print(tr('cli.state.$state'));
+    if (status['alwaysOn'] == true) {
+      print(tr(status['firewallBlocking'] == true ? 'cli.alwaysOn' : 'cli.alwaysOnUnenforced'));
+    }
+    final announcement = status['announcement'] as Map<String, dynamic>?;
+    if (announcement != null) {
+      print(tr('ui.announcement.${announcement['severity']}', {'message': announcement['message']}));
+    }
+    final blocked = status['blocked'] as Map<String, dynamic>?;
+    if (blocked != null) {
+      print(tr('cli.blocked', {'host': blocked['host'], 'policy': blocked['policy'], 'reason': blocked['reason']}));
+    }
+    if ((status['location'] as String).isNotEmpty) print(tr('ui.location', {'location': status['location']}));
+    if (status['pinnedLocation'] != null) print(tr('cli.pinnedLocation', {'location': status['pinnedLocation']}));
+    if ((status['route'] as String).isNotEmpty) print(tr('ui.route', {'route': status['route']}));
+    print(tr('cli.connections', {'active': status['activeConnections'], 'total': status['totalConnections']}));
+    final server = status['server'] as Map<String, dynamic>?;
+    if (server != null) _reportServer(server);
+  }
+  exit(code);
+}
+
+// Prints the node's latest statistics about the client's tunnels
+void _reportServer(Map<String, dynamic> server) {
+  print(tr(server['overloaded'] == true ? 'cli.serverOverloaded' : 'cli.serverLoad', {'load': _percent(server['load'])}));
+  final rateLimit = server['rateLimit'] as int;
+  if (rateLimit > 0) {
+    print(tr(server['throttled'] == true ? 'cli.throttled' : 'cli.rateLimit', {'rate': _bytes(rateLimit)}));
+  }
+  if (server['quota'] != null) {
+    print(tr('cli.quota', {'used': _bytes(server['quotaUsed'] as int), 'quota': _bytes(server['quota'] as int)}));
+  }
+}
+
+String _percent(Object? fraction) => '${((fraction as num) * 100).round()}%';
+
+String _bytes(int n) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  var value = n.toDouble();
+  var unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit++;
+  }
+  return '${unit == 0 ? n : value.toStringAsFixed(1)} ${units[unit]}';
+}
+
+Future<void> configEffective(bool asJson) async {
+  final Map<String, dynamic> config;
+  try {
+    config = await _request('GET', '/v1/config/effective');
+  } catch (e) {
+    stderr.writeln(tr('cli.unreachable', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(config));
+    return;
+  }
+  for (final name in ['tunnelByDefault', 'killSwitch', 'allowLan', 'dnsServers', 'searchDomains', 'malwareProtection',
+      'parentalControls']) {
+    final setting = config[name] as Map<String, dynamic>;
+    final value = switch (setting['value']) {
+      List list => list.isEmpty ? tr('cli.system') : list.join(', '),
+      Map profile => profile['name'],
+      null => tr('cli.noProfile'),
+      final v => v,
+    };
+    print('${name.padRight(18)} ${'$value'.padRight(24)} ${setting['source']}');
+  }
+  final rules = config['rules'] as List;
+  print('');
+  print(tr(rules.isEmpty ? 'cli.noRules' : 'cli.rules'));
+  for (final rule in rules) {
+    print('  ${(rule['site'] as String).padRight(32)} ${(rule['action'] as String).padRight(7)} ${rule['source']}');
+    for (final overridden in (rule['overrides'] as List? ?? [])) {
+      print('  ${''.padRight(32)} ${tr('cli.overrides', {'action': overridden['action'], 'source': overridden['source']})}');
+    }
+  }
+}
+
+// Checks every transport to every candidate server from this network and
+// prints which got through, one row per server
+Future<void> preflight(bool asJson) async {
+  final Map<String, dynamic> body;
+  try {
+    body = await _request('POST', '/v1/preflight');
+  } catch (e) {
+    stderr.writeln(tr('cli.preflightFailed', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(body));
+    return;
+  }
+  final results = body['results'] as List;
+  if (results.isEmpty) {
+    print(tr('cli.noCandidates'));
+    return;
+  }
+  print('${tr('cli.server').padRight(24)} ${tr('cli.location').padRight(16)} '
+      '${preflightTransports.map((t) => t.padRight(12)).join(' ')}');
+  final errors = <String>[];
+  for (final result in results) {
+    final id = (result['id'] as String).isEmpty ? result['url'] as String : result['id'] as String;
+    final cells = preflightTransports.map((t) {
+      final check = result['checks'][t];
+      if (check == null) return '-'.padRight(12);
+      if (check['ok'] != true) errors.add('$id $t: ${check['error']}');
+      return (check['ok'] == true ? '${check['ms']}ms' : 'FAIL').padRight(12);
+    });
+    print('${id.padRight(24)} ${(result['location'] as String).padRight(16)} ${cells.join(' ')}');
+  }
+  if (errors.isNotEmpty) {
+    print('');
+    errors.forEach(print);
+  }
+}
+
+// Checks that sites see the tunnel's address and resolvers rather than
+// ours, and what else could give us away, with a fix for each problem
+Future<void> leakcheck(bool asJson) async {
+  final Map<String, dynamic> body;
+  try {
+    body = await _request('POST', '/v1/leakcheck');
+  } catch (e) {
+    stderr.writeln(tr('cli.leakcheckFailed', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(body));
+  } else {
+    for (final finding in body['findings'] as List) {
+      final key = 'leak.${finding['check']}.${finding['outcome']}';
+      final args = (finding['args'] as Map<String, dynamic>).cast<String, Object?>();
+      print('${'[${finding['level']}]'.padRight(10)} ${tr(key, args)}');
+      if (Messages.current.has('$key.fix')) {
+        print('${''.padRight(10)} ${tr('cli.fix', {'fix': tr('$key.fix', args)})}');
+      }
+    }
+  }
+  if (body['level'] == 'leak') exit(exitLeak);
+}
+
+// Prints the operator's transparency statement once it verifies, warning
+// when the next one is overdue
+Future<void> transparency(bool asJson) async {
+  final Map<String, dynamic> body;
+  try {
+    body = await _request('GET', '/v1/transparency');
+  } catch (e) {
+    stderr.writeln(tr('cli.transparencyFailed', {'error': e}));
+    exit(e is SocketException || e is FileSystemException ? exitUnavailable : exitFailed);
+  }
+
+  final statement = body['statement'] as Map<String, dynamic>?;
+  if (asJson) {
+    print(const JsonEncoder.withIndent('  ').convert(body));
+  } else if (statement == null) {
+    print(tr('cli.transparency.none'));
+  } else {
+    String date(String key) => DateTime.parse(statement[key] as String).toLocal().toString().substring(0, 16);
+    print(tr('cli.transparency.issued', {'sequence': statement['sequence'], 'issued': date('issuedAt')}));
+    print('');
+    print(statement['statement']);
+    print('');
+    print(tr(statement['stale'] == true ? 'cli.transparency.stale' : 'cli.transparency.nextUpdate', {'date': date('nextUpdate')}));
+  }
+  if (statement?['stale'] == true) exit(exitStale);
+}
+
+Future<Map<String, dynamic>> _request(String method, String path, {Map<String, dynamic>? payload}) async {
+  final home = Platform.environment['HOME'] ?? Platform.environment['USERPROFILE'] ?? '.';
+  final socket = File('$home/.horsevpn/control.sock');
+  final client = HttpClient();
+  try {
+    final HttpClientRequest request;
+    if (!Platform.isWindows && await socket.exists()) {
+      // The socket's permissions stand in for the token
+      client.connectionFactory = (uri, proxyHost, proxyPort) =>
+          Socket.startConnect(InternetAddress(socket.path, type: InternetAddressType.unix), 0);
+      request = await client.open(method, 'localhost', 80, path);
+    } else {
+      final token = (await File('$home/.horsevpn/companion-token').readAsString()).trim();
+      request = await client.open(method, '127.0.0.1', companionPort, path);
+      request.headers.set(HttpHeaders.authorizationHeader, 'Bearer $token');
+    }
+    if (payload != null) {
+      request.headers.contentType = ContentType.json;
+      request.write(jsonEncode(payload));
+    }
+    final response = await request.close();
+    final body = await utf8.decoder.bind(response).join();
+    if (response.statusCode == 502) {
+      throw Exception(jsonDecode(body)['error']);
+    }
+    if (response.statusCode != 200) {
+      throw Exception('HTTP ${response.statusCode}');
+    }
+    return jsonDecode(body) as Map<String, dynamic>;
+  } finally {
+    client.close();
+  }
+}
@@ -0,0 +1,198 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'package:http/http.dart' as http;
+
+// Credentials presented to VPN servers. Either a static token
+// (--dart-define=HORSEVPN_TOKEN=...) or an OIDC login using the device code
+// flow (--dart-define=HORSEVPN_OIDC_ISSUER=... and HORSEVPN_OIDC_CLIENT_ID=...).
+
+const String staticToken = String.fromEnvironment('HORSEVPN_TOKEN');
+const String oidcIssuer = String.fromEnvironment('HORSEVPN_OIDC_ISSUER');
+const String oidcClientId = String.fromEnvironment('HORSEVPN_OIDC_CLIENT_ID');
+
+// Short-lived tokens minted by the sync server in exchange for a dedicated IP
+// reservation token. Each is only accepted by one server, for a few minutes,
+// so the reservation token itself never reaches the VPN servers. Requests
+// carry this install's device ID so the user can revoke it if it's lost.
+class SessionTokens {
+  SessionTokens(this.syncServerUrl, this.credential);
+
+  final String syncServerUrl;
+  final String credential;
+
+  String? _token;
+  String? _serverId;
+  DateTime _expiresAt = DateTime.fromMillisecondsSinceEpoch(0);
+  String? _deviceId;
+
+  // Generated on first use and kept in ~/.horsevpn/device-id
+  Future<String> deviceId() async {
+    if (_deviceId != null) return _deviceId!;
+
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    final file = File('$home/.horsevpn/device-id');
+    if (await file.exists()) {
+      _deviceId = (await file.readAsString()).trim();
+    } else {
+      final random = Random.secure();
+      _deviceId = List<int>.generate(16, (_) => random.nextInt(256))
+          .map((b) => b.toRadixString(16).padLeft(2, '0'))
+          .join();
+      await file.parent.create(recursive: true);
+      await file.writeAsString(_deviceId!);
+    }
+    return _deviceId!;
+  }
+
+  Future<String> token(String serverId) async {
+    // Refresh a little early so a token doesn't expire mid-handshake
+    if (_token != null &&
+        _serverId == serverId &&
+        DateTime.now().isBefore(_expiresAt.subtract(const Duration(seconds: 30)))) {
+      return _token!;
+    }
+
+    final response = await http.post(
+      Uri.parse('$syncServerUrl/session-tokens'),
+      headers: {
+        'Content-Type': 'application/json',
+        'Authorization': 'Bearer $credential',
+      },
+      body: jsonEncode({
+        'serverId': serverId,
+        'deviceId': await deviceId(),
+        'deviceName': Platform.localHostname,
+      }),
+    );
+    if (response.statusCode == 403) {
+      throw Exception('This device has been revoked');
+    } else if (response.statusCode != 200) {
+      throw Exception('Failed to get session token');
+    }
+    final body = jsonDecode(response.body);
+    _token = body['token'];
+    _serverId = serverId;
+    _expiresAt = DateTime.fromMillisecondsSinceEpoch(body['expiresAt']);
+    return _token!;
+  }
+
+  // The devices that have used the reservation, with this one marked current
+  Future<List<Map<String, dynamic>>> devices() async {
+    final response = await http.get(
+      Uri.parse('$syncServerUrl/devices'),
+      headers: {'Authorization': 'Bearer $credential'},
+    );
+    if (response.statusCode != 200) {
+      throw Exception('Failed to list devices: ${response.statusCode}');
+    }
+    final current = await deviceId();
+    return (jsonDecode(response.body) as List)
+        .cast<Map<String, dynamic>>()
+        .map((d) => {...d, 'current': d['deviceId'] == current})
+        .toList();
+  }
+
+  // Revokes one of the reservation's devices, e.g. a lost laptop. Its
+  // session tokens stop working within a few minutes.
+  Future<void> revokeDevice(String id) async {
+    final response = await http.delete(
+      Uri.parse('$syncServerUrl/devices/${Uri.encodeComponent(id)}'),
+      headers: {'Authorization': 'Bearer $credential'},
+    );
+    if (response.statusCode == 404) {
+      throw Exception('Unknown device $id');
+    } else if (response.statusCode != 200) {
+      throw Exception('Failed to revoke device: ${response.statusCode}');
+    }
+  }
+}
+
+class DeviceCodePrompt {
+  DeviceCodePrompt(this.userCode, this.verificationUri);
+
+  final String userCode;
+  final String verificationUri;
+}
+
+class OidcDeviceLogin {
+  String? _token;
+  DateTime _expiresAt = DateTime.fromMillisecondsSinceEpoch(0);
+
+  static bool get configured => oidcIssuer.isNotEmpty && oidcClientId.isNotEmpty;
+
+  // Returns a valid token, running the device code flow if we don't have
+  // one. onPrompt is called with the code the user must enter.
+  Future<String> token(void Function(DeviceCodePrompt) onPrompt) async {
+    if (_token != null && DateTime.now().isBefore(_expiresAt)) {
+      return _token!;
+    }
+
+    final config = await _discover();
+    final deviceEndpoint = config['device_authorization_endpoint'];
+    final tokenEndpoint = config['token_endpoint'];
+    if (deviceEndpoint == null || tokenEndpoint == null) {
+      throw Exception('Identity provider does not support device login');
+    }
+
+    final deviceResponse = await http.post(
+      Uri.parse(deviceEndpoint),
+      body: {'client_id': oidcClientId, 'scope': 'openid'},
+    );
+    if (deviceResponse.statusCode != 200) {
+      throw Exception('Device authorization failed');
+    }
+    final device = jsonDecode(deviceResponse.body);
+    onPrompt(DeviceCodePrompt(
+      device['user_code'],
+      device['verification_uri_complete'] ?? device['verification_uri'],
+    ));
+
+    var interval = Duration(seconds: device['interval'] ?? 5);
+    final deadline = DateTime.now().add(Duration(seconds: device['expires_in'] ?? 600));
+    while (DateTime.now().isBefore(deadline)) {
+      await Future.delayed(interval);
+      final response = await http.post(
+        Uri.parse(tokenEndpoint),
+        body: {
+          'grant_type': 'urn:ietf:params:oauth:grant-type:device_code',
+          'device_code': device['device_code'],
+          'client_id': oidcClientId,
+        },
+      );
+      final body = jsonDecode(response.body);
+      if (response.statusCode == 200) {
+        // Servers validate the audience against our client ID, which is
+        // what the ID token is issued for
+        _token = body['id_token'] ?? body['access_token'];
+        final lifetime = body['expires_in'] ?? 3600;
+        _expiresAt = DateTime.now().add(Duration(seconds: lifetime - 60));
+        return _token!;
+      }
+      switch (body['error']) {
+        case 'authorization_pending':
+          break;
+        case 'slow_down':
+          interval += const Duration(seconds: 5);
+          break;
+        default:
+          throw Exception('Login failed: ${body['error']}');
+      }
+    }
+    throw Exception('Login timed out');
+  }
+
+  Future<Map<String, dynamic>> _discover() async {
+    final issuer = oidcIssuer.endsWith('/')
+        ? oidcIssuer.substring(0, oidcIssuer.length - 1)
+        : oidcIssuer;
+    final response =
+        await http.get(Uri.parse('$issuer/.well-known/openid-configuration'));
+    if (response.statusCode != 200) {
+      throw Exception('OIDC discovery failed');
+    }
+    return jsonDecode(response.body);
+  }
+}
@@ -0,0 +1,651 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'config_bundle.dart';
+import 'effective_config.dart';
+import 'leakcheck.dart';
+import 'org_policy.dart';
+import 'parental_controls.dart';
+import 'preflight.dart';
+import 'transparency.dart';
+import 'virtual_networks.dart';
+
+// Local API for the browser extension companion. It listens on loopback
+// only and every /v1 request must carry the bearer token written to
+// ~/.horsevpn/companion-token, which the extension reads during setup.
+//
+// Outside Windows the same API is also served on the Unix socket
+// ~/.horsevpn/control.sock, which only the user can open, so requests there
+// need no token. The horsevpn command line uses it when it is there.
+
+const int companionPort = int.fromEnvironment(
+  'HORSEVPN_COMPANION_PORT',
+  defaultValue: 9180,
+);
+
+class ProxyStats {
+  int activeConnections = 0;
+  int totalConnections = 0;
+  int bytesUp = 0;
+  int bytesDown = 0;
+  // The latest numbers a node sent about a tunnel, if any has
+  ServerStats? server;
+  // The operator's announcement, as the last node to send one had it
+  Announcement? announcement;
+  // The last destination a node's policy plugin blocked
+  PolicyBlock? blocked;
+
+  Map<String, dynamic> toJson() => {
+        'activeConnections': activeConnections,
+        'totalConnections': totalConnections,
+        'bytesUp': bytesUp,
+        'bytesDown': bytesDown,
+        if (server != null) 'server': server!.toJson(),
+        if (announcement != null && !announcement!.expired) 'announcement': announcement!.toJson(),
+        if (blocked != null) 'blocked': blocked!.toJson(),
+      };
+}
+
+// What a node sends before refusing a destination that a policy plugin the
+// tunnel asked for with X-Tunnel-Policies blocks, such as malware protection
+class PolicyBlock {
+  PolicyBlock({required this.policy, required this.host, required this.reason, required this.at});
+
+  final String policy;
+  final String host;
+  final String reason;
+  final DateTime at;
+
+  // Parses a text message from the node, or returns null if it isn't a
+  // block
+  static PolicyBlock? tryParse(String message) {
+    try {
+      final data = jsonDecode(message);
+      if (data is! Map || data['type'] != 'blocked') return null;
+      return PolicyBlock(
+        policy: '${data['policy']}',
+        host: '${data['host']}',
+        reason: '${data['reason']}',
+        at: DateTime.now(),
+      );
+    } on FormatException {
+      return null;
+    }
+  }
+
+  Map<String, dynamic> toJson() => {
+        'policy': policy,
+        'host': host,
+        'reason': reason,
+        'at': at.toUtc().toIso8601String(),
+      };
+}
+
+// The operator's message of the day or incident banner, which a node sends
+// when a tunnel asked with X-Tunnel-Announcements comes up, and again
+// whenever it changes
+class Announcement {
+  Announcement({required this.message, required this.severity, this.expiresAt});
+
+  // Empty when the operator took the announcement down
+  final String message;
+  // info, maintenance or incident
+  final String severity;
+  final DateTime? expiresAt;
+
+  bool get expired => expiresAt != null && DateTime.now().isAfter(expiresAt!);
+
+  // Parses a text message from the node, or returns null if it isn't an
+  // announcement
+  static Announcement? tryParse(String message) {
+    try {
+      final data = jsonDecode(message);
+      if (data is! Map || data['type'] != 'announcement') return null;
+      final expiresAt = data['expiresAt'] as num?;
+      final severity = data['severity'];
+      return Announcement(
+        message: data['message'] as String? ?? '',
+        // Anything newer than we know shows as plain info
+        severity: const ['maintenance', 'incident'].contains(severity) ? severity as String : 'info',
+        expiresAt: expiresAt == null ? null : DateTime.fromMillisecondsSinceEpoch(expiresAt.toInt()),
+      );
+    } on FormatException {
+      return null;
+    }
+  }
+
+  Map<String, dynamic> toJson() => {
+        'message': message,
+        'severity': severity,
+        if (expiresAt != null) 'expiresAt': expiresAt!.toUtc().toIso8601String(),
+      };
+}
+
+// What a node says about a tunnel every few seconds when asked with
+// X-Tunnel-Stats: how busy it is, whether a rate limit is slowing the
+// tunnel down and how much of the monthly quota is left
+class ServerStats {
+  ServerStats({
+    required this.load,
+    required this.overloaded,
+    required this.throttled,
+    required this.rateLimit,
+    this.quotaUsed,
+    this.quota,
+    required this.updated,
+  });
+
+  final double load;
+  final bool overloaded;
+  final bool throttled;
+  // Bytes a second, 0 for no limit
+  final int rateLimit;
+  final int? quotaUsed;
+  final int? quota;
+  final DateTime updated;
+
+  // Parses a text message from the node, or returns null if it isn't
+  // statistics
+  static ServerStats? tryParse(String message) {
+    try {
+      final data = jsonDecode(message);
+      if (data is! Map || data['type'] != 'stats') return null;
+      return ServerStats(
+        load: (data['load'] as num?)?.toDouble() ?? 0,
+        overloaded: data['overloaded'] == true,
+        throttled: data['throttled'] == true,
+        rateLimit: (data['rateLimit'] as num?)?.toInt() ?? 0,
+        quotaUsed: (data['quotaUsed'] as num?)?.toInt(),
+        quota: (data['quota'] as num?)?.toInt(),
+        updated: DateTime.now(),
+      );
+    } on FormatException {
+      return null;
+    }
+  }
+
+  Map<String, dynamic> toJson() => {
+        'load': load,
+        'overloaded': overloaded,
+        'throttled': throttled,
+        'rateLimit': rateLimit,
+        if (quota != null) 'quotaUsed': quotaUsed,
+        if (quota != null) 'quota': quota,
+        'updated': updated.toUtc().toIso8601String(),
+      };
+}
+
+class CompanionApi {
+  CompanionApi({required this.stats, required this.proxyPort});
+
+  final ProxyStats stats;
+  final int proxyPort;
+
+  String route = '';
+  String location = '';
+
+  // Sites listed here override the default: true sends the site through
+  // the tunnel, false sends it direct
+  bool tunnelByDefault = true;
+  // Whether the user chose tunnelByDefault, rather than leaving it to the
+  // org or config bundle
+  bool tunnelByDefaultSet = false;
+  final Map<String, bool> sites = {};
+  // Named virtual networks alongside the main proxy
+  List<NetworkProxy> networks = [];
+  // The user's kill switch choice; null leaves it to the config bundle
+  bool? killSwitch;
+  // The user's malware protection choice; null leaves it to the config
+  // bundle, and off without one
+  bool? malwareProtection;
+  // HORSEVPN_ALWAYS_ON, and whether the kill switch firewall is blocking
+  // traffic outside the tunnel right now
+  bool alwaysOn = false;
+  bool Function()? firewallBlocking;
+  // The user's lazy dial choice; null leaves it to HORSEVPN_LAZY_DIAL
+  bool? lazyDial;
+  bool lazyDialByDefault = false;
+  void Function()? onLazyDialChanged;
+  // From ~/.horsevpn/parental-controls.json
+  ParentalProfile? parentalControls;
+  void Function()? onKillSwitchChanged;
+  // Runs `horsevpn preflight` against the current candidates
+  Future<List<PreflightResult>> Function()? onPreflight;
+  // Dials now for `horsevpn connect`, if there is no route yet
+  Future<void> Function()? onConnect;
+  // Runs `horsevpn leakcheck` through the proxy
+  Future<List<LeakFinding>> Function()? onLeakcheck;
+  // Fetches and verifies the operator's transparency statement
+  Future<TransparencyStatement?> Function()? onTransparency;
+  // `horsevpn up`, `down`, `switch-server` and `rotate`
+  Future<void> Function()? onUp;
+  Future<void> Function()? onDown;
+  Future<void> Function(String? location, bool auto)? onSwitchServer;
+  // Returns the new exit addresses, or null for a new server
+  Future<List<String>?> Function()? onRotate;
+  // `horsevpn devices` and `horsevpn devices revoke <id>`
+  Future<List<Map<String, dynamic>>> Function()? onDevices;
+  Future<void> Function(String id)? onRevokeDevice;
+  // Bumped on every rule change so the extension can tell when to refetch
+  // the PAC script
+  int pacVersion = 1;
+  // Set while on a trusted network; everything goes direct
+  bool paused = false;
+  // Set between `horsevpn down` and `horsevpn up`; everything goes direct
+  // unless the kill switch is on
+  bool down = false;
+  // The location `horsevpn switch-server` chose, if any, instead of our
+  // geolocation
+  String? pinnedLocation;
+  // The organization's rules, which win over the user's own
+  OrgPolicy? orgPolicy;
+  // Pushed by the sync server; see effective_config.dart for how it combines
+  // with the user's settings
+  ConfigBundle? configBundle;
+
+  late final String _token;
+  HttpServer? _server;
+  HttpServer? _control;
+
+  static Directory get _configDir {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    return Directory('$home/.horsevpn');
+  }
+
+  // chmod throws unless path ends up with mode, so nothing secret is left
+  // readable by other users when it fails
+  static Future<void> _chmod(String mode, String path) async {
+    final result = await Process.run('chmod', [mode, path]);
+    if (result.exitCode != 0) {
+      throw FileSystemException('chmod $mode failed: ${result.stderr}'.trim(), path);
+    }
+  }
+
+  Future<void> start() async {
+    // The directory is closed to other users before the token or the socket
+    // is in it, so neither is ever reachable through it
+    final dir = _configDir;
+    await dir.create(recursive: true);
+    if (!Platform.isWindows) await _chmod('700', dir.path);
+
+    final random = Random.secure();
+    _token = base64Url.encode(List<int>.generate(32, (_) => random.nextInt(256)));
+    final tokenFile = File('${dir.path}/companion-token');
+    await tokenFile.create();
+    if (!Platform.isWindows) await _chmod('600', tokenFile.path);
+    await tokenFile.writeAsString(_token);
+
+    await _loadSites();
+
+    _server = await HttpServer.bind(InternetAddress.loopbackIPv4, companionPort);
+    _server!.listen(_handle);
+    print('Companion API listening on 127.0.0.1:$companionPort');
+
+    // dart:io can't serve named pipes, so on Windows the command line uses
+    // the port and token
+    if (!Platform.isWindows) {
+      final socket = File(controlSocketPath);
+      // Left over from a client that didn't exit cleanly; a running one
+      // would hold the port, so binding it above would have failed
+      if (await socket.exists()) await socket.delete();
+      try {
+        _control = await HttpServer.bind(InternetAddress(socket.path, type: InternetAddressType.unix), 0);
+        await _chmod('600', socket.path);
+        _control!.listen((request) => _handle(request, local: true));
+      } catch (e) {
+        await _control?.close(force: true);
+        _control = null;
+        print('Control socket unavailable: $e');
+      }
+    }
+  }
+
+  static String get controlSocketPath => '${_configDir.path}/control.sock';
+
+  Future<void> stop() async {
+    await _server?.close(force: true);
+    _server = null;
+    if (_control != null) {
+      await _control!.close(force: true);
+      _control = null;
+      await File(controlSocketPath).delete().catchError((_) => File(controlSocketPath));
+    }
+  }
+
+  Future<void> _loadSites() async {
+    final file = File('${_configDir.path}/sites.json');
+    if (!await file.exists()) return;
+    try {
+      final data = jsonDecode(await file.readAsString());
+      tunnelByDefaultSet = data['tunnelByDefault'] != null;
+      tunnelByDefault = data['tunnelByDefault'] ?? true;
+      killSwitch = data['killSwitch'] as bool?;
+      malwareProtection = data['malwareProtection'] as bool?;
+      lazyDial = data['lazyDial'] as bool?;
+      (data['sites'] as Map<String, dynamic>? ?? {})
+          .forEach((site, tunnel) => sites[site] = tunnel == true);
+    } catch (e) {
+      print('Ignoring unreadable sites.json: $e');
+    }
+  }
+
+  Future<void> _saveSites() async {
+    final file = File('${_configDir.path}/sites.json');
+    await file.writeAsString(jsonEncode({
+      if (tunnelByDefaultSet) 'tunnelByDefault': tunnelByDefault,
+      'sites': sites,
+      if (killSwitch != null) 'killSwitch': killSwitch,
+      if (malwareProtection != null) 'malwareProtection': malwareProtection,
+      if (lazyDial != null) 'lazyDial': lazyDial,
+    }));
+  }
+
+  bool _authorized(HttpRequest request) {
+    final header = request.headers.value(HttpHeaders.authorizationHeader);
+    if (header == null || !header.startsWith('Bearer ')) return false;
+    final presented = header.substring(7);
+    if (presented.length != _token.length) return false;
+    // Constant-time comparison
+    var diff = 0;
+    for (var i = 0; i < presented.length; i++) {
+      diff |= presented.codeUnitAt(i) ^ _token.codeUnitAt(i);
+    }
+    return diff == 0;
+  }
+
+  // local is for requests on the control socket, whose file permissions
+  // stand in for the token
+  Future<void> _handle(HttpRequest request, {bool local = false}) async {
+    final response = request.response;
+
+    // Only extension pages may call us from a browser context
+    final origin = request.headers.value('origin');
+    if (origin != null) {
+      if (!origin.startsWith('chrome-extension://') &&
+          !origin.startsWith('moz-extension://')) {
+        response.statusCode = HttpStatus.forbidden;
+        await response.close();
+        return;
+      }
+      response.headers.set('Access-Control-Allow-Origin', origin);
+      response.headers.set('Access-Control-Allow-Headers', 'Authorization, Content-Type');
+      response.headers.set('Access-Control-Allow-Methods', 'GET, POST, PUT, DELETE');
+      if (request.method == 'OPTIONS') {
+        response.statusCode = HttpStatus.noContent;
+        await response.close();
+        return;
+      }
+    }
+
+    if (!local && !_authorized(request)) {
+      response.statusCode = HttpStatus.unauthorized;
+      await response.close();
+      return;
+    }
+
+    try {
+      await _route(request, response);
+    } catch (e) {
+      response.statusCode = HttpStatus.badRequest;
+      _json(response, {'error': 'Invalid request'});
+    }
+    await response.close();
+  }
+
+  Future<void> _route(HttpRequest request, HttpResponse response) async {
+    final path = request.uri.path;
+
+    if (request.method == 'GET' && path == '/v1/status') {
+      _json(response, _status());
+    } else if (request.method == 'POST' && path == '/v1/connect' && onConnect != null) {
+      try {
+        if (!paused) await onConnect!();
+        _json(response, _status());
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'POST' && path == '/v1/up' && onUp != null) {
+      try {
+        await onUp!();
+        _json(response, _status());
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'POST' && path == '/v1/down' && onDown != null) {
+      await onDown!();
+      _json(response, _status());
+    } else if (request.method == 'POST' && path == '/v1/switch-server' && onSwitchServer != null) {
+      final body = jsonDecode(await utf8.decoder.bind(request).join()) as Map<String, dynamic>;
+      try {
+        await onSwitchServer!(body['location'] as String?, body['auto'] == true);
+        _json(response, _status());
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'POST' && path == '/v1/rotate' && onRotate != null) {
+      try {
+        final egress = await onRotate!();
+        _json(response, {..._status(), 'egress': egress});
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'GET' && path == '/v1/devices' && onDevices != null) {
+      try {
+        _json(response, {'devices': await onDevices!()});
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'DELETE' && path.startsWith('/v1/devices/') && onRevokeDevice != null) {
+      final id = Uri.decodeComponent(path.substring('/v1/devices/'.length));
+      try {
+        await onRevokeDevice!(id);
+        _json(response, {'deviceId': id, 'status': 'revoked'});
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'GET' && path == '/v1/stats') {
+      _json(response, stats.toJson());
+    } else if (request.method == 'GET' && path == '/v1/sites') {
+      _json(response, {'tunnelByDefault': tunnelByDefault, 'sites': sites});
+    } else if (request.method == 'PUT' && path == '/v1/sites') {
+      final body = jsonDecode(await utf8.decoder.bind(request).join());
+      // null goes back to the org's or config bundle's default
+      tunnelByDefaultSet = body['tunnelByDefault'] != null;
+      tunnelByDefault = body['tunnelByDefault'] != false;
+      await _rulesChanged();
+      _json(response, {'tunnelByDefault': tunnelByDefault, 'pacVersion': pacVersion});
+    } else if (path.startsWith('/v1/sites/')) {
+      final site = _normalizeSite(Uri.decodeComponent(path.substring('/v1/sites/'.length)));
+      if (site == null) {
+        response.statusCode = HttpStatus.badRequest;
+        _json(response, {'error': 'Invalid site'});
+      } else if (request.method == 'PUT') {
+        final body = jsonDecode(await utf8.decoder.bind(request).join());
+        sites[site] = body['tunnel'] == true;
+        await _rulesChanged();
+        _json(response, {'site': site, 'tunnel': sites[site], 'pacVersion': pacVersion});
+      } else if (request.method == 'DELETE') {
+        sites.remove(site);
+        await _rulesChanged();
+        _json(response, {'site': site, 'pacVersion': pacVersion});
+      } else {
+        response.statusCode = HttpStatus.methodNotAllowed;
+      }
+    } else if (request.method == 'GET' && path == '/v1/networks') {
+      _json(response, networks.map((n) => n.toJson()).toList());
+    } else if (request.method == 'GET' && path == '/v1/config/effective') {
+      _json(response, effective.toJson());
+    } else if (request.method == 'PUT' && path == '/v1/kill-switch') {
+      final body = jsonDecode(await utf8.decoder.bind(request).join());
+      killSwitch = body['enabled'] as bool?;
+      await _rulesChanged();
+      onKillSwitchChanged?.call();
+      _json(response, {'killSwitch': effective.killSwitch.toJson(), 'pacVersion': pacVersion});
+    } else if (request.method == 'PUT' && path == '/v1/malware-protection') {
+      final body = jsonDecode(await utf8.decoder.bind(request).join());
+      malwareProtection = body['enabled'] as bool?;
+      await _saveSites();
+      _json(response, {'malwareProtection': effective.malwareProtection.toJson()});
+    } else if (request.method == 'PUT' && path == '/v1/lazy-dial') {
+      final body = jsonDecode(await utf8.decoder.bind(request).join());
+      lazyDial = body['enabled'] as bool?;
+      await _saveSites();
+      onLazyDialChanged?.call();
+      _json(response, {'lazyDial': lazyDial ?? lazyDialByDefault});
+    } else if (request.method == 'POST' && path == '/v1/preflight' && onPreflight != null) {
+      try {
+        final results = await onPreflight!();
+        _json(response, {'results': results.map((r) => r.toJson()).toList()});
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'POST' && path == '/v1/leakcheck' && onLeakcheck != null) {
+      try {
+        if (paused) throw Exception('Paused on a trusted network');
+        final findings = await onLeakcheck!();
+        _json(response, {
+          'level': worstLeakLevel(findings.map((f) => f.level)),
+          'findings': findings.map((f) => f.toJson()).toList(),
+        });
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'GET' && path == '/v1/transparency' && onTransparency != null) {
+      try {
+        final statement = await onTransparency!();
+        _json(response, {'statement': statement?.toJson()});
+      } catch (e) {
+        response.statusCode = HttpStatus.badGateway;
+        _json(response, {'error': '$e'});
+      }
+    } else if (request.method == 'GET' && path == '/v1/pac') {
+      response.headers.contentType =
+          ContentType('application', 'x-ns-proxy-autoconfig');
+      response.headers.set('ETag', '"$pacVersion"');
+      response.write(pacScript());
+    } else {
+      response.statusCode = HttpStatus.notFound;
+    }
+  }
+
+  // state is connected, disconnected (connects on next use), paused or down
+  Map<String, dynamic> _status() => {
+        'state': paused ? 'paused' : (down ? 'down' : (route.isNotEmpty ? 'connected' : 'disconnected')),
+        'route': route,
+        'location': location,
+        if (pinnedLocation != null) 'pinnedLocation': pinnedLocation,
+        'paused': paused,
+        'down': down,
+        'alwaysOn': alwaysOn,
+        if (alwaysOn) 'firewallBlocking': firewallBlocking?.call() ?? false,
+        'pacVersion': pacVersion,
+        'configBundle': configBundle == null
+            ? null
+            : {'scope': configBundle!.scope, 'version': configBundle!.version},
+      };
+
+  void setPaused(bool value) {
+    if (paused == value) return;
+    paused = value;
+    pacVersion++;
+  }
+
+  void setDown(bool value) {
+    if (down == value) return;
+    down = value;
+    pacVersion++;
+  }
+
+  void setOrgPolicy(OrgPolicy? policy) {
+    if (policy?.version == orgPolicy?.version) return;
+    orgPolicy = policy;
+    pacVersion++;
+  }
+
+  // Swaps in a whole bundle at once, so the PAC script never mixes two
+  void setConfigBundle(ConfigBundle? bundle) {
+    if (bundle?.etag == configBundle?.etag) return;
+    configBundle = bundle;
+    pacVersion++;
+  }
+
+  Future<void> _rulesChanged() async {
+    pacVersion++;
+    await _saveSites();
+  }
+
+  static String? _normalizeSite(String site) {
+    site = site.trim().toLowerCase();
+    if (site.startsWith('*.')) site = site.substring(2);
+    if (!RegExp(r'^[a-z0-9.-]{1,253}$').hasMatch(site)) return null;
+    return site;
+  }
+
+  // The user's settings combined with the org policy and config bundle
+  EffectiveConfig get effective => EffectiveConfig.merge(
+        org: orgPolicy,
+        bundle: configBundle,
+        alwaysOn: alwaysOn,
+        local: LocalSettings(
+          tunnelByDefault: tunnelByDefaultSet ? tunnelByDefault : null,
+          sites: sites,
+          networkSites: {
+            for (final n in networks)
+              for (final site in n.network.sites) site: n.network.name,
+          },
+          killSwitch: killSwitch,
+          malwareProtection: malwareProtection,
+          parentalControls: parentalControls,
+        ),
+      );
+
+  // A PAC script that sends toggled-on sites (and their subdomains) through
+  // the local SOCKS proxy and everything else direct, or the reverse
+  String pacScript() {
+    if (paused || (down && !effective.killSwitch.value)) {
+      return 'function FindProxyForURL(url, host) {\n  return "DIRECT";\n}\n';
+    }
+    String socks(int port) => 'SOCKS5 127.0.0.1:$port; SOCKS 127.0.0.1:$port';
+    final proxy = socks(proxyPort);
+    final networkPorts = {for (final n in networks) 'network:${n.network.name}': n.network.port};
+    final config = effective;
+    final defaultAction = config.tunnelByDefault.value ? proxy : 'DIRECT';
+    final rules = StringBuffer();
+    if (config.killSwitch.value && config.allowLan.value) {
+      rules.writeln('  if (isPlainHostName(host) || isInNet(host, "10.0.0.0", "255.0.0.0") ||'
+          ' isInNet(host, "172.16.0.0", "255.240.0.0") || isInNet(host, "192.168.0.0", "255.255.0.0"))'
+          ' return "DIRECT";');
+    }
+    for (final rule in config.rules) {
+      // Nothing listens on the discard port, so blocked sites fail to load
+      final action = switch (rule.action) {
+        'block' => 'PROXY 127.0.0.1:9',
+        'direct' => 'DIRECT',
+        'tunnel' => proxy,
+        _ => socks(networkPorts[rule.action]!),
+      };
+      rules.writeln(
+          '  if (host === "${rule.site}" || dnsDomainIs(host, ".${rule.site}")) return "$action";');
+    }
+    return 'function FindProxyForURL(url, host) {\n'
+        '  host = host.toLowerCase();\n'
+        '$rules'
+        '  return "$defaultAction";\n'
+        '}\n';
+  }
+
+  void _json(HttpResponse response, Object body) {
+    response.headers.contentType = ContentType.json;
+    response.write(jsonEncode(body));
+  }
+}
@@ -0,0 +1,194 @@
+import 'dart:convert';
+import 'dart:io';
+import 'package:cryptography/cryptography.dart';
+import 'package:http/http.dart' as http;
+import 'parental_controls.dart';
+
+// Client configuration pushed by the sync server: split-tunnel rules, DNS
+// settings, a blocklist, kill-switch policy, malware protection and parental
+// controls, from the
+// user's organization or the server's global bundle. Bundles are signed with
+// the sync server's Ed25519 key, which is pinned with
+// --dart-define=HORSEVPN_CONFIG_PUBLIC_KEY=<base64> (the key served at
+// /session-tokens/public-key); without it bundles aren't fetched at all.
+const String configPublicKey = String.fromEnvironment('HORSEVPN_CONFIG_PUBLIC_KEY');
+
+// Must match the sync server's
+const String _signingContext = 'horsevpn-config-bundle-v1\n';
+
+class ClientConfig {
+  ClientConfig({
+    this.tunnelByDefault,
+    this.direct = const [],
+    this.tunnel = const [],
+    this.dnsServers = const [],
+    this.searchDomains = const [],
+    this.blocklist = const [],
+    this.killSwitch = false,
+    this.allowLan = true,
+    this.malwareProtection = false,
+    this.parentalControls,
+    this.sections = const {},
+    this.enforced = const {},
+  });
+
+  // Unset when the bundle leaves the choice to the user
+  final bool? tunnelByDefault;
+  final List<String> direct;
+  final List<String> tunnel;
+  final List<String> dnsServers;
+  final List<String> searchDomains;
+  final List<String> blocklist;
+  final bool killSwitch;
+  final bool allowLan;
+  final bool malwareProtection;
+  // The profile the parentalControls section picks
+  final ParentalProfile? parentalControls;
+  // The sections the bundle sets (splitTunnel, dns, blocklist, killSwitch,
+  // malwareProtection, parentalControls), and those of them that win over
+  // the user's own settings
+  final Set<String> sections;
+  final Set<String> enforced;
+
+  bool sets(String section) => sections.contains(section);
+
+  // The blocklist is always enforced
+  bool enforces(String section) => section == 'blocklist' ? sets(section) : enforced.contains(section);
+
+  factory ClientConfig.fromJson(Map<String, dynamic> json) {
+    List<String> strings(Map<String, dynamic>? section, String key) =>
+        (section?[key] as List? ?? []).map((s) => s.toString()).toList();
+    final split = json['splitTunnel'] as Map<String, dynamic>?;
+    final dns = json['dns'] as Map<String, dynamic>?;
+    final kill = json['killSwitch'] as Map<String, dynamic>?;
+    final malware = json['malwareProtection'] as Map<String, dynamic>?;
+    final parental = json['parentalControls'] as Map<String, dynamic>?;
+    return ClientConfig(
+      tunnelByDefault: split?['tunnelByDefault'] as bool?,
+      direct: strings(split, 'direct'),
+      tunnel: strings(split, 'tunnel'),
+      dnsServers: strings(dns, 'servers'),
+      searchDomains: strings(dns, 'searchDomains'),
+      blocklist: (json['blocklist'] as List? ?? []).map((s) => s.toString()).toList(),
+      killSwitch: kill?['enabled'] as bool? ?? false,
+      allowLan: kill?['allowLan'] as bool? ?? true,
+      malwareProtection: malware?['enabled'] as bool? ?? false,
+      parentalControls: parental != null ? parentalProfileFromJson(parental) : null,
+      sections: json.keys.where((k) => k != 'enforce').toSet(),
+      enforced: (json['enforce'] as List? ?? []).map((s) => s.toString()).toSet(),
+    );
+  }
+}
+
+class ConfigBundle {
+  ConfigBundle._(this.scope, this.version, this.issuedAt, this.config, this._payload, this._signature);
+
+  final String scope;
+  final int version;
+  final DateTime issuedAt;
+  final ClientConfig config;
+  // As received, so the bundle can be saved and checked again on load
+  final String _payload;
+  final String _signature;
+
+  String get etag => '"$scope:$version"';
+
+  // Checks the signature over the payload and only then parses it
+  static Future<ConfigBundle> verify(String payload, String signature) async {
+    final payloadBytes = base64.decode(payload);
+    final ok = await Ed25519().verify(
+      [...utf8.encode(_signingContext), ...payloadBytes],
+      signature: Signature(
+        base64.decode(signature),
+        publicKey: SimplePublicKey(base64.decode(configPublicKey), type: KeyPairType.ed25519),
+      ),
+    );
+    if (!ok) throw Exception('Config bundle signature is invalid');
+
+    final json = jsonDecode(utf8.decode(payloadBytes)) as Map<String, dynamic>;
+    return ConfigBundle._(
+      json['scope'] as String,
+      json['version'] as int,
+      DateTime.fromMillisecondsSinceEpoch(json['issuedAt'] as int),
+      ClientConfig.fromJson(json['config'] as Map<String, dynamic>? ?? {}),
+      payload,
+      signature,
+    );
+  }
+}
+
+// Fetches bundles and keeps the last good one in ~/.horsevpn/config-bundle.json
+class ConfigBundles {
+  ConfigBundles(this.syncServerUrl, this.credential);
+
+  final String syncServerUrl;
+  // Reservation token, for the user's org bundle; empty for the global one
+  final String credential;
+
+  ConfigBundle? current;
+
+  static bool get configured => configPublicKey.isNotEmpty;
+
+  static File get _file {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    return File('$home/.horsevpn/config-bundle.json');
+  }
+
+  // The saved bundle, if there is one and it still verifies
+  Future<ConfigBundle?> load() async {
+    final file = _file;
+    if (!await file.exists()) return null;
+    try {
+      final data = jsonDecode(await file.readAsString());
+      return current = await ConfigBundle.verify(data['payload'], data['signature']);
+    } catch (e) {
+      print('Ignoring saved config bundle: $e');
+      return null;
+    }
+  }
+
+  // Waits up to wait for the bundle to change, and returns whether current
+  // changed. It becomes null when the server no longer has a bundle for us.
+  // A bundle older than the one we hold for the same scope is refused, so a
+  // replayed response can't roll us back.
+  Future<bool> poll({Duration wait = Duration.zero}) async {
+    final held = current;
+    final response = await http.get(
+      Uri.parse('$syncServerUrl/client-config?wait=${wait.inSeconds}'),
+      headers: {
+        if (credential.isNotEmpty) 'Authorization': 'Bearer $credential',
+        if (held != null) 'If-None-Match': held.etag,
+      },
+    ).timeout(wait + const Duration(seconds: 30));
+    if (response.statusCode == 304) return false;
+    if (response.statusCode == 404) {
+      if (held == null) return false;
+      current = null;
+      await _file.delete().catchError((_) => _file);
+      return true;
+    }
+    if (response.statusCode != 200) {
+      throw Exception('Failed to fetch client config: ${response.statusCode}');
+    }
+
+    final body = jsonDecode(response.body);
+    final bundle = await ConfigBundle.verify(body['payload'], body['signature']);
+    if (held != null && bundle.scope == held.scope && !bundle.issuedAt.isAfter(held.issuedAt)) {
+      throw Exception('Refusing config bundle older than the one applied');
+    }
+    await _save(bundle);
+    current = bundle;
+    return true;
+  }
+
+  // Writes to a temporary file first so a crash never leaves half a bundle
+  Future<void> _save(ConfigBundle bundle) async {
+    final file = _file;
+    await file.parent.create(recursive: true);
+    final tmp = File('${file.path}.tmp');
+    await tmp.writeAsString(jsonEncode({'payload': bundle._payload, 'signature': bundle._signature}));
+    await tmp.rename(file.path);
+  }
+}
@@ -0,0 +1,343 @@
+import 'dart:async';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+import 'package:web_socket_channel/io.dart';
+import 'dns_overrides.dart';
+import 'udp_associate.dart';
+
+// Local DNS forwarder (desktop only). Applications that resolve names
+// themselves before using the proxy, or don't use it at all, ask the
+// system resolver, which asks the network's, and that gives away every
+// name the user visits. The forwarder answers DNS on 127.0.0.1, over UDP
+// and TCP, and sends each query as plain DNS through the node's /udp relay
+// to the config bundle's first DNS server, or dnsUpstream without one, so
+// only the node's resolver sees it. Names in dnsOverrides are answered
+// here. Queries over TCP go through the relay as UDP too, so a large
+// answer comes back truncated. Until there is a tunnel, queries go straight
+// to the same server, since the client's own lookups to get one may be
+// among them.
+//
+// The port is set with --dart-define=HORSEVPN_DNS_PORT (0 turns the
+// forwarder off); ports below 1024 need administrator rights on Linux.
+const int dnsForwarderPort = int.fromEnvironment('HORSEVPN_DNS_PORT', defaultValue: 53);
+
+// Used when the config bundle names no DNS servers, set with
+// --dart-define=HORSEVPN_DNS_UPSTREAM
+const String dnsUpstream = String.fromEnvironment('HORSEVPN_DNS_UPSTREAM', defaultValue: '1.1.1.1');
+
+// With --dart-define=HORSEVPN_DNS_SYSTEM=true, the system's DNS settings
+// point at the forwarder while the VPN is up; see SystemDns
+const bool dnsSystem = bool.fromEnvironment('HORSEVPN_DNS_SYSTEM');
+
+const Duration _queryTimeout = Duration(seconds: 5);
+
+class DnsForwarder {
+  DnsForwarder({
+    required this.openRelay,
+    required this.upstreams,
+    required this.refuse,
+    required this.tunneled,
+    this.onSent,
+    this.onReceived,
+  });
+
+  // Opens a WebSocket to the current node's /udp relay
+  final Future<IOWebSocketChannel> Function() openRelay;
+  // The config bundle's DNS servers, which may change while we run
+  final List<String> Function() upstreams;
+  // True while queries may not go through the tunnel: paused on a trusted
+  // network, or down. They get REFUSED, so resolvers move on quickly.
+  final bool Function() refuse;
+  // True once there is a tunnel to send queries through
+  final bool Function() tunneled;
+  final void Function(int bytes)? onSent;
+  final void Function(int bytes)? onReceived;
+
+  DnsOverrides overrides = DnsOverrides();
+
+  RawDatagramSocket? _udp;
+  // For queries sent straight to the upstream
+  Future<RawDatagramSocket>? _direct;
+  ServerSocket? _tcp;
+  Future<IOWebSocketChannel>? _relay;
+  // Queries waiting for an answer, by the ID we sent them with; IDs are
+  // rewritten so queries from different applications can't collide
+  final Map<int, _Pending> _pending = {};
+  final Random _random = Random.secure();
+
+  bool get running => _udp != null;
+
+  Future<void> start() async {
+    final udp = await RawDatagramSocket.bind(InternetAddress.loopbackIPv4, dnsForwarderPort);
+    try {
+      _tcp = await ServerSocket.bind(InternetAddress.loopbackIPv4, dnsForwarderPort);
+    } catch (e) {
+      udp.close();
+      rethrow;
+    }
+    _udp = udp;
+    udp.listen((event) {
+      if (event != RawSocketEvent.read) return;
+      final datagram = udp.receive();
+      if (datagram == null) return;
+      _resolve(datagram.data, (reply) => udp.send(reply, datagram.address, datagram.port));
+    });
+    _tcp!.listen(_serveTcp);
+  }
+
+  Future<void> stop() async {
+    _udp?.close();
+    _udp = null;
+    _direct?.then((socket) => socket.close()).catchError((e) {});
+    _direct = null;
+    await _tcp?.close();
+    _tcp = null;
+    reset();
+  }
+
+  // Closes the relay, so the next query opens one to whatever node we use
+  // by then; called whenever the tunnels are dropped
+  void reset() {
+    final relay = _relay;
+    _relay = null;
+    relay?.then((channel) => channel.sink.close()).catchError((e) {});
+    for (final pending in _pending.values) {
+      pending.timer.cancel();
+    }
+    _pending.clear();
+  }
+
+  // DNS over TCP: each message has a two byte length before it
+  void _serveTcp(Socket socket) {
+    var buffer = <int>[];
+    socket.listen((data) {
+      buffer.addAll(data);
+      while (buffer.length >= 2) {
+        final length = buffer[0] << 8 | buffer[1];
+        if (buffer.length < 2 + length) break;
+        final query = Uint8List.fromList(buffer.sublist(2, 2 + length));
+        buffer = buffer.sublist(2 + length);
+        _resolve(query, (reply) {
+          try {
+            socket.add([reply.length >> 8, reply.length & 0xff, ...reply]);
+          } catch (e) {
+            // The application hung up
+          }
+        });
+      }
+    }, onDone: () {
+      // Answers still on their way have until they time out
+      Timer(_queryTimeout, socket.destroy);
+    }, onError: (e) => socket.destroy(), cancelOnError: true);
+  }
+
+  void _resolve(Uint8List query, void Function(Uint8List reply) reply) {
+    // A header at least, and a query rather than a response
+    if (query.length < 12 || query[2] & 0x80 != 0) return;
+    if (refuse()) {
+      reply(_refused(query));
+      return;
+    }
+    final local = overrides.answer(query);
+    if (local != null) {
+      reply(local);
+      return;
+    }
+    final upstream = _upstream();
+    if (upstream == null || _pending.length >= 0x10000) {
+      reply(_refused(query));
+      return;
+    }
+
+    int id;
+    do {
+      id = _random.nextInt(0x10000);
+    } while (_pending.containsKey(id));
+    final originalId = query[0] << 8 | query[1];
+    _pending[id] = _Pending(originalId, reply, Timer(_queryTimeout, () => _pending.remove(id)));
+
+    final message = [id >> 8, id & 0xff, ...query.sublist(2)];
+    if (!tunneled()) {
+      _sendDirect(Uint8List.fromList(message), upstream).catchError((e) {
+        final pending = _pending.remove(id);
+        pending?.timer.cancel();
+        pending?.reply(_servFail(query));
+      });
+      return;
+    }
+    final datagram = Uint8List.fromList([
+      // RSV RSV FRAG ATYP DST.ADDR DST.PORT
+      0, 0, 0, upstream.type == InternetAddressType.IPv4 ? 1 : 4, ...upstream.rawAddress, 0, 53,
+      ...message,
+    ]);
+    _channel().then((channel) {
+      onSent?.call(datagram.length);
+      channel.sink.add(datagram);
+    }).catchError((e) {
+      final pending = _pending.remove(id);
+      pending?.timer.cancel();
+      pending?.reply(_servFail(query));
+    });
+  }
+
+  Future<void> _sendDirect(Uint8List message, InternetAddress upstream) async {
+    final socket = await (_direct ??= _bindDirect());
+    socket.send(message, upstream, 53);
+  }
+
+  Future<RawDatagramSocket> _bindDirect() async {
+    final socket = await RawDatagramSocket.bind(InternetAddress.anyIPv4, 0);
+    socket.listen((event) {
+      if (event != RawSocketEvent.read) return;
+      final datagram = socket.receive();
+      if (datagram == null || datagram.port != 53) return;
+      _answered(datagram.data);
+    });
+    return socket;
+  }
+
+  InternetAddress? _upstream() {
+    for (final server in [...upstreams(), dnsUpstream]) {
+      final address = InternetAddress.tryParse(server);
+      if (address != null) return address;
+    }
+    return null;
+  }
+
+  Future<IOWebSocketChannel> _channel() {
+    final existing = _relay;
+    if (existing != null) return existing;
+    final relay = openRelay();
+    _relay = relay;
+    relay.then((channel) {
+      channel.stream.listen(_received, onDone: () {
+        if (identical(_relay, relay)) _relay = null;
+      }, onError: (e) {
+        if (identical(_relay, relay)) _relay = null;
+      });
+    }, onError: (e) {
+      if (identical(_relay, relay)) _relay = null;
+    });
+    return relay;
+  }
+
+  void _received(dynamic message) {
+    if (message is! List<int>) return;
+    onReceived?.call(message.length);
+    final datagram = Uint8List.fromList(message);
+    final headerLength = socksUdpHeaderLength(datagram);
+    if (headerLength == null) return;
+    _answered(Uint8List.sublistView(datagram, headerLength));
+  }
+
+  // Passes an answer on to whoever asked, with their ID
+  void _answered(Uint8List answer) {
+    if (answer.length < 12) return;
+    final pending = _pending.remove(answer[0] << 8 | answer[1]);
+    if (pending == null) return;
+    pending.timer.cancel();
+    answer[0] = pending.originalId >> 8;
+    answer[1] = pending.originalId & 0xff;
+    pending.reply(answer);
+  }
+
+  static Uint8List _refused(Uint8List query) => _error(query, 5);
+  static Uint8List _servFail(Uint8List query) => _error(query, 2);
+
+  // Just the header: the query's ID and recursion desired, with rcode
+  static Uint8List _error(Uint8List query, int rcode) =>
+      Uint8List.fromList([query[0], query[1], 0x80 | (query[2] & 0x79), 0x80 | rcode, 0, 0, 0, 0, 0, 0, 0, 0]);
+}
+
+class _Pending {
+  _Pending(this.originalId, this.reply, this.timer);
+
+  final int originalId;
+  final void Function(Uint8List reply) reply;
+  final Timer timer;
+}
+
+// Points the system's DNS at the forwarder while the VPN is up, with
+// HORSEVPN_DNS_SYSTEM, which only works with the forwarder on port 53.
+// On Linux /etc/resolv.conf is moved aside to /etc/resolv.conf.horsevpn
+// and replaced by one naming 127.0.0.1, keeping its search and options
+// lines; a backup left by a crash is kept and restored later. On Windows
+// each connected adapter's DNS server is set to 127.0.0.1 and reset to
+// automatic afterwards, so static DNS settings are lost. Both need
+// administrator rights; without them the client runs as usual and says so.
+class SystemDns {
+  bool _active = false;
+
+  bool get enabled => dnsSystem && dnsForwarderPort == 53;
+  bool get active => _active;
+
+  static const String _resolvConf = '/etc/resolv.conf';
+  static const String _backup = '/etc/resolv.conf.horsevpn';
+
+  Future<void> engage() async {
+    if (!enabled || _active) return;
+    final ok = await _point();
+    _active = ok;
+    print(ok ? 'System DNS now goes through the VPN' : 'Could not change the system DNS settings; run with administrator rights');
+  }
+
+  Future<void> release() async {
+    if (!_active) return;
+    _active = false;
+    if (!await _restore()) print('Could not restore the system DNS settings');
+  }
+
+  Future<bool> _point() async {
+    if (Platform.isWindows) {
+      return _powershell('Get-NetAdapter | Where-Object Status -eq Up | '
+          'Set-DnsClientServerAddress -ServerAddresses 127.0.0.1');
+    }
+    if (!Platform.isLinux) return false;
+    try {
+      final original = await File(_resolvConf).readAsString();
+      // rename moves a symlink, such as systemd-resolved's, not its target
+      if (!await FileSystemEntity.isFile(_backup)) {
+        await Link(_resolvConf).exists()
+            ? await Link(_resolvConf).rename(_backup)
+            : await File(_resolvConf).rename(_backup);
+      }
+      final kept = original
+          .split('\n')
+          .where((line) => line.startsWith('search') || line.startsWith('domain') || line.startsWith('options'));
+      final replacement = File('$_resolvConf.tmp');
+      await replacement.writeAsString(
+          '# Written by HorseVPN while connected; the original is in $_backup\n'
+          'nameserver 127.0.0.1\n${kept.map((line) => '$line\n').join()}');
+      await replacement.rename(_resolvConf);
+      return true;
+    } on FileSystemException {
+      return false;
+    }
+  }
+
+  Future<bool> _restore() async {
+    if (Platform.isWindows) {
+      return _powershell('Get-NetAdapter | Set-DnsClientServerAddress -ResetServerAddresses');
+    }
+    try {
+      if (await Link(_backup).exists()) {
+        await Link(_backup).rename(_resolvConf);
+      } else {
+        await File(_backup).rename(_resolvConf);
+      }
+      return true;
+    } on FileSystemException {
+      return false;
+    }
+  }
+
+  static Future<bool> _powershell(String command) async {
+    try {
+      final result = await Process.run('powershell', ['-NoProfile', '-Command', command]);
+      return result.exitCode == 0;
+    } on ProcessException {
+      return false;
+    }
+  }
+}
@@ -0,0 +1,117 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+
+// Local name overrides (desktop only), like a hosts file: names the client
+// answers itself instead of leaving them to the node's resolver, for lab
+// setups and split-horizon names that public DNS doesn't know. Configured in
+// ~/.horsevpn/hosts.json:
+//
+//   {"hosts": {"wiki.lab": "10.0.0.5", "gitlab.corp.example.com": "10.1.2.3"},
+//    "searchDomains": ["corp.example.com"]}
+//
+// A CONNECT to a listed name goes to its address, and DNS queries for it
+// sent through the proxy's UDP ASSOCIATE are answered without crossing the
+// tunnel. A name without dots is tried with each search domain in turn, the
+// local ones before the config bundle's; if none of them is listed, it is
+// sent to the node with the first search domain added.
+class DnsOverrides {
+  DnsOverrides({this.hosts = const {}, this.searchDomains = const []});
+
+  final Map<String, InternetAddress> hosts;
+  final List<String> searchDomains;
+
+  // Seconds resolvers may keep an answer; short, so edits apply soon
+  static const int _ttl = 60;
+
+  static const int _typeA = 1;
+  static const int _typeAAAA = 28;
+  static const int _classIN = 1;
+
+  static Future<DnsOverrides> load() async {
+    final home = Platform.environment['HOME'] ?? Platform.environment['USERPROFILE'] ?? '.';
+    final file = File('$home/.horsevpn/hosts.json');
+    final hosts = <String, InternetAddress>{};
+    final searchDomains = <String>[];
+    if (await file.exists()) {
+      try {
+        final data = jsonDecode(await file.readAsString());
+        for (final entry in ((data['hosts'] as Map?) ?? {}).entries) {
+          final name = _normalize(entry.key.toString());
+          final address = InternetAddress.tryParse(entry.value.toString());
+          if (name.isEmpty || address == null) {
+            print('Ignoring invalid host override: ${entry.key} -> ${entry.value}');
+            continue;
+          }
+          hosts[name] = address;
+        }
+        for (final domain in (data['searchDomains'] as List? ?? [])) {
+          final d = _normalize(domain.toString());
+          if (d.isNotEmpty && !searchDomains.contains(d)) searchDomains.add(d);
+        }
+      } catch (e) {
+        print('Ignoring unreadable hosts.json: $e');
+      }
+    }
+    return DnsOverrides(hosts: hosts, searchDomains: searchDomains);
+  }
+
+  static String _normalize(String name) => name.trim().toLowerCase().replaceAll(RegExp(r'^\.+|\.+$'), '');
+
+  // Where a CONNECT to host should go instead: a listed address, a short
+  // name completed with a search domain, or null to leave it alone.
+  // bundleSearchDomains come from the config bundle and are tried last.
+  String? rewrite(String host, [List<String> bundleSearchDomains = const []]) {
+    final name = _normalize(host);
+    final address = hosts[name];
+    if (address != null) return address.address;
+    if (name.isEmpty || name.contains('.') || InternetAddress.tryParse(name) != null) return null;
+    final domains = [...searchDomains, ...bundleSearchDomains.map(_normalize).where((d) => d.isNotEmpty)];
+    for (final domain in domains) {
+      final listed = hosts['$name.$domain'];
+      if (listed != null) return listed.address;
+    }
+    return domains.isEmpty ? null : '$name.${domains.first}';
+  }
+
+  // The reply to a DNS query for a listed name, or null to send the query on
+  // as usual. A listed name has only the record of its address's family;
+  // asking for any other type gets an empty answer.
+  Uint8List? answer(Uint8List query) {
+    // Header, then one standard query: labels, a zero byte, type and class
+    if (query.length < 12 || query[2] & 0xf8 != 0 || (query[4] << 8 | query[5]) != 1) return null;
+    final labels = <String>[];
+    var offset = 12;
+    while (offset < query.length && query[offset] != 0) {
+      final length = query[offset];
+      if (length > 63 || offset + 1 + length > query.length) return null;
+      labels.add(latin1.decode(query.sublist(offset + 1, offset + 1 + length)).toLowerCase());
+      offset += 1 + length;
+    }
+    final questionEnd = offset + 5;
+    if (questionEnd > query.length) return null;
+    final address = hosts[labels.join('.')];
+    if (address == null) return null;
+    final qtype = query[offset + 1] << 8 | query[offset + 2];
+    final qclass = query[offset + 3] << 8 | query[offset + 4];
+
+    final type = address.type == InternetAddressType.IPv4 ? _typeA : _typeAAAA;
+    final withAnswer = qtype == type && qclass == _classIN;
+    final reply = BytesBuilder()
+      // ID, then a response with the query's recursion desired, recursion
+      // available and no error
+      ..add(query.sublist(0, 2))
+      ..add([0x80 | (query[2] & 0x01), 0x80, 0, 1, 0, withAnswer ? 1 : 0, 0, 0, 0, 0])
+      ..add(query.sublist(12, questionEnd));
+    if (withAnswer) {
+      final rdata = address.rawAddress;
+      reply
+        // A pointer to the name in the question
+        ..add([0xc0, 0x0c, type >> 8, type & 0xff, 0, _classIN])
+        ..add([_ttl >> 24, (_ttl >> 16) & 0xff, (_ttl >> 8) & 0xff, _ttl & 0xff])
+        ..add([rdata.length >> 8, rdata.length & 0xff])
+        ..add(rdata);
+    }
+    return reply.toBytes();
+  }
+}
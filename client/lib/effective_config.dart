@@ -0,0 +1,187 @@
+import 'config_bundle.dart';
+import 'org_policy.dart';
+import 'parental_controls.dart';
+
+// How pushed configuration and the user's own settings combine. Each setting
+// comes from the first of these that sets it:
+//
+//   0. always-on mode (HORSEVPN_ALWAYS_ON), which holds the kill switch on
+//   1. the org policy (/org/policy) and the bundle's blocklist, always
+//   2. bundle sections the bundle enforces
+//   3. the user's local settings
+//   4. bundle sections the bundle doesn't enforce, as defaults
+//   5. built-in defaults: tunnel everything, kill switch off, system DNS,
+//      malware protection and parental controls off
+//
+// Site rules follow the same order: the first rule naming a site decides it,
+// and lower rules for the same site are reported as overridden. Sites the
+// user assigns to a virtual network count as the user's own rules.
+enum ConfigSource { builtIn, alwaysOn, orgPolicy, bundle, bundleDefault, user }
+
+String _sourceName(ConfigSource source) => switch (source) {
+      ConfigSource.builtIn => 'built-in',
+      ConfigSource.alwaysOn => 'always-on',
+      ConfigSource.orgPolicy => 'org policy',
+      ConfigSource.bundle => 'config bundle (enforced)',
+      ConfigSource.bundleDefault => 'config bundle (default)',
+      ConfigSource.user => 'local',
+    };
+
+class EffectiveSetting<T> {
+  EffectiveSetting(this.value, this.source);
+
+  final T value;
+  final ConfigSource source;
+
+  bool get enforced =>
+      source == ConfigSource.alwaysOn || source == ConfigSource.orgPolicy || source == ConfigSource.bundle;
+
+  Map<String, dynamic> toJson() => {
+        'value': value,
+        'source': _sourceName(source),
+        'enforced': enforced,
+      };
+}
+
+// action is tunnel, direct, block or network:<name>
+class SiteRule {
+  SiteRule(this.site, this.action, this.source);
+
+  final String site;
+  final String action;
+  final ConfigSource source;
+  // Lower-priority rules for the same site that this one wins over
+  final List<SiteRule> overridden = [];
+
+  Map<String, dynamic> toJson() => {
+        'site': site,
+        'action': action,
+        'source': _sourceName(source),
+        if (overridden.isNotEmpty)
+          'overrides': overridden
+              .map((r) => {'action': r.action, 'source': _sourceName(r.source)})
+              .toList(),
+      };
+}
+
+// The user's own settings; unset fields leave the choice to pushed defaults
+class LocalSettings {
+  LocalSettings({
+    this.tunnelByDefault,
+    this.sites = const {},
+    this.networkSites = const {},
+    this.killSwitch,
+    this.malwareProtection,
+    this.parentalControls,
+  });
+
+  final bool? tunnelByDefault;
+  // true sends the site through the tunnel, false sends it direct
+  final Map<String, bool> sites;
+  // Sites sent to a virtual network, by network name
+  final Map<String, String> networkSites;
+  final bool? killSwitch;
+  final bool? malwareProtection;
+  // From ~/.horsevpn/parental-controls.json
+  final ParentalProfile? parentalControls;
+}
+
+class EffectiveConfig {
+  EffectiveConfig._(this.tunnelByDefault, this.killSwitch, this.allowLan, this.dnsServers,
+      this.searchDomains, this.malwareProtection, this.parentalControls, this.rules);
+
+  final EffectiveSetting<bool> tunnelByDefault;
+  final EffectiveSetting<bool> killSwitch;
+  final EffectiveSetting<bool> allowLan;
+  final EffectiveSetting<List<String>> dnsServers;
+  final EffectiveSetting<List<String>> searchDomains;
+  // Whether tunnels ask the node to check destinations against its malware
+  // feeds
+  final EffectiveSetting<bool> malwareProtection;
+  // The parental controls profile the proxy applies, if any
+  final EffectiveSetting<ParentalProfile?> parentalControls;
+  // In priority order, one per site
+  final List<SiteRule> rules;
+
+  static EffectiveConfig merge(
+      {OrgPolicy? org, ConfigBundle? bundle, required LocalSettings local, bool alwaysOn = false}) {
+    final config = bundle?.config;
+
+    // fromBundle is null when the bundle doesn't set the setting; whether it
+    // wins over fromUser depends on whether its section is enforced
+    EffectiveSetting<T> pick<T>(String section, T? fromOrg, T? fromBundle, T? fromUser, T builtIn) {
+      final enforced = config?.enforces(section) ?? false;
+      if (fromOrg != null) return EffectiveSetting(fromOrg, ConfigSource.orgPolicy);
+      if (fromBundle != null && enforced) return EffectiveSetting(fromBundle, ConfigSource.bundle);
+      if (fromUser != null) return EffectiveSetting(fromUser, ConfigSource.user);
+      if (fromBundle != null) return EffectiveSetting(fromBundle, ConfigSource.bundleDefault);
+      return EffectiveSetting(builtIn, ConfigSource.builtIn);
+    }
+
+    T? fromSection<T>(String section, T value) => config != null && config.sets(section) ? value : null;
+
+    final tunnelByDefault = pick<bool>(
+        'splitTunnel', org?.tunnelByDefault, config?.tunnelByDefault, local.tunnelByDefault, true);
+    final killSwitch = alwaysOn
+        ? EffectiveSetting(true, ConfigSource.alwaysOn)
+        : pick<bool>('killSwitch', null, fromSection('killSwitch', config?.killSwitch), local.killSwitch, false);
+    // Only the bundle sets these; a kill switch the user turns on keeps LAN
+    // access
+    final allowLan = pick<bool>('killSwitch', null, fromSection('killSwitch', config?.allowLan), null, true);
+    final dnsServers = pick<List<String>>('dns', null, fromSection('dns', config?.dnsServers), null, const []);
+    final searchDomains =
+        pick<List<String>>('dns', null, fromSection('dns', config?.searchDomains), null, const []);
+    final malwareProtection = pick<bool>('malwareProtection', null,
+        fromSection('malwareProtection', config?.malwareProtection), local.malwareProtection, false);
+    final parentalControls = pick<ParentalProfile?>('parentalControls', null,
+        fromSection('parentalControls', config?.parentalControls), local.parentalControls, null);
+
+    // Candidate rules in priority order; the first for each site wins
+    final candidates = <SiteRule>[
+      if (config != null)
+        for (final site in config.blocklist) SiteRule(site, 'block', ConfigSource.bundle),
+      if (org != null) ...[
+        for (final site in org.block) SiteRule(site, 'block', ConfigSource.orgPolicy),
+        for (final site in org.direct) SiteRule(site, 'direct', ConfigSource.orgPolicy),
+        for (final site in org.tunnel) SiteRule(site, 'tunnel', ConfigSource.orgPolicy),
+      ],
+      if (config != null && config.enforces('splitTunnel')) ..._bundleRules(config, ConfigSource.bundle),
+      for (final entry in local.networkSites.entries)
+        SiteRule(entry.key, 'network:${entry.value}', ConfigSource.user),
+      for (final entry in local.sites.entries)
+        SiteRule(entry.key, entry.value ? 'tunnel' : 'direct', ConfigSource.user),
+      if (config != null && !config.enforces('splitTunnel'))
+        ..._bundleRules(config, ConfigSource.bundleDefault),
+    ];
+    final bySite = <String, SiteRule>{};
+    final rules = <SiteRule>[];
+    for (final rule in candidates) {
+      final winner = bySite[rule.site];
+      if (winner == null) {
+        bySite[rule.site] = rule;
+        rules.add(rule);
+      } else {
+        winner.overridden.add(rule);
+      }
+    }
+
+    return EffectiveConfig._(
+        tunnelByDefault, killSwitch, allowLan, dnsServers, searchDomains, malwareProtection, parentalControls, rules);
+  }
+
+  static List<SiteRule> _bundleRules(ClientConfig config, ConfigSource source) => [
+        for (final site in config.direct) SiteRule(site, 'direct', source),
+        for (final site in config.tunnel) SiteRule(site, 'tunnel', source),
+      ];
+
+  Map<String, dynamic> toJson() => {
+        'tunnelByDefault': tunnelByDefault.toJson(),
+        'killSwitch': killSwitch.toJson(),
+        'allowLan': allowLan.toJson(),
+        'dnsServers': dnsServers.toJson(),
+        'searchDomains': searchDomains.toJson(),
+        'malwareProtection': malwareProtection.toJson(),
+        'parentalControls': parentalControls.toJson(),
+        'rules': rules.map((r) => r.toJson()).toList(),
+      };
+}
@@ -0,0 +1,58 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+
+// Varies how the client opens tunnels so connections from different users
+// don't all look alike to a censor:
+//
+//   --dart-define=HORSEVPN_CONNECT_JITTER_MS=<n>  wait 0..n ms before connecting
+//   --dart-define=HORSEVPN_HANDSHAKE_PADDING=true pad the upgrade request with
+//                                                 a cookie of random length
+//   --dart-define=HORSEVPN_DECOY_PATHS=/,/favicon.ico
+//                                                 fetch these pages from the
+//                                                 node first, in random
+//                                                 order, like a browser would
+const int connectJitterMs = int.fromEnvironment('HORSEVPN_CONNECT_JITTER_MS');
+const bool handshakePadding = bool.fromEnvironment('HORSEVPN_HANDSHAKE_PADDING');
+const String decoyPaths = String.fromEnvironment('HORSEVPN_DECOY_PATHS');
+
+class HandshakeVariation {
+  final Random _random = Random.secure();
+
+  // Runs before each tunnel connects to route
+  Future<void> beforeConnect(String route, HttpClient client) async {
+    if (connectJitterMs > 0) {
+      await Future.delayed(Duration(milliseconds: _random.nextInt(connectJitterMs + 1)));
+    }
+    await _fetchDecoys(route, client);
+  }
+
+  // Headers to add to the upgrade request
+  Map<String, String> headers() {
+    if (!handshakePadding) return const {};
+    final pad = List<int>.generate(8 + _random.nextInt(185), (_) => _random.nextInt(256));
+    return {'Cookie': '_p=${base64Url.encode(pad).replaceAll('=', '')}'};
+  }
+
+  Future<void> _fetchDecoys(String route, HttpClient client) async {
+    final paths = decoyPaths.split(',').map((p) => p.trim()).where((p) => p.isNotEmpty).toList()
+      ..shuffle(_random);
+    if (paths.isEmpty) return;
+
+    final ws = Uri.parse(route);
+    for (final path in paths) {
+      try {
+        final request = await client.getUrl(Uri(
+          scheme: ws.scheme == 'wss' ? 'https' : 'http',
+          host: ws.host,
+          port: ws.hasPort ? ws.port : null,
+          path: path,
+        ));
+        final response = await request.close();
+        await response.drain<void>();
+      } catch (e) {
+        // Only there for show; the tunnel doesn't depend on it
+      }
+    }
+  }
+}
@@ -0,0 +1,165 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'package:http2/http2.dart';
+import 'messages.dart';
+
+// Tunnels as HTTP/2 CONNECT streams, all sharing one TLS connection to the
+// node; see the server's h2connect.go. This gets through corporate proxies
+// that allow CONNECT but break WebSockets: with HTTPS_PROXY set, the
+// connection to the node is itself made through the proxy.
+class H2Connection {
+  H2Connection._(this._transport, this._authority);
+
+  final ClientTransportConnection _transport;
+  final String _authority;
+
+  bool get isOpen => _transport.isOpen;
+
+  // route is the node's WebSocket URL; CONNECT streams go to the same host
+  static Future<H2Connection> connect(
+    String route, {
+    bool Function(X509Certificate cert)? onBadCertificate,
+  }) async {
+    final uri = Uri.parse(route);
+    final port = uri.hasPort ? uri.port : 443;
+
+    final SecureSocket socket;
+    final proxy = _proxyFromEnvironment();
+    if (proxy != null) {
+      final tunnel = await _connectThroughProxy(proxy, uri.host, port);
+      socket = await SecureSocket.secure(
+        tunnel,
+        host: uri.host,
+        supportedProtocols: ['h2'],
+        onBadCertificate: onBadCertificate,
+      );
+    } else {
+      socket = await SecureSocket.connect(
+        uri.host,
+        port,
+        supportedProtocols: ['h2'],
+        onBadCertificate: onBadCertificate,
+      );
+    }
+    if (socket.selectedProtocol != 'h2') {
+      socket.destroy();
+      throw Exception('${uri.host} does not speak HTTP/2');
+    }
+    return H2Connection._(
+      ClientTransportConnection.viaSocket(socket),
+      '${uri.host}:$port',
+    );
+  }
+
+  // Opens a tunnel on a new stream, completing once the node accepts it
+  Future<H2Tunnel> open(Map<String, String> headers) async {
+    final stream = _transport.makeRequest([
+      Header.ascii(':method', 'CONNECT'),
+      Header.ascii(':authority', _authority),
+      for (final h in headers.entries) Header.ascii(h.key.toLowerCase(), h.value),
+    ]);
+    final tunnel = H2Tunnel._();
+    final status = Completer<int>();
+    String? notice;
+
+    stream.incomingMessages.listen((message) {
+      if (message is HeadersStreamMessage) {
+        for (final h in message.headers) {
+          if (ascii.decode(h.name) == 'x-notice') notice = ascii.decode(h.value);
+        }
+        for (final h in message.headers) {
+          if (ascii.decode(h.name) == ':status' && !status.isCompleted) {
+            status.complete(int.parse(ascii.decode(h.value)));
+          }
+        }
+      } else if (message is DataStreamMessage) {
+        tunnel._down.add(message.bytes);
+      }
+    }, onDone: () {
+      if (!status.isCompleted) {
+        status.completeError(Exception('Stream closed before the node answered'));
+      }
+      tunnel._down.close();
+    }, onError: (e) {
+      if (!status.isCompleted) status.completeError(e);
+      tunnel._down.close();
+    });
+
+    final code = await status.future;
+    if (code != 200) {
+      stream.terminate();
+      throw NoticeException('Tunnel refused: $code', notice);
+    }
+
+    tunnel._up.stream.listen((data) {
+      try {
+        stream.sendData(data);
+      } catch (e) {
+        // The stream is gone; the incoming side reports it
+      }
+    }, onDone: () => stream.outgoingMessages.close());
+    return tunnel;
+  }
+
+  Future<void> close() => _transport.terminate();
+
+  static Uri? _proxyFromEnvironment() {
+    final env = Platform.environment;
+    final proxy = env['HTTPS_PROXY'] ?? env['https_proxy'];
+    if (proxy == null || proxy.isEmpty) return null;
+    return Uri.parse(proxy.contains('://') ? proxy : 'http://$proxy');
+  }
+
+  // Asks an HTTP proxy for a raw TCP connection to host:port
+  static Future<Socket> _connectThroughProxy(Uri proxy, String host, int port) async {
+    final socket = await Socket.connect(proxy.host, proxy.hasPort ? proxy.port : 8080);
+    final request = StringBuffer()
+      ..write('CONNECT $host:$port HTTP/1.1\r\n')
+      ..write('Host: $host:$port\r\n');
+    if (proxy.userInfo.isNotEmpty) {
+      final credentials = base64Encode(utf8.encode(Uri.decodeComponent(proxy.userInfo)));
+      request.write('Proxy-Authorization: Basic $credentials\r\n');
+    }
+    request.write('\r\n');
+    socket.write(request);
+
+    // The node says nothing until our TLS hello, so the proxy's answer is
+    // all there is to read before handing the socket to SecureSocket
+    final answered = Completer<String>();
+    final response = <int>[];
+    final subscription = socket.listen((data) {
+      response.addAll(data);
+      final text = latin1.decode(response);
+      if (text.contains('\r\n\r\n') && !answered.isCompleted) {
+        answered.complete(text);
+      }
+    }, onDone: () {
+      if (!answered.isCompleted) {
+        answered.completeError(Exception('Proxy closed the connection'));
+      }
+    }, onError: (e) {
+      if (!answered.isCompleted) answered.completeError(e);
+    });
+
+    final text = await answered.future;
+    subscription.pause();
+    final statusLine = text.substring(0, text.indexOf('\r\n')).split(' ');
+    if (statusLine.length < 2 || statusLine[1] != '200') {
+      socket.destroy();
+      throw Exception('Proxy refused CONNECT: ${statusLine.join(' ')}');
+    }
+    return socket;
+  }
+}
+
+// One tunnel; mirrors the parts of WebSocketChannel the proxy uses
+class H2Tunnel {
+  H2Tunnel._();
+
+  final StreamController<List<int>> _down = StreamController();
+  final StreamController<List<int>> _up = StreamController();
+
+  Stream<List<int>> get stream => _down.stream;
+  StreamSink<List<int>> get sink => _up.sink;
+}
@@ -0,0 +1,154 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+import 'socks.dart';
+
+// The local proxy's HTTP frontend (desktop only), for applications that
+// only speak HTTP proxies, on localhost:8118 next to SOCKS on 1080:
+//
+//   HTTPS_PROXY=http://localhost:8118 HTTP_PROXY=http://localhost:8118 curl https://example.com
+//
+// CONNECT host:port opens a tunnel to the destination, as a SOCKS CONNECT
+// would, and answers 200 once the node has reached it. A plain HTTP request
+// with an absolute URI (GET http://example.com/ HTTP/1.1) goes to the URI's
+// host, port 80 by default, in origin form with the Proxy-* headers taken
+// out and Connection: close, so a request for another host never reuses
+// the tunnel. Failures get 403 when the node may not go there and 502
+// otherwise. Credentials come as Proxy-Authorization: Basic, with the same
+// password and routing hints in the username as SOCKS (see RoutingHints):
+//
+//   curl --proxy http://country=Germany:x@localhost:8118 https://example.com
+//
+// Only HTTP/1.x is spoken; the tunnel's own traffic can be anything.
+class HttpProxyStart {
+  // Longest request head we read before giving up
+  static const int _maxHead = 64 * 1024;
+  static const List<int> _endOfHead = [13, 10, 13, 10];
+
+  // Reads the application's request and returns the tunnel to open for it.
+  // Throws FormatException, after answering, if it can't be served.
+  static Future<SocksStart> accept(Socket socket, {String password = ''}) async {
+    final reader = HandshakeReader(socket);
+    try {
+      final head = await reader.readUntil(_endOfHead, _maxHead);
+      if (head == null) throw const FormatException('Truncated HTTP proxy request');
+      final lines = latin1.decode(head).split('\r\n');
+      final requestLine = lines.first.split(' ');
+      if (requestLine.length != 3 || !requestLine[2].startsWith('HTTP/1.')) {
+        _refuse(socket, 400, 'Bad Request');
+        throw FormatException('Bad HTTP proxy request', lines.first);
+      }
+      final method = requestLine[0];
+      final version = requestLine[2];
+      final headers = lines.sublist(1).where((l) => l.isNotEmpty).toList();
+
+      final RoutingHints? hints;
+      try {
+        hints = _authenticate(headers, password);
+      } on FormatException {
+        _refuse(socket, 407, 'Proxy Authentication Required', ['Proxy-Authenticate: Basic realm="HorseVPN"']);
+        rethrow;
+      }
+
+      if (method == 'CONNECT') {
+        final target = Uri.tryParse('//${requestLine[1]}');
+        if (target == null || target.host.isEmpty || !target.hasPort) {
+          _refuse(socket, 400, 'Bad Request');
+          throw FormatException('Bad CONNECT target', requestLine[1]);
+        }
+        reader.consume();
+        return SocksStart.connect(reader.rest(), hints, target.host, target.port,
+            translateReply: (code) => code == 0 ? utf8.encode('$version 200 Connection established\r\n\r\n') : _failure(code));
+      }
+
+      final uri = Uri.tryParse(requestLine[1]);
+      if (uri == null || uri.scheme != 'http' || uri.host.isEmpty) {
+        _refuse(socket, 400, 'Bad Request');
+        throw FormatException('Not an absolute http URI', requestLine[1]);
+      }
+      // The request goes on in origin form, as the server expects it
+      final path = '${uri.path.isEmpty ? '/' : uri.path}${uri.hasQuery ? '?${uri.query}' : ''}';
+      final forwarded = [
+        '$method $path $version',
+        for (final header in headers)
+          if (!_hopByHop(header)) header,
+        'Connection: close',
+        '',
+        '',
+      ].join('\r\n');
+      reader.consume();
+      final rest = reader.rest();
+      Stream<Uint8List> request() async* {
+        yield latin1.encode(forwarded);
+        yield* rest;
+      }
+
+      return SocksStart.connect(
+        request(),
+        hints,
+        uri.host,
+        uri.port,
+        translateReply: (code) => code == 0 ? const <int>[] : _failure(code),
+      );
+    } catch (e) {
+      reader.cancel();
+      rethrow;
+    }
+  }
+
+  // The hints in Proxy-Authorization's username. With a password set, the
+  // header must carry it. Throws FormatException if it doesn't, or on an
+  // unknown hint.
+  static RoutingHints? _authenticate(List<String> headers, String password) {
+    final value = _header(headers, 'proxy-authorization');
+    if (value == null) {
+      if (password.isNotEmpty) throw const FormatException('No proxy credentials');
+      return null;
+    }
+    final parts = value.split(' ');
+    if (parts.length != 2 || parts[0].toLowerCase() != 'basic') throw const FormatException('Unsupported proxy credentials');
+    final String credentials;
+    try {
+      credentials = utf8.decode(base64.decode(parts[1]), allowMalformed: true);
+    } on FormatException {
+      throw const FormatException('Malformed proxy credentials');
+    }
+    final colon = credentials.indexOf(':');
+    final user = colon < 0 ? credentials : credentials.substring(0, colon);
+    final pass = colon < 0 ? '' : credentials.substring(colon + 1);
+    if (password.isNotEmpty && pass != password) throw const FormatException('Wrong proxy password');
+    return RoutingHints.parse(user);
+  }
+
+  static String? _header(List<String> headers, String name) {
+    for (final header in headers) {
+      final colon = header.indexOf(':');
+      if (colon > 0 && header.substring(0, colon).trim().toLowerCase() == name) {
+        return header.substring(colon + 1).trim();
+      }
+    }
+    return null;
+  }
+
+  // Headers meant for the proxy, or for the connection we replace
+  static bool _hopByHop(String header) {
+    final name = header.split(':').first.trim().toLowerCase();
+    return name.startsWith('proxy-') || name == 'connection' || name == 'keep-alive';
+  }
+
+  static List<int> _failure(int code) =>
+      code == 2 ? _response(403, 'Forbidden') : _response(502, 'Bad Gateway');
+
+  static List<int> _response(int status, String reason, [List<String> headers = const []]) => latin1.encode([
+        'HTTP/1.1 $status $reason',
+        ...headers,
+        'Content-Length: 0',
+        'Connection: close',
+        '',
+        '',
+      ].join('\r\n'));
+
+  static void _refuse(Socket socket, int status, String reason, [List<String> headers = const []]) {
+    socket.add(_response(status, reason, headers));
+  }
+}
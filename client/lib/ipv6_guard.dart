@@ -0,0 +1,73 @@
+import 'dart:io';
+
+// IPv6 leak protection. Nodes carry IPv4 and, where their exit has it,
+// IPv6, but only for what goes through the tunnel; on a dual-stack network
+// an application that bypasses the proxy, or a system whose VPN only routes
+// IPv4, reaches IPv6 sites directly from the user's own address. With
+// --dart-define=HORSEVPN_IPV6=block, outgoing IPv6 to the internet
+// (2000::/3) is refused while the VPN is up, so applications fall back to
+// IPv4. Link-local and unique local addresses stay reachable, so neighbor
+// discovery, router advertisements and the LAN keep working.
+//
+// On the desktop the rule goes in the system firewall: ip6tables on Linux,
+// Windows Firewall on Windows. Both need administrator rights; without them
+// the proxy runs as usual and says so. On Android the VPN interface takes
+// IPv6 too and drops it. The rule is tagged, so one left behind by a crash
+// is replaced rather than doubled.
+const String ipv6Policy = String.fromEnvironment('HORSEVPN_IPV6', defaultValue: 'allow');
+
+const String _ruleName = 'horsevpn-ipv6';
+const String _internet = '2000::/3';
+
+class Ipv6Guard {
+  bool _active = false;
+
+  bool get enabled => ipv6Policy == 'block';
+  bool get active => _active;
+
+  // Blocks outgoing IPv6 to the internet, if the policy says so
+  Future<void> engage() async {
+    if (!enabled || _active) return;
+    await _remove();
+    final ok = await _run(_addCommand());
+    _active = ok;
+    print(ok ? 'Blocking outgoing IPv6 while connected' : 'Could not block outgoing IPv6; run with administrator rights');
+  }
+
+  Future<void> release() async {
+    if (!_active) return;
+    _active = false;
+    await _remove();
+  }
+
+  Future<void> _remove() async {
+    if (Platform.isWindows) {
+      await _run(['netsh', 'advfirewall', 'firewall', 'delete', 'rule', 'name=$_ruleName']);
+    } else if (Platform.isLinux) {
+      // -D removes one copy at a time
+      while (await _run(['ip6tables', '-D', 'OUTPUT', ..._linuxRule])) {}
+    }
+  }
+
+  List<String> _addCommand() {
+    if (Platform.isWindows) {
+      return ['netsh', 'advfirewall', 'firewall', 'add', 'rule', 'name=$_ruleName',
+          'dir=out', 'action=block', 'remoteip=$_internet'];
+    }
+    return ['ip6tables', '-I', 'OUTPUT', ..._linuxRule];
+  }
+
+  // Rejected rather than dropped, so applications try IPv4 at once
+  static const List<String> _linuxRule = ['-d', _internet, '-m', 'comment', '--comment', _ruleName,
+      '-j', 'REJECT', '--reject-with', 'icmp6-adm-prohibited'];
+
+  static Future<bool> _run(List<String> command) async {
+    if (!Platform.isWindows && !Platform.isLinux) return false;
+    try {
+      final result = await Process.run(command.first, command.sublist(1));
+      return result.exitCode == 0;
+    } on ProcessException {
+      return false;
+    }
+  }
+}
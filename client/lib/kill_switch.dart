@@ -0,0 +1,251 @@
+import 'dart:io';
+import 'dart:typed_data';
+
+// Kill switch enforcement (desktop only). On its own the kill switch only
+// keeps the proxy and PAC script in charge, so applications that ignore
+// the proxy still go out directly, and so does everything while the client
+// reconnects. With --dart-define=HORSEVPN_KILL_SWITCH_FIREWALL=block or
+// revert, and the kill switch on, the system firewall allows outgoing
+// traffic only to the node, the addresses the client needs to reach a node
+// (the sync server, the route service, geolocation and the DNS upstream),
+// loopback, DHCP and IPv6 neighbor discovery, and the LAN with allowLan.
+// When the tunnel goes down unexpectedly (the network changed, or a dial
+// failed), block keeps the rules, so nothing leaks until the client is
+// back; revert removes them until it is. They are removed for good on
+// `horsevpn down`, on trusted networks, on exit and when the kill switch
+// is turned off.
+//
+// On Linux the rules go in an nftables table, or iptables and ip6tables
+// chains where nft isn't installed; on Windows in a Windows Firewall (WFP)
+// rule blocking every address but those. All need administrator rights;
+// without them the client runs as usual and says so. Elsewhere, macOS
+// included, there is no backend, so the mode is off and the client says
+// that instead. The rules are tagged,
+// so those left behind by a crash stay in force until the next run
+// replaces them.
+const String killSwitchFirewallMode = String.fromEnvironment('HORSEVPN_KILL_SWITCH_FIREWALL', defaultValue: 'off');
+
+const String _ruleName = 'horsevpn-killswitch';
+const String _nftTable = 'horsevpn_killswitch';
+const String _chain = 'HORSEVPN-KILLSWITCH';
+
+// Private, link-local and local multicast ranges
+const List<String> _lan = [
+  '10.0.0.0/8', '172.16.0.0/12', '192.168.0.0/16', '169.254.0.0/16', '224.0.0.0/24', '255.255.255.255/32',
+  'fc00::/7', 'fe80::/10', 'ff02::/16',
+];
+
+class KillSwitchFirewall {
+  bool _active = false;
+  bool _useIptables = false;
+  // The hosts traffic may go to, and their addresses when last looked up;
+  // an address is kept when a lookup fails, as it will while blocked
+  final Map<String, List<InternetAddress>> _endpoints = {};
+  bool _allowLan = true;
+  bool _unsupportedReported = false;
+
+  static bool get supported => Platform.isLinux || Platform.isWindows;
+  bool get _requested => killSwitchFirewallMode == 'block' || killSwitchFirewallMode == 'revert';
+  bool get enabled => _requested && supported;
+  bool get active => _active;
+
+  // Allows only endpoints, URLs or hosts, and the rest described above.
+  // Called again whenever the node changes.
+  Future<void> engage(Iterable<String> endpoints, {required bool allowLan}) async {
+    if (_requested && !supported && !_unsupportedReported) {
+      _unsupportedReported = true;
+      print('The kill switch firewall is unsupported on this platform; traffic can leave outside the tunnel');
+    }
+    if (!enabled) return;
+    final hosts = endpoints.map(_host).where((host) => host.isNotEmpty).toSet();
+    _endpoints.removeWhere((host, _) => !hosts.contains(host));
+    for (final host in hosts) {
+      await _resolve(host);
+    }
+    _allowLan = allowLan;
+    final wasActive = _active;
+    _active = await _apply();
+    if (_active && !wasActive) {
+      print('Blocking traffic outside the tunnel');
+    } else if (!_active) {
+      print('Could not install the kill switch firewall rules; run with administrator rights');
+    }
+  }
+
+  // Adds an endpoint, such as a node a routing hint picked, while engaged
+  Future<void> allow(String endpoint) async {
+    final host = _host(endpoint);
+    if (!_active || host.isEmpty || _endpoints.containsKey(host)) return;
+    await _resolve(host);
+    _active = await _apply();
+  }
+
+  // The tunnel went down without being asked to
+  Future<void> dropped() async {
+    if (!_active) return;
+    if (killSwitchFirewallMode == 'revert') {
+      await release();
+      print('Tunnel down, firewall rules removed until it is back');
+    } else {
+      print('Tunnel down, blocking traffic until it is back');
+    }
+  }
+
+  Future<void> release() async {
+    if (!_active) return;
+    _active = false;
+    await _remove();
+  }
+
+  static String _host(String endpoint) {
+    if (!endpoint.contains('://')) return endpoint;
+    return Uri.tryParse(endpoint)?.host ?? '';
+  }
+
+  Future<void> _resolve(String host) async {
+    final address = InternetAddress.tryParse(host);
+    if (address != null) {
+      _endpoints[host] = [address];
+      return;
+    }
+    try {
+      _endpoints[host] = await InternetAddress.lookup(host);
+    } on SocketException {
+      _endpoints.putIfAbsent(host, () => []);
+    }
+  }
+
+  List<String> get _allowed => [
+        '127.0.0.0/8', '::1/128',
+        for (final addresses in _endpoints.values)
+          for (final address in addresses)
+            '${address.address}/${address.type == InternetAddressType.IPv4 ? 32 : 128}',
+        if (_allowLan) ..._lan,
+      ];
+
+  Future<bool> _apply() async {
+    if (Platform.isWindows) {
+      await _remove();
+      final ranges = _blockedRanges(_allowed);
+      // One rule per family, as netsh won't mix them
+      return await _run(['netsh', 'advfirewall', 'firewall', 'add', 'rule', 'name=$_ruleName',
+              'dir=out', 'action=block', 'remoteip=${ranges.v4.join(',')}']) &&
+          await _run(['netsh', 'advfirewall', 'firewall', 'add', 'rule', 'name=$_ruleName',
+              'dir=out', 'action=block', 'remoteip=${ranges.v6.join(',')}']);
+    }
+    if (!_useIptables) {
+      if (await _applyNft()) return true;
+      // No nft, or a kernel without nf_tables
+      _useIptables = true;
+    }
+    return await _applyIptables('iptables') && await _applyIptables('ip6tables');
+  }
+
+  Future<void> _remove() async {
+    if (Platform.isWindows) {
+      await _run(['netsh', 'advfirewall', 'firewall', 'delete', 'rule', 'name=$_ruleName']);
+    } else if (Platform.isLinux) {
+      await _run(['nft', 'delete', 'table', 'inet', _nftTable]);
+      for (final command in ['iptables', 'ip6tables']) {
+        // -D removes one copy at a time
+        while (await _run([command, '-D', 'OUTPUT', '-j', _chain])) {}
+        await _run([command, '-F', _chain]);
+        await _run([command, '-X', _chain]);
+      }
+    }
+  }
+
+  // Replaces the table in one go, so nothing slips through while the node
+  // changes
+  Future<bool> _applyNft() async {
+    final rules = StringBuffer()
+      ..writeln('table inet $_nftTable {}')
+      ..writeln('delete table inet $_nftTable')
+      ..writeln('table inet $_nftTable {')
+      ..writeln('  chain output {')
+      ..writeln('    type filter hook output priority 0; policy accept;')
+      ..writeln('    oifname "lo" accept')
+      ..writeln('    udp sport 68 udp dport 67 accept')
+      ..writeln('    meta l4proto ipv6-icmp accept');
+    for (final cidr in _allowed) {
+      rules.writeln('    ${cidr.contains(':') ? 'ip6' : 'ip'} daddr $cidr accept');
+    }
+    rules
+      ..writeln('    reject')
+      ..writeln('  }')
+      ..writeln('}');
+    final file = File('${Directory.systemTemp.path}/$_ruleName.nft');
+    try {
+      await file.writeAsString(rules.toString());
+      return await _run(['nft', '-f', file.path]);
+    } on FileSystemException {
+      return false;
+    } finally {
+      file.delete().catchError((e) => file);
+    }
+  }
+
+  Future<bool> _applyIptables(String command) async {
+    final v6 = command == 'ip6tables';
+    // The chain may be left from before; -N fails then, -F empties it
+    await _run([command, '-N', _chain]);
+    if (!await _run([command, '-F', _chain])) return false;
+    final rules = [
+      ['-o', 'lo'],
+      v6 ? ['-p', 'ipv6-icmp'] : ['-p', 'udp', '--sport', '68', '--dport', '67'],
+      for (final cidr in _allowed.where((cidr) => cidr.contains(':') == v6)) ['-d', cidr],
+    ];
+    for (final rule in rules) {
+      if (!await _run([command, '-A', _chain, ...rule, '-j', 'ACCEPT'])) return false;
+    }
+    if (!await _run([command, '-A', _chain, '-j', 'REJECT'])) return false;
+    if (!await _run([command, '-C', 'OUTPUT', '-j', _chain])) {
+      return _run([command, '-I', 'OUTPUT', '-j', _chain]);
+    }
+    return true;
+  }
+
+  static Future<bool> _run(List<String> command) async {
+    if (!Platform.isWindows && !Platform.isLinux) return false;
+    try {
+      final result = await Process.run(command.first, command.sublist(1));
+      return result.exitCode == 0;
+    } on ProcessException {
+      return false;
+    }
+  }
+}
+
+// Windows Firewall lets a block rule win over any allow rule, so instead of
+// allowing some addresses the rule blocks all the others, as ranges
+({List<String> v4, List<String> v6}) _blockedRanges(List<String> allowed) {
+  List<String> complement(InternetAddressType type, int bits) {
+    final intervals = <(BigInt, BigInt)>[];
+    for (final cidr in allowed) {
+      final [ip, prefix] = cidr.split('/');
+      final address = InternetAddress.tryParse(ip);
+      if (address == null || address.type != type) continue;
+      final start = address.rawAddress.fold(BigInt.zero, (n, byte) => n << 8 | BigInt.from(byte));
+      final size = BigInt.one << (bits - int.parse(prefix));
+      intervals.add((start ~/ size * size, start ~/ size * size + size - BigInt.one));
+    }
+    intervals.sort((a, b) => a.$1.compareTo(b.$1));
+    final ranges = <String>[];
+    var next = BigInt.zero;
+    final last = (BigInt.one << bits) - BigInt.one;
+    for (final (start, end) in intervals) {
+      if (start > next) ranges.add('${_format(next, type)}-${_format(start - BigInt.one, type)}');
+      if (end >= next) next = end + BigInt.one;
+    }
+    if (next <= last) ranges.add('${_format(next, type)}-${_format(last, type)}');
+    return ranges;
+  }
+
+  return (v4: complement(InternetAddressType.IPv4, 32), v6: complement(InternetAddressType.IPv6, 128));
+}
+
+String _format(BigInt n, InternetAddressType type) {
+  final length = type == InternetAddressType.IPv4 ? 4 : 16;
+  final bytes = List.generate(length, (i) => (n >> (8 * (length - 1 - i))).toUnsigned(8).toInt());
+  return InternetAddress.fromRawAddress(Uint8List.fromList(bytes), type: type).address;
+}
@@ -0,0 +1,332 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+
+// Leak self-check, run with `horsevpn leakcheck` while connected. It asks
+// the sync server's /leakcheck echo endpoint which address a request comes
+// from, once through the local SOCKS proxy and once directly, and looks up
+// a random name under the sync server's leak check DNS zone both ways to
+// see which resolvers ask for it. It also sends a STUN binding request
+// directly, as a browser's WebRTC would, and lists the machine's public
+// IPv6 addresses, since UDP and IPv6 don't have to go through the proxy.
+//
+// Each finding names its check (ip, dns, webrtc or ipv6) and an outcome;
+// the message for it is `leak.<check>.<outcome>` in the message catalog,
+// with its args, and the fix, if there is one, `leak.<check>.<outcome>.fix`.
+const Duration leakcheckTimeout = Duration(seconds: 10);
+
+// host:port of a STUN server, set with --dart-define=HORSEVPN_STUN_SERVER
+const String stunServer = String.fromEnvironment(
+  'HORSEVPN_STUN_SERVER',
+  defaultValue: 'stun.l.google.com:19302',
+);
+
+// ok: nothing leaks; warn: something could, in some applications; leak:
+// traffic through the tunnel gives the user away; skipped: not checked
+const List<String> leakLevels = ['ok', 'skipped', 'warn', 'leak'];
+
+class LeakFinding {
+  LeakFinding(this.check, this.level, this.outcome, [this.args = const {}]);
+
+  final String check;
+  final String level;
+  final String outcome;
+  final Map<String, String> args;
+
+  Map<String, dynamic> toJson() => {
+        'check': check,
+        'level': level,
+        'outcome': outcome,
+        'args': args,
+      };
+}
+
+// Checks everything at once. proxyPort is the local SOCKS proxy;
+// proxyPassword is its password, if it needs one.
+Future<List<LeakFinding>> runLeakcheck(String syncServerUrl,
+    {required int proxyPort, String proxyPassword = ''}) async {
+  final base = Uri.parse(syncServerUrl);
+  final proxy = _Socks(proxyPort, proxyPassword);
+
+  final direct = _directJson(base.resolve('/leakcheck'));
+  final tunneled = proxy.getJson(base.resolve('/leakcheck'));
+  final stun = _stunAddress().catchError((e) => null);
+  final ipv6 = _publicIpv6();
+
+  final findings = <LeakFinding>[];
+  Map<String, dynamic>? seen;
+  String? tunnelIp;
+  try {
+    seen = await direct;
+    final directIp = seen['ip'] as String?;
+    tunnelIp = (await tunneled)['ip'] as String?;
+    findings.add(tunnelIp == directIp
+        ? LeakFinding('ip', 'leak', 'leak', {'ip': '$tunnelIp'})
+        : LeakFinding('ip', 'ok', 'ok', {'tunnel': '$tunnelIp', 'direct': '$directIp'}));
+  } catch (e) {
+    tunneled.ignore();
+    findings.add(LeakFinding('ip', 'warn', 'failed', {'error': '$e'}));
+  }
+
+  final zone = seen?['dnsZone'] as String?;
+  findings.add(zone == null
+      ? LeakFinding('dns', 'skipped', 'off')
+      : await _checkDns(base, zone, proxy));
+
+  final stunIp = await stun;
+  if (stunIp == null) {
+    findings.add(LeakFinding('webrtc', 'ok', 'blocked'));
+  } else if (stunIp == tunnelIp) {
+    findings.add(LeakFinding('webrtc', 'ok', 'tunneled', {'ip': stunIp}));
+  } else {
+    findings.add(LeakFinding('webrtc', 'warn', 'exposed', {'ip': stunIp}));
+  }
+
+  final addresses = await ipv6;
+  findings.add(addresses.isEmpty
+      ? LeakFinding('ipv6', 'ok', 'none')
+      : LeakFinding('ipv6', 'warn', 'exposed', {'addresses': addresses.join(', ')}));
+  return findings;
+}
+
+// The worst level among findings
+String worstLeakLevel(Iterable<dynamic> levels) =>
+    levels.fold('ok', (worst, l) => leakLevels.indexOf('$l') > leakLevels.indexOf(worst) ? '$l' : worst);
+
+// Looks up one random name through the tunnel, where the node resolves it,
+// and another through the system resolver, then asks the sync server which
+// resolvers each lookup came from
+Future<LeakFinding> _checkDns(Uri base, String zone, _Socks proxy) async {
+  final tunnelToken = _token();
+  final localToken = _token();
+  await Future.wait([
+    // The node resolves the name to dial it; whether the dial works
+    // doesn't matter
+    proxy.connect('$tunnelToken.$zone', 443).then((s) => s.close()).catchError((e) {}),
+    InternetAddress.lookup('$localToken.$zone').catchError((e) => <InternetAddress>[]),
+  ]).timeout(leakcheckTimeout, onTimeout: () => []);
+
+  Future<Set<String>> resolvers(String token) async =>
+      ((await _directJson(base.resolve('/leakcheck/dns/$token')))['resolvers'] as List)
+          .map((r) => '$r')
+          .toSet();
+  final tunnel = await resolvers(tunnelToken);
+  final local = await resolvers(localToken);
+  if (tunnel.isEmpty) return LeakFinding('dns', 'warn', 'unreached');
+  final shared = tunnel.intersection(local);
+  if (shared.isNotEmpty) return LeakFinding('dns', 'leak', 'leak', {'resolvers': shared.join(', ')});
+  return LeakFinding('dns', 'ok', 'ok', {
+    'tunnel': tunnel.join(', '),
+    'local': local.isEmpty ? '-' : local.join(', '),
+  });
+}
+
+String _token() {
+  final random = Random.secure();
+  return List.generate(24, (_) => random.nextInt(36).toRadixString(36)).join();
+}
+
+Future<Map<String, dynamic>> _directJson(Uri uri) async {
+  final client = HttpClient()..connectionTimeout = leakcheckTimeout;
+  try {
+    final request = await client.getUrl(uri);
+    final response = await request.close().timeout(leakcheckTimeout);
+    final body = await utf8.decoder.bind(response).join();
+    if (response.statusCode != 200) throw HttpException('HTTP ${response.statusCode}', uri: uri);
+    return jsonDecode(body) as Map<String, dynamic>;
+  } finally {
+    client.close();
+  }
+}
+
+// The address a STUN server sees our UDP come from (RFC 5389 binding
+// request, XOR-MAPPED-ADDRESS), or null if it doesn't answer
+Future<String?> _stunAddress() async {
+  final separator = stunServer.lastIndexOf(':');
+  final host = stunServer.substring(0, separator);
+  final port = int.parse(stunServer.substring(separator + 1));
+  final server = (await InternetAddress.lookup(host, type: InternetAddressType.IPv4)).first;
+
+  final socket = await RawDatagramSocket.bind(InternetAddress.anyIPv4, 0);
+  try {
+    final random = Random.secure();
+    final transaction = List.generate(12, (_) => random.nextInt(256));
+    final request = BytesBuilder()
+      ..add([0x00, 0x01, 0x00, 0x00])
+      ..add(_stunCookie)
+      ..add(transaction);
+    final answer = Completer<String?>();
+    socket.listen((event) {
+      if (event != RawSocketEvent.read) return;
+      final datagram = socket.receive();
+      if (datagram == null || answer.isCompleted) return;
+      final address = _xorMappedAddress(datagram.data, transaction);
+      if (address != null) answer.complete(address);
+    });
+    // UDP may drop the request; send it a few times
+    for (var i = 0; i < 3 && !answer.isCompleted; i++) {
+      socket.send(request.toBytes(), server, port);
+      await Future.any([answer.future, Future.delayed(const Duration(seconds: 1))]);
+    }
+    return answer.isCompleted ? await answer.future : null;
+  } finally {
+    socket.close();
+  }
+}
+
+const List<int> _stunCookie = [0x21, 0x12, 0xa4, 0x42];
+
+String? _xorMappedAddress(Uint8List data, List<int> transaction) {
+  // Binding success response with our transaction ID
+  if (data.length < 20 || data[0] != 0x01 || data[1] != 0x01) return null;
+  for (var i = 0; i < 12; i++) {
+    if (data[8 + i] != transaction[i]) return null;
+  }
+  var offset = 20;
+  while (offset + 4 <= data.length) {
+    final type = data[offset] << 8 | data[offset + 1];
+    final length = data[offset + 2] << 8 | data[offset + 3];
+    final value = offset + 4;
+    if (value + length > data.length) return null;
+    // XOR-MAPPED-ADDRESS, IPv4: reserved, family, port, address
+    if (type == 0x0020 && length >= 8 && data[value + 1] == 0x01) {
+      return List.generate(4, (i) => data[value + 4 + i] ^ _stunCookie[i]).join('.');
+    }
+    offset = value + ((length + 3) & ~3);
+  }
+  return null;
+}
+
+// Global unicast IPv6 addresses of this machine's interfaces
+Future<List<String>> _publicIpv6() async {
+  final interfaces = await NetworkInterface.list(type: InternetAddressType.IPv6);
+  return [
+    for (final interface in interfaces)
+      for (final address in interface.addresses)
+        // 2000::/3; link-local, unique local and loopback addresses don't
+        // reach the internet
+        if ((address.rawAddress[0] & 0xe0) == 0x20) address.address,
+  ];
+}
+
+// A SOCKS5 client for the local proxy. RawSockets, so that a connection can
+// go on to TLS with the bytes after the handshake untouched.
+class _Socks {
+  _Socks(this.proxyPort, this.password);
+
+  final int proxyPort;
+  final String password;
+
+  // Opens a connection to host:port through the proxy
+  Future<_RawReader> connect(String host, int port) async {
+    final socket = await RawSocket.connect(InternetAddress.loopbackIPv4, proxyPort, timeout: leakcheckTimeout);
+    final reader = _RawReader(socket);
+    try {
+      await reader.write([5, 1, password.isNotEmpty ? 2 : 0]);
+      final method = await reader.read(2);
+      if (method[1] == 2) {
+        final user = utf8.encode('leakcheck');
+        final pass = utf8.encode(password);
+        await reader.write([1, user.length, ...user, pass.length, ...pass]);
+        if ((await reader.read(2))[1] != 0) throw const SocketException('The proxy refused its password');
+      } else if (method[1] != 0) {
+        throw const SocketException('The proxy wants a password');
+      }
+      final name = utf8.encode(host);
+      await reader.write([5, 1, 0, 3, name.length, ...name, port >> 8, port & 0xff]);
+      final reply = await reader.read(4);
+      if (reply[1] != 0) throw SocketException('The proxy could not connect to $host:$port (SOCKS reply ${reply[1]})');
+      final addressLength = switch (reply[3]) { 1 => 4, 4 => 16, _ => (await reader.read(1))[0] };
+      await reader.read(addressLength + 2);
+      return reader;
+    } catch (e) {
+      reader.close();
+      rethrow;
+    }
+  }
+
+  // GETs uri through the proxy, over TLS for https
+  Future<Map<String, dynamic>> getJson(Uri uri) async {
+    var conn = await connect(uri.host, uri.port).timeout(leakcheckTimeout);
+    try {
+      if (uri.scheme == 'https') {
+        conn = await conn.secure(uri.host);
+      }
+      final path = uri.hasQuery ? '${uri.path}?${uri.query}' : uri.path;
+      await conn.write(utf8.encode('GET $path HTTP/1.1\r\nHost: ${uri.hasPort ? '${uri.host}:${uri.port}' : uri.host}\r\n'
+          'Accept: application/json\r\nConnection: close\r\n\r\n'));
+      final response = utf8.decode(await conn.readAll().timeout(leakcheckTimeout), allowMalformed: true);
+      final split = response.indexOf('\r\n\r\n');
+      final status = response.split(' ');
+      if (split < 0 || status.length < 2 || status[1] != '200') {
+        throw HttpException('HTTP ${status.length < 2 ? '?' : status[1]} through the proxy', uri: uri);
+      }
+      return jsonDecode(response.substring(split + 4)) as Map<String, dynamic>;
+    } finally {
+      conn.close();
+    }
+  }
+}
+
+// Reads a RawSocket's bytes as they're asked for
+class _RawReader {
+  _RawReader(this.socket) {
+    _subscription = socket.listen((event) {
+      if (event == RawSocketEvent.read) {
+        final data = socket.read();
+        if (data != null) _buffer.addAll(data);
+      } else if (event == RawSocketEvent.readClosed || event == RawSocketEvent.closed) {
+        _closed = true;
+      }
+      _waiting?.complete();
+      _waiting = null;
+    }, onError: (e) {
+      _closed = true;
+      _waiting?.completeError(e);
+      _waiting = null;
+    });
+  }
+
+  final RawSocket socket;
+  late final StreamSubscription<RawSocketEvent> _subscription;
+  final List<int> _buffer = [];
+  bool _closed = false;
+  Completer<void>? _waiting;
+
+  Future<void> write(List<int> bytes) async {
+    var written = socket.write(bytes);
+    while (written < bytes.length) {
+      if (_closed) throw const SocketException('The proxy closed the connection');
+      await Future.delayed(const Duration(milliseconds: 10));
+      written += socket.write(bytes, written);
+    }
+  }
+
+  Future<List<int>> read(int n) async {
+    while (_buffer.length < n) {
+      if (_closed) throw const SocketException('The proxy closed the connection');
+      await (_waiting = Completer()).future;
+    }
+    final bytes = _buffer.sublist(0, n);
+    _buffer.removeRange(0, n);
+    return bytes;
+  }
+
+  Future<List<int>> readAll() async {
+    while (!_closed) {
+      await (_waiting = Completer()).future;
+    }
+    return _buffer;
+  }
+
+  // Continues the connection over TLS. The proxy's node is the one dialing,
+  // so the sync server's certificate is checked as usual.
+  Future<_RawReader> secure(String host) async =>
+      _RawReader(await RawSecureSocket.secure(socket, subscription: _subscription, host: host));
+
+  void close() {
+    socket.close();
+  }
+}
@@ -1,3 +1,4 @@
+import 'dart:async';
 import 'dart:io';
 import 'dart:convert';
 import 'package:flutter/material.dart';
@@ -5,8 +6,121 @@ import 'package:flutter/services.dart';
 import 'package:http/http.dart' as http;
 import 'package:web_socket_channel/web_socket_channel.dart';
 import 'package:web_socket_channel/io.dart';
+import 'auth.dart';
+import 'companion_api.dart';
+import 'config_bundle.dart';
+import 'dns_forwarder.dart';
+import 'dns_overrides.dart';
+import 'effective_config.dart';
+import 'fingerprint.dart';
+import 'netem.dart';
+import 'h2_transport.dart';
+import 'http_proxy.dart';
+import 'ipv6_guard.dart';
+import 'kill_switch.dart';
+import 'leakcheck.dart';
+import 'messages.dart';
+import 'migrating_tunnel.dart';
+import 'mux_tunnel.dart';
+import 'port_forwards.dart';
+import 'network_monitor.dart';
+import 'org_policy.dart';
+import 'parental_controls.dart';
+import 'poll_transport.dart';
+import 'preflight.dart';
+import 'socks.dart';
+import 'transparency.dart';
+import 'trusted_networks.dart';
+import 'udp_associate.dart';
+import 'virtual_networks.dart';
 
-void main() {
+// Opt-in anonymous connection quality reports, enabled with
+// --dart-define=HORSEVPN_TELEMETRY=true
+const bool telemetryEnabled = bool.fromEnvironment('HORSEVPN_TELEMETRY');
+// Password applications must give the local SOCKS proxy, set with
+// --dart-define=HORSEVPN_PROXY_PASSWORD=<password>; empty allows any local
+// application
+const String proxyPassword = String.fromEnvironment('HORSEVPN_PROXY_PASSWORD');
+// Tunnels that move to a new WebSocket when theirs degrades, enabled with
+// --dart-define=HORSEVPN_MIGRATE_TUNNELS=true; see migrating_tunnel.dart
+const bool migrateTunnels = bool.fromEnvironment('HORSEVPN_MIGRATE_TUNNELS');
+const String syncServerUrl = String.fromEnvironment(
+  'HORSEVPN_SYNC_SERVER',
+  defaultValue: 'https://vpnmanager.0x409.nl',
+);
+// Picks a node for a location, and tells us ours
+const String routeServiceUrl = 'https://horse.0x409.nl';
+const String geolocationUrl = 'http://ip-api.com';
+
+// Dedicated IP reservation token issued by the sync server operator, set with
+// --dart-define=HORSEVPN_DEDICATED_IP=<token>
+const String dedicatedIpToken = String.fromEnvironment('HORSEVPN_DEDICATED_IP');
+
+// Lazy dialing (desktop only): the proxy starts listening right away but
+// only looks up a route and signs in when the first connection arrives, and
+// after HORSEVPN_IDLE_TIMEOUT seconds without connections forgets the route
+// and closes its tunnels. --dart-define=HORSEVPN_LAZY_DIAL=true turns it on
+// by default; users change it with PUT /v1/lazy-dial on the companion API.
+const bool lazyDialByDefault = bool.fromEnvironment('HORSEVPN_LAZY_DIAL');
+
+// Always-on mode (desktop only), for managed machines where no traffic may
+// leave outside the tunnel: with --dart-define=HORSEVPN_ALWAYS_ON=true the
+// client dials as soon as it starts, whatever the lazy dial setting, and
+// holds the kill switch on, so trusted networks don't pause it and the
+// firewall rules stay in place through `horsevpn down`. Start the client
+// from a system service to have it connect before anyone logs in.
+const bool alwaysOn = bool.fromEnvironment('HORSEVPN_ALWAYS_ON');
+const int idleTimeoutSeconds = int.fromEnvironment(
+  'HORSEVPN_IDLE_TIMEOUT',
+  defaultValue: 300,
+);
+
+// HTTP/2 CONNECT (desktop only): with --dart-define=HORSEVPN_H2_CONNECT=true
+// tunnels are streams on one HTTP/2 connection to the node instead of
+// separate WebSockets, made through HTTPS_PROXY if that is set. The node
+// must serve TLS itself.
+const bool h2Connect = bool.fromEnvironment('HORSEVPN_H2_CONNECT');
+
+// Multiplexed tunnels (desktop only): with
+// --dart-define=HORSEVPN_MUX_TUNNELS=true connections are streams in one
+// long-lived WebSocket to the node instead of a WebSocket each; see
+// mux_tunnel.dart
+const bool muxTunnels = bool.fromEnvironment('HORSEVPN_MUX_TUNNELS');
+
+// Link-local discovery (mDNS and LLMNR) on Android, where the VPN takes the
+// whole device: with --dart-define=HORSEVPN_DISCOVERY=lan it stays on the
+// local network so printers and casting keep working (Android 13 and
+// later), with block it is dropped so the network doesn't hear the device
+// announce itself, and with tunnel it goes to the node like everything else.
+const String discoveryPolicy = String.fromEnvironment('HORSEVPN_DISCOVERY', defaultValue: 'lan');
+
+// HTTP proxy (desktop only): applications that only speak HTTP proxies can
+// use localhost:8118, or --dart-define=HORSEVPN_HTTP_PROXY_PORT=<port>, with
+// CONNECT or absolute URIs; see http_proxy.dart. 0 turns it off.
+const int httpProxyPort = int.fromEnvironment('HORSEVPN_HTTP_PROXY_PORT', defaultValue: 8118);
+
+// Seconds between the statistics nodes send about WebSocket tunnels, which
+// `horsevpn status` shows
+const int serverStatsInterval = 5;
+
+// How long the desktop proxy waits for open connections when told to exit
+const Duration shutdownDrainTimeout = Duration(seconds: 10);
+
+// Simulated network conditions from --netem; see netem.dart
+Netem? netem;
+
+Future<void> main(List<String> args) async {
+  try {
+    final spec = NetemSpec.fromArgs(args);
+    if (spec != null) {
+      netem = Netem(spec);
+      print('Simulating network conditions: $spec');
+    }
+  } on FormatException catch (e) {
+    stderr.writeln('--netem: ${e.message}: ${e.source}');
+    exit(64);
+  }
+  await Messages.load();
   runApp(const MyApp());
 }
 
@@ -33,10 +147,69 @@ class MyHomePage extends StatefulWidget {
 }
 
 class _MyHomePageState extends State<MyHomePage> {
-  String status = 'Initializing...';
+  String status = tr('status.initializing');
   String location = '';
   String route = '';
   bool isRunning = false;
+  final ProxyStats stats = ProxyStats();
+  CompanionApi? companion;
+  final OidcDeviceLogin oidcLogin = OidcDeviceLogin();
+  String? authToken;
+  // Set when connecting with a dedicated IP reservation; tokens are then
+  // fetched per connection for routeServerId
+  SessionTokens? sessionTokens;
+  String? routeServerId;
+  // Routes for connections with routing hints in their SOCKS username
+  final hintRoutes = HintRoutes(syncServerUrl);
+  // In flight while a lazy dial runs, so concurrent connections share it
+  Future<String>? dialing;
+  Timer? idleTimer;
+  NetworkMonitor? networkMonitor;
+  // Aborts each open tunnel; used to drop them when the network changes
+  final Set<void Function()> openTunnels = {};
+  // Consecutive failed WebSocket connects; after a few we assume the network
+  // breaks WebSockets and fall back to HTTP polling until the route changes.
+  // A preflight that found the same starts us on polling.
+  int wsFailures = 0;
+  bool usePolling = false;
+  // Shared by all tunnels in HTTP/2 CONNECT mode, for h2Route
+  Future<H2Connection>? h2Connection;
+  String h2Route = '';
+  // Shared by all tunnels with HORSEVPN_MUX_TUNNELS, for muxRoute
+  Future<MuxSession>? muxSession;
+  String muxRoute = '';
+  final HandshakeVariation handshakeVariation = HandshakeVariation();
+  TrustedNetworks trustedNetworks = TrustedNetworks();
+  final ipv6Guard = Ipv6Guard();
+  // From ~/.horsevpn/hosts.json
+  DnsOverrides dnsOverrides = DnsOverrides();
+  // Answers DNS on 127.0.0.1 through the tunnel, unless HORSEVPN_DNS_PORT
+  // is 0 or the port was taken
+  DnsForwarder? dnsForwarder;
+  final systemDns = SystemDns();
+  // With HORSEVPN_KILL_SWITCH_FIREWALL, holds traffic to the tunnel while
+  // the kill switch is on
+  final killSwitchFirewall = KillSwitchFirewall();
+  // With HORSEVPN_PORT_FORWARDS, takes the connections the node forwards
+  late final portForwarder = PortForwarder(
+    parsePortForwards(portForwardsSpec),
+    onSent: (n) => stats.bytesUp += n,
+    onReceived: (n) => stats.bytesDown += n,
+  );
+  // Refetches the organization's policy now and then
+  Timer? orgPolicyTimer;
+  // Set when HORSEVPN_CONFIG_PUBLIC_KEY is configured
+  ConfigBundles? configBundles;
+  // Named virtual networks from ~/.horsevpn/networks.json
+  List<NetworkProxy> networks = [];
+  // True while on a trusted network, where the proxy refuses connections
+  bool paused = false;
+  // True between `horsevpn down` and `horsevpn up`; the proxy refuses
+  // connections then too
+  bool down = false;
+  // Set by `horsevpn switch-server <location>`; dials go there instead of
+  // where geolocation puts us
+  String? pinnedLocation;
 
   @override
   void initState() {
@@ -44,30 +217,329 @@ class _MyHomePageState extends State<MyHomePage> {
     startVPN();
   }
 
+  // The user's choice from sites.json, or HORSEVPN_LAZY_DIAL
+  bool get lazyDial => !alwaysOn && (companion?.lazyDial ?? lazyDialByDefault);
+
   Future<void> startVPN() async {
     try {
-      setState(() => status = 'Getting location...');
-      final loc = await getLocation();
-      setState(() {
-        location = loc;
-        status = 'Getting route for $loc...';
-      });
-      final r = await getRoute(loc);
-      setState(() {
-        route = r;
-      });
+      final desktop = !(Platform.isAndroid || Platform.isIOS || Platform.isMacOS);
+      // Loads the lazy dial setting along with the rest of sites.json
+      if (desktop) await startCompanion();
+      if (lazyDial && desktop) {
+        await startProxyDesktop();
+        setState(() {
+          status = tr('status.lazy');
+          isRunning = true;
+        });
+        return;
+      }
+
+      final r = await dial();
       if (r.startsWith('wss://')) {
-        setState(() => status = 'Starting WebSocket proxy...');
+        setState(() => status = tr('status.starting'));
         await startProxy(r);
         setState(() {
-          status = 'Proxy running on localhost:1080';
+          status = tr('status.running');
           isRunning = true;
         });
       } else {
-        setState(() => status = 'No WebSocket route');
+        setState(() => status = tr('status.noRoute'));
       }
     } catch (e) {
-      setState(() => status = 'Error: $e');
+      setState(() => status = tr('status.error', {'error': Messages.current.describe(e)}));
+    }
+  }
+
+  // Looks up our location, unless at or pinnedLocation gives it, and our
+  // route, other than the servers in exclude, and gets credentials for the
+  // route
+  Future<String> dial({String? at, List<String> exclude = const []}) async {
+    setState(() => status = tr('status.gettingLocation'));
+    final loc = at ?? pinnedLocation ?? await getLocation();
+    setState(() {
+      location = loc;
+      status = tr('status.gettingRoute', {'location': loc});
+    });
+    final r = await getRoute(loc, exclude: exclude);
+    setState(() {
+      route = r;
+    });
+    if (!usePolling && await PreflightCache.prefersPolling(r)) {
+      print('Preflight found WebSockets blocked on this network, using HTTP polling');
+      setState(() => usePolling = true);
+    }
+    if (r.startsWith('wss://')) {
+      if (staticToken.isNotEmpty) {
+        authToken = staticToken;
+      } else if (OidcDeviceLogin.configured) {
+        setState(() => status = tr('status.signingIn'));
+        authToken = await oidcLogin.token((prompt) => setState(() =>
+            status = tr('status.signInPrompt', {'uri': prompt.verificationUri, 'code': prompt.userCode})));
+      } else if (dedicatedIpToken.isNotEmpty && routeServerId != null) {
+        sessionTokens = SessionTokens(syncServerUrl, dedicatedIpToken);
+        await sessionTokens!.token(routeServerId!);
+      }
+    }
+    return r;
+  }
+
+  // The route for a new connection, dialing first (to at, if given) if we
+  // don't have one
+  Future<String> ensureRoute({String? at, List<String> exclude = const []}) {
+    if (down) return Future.error(Exception('The VPN is down; run horsevpn up'));
+    idleTimer?.cancel();
+    // route is set partway through a dial, before we have credentials
+    if (dialing != null) return dialing!;
+    if (route.isNotEmpty) return Future.value(route);
+
+    return dialing = dial(at: at, exclude: exclude).then((r) async {
+      if (!r.startsWith('wss://')) {
+        route = '';
+        throw Exception('No WebSocket route');
+      }
+      // Before any tunnel opens to a node the rules don't know
+      await updateFirewall();
+      companion
+        ?..route = r
+        ..location = location;
+      if (muxTunnels && portForwarder.enabled) openForwardingSession(r);
+      setState(() => status = tr('status.running'));
+      return r;
+    }, onError: (e) async {
+      await killSwitchFirewall.dropped();
+      throw e;
+    }).whenComplete(() => dialing = null);
+  }
+
+  // Installs the kill switch's firewall rules for the current route, or
+  // removes them where the kill switch doesn't apply
+  Future<void> updateFirewall() async {
+    if (!killSwitch || paused || (down && !alwaysOn)) return killSwitchFirewall.release();
+    if (route.isEmpty) return;
+    await killSwitchFirewall.engage([
+      route,
+      syncServerUrl,
+      routeServiceUrl,
+      geolocationUrl,
+      ...effectiveConfig.dnsServers.value,
+      dnsUpstream,
+    ], allowLan: effectiveConfig.allowLan.value);
+  }
+
+  // Tunnels opened on the previous network are dead but TCP won't notice for
+  // minutes, so drop them now and make the next connection dial again; the
+  // route may differ from the new network too.
+  void networkChanged() {
+    print('Network changed, dropping ${openTunnels.length} tunnel(s) and re-dialing');
+    dropTunnels();
+    setState(() {
+      route = '';
+      status = tr('status.networkChanged');
+      // The new network may handle WebSockets fine
+      usePolling = false;
+      wsFailures = 0;
+    });
+    companion?.route = '';
+    killSwitchFirewall.dropped().whenComplete(checkTrustedNetwork);
+  }
+
+  void dropTunnels() {
+    hintRoutes.clear();
+    for (final abort in List.of(openTunnels)) {
+      abort();
+    }
+    for (final network in networks) {
+      network.dropTunnels();
+    }
+    h2Connection?.then((c) => c.close()).catchError((e) {});
+    h2Connection = null;
+    muxSession?.then((s) => s.close()).catchError((e) {});
+    muxSession = null;
+    dnsForwarder?.reset();
+  }
+
+  // Port forwards arrive in the multiplexed tunnel, so with any configured
+  // it opens as soon as there is a route
+  Future<void> openForwardingSession(String route) async {
+    try {
+      final token = sessionTokens != null ? await sessionTokens!.token(routeServerId!) : authToken;
+      await muxSessionFor(route, {
+        'Origin': 'https://horsevpn-client.localhost',
+        if (token != null) 'Authorization': 'Bearer $token',
+        if (effectiveConfig.malwareProtection.value) 'X-Tunnel-Policies': 'malware',
+      });
+    } catch (e) {
+      print('Multiplexed tunnel for port forwards unavailable: $e');
+    }
+  }
+
+  // The multiplexed tunnel to route's node, connecting (again) if there is
+  // none or it has dropped. It keeps the headers of the connection that
+  // opened it.
+  Future<MuxSession> muxSessionFor(String route, Map<String, String> headers) async {
+    final current = muxSession;
+    if (current != null && muxRoute == route) {
+      try {
+        final session = await current;
+        if (session.isOpen) return session;
+      } catch (e) {
+        // Connect failed last time, try again
+      }
+      if (!identical(muxSession, current)) return muxSessionFor(route, headers);
+    }
+    muxRoute = route;
+    final client = HttpClient()
+      ..badCertificateCallback = (cert, host, port) {
+        print('Warning: Certificate validation for $host - consider implementing pinning');
+        return true;
+      };
+    return muxSession = MuxSession.connect(route, headers, client)
+        .then((session) => session..onStream = portForwarder.enabled ? portForwarder.serve : null);
+  }
+
+  // The HTTP/2 connection to route's node, connecting (again) if there is
+  // none or it has dropped
+  Future<H2Connection> h2ConnectionFor(String route) async {
+    final current = h2Connection;
+    if (current != null && h2Route == route) {
+      try {
+        final conn = await current;
+        if (conn.isOpen) return conn;
+      } catch (e) {
+        // Connect failed last time, try again
+      }
+      // Another connection may have reconnected while we waited
+      if (!identical(h2Connection, current)) return h2ConnectionFor(route);
+    }
+    h2Route = route;
+    return h2Connection = H2Connection.connect(route, onBadCertificate: (cert) {
+      print('Warning: Certificate validation for $route - consider implementing pinning');
+      return true;
+    });
+  }
+
+  // Pushed configuration merged with the user's own; on mobile, where there
+  // is no companion API, only pushed configuration applies
+  EffectiveConfig get effectiveConfig =>
+      companion?.effective ??
+      EffectiveConfig.merge(bundle: configBundles?.current, local: LocalSettings(), alwaysOn: alwaysOn);
+
+  // With the kill switch on, nothing may bypass the tunnel
+  bool get killSwitch => effectiveConfig.killSwitch.value;
+
+  // Pauses the VPN on trusted networks and resumes it anywhere else. The
+  // kill switch overrides trusted networks.
+  Future<void> checkTrustedNetwork() async {
+    final trusted = !killSwitch && await trustedNetworks.isTrusted();
+    // The kill switch may have just been turned on or off
+    if (trusted == paused) return updateFirewall();
+
+    paused = trusted;
+    companion?.setPaused(trusted);
+    if (trusted) {
+      dropTunnels();
+      await ipv6Guard.release();
+      await systemDns.release();
+      await killSwitchFirewall.release();
+      setState(() {
+        route = '';
+        status = tr('status.trusted');
+      });
+      companion?.route = '';
+    } else {
+      // Stays down until `horsevpn up`
+      if (down) return;
+      setState(() => status = tr('status.untrusted'));
+      await ipv6Guard.engage();
+      if (dnsForwarder != null) await systemDns.engage();
+      if (!lazyDial) {
+        ensureRoute().catchError((e) {
+          setState(() => status = tr('status.error', {'error': Messages.current.describe(e)}));
+          return '';
+        });
+      }
+    }
+  }
+
+  // Applies the user's organization policy, if they have an account on the
+  // sync server (through their reservation token) and are in an org
+  Future<void> refreshOrgPolicy() async {
+    if (dedicatedIpToken.isEmpty) return;
+    try {
+      companion?.setOrgPolicy(await OrgPolicy.fetch(syncServerUrl, dedicatedIpToken));
+    } catch (e) {
+      // Keep the last policy we had
+      print('Organization policy refresh failed: $e');
+    }
+  }
+
+  // Loads the last config bundle we applied, then keeps asking the sync
+  // server for changes; each request waits there until the bundle changes
+  Future<void> startConfigBundles() async {
+    if (!ConfigBundles.configured || configBundles != null) return;
+    final bundles = configBundles = ConfigBundles(syncServerUrl, dedicatedIpToken);
+    await bundles.load();
+    applyConfigBundle();
+    () async {
+      while (true) {
+        try {
+          if (await bundles.poll(wait: const Duration(minutes: 4))) applyConfigBundle();
+        } catch (e) {
+          // Keep the bundle we have
+          print('Config bundle refresh failed: $e');
+          await Future.delayed(const Duration(minutes: 1));
+        }
+      }
+    }();
+  }
+
+  void applyConfigBundle() {
+    final bundle = configBundles?.current;
+    if (bundle != null) {
+      print('Applying config bundle ${bundle.scope} version ${bundle.version}');
+    }
+    companion?.setConfigBundle(bundle);
+    checkTrustedNetwork();
+  }
+
+  // Called when the last connection closes. In lazy mode the route is
+  // forgotten after the idle timeout, and the HTTP/2 and multiplexed
+  // connections to its node closed, so the next connection dials afresh
+  // (possibly from a different network).
+  void connectionsIdle() {
+    if (!lazyDial) return;
+    idleTimer?.cancel();
+    idleTimer = Timer(const Duration(seconds: idleTimeoutSeconds), () {
+      if (stats.activeConnections > 0 || !lazyDial) return;
+      h2Connection?.then((c) => c.close()).catchError((e) {});
+      h2Connection = null;
+      // Port forwards arrive through the multiplexed tunnel, so it stays
+      // open for them
+      if (!portForwarder.enabled) {
+        muxSession?.then((s) => s.close()).catchError((e) {});
+        muxSession = null;
+      }
+      setState(() {
+        route = '';
+        status = tr('status.idle');
+      });
+      companion?.route = '';
+    });
+  }
+
+  // PUT /v1/lazy-dial: going lazy starts the idle timeout if nothing is
+  // open, and going eager dials now
+  void lazyDialChanged() {
+    if (lazyDial) {
+      if (stats.activeConnections == 0) connectionsIdle();
+    } else {
+      idleTimer?.cancel();
+      if (!paused && !down) {
+        ensureRoute().catchError((e) {
+          setState(() => status = tr('status.error', {'error': Messages.current.describe(e)}));
+          return '';
+        });
+      }
     }
   }
 
@@ -75,15 +547,92 @@ class _MyHomePageState extends State<MyHomePage> {
     if (isRunning) {
       // Stop is complex, for now just restart
       setState(() {
-        status = 'Restarting...';
+        status = tr('status.restarting');
         isRunning = false;
       });
       startVPN();
     }
   }
 
+  // `horsevpn down`: drops the tunnels and refuses new connections until
+  // `horsevpn up`, without exiting
+  Future<void> goDown() async {
+    if (down) return;
+    down = true;
+    companion?.setDown(true);
+    await dialing?.catchError((e) => '');
+    dropTunnels();
+    await ipv6Guard.release();
+    await systemDns.release();
+    // Always-on keeps blocking until `horsevpn up`
+    if (!alwaysOn) await killSwitchFirewall.release();
+    setState(() {
+      route = '';
+      status = tr('status.down');
+    });
+    companion?.route = '';
+  }
+
+  // `horsevpn up`: undoes `horsevpn down` and dials now, unless we're paused
+  // on a trusted network
+  Future<void> up() async {
+    down = false;
+    companion?.setDown(false);
+    if (paused) return;
+    await ipv6Guard.engage();
+    if (dnsForwarder != null) await systemDns.engage();
+    await ensureRoute();
+  }
+
+  // `horsevpn switch-server`: drops the tunnels and dials again, to
+  // newLocation from now on if given, back to wherever geolocation puts us
+  // with auto, and otherwise to the location we have without looking it up
+  // again. Servers in exclude, by URL or ID, aren't picked.
+  Future<void> switchServer(String? newLocation, bool auto, {List<String> exclude = const []}) async {
+    if (down) throw Exception('The VPN is down; run horsevpn up');
+    if (paused) throw Exception('Paused on a trusted network');
+    pinnedLocation = auto ? null : newLocation ?? pinnedLocation;
+    companion?.pinnedLocation = pinnedLocation;
+    await dialing?.catchError((e) => '');
+    dropTunnels();
+    setState(() {
+      route = '';
+      // The new server may handle WebSockets fine
+      usePolling = false;
+      wsFailures = 0;
+    });
+    companion?.route = '';
+    await ensureRoute(at: (auto || location.isEmpty) ? null : pinnedLocation ?? location, exclude: exclude);
+  }
+
+  // `horsevpn rotate`: moves our multiplexed tunnel to another exit address
+  // of its node, when the node has one, and otherwise switches to another
+  // server in our location. Returns the new addresses, or null for a new
+  // server.
+  Future<List<String>?> rotate() async {
+    if (down) throw Exception('The VPN is down; run horsevpn up');
+    if (paused) throw Exception('Paused on a trusted network');
+    MuxSession? session;
+    try {
+      if (route.isNotEmpty && muxRoute == route) session = await muxSession;
+    } catch (e) {
+      // It never connected, so there is nothing to rotate
+    }
+    if (session != null && session.takes('rotate')) {
+      final reply = await session.control({'type': 'rotate'}).timeout(const Duration(seconds: 10));
+      final egress = (reply['egress'] as List? ?? []).cast<String>();
+      if (egress.isNotEmpty) {
+        print('Exit address rotated to ${egress.join(', ')}');
+        return egress;
+      }
+    }
+    if (dedicatedIpToken.isNotEmpty) throw Exception('A dedicated IP stays on its server');
+    await switchServer(null, false, exclude: [if (route.isNotEmpty) route, if (routeServerId != null) routeServerId!]);
+    return null;
+  }
+
   Future<String> getLocation() async {
-    final response = await http.get(Uri.parse('http://ip-api.com/json/'));
+    final response = await http.get(Uri.parse('$geolocationUrl/json/'));
     if (response.statusCode == 200) {
       final data = jsonDecode(response.body);
       return data['country'];
@@ -92,9 +641,16 @@ class _MyHomePageState extends State<MyHomePage> {
     }
   }
 
-  Future<String> getRoute(String location) async {
+  Future<String> getRoute(String location, {List<String> exclude = const []}) async {
+    if (dedicatedIpToken.isNotEmpty) {
+      return getDedicatedRoute(location);
+    }
+    if (exclude.isNotEmpty) {
+      return getRouteExcluding(location, exclude);
+    }
+
     final response = await http.post(
-      Uri.parse('https://horse.0x409.nl/route'),
+      Uri.parse('$routeServiceUrl/route'),
       headers: {'Content-Type': 'application/json'},
       body: jsonEncode({'location': location}),
     );
@@ -105,60 +661,521 @@ class _MyHomePageState extends State<MyHomePage> {
     }
   }
 
+  // Asks the sync server for a server other than those in exclude, which the
+  // route service can't do
+  Future<String> getRouteExcluding(String location, List<String> exclude) async {
+    final response = await http.post(
+      Uri.parse('$syncServerUrl/route'),
+      headers: {'Content-Type': 'application/json'},
+      body: jsonEncode({'location': location, 'exclude': exclude}),
+    );
+    if (response.statusCode == 200) {
+      final body = jsonDecode(response.body);
+      routeServerId = body['id'];
+      return body['url'];
+    } else if (response.statusCode == 404) {
+      throw Exception('No other server in $location');
+    } else {
+      throw Exception('Failed to get route');
+    }
+  }
+
+  // Devices are tracked per dedicated IP reservation, whether or not we've
+  // connected with it yet
+  SessionTokens reservationDevices() {
+    if (dedicatedIpToken.isEmpty) throw Exception('Devices are only tracked with a dedicated IP reservation');
+    return sessionTokens ?? SessionTokens(syncServerUrl, dedicatedIpToken);
+  }
+
+  // Asks the sync server for the server pinned to our reservation. If it is
+  // offline we fail rather than silently exiting from a different address.
+  Future<String> getDedicatedRoute(String location) async {
+    final response = await http.post(
+      Uri.parse('$syncServerUrl/route'),
+      headers: {'Content-Type': 'application/json'},
+      body: jsonEncode({'location': location, 'dedicatedIp': dedicatedIpToken}),
+    );
+    if (response.statusCode == 200) {
+      final body = jsonDecode(response.body);
+      routeServerId = body['id'];
+      return body['url'];
+    } else if (response.statusCode == 409) {
+      throw Exception('Dedicated IP server is currently unavailable');
+    } else {
+      throw Exception('Failed to get dedicated route');
+    }
+  }
+
+  // Checks each transport to the sync server's candidates for our location,
+  // and to our current route, and caches the results for this network
+  Future<List<PreflightResult>> preflight() async {
+    final loc = location.isNotEmpty ? location : await getLocation();
+    final response = await http.post(
+      Uri.parse('$syncServerUrl/route'),
+      headers: {'Content-Type': 'application/json'},
+      body: jsonEncode({
+        'location': loc,
+        if (dedicatedIpToken.isNotEmpty) 'dedicatedIp': dedicatedIpToken,
+      }),
+    );
+    if (response.statusCode != 200) {
+      throw Exception('Failed to get candidates: ${response.statusCode}');
+    }
+    final candidates = ((jsonDecode(response.body)['candidates'] as List?) ?? [])
+        .cast<Map<String, dynamic>>();
+    if (route.isNotEmpty && !candidates.any((c) => c['url'] == route)) {
+      candidates.add({'id': routeServerId ?? '', 'location': location, 'url': route});
+    }
+    final results = await runPreflight(candidates, {
+      'Origin': 'https://horsevpn-client.localhost',
+      if (authToken != null) 'Authorization': 'Bearer $authToken',
+    });
+    await PreflightCache.save(results);
+    return results;
+  }
+
+  // Checks, through our own proxy, that the public IP and DNS resolvers
+  // sites see are the tunnel's
+  Future<List<LeakFinding>> leakcheck() async {
+    await ensureRoute();
+    return runLeakcheck(syncServerUrl, proxyPort: 1080, proxyPassword: proxyPassword);
+  }
+
+  // On SIGINT or SIGTERM the proxy stops taking connections and gives those
+  // open up to shutdownDrainTimeout to finish before exiting. A second
+  // signal exits at once.
+  void watchShutdown(List<ServerSocket> servers) {
+    var stopping = false;
+    for (final signal in [ProcessSignal.sigint, if (!Platform.isWindows) ProcessSignal.sigterm]) {
+      signal.watch().listen((sig) async {
+        if (stopping) exit(1);
+        stopping = true;
+        print('Received $sig, waiting for ${stats.activeConnections} connection(s) to finish');
+        for (final server in servers) {
+          await server.close();
+        }
+        final deadline = DateTime.now().add(shutdownDrainTimeout);
+        while (stats.activeConnections > 0 && DateTime.now().isBefore(deadline)) {
+          await Future.delayed(const Duration(milliseconds: 250));
+        }
+        if (stats.activeConnections > 0) {
+          print('Closing ${stats.activeConnections} connection(s) that did not finish in time');
+        }
+        dropTunnels();
+        for (final network in networks) {
+          await network.stop();
+        }
+        await companion?.stop();
+        await ipv6Guard.release();
+        await systemDns.release();
+        await killSwitchFirewall.release();
+        await dnsForwarder?.stop();
+        exit(0);
+      });
+    }
+  }
+
   Future<void> startProxy(String route) async {
     const platform = MethodChannel('horsevpn');
     if (Platform.isAndroid || Platform.isIOS || Platform.isMacOS) {
-      await platform.invokeMethod('startVPN', {'route': route});
+      await startConfigBundles();
+      final config = effectiveConfig;
+      await platform.invokeMethod('startVPN', {
+        'route': route,
+        if (config.dnsServers.value.isNotEmpty) 'dnsServers': config.dnsServers.value,
+        if (config.searchDomains.value.isNotEmpty) 'searchDomains': config.searchDomains.value,
+        'blockIpv6': ipv6Policy == 'block',
+        'discovery': discoveryPolicy,
+      });
     } else {
-      await startProxyDesktop(route);
+      await startProxyDesktop();
+    }
+  }
+
+  // Reports connect latency and throughput for the server we used. Only the
+  // server URL and the measurements are sent; failures are ignored.
+  Future<void> reportTelemetry(String route, int connectMs, int bytes, Duration elapsed) async {
+    if (!telemetryEnabled) return;
+    final body = <String, dynamic>{'url': route, 'connectMs': connectMs};
+    if (elapsed.inMilliseconds >= 1000 && bytes > 0) {
+      body['throughputKbps'] = bytes * 8 / elapsed.inMilliseconds;
+    }
+    try {
+      await http.post(
+        Uri.parse('$syncServerUrl/telemetry'),
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode(body),
+      );
+    } catch (e) {
+      print('Telemetry report failed: $e');
+    }
+  }
+
+  // The companion API, once; starting it loads the user's settings from
+  // sites.json
+  Future<void> startCompanion() async {
+    if (companion != null) return;
+    companion = CompanionApi(stats: stats, proxyPort: 1080)
+      ..lazyDialByDefault = lazyDialByDefault
+      ..alwaysOn = alwaysOn
+      ..firewallBlocking = (() => killSwitchFirewall.active)
+      ..onKillSwitchChanged = checkTrustedNetwork
+      ..onLazyDialChanged = lazyDialChanged
+      ..onPreflight = preflight
+      ..onConnect = ensureRoute
+      ..onLeakcheck = leakcheck
+      ..onTransparency = Transparency(syncServerUrl).fetch
+      ..onUp = up
+      ..onDown = goDown
+      ..onSwitchServer = switchServer
+      ..onRotate = rotate
+      ..onDevices = (() => reservationDevices().devices())
+      ..onRevokeDevice = ((id) => reservationDevices().revokeDevice(id));
+    try {
+      await companion!.start();
+    } catch (e) {
+      print('Companion API unavailable: $e');
     }
   }
 
-  Future<void> startProxyDesktop(String route) async {
+  Future<void> startProxyDesktop() async {
     final server = await ServerSocket.bind(InternetAddress.loopbackIPv4, 1080);
-    server.listen((socket) async {
+    ServerSocket? httpServer;
+    if (httpProxyPort > 0) {
       try {
-        // Create secure WebSocket connection with certificate validation
-        final uri = Uri.parse(route);
+        httpServer = await ServerSocket.bind(InternetAddress.loopbackIPv4, httpProxyPort);
+      } catch (e) {
+        print('HTTP proxy unavailable on localhost:$httpProxyPort: $e');
+      }
+    }
+    watchShutdown([server, if (httpServer != null) httpServer]);
+
+    await startCompanion();
+    companion!
+      ..route = route
+      ..location = location;
+
+    await refreshOrgPolicy();
+    orgPolicyTimer ??= Timer.periodic(const Duration(minutes: 10), (_) => refreshOrgPolicy());
+
+    if (networks.isEmpty) {
+      for (final network in await VirtualNetwork.load()) {
+        final proxy = NetworkProxy(network, syncServerUrl, getLocation, netem);
+        try {
+          await proxy.start();
+          networks.add(proxy);
+        } catch (e) {
+          print('Virtual network ${network.name} unavailable: $e');
+        }
+      }
+      companion!.networks = networks;
+    }
+
+    trustedNetworks = await TrustedNetworks.load();
+    dnsOverrides = await DnsOverrides.load();
+    companion!.parentalControls = await loadParentalProfile();
+    if (dnsForwarderPort > 0 && dnsForwarder == null) {
+      final forwarder = DnsForwarder(
+        openRelay: openDnsRelay,
+        upstreams: () => effectiveConfig.dnsServers.value,
+        refuse: () => paused || down,
+        tunneled: () => route.isNotEmpty && dialing == null,
+        onSent: (n) => stats.bytesUp += n,
+        onReceived: (n) => stats.bytesDown += n,
+      );
+      try {
+        await forwarder.start();
+        dnsForwarder = forwarder;
+      } catch (e) {
+        print('DNS forwarder unavailable on 127.0.0.1:$dnsForwarderPort: $e');
+      }
+    }
+    dnsForwarder?.overrides = dnsOverrides;
+    await startConfigBundles();
+    await checkTrustedNetwork();
+    if (!paused) {
+      await ipv6Guard.engage();
+      if (dnsForwarder != null) await systemDns.engage();
+    }
+    networkMonitor ??= NetworkMonitor(networkChanged)..start();
+
+    server.listen((socket) => serveProxy(socket, () => SocksStart.accept(socket, password: proxyPassword)));
+    httpServer?.listen((socket) => serveProxy(socket, () => HttpProxyStart.accept(socket, password: proxyPassword)));
+  }
+
+  // A WebSocket to the current node's /udp relay, for the DNS forwarder
+  Future<IOWebSocketChannel> openDnsRelay() async {
+    final route = await ensureRoute();
+    final token = sessionTokens != null ? await sessionTokens!.token(routeServerId!) : authToken;
+    final client = HttpClient()
+      ..badCertificateCallback = (cert, host, port) {
+        print('Warning: Certificate validation for $host - consider implementing pinning');
+        return true;
+      };
+    final channel = IOWebSocketChannel.connect(
+      Uri.parse(route).replace(path: '/udp'),
+      protocols: ['vpn-protocol'],
+      headers: {
+        'Origin': 'https://horsevpn-client.localhost',
+        if (token != null) 'Authorization': 'Bearer $token',
+      },
+      customClient: client,
+    );
+    await channel.ready;
+    return channel;
+  }
+
+  // Tunnels one application connection to the local proxy, once accept has
+  // read where it goes
+  Future<void> serveProxy(Socket socket, Future<SocksStart> Function() accept) async {
+    if (paused || down) {
+      socket.destroy();
+      return;
+    }
+    SocksStart start;
+    try {
+      start = await accept();
+    } catch (e) {
+      print('Proxy handshake failed: $e');
+      socket.close();
+      return;
+    }
+    if (!start.udpAssociate) {
+      final blocked = effectiveConfig.parentalControls.value?.blocks(start.host, DateTime.now());
+      if (blocked != null) {
+        print('Blocked ${start.host} (parental: $blocked)');
+        stats.blocked = PolicyBlock(policy: 'parental', host: start.host, reason: blocked, at: DateTime.now());
+        socket.add(start.failureReply(SocksStart.notAllowed));
+        await socket.close();
+        return;
+      }
+      final override = dnsOverrides.rewrite(start.host, effectiveConfig.searchDomains.value);
+      if (override != null) start = start.redirect(override);
+    }
+    try {
+      final hints = start.hints;
+      // Hinted connections leave from the exit they ask for
+      final route = hints != null ? await hintRoutes.route(hints) : await ensureRoute();
+      if (hints != null) await killSwitchFirewall.allow(route);
+      // Create secure WebSocket connection with certificate validation
+      final uri = Uri.parse(route);
+      final token = sessionTokens != null && hints == null
+          ? await sessionTokens!.token(routeServerId!)
+          : authToken;
+      final headers = {
+        'Origin': 'https://horsevpn-client.localhost', // Set proper origin
+        if (token != null) 'Authorization': 'Bearer $token',
+        // Nodes without malware feeds refuse the tunnel rather than carry
+        // it unchecked
+        if (effectiveConfig.malwareProtection.value) 'X-Tunnel-Policies': 'malware',
+      };
+
+      if (start.udpAssociate) {
+        final client = HttpClient()
+          ..badCertificateCallback = (cert, host, port) {
+            print('Warning: Certificate validation for $host - consider implementing pinning');
+            return true;
+          };
+        final association = await UdpAssociation.open(
+          socket, start.stream, start.request, route, headers, client,
+          dnsOverrides: dnsOverrides,
+          onSent: (n) => stats.bytesUp += n,
+          onReceived: (n) => stats.bytesDown += n,
+        );
+        stats.activeConnections++;
+        stats.totalConnections++;
+        openTunnels.add(association.close);
+        await association.done;
+        openTunnels.remove(association.close);
+        stats.activeConnections--;
+        if (stats.activeConnections == 0) connectionsIdle();
+        return;
+      }
+
+      final connectTimer = Stopwatch()..start();
+      final Stream<dynamic> stream;
+      final StreamSink<dynamic> sink;
+      // WebSocket tunnels pass on half-closes as empty messages
+      var halfClose = false;
+      IOWebSocketChannel? wsChannel;
+      if (h2Connect) {
+        final conn = await h2ConnectionFor(route);
+        final tunnel = await conn.open(headers);
+        stream = tunnel.stream;
+        sink = tunnel.sink;
+      } else if (muxTunnels && !usePolling && hints == null) {
+        final session = await muxSessionFor(route, headers);
+        final tunnel = session.open();
+        stream = tunnel.stream;
+        sink = tunnel.sink;
+        halfClose = true;
+      } else if (migrateTunnels && !usePolling) {
+        final tunnel = MigratingTunnel.connect(route, headers);
+        await tunnel.ready;
+        stream = tunnel.stream;
+        sink = tunnel.sink;
+      } else if (usePolling) {
+        final tunnel = PollTunnel.connect(route, headers);
+        await tunnel.ready;
+        stream = tunnel.stream;
+        sink = tunnel.sink;
+      } else {
+        final client = HttpClient()
+          ..badCertificateCallback = (cert, host, port) {
+            // In production, implement proper certificate pinning
+            // For now, accept certificates but log warnings
+            print('Warning: Certificate validation for $host - consider implementing pinning');
+            return true; // Allow connection but log security warning
+          };
+        await handshakeVariation.beforeConnect(route, client);
         final channel = IOWebSocketChannel.connect(
           uri,
           protocols: ['vpn-protocol'],
+          // The node sends live statistics for `horsevpn status`
+          // and the operator's announcements
           headers: {
-            'Origin': 'https://horsevpn-client.localhost', // Set proper origin
+            ...headers,
+            ...handshakeVariation.headers(),
+            'X-Tunnel-Stats': '$serverStatsInterval',
+            'X-Tunnel-Announcements': '1',
           },
-          customClient: HttpClient()
-            ..badCertificateCallback = (cert, host, port) {
-              // In production, implement proper certificate pinning
-              // For now, accept certificates but log warnings
-              print('Warning: Certificate validation for $host - consider implementing pinning');
-              return true; // Allow connection but log security warning
-            },
+          customClient: client,
         );
+        try {
+          await channel.ready;
+          wsFailures = 0;
+        } catch (e) {
+          if (hints != null) hintRoutes.forget(hints);
+          if (++wsFailures >= 3) {
+            print('WebSocket connects keep failing, falling back to HTTP polling');
+            setState(() => usePolling = true);
+          }
+          rethrow;
+        }
+        stream = channel.stream;
+        sink = channel.sink;
+        halfClose = true;
+        wsChannel = channel;
+      }
+      final connectMs = connectTimer.elapsedMilliseconds;
+      final sessionTimer = Stopwatch()..start();
+      var bytesReceived = 0;
 
-        await channel.ready;
+      stats.activeConnections++;
+      stats.totalConnections++;
+      var counted = true;
+      void finished() {
+        if (counted) {
+          counted = false;
+          stats.activeConnections--;
+          if (stats.activeConnections == 0) connectionsIdle();
+        }
+      }
 
-        // Copy from socket to channel
-        socket.listen((data) {
-          channel.sink.add(data);
-        }, onDone: () {
-          channel.sink.close();
-        }, onError: (e) {
-          channel.sink.close();
-        });
+      void abort() {
+        openTunnels.remove(abort);
+        finished();
+        socket.destroy();
+        sink.close();
+      }
+      openTunnels.add(abort);
 
-        // Copy from channel to socket
-        channel.stream.listen((data) {
-          socket.add(data);
-        }, onDone: () {
-          socket.close();
-        }, onError: (e) {
-          socket.close();
-        });
-      } catch (e) {
-        print('WebSocket connection error: $e');
+      // Each direction can end on its own; the tunnel closes once both have
+      var upDone = false;
+      var downDone = false;
+
+      // The node dials the destination and answers the CONNECT
+      sink.add([...SocksStart.noAuthGreeting, ...start.request]);
+      var skipReply = SocksStart.greetingReplyLength;
+      // Collects the reply to the CONNECT for applications that don't speak
+      // SOCKS, to answer them in their own protocol
+      List<int>? reply = start.translateReply != null ? [] : null;
+
+      // Copy from socket to channel
+      (netem?.apply(start.stream) ?? start.stream).listen((data) {
+        stats.bytesUp += data.length;
+        sink.add(data);
+      }, onDone: () {
+        upDone = true;
+        if (halfClose && !downDone) {
+          sink.add(<int>[]);
+        } else {
+          sink.close();
+        }
+      }, onError: (e) {
+        sink.close();
+      });
+
+      // Copy from channel to socket
+      (netem?.apply(stream) ?? stream).listen((data) {
+        if (data is String) {
+          stats.server = ServerStats.tryParse(data) ?? stats.server;
+          final announcement = Announcement.tryParse(data);
+          if (announcement != null) {
+            setState(() => stats.announcement = announcement.message.isEmpty ? null : announcement);
+          }
+          final blocked = PolicyBlock.tryParse(data);
+          if (blocked != null) {
+            print('Blocked ${blocked.host} (${blocked.policy}: ${blocked.reason})');
+            stats.blocked = blocked;
+          }
+          return;
+        }
+        if (data is List<int>) {
+          if (halfClose && data.isEmpty) {
+            // The far end finished sending; Socket.close only shuts down
+            // our writing
+            downDone = true;
+            socket.close();
+            if (upDone) sink.close();
+            return;
+          }
+          if (skipReply > 0) {
+            // The node's answer to our greeting, which the app already
+            // had from us
+            final skip = skipReply < data.length ? skipReply : data.length;
+            skipReply -= skip;
+            data = data.sublist(skip);
+            if (data.isEmpty) return;
+          }
+          if (reply != null) {
+            reply!.addAll(data);
+            final length = SocksStart.replyLength(reply!);
+            if (length == null || reply!.length < length) return;
+            socket.add(start.translateReply!(reply![1]));
+            data = reply!.sublist(length);
+            reply = null;
+            if (data.isEmpty) return;
+          }
+          bytesReceived += data.length;
+          stats.bytesDown += data.length;
+        }
+        socket.add(data);
+      }, onDone: () {
+        openTunnels.remove(abort);
+        finished();
+        socket.close();
+        // The node closes with a policy violation when a stream limit is hit
+        final reason = wsChannel?.closeReason;
+        if (wsChannel?.closeCode == WebSocketStatus.policyViolation && reason != null) {
+          print('${start.target}: ${Messages.current.closeNotice(reason)}');
+        }
+        reportTelemetry(route, connectMs, bytesReceived, sessionTimer.elapsed);
+      }, onError: (e) {
+        openTunnels.remove(abort);
+        finished();
         socket.close();
+      });
+    } catch (e) {
+      print('WebSocket connection error for ${start.target}: $e');
+      // Refusals the user can act on, such as a session limit, show up in
+      // the status
+      if (e is NoticeException && e.notice != null) {
+        setState(() => status = Messages.current.describe(e));
       }
-    });
+      socket.add(start.failureReply(SocksStart.generalFailure));
+      socket.close();
+    }
   }
 
   @override
@@ -184,12 +1201,25 @@ class _MyHomePageState extends State<MyHomePage> {
                     const SizedBox(height: 8),
                     Text(status),
                     const SizedBox(height: 16),
+                    if (stats.announcement != null && !stats.announcement!.expired) ...[
+                      Text(
+                        tr('ui.announcement.${stats.announcement!.severity}', {'message': stats.announcement!.message}),
+                        style: TextStyle(
+                          color: stats.announcement!.severity == 'incident' ? Theme.of(context).colorScheme.error : null,
+                        ),
+                      ),
+                      const SizedBox(height: 16),
+                    ],
                     if (location.isNotEmpty) ...[
-                      Text('Location: $location'),
+                      Text(tr('ui.location', {'location': location})),
                       const SizedBox(height: 8),
                     ],
                     if (route.isNotEmpty) ...[
-                      Text('Route: $route'),
+                      Text(tr('ui.route', {'route': route})),
+                    ],
+                    if (netem != null) ...[
+                      const SizedBox(height: 8),
+                      Text(tr('ui.simulated', {'spec': netem!.spec})),
                     ],
                   ],
                 ),
@@ -198,7 +1228,7 @@ class _MyHomePageState extends State<MyHomePage> {
             const SizedBox(height: 32),
             ElevatedButton(
               onPressed: toggleVPN,
-              child: Text(isRunning ? 'Restart VPN' : 'Start VPN'),
+              child: Text(tr(isRunning ? 'ui.restart' : 'ui.start')),
             ),
           ],
         ),
@@ -0,0 +1,307 @@
+import 'dart:convert';
+import 'dart:io';
+
+// User-facing text in the user's language. Messages are looked up by key in
+// a catalog for the locale, then in the language's catalog (nl for nl_BE),
+// then in English. {name} in a message is replaced by the argument of that
+// name.
+//
+// The locale comes from --dart-define=HORSEVPN_LOCALE=<locale>, else from
+// LC_ALL, LC_MESSAGES or LANG, else from the system. Translations beyond the
+// built-in ones, or changes to them, go in ~/.horsevpn/locales/<locale>.json
+// as {"key": "message"}.
+//
+// Nodes mark refusals and closes the user should hear about with a notice
+// key: the X-Notice header on an HTTP answer, or the close reason of a
+// WebSocket close frame with underscores for spaces. Keys are stable while
+// the English text beside them may change, so the client shows its own
+// translation of the key and falls back to the node's text for keys it
+// doesn't know.
+const String localeOverride = String.fromEnvironment('HORSEVPN_LOCALE');
+
+const Map<String, Map<String, String>> builtinCatalogs = {
+  'en': {
+    'status.initializing': 'Initializing...',
+    'status.lazy': 'Proxy running on localhost:1080, connects on first use',
+    'status.starting': 'Starting WebSocket proxy...',
+    'status.running': 'Proxy running on localhost:1080',
+    'status.noRoute': 'No WebSocket route',
+    'status.error': 'Error: {error}',
+    'status.gettingLocation': 'Getting location...',
+    'status.gettingRoute': 'Getting route for {location}...',
+    'status.signingIn': 'Signing in...',
+    'status.signInPrompt': 'Sign in at {uri} with code {code}',
+    'status.networkChanged': 'Network changed, reconnecting on next use',
+    'status.trusted': 'On a trusted network, VPN paused',
+    'status.untrusted': 'Left trusted network, VPN resumed',
+    'status.idle': 'Idle, connects on next use',
+    'status.restarting': 'Restarting...',
+    'status.down': 'VPN down, run horsevpn up to reconnect',
+    'ui.location': 'Location: {location}',
+    'ui.route': 'Route: {route}',
+    'ui.announcement.info': 'Notice: {message}',
+    'ui.announcement.maintenance': 'Planned maintenance: {message}',
+    'ui.announcement.incident': 'Service incident: {message}',
+    'ui.simulated': 'Simulated network: {spec}',
+    'ui.start': 'Start VPN',
+    'ui.restart': 'Restart VPN',
+    'cli.unreachable': 'Could not reach the HorseVPN client: {error}',
+    'cli.noRules': 'No site rules',
+    'cli.rules': 'Site rules, first match wins:',
+    'cli.overrides': 'overrides {action} from {source}',
+    'cli.preflightFailed': 'Preflight failed: {error}',
+    'cli.noCandidates': 'No candidate servers',
+    'cli.server': 'Server',
+    'cli.location': 'Location',
+    'cli.system': '(system)',
+    'cli.noProfile': '(none)',
+    'cli.state.connected': 'Connected',
+    'cli.state.disconnected': 'Not connected, connects on next use',
+    'cli.state.paused': 'Paused on a trusted network',
+    'cli.state.down': 'Down, until horsevpn up',
+    'cli.pinnedLocation': 'Location chosen with switch-server: {location}',
+    'cli.alwaysOn': 'Always-on: the firewall blocks traffic outside the tunnel',
+    'cli.alwaysOnUnenforced': 'Always-on, but the firewall rules are not in place; traffic can leave outside the tunnel',
+    'cli.rotated': 'Exit address rotated to {egress}',
+    'cli.rotatedServer': 'Moved to another server for a new exit address',
+    'cli.blocked': 'Last blocked: {host} ({policy}, {reason})',
+    'cli.connections': 'Connections: {active} open, {total} in total',
+    'cli.serverLoad': 'Server load: {load}',
+    'cli.serverOverloaded': 'Server load: {load}, turning new connections away',
+    'cli.rateLimit': 'Rate limit: {rate}/s',
+    'cli.throttled': 'Rate limit: {rate}/s, slowing your connections down',
+    'cli.quota': 'Data this month: {used} of {quota}',
+    'cli.leakcheckFailed': 'Leak check failed: {error}',
+    'cli.transparencyFailed': 'Could not verify the transparency statement: {error}',
+    'cli.transparency.none': 'The operator publishes no transparency statement',
+    'cli.transparency.issued': 'Transparency statement #{sequence}, signed {issued}:',
+    'cli.transparency.nextUpdate': 'Next statement due by {date}',
+    'cli.transparency.stale': 'Warning: the next statement was due by {date} and has not appeared',
+    'cli.fix': 'Fix: {fix}',
+    'cli.devicesFailed': 'Could not manage devices: {error}',
+    'cli.devices.none': 'No devices have used this reservation',
+    'cli.devices.device': 'Device',
+    'cli.devices.name': 'Name',
+    'cli.devices.lastSeen': 'Last seen',
+    'cli.devices.current': '(this device)',
+    'cli.devices.revoked': '(revoked)',
+    'cli.deviceRevoked': 'Revoked device {id}; it can no longer connect',
+    'leak.ip.ok': 'Public IP: sites see {tunnel} through the tunnel rather than your own {direct}',
+    'leak.ip.leak': 'Public IP leak: sites see your own address {ip} through the tunnel',
+    'leak.ip.leak.fix': 'Reconnect with `horsevpn connect`; if it persists, the node shares your public address and cannot hide it',
+    'leak.ip.failed': 'Public IP: not checked, {error}',
+    'leak.dns.ok': 'DNS: names looked up through the tunnel go to {tunnel}, not to your resolver {local}',
+    'leak.dns.leak': 'DNS leak: names looked up through the tunnel reach your own resolver {resolvers}',
+    'leak.dns.leak.fix': 'Reconnect with `horsevpn connect`; if it persists, the node uses the same resolver as you',
+    'leak.dns.unreached': 'DNS: no lookup through the tunnel reached the sync server',
+    'leak.dns.off': 'DNS: not checked, the sync server has no leak check zone',
+    'leak.webrtc.blocked': 'WebRTC: UDP to the STUN server is blocked, so browsers cannot reveal your address through it',
+    'leak.webrtc.tunneled': 'WebRTC: the STUN server sees the tunnel address {ip}',
+    'leak.webrtc.exposed': 'WebRTC risk: UDP does not go through the proxy, so sites using WebRTC can see {ip}',
+    'leak.webrtc.exposed.fix': 'In Firefox set media.peerconnection.ice.proxy_only to true; in Chrome set the WebRTC IP handling policy to "Disable non-proxied UDP"',
+    'leak.ipv6.none': 'IPv6: no public IPv6 address on this machine',
+    'leak.ipv6.exposed': 'IPv6 risk: applications that bypass the proxy can use {addresses}',
+    'leak.ipv6.exposed.fix': 'Build with --dart-define=HORSEVPN_IPV6=block, or turn IPv6 off on this network interface',
+    'notice.unauthorized': 'The server refused your credentials',
+    'notice.overloaded': 'The server is overloaded, try again shortly',
+    'notice.session_limit': 'Too many devices are connected with your account',
+    'notice.tenant_quota': "Your organization's tunnel limit is reached",
+    'notice.e2e_required': 'The server requires end-to-end encryption',
+    'notice.stream_idle_timeout': 'A connection was closed after being idle too long',
+    'notice.stream_lifetime_limit': 'A connection was closed after reaching its time limit',
+    'notice.stream_byte_limit': 'A connection was closed after reaching its data limit',
+    'notice.quota_exceeded': "You have used this month's data allowance",
+  },
+  'nl': {
+    'status.initializing': 'Bezig met starten...',
+    'status.lazy': 'Proxy actief op localhost:1080, verbindt bij eerste gebruik',
+    'status.starting': 'WebSocket-proxy starten...',
+    'status.running': 'Proxy actief op localhost:1080',
+    'status.noRoute': 'Geen WebSocket-route',
+    'status.error': 'Fout: {error}',
+    'status.gettingLocation': 'Locatie bepalen...',
+    'status.gettingRoute': 'Route zoeken voor {location}...',
+    'status.signingIn': 'Aanmelden...',
+    'status.signInPrompt': 'Meld je aan op {uri} met code {code}',
+    'status.networkChanged': 'Netwerk gewijzigd, verbindt opnieuw bij volgend gebruik',
+    'status.trusted': 'Op een vertrouwd netwerk, VPN gepauzeerd',
+    'status.untrusted': 'Vertrouwd netwerk verlaten, VPN hervat',
+    'status.idle': 'Inactief, verbindt bij volgend gebruik',
+    'status.restarting': 'Opnieuw starten...',
+    'status.down': 'VPN uit, voer horsevpn up uit om weer te verbinden',
+    'ui.location': 'Locatie: {location}',
+    'ui.route': 'Route: {route}',
+    'ui.announcement.info': 'Mededeling: {message}',
+    'ui.announcement.maintenance': 'Gepland onderhoud: {message}',
+    'ui.announcement.incident': 'Storing: {message}',
+    'ui.simulated': 'Gesimuleerd netwerk: {spec}',
+    'ui.start': 'VPN starten',
+    'ui.restart': 'VPN herstarten',
+    'cli.unreachable': 'De HorseVPN-client is niet bereikbaar: {error}',
+    'cli.noRules': 'Geen siteregels',
+    'cli.rules': 'Siteregels, de eerste die past geldt:',
+    'cli.overrides': 'gaat voor {action} uit {source}',
+    'cli.preflightFailed': 'Preflight mislukt: {error}',
+    'cli.noCandidates': 'Geen kandidaat-servers',
+    'cli.server': 'Server',
+    'cli.location': 'Locatie',
+    'cli.system': '(systeem)',
+    'cli.noProfile': '(geen)',
+    'cli.state.connected': 'Verbonden',
+    'cli.state.disconnected': 'Niet verbonden, verbindt bij volgend gebruik',
+    'cli.state.paused': 'Gepauzeerd op een vertrouwd netwerk',
+    'cli.state.down': 'Uit, tot horsevpn up',
+    'cli.pinnedLocation': 'Locatie gekozen met switch-server: {location}',
+    'cli.alwaysOn': 'Altijd aan: de firewall blokkeert verkeer buiten de tunnel',
+    'cli.alwaysOnUnenforced': 'Altijd aan, maar de firewallregels zijn niet actief; verkeer kan buiten de tunnel om gaan',
+    'cli.rotated': 'Uitgangsadres gewisseld naar {egress}',
+    'cli.rotatedServer': 'Naar een andere server gegaan voor een nieuw uitgangsadres',
+    'cli.blocked': 'Laatst geblokkeerd: {host} ({policy}, {reason})',
+    'cli.connections': 'Verbindingen: {active} open, {total} in totaal',
+    'cli.serverLoad': 'Serverbelasting: {load}',
+    'cli.serverOverloaded': 'Serverbelasting: {load}, nieuwe verbindingen worden geweigerd',
+    'cli.rateLimit': 'Snelheidslimiet: {rate}/s',
+    'cli.throttled': 'Snelheidslimiet: {rate}/s, je verbindingen worden vertraagd',
+    'cli.quota': 'Data deze maand: {used} van {quota}',
+    'cli.leakcheckFailed': 'Lekcontrole mislukt: {error}',
+    'cli.transparencyFailed': 'De transparantieverklaring kon niet worden geverifieerd: {error}',
+    'cli.transparency.none': 'De beheerder publiceert geen transparantieverklaring',
+    'cli.transparency.issued': 'Transparantieverklaring #{sequence}, ondertekend op {issued}:',
+    'cli.transparency.nextUpdate': 'Volgende verklaring uiterlijk {date}',
+    'cli.transparency.stale': 'Let op: de volgende verklaring had er uiterlijk {date} moeten zijn en is er niet',
+    'cli.fix': 'Oplossing: {fix}',
+    'cli.devicesFailed': 'Apparaten beheren mislukt: {error}',
+    'cli.devices.none': 'Er hebben geen apparaten deze reservering gebruikt',
+    'cli.devices.device': 'Apparaat',
+    'cli.devices.name': 'Naam',
+    'cli.devices.lastSeen': 'Laatst gezien',
+    'cli.devices.current': '(dit apparaat)',
+    'cli.devices.revoked': '(ingetrokken)',
+    'cli.deviceRevoked': 'Apparaat {id} ingetrokken; het kan niet meer verbinden',
+    'leak.ip.ok': 'Publiek IP: sites zien via de tunnel {tunnel} in plaats van je eigen {direct}',
+    'leak.ip.leak': 'IP-lek: sites zien via de tunnel je eigen adres {ip}',
+    'leak.ip.leak.fix': 'Verbind opnieuw met `horsevpn connect`; blijft het, dan deelt de node je publieke adres en kan hij het niet verbergen',
+    'leak.ip.failed': 'Publiek IP: niet gecontroleerd, {error}',
+    'leak.dns.ok': 'DNS: namen die via de tunnel worden opgezocht gaan naar {tunnel}, niet naar je eigen resolver {local}',
+    'leak.dns.leak': 'DNS-lek: namen die via de tunnel worden opgezocht bereiken je eigen resolver {resolvers}',
+    'leak.dns.leak.fix': 'Verbind opnieuw met `horsevpn connect`; blijft het, dan gebruikt de node dezelfde resolver als jij',
+    'leak.dns.unreached': 'DNS: geen enkele opzoeking via de tunnel bereikte de sync-server',
+    'leak.dns.off': 'DNS: niet gecontroleerd, de sync-server heeft geen zone voor lekcontroles',
+    'leak.webrtc.blocked': 'WebRTC: UDP naar de STUN-server is geblokkeerd, dus browsers kunnen je adres er niet mee prijsgeven',
+    'leak.webrtc.tunneled': 'WebRTC: de STUN-server ziet het tunneladres {ip}',
+    'leak.webrtc.exposed': 'WebRTC-risico: UDP gaat niet via de proxy, dus sites die WebRTC gebruiken kunnen {ip} zien',
+    'leak.webrtc.exposed.fix': 'Zet in Firefox media.peerconnection.ice.proxy_only op true; kies in Chrome het WebRTC-IP-beleid "Disable non-proxied UDP"',
+    'leak.ipv6.none': 'IPv6: geen publiek IPv6-adres op deze machine',
+    'leak.ipv6.exposed': 'IPv6-risico: apps die de proxy omzeilen kunnen {addresses} gebruiken',
+    'leak.ipv6.exposed.fix': 'Bouw met --dart-define=HORSEVPN_IPV6=block, of zet IPv6 uit op deze netwerkinterface',
+    'notice.unauthorized': 'De server weigerde je inloggegevens',
+    'notice.overloaded': 'De server is overbelast, probeer het zo opnieuw',
+    'notice.session_limit': 'Er zijn te veel apparaten verbonden met je account',
+    'notice.tenant_quota': 'De tunnellimiet van je organisatie is bereikt',
+    'notice.e2e_required': 'De server vereist end-to-end-versleuteling',
+    'notice.stream_idle_timeout': 'Een verbinding is gesloten omdat ze te lang inactief was',
+    'notice.stream_lifetime_limit': 'Een verbinding is gesloten omdat haar tijdslimiet bereikt is',
+    'notice.stream_byte_limit': 'Een verbinding is gesloten omdat haar datalimiet bereikt is',
+    'notice.quota_exceeded': 'Je hebt de databundel van deze maand opgebruikt',
+  },
+};
+
+// A refusal from a node, with the notice key it came with, if any
+class NoticeException implements Exception {
+  const NoticeException(this.text, this.notice);
+
+  // In English, for logs
+  final String text;
+  final String? notice;
+
+  @override
+  String toString() => text;
+}
+
+class Messages {
+  Messages(this.locale, this._catalogs);
+
+  final String locale;
+  // Most specific first, English last
+  final List<Map<String, String>> _catalogs;
+
+  static Messages current = Messages('en', [builtinCatalogs['en']!]);
+
+  // Sets current to the messages for the detected locale
+  static Future<Messages> load() async {
+    final locale = detectLocale();
+    final language = locale.split('_').first;
+    final catalogs = <Map<String, String>>[];
+    for (final name in {locale, language, 'en'}) {
+      final user = await _userCatalog(name);
+      if (user != null) catalogs.add(user);
+      final builtin = builtinCatalogs[name];
+      if (builtin != null) catalogs.add(builtin);
+    }
+    return current = Messages(locale, catalogs);
+  }
+
+  // e.g. nl_NL from nl_NL.UTF-8 or nl-NL
+  static String detectLocale() {
+    final env = Platform.environment;
+    final raw = localeOverride.isNotEmpty
+        ? localeOverride
+        : [env['LC_ALL'], env['LC_MESSAGES'], env['LANG'], Platform.localeName]
+            .firstWhere((v) => v != null && v.isNotEmpty && v != 'C' && v != 'POSIX',
+                orElse: () => 'en')!;
+    return raw.split('.').first.split('@').first.replaceAll('-', '_');
+  }
+
+  static Future<Map<String, String>?> _userCatalog(String locale) async {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    final file = File('$home/.horsevpn/locales/$locale.json');
+    if (!await file.exists()) return null;
+    try {
+      return (jsonDecode(await file.readAsString()) as Map<String, dynamic>)
+          .map((k, v) => MapEntry(k, v.toString()));
+    } catch (e) {
+      print('Ignoring unreadable locales/$locale.json: $e');
+      return null;
+    }
+  }
+
+  // The message for key, or key itself if no catalog has it
+  String tr(String key, [Map<String, Object?> args = const {}]) =>
+      _format(_lookup(key) ?? key, args);
+
+  bool has(String key) => _lookup(key) != null;
+
+  // The message for a node's notice key, or fallback, the node's own text,
+  // for keys the catalogs don't have
+  String notice(String key, String fallback) => _lookup('notice.$key') ?? fallback;
+
+  // The message for a WebSocket close reason from a node
+  String closeNotice(String reason) => notice(reason.replaceAll(' ', '_'), reason);
+
+  // error for the user: translated if it carries a notice key
+  String describe(Object error) {
+    if (error is NoticeException && error.notice != null) {
+      return notice(error.notice!, error.text);
+    }
+    return '$error';
+  }
+
+  String? _lookup(String key) {
+    for (final catalog in _catalogs) {
+      final message = catalog[key];
+      if (message != null) return message;
+    }
+    return null;
+  }
+
+  static String _format(String message, Map<String, Object?> args) =>
+      message.replaceAllMapped(RegExp(r'\{(\w+)\}'), (m) {
+        final name = m[1]!;
+        return args.containsKey(name) ? '${args[name]}' : m[0]!;
+      });
+}
+
+// Shorthand for Messages.current.tr
+String tr(String key, [Map<String, Object?> args = const {}]) => Messages.current.tr(key, args);
@@ -0,0 +1,252 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+import 'package:http/http.dart' as http;
+import 'package:web_socket_channel/io.dart';
+import 'messages.dart';
+
+// A tunnel that survives its transport (desktop, with
+// --dart-define=HORSEVPN_MIGRATE_TUNNELS=true). It is a poll session on the
+// node carried over a WebSocket; see the server's migrate.go. Both
+// directions are numbered chunks kept until the other side acknowledges
+// them, so when the WebSocket breaks, or its round trip time climbs well
+// above the best we've seen, or data goes unacknowledged for too long, we
+// attach a fresh WebSocket to the same session, resend what wasn't
+// acknowledged and carry on. The application's connection never notices.
+// It mirrors the parts of WebSocketChannel the proxy uses: ready, stream
+// and sink.
+class MigratingTunnel {
+  MigratingTunnel._(this._route, this._headers);
+
+  final Uri _route;
+  final Map<String, String> _headers;
+  final http.Client _client = http.Client();
+
+  final StreamController<List<int>> _down = StreamController();
+  final StreamController<List<int>> _up = StreamController();
+  final Completer<void> _ready = Completer();
+
+  String? _sessionId;
+  IOWebSocketChannel? _carrier;
+  bool _closed = false;
+  bool _upDone = false;
+
+  // Upstream chunks the node hasn't acknowledged, oldest first
+  final List<_Chunk> _unacked = [];
+  int _upSeq = 0;
+  int _downNext = 0;
+
+  // Round trip times from acknowledgements, in milliseconds
+  double? _srtt;
+  double? _bestRtt;
+  Timer? _monitor;
+  DateTime _attachedAt = DateTime.now();
+  int _attachFailures = 0;
+
+  static const _chunk = 0;
+  static const _ack = 1;
+  static const _maxChunk = 64 * 1024;
+  // Carriers get this long before we judge them
+  static const _settle = Duration(seconds: 5);
+  static const _maxAttachFailures = 5;
+
+  Future<void> get ready => _ready.future;
+  Stream<List<int>> get stream => _down.stream;
+  StreamSink<List<int>> get sink => _up.sink;
+
+  static MigratingTunnel connect(String route, Map<String, String> headers) {
+    final tunnel = MigratingTunnel._(Uri.parse(route), headers);
+    tunnel._open();
+    return tunnel;
+  }
+
+  Uri _pollUrl(String path) => _route.replace(
+        scheme: _route.scheme == 'wss' ? 'https' : 'http',
+        path: '/poll/$path',
+      );
+
+  Future<void> _open() async {
+    try {
+      final response = await _client.post(_pollUrl('open'), headers: _headers);
+      if (response.statusCode != 200) {
+        throw NoticeException('Poll session refused: ${response.statusCode}', response.headers['x-notice']);
+      }
+      _sessionId = jsonDecode(response.body)['sessionId'];
+      await _attach();
+      _ready.complete();
+    } catch (e) {
+      _ready.completeError(e);
+      _shutdown();
+      return;
+    }
+
+    _monitor = Timer.periodic(const Duration(seconds: 1), (_) => _check());
+    _up.stream.listen((data) {
+      for (var i = 0; i < data.length; i += _maxChunk) {
+        final end = i + _maxChunk < data.length ? i + _maxChunk : data.length;
+        final chunk = _Chunk(_upSeq++, data.sublist(i, end));
+        _unacked.add(chunk);
+        _send(chunk);
+      }
+    }, onDone: () {
+      _upDone = true;
+      if (_unacked.isEmpty) _closeSession();
+    });
+  }
+
+  // Attaches a new WebSocket to the session, replacing the current one, and
+  // resends everything the node hasn't acknowledged
+  Future<void> _attach() async {
+    final old = _carrier;
+    _carrier = null;
+    old?.sink.close();
+
+    final carrier = IOWebSocketChannel.connect(
+      _route.replace(path: '/poll/$_sessionId/ws', queryParameters: {'ack': '$_downNext'}),
+      protocols: ['vpn-protocol'],
+      headers: {'Origin': 'https://horsevpn-client.localhost'},
+    );
+    await carrier.ready;
+    if (_closed) {
+      carrier.sink.close();
+      return;
+    }
+    _carrier = carrier;
+    _attachedAt = DateTime.now();
+    _srtt = null;
+    _bestRtt = null;
+    _attachFailures = 0;
+
+    carrier.stream.listen((message) {
+      if (message is List<int>) _receive(Uint8List.fromList(message));
+    }, onDone: () {
+      if (!identical(_carrier, carrier)) return;
+      if (carrier.closeCode == WebSocketStatus.normalClosure) {
+        // The session itself is over
+        _shutdown();
+      } else {
+        _migrate('carrier lost');
+      }
+    });
+
+    for (final chunk in _unacked) {
+      chunk.sentAt = null;
+      _send(chunk);
+    }
+  }
+
+  void _send(_Chunk chunk) {
+    final carrier = _carrier;
+    if (carrier == null) return;
+    // Timed from the first send on the current carrier
+    chunk.sentAt ??= DateTime.now();
+    carrier.sink.add(_frame(_chunk, chunk.seq, chunk.data));
+  }
+
+  void _receive(Uint8List message) {
+    if (message.length < 9) return;
+    final n = ByteData.sublistView(message).getUint64(1);
+    switch (message[0]) {
+      case _ack:
+        while (_unacked.isNotEmpty && _unacked.first.seq < n) {
+          final chunk = _unacked.removeAt(0);
+          if (_unacked.isEmpty || _unacked.first.seq >= n) _sample(chunk);
+        }
+        if (_upDone && _unacked.isEmpty) _closeSession();
+      case _chunk:
+        // Chunks before _downNext are repeats after a migration
+        if (n != _downNext || _closed) return;
+        _downNext++;
+        _down.add(message.sublist(9));
+        _carrier?.sink.add(_frame(_ack, _downNext));
+    }
+  }
+
+  void _sample(_Chunk chunk) {
+    final sentAt = chunk.sentAt;
+    if (sentAt == null) return;
+    final rtt = DateTime.now().difference(sentAt).inMicroseconds / 1000;
+    final srtt = _srtt;
+    _srtt = srtt == null ? rtt : srtt * 7 / 8 + rtt / 8;
+    final best = _bestRtt;
+    if (best == null || rtt < best) _bestRtt = rtt;
+  }
+
+  // Moves to a new carrier if this one has degraded
+  void _check() {
+    if (_closed || _carrier == null) return;
+    final now = DateTime.now();
+    if (now.difference(_attachedAt) < _settle) return;
+
+    final best = _bestRtt;
+    final srtt = _srtt;
+    if (best != null && srtt != null && srtt > best * 4 && srtt > best + 500) {
+      _migrate('round trip time up from ${best.round()}ms to ${srtt.round()}ms');
+      return;
+    }
+    final oldest = _unacked.isEmpty ? null : _unacked.first.sentAt;
+    final timeout = Duration(milliseconds: ((best ?? 1000) * 4).round().clamp(3000, 15000));
+    if (oldest != null && now.difference(oldest) > timeout) {
+      _migrate('no acknowledgement for ${now.difference(oldest).inSeconds}s');
+    }
+  }
+
+  Future<void> _migrate(String reason) async {
+    if (_closed) return;
+    print('Moving tunnel to a new carrier: $reason');
+    _carrier?.sink.close();
+    _carrier = null;
+    while (!_closed) {
+      try {
+        await _attach();
+        return;
+      } catch (e) {
+        if (++_attachFailures >= _maxAttachFailures) {
+          print('Giving up on tunnel after $_attachFailures failed carriers: $e');
+          _shutdown();
+          return;
+        }
+        await Future.delayed(Duration(milliseconds: 250 * _attachFailures));
+      }
+    }
+  }
+
+  static Uint8List _frame(int kind, int n, [List<int> data = const []]) {
+    final frame = Uint8List(9 + data.length);
+    final header = ByteData.sublistView(frame);
+    header.setUint8(0, kind);
+    header.setUint64(1, n);
+    frame.setRange(9, frame.length, data);
+    return frame;
+  }
+
+  Future<void> _closeSession() async {
+    if (_sessionId != null && !_closed) {
+      try {
+        await _client.delete(_pollUrl('$_sessionId'));
+      } catch (e) {
+        // The node expires idle sessions anyway
+      }
+    }
+    _shutdown();
+  }
+
+  void _shutdown() {
+    if (_closed) return;
+    _closed = true;
+    _monitor?.cancel();
+    _carrier?.sink.close();
+    _carrier = null;
+    _down.close();
+    _client.close();
+  }
+}
+
+class _Chunk {
+  _Chunk(this.seq, this.data);
+
+  final int seq;
+  final List<int> data;
+  DateTime? sentAt;
+}
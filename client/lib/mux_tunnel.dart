@@ -0,0 +1,447 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+import 'package:cryptography/cryptography.dart';
+import 'package:web_socket_channel/io.dart';
+import 'messages.dart';
+
+// Tunnels as streams in one long-lived WebSocket to the node (desktop, with
+// --dart-define=HORSEVPN_MUX_TUNNELS=true), so a new connection costs one
+// frame instead of a TLS and WebSocket handshake; see the server's mux
+// package for the framing. Each stream mirrors the parts of
+// WebSocketChannel the proxy uses, including half-closes as empty messages.
+// A node without multiplexing closes the WebSocket at the first frame.
+//
+// We ask for a resumable session. When its WebSocket drops we reconnect,
+// backing off from 100 ms to 5 s between attempts for up to 30 s, and the
+// node carries the session on with its streams intact: both sides count
+// the frames they receive, acknowledge them now and then, and resend what
+// the other hadn't received. Streams opened meanwhile wait in the replay
+// buffer. If the node no longer has the session (410), or we run out of
+// time, the streams end as if reset. Nodes that can't resume don't answer
+// with a token, and their sessions end with their WebSocket as before.
+//
+// Control frames carry JSON messages about the session as a whole, such
+// as a request to rotate its exit address, which the node answers in
+// order. We only send those the node lists in X-Tunnel-Mux-Control, since
+// others end the session.
+//
+// The node can open streams too, with even IDs, for connections to ports
+// forwarded to us (see port_forwards.dart); they go to onStream, or are
+// reset without it.
+class MuxSession {
+  MuxSession._(this._route, this._headers, this._client);
+
+  final Uri _route;
+  final Map<String, String> _headers;
+  final HttpClient _client;
+  IOWebSocketChannel? _channel;
+  final Map<int, MuxTunnel> _streams = {};
+  final BytesBuilder _pending = BytesBuilder();
+  int _nextId = 1;
+  bool _closed = false;
+
+  // Set for a resumable session
+  String? _token;
+  // Frames sent and not yet acknowledged, oldest first
+  final List<Uint8List> _replay = [];
+  int _sent = 0;
+  int _acked = 0;
+  int _received = 0;
+  int _receivedBytes = 0;
+  int _ackedUpTo = 0;
+  int _ackedBytes = 0;
+
+  // The control messages the node takes, and our messages it hasn't
+  // answered yet, oldest first
+  Set<String> _controls = {};
+  final List<Completer<Map<String, dynamic>>> _controlReplies = [];
+
+  static const _open = 0;
+  static const _data = 1;
+  static const _window = 2;
+  static const _close = 3;
+  static const _reset = 4;
+  static const _ack = 5;
+  static const _control = 6;
+  static const _headerSize = 7;
+  static const _maxPayload = 32 * 1024;
+  static const window = 256 * 1024;
+  // Acknowledge every this many frames or bytes, as the node does
+  static const _ackEvery = 16;
+  static const _ackBytes = 128 * 1024;
+  static const _resumeTimeout = Duration(seconds: 30);
+  static const _maxBackoff = Duration(seconds: 5);
+
+  // Gets the streams the node opens
+  void Function(MuxTunnel tunnel)? onStream;
+
+  // Open while reconnecting too: new streams go out once it resumes
+  bool get isOpen => !_closed;
+
+  static Future<MuxSession> connect(
+    String route,
+    Map<String, String> headers,
+    HttpClient client,
+  ) async {
+    final session = MuxSession._(Uri.parse(route), headers, client);
+    final response = await session._dial({'X-Tunnel-Mux-Resume': 'new'});
+    session._token = response.headers.value('X-Tunnel-Mux-Resume');
+    session._controls = _listed(response.headers.value('X-Tunnel-Mux-Control'));
+    session._attach(response.socket);
+    return session;
+  }
+
+  static Set<String> _listed(String? header) =>
+      (header ?? '').split(',').map((s) => s.trim()).where((s) => s.isNotEmpty).toSet();
+
+  // Opens a WebSocket to the node with extra headers, keeping the
+  // response's headers, which IOWebSocketChannel doesn't give us
+  Future<({WebSocket socket, HttpHeaders headers})> _dial(Map<String, String> extra) async {
+    final key = base64.encode(List.generate(16, (_) => Random.secure().nextInt(256)));
+    final request = await _client.openUrl(
+      'GET',
+      _route.replace(scheme: _route.scheme == 'wss' ? 'https' : 'http'),
+    );
+    request.followRedirects = false;
+    ({..._headers, 'X-Tunnel-Mux': 'mux1', ...extra}).forEach(request.headers.set);
+    request.headers
+      ..set(HttpHeaders.connectionHeader, 'Upgrade')
+      ..set(HttpHeaders.upgradeHeader, 'websocket')
+      ..set('Sec-WebSocket-Key', key)
+      ..set('Sec-WebSocket-Version', '13')
+      ..set('Sec-WebSocket-Protocol', 'vpn-protocol');
+    final response = await request.close();
+    if (response.statusCode != HttpStatus.switchingProtocols) {
+      await response.drain<void>();
+      throw MuxRefusedException(response.statusCode, response.headers.value('x-notice'));
+    }
+    final accept = await Sha1().hash(utf8.encode('${key}258EAFA5-E914-47DA-95CA-C5AB0DC85B11'));
+    if (response.headers.value('Sec-WebSocket-Accept') != base64.encode(accept.bytes)) {
+      (await response.detachSocket()).destroy();
+      throw HttpException('Bad WebSocket handshake', uri: _route);
+    }
+    final socket = WebSocket.fromUpgradedSocket(
+      await response.detachSocket(),
+      protocol: 'vpn-protocol',
+      serverSide: false,
+    );
+    return (socket: socket, headers: response.headers);
+  }
+
+  void _attach(WebSocket socket) {
+    final channel = _channel = IOWebSocketChannel(socket);
+    channel.stream.listen(
+      (message) {
+        if (message is List<int>) _receive(message);
+      },
+      onDone: () => _lost(channel),
+      onError: (e) => _lost(channel),
+    );
+  }
+
+  // The WebSocket under the session ended; a resumable session reconnects
+  void _lost(IOWebSocketChannel channel) {
+    if (!identical(channel, _channel)) return;
+    _channel = null;
+    _pending.clear();
+    if (_token == null || _closed) {
+      _shutdown();
+      return;
+    }
+    print('Multiplexed tunnel lost its connection, reconnecting (${_streams.length} streams)');
+    _resume();
+  }
+
+  Future<void> _resume() async {
+    final deadline = DateTime.now().add(_resumeTimeout);
+    var backoff = const Duration(milliseconds: 100);
+    for (var attempt = 1; !_closed; attempt++) {
+      try {
+        final response = await _dial({
+          'X-Tunnel-Mux-Resume': _token!,
+          'X-Tunnel-Mux-Received': '$_received',
+        });
+        final received = int.tryParse(response.headers.value('X-Tunnel-Mux-Received') ?? '');
+        if (received == null || received < _acked || received > _sent || _closed) {
+          response.socket.close();
+          break;
+        }
+        _acknowledge(received);
+        _attach(response.socket);
+        for (final frame in _replay) {
+          _channel!.sink.add(frame);
+        }
+        print('Resumed multiplexed tunnel after $attempt attempt(s) (${_streams.length} streams)');
+        return;
+      } on MuxRefusedException catch (e) {
+        if (e.statusCode == HttpStatus.gone) break;
+        print('Reconnecting multiplexed tunnel failed (attempt $attempt): $e');
+      } catch (e) {
+        print('Reconnecting multiplexed tunnel failed (attempt $attempt): $e');
+      }
+      if (DateTime.now().add(backoff).isAfter(deadline)) break;
+      await Future.delayed(backoff);
+      backoff = backoff * 2 > _maxBackoff ? _maxBackoff : backoff * 2;
+    }
+    if (!_closed) print("Can't resume multiplexed tunnel, resetting its ${_streams.length} streams");
+    _shutdown();
+  }
+
+  // Opens a stream; the node learns of it with the first frame, so there is
+  // nothing to wait for
+  MuxTunnel open() {
+    if (_closed) throw Exception('Multiplexed tunnel is closed');
+    final id = _nextId;
+    _nextId += 2;
+    final tunnel = MuxTunnel._(this, id);
+    _streams[id] = tunnel;
+    _send(_open, id);
+    tunnel._up.stream.listen(tunnel._write, onDone: tunnel._sinkClosed);
+    return tunnel;
+  }
+
+  // Whether the node takes control messages of type
+  bool takes(String type) => !_closed && _controls.contains(type);
+
+  // Sends the node a control message and waits for its answer
+  Future<Map<String, dynamic>> control(Map<String, dynamic> message) {
+    if (!takes(message['type'] as String)) {
+      return Future.error(Exception("The node doesn't take ${message['type']} messages"));
+    }
+    final reply = Completer<Map<String, dynamic>>();
+    _controlReplies.add(reply);
+    _send(_control, 0, utf8.encode(jsonEncode(message)));
+    return reply.future;
+  }
+
+  void close() {
+    // An empty message ends the session on the node, where a dropped
+    // WebSocket would leave it waiting for us
+    _channel?.sink.add(<int>[]);
+    _channel?.sink.close();
+    _shutdown();
+  }
+
+  void _send(int type, int id, [List<int> payload = const []]) {
+    if (_closed) return;
+    final frame = Uint8List(_headerSize + payload.length);
+    final header = ByteData.sublistView(frame);
+    header.setUint8(0, type);
+    header.setUint32(1, id);
+    header.setUint16(5, payload.length);
+    frame.setRange(_headerSize, frame.length, payload);
+    if (_token != null && type != _ack) {
+      _replay.add(frame);
+      _sent++;
+    }
+    _channel?.sink.add(frame);
+  }
+
+  // Forgets the frames the node has received, n in all
+  void _acknowledge(int n) {
+    if (n <= _acked || n > _sent) return;
+    _replay.removeRange(0, n - _acked);
+    _acked = n;
+  }
+
+  // Counts a frame from the node, acknowledging now and then
+  void _count(int length) {
+    _received++;
+    _receivedBytes += length;
+    if (_received - _ackedUpTo >= _ackEvery || _receivedBytes - _ackedBytes >= _ackBytes) {
+      _ackedUpTo = _received;
+      _ackedBytes = _receivedBytes;
+      _send(_ack, 0, (ByteData(8)..setUint64(0, _received)).buffer.asUint8List());
+    }
+  }
+
+  // Frames can be split across WebSocket messages, or several share one
+  void _receive(List<int> message) {
+    _pending.add(message);
+    var buffer = _pending.takeBytes();
+    var offset = 0;
+    while (buffer.length - offset >= _headerSize) {
+      final header = ByteData.sublistView(buffer, offset);
+      final length = header.getUint16(5);
+      if (buffer.length - offset < _headerSize + length) break;
+      final type = header.getUint8(0);
+      final id = header.getUint32(1);
+      final payload = Uint8List.sublistView(buffer, offset + _headerSize, offset + _headerSize + length);
+      offset += _headerSize + length;
+      if (type == _ack) {
+        if (payload.length == 8) _acknowledge(ByteData.sublistView(payload).getUint64(0));
+        continue;
+      }
+      if (type == _control) {
+        _answered(payload);
+      } else if (type == _open && id.isEven && !_streams.containsKey(id)) {
+        _accepted(id);
+      } else {
+        _streams[id]?._frame(type, payload);
+      }
+      if (_token != null) _count(_headerSize + length);
+    }
+    _pending.add(Uint8List.sublistView(buffer, offset));
+  }
+
+  void _accepted(int id) {
+    final handler = onStream;
+    if (handler == null) {
+      _send(_reset, id);
+      return;
+    }
+    final tunnel = MuxTunnel._(this, id);
+    _streams[id] = tunnel;
+    tunnel._up.stream.listen(tunnel._write, onDone: tunnel._sinkClosed);
+    handler(tunnel);
+  }
+
+  void _answered(Uint8List payload) {
+    if (_controlReplies.isEmpty) return;
+    final reply = _controlReplies.removeAt(0);
+    try {
+      reply.complete(jsonDecode(utf8.decode(payload)) as Map<String, dynamic>);
+    } catch (e) {
+      reply.completeError(FormatException('Invalid control message from the node: $e'));
+    }
+  }
+
+  void _shutdown() {
+    if (_closed) return;
+    _closed = true;
+    _replay.clear();
+    for (final reply in _controlReplies) {
+      reply.completeError(Exception('Multiplexed tunnel is closed'));
+    }
+    _controlReplies.clear();
+    for (final tunnel in List.of(_streams.values)) {
+      tunnel._finish();
+    }
+  }
+}
+
+// The node answered a tunnel request with statusCode instead of upgrading
+class MuxRefusedException extends NoticeException {
+  const MuxRefusedException(this.statusCode, String? notice)
+      : super('Multiplexed tunnel refused: $statusCode', notice);
+
+  final int statusCode;
+}
+
+// One stream in a MuxSession
+class MuxTunnel {
+  MuxTunnel._(this._session, this._id);
+
+  final MuxSession _session;
+  final int _id;
+
+  final StreamController<List<int>> _down = StreamController();
+  final StreamController<List<int>> _up = StreamController();
+
+  // Upstream data waiting for the node to give us window
+  final List<List<int>> _queue = [];
+  int _sendWindow = MuxSession.window;
+  int _unacked = 0;
+  bool _sentClose = false;
+  bool _gotClose = false;
+  bool _finished = false;
+
+  Stream<List<int>> get stream => _down.stream;
+  StreamSink<List<int>> get sink => _up.sink;
+
+  void _write(List<int> data) {
+    if (_finished || _sentClose) return;
+    if (data.isEmpty) {
+      // Half-close, once the queued data is out
+      _queue.add(data);
+    } else {
+      for (var i = 0; i < data.length; i += MuxSession._maxPayload) {
+        final end = i + MuxSession._maxPayload < data.length ? i + MuxSession._maxPayload : data.length;
+        _queue.add(data.sublist(i, end));
+      }
+    }
+    _flush();
+  }
+
+  void _flush() {
+    while (_queue.isNotEmpty && !_finished) {
+      final chunk = _queue.first;
+      if (chunk.isEmpty) {
+        _queue.removeAt(0);
+        _sendClose();
+        continue;
+      }
+      if (_sendWindow == 0) return;
+      if (chunk.length > _sendWindow) {
+        _queue[0] = chunk.sublist(_sendWindow);
+        _session._send(MuxSession._data, _id, chunk.sublist(0, _sendWindow));
+        _sendWindow = 0;
+        return;
+      }
+      _queue.removeAt(0);
+      _sendWindow -= chunk.length;
+      _session._send(MuxSession._data, _id, chunk);
+    }
+  }
+
+  void _sendClose() {
+    if (_sentClose) return;
+    _sentClose = true;
+    _session._send(MuxSession._close, _id);
+    if (_gotClose) _finish();
+  }
+
+  // The proxy closes the sink once it is done with the tunnel: a graceful
+  // end if the node has finished too, otherwise an abort
+  void _sinkClosed() {
+    if (_finished) return;
+    if (_gotClose) {
+      _queue.add(const []);
+      _flush();
+    } else {
+      _session._send(MuxSession._reset, _id);
+      _finish();
+    }
+  }
+
+  void _frame(int type, Uint8List payload) {
+    switch (type) {
+      case MuxSession._data:
+        _down.add(payload);
+        // The proxy doesn't push back on us, so give the window back as
+        // soon as data is passed on
+        _unacked += payload.length;
+        if (_unacked >= MuxSession.window ~/ 2) {
+          final credit = ByteData(4)..setUint32(0, _unacked);
+          _unacked = 0;
+          _session._send(MuxSession._window, _id, credit.buffer.asUint8List());
+        }
+        break;
+      case MuxSession._window:
+        if (payload.length == 4) {
+          _sendWindow += ByteData.sublistView(payload).getUint32(0);
+          _flush();
+        }
+        break;
+      case MuxSession._close:
+        _gotClose = true;
+        _down.add(const []);
+        if (_sentClose) _finish();
+        break;
+      case MuxSession._reset:
+        _finish();
+        break;
+    }
+  }
+
+  void _finish() {
+    if (_finished) return;
+    _finished = true;
+    _queue.clear();
+    _session._streams.remove(_id);
+    _down.close();
+  }
+}
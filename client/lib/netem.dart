@@ -0,0 +1,146 @@
+import 'dart:async';
+import 'dart:math';
+
+// Simulated network conditions (desktop only), for reproducing reports like
+// "the VPN is slow on hotel Wi-Fi" on a good connection. Start the client
+// with
+//
+//   --netem=latency=150ms,jitter=80ms,loss=3%,seed=1
+//
+// (from flutter run, pass it with --dart-entrypoint-args) or a preset:
+// --netem=hotel, --netem=3g or --netem=satellite. Every tunnel
+// of the local proxy then has each chunk in either direction held back by
+// latency plus or minus jitter. Tunnels are reliable streams, so a "lost"
+// chunk isn't dropped: it arrives one retransmission timeout late, as TCP
+// would deliver it, and holds up everything behind it. Order is always
+// kept. With seed set the same delays come out on every run.
+class NetemSpec {
+  const NetemSpec({
+    this.latency = Duration.zero,
+    this.jitter = Duration.zero,
+    this.loss = 0,
+    this.seed,
+  });
+
+  final Duration latency;
+  final Duration jitter;
+  // Fraction of chunks lost, 0 to 1
+  final double loss;
+  final int? seed;
+
+  static const Map<String, NetemSpec> presets = {
+    'hotel': NetemSpec(latency: Duration(milliseconds: 150), jitter: Duration(milliseconds: 80), loss: 0.03),
+    '3g': NetemSpec(latency: Duration(milliseconds: 300), jitter: Duration(milliseconds: 100), loss: 0.01),
+    'satellite': NetemSpec(latency: Duration(milliseconds: 600), jitter: Duration(milliseconds: 30), loss: 0.005),
+  };
+
+  // The spec from a --netem argument, or null if there is none. Throws
+  // FormatException on a malformed spec rather than running unsimulated.
+  static NetemSpec? fromArgs(List<String> args) {
+    for (final arg in args) {
+      if (arg.startsWith('--netem=')) return parse(arg.substring('--netem='.length));
+    }
+    return null;
+  }
+
+  static NetemSpec parse(String spec) {
+    final preset = presets[spec];
+    if (preset != null) return preset;
+
+    var latency = Duration.zero;
+    var jitter = Duration.zero;
+    var loss = 0.0;
+    int? seed;
+    for (final part in spec.split(',')) {
+      final kv = part.split('=');
+      if (kv.length != 2) throw FormatException('Invalid netem setting', part);
+      final value = kv[1].trim();
+      switch (kv[0].trim()) {
+        case 'latency':
+          latency = _parseDuration(value);
+        case 'jitter':
+          jitter = _parseDuration(value);
+        case 'loss':
+          final percent = double.tryParse(value.endsWith('%') ? value.substring(0, value.length - 1) : value);
+          if (percent == null || percent < 0 || percent > 100) {
+            throw FormatException('Invalid netem loss', value);
+          }
+          loss = percent / 100;
+        case 'seed':
+          seed = int.tryParse(value) ?? (throw FormatException('Invalid netem seed', value));
+        default:
+          throw FormatException('Unknown netem setting', kv[0]);
+      }
+    }
+    return NetemSpec(latency: latency, jitter: jitter, loss: loss, seed: seed);
+  }
+
+  // 150ms or 1s; a bare number is milliseconds
+  static Duration _parseDuration(String value) {
+    final match = RegExp(r'^(\d+)(ms|s)?$').firstMatch(value);
+    if (match == null) throw FormatException('Invalid netem duration', value);
+    final n = int.parse(match.group(1)!);
+    return match.group(2) == 's' ? Duration(seconds: n) : Duration(milliseconds: n);
+  }
+
+  @override
+  String toString() =>
+      'latency ${latency.inMilliseconds}ms, jitter ${jitter.inMilliseconds}ms, '
+      'loss ${(loss * 100).toStringAsFixed(1)}%${seed != null ? ', seed $seed' : ''}';
+}
+
+class Netem {
+  Netem(this.spec) : _random = Random(spec.seed);
+
+  final NetemSpec spec;
+  final Random _random;
+
+  // A lost chunk is resent after roughly TCP's minimum retransmission
+  // timeout on top of the round trip
+  Duration get _retransmit => const Duration(milliseconds: 200) + spec.latency * 2;
+
+  Duration _delay() {
+    var delay = spec.latency;
+    if (spec.jitter > Duration.zero) {
+      final jitterUs = spec.jitter.inMicroseconds;
+      delay += Duration(microseconds: _random.nextInt(2 * jitterUs + 1) - jitterUs);
+    }
+    if (spec.loss > 0 && _random.nextDouble() < spec.loss) {
+      delay += _retransmit;
+    }
+    return delay < Duration.zero ? Duration.zero : delay;
+  }
+
+  // apply delays one direction of a tunnel. Events, errors and the end of
+  // the stream come out in the order they went in, none sooner than the one
+  // before it.
+  Stream<T> apply<T>(Stream<T> input) {
+    final out = StreamController<T>();
+    StreamSubscription<T>? subscription;
+    var releaseAt = DateTime.now();
+    var tail = Future<void>.value();
+
+    void later(void Function() emit) {
+      final at = DateTime.now().add(_delay());
+      if (at.isAfter(releaseAt)) releaseAt = at;
+      final due = releaseAt;
+      tail = tail.then((_) async {
+        final wait = due.difference(DateTime.now());
+        if (wait > Duration.zero) await Future.delayed(wait);
+        if (!out.isClosed) emit();
+      });
+    }
+
+    out.onListen = () {
+      subscription = input.listen(
+        (event) => later(() => out.add(event)),
+        onError: (Object e, StackTrace st) => later(() => out.addError(e, st)),
+        onDone: () => later(out.close),
+      );
+    };
+    out.onPause = () => subscription?.pause();
+    out.onResume = () => subscription?.resume();
+    out.onCancel = () => subscription?.cancel();
+    return out.stream;
+  }
+}
@@ -0,0 +1,64 @@
+import 'dart:async';
+import 'dart:io';
+
+// Watches the machine's network interfaces and reports when the set of
+// addresses changes, e.g. when switching from Wi-Fi to Ethernet or joining
+// another network. Tunnels opened on the old network are dead at that point
+// even though TCP won't notice for minutes.
+//
+// dart:io has no change notifications, so the interface list is polled;
+// listing interfaces is cheap and a few seconds of delay is far better than
+// waiting for a TCP timeout.
+class NetworkMonitor {
+  NetworkMonitor(this.onChange, {this.interval = const Duration(seconds: 3)});
+
+  final void Function() onChange;
+  final Duration interval;
+
+  Timer? _timer;
+  String? _fingerprint;
+  bool _checking = false;
+
+  Future<void> start() async {
+    _fingerprint = await currentFingerprint();
+    _timer = Timer.periodic(interval, (_) => _check());
+  }
+
+  void stop() {
+    _timer?.cancel();
+    _timer = null;
+  }
+
+  Future<void> _check() async {
+    if (_checking) return;
+    _checking = true;
+    try {
+      final fingerprint = await currentFingerprint();
+      if (fingerprint != _fingerprint) {
+        _fingerprint = fingerprint;
+        onChange();
+      }
+    } catch (e) {
+      print('Network check failed: $e');
+    } finally {
+      _checking = false;
+    }
+  }
+
+  // Interface names and addresses, sorted so the order the OS lists them in
+  // doesn't matter. Preflight results are cached under it too.
+  static Future<String> currentFingerprint() async {
+    final interfaces = await NetworkInterface.list(
+      includeLoopback: false,
+      includeLinkLocal: false,
+    );
+    final entries = <String>[];
+    for (final iface in interfaces) {
+      for (final addr in iface.addresses) {
+        entries.add('${iface.name}=${addr.address}');
+      }
+    }
+    entries.sort();
+    return entries.join(',');
+  }
+}
@@ -0,0 +1,47 @@
+import 'dart:convert';
+import 'package:http/http.dart' as http;
+
+// Split-tunnel and block rules set by the user's organization on the sync
+// server. They take precedence over the user's own site rules.
+class OrgPolicy {
+  OrgPolicy({
+    this.tunnelByDefault,
+    this.direct = const [],
+    this.tunnel = const [],
+    this.block = const [],
+    this.version = 0,
+  });
+
+  final bool? tunnelByDefault;
+  final List<String> direct;
+  final List<String> tunnel;
+  final List<String> block;
+  final int version;
+
+  factory OrgPolicy.fromJson(Map<String, dynamic> json) {
+    final policy = json['policy'] as Map<String, dynamic>? ?? {};
+    List<String> sites(String key) =>
+        (policy[key] as List? ?? []).map((s) => s.toString()).toList();
+    return OrgPolicy(
+      tunnelByDefault: policy['tunnelByDefault'] as bool?,
+      direct: sites('direct'),
+      tunnel: sites('tunnel'),
+      block: sites('block'),
+      version: json['version'] as int? ?? 0,
+    );
+  }
+
+  // The policy for the holder of credential, or null if they aren't in an
+  // organization
+  static Future<OrgPolicy?> fetch(String syncServerUrl, String credential) async {
+    final response = await http.get(
+      Uri.parse('$syncServerUrl/org/policy'),
+      headers: {'Authorization': 'Bearer $credential'},
+    );
+    if (response.statusCode == 404) return null;
+    if (response.statusCode != 200) {
+      throw Exception('Failed to fetch organization policy: ${response.statusCode}');
+    }
+    return OrgPolicy.fromJson(jsonDecode(response.body));
+  }
+}
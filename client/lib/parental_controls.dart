@@ -0,0 +1,120 @@
+import 'dart:convert';
+import 'dart:io';
+
+// Parental controls (desktop only): a profile's rules block domains, listed
+// or by category, during time windows on the device's clock, e.g. social
+// media from 22:00 to 07:00 on school nights. The proxy refuses a blocked
+// destination as the node would (SOCKS reply 2, or 403 from the HTTP proxy)
+// without opening a tunnel. Profiles are set in
+// ~/.horsevpn/parental-controls.json, or by a config bundle's
+// parentalControls section, in the same format:
+//
+//   {"profile": "kids",
+//    "profiles": [{"name": "kids",
+//                  "categories": {"social": ["tiktok.com", "instagram.com"]},
+//                  "rules": [{"days": ["sun", "mon", "tue", "wed", "thu"],
+//                             "from": "22:00", "to": "07:00",
+//                             "categories": ["social"],
+//                             "domains": ["youtube.com"]}]}]}
+//
+// A window ends before to, runs past midnight when to is earlier and lasts
+// all day when they are equal; days are those it starts on, every day if
+// left out. The profile's users and timezone are for nodes (see the sync
+// server's parentalcontrols.ts), so they are ignored here.
+const List<String> _days = ['mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun'];
+
+class ScheduleRule {
+  ScheduleRule(this.days, this.from, this.to, this.domains);
+
+  // DateTime.weekday values; empty for every day
+  final Set<int> days;
+  // Minutes after midnight
+  final int from;
+  final int to;
+  final List<String> domains;
+
+  bool _startsOn(int weekday) => days.isEmpty || days.contains(weekday);
+
+  bool active(DateTime now) {
+    final minute = now.hour * 60 + now.minute;
+    final yesterday = now.weekday == DateTime.monday ? DateTime.sunday : now.weekday - 1;
+    if (from == to) return _startsOn(now.weekday);
+    if (from < to) return _startsOn(now.weekday) && minute >= from && minute < to;
+    return _startsOn(now.weekday) && minute >= from || _startsOn(yesterday) && minute < to;
+  }
+
+  String get window => '${_clock(from)}-${_clock(to)}';
+
+  static String _clock(int minutes) =>
+      '${(minutes ~/ 60).toString().padLeft(2, '0')}:${(minutes % 60).toString().padLeft(2, '0')}';
+}
+
+class ParentalProfile {
+  ParentalProfile(this.name, this.rules);
+
+  final String name;
+  final List<ScheduleRule> rules;
+
+  // Why host is blocked at now, or null if it isn't
+  String? blocks(String host, DateTime now) {
+    final name = host.trim().toLowerCase().replaceAll(RegExp(r'\.+$'), '');
+    for (final rule in rules) {
+      if (!rule.active(now)) continue;
+      for (final domain in rule.domains) {
+        if (name == domain || name.endsWith('.$domain')) return '${this.name} profile, ${rule.window}';
+      }
+    }
+    return null;
+  }
+
+  // Reads one profile, with its rules' categories replaced by their domains
+  static ParentalProfile fromJson(Map<String, dynamic> json) {
+    final categories = (json['categories'] as Map<String, dynamic>? ?? {}).map((name, domains) =>
+        MapEntry(name, (domains as List).map((d) => d.toString().toLowerCase()).toList()));
+    int minutes(Object? value) {
+      final match = RegExp(r'^([01][0-9]|2[0-3]):([0-5][0-9])$').firstMatch(value.toString());
+      if (match == null) throw FormatException('Invalid time $value');
+      return int.parse(match[1]!) * 60 + int.parse(match[2]!);
+    }
+
+    return ParentalProfile(json['name'] as String, [
+      for (final rule in (json['rules'] as List? ?? []).cast<Map<String, dynamic>>())
+        ScheduleRule(
+          {
+            for (final day in (rule['days'] as List? ?? []))
+              if (_days.contains(day)) _days.indexOf(day) + 1 else throw FormatException('Invalid day $day'),
+          },
+          minutes(rule['from']),
+          minutes(rule['to']),
+          [
+            ...(rule['domains'] as List? ?? []).map((d) => d.toString().toLowerCase()),
+            for (final category in (rule['categories'] as List? ?? [])) ...?categories[category],
+          ],
+        ),
+    ]);
+  }
+
+  Map<String, dynamic> toJson() => {'name': name, 'rules': rules.length};
+}
+
+// The profile named by "profile", out of "profiles"; null when it names none
+ParentalProfile? parentalProfileFromJson(Map<String, dynamic> json) {
+  final name = json['profile'];
+  for (final profile in (json['profiles'] as List? ?? []).cast<Map<String, dynamic>>()) {
+    if (profile['name'] == name) return ParentalProfile.fromJson(profile);
+  }
+  return null;
+}
+
+// The device's own profile, from ~/.horsevpn/parental-controls.json
+Future<ParentalProfile?> loadParentalProfile() async {
+  final home = Platform.environment['HOME'] ?? Platform.environment['USERPROFILE'] ?? '.';
+  final file = File('$home/.horsevpn/parental-controls.json');
+  if (!await file.exists()) return null;
+  try {
+    return parentalProfileFromJson(jsonDecode(await file.readAsString()) as Map<String, dynamic>);
+  } catch (e) {
+    print('Ignoring unreadable parental-controls.json: $e');
+    return null;
+  }
+}
@@ -0,0 +1,131 @@
+import 'dart:async';
+import 'dart:convert';
+import 'package:http/http.dart' as http;
+import 'messages.dart';
+
+// Tunnel over plain HTTP requests for networks that break WebSockets; see
+// the server's /poll endpoints. It mirrors the parts of WebSocketChannel the
+// proxy uses: ready, stream and sink.
+class PollTunnel {
+  PollTunnel._(this._base, this._headers);
+
+  final Uri _base;
+  final Map<String, String> _headers;
+  final http.Client _client = http.Client();
+
+  final StreamController<List<int>> _down = StreamController();
+  final StreamController<List<int>> _up = StreamController();
+  final Completer<void> _ready = Completer();
+
+  String? _sessionId;
+  int _upSeq = 0;
+  int _downNext = 0;
+  bool _closed = false;
+
+  Future<void> get ready => _ready.future;
+  Stream<List<int>> get stream => _down.stream;
+  StreamSink<List<int>> get sink => _up.sink;
+
+  // route is the node's WebSocket URL; the poll endpoints live next to it
+  static PollTunnel connect(String route, Map<String, String> headers) {
+    final ws = Uri.parse(route);
+    final base = ws.replace(
+      scheme: ws.scheme == 'wss' ? 'https' : 'http',
+      path: '/poll',
+    );
+    final tunnel = PollTunnel._(base, headers);
+    tunnel._open();
+    return tunnel;
+  }
+
+  Uri _url(String path, [Map<String, String>? query]) =>
+      _base.replace(path: '${_base.path}/$path', queryParameters: query);
+
+  Future<void> _open() async {
+    try {
+      final response = await _client.post(_url('open'), headers: _headers);
+      if (response.statusCode != 200) {
+        throw NoticeException('Poll session refused: ${response.statusCode}', response.headers['x-notice']);
+      }
+      _sessionId = jsonDecode(response.body)['sessionId'];
+      _ready.complete();
+    } catch (e) {
+      _ready.completeError(e);
+      _shutdown();
+      return;
+    }
+
+    _pollDown();
+    // Chunks must arrive in order, so send one at a time
+    await for (final data in _up.stream) {
+      await _sendUp(data);
+      if (_closed) return;
+    }
+    await _closeSession();
+  }
+
+  // Sends one upstream chunk, retrying until the node has it
+  Future<void> _sendUp(List<int> data) async {
+    final seq = _upSeq++;
+    for (var attempt = 0; attempt < 5 && !_closed; attempt++) {
+      try {
+        final response = await _client.post(
+          _url('$_sessionId/up', {'seq': '$seq', 'ack': '$_downNext'}),
+          body: data,
+        );
+        if (response.statusCode == 204) return;
+        if (response.statusCode == 404) break;
+      } catch (e) {
+        await Future.delayed(Duration(milliseconds: 200 * (attempt + 1)));
+      }
+    }
+    _shutdown();
+  }
+
+  Future<void> _pollDown() async {
+    var failures = 0;
+    while (!_closed) {
+      try {
+        final response = await _client.get(
+          _url('$_sessionId/down', {'ack': '$_downNext'}),
+        );
+        if (response.statusCode == 404) break;
+        if (response.statusCode != 200) {
+          throw Exception('Poll failed: ${response.statusCode}');
+        }
+        failures = 0;
+        final body = jsonDecode(response.body);
+        for (final chunk in body['chunks']) {
+          final seq = chunk['seq'] as int;
+          if (seq < _downNext) continue;
+          if (_closed) return;
+          _down.add(base64Decode(chunk['data']));
+          _downNext = seq + 1;
+        }
+        if (body['closed'] == true) break;
+      } catch (e) {
+        if (++failures >= 5) break;
+        await Future.delayed(Duration(milliseconds: 200 * failures));
+      }
+    }
+    _shutdown();
+  }
+
+  Future<void> _closeSession() async {
+    if (_sessionId != null && !_closed) {
+      try {
+        await _client.delete(_url('$_sessionId'));
+      } catch (e) {
+        // The node expires idle sessions anyway
+      }
+    }
+    _shutdown();
+  }
+
+  void _shutdown() {
+    if (_closed) return;
+    _closed = true;
+    _down.close();
+    _client.close();
+  }
+}
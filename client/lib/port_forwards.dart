@@ -0,0 +1,83 @@
+import 'dart:async';
+import 'dart:io';
+import 'dart:typed_data';
+import 'mux_tunnel.dart';
+
+// Port forwarding (desktop only, with HORSEVPN_MUX_TUNNELS). A port
+// reserved on our dedicated IP's node through the sync server's
+// /port-forwards brings its inbound connections to us as streams the node
+// opens in our multiplexed tunnel, each starting with the reserved port as
+// 2 bytes, big endian. With --dart-define=HORSEVPN_PORT_FORWARDS=20001:8080,20002
+// we connect each to 127.0.0.1 on the local port after the colon, or the
+// same port without one. Streams for other ports are refused. The tunnel
+// opens as soon as there is a route, rather than on first use, so that
+// inbound connections have somewhere to go.
+const String portForwardsSpec = String.fromEnvironment('HORSEVPN_PORT_FORWARDS');
+
+// Reserved port to local port
+Map<int, int> parsePortForwards(String spec) {
+  final forwards = <int, int>{};
+  for (final entry in spec.split(',').map((e) => e.trim()).where((e) => e.isNotEmpty)) {
+    final [reserved, ...local] = entry.split(':');
+    final from = int.tryParse(reserved);
+    final to = local.isEmpty ? from : (local.length == 1 ? int.tryParse(local.first) : null);
+    if (from == null || to == null || from < 1 || from > 65535 || to < 1 || to > 65535) {
+      print('Ignoring invalid port forward $entry');
+      continue;
+    }
+    forwards[from] = to;
+  }
+  return forwards;
+}
+
+class PortForwarder {
+  PortForwarder(this.forwards, {this.onSent, this.onReceived});
+
+  final Map<int, int> forwards;
+  final void Function(int)? onSent;
+  final void Function(int)? onReceived;
+
+  bool get enabled => forwards.isNotEmpty;
+
+  // Relays one stream the node opened to its local port, passing
+  // half-closes on both ways
+  Future<void> serve(MuxTunnel tunnel) async {
+    final incoming = StreamIterator(tunnel.stream);
+    Socket? socket;
+    try {
+      final head = BytesBuilder(copy: false);
+      while (head.length < 2) {
+        if (!await incoming.moveNext() || incoming.current.isEmpty) throw const SocketException('Stream ended early');
+        head.add(incoming.current);
+      }
+      final bytes = head.takeBytes();
+      final port = bytes[0] << 8 | bytes[1];
+      final local = forwards[port];
+      if (local == null) throw SocketException('Inbound connection for port $port, which we don\'t forward');
+      final connected = socket = await Socket.connect(InternetAddress.loopbackIPv4, local);
+      if (bytes.length > 2) connected.add(bytes.sublist(2));
+
+      final toLocal = () async {
+        while (await incoming.moveNext()) {
+          final data = incoming.current;
+          // The node half-closed
+          if (data.isEmpty) break;
+          onReceived?.call(data.length);
+          connected.add(data);
+        }
+        // Closes our writing side only
+        await connected.close();
+      }();
+      await for (final data in connected) {
+        onSent?.call(data.length);
+        tunnel.sink.add(data);
+      }
+      tunnel.sink.add(const []);
+      await toLocal;
+    } catch (e) {
+      print('Port forward failed: $e');
+      socket?.destroy();
+    }
+    await tunnel.sink.close();
+  }
+}
@@ -0,0 +1,203 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'package:web_socket_channel/io.dart';
+import 'h2_transport.dart';
+import 'network_monitor.dart';
+import 'poll_transport.dart';
+
+// Pre-flight reachability: for each candidate server the sync server offers,
+// try each transport from the current network and record which get through.
+// Run with `horsevpn preflight`. Results are kept in
+// ~/.horsevpn/preflight.json per network, for a day, and automatic transport
+// selection uses them: on a network where WebSockets to the route failed but
+// polling worked, the proxy polls from the first connection instead of
+// after three failed WebSocket connects.
+const Duration preflightTimeout = Duration(seconds: 5);
+const Duration preflightMaxAge = Duration(hours: 24);
+
+const List<String> preflightTransports = ['websocket', 'polling', 'h2', 'tls'];
+
+class PreflightCheck {
+  PreflightCheck(this.ok, this.ms, [this.error]);
+
+  final bool ok;
+  final int ms;
+  final String? error;
+
+  Map<String, dynamic> toJson() => {
+        'ok': ok,
+        'ms': ms,
+        if (error != null) 'error': error,
+      };
+
+  static PreflightCheck fromJson(Map<String, dynamic> json) =>
+      PreflightCheck(json['ok'] == true, json['ms'] as int? ?? 0, json['error'] as String?);
+}
+
+class PreflightResult {
+  PreflightResult(this.id, this.location, this.url, this.checks);
+
+  final String id;
+  final String location;
+  final String url;
+  // By transport; a transport the server doesn't offer is absent
+  final Map<String, PreflightCheck> checks;
+
+  Map<String, dynamic> toJson() => {
+        'id': id,
+        'location': location,
+        'url': url,
+        'checks': checks.map((t, c) => MapEntry(t, c.toJson())),
+      };
+
+  static PreflightResult fromJson(Map<String, dynamic> json) => PreflightResult(
+        json['id'] as String? ?? '',
+        json['location'] as String? ?? '',
+        json['url'] as String,
+        (json['checks'] as Map<String, dynamic>)
+            .map((t, c) => MapEntry(t, PreflightCheck.fromJson(c as Map<String, dynamic>))),
+      );
+}
+
+// Checks every transport of every candidate at once. candidates are /route
+// candidates from the sync server: id, location, url and endpoints.
+Future<List<PreflightResult>> runPreflight(
+    List<Map<String, dynamic>> candidates, Map<String, String> headers) {
+  return Future.wait(candidates.map((candidate) async {
+    final url = candidate['url'] as String;
+    final tls = (candidate['endpoints'] as List? ?? [])
+        .map((e) => e.toString())
+        .firstWhere((e) => e.startsWith('tls://'), orElse: () => '');
+    final checks = <String, Future<PreflightCheck>>{
+      'websocket': _check(() => _websocket(url, headers)),
+      'polling': _check(() => _polling(url, headers)),
+      // HTTP/2 CONNECT needs the node to serve TLS itself
+      if (url.startsWith('wss://')) 'h2': _check(() => _h2(url)),
+      if (tls.isNotEmpty) 'tls': _check(() => _tls(tls)),
+    };
+    final done = <String, PreflightCheck>{};
+    for (final entry in checks.entries) {
+      done[entry.key] = await entry.value;
+    }
+    return PreflightResult(
+      candidate['id'] as String? ?? '',
+      candidate['location'] as String? ?? '',
+      url,
+      done,
+    );
+  }));
+}
+
+Future<PreflightCheck> _check(Future<void> Function() attempt) async {
+  final timer = Stopwatch()..start();
+  try {
+    await attempt().timeout(preflightTimeout);
+    return PreflightCheck(true, timer.elapsedMilliseconds);
+  } on TimeoutException {
+    return PreflightCheck(false, timer.elapsedMilliseconds, 'timed out');
+  } catch (e) {
+    return PreflightCheck(false, timer.elapsedMilliseconds, '$e');
+  }
+}
+
+HttpClient _client() => HttpClient()..badCertificateCallback = (cert, host, port) => true;
+
+Future<void> _websocket(String url, Map<String, String> headers) async {
+  final channel = IOWebSocketChannel.connect(
+    Uri.parse(url),
+    protocols: ['vpn-protocol'],
+    headers: headers,
+    customClient: _client(),
+  );
+  try {
+    await channel.ready;
+  } finally {
+    channel.sink.close().catchError((e) {});
+  }
+}
+
+Future<void> _polling(String url, Map<String, String> headers) async {
+  final tunnel = PollTunnel.connect(url, headers);
+  try {
+    await tunnel.ready;
+  } finally {
+    tunnel.sink.close().catchError((e) {});
+  }
+}
+
+Future<void> _h2(String url) async {
+  final conn = await H2Connection.connect(url, onBadCertificate: (cert) => true);
+  await conn.close();
+}
+
+Future<void> _tls(String endpoint) async {
+  final uri = Uri.parse(endpoint);
+  final socket = await SecureSocket.connect(
+    uri.host,
+    uri.hasPort ? uri.port : 443,
+    supportedProtocols: ['horsevpn/1'],
+    onBadCertificate: (cert) => true,
+    timeout: preflightTimeout,
+  );
+  socket.destroy();
+}
+
+// Results per network fingerprint in ~/.horsevpn/preflight.json
+class PreflightCache {
+  static File get _file {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    return File('$home/.horsevpn/preflight.json');
+  }
+
+  static Future<Map<String, dynamic>> _read() async {
+    try {
+      return jsonDecode(await _file.readAsString()) as Map<String, dynamic>;
+    } catch (e) {
+      return {};
+    }
+  }
+
+  // Saves results for the current network, dropping those for networks
+  // not checked within preflightMaxAge
+  static Future<void> save(List<PreflightResult> results) async {
+    final networks = await _read();
+    final cutoff = DateTime.now().subtract(preflightMaxAge).millisecondsSinceEpoch;
+    networks.removeWhere((_, entry) => (entry['checkedAt'] as int? ?? 0) < cutoff);
+    networks[await NetworkMonitor.currentFingerprint()] = {
+      'checkedAt': DateTime.now().millisecondsSinceEpoch,
+      'results': results.map((r) => r.toJson()).toList(),
+    };
+    await _file.parent.create(recursive: true);
+    await _file.writeAsString(jsonEncode(networks));
+  }
+
+  // Results for the current network, if it was checked within
+  // preflightMaxAge
+  static Future<List<PreflightResult>> load() async {
+    final entry = (await _read())[await NetworkMonitor.currentFingerprint()];
+    if (entry == null) return [];
+    final cutoff = DateTime.now().subtract(preflightMaxAge).millisecondsSinceEpoch;
+    if ((entry['checkedAt'] as int? ?? 0) < cutoff) return [];
+    try {
+      return (entry['results'] as List)
+          .map((r) => PreflightResult.fromJson(r as Map<String, dynamic>))
+          .toList();
+    } catch (e) {
+      print('Ignoring unreadable preflight.json: $e');
+      return [];
+    }
+  }
+
+  // Whether preflight found on this network that WebSockets to route fail
+  // where polling gets through
+  static Future<bool> prefersPolling(String route) async {
+    for (final result in await load()) {
+      if (result.url != route) continue;
+      return result.checks['websocket']?.ok == false && result.checks['polling']?.ok == true;
+    }
+    return false;
+  }
+}
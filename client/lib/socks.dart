@@ -0,0 +1,387 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+import 'package:http/http.dart' as http;
+
+// The local proxy's SOCKS5 frontend (RFC 1928, desktop only). We answer the
+// application's handshake ourselves: no authentication, or
+// username/password (RFC 1929), which is required when the client is built
+// with --dart-define=HORSEVPN_PROXY_PASSWORD=<password>. Then we read its
+// CONNECT to an IPv4, IPv6 or domain address and send that CONNECT on
+// through the tunnel, where the node dials the destination and its reply
+// goes back to the application as is. UDP ASSOCIATE is answered here and
+// served by udp_associate.dart over the node's UDP relay. BIND gets
+// "command not supported".
+//
+// Per-connection exit selection: the username can carry routing hints, and
+// that one connection leaves from the exit they name instead of the
+// proxy's own route:
+//
+//   curl --proxy socks5h://country=Germany:x@localhost:1080 https://example.com
+//   curl --proxy socks5h://server=node-17:x@localhost:1080 https://example.com
+//
+// country (or location) looks up a node for that location; server picks the
+// node with that ID, if the sync server lets us use it. Hints are separated
+// by commas; server wins if both are given. A username that isn't hints (no
+// '=') changes nothing, and an unknown hint fails authentication so a typo
+// doesn't go out through the wrong exit.
+class RoutingHints {
+  const RoutingHints({this.location, this.serverId});
+
+  final String? location;
+  final String? serverId;
+
+  // The hints in a SOCKS username, or null if it has none. Throws
+  // FormatException on an unknown or empty hint.
+  static RoutingHints? parse(String username) {
+    if (!username.contains('=')) return null;
+    String? location;
+    String? serverId;
+    for (final part in username.split(',')) {
+      final kv = part.split('=');
+      if (kv.length != 2 || kv[1].trim().isEmpty) throw FormatException('Invalid routing hint', part);
+      final value = Uri.decodeComponent(kv[1].trim());
+      switch (kv[0].trim().toLowerCase()) {
+        case 'country':
+        case 'location':
+          location = value;
+        case 'server':
+          serverId = value;
+        default:
+          throw FormatException('Unknown routing hint', kv[0]);
+      }
+    }
+    return RoutingHints(location: location, serverId: serverId);
+  }
+
+  // Connections with the same key share a route
+  String get key => serverId != null ? 'server:$serverId' : 'location:${location!.toLowerCase()}';
+
+  @override
+  String toString() => serverId != null ? 'server $serverId' : 'location $location';
+}
+
+// The start of a connection to the local proxy, up to its CONNECT or UDP
+// ASSOCIATE request
+class SocksStart {
+  SocksStart._(this.stream, this.hints, this.request, this.host, this.port, this.udpAssociate, [this.translateReply]);
+
+  // A CONNECT to host that didn't come from a SOCKS client, such as the
+  // HTTP proxy's. translateReply turns the node's reply code into what the
+  // application gets instead of the SOCKS reply.
+  SocksStart.connect(this.stream, this.hints, this.host, this.port, {this.translateReply})
+      : request = _connectRequest(host, port),
+        udpAssociate = false;
+
+  // The rest of what the application sends, for the tunnel
+  final Stream<Uint8List> stream;
+  final RoutingHints? hints;
+  // The CONNECT request, to send the node after noAuthGreeting; the node
+  // answers the greeting with greetingReplyLength bytes that aren't for the
+  // application, then the request with the reply that is
+  final Uint8List request;
+  // The destination. For UDP ASSOCIATE, where the application will send
+  // from, often 0.0.0.0:0 for "don't know yet".
+  final String host;
+  final int port;
+  // The request is UDP ASSOCIATE; the connection then only controls the
+  // association's lifetime
+  final bool udpAssociate;
+  // Set when the application doesn't speak SOCKS; see SocksStart.connect
+  final List<int> Function(int reply)? translateReply;
+
+  static const List<int> noAuthGreeting = [5, 1, 0];
+  static const int greetingReplyLength = 2;
+
+  // host:port, for logs
+  String get target => '$host:$port';
+
+  static const int _connect = 1;
+  static const int _udpAssociate = 3;
+
+  static const int _noAuth = 0;
+  static const int _userPass = 2;
+  static const int _noAcceptable = 0xff;
+
+  // SOCKS5 reply codes we give ourselves
+  static const int generalFailure = 1;
+  static const int notAllowed = 2;
+  static const int commandNotSupported = 7;
+  static const int addressNotSupported = 8;
+
+  // A reply refusing the request with code
+  static List<int> failure(int code) => [5, code, 0, 1, 0, 0, 0, 0, 0, 0];
+
+  // What to tell the application when its request fails with code
+  List<int> failureReply(int code) => translateReply?.call(code) ?? failure(code);
+
+  // The length of the node's reply starting with head, or null if head is
+  // too short to tell: VER REP RSV ATYP, the address and the port
+  static int? replyLength(List<int> head) {
+    if (head.length < 5) return null;
+    return switch (head[3]) {
+      1 => 4 + 4 + 2,
+      4 => 4 + 16 + 2,
+      _ => 4 + 1 + head[4] + 2,
+    };
+  }
+
+  // Runs the application's side of the handshake. With a password set,
+  // only username/password with that password is accepted. Throws
+  // FormatException (after answering, where SOCKS has a way to) if the
+  // application can't go on.
+  static Future<SocksStart> accept(Socket socket, {String password = ''}) async {
+    final reader = HandshakeReader(socket);
+    try {
+      // VER NMETHODS METHODS...
+      final head = await reader.read(2);
+      if (head == null || head[0] != 5) throw const FormatException('Not a SOCKS5 client');
+      final methods = await reader.read(head[1]);
+      if (methods == null) throw const FormatException('Truncated SOCKS greeting');
+      final int method;
+      if (methods.contains(_userPass)) {
+        method = _userPass;
+      } else if (methods.contains(_noAuth) && password.isEmpty) {
+        method = _noAuth;
+      } else {
+        socket.add([5, _noAcceptable]);
+        throw const FormatException('No acceptable SOCKS authentication');
+      }
+      socket.add([5, method]);
+
+      RoutingHints? hints;
+      if (method == _userPass) hints = await _authenticate(socket, reader, password);
+
+      // VER CMD RSV ATYP DST.ADDR DST.PORT
+      final req = await reader.read(4);
+      if (req == null || req[0] != 5) throw const FormatException('Bad SOCKS request');
+      final String host;
+      final Uint8List addr;
+      switch (req[3]) {
+        case 1:
+        case 4:
+          addr = await reader.read(req[3] == 1 ? 4 : 16) ?? (throw const FormatException('Bad SOCKS request'));
+          host = InternetAddress.fromRawAddress(addr).address;
+        case 3:
+          final len = await reader.read(1) ?? (throw const FormatException('Bad SOCKS request'));
+          final name = await reader.read(len[0]) ?? (throw const FormatException('Bad SOCKS request'));
+          addr = Uint8List.fromList([...len, ...name]);
+          host = utf8.decode(name, allowMalformed: true);
+        default:
+          socket.add(failure(addressNotSupported));
+          throw FormatException('Unsupported SOCKS address type', req[3]);
+      }
+      final port = await reader.read(2) ?? (throw const FormatException('Bad SOCKS request'));
+      if (req[1] != _connect && req[1] != _udpAssociate) {
+        socket.add(failure(commandNotSupported));
+        throw FormatException('Unsupported SOCKS command', req[1]);
+      }
+      reader.consume();
+
+      final request = Uint8List.fromList([...req, ...addr, ...port]);
+      return SocksStart._(reader.rest(), hints, request, host, port[0] << 8 | port[1], req[1] == _udpAssociate);
+    } catch (e) {
+      reader.cancel();
+      rethrow;
+    }
+  }
+
+  // The same start with the request naming host instead, an address or a
+  // name for the node to resolve
+  SocksStart redirect(String host) {
+    final redirected = Uint8List.fromList([...request.sublist(0, 3), ..._connectRequest(host, port).sublist(3)]);
+    return SocksStart._(stream, hints, redirected, host, port, udpAssociate, translateReply);
+  }
+
+  static Uint8List _connectRequest(String host, int port) {
+    final ip = InternetAddress.tryParse(host);
+    final name = utf8.encode(host);
+    final addr = ip?.rawAddress ?? [name.length, ...name];
+    final atyp = ip == null ? 3 : (ip.type == InternetAddressType.IPv4 ? 1 : 4);
+    return Uint8List.fromList([5, _connect, 0, atyp, ...addr, port >> 8, port & 0xff]);
+  }
+
+  // RFC 1929: VER ULEN UNAME PLEN PASSWD. The username may carry hints.
+  static Future<RoutingHints?> _authenticate(Socket socket, HandshakeReader reader, String password) async {
+    final ver = await reader.read(2);
+    if (ver == null || ver[0] != 1) throw const FormatException('Bad SOCKS authentication');
+    final user = await reader.read(ver[1]);
+    final plen = await reader.read(1);
+    final pass = plen == null ? null : await reader.read(plen[0]);
+    if (user == null || pass == null) throw const FormatException('Bad SOCKS authentication');
+
+    if (password.isNotEmpty && utf8.decode(pass, allowMalformed: true) != password) {
+      socket.add([1, 1]);
+      throw const FormatException('Wrong SOCKS password');
+    }
+    try {
+      final hints = RoutingHints.parse(utf8.decode(user, allowMalformed: true));
+      socket.add([1, 0]);
+      return hints;
+    } on FormatException {
+      socket.add([1, 1]);
+      rethrow;
+    }
+  }
+}
+
+// Buffers a socket's data while we look at the greeting, then hands the
+// rest on as a stream
+class HandshakeReader {
+  HandshakeReader(Stream<Uint8List> input) {
+    _subscription = input.listen(
+      (data) {
+        if (_out != null) {
+          _out!.add(data);
+        } else {
+          _buffer.add(data);
+          _wake();
+        }
+      },
+      onError: (Object e, StackTrace st) {
+        if (_out != null) {
+          _out!.addError(e, st);
+        } else {
+          _done = true;
+          _wake();
+        }
+      },
+      onDone: () {
+        _done = true;
+        if (_out != null) {
+          _out!.close();
+        } else {
+          _wake();
+        }
+      },
+    );
+  }
+
+  late final StreamSubscription<Uint8List> _subscription;
+  final _buffer = BytesBuilder();
+  // Bytes of the buffer already read
+  var _offset = 0;
+  var _done = false;
+  Completer<void>? _waiting;
+  StreamController<Uint8List>? _out;
+
+  void _wake() {
+    _waiting?.complete();
+    _waiting = null;
+  }
+
+  // The next n bytes, or null if the stream ends first
+  Future<Uint8List?> read(int n) async {
+    while (_buffer.length - _offset < n) {
+      if (_done) return null;
+      _waiting = Completer();
+      await _waiting!.future;
+    }
+    final bytes = Uint8List.sublistView(_buffer.toBytes(), _offset, _offset + n);
+    _offset += n;
+    return bytes;
+  }
+
+  // Everything up to and including end, or null if the stream ends first or
+  // end doesn't come within max bytes
+  Future<Uint8List?> readUntil(List<int> end, int max) async {
+    var searched = _offset;
+    while (true) {
+      final bytes = _buffer.toBytes();
+      for (var i = searched; i + end.length <= bytes.length; i++) {
+        var match = true;
+        for (var j = 0; j < end.length && match; j++) {
+          match = bytes[i + j] == end[j];
+        }
+        if (match) {
+          final found = Uint8List.sublistView(bytes, _offset, i + end.length);
+          _offset = i + end.length;
+          return found;
+        }
+      }
+      if (bytes.length - _offset > max || _done) return null;
+      searched = bytes.length - end.length + 1 > _offset ? bytes.length - end.length + 1 : _offset;
+      _waiting = Completer();
+      await _waiting!.future;
+    }
+  }
+
+  // Drops what has been read, so rest won't pass it on
+  void consume() {
+    final left = _buffer.takeBytes().sublist(_offset);
+    _buffer.add(left);
+    _offset = 0;
+  }
+
+  // Everything not consumed, followed by whatever comes next
+  Stream<Uint8List> rest() {
+    final out = _out = StreamController<Uint8List>(
+      onPause: () => _subscription.pause(),
+      onResume: () => _subscription.resume(),
+      onCancel: () => _subscription.cancel(),
+    );
+    if (_buffer.isNotEmpty) out.add(_buffer.takeBytes());
+    if (_done) out.close();
+    return out.stream;
+  }
+
+  void cancel() => _subscription.cancel();
+}
+
+// Routes for hinted connections, looked up once per hint until the network
+// changes
+class HintRoutes {
+  HintRoutes(this.syncServerUrl);
+
+  final String syncServerUrl;
+  final _routes = <String, Future<String>>{};
+
+  Future<String> route(RoutingHints hints) {
+    return _routes.putIfAbsent(hints.key, () {
+      final lookup = _lookup(hints);
+      // Don't keep a failure; the next connection asks again
+      lookup.catchError((e) {
+        _routes.remove(hints.key);
+        return '';
+      });
+      return lookup;
+    });
+  }
+
+  // The node is gone or refused us; look it up again next time
+  void forget(RoutingHints hints) => _routes.remove(hints.key);
+
+  void clear() => _routes.clear();
+
+  Future<String> _lookup(RoutingHints hints) async {
+    final String r;
+    if (hints.serverId != null) {
+      final response = await http.post(
+        Uri.parse('$syncServerUrl/route'),
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode({'serverId': hints.serverId}),
+      );
+      if (response.statusCode == 410) {
+        // Removed from the catalog recently, rather than never known
+        throw Exception('Server ${hints.serverId} is gone; pick another server or location');
+      }
+      if (response.statusCode != 200) {
+        throw Exception('No route to server ${hints.serverId}: ${response.statusCode}');
+      }
+      r = jsonDecode(response.body)['url'];
+    } else {
+      final response = await http.post(
+        Uri.parse('https://horse.0x409.nl/route'),
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode({'location': hints.location}),
+      );
+      if (response.statusCode != 200) {
+        throw Exception('No route for ${hints.location}: ${response.statusCode}');
+      }
+      r = response.body;
+    }
+    if (!r.startsWith('wss://')) throw Exception('No WebSocket route for $hints');
+    return r;
+  }
+}
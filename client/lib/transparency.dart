@@ -0,0 +1,147 @@
+import 'dart:convert';
+import 'dart:io';
+import 'package:cryptography/cryptography.dart';
+import 'package:http/http.dart' as http;
+
+// The operator's transparency statement (warrant canary), served signed by
+// the sync server at /transparency. Statements are signed with a key of
+// their own, pinned with
+// --dart-define=HORSEVPN_TRANSPARENCY_PUBLIC_KEY=<base64> (logged by the
+// sync server when it first generates one). When the operator rotates it,
+// each new key comes signed by the one before, so the pinned key keeps
+// working; once we have seen a newer key we trust only that one onwards.
+const String transparencyPublicKey = String.fromEnvironment('HORSEVPN_TRANSPARENCY_PUBLIC_KEY');
+
+// Must match the sync server's
+const String _statementContext = 'horsevpn-transparency-v1\n';
+const String _endorsementContext = 'horsevpn-transparency-key-v1\n';
+
+class TransparencyStatement {
+  TransparencyStatement._(this.statement, this.sequence, this.issuedAt, this.nextUpdate, this.keyId);
+
+  final String statement;
+  final int sequence;
+  final DateTime issuedAt;
+  // Past this without a newer statement, the canary has lapsed
+  final DateTime nextUpdate;
+  final String keyId;
+
+  bool get stale => DateTime.now().isAfter(nextUpdate);
+
+  Map<String, dynamic> toJson() => {
+        'statement': statement,
+        'sequence': sequence,
+        'issuedAt': issuedAt.toUtc().toIso8601String(),
+        'nextUpdate': nextUpdate.toUtc().toIso8601String(),
+        'keyId': keyId,
+        'stale': stale,
+      };
+}
+
+// Fetches and checks statements, keeping the newest sequence and key seen
+// in ~/.horsevpn/transparency.json
+class Transparency {
+  Transparency(this.syncServerUrl);
+
+  final String syncServerUrl;
+
+  static bool get configured => transparencyPublicKey.isNotEmpty;
+
+  static File get _file {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    return File('$home/.horsevpn/transparency.json');
+  }
+
+  // The current statement, or null if the operator publishes none. Throws
+  // if it doesn't verify, is older than one seen before, or was withdrawn
+  // after we saw one, all of which should worry the user more than no
+  // statement at all.
+  Future<TransparencyStatement?> fetch() async {
+    if (!configured) {
+      throw Exception('This client was built without HORSEVPN_TRANSPARENCY_PUBLIC_KEY');
+    }
+    final seen = await _load();
+    final response = await http
+        .get(Uri.parse('$syncServerUrl/transparency'))
+        .timeout(const Duration(seconds: 30));
+    if (response.statusCode == 404) {
+      if (seen != null) throw Exception('The transparency statement was withdrawn');
+      return null;
+    }
+    if (response.statusCode != 200) {
+      throw Exception('Failed to fetch transparency statement: ${response.statusCode}');
+    }
+
+    final body = jsonDecode(response.body) as Map<String, dynamic>;
+    final signer = await _followKeys(body['keys'] as List? ?? [], seen?['publicKey'] as String? ?? transparencyPublicKey);
+    final payloadBytes = base64.decode(body['payload'] as String);
+    if (!await _verify([...utf8.encode(_statementContext), ...payloadBytes], body['signature'] as String, signer['publicKey'] as String)) {
+      throw Exception('Transparency statement signature is invalid');
+    }
+
+    final json = jsonDecode(utf8.decode(payloadBytes)) as Map<String, dynamic>;
+    if (json['keyId'] != signer['id']) {
+      throw Exception('Transparency statement names the wrong key');
+    }
+    final statement = TransparencyStatement._(
+      json['statement'] as String,
+      json['sequence'] as int,
+      DateTime.fromMillisecondsSinceEpoch(json['issuedAt'] as int),
+      DateTime.fromMillisecondsSinceEpoch(json['nextUpdate'] as int),
+      json['keyId'] as String,
+    );
+    if (seen != null && statement.sequence < (seen['sequence'] as int)) {
+      throw Exception('Refusing transparency statement older than one seen before');
+    }
+    await _save({'sequence': statement.sequence, 'publicKey': signer['publicKey']});
+    return statement;
+  }
+
+  // Finds trusted among keys, oldest first, and follows the endorsements
+  // from there to the newest key, which must be the one that signs
+  static Future<Map<String, dynamic>> _followKeys(List keys, String trusted) async {
+    final start = keys.indexWhere((k) => k['publicKey'] == trusted);
+    if (start < 0) throw Exception('Transparency statement is not signed by a key we trust');
+    for (var i = start + 1; i < keys.length; i++) {
+      final key = keys[i] as Map<String, dynamic>;
+      final endorsement = key['endorsement'] as String?;
+      final message = utf8.encode('$_endorsementContext${key['id']}\n${key['publicKey']}');
+      if (endorsement == null || !await _verify(message, endorsement, keys[i - 1]['publicKey'] as String)) {
+        throw Exception('Transparency key ${key['id']} is not endorsed by the key before it');
+      }
+    }
+    return keys.last as Map<String, dynamic>;
+  }
+
+  static Future<bool> _verify(List<int> message, String signature, String publicKey) {
+    return Ed25519().verify(
+      message,
+      signature: Signature(
+        base64.decode(signature),
+        publicKey: SimplePublicKey(base64.decode(publicKey), type: KeyPairType.ed25519),
+      ),
+    );
+  }
+
+  static Future<Map<String, dynamic>?> _load() async {
+    final file = _file;
+    if (!await file.exists()) return null;
+    try {
+      return jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+    } catch (e) {
+      print('Ignoring saved transparency state: $e');
+      return null;
+    }
+  }
+
+  // Writes to a temporary file first so a crash never leaves half of it
+  static Future<void> _save(Map<String, dynamic> state) async {
+    final file = _file;
+    await file.parent.create(recursive: true);
+    final tmp = File('${file.path}.tmp');
+    await tmp.writeAsString(jsonEncode(state));
+    await tmp.rename(file.path);
+  }
+}
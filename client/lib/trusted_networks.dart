@@ -0,0 +1,124 @@
+import 'dart:convert';
+import 'dart:io';
+
+// Networks where the tunnel isn't needed, such as home or office Wi-Fi. While
+// on one, the desktop proxy pauses and the PAC script sends everything
+// direct; on any other network it connects again. Configured in
+// ~/.horsevpn/trusted-networks.json:
+//
+//   {"ssids": ["HomeWifi"], "subnets": ["192.168.1.0/24", "fd00:1::/64"]}
+class TrustedNetworks {
+  TrustedNetworks({this.ssids = const [], this.subnets = const []});
+
+  final List<String> ssids;
+  final List<Subnet> subnets;
+
+  bool get isEmpty => ssids.isEmpty && subnets.isEmpty;
+
+  static Future<TrustedNetworks> load() async {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    final file = File('$home/.horsevpn/trusted-networks.json');
+    if (!await file.exists()) return TrustedNetworks();
+
+    try {
+      final data = jsonDecode(await file.readAsString());
+      final subnets = <Subnet>[];
+      for (final s in (data['subnets'] as List? ?? [])) {
+        final subnet = Subnet.tryParse(s.toString());
+        if (subnet == null) {
+          print('Ignoring invalid trusted subnet: $s');
+          continue;
+        }
+        subnets.add(subnet);
+      }
+      return TrustedNetworks(
+        ssids: (data['ssids'] as List? ?? []).map((s) => s.toString()).toList(),
+        subnets: subnets,
+      );
+    } catch (e) {
+      print('Ignoring unreadable trusted-networks.json: $e');
+      return TrustedNetworks();
+    }
+  }
+
+  // Whether we're currently on a trusted network: connected to a listed
+  // SSID, or holding an address inside a listed subnet
+  Future<bool> isTrusted() async {
+    if (isEmpty) return false;
+
+    if (subnets.isNotEmpty) {
+      final interfaces = await NetworkInterface.list(includeLoopback: false);
+      for (final iface in interfaces) {
+        for (final addr in iface.addresses) {
+          if (subnets.any((s) => s.contains(addr))) return true;
+        }
+      }
+    }
+
+    if (ssids.isNotEmpty) {
+      final ssid = await currentSsid();
+      if (ssid != null && ssids.contains(ssid)) return true;
+    }
+    return false;
+  }
+
+  // The SSID of the Wi-Fi network we're on, if any. There is no portable API
+  // for this, so ask each platform's own tool.
+  static Future<String?> currentSsid() async {
+    try {
+      if (Platform.isLinux) {
+        final result = await Process.run('iwgetid', ['-r']);
+        final ssid = result.stdout.toString().trim();
+        if (result.exitCode == 0 && ssid.isNotEmpty) return ssid;
+
+        final nmcli = await Process.run('nmcli', ['-t', '-f', 'active,ssid', 'dev', 'wifi']);
+        for (final line in LineSplitter.split(nmcli.stdout.toString())) {
+          if (line.startsWith('yes:')) return line.substring(4);
+        }
+      } else if (Platform.isMacOS) {
+        final result = await Process.run('networksetup', ['-getairportnetwork', 'en0']);
+        final match = RegExp(r'Current Wi-Fi Network: (.+)').firstMatch(result.stdout.toString());
+        return match?.group(1)?.trim();
+      } else if (Platform.isWindows) {
+        final result = await Process.run('netsh', ['wlan', 'show', 'interfaces']);
+        final match = RegExp(r'^\s*SSID\s*: (.+)$', multiLine: true).firstMatch(result.stdout.toString());
+        return match?.group(1)?.trim();
+      }
+    } catch (e) {
+      // The tool isn't installed; treat it as not being on Wi-Fi
+    }
+    return null;
+  }
+}
+
+class Subnet {
+  Subnet(this.network, this.prefixLength);
+
+  final List<int> network;
+  final int prefixLength;
+
+  static Subnet? tryParse(String cidr) {
+    final parts = cidr.split('/');
+    if (parts.length != 2) return null;
+    final addr = InternetAddress.tryParse(parts[0]);
+    final prefix = int.tryParse(parts[1]);
+    if (addr == null || prefix == null || prefix < 0 || prefix > addr.rawAddress.length * 8) {
+      return null;
+    }
+    return Subnet(addr.rawAddress, prefix);
+  }
+
+  bool contains(InternetAddress addr) {
+    final raw = addr.rawAddress;
+    if (raw.length != network.length) return false;
+    var bits = prefixLength;
+    for (var i = 0; i < raw.length && bits > 0; i++) {
+      final mask = bits >= 8 ? 0xff : (0xff << (8 - bits)) & 0xff;
+      if ((raw[i] & mask) != (network[i] & mask)) return false;
+      bits -= 8;
+    }
+    return true;
+  }
+}
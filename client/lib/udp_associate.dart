@@ -0,0 +1,144 @@
+import 'dart:async';
+import 'dart:io';
+import 'dart:typed_data';
+import 'package:web_socket_channel/io.dart';
+import 'dns_overrides.dart';
+
+// SOCKS5 UDP ASSOCIATE (RFC 1928 section 7) for applications using the
+// local proxy (desktop only). We bind a UDP socket next to the proxy, tell
+// the application its address, and pass its datagrams to the node's /udp
+// relay over a WebSocket of their own. Datagrams already carry the SOCKS5
+// UDP header the relay reads, and come back with the one it writes, so both
+// directions go through unchanged. The node keeps the NAT mapping; see the
+// server's README. The association lasts as long as the application's
+// control connection, or the WebSocket, whichever ends first. Only the
+// application's own address may send to the socket, from the port it named
+// in its request or, if it named none, the first one it sends from. DNS
+// queries for names in dnsOverrides are answered here and never sent.
+class UdpAssociation {
+  UdpAssociation._(this._control, this._socket, this._channel, this._appPort);
+
+  final Socket _control;
+  final RawDatagramSocket _socket;
+  final IOWebSocketChannel _channel;
+  int? _appPort;
+  final _done = Completer<void>();
+
+  // Completes once the association has ended
+  Future<void> get done => _done.future;
+
+  // Opens the relay for a UDP ASSOCIATE request that came in on control,
+  // followed by rest, and answers it. Throws if the relay can't be reached,
+  // before anything is sent to the application.
+  static Future<UdpAssociation> open(
+    Socket control,
+    Stream<Uint8List> rest,
+    Uint8List request,
+    String route,
+    Map<String, String> headers,
+    HttpClient client, {
+    DnsOverrides? dnsOverrides,
+    void Function(int bytes)? onSent,
+    void Function(int bytes)? onReceived,
+  }) async {
+    final channel = IOWebSocketChannel.connect(
+      Uri.parse(route).replace(path: '/udp'),
+      protocols: ['vpn-protocol'],
+      headers: headers,
+      customClient: client,
+    );
+    await channel.ready;
+    final RawDatagramSocket socket;
+    try {
+      socket = await RawDatagramSocket.bind(control.address, 0);
+    } catch (e) {
+      channel.sink.close();
+      rethrow;
+    }
+
+    // DST.PORT is the last two bytes of the request; 0 means unknown
+    final port = request[request.length - 2] << 8 | request[request.length - 1];
+    final association = UdpAssociation._(control, socket, channel, port == 0 ? null : port);
+    control.add(_reply(socket.address, socket.port));
+
+    socket.listen((event) {
+      if (event != RawSocketEvent.read) return;
+      final datagram = socket.receive();
+      if (datagram == null || !association._fromApp(datagram)) return;
+      // RSV(2) FRAG(1) ATYP(1); the node drops fragments too, but they
+      // needn't cross the tunnel first
+      if (datagram.data.length < 4 || datagram.data[2] != 0) return;
+      if (dnsOverrides != null && dnsOverrides.hosts.isNotEmpty) {
+        final reply = _answerLocally(datagram.data, dnsOverrides);
+        if (reply != null) {
+          socket.send(reply, datagram.address, datagram.port);
+          return;
+        }
+      }
+      onSent?.call(datagram.data.length);
+      channel.sink.add(datagram.data);
+    }, onDone: association.close);
+
+    channel.stream.listen((message) {
+      final appPort = association._appPort;
+      if (message is! List<int> || appPort == null) return;
+      onReceived?.call(message.length);
+      socket.send(message, control.remoteAddress, appPort);
+    }, onDone: association.close, onError: (e) => association.close());
+
+    // Nothing more is expected on the control connection; it closing ends
+    // the association
+    rest.listen((_) {}, onDone: association.close, onError: (e) => association.close());
+    return association;
+  }
+
+  bool _fromApp(Datagram datagram) {
+    if (datagram.address != _control.remoteAddress) return false;
+    _appPort ??= datagram.port;
+    return datagram.port == _appPort;
+  }
+
+  void close() {
+    if (_done.isCompleted) return;
+    _socket.close();
+    _channel.sink.close();
+    _control.destroy();
+    _done.complete();
+  }
+
+  // The reply to a DNS query to port 53 that overrides answers, with the
+  // request's own header, which names the server the reply comes from
+  static Uint8List? _answerLocally(Uint8List datagram, DnsOverrides overrides) {
+    final headerLength = socksUdpHeaderLength(datagram);
+    if (headerLength == null) return null;
+    if ((datagram[headerLength - 2] << 8 | datagram[headerLength - 1]) != 53) return null;
+    final answer = overrides.answer(Uint8List.sublistView(datagram, headerLength));
+    if (answer == null) return null;
+    return Uint8List.fromList([...datagram.sublist(0, headerLength), ...answer]);
+  }
+
+  // VER REP RSV ATYP BND.ADDR BND.PORT
+  static List<int> _reply(InternetAddress address, int port) {
+    final atyp = address.type == InternetAddressType.IPv4 ? 1 : 4;
+    return [5, 0, 0, atyp, ...address.rawAddress, port >> 8, port & 0xff];
+  }
+}
+
+// The length of datagram's SOCKS5 UDP header, RSV(2) FRAG(1) ATYP(1)
+// DST.ADDR DST.PORT(2), or null if it has none that we can read
+int? socksUdpHeaderLength(Uint8List datagram) {
+  if (datagram.length < 4) return null;
+  final int headerLength;
+  switch (datagram[3]) {
+    case 1:
+      headerLength = 4 + 4 + 2;
+    case 4:
+      headerLength = 4 + 16 + 2;
+    case 3:
+      if (datagram.length < 5) return null;
+      headerLength = 4 + 1 + datagram[4] + 2;
+    default:
+      return null;
+  }
+  return datagram.length < headerLength ? null : headerLength;
+}
@@ -0,0 +1,212 @@
+import 'dart:convert';
+import 'dart:io';
+import 'package:http/http.dart' as http;
+import 'package:web_socket_channel/io.dart';
+import 'auth.dart';
+import 'companion_api.dart';
+import 'netem.dart';
+
+// Named virtual networks (desktop only): extra tunnels alongside the main
+// one, each with its own exit, credentials, SOCKS listener and sites. For
+// example work traffic can leave through the org's exit while everything
+// else uses a public one. Configured in ~/.horsevpn/networks.json:
+//
+//   {"networks": [
+//     {"name": "work", "port": 1081, "dedicatedIp": "<reservation token>",
+//      "sites": ["corp.example.com"]},
+//     {"name": "nl", "port": 1082, "location": "Netherlands", "sites": ["example.nl"]}
+//   ]}
+//
+// Each network routes by its location (the device's own if unset), or to
+// the server pinned to its dedicatedIp reservation, and authenticates with
+// token or session tokens for the reservation. The PAC script sends the
+// listed sites (and their subdomains) to the network's listener.
+class VirtualNetwork {
+  VirtualNetwork({
+    required this.name,
+    required this.port,
+    this.location,
+    this.dedicatedIp,
+    this.token,
+    this.sites = const [],
+  });
+
+  final String name;
+  final int port;
+  final String? location;
+  final String? dedicatedIp;
+  final String? token;
+  final List<String> sites;
+
+  static Future<List<VirtualNetwork>> load() async {
+    final home = Platform.environment['HOME'] ??
+        Platform.environment['USERPROFILE'] ??
+        '.';
+    final file = File('$home/.horsevpn/networks.json');
+    if (!await file.exists()) return [];
+
+    try {
+      final data = jsonDecode(await file.readAsString());
+      final networks = <VirtualNetwork>[];
+      for (final n in (data['networks'] as List? ?? [])) {
+        final name = n['name'];
+        final port = n['port'];
+        if (name is! String || !RegExp(r'^[a-z0-9_-]{1,32}$').hasMatch(name) ||
+            port is! int || port < 1024 || port > 65535 || port == 1080 || port == companionPort ||
+            networks.any((other) => other.name == name || other.port == port)) {
+          print('Ignoring invalid virtual network: $n');
+          continue;
+        }
+        networks.add(VirtualNetwork(
+          name: name,
+          port: port,
+          location: n['location'] as String?,
+          dedicatedIp: n['dedicatedIp'] as String?,
+          token: n['token'] as String?,
+          sites: (n['sites'] as List? ?? []).map((s) => s.toString().toLowerCase()).toList(),
+        ));
+      }
+      return networks;
+    } catch (e) {
+      print('Ignoring unreadable networks.json: $e');
+      return [];
+    }
+  }
+}
+
+// The SOCKS listener and tunnels of one virtual network. Like the main
+// proxy, it dials on the first connection and keeps the route until the
+// network changes.
+class NetworkProxy {
+  NetworkProxy(this.network, this.syncServerUrl, this.locate, [this.netem]);
+
+  final VirtualNetwork network;
+  final String syncServerUrl;
+  // The device's location, for networks without one of their own
+  final Future<String> Function() locate;
+  final Netem? netem;
+  final ProxyStats stats = ProxyStats();
+
+  String route = '';
+  String? _serverId;
+  SessionTokens? _sessionTokens;
+  Future<String>? _dialing;
+  ServerSocket? _server;
+  final Set<Socket> _sockets = {};
+
+  Future<void> start() async {
+    _server = await ServerSocket.bind(InternetAddress.loopbackIPv4, network.port);
+    _server!.listen(_handle);
+    print('Virtual network ${network.name} listening on localhost:${network.port}');
+  }
+
+  Future<void> stop() async {
+    await _server?.close();
+    _server = null;
+    dropTunnels();
+  }
+
+  // Drops open tunnels and forgets the route, as after a network change
+  void dropTunnels() {
+    for (final socket in List.of(_sockets)) {
+      socket.destroy();
+    }
+    route = '';
+  }
+
+  Map<String, dynamic> toJson() => {
+        'name': network.name,
+        'port': network.port,
+        'route': route,
+        'sites': network.sites,
+        ...stats.toJson(),
+      };
+
+  Future<String> _ensureRoute() {
+    if (route.isNotEmpty) return Future.value(route);
+    return _dialing ??= _dial().whenComplete(() => _dialing = null);
+  }
+
+  Future<String> _dial() async {
+    final location = network.location ?? await locate();
+    final dedicatedIp = network.dedicatedIp;
+    final http.Response response;
+    if (dedicatedIp != null) {
+      response = await http.post(
+        Uri.parse('$syncServerUrl/route'),
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode({'location': location, 'dedicatedIp': dedicatedIp}),
+      );
+    } else {
+      response = await http.post(
+        Uri.parse('https://horse.0x409.nl/route'),
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode({'location': location}),
+      );
+    }
+    if (response.statusCode != 200) {
+      throw Exception('Failed to get route for ${network.name}: ${response.statusCode}');
+    }
+
+    String r;
+    if (dedicatedIp != null) {
+      final body = jsonDecode(response.body);
+      _serverId = body['id'];
+      r = body['url'];
+      _sessionTokens ??= SessionTokens(syncServerUrl, dedicatedIp);
+    } else {
+      r = response.body;
+    }
+    if (!r.startsWith('wss://')) {
+      throw Exception('No WebSocket route for ${network.name}');
+    }
+    return route = r;
+  }
+
+  Future<void> _handle(Socket socket) async {
+    try {
+      final route = await _ensureRoute();
+      final token = _sessionTokens != null ? await _sessionTokens!.token(_serverId!) : network.token;
+      final client = HttpClient()
+        ..badCertificateCallback = (cert, host, port) {
+          print('Warning: Certificate validation for $host - consider implementing pinning');
+          return true;
+        };
+      final channel = IOWebSocketChannel.connect(
+        Uri.parse(route),
+        protocols: ['vpn-protocol'],
+        headers: {
+          'Origin': 'https://horsevpn-client.localhost',
+          if (token != null) 'Authorization': 'Bearer $token',
+        },
+        customClient: client,
+      );
+      await channel.ready;
+
+      _sockets.add(socket);
+      stats.activeConnections++;
+      stats.totalConnections++;
+      var counted = true;
+      void finished() {
+        if (!counted) return;
+        counted = false;
+        _sockets.remove(socket);
+        stats.activeConnections--;
+        channel.sink.close();
+        socket.destroy();
+      }
+
+      (netem?.apply(socket) ?? socket).listen((data) {
+        stats.bytesUp += data.length;
+        channel.sink.add(data);
+      }, onDone: finished, onError: (e) => finished());
+      (netem?.apply(channel.stream) ?? channel.stream).listen((data) {
+        if (data is List<int>) stats.bytesDown += data.length;
+        socket.add(data);
+      }, onDone: finished, onError: (e) => finished());
+    } catch (e) {
+      print('Virtual network ${network.name} connection error: $e');
+      socket.destroy();
+    }
+  }
+}
@@ -0,0 +1,106 @@
+// Operator announcements: a message of the day or incident banner that
+// nodes pass on to the clients connected through them, when they connect
+// and whenever it changes. There is one at a time; setting a new one
+// replaces it, and one with expiresAt stops being served after then.
+import sqlite3 from 'sqlite3';
+
+export type AnnouncementSeverity = 'info' | 'maintenance' | 'incident';
+
+const SEVERITIES: AnnouncementSeverity[] = ['info', 'maintenance', 'incident'];
+
+const MAX_MESSAGE_LENGTH = 500;
+
+export interface Announcement {
+  message: string;
+  severity: AnnouncementSeverity;
+  updatedBy: string;
+  updatedAt: number;
+  // Milliseconds since the epoch
+  expiresAt?: number;
+}
+
+let current: Announcement | undefined;
+let db: sqlite3.Database;
+
+export function initAnnouncements(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    // A single row, with id 1
+    db.run(`CREATE TABLE IF NOT EXISTS announcement (
+      id INTEGER PRIMARY KEY CHECK (id = 1),
+      message TEXT NOT NULL,
+      severity TEXT NOT NULL,
+      updated_by TEXT NOT NULL,
+      updated_at INTEGER NOT NULL,
+      expires_at INTEGER
+    )`);
+    db.get('SELECT * FROM announcement WHERE id = 1', [], (err, row: any) => {
+      if (err) {
+        console.error('Error loading announcement from DB:', err);
+        return;
+      }
+      if (row) {
+        current = {
+          message: row.message,
+          severity: row.severity,
+          updatedBy: row.updated_by,
+          updatedAt: row.updated_at,
+          ...(row.expires_at !== null && { expiresAt: row.expires_at })
+        };
+      }
+    });
+  });
+}
+
+// Checks an announcement from the admin API, returning its message,
+// severity and expiry or an error message
+export function parseAnnouncement(body: any): Pick<Announcement, 'message' | 'severity' | 'expiresAt'> | string {
+  if (typeof body !== 'object' || body === null) {
+    return 'Announcement must be an object';
+  }
+  const { message, severity = 'info', expiresAt } = body;
+  if (typeof message !== 'string' || message.trim().length === 0 || message.length > MAX_MESSAGE_LENGTH) {
+    return `message must be 1 to ${MAX_MESSAGE_LENGTH} characters`;
+  }
+  if (!SEVERITIES.includes(severity)) {
+    return `severity must be one of ${SEVERITIES.join(', ')}`;
+  }
+  if (expiresAt !== undefined && (!Number.isSafeInteger(expiresAt) || expiresAt <= Date.now())) {
+    return 'expiresAt must be a time in the future, in milliseconds since the epoch';
+  }
+  return { message: message.trim(), severity, ...(expiresAt !== undefined && { expiresAt }) };
+}
+
+// The announcement being served, unless there is none or it has expired
+export function currentAnnouncement(): Announcement | undefined {
+  if (current?.expiresAt !== undefined && current.expiresAt <= Date.now()) {
+    return undefined;
+  }
+  return current;
+}
+
+export function putAnnouncement(announcement: Pick<Announcement, 'message' | 'severity' | 'expiresAt'>, updatedBy: string): Announcement {
+  current = { ...announcement, updatedBy, updatedAt: Date.now() };
+  db.run(
+    'INSERT OR REPLACE INTO announcement (id, message, severity, updated_by, updated_at, expires_at) VALUES (1, ?, ?, ?, ?, ?)',
+    [current.message, current.severity, updatedBy, current.updatedAt, current.expiresAt ?? null]
+  );
+  return current;
+}
+
+export function deleteAnnouncement(): boolean {
+  if (!current) return false;
+  current = undefined;
+  db.run('DELETE FROM announcement WHERE id = 1');
+  return true;
+}
+
+// The announcement as nodes receive it, without who set it
+export function announcementView(announcement: Announcement) {
+  return {
+    message: announcement.message,
+    severity: announcement.severity,
+    updatedAt: announcement.updatedAt,
+    ...(announcement.expiresAt !== undefined && { expiresAt: announcement.expiresAt })
+  };
+}
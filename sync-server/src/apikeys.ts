@@ -0,0 +1,109 @@
+// API keys for tunnels. Operators issue long-lived keys to users (e.g. for
+// servers and scripts that can't do the session token exchange); nodes with
+// API_KEYS_URL check each key here and cache the answer briefly, so a revoked
+// or expired key stops working within a minute. Only SHA-256 hashes of keys
+// are stored.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface ApiKey {
+  id: string;
+  user: string;
+  name: string;
+  createdAt: number;
+  // null if the key doesn't expire
+  expiresAt: number | null;
+  revokedAt: number | null;
+}
+
+export const API_KEY_PREFIX = 'hvk_';
+
+// Keyed by hash
+const keys: Map<string, ApiKey> = new Map();
+let db: sqlite3.Database;
+
+export function initApiKeys(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS api_keys (
+      id TEXT PRIMARY KEY,
+      hash TEXT NOT NULL UNIQUE,
+      user TEXT NOT NULL,
+      name TEXT NOT NULL,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER,
+      revoked_at INTEGER
+    )`);
+    db.all('SELECT * FROM api_keys', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading API keys from DB:', err);
+        return;
+      }
+      rows.forEach(row => keys.set(row.hash, {
+        id: row.id,
+        user: row.user,
+        name: row.name,
+        createdAt: row.created_at,
+        expiresAt: row.expires_at,
+        revokedAt: row.revoked_at
+      }));
+    });
+  });
+}
+
+function hashKey(key: string): string {
+  return crypto.createHash('sha256').update(key).digest('hex');
+}
+
+function saveKey(hash: string, key: ApiKey) {
+  db.run(
+    'INSERT OR REPLACE INTO api_keys (id, hash, user, name, created_at, expires_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?)',
+    [key.id, hash, key.user, key.name, key.createdAt, key.expiresAt, key.revokedAt],
+    (err) => {
+      if (err) console.error('Error saving API key:', err);
+    }
+  );
+}
+
+// Issues a key; the secret is returned only here
+export function createApiKey(user: string, name: string, ttlMs: number | null): { key: ApiKey; secret: string } {
+  const secret = API_KEY_PREFIX + crypto.randomBytes(32).toString('base64url');
+  const now = Date.now();
+  const key: ApiKey = {
+    id: crypto.randomBytes(8).toString('hex'),
+    user,
+    name,
+    createdAt: now,
+    expiresAt: ttlMs === null ? null : now + ttlMs,
+    revokedAt: null
+  };
+  const hash = hashKey(secret);
+  keys.set(hash, key);
+  saveKey(hash, key);
+  return { key, secret };
+}
+
+export function listApiKeys(user?: string): ApiKey[] {
+  return Array.from(keys.values()).filter(k => user === undefined || k.user === user);
+}
+
+export function revokeApiKey(id: string): ApiKey | undefined {
+  for (const [hash, key] of keys) {
+    if (key.id !== id) continue;
+    if (key.revokedAt === null) {
+      key.revokedAt = Date.now();
+      saveKey(hash, key);
+    }
+    return key;
+  }
+  return undefined;
+}
+
+// Returns the key if it is valid now, or why it isn't
+export function verifyApiKey(secret: string): ApiKey | string {
+  const key = keys.get(hashKey(secret));
+  if (!key) return 'Unknown key';
+  if (key.revokedAt !== null) return 'Key has been revoked';
+  if (key.expiresAt !== null && key.expiresAt <= Date.now()) return 'Key has expired';
+  return key;
+}
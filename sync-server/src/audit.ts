@@ -0,0 +1,114 @@
+// Append-only audit log of administrative and auth events. Each entry carries
+// the SHA-256 of the previous entry's hash and its own contents, so editing or
+// deleting a row breaks the chain from that point on.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface AuditEntry {
+  seq: number;
+  at: number;
+  event: string;
+  actor: string;
+  details: Record<string, unknown>;
+  prevHash: string;
+  hash: string;
+}
+
+const GENESIS_HASH = '0'.repeat(64);
+
+let db: sqlite3.Database;
+let head = { seq: 0, hash: GENESIS_HASH };
+let loaded = false;
+// Events recorded before the chain head has been read from the database
+const pending: Array<[string, string, Record<string, unknown>]> = [];
+
+export function initAudit(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS audit_log (
+      seq INTEGER PRIMARY KEY,
+      at INTEGER NOT NULL,
+      event TEXT NOT NULL,
+      actor TEXT NOT NULL,
+      details TEXT NOT NULL,
+      prev_hash TEXT NOT NULL,
+      hash TEXT NOT NULL
+    )`);
+    db.get('SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1', [], (err, row: any) => {
+      if (err) {
+        console.error('Error loading audit log head from DB:', err);
+      } else if (row) {
+        head = { seq: row.seq, hash: row.hash };
+      }
+      loaded = true;
+      pending.splice(0).forEach(([event, actor, details]) => recordAudit(event, actor, details));
+    });
+  });
+}
+
+function entryHash(prevHash: string, seq: number, at: number, event: string, actor: string, details: string): string {
+  return crypto.createHash('sha256')
+    .update(`${prevHash}\n${JSON.stringify([seq, at, event, actor, details])}`)
+    .digest('hex');
+}
+
+// Records an event. actor identifies who caused it, e.g. "admin@1.2.3.4".
+export function recordAudit(event: string, actor: string, details: Record<string, unknown> = {}) {
+  if (!loaded) {
+    pending.push([event, actor, details]);
+    return;
+  }
+
+  const seq = head.seq + 1;
+  const at = Date.now();
+  const detailsJson = JSON.stringify(details);
+  const hash = entryHash(head.hash, seq, at, event, actor, detailsJson);
+
+  db.run(
+    'INSERT INTO audit_log (seq, at, event, actor, details, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?)',
+    [seq, at, event, actor, detailsJson, head.hash, hash],
+    (err) => {
+      if (err) console.error('Error writing audit log entry:', err);
+    }
+  );
+  head = { seq, hash };
+}
+
+function rowToEntry(row: any): AuditEntry {
+  return {
+    seq: row.seq,
+    at: row.at,
+    event: row.event,
+    actor: row.actor,
+    details: JSON.parse(row.details),
+    prevHash: row.prev_hash,
+    hash: row.hash
+  };
+}
+
+// Returns entries after the given sequence number, oldest first
+export function exportAudit(since: number, limit: number, callback: (err: Error | null, entries: AuditEntry[]) => void) {
+  db.all('SELECT * FROM audit_log WHERE seq > ? ORDER BY seq LIMIT ?', [since, limit], (err, rows: any[]) => {
+    if (err) return callback(err, []);
+    callback(null, rows.map(rowToEntry));
+  });
+}
+
+// Walks the whole chain and reports the first entry that doesn't match
+export function verifyAudit(callback: (err: Error | null, result: { entries: number; head: string; brokenAt: number | null }) => void) {
+  db.all('SELECT * FROM audit_log ORDER BY seq', [], (err, rows: any[]) => {
+    if (err) return callback(err, { entries: 0, head: GENESIS_HASH, brokenAt: null });
+
+    let prevHash = GENESIS_HASH;
+    let prevSeq = 0;
+    for (const row of rows) {
+      const expected = entryHash(prevHash, row.seq, row.at, row.event, row.actor, row.details);
+      if (row.seq !== prevSeq + 1 || row.prev_hash !== prevHash || row.hash !== expected) {
+        return callback(null, { entries: rows.length, head: prevHash, brokenAt: prevSeq + 1 });
+      }
+      prevHash = row.hash;
+      prevSeq = row.seq;
+    }
+    callback(null, { entries: rows.length, head: prevHash, brokenAt: null });
+  });
+}
@@ -0,0 +1,60 @@
+// Canary rollout: a fixed share of clients is routed to servers tagged
+// "canary" so new server builds can be compared against the stable fleet.
+import crypto from 'crypto';
+
+export type Cohort = 'canary' | 'stable';
+
+export const CANARY_TAG = 'canary';
+
+const CANARY_PERCENT = Math.min(100, Math.max(0, parseFloat(process.env.CANARY_PERCENT || '0') || 0));
+
+// Random per-process key so client buckets are sticky without storing addresses
+const bucketKey = crypto.randomBytes(32);
+
+export function cohortOfTags(tags: string[]): Cohort {
+  return tags.includes(CANARY_TAG) ? 'canary' : 'stable';
+}
+
+// Assigns a client to a cohort. The same client lands in the same cohort for
+// the lifetime of the process.
+export function cohortForClient(clientKey: string): Cohort {
+  if (CANARY_PERCENT <= 0) return 'stable';
+  const digest = crypto.createHmac('sha256', bucketKey).update(clientKey).digest();
+  const bucket = digest.readUInt32BE(0) % 10000;
+  return bucket < CANARY_PERCENT * 100 ? 'canary' : 'stable';
+}
+
+interface CohortStats {
+  samples: number;
+  connectMsTotal: number;
+  throughputSamples: number;
+  throughputKbpsTotal: number;
+}
+
+const stats: Record<Cohort, CohortStats> = {
+  canary: { samples: 0, connectMsTotal: 0, throughputSamples: 0, throughputKbpsTotal: 0 },
+  stable: { samples: 0, connectMsTotal: 0, throughputSamples: 0, throughputKbpsTotal: 0 }
+};
+
+export function recordCohortSample(cohort: Cohort, connectMs: number, throughputKbps?: number) {
+  const s = stats[cohort];
+  s.samples++;
+  s.connectMsTotal += connectMs;
+  if (throughputKbps !== undefined) {
+    s.throughputSamples++;
+    s.throughputKbpsTotal += throughputKbps;
+  }
+}
+
+export function cohortSummary() {
+  const summarize = (s: CohortStats) => ({
+    samples: s.samples,
+    avgConnectMs: s.samples > 0 ? s.connectMsTotal / s.samples : null,
+    avgThroughputKbps: s.throughputSamples > 0 ? s.throughputKbpsTotal / s.throughputSamples : null
+  });
+  return {
+    canaryPercent: CANARY_PERCENT,
+    canary: summarize(stats.canary),
+    stable: summarize(stats.stable)
+  };
+}
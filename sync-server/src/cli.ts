@@ -0,0 +1,108 @@
+#!/usr/bin/env node
+// horsevpn-sync: command line for sync server operators. It talks to a
+// running sync server's admin API, at SYNC_SERVER_URL with ADMIN_TOKEN
+// (and, once the token has TOTP enrolled, a step-up session from
+// HORSEVPN_STEP_UP or a code from HORSEVPN_TOTP_CODE).
+//
+//   horsevpn-sync tokens create-node --location=<loc> [--ttl=1h] [--tags=a,b]
+//   horsevpn-sync tokens list
+//   horsevpn-sync tokens revoke <id>
+import axios, { AxiosError } from 'axios';
+
+const USAGE = `Usage:
+  horsevpn-sync tokens create-node --location=<location> [--ttl=1h] [--tags=a,b]
+  horsevpn-sync tokens list
+  horsevpn-sync tokens revoke <id>
+
+Environment:
+  SYNC_SERVER_URL     sync server to talk to (default: http://localhost:3001)
+  ADMIN_TOKEN         admin API token with the operator role
+  HORSEVPN_STEP_UP    step-up session from POST /admin/totp/session, once TOTP is enrolled
+  HORSEVPN_TOTP_CODE  current TOTP code, instead of a step-up session`;
+
+// Parses durations such as 90s, 30m, 1h and 7d; plain numbers are seconds
+export function parseDuration(s: string): number | undefined {
+  const match = /^([0-9]+)([smhd]?)$/.exec(s);
+  if (!match) return undefined;
+  const unit = { '': 1, s: 1, m: 60, h: 3600, d: 86400 }[match[2]]!;
+  return parseInt(match[1], 10) * unit;
+}
+
+function parseFlags(args: string[]): { flags: Map<string, string>; positional: string[] } {
+  const flags: Map<string, string> = new Map();
+  const positional: string[] = [];
+  for (const arg of args) {
+    const match = /^--([a-z-]+)=(.*)$/.exec(arg);
+    if (match) {
+      flags.set(match[1], match[2]);
+    } else {
+      positional.push(arg);
+    }
+  }
+  return { flags, positional };
+}
+
+function fail(message: string): never {
+  console.error(message);
+  process.exit(1);
+}
+
+function client() {
+  const token = process.env.ADMIN_TOKEN;
+  if (!token) fail('ADMIN_TOKEN must be set');
+  const headers: Record<string, string> = { Authorization: `Bearer ${token}` };
+  if (process.env.HORSEVPN_STEP_UP) {
+    headers['X-Step-Up'] = process.env.HORSEVPN_STEP_UP;
+  } else if (process.env.HORSEVPN_TOTP_CODE) {
+    headers['X-TOTP-Code'] = process.env.HORSEVPN_TOTP_CODE;
+  }
+  return axios.create({ baseURL: process.env.SYNC_SERVER_URL || 'http://localhost:3001', headers, timeout: 10000 });
+}
+
+async function createNodeToken(flags: Map<string, string>) {
+  const location = flags.get('location');
+  if (!location) fail('--location is required');
+  const ttlSeconds = parseDuration(flags.get('ttl') ?? '1h');
+  if (ttlSeconds === undefined || ttlSeconds <= 0) fail('Invalid --ttl, expected e.g. 30m, 1h or 7d');
+  const tags = (flags.get('tags') ?? '').split(',').map(t => t.trim()).filter(t => t !== '');
+
+  const { data } = await client().post('/join-tokens', { location, tags, ttlSeconds });
+  console.log(data.token);
+  console.error(`Join token ${data.id} for ${location}, single use, expires ${new Date(data.expiresAt).toISOString()}`);
+  console.error('Start the node with JOIN_TOKEN set to the token above.');
+}
+
+async function listTokens() {
+  const { data } = await client().get('/join-tokens');
+  for (const t of data) {
+    const state = t.used ? `used by ${t.serverId}` : t.expiresAt <= Date.now() ? 'expired' : 'unused';
+    console.log(`${t.id}  ${t.location}  ${new Date(t.expiresAt).toISOString()}  ${state}`);
+  }
+}
+
+async function revokeToken(id: string | undefined) {
+  if (!id) fail(USAGE);
+  await client().delete(`/join-tokens/${encodeURIComponent(id)}`);
+  console.log(`Revoked join token ${id}`);
+}
+
+async function main(argv: string[]) {
+  const [group, command, ...rest] = argv;
+  const { flags, positional } = parseFlags(rest);
+  if (group !== 'tokens') fail(USAGE);
+  switch (command) {
+    case 'create-node':
+      return createNodeToken(flags);
+    case 'list':
+      return listTokens();
+    case 'revoke':
+      return revokeToken(positional[0]);
+    default:
+      fail(USAGE);
+  }
+}
+
+main(process.argv.slice(2)).catch((err: AxiosError<{ error?: string }>) => {
+  const detail = err.response?.data?.error ?? err.message;
+  fail(`Error: ${detail}`);
+});
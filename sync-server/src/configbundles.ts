@@ -0,0 +1,280 @@
+// Client configuration bundles: split-tunnel rules, DNS settings, a blocklist,
+// kill-switch policy, malware protection and parental controls that the sync
+// server distributes to clients. There
+// is one global bundle, set by operators, and one per organization, set by
+// its admins; members of an org with a bundle get the org's, everyone else
+// the global one. Each change bumps the bundle's version, and bundles are
+// served signed with the sync server's Ed25519 key so clients can check
+// them before applying them.
+import sqlite3 from 'sqlite3';
+import net from 'net';
+import { normalizeSite } from './orgs';
+import { ParentalProfile, parseParentalProfiles } from './parentalcontrols';
+import { signWithSyncKey } from './sessiontokens';
+
+// Sections whose settings can be enforced. The blocklist is always enforced.
+export type ConfigSection = 'splitTunnel' | 'dns' | 'killSwitch' | 'malwareProtection' | 'parentalControls';
+
+const CONFIG_SECTIONS: ConfigSection[] = ['splitTunnel', 'dns', 'killSwitch', 'malwareProtection', 'parentalControls'];
+
+// Sections left out of a bundle leave the client's own settings alone.
+// Sections listed in enforce win over the user's local settings; the others
+// are defaults the user can override.
+export interface ClientConfig {
+  splitTunnel?: {
+    tunnelByDefault?: boolean;
+    direct: string[];
+    tunnel: string[];
+  };
+  dns?: {
+    servers: string[];
+    searchDomains: string[];
+  };
+  blocklist?: string[];
+  killSwitch?: {
+    enabled: boolean;
+    // Whether local network traffic may bypass the tunnel
+    allowLan: boolean;
+  };
+  // Whether tunnels ask exit nodes to check destinations against their
+  // malware feeds
+  malwareProtection?: {
+    enabled: boolean;
+  };
+  // The profile clients apply, out of profiles; see parentalcontrols.ts
+  parentalControls?: {
+    profile: string;
+    profiles: ParentalProfile[];
+  };
+  enforce?: ConfigSection[];
+}
+
+export interface ConfigBundle {
+  // 'global' or 'org:<org ID>'
+  scope: string;
+  version: number;
+  config: ClientConfig;
+  updatedBy: string;
+  updatedAt: number;
+}
+
+// Prefixed to the payload before signing, so a bundle signature can never
+// pass for a session token signature made with the same key
+const CONFIG_BUNDLE_CONTEXT = 'horsevpn-config-bundle-v1\n';
+
+const MAX_SITES = 2000;
+const MAX_DNS_SERVERS = 4;
+
+const bundles: Map<string, ConfigBundle> = new Map();
+// Long-polling clients waiting for the next change
+const waiters: Set<() => void> = new Set();
+let db: sqlite3.Database;
+
+export function initConfigBundles(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS config_bundles (
+      scope TEXT PRIMARY KEY,
+      version INTEGER NOT NULL,
+      config TEXT NOT NULL,
+      updated_by TEXT NOT NULL,
+      updated_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM config_bundles', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading config bundles from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        bundles.set(row.scope, {
+          scope: row.scope,
+          version: row.version,
+          config: JSON.parse(row.config),
+          updatedBy: row.updated_by,
+          updatedAt: row.updated_at
+        });
+      });
+      console.log(`Loaded ${bundles.size} config bundles`);
+    });
+  });
+}
+
+export function orgScope(orgId: string): string {
+  return `org:${orgId}`;
+}
+
+function parseSites(list: unknown, name: string): string[] | string {
+  if (!Array.isArray(list) || list.length > MAX_SITES) {
+    return `${name} must be a list of at most ${MAX_SITES} sites`;
+  }
+  const sites: string[] = [];
+  for (const site of list) {
+    const normalized = normalizeSite(site);
+    if (!normalized) return `Invalid site in ${name}: ${site}`;
+    sites.push(normalized);
+  }
+  return Array.from(new Set(sites));
+}
+
+// Checks and normalizes a client config, returning it or an error message
+export function parseClientConfig(body: any): ClientConfig | string {
+  if (typeof body !== 'object' || body === null) {
+    return 'Config must be an object';
+  }
+  const config: ClientConfig = {};
+
+  if (body.splitTunnel !== undefined) {
+    const s = body.splitTunnel;
+    if (typeof s !== 'object' || s === null) return 'splitTunnel must be an object';
+    if (s.tunnelByDefault !== undefined && typeof s.tunnelByDefault !== 'boolean') {
+      return 'splitTunnel.tunnelByDefault must be a boolean';
+    }
+    const direct = parseSites(s.direct ?? [], 'splitTunnel.direct');
+    if (typeof direct === 'string') return direct;
+    const tunnel = parseSites(s.tunnel ?? [], 'splitTunnel.tunnel');
+    if (typeof tunnel === 'string') return tunnel;
+    config.splitTunnel = { direct, tunnel };
+    if (s.tunnelByDefault !== undefined) config.splitTunnel.tunnelByDefault = s.tunnelByDefault;
+  }
+
+  if (body.dns !== undefined) {
+    const d = body.dns;
+    if (typeof d !== 'object' || d === null) return 'dns must be an object';
+    const servers = d.servers ?? [];
+    if (!Array.isArray(servers) || servers.length > MAX_DNS_SERVERS ||
+        !servers.every((s: unknown) => typeof s === 'string' && net.isIP(s) !== 0)) {
+      return `dns.servers must be a list of at most ${MAX_DNS_SERVERS} IP addresses`;
+    }
+    const searchDomains = parseSites(d.searchDomains ?? [], 'dns.searchDomains');
+    if (typeof searchDomains === 'string') return searchDomains;
+    config.dns = { servers, searchDomains };
+  }
+
+  if (body.blocklist !== undefined) {
+    const blocklist = parseSites(body.blocklist, 'blocklist');
+    if (typeof blocklist === 'string') return blocklist;
+    config.blocklist = blocklist;
+  }
+
+  if (body.killSwitch !== undefined) {
+    const k = body.killSwitch;
+    if (typeof k !== 'object' || k === null) return 'killSwitch must be an object';
+    const enabled = k.enabled ?? false;
+    const allowLan = k.allowLan ?? true;
+    if (typeof enabled !== 'boolean' || typeof allowLan !== 'boolean') {
+      return 'killSwitch.enabled and killSwitch.allowLan must be booleans';
+    }
+    config.killSwitch = { enabled, allowLan };
+  }
+
+  if (body.malwareProtection !== undefined) {
+    const m = body.malwareProtection;
+    if (typeof m !== 'object' || m === null || typeof (m.enabled ?? false) !== 'boolean') {
+      return 'malwareProtection must be an object with a boolean enabled';
+    }
+    config.malwareProtection = { enabled: m.enabled ?? false };
+  }
+
+  if (body.parentalControls !== undefined) {
+    const p = body.parentalControls;
+    if (typeof p !== 'object' || p === null) return 'parentalControls must be an object';
+    const profiles = parseParentalProfiles(p.profiles, false);
+    if (typeof profiles === 'string') return `parentalControls: ${profiles}`;
+    if (!profiles.some(profile => profile.name === p.profile)) {
+      return 'parentalControls.profile must name one of its profiles';
+    }
+    config.parentalControls = { profile: p.profile, profiles };
+  }
+
+  if (body.enforce !== undefined) {
+    if (!Array.isArray(body.enforce) || !body.enforce.every((s: unknown) => CONFIG_SECTIONS.includes(s as ConfigSection))) {
+      return `enforce must list sections out of ${CONFIG_SECTIONS.join(', ')}`;
+    }
+    const enforce = CONFIG_SECTIONS.filter(s => body.enforce.includes(s));
+    const missing = enforce.find(s => config[s] === undefined);
+    if (missing) return `Cannot enforce ${missing}, which the bundle doesn't set`;
+    config.enforce = enforce;
+  }
+
+  return config;
+}
+
+export function listConfigBundles(): ConfigBundle[] {
+  return Array.from(bundles.values());
+}
+
+export function findConfigBundle(scope: string): ConfigBundle | undefined {
+  return bundles.get(scope);
+}
+
+// The bundle a user gets: their org's if it has one, otherwise the global one
+export function configBundleFor(orgId: string | undefined): ConfigBundle | undefined {
+  return (orgId !== undefined ? bundles.get(orgScope(orgId)) : undefined) ?? bundles.get('global');
+}
+
+function changed() {
+  for (const wake of waiters) wake();
+  waiters.clear();
+}
+
+// Replaces a bundle, bumping its version unless nothing changed
+export function putConfigBundle(scope: string, config: ClientConfig, updatedBy: string): { bundle: ConfigBundle; changed: boolean } {
+  const existing = bundles.get(scope);
+  if (existing && JSON.stringify(existing.config) === JSON.stringify(config)) {
+    return { bundle: existing, changed: false };
+  }
+  const bundle: ConfigBundle = {
+    scope,
+    version: (existing?.version ?? 0) + 1,
+    config,
+    updatedBy,
+    updatedAt: Date.now()
+  };
+  bundles.set(scope, bundle);
+  db.run(
+    'INSERT OR REPLACE INTO config_bundles (scope, version, config, updated_by, updated_at) VALUES (?, ?, ?, ?, ?)',
+    [scope, bundle.version, JSON.stringify(config), updatedBy, bundle.updatedAt]
+  );
+  changed();
+  return { bundle, changed: true };
+}
+
+export function deleteConfigBundle(scope: string): boolean {
+  if (!bundles.delete(scope)) return false;
+  db.run('DELETE FROM config_bundles WHERE scope = ?', [scope]);
+  changed();
+  return true;
+}
+
+// Resolves after the next change to any bundle, or after timeoutMs
+export function waitForConfigChange(timeoutMs: number): Promise<void> {
+  return new Promise(resolve => {
+    const wake = () => {
+      clearTimeout(timer);
+      waiters.delete(wake);
+      resolve();
+    };
+    const timer = setTimeout(wake, timeoutMs);
+    waiters.add(wake);
+  });
+}
+
+// An ETag naming the bundle's scope and version
+export function configBundleETag(bundle: ConfigBundle): string {
+  return `"${bundle.scope}:${bundle.version}"`;
+}
+
+// The bundle as clients receive it. The signature covers the exact payload
+// bytes, so clients verify before parsing and need no canonical JSON.
+export function signedConfigBundle(bundle: ConfigBundle) {
+  const payload = Buffer.from(JSON.stringify({
+    scope: bundle.scope,
+    version: bundle.version,
+    issuedAt: bundle.updatedAt,
+    config: bundle.config
+  }));
+  return {
+    payload: payload.toString('base64'),
+    signature: signWithSyncKey(Buffer.concat([Buffer.from(CONFIG_BUNDLE_CONTEXT), payload])).toString('base64')
+  };
+}
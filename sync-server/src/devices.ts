@@ -0,0 +1,116 @@
+// Devices a user connects from. Clients generate their own device ID and send
+// it when asking for a session token; a revoked device can't get new tokens,
+// and nodes poll the revocation list so tokens it already holds stop working.
+import sqlite3 from 'sqlite3';
+
+export interface Device {
+  user: string;
+  deviceId: string;
+  name: string;
+  firstSeen: number;
+  lastSeen: number;
+  revokedAt: number | null;
+}
+
+const MAX_DEVICES_PER_USER = 20;
+
+// Keyed by user, then device ID
+const devices: Map<string, Map<string, Device>> = new Map();
+let db: sqlite3.Database;
+
+export function initDevices(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS devices (
+      user TEXT NOT NULL,
+      device_id TEXT NOT NULL,
+      name TEXT NOT NULL,
+      first_seen INTEGER NOT NULL,
+      last_seen INTEGER NOT NULL,
+      revoked_at INTEGER,
+      PRIMARY KEY (user, device_id)
+    )`);
+    db.all('SELECT * FROM devices', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading devices from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        userDevices(row.user).set(row.device_id, {
+          user: row.user,
+          deviceId: row.device_id,
+          name: row.name,
+          firstSeen: row.first_seen,
+          lastSeen: row.last_seen,
+          revokedAt: row.revoked_at
+        });
+      });
+    });
+  });
+}
+
+function userDevices(user: string): Map<string, Device> {
+  let m = devices.get(user);
+  if (!m) {
+    m = new Map();
+    devices.set(user, m);
+  }
+  return m;
+}
+
+function saveDevice(device: Device) {
+  db.run(
+    'INSERT OR REPLACE INTO devices (user, device_id, name, first_seen, last_seen, revoked_at) VALUES (?, ?, ?, ?, ?, ?)',
+    [device.user, device.deviceId, device.name, device.firstSeen, device.lastSeen, device.revokedAt]
+  );
+}
+
+export function validDeviceId(deviceId: unknown): deviceId is string {
+  return typeof deviceId === 'string' && /^[a-zA-Z0-9_-]{8,64}$/.test(deviceId);
+}
+
+// Records that a device is in use. Returns an error message if it has been
+// revoked or the user already has too many devices.
+export function touchDevice(user: string, deviceId: string, name: string): Device | string {
+  const m = userDevices(user);
+  const now = Date.now();
+  let device = m.get(deviceId);
+  if (device) {
+    if (device.revokedAt !== null) {
+      return 'Device has been revoked';
+    }
+    device.lastSeen = now;
+    if (name) device.name = name;
+  } else {
+    if (Array.from(m.values()).filter(d => d.revokedAt === null).length >= MAX_DEVICES_PER_USER) {
+      return 'Too many devices';
+    }
+    device = { user, deviceId, name: name || 'unnamed', firstSeen: now, lastSeen: now, revokedAt: null };
+    m.set(deviceId, device);
+  }
+  saveDevice(device);
+  return device;
+}
+
+export function devicesForUser(user: string): Device[] {
+  return Array.from(devices.get(user)?.values() ?? []);
+}
+
+export function revokeDevice(user: string, deviceId: string): boolean {
+  const device = devices.get(user)?.get(deviceId);
+  if (!device) return false;
+  if (device.revokedAt === null) {
+    device.revokedAt = Date.now();
+    saveDevice(device);
+  }
+  return true;
+}
+
+// IDs of every revoked device, for nodes to reject their tokens
+export function revokedDeviceIds(): string[] {
+  const ids: string[] = [];
+  devices.forEach(m => m.forEach(device => {
+    if (device.revokedAt !== null) ids.push(device.deviceId);
+  }));
+  return ids;
+}
@@ -0,0 +1,381 @@
+// Periodic export of usage and the audit log to S3-compatible object
+// storage, for long-term analytics outside the primary database. Every
+// EXPORT_INTERVAL seconds the sync server writes one object of usage rows
+// for the period just ended and one of audit entries added since the last
+// export, as JSON lines or CSV:
+//
+//   <prefix>usage/dt=2024-05-01/usage-20240501T130000Z.jsonl
+//   <prefix>audit/dt=2024-05-01/audit-1201-1350.jsonl
+//
+// Usage is aggregated in memory: per server, the peak and average tunnels
+// from load reports; per user and server, sessions started and the seconds
+// of sessions that ended. A restart loses the period in progress. The audit
+// export remembers the last sequence number written, so every entry is
+// exported exactly once even across restarts.
+//
+// Requests are signed with AWS Signature Version 4 and use path-style URLs,
+// which AWS, MinIO, Ceph, R2 and most others accept.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+import axios from 'axios';
+import { exportAudit, AuditEntry } from './audit';
+import { LoadReport } from './load';
+import { Session } from './sessions';
+import { Counter } from './metrics';
+
+export type ExportFormat = 'json' | 'csv';
+
+interface S3Config {
+  endpoint: URL;
+  bucket: string;
+  region: string;
+  accessKeyId: string;
+  secretAccessKey: string;
+  sessionToken?: string;
+  prefix: string;
+}
+
+interface ExportConfig {
+  s3: S3Config;
+  format: ExportFormat;
+  intervalMs: number;
+}
+
+interface ServerUsage {
+  peakTunnels: number;
+  tunnelSum: number;
+  reports: number;
+}
+
+interface UserUsage {
+  sessionsStarted: number;
+  sessionSeconds: number;
+}
+
+const AUDIT_PAGE = 10000;
+
+const exportsTotal = new Counter('horsevpn_sync_exports_total', 'Objects exported to object storage by kind and result');
+
+let db: sqlite3.Database;
+let config: ExportConfig | null = null;
+let periodStart = Date.now();
+// Keyed by server ID
+let serverUsage: Map<string, ServerUsage> = new Map();
+// Keyed by user, then server ID
+let userUsage: Map<string, Map<string, UserUsage>> = new Map();
+let running = false;
+
+function exportConfigFromEnv(): ExportConfig | null {
+  const bucket = process.env.EXPORT_S3_BUCKET;
+  if (!bucket) return null;
+
+  const accessKeyId = process.env.EXPORT_S3_ACCESS_KEY_ID;
+  const secretAccessKey = process.env.EXPORT_S3_SECRET_ACCESS_KEY;
+  if (!accessKeyId || !secretAccessKey) {
+    console.warn('EXPORT_S3_BUCKET is set without EXPORT_S3_ACCESS_KEY_ID and EXPORT_S3_SECRET_ACCESS_KEY; exports are off');
+    return null;
+  }
+  const region = process.env.EXPORT_S3_REGION || 'us-east-1';
+  let endpoint: URL;
+  try {
+    endpoint = new URL(process.env.EXPORT_S3_ENDPOINT || `https://s3.${region}.amazonaws.com`);
+  } catch {
+    console.warn(`Ignoring invalid EXPORT_S3_ENDPOINT value: ${process.env.EXPORT_S3_ENDPOINT}; exports are off`);
+    return null;
+  }
+
+  let format: ExportFormat = 'json';
+  const f = process.env.EXPORT_FORMAT;
+  if (f === 'csv' || f === 'json') {
+    format = f;
+  } else if (f !== undefined) {
+    console.warn(`Ignoring invalid EXPORT_FORMAT value: ${f}`);
+  }
+
+  let intervalMs = 60 * 60 * 1000;
+  const v = process.env.EXPORT_INTERVAL;
+  if (v) {
+    const n = parseInt(v, 10);
+    if (!isNaN(n) && n >= 60) {
+      intervalMs = n * 1000;
+    } else {
+      console.warn(`Ignoring invalid EXPORT_INTERVAL value: ${v}`);
+    }
+  }
+
+  let prefix = process.env.EXPORT_S3_PREFIX ?? 'horsevpn/';
+  if (prefix !== '' && !prefix.endsWith('/')) prefix += '/';
+
+  return {
+    s3: {
+      endpoint, bucket, region, accessKeyId, secretAccessKey,
+      sessionToken: process.env.EXPORT_S3_SESSION_TOKEN || undefined,
+      prefix
+    },
+    format,
+    intervalMs
+  };
+}
+
+export function initExports(database: sqlite3.Database) {
+  db = database;
+  db.run(`CREATE TABLE IF NOT EXISTS export_cursors (
+    name TEXT PRIMARY KEY,
+    value INTEGER NOT NULL
+  )`);
+  config = exportConfigFromEnv();
+  if (config) {
+    console.log(`Exporting usage and audit data to s3://${config.s3.bucket}/${config.s3.prefix} every ${config.intervalMs / 1000}s as ${config.format}`);
+    setInterval(() => {
+      runExport().catch(err => console.error('Export failed:', err.message));
+    }, config.intervalMs);
+  }
+}
+
+export function exportsEnabled(): boolean {
+  return config !== null;
+}
+
+export function recordLoadUsage(report: LoadReport) {
+  if (!config) return;
+  let usage = serverUsage.get(report.serverId);
+  if (!usage) {
+    usage = { peakTunnels: 0, tunnelSum: 0, reports: 0 };
+    serverUsage.set(report.serverId, usage);
+  }
+  usage.peakTunnels = Math.max(usage.peakTunnels, report.tunnels);
+  usage.tunnelSum += report.tunnels;
+  usage.reports++;
+}
+
+function userUsageFor(user: string, serverId: string): UserUsage {
+  let servers = userUsage.get(user);
+  if (!servers) {
+    servers = new Map();
+    userUsage.set(user, servers);
+  }
+  let usage = servers.get(serverId);
+  if (!usage) {
+    usage = { sessionsStarted: 0, sessionSeconds: 0 };
+    servers.set(serverId, usage);
+  }
+  return usage;
+}
+
+export function recordSessionStart(user: string, serverId: string) {
+  if (!config) return;
+  userUsageFor(user, serverId).sessionsStarted++;
+}
+
+export function recordSessionEnd(session: Session) {
+  if (!config) return;
+  userUsageFor(session.user, session.serverId).sessionSeconds += Math.round((Date.now() - session.startedAt) / 1000);
+}
+
+// Writes the usage of the period that just ended and the audit entries not
+// exported yet. Returns the keys written.
+export async function runExport(): Promise<string[]> {
+  if (!config) throw new Error('Exports are not configured');
+  if (running) return [];
+  running = true;
+  try {
+    const written: string[] = [];
+    const usageKey = await exportUsage(config);
+    if (usageKey) written.push(usageKey);
+    written.push(...await exportAuditEntries(config));
+    return written;
+  } finally {
+    running = false;
+  }
+}
+
+async function exportUsage(config: ExportConfig): Promise<string | null> {
+  const start = periodStart;
+  const end = Date.now();
+  const servers = serverUsage;
+  const users = userUsage;
+  periodStart = end;
+  serverUsage = new Map();
+  userUsage = new Map();
+
+  const rows: Record<string, unknown>[] = [];
+  const period = { period_start: new Date(start).toISOString(), period_end: new Date(end).toISOString() };
+  servers.forEach((u, serverId) => rows.push({
+    ...period, server_id: serverId, user: '',
+    sessions_started: 0, session_seconds: 0,
+    peak_tunnels: u.peakTunnels, avg_tunnels: Math.round(u.tunnelSum / u.reports * 100) / 100
+  }));
+  users.forEach((byServer, user) => byServer.forEach((u, serverId) => rows.push({
+    ...period, server_id: serverId, user,
+    sessions_started: u.sessionsStarted, session_seconds: u.sessionSeconds,
+    peak_tunnels: 0, avg_tunnels: 0
+  })));
+  if (rows.length === 0) return null;
+
+  const key = `${config.s3.prefix}usage/${partition(end)}/usage-${compactTime(end)}.${extension(config.format)}`;
+  try {
+    await putObject(config.s3, key, encodeRows(rows, config.format), contentType(config.format));
+  } catch (err) {
+    exportsTotal.inc({ kind: 'usage', result: 'failed' });
+    // Put the period back so the next export covers it
+    mergeUsage(start, servers, users);
+    throw err;
+  }
+  exportsTotal.inc({ kind: 'usage', result: 'ok' });
+  return key;
+}
+
+function mergeUsage(start: number, servers: Map<string, ServerUsage>, users: Map<string, Map<string, UserUsage>>) {
+  periodStart = start;
+  servers.forEach((old, serverId) => {
+    const cur = serverUsage.get(serverId);
+    serverUsage.set(serverId, cur ? {
+      peakTunnels: Math.max(old.peakTunnels, cur.peakTunnels),
+      tunnelSum: old.tunnelSum + cur.tunnelSum,
+      reports: old.reports + cur.reports
+    } : old);
+  });
+  users.forEach((byServer, user) => byServer.forEach((old, serverId) => {
+    const cur = userUsageFor(user, serverId);
+    cur.sessionsStarted += old.sessionsStarted;
+    cur.sessionSeconds += old.sessionSeconds;
+  }));
+}
+
+async function exportAuditEntries(config: ExportConfig): Promise<string[]> {
+  const written: string[] = [];
+  let since = await readCursor('audit');
+  for (;;) {
+    const entries = await new Promise<AuditEntry[]>((resolve, reject) => {
+      exportAudit(since, AUDIT_PAGE, (err, entries) => err ? reject(err) : resolve(entries));
+    });
+    if (entries.length === 0) return written;
+
+    const first = entries[0].seq;
+    const last = entries[entries.length - 1].seq;
+    const rows = entries.map(e => ({
+      seq: e.seq, at: new Date(e.at).toISOString(), event: e.event, actor: e.actor,
+      details: JSON.stringify(e.details), prev_hash: e.prevHash, hash: e.hash
+    }));
+    const key = `${config.s3.prefix}audit/${partition(Date.now())}/audit-${first}-${last}.${extension(config.format)}`;
+    try {
+      await putObject(config.s3, key, encodeRows(rows, config.format), contentType(config.format));
+    } catch (err) {
+      exportsTotal.inc({ kind: 'audit', result: 'failed' });
+      throw err;
+    }
+    exportsTotal.inc({ kind: 'audit', result: 'ok' });
+    await writeCursor('audit', last);
+    written.push(key);
+    since = last;
+    if (entries.length < AUDIT_PAGE) return written;
+  }
+}
+
+function readCursor(name: string): Promise<number> {
+  return new Promise((resolve, reject) => {
+    db.get('SELECT value FROM export_cursors WHERE name = ?', [name], (err, row: any) => {
+      if (err) return reject(err);
+      resolve(row ? row.value : 0);
+    });
+  });
+}
+
+function writeCursor(name: string, value: number): Promise<void> {
+  return new Promise((resolve, reject) => {
+    db.run('INSERT OR REPLACE INTO export_cursors (name, value) VALUES (?, ?)', [name, value], (err) => {
+      if (err) return reject(err);
+      resolve();
+    });
+  });
+}
+
+function partition(at: number): string {
+  return `dt=${new Date(at).toISOString().slice(0, 10)}`;
+}
+
+function compactTime(at: number): string {
+  return new Date(at).toISOString().replace(/[-:]/g, '').replace(/\.\d+/, '');
+}
+
+function extension(format: ExportFormat): string {
+  return format === 'csv' ? 'csv' : 'jsonl';
+}
+
+function contentType(format: ExportFormat): string {
+  return format === 'csv' ? 'text/csv' : 'application/x-ndjson';
+}
+
+// JSON lines, or CSV with a header row taken from the first row's keys
+export function encodeRows(rows: Record<string, unknown>[], format: ExportFormat): string {
+  if (format === 'json') {
+    return rows.map(r => JSON.stringify(r)).join('\n') + '\n';
+  }
+  const columns = Object.keys(rows[0]);
+  const field = (v: unknown) => {
+    const s = v === undefined || v === null ? '' : String(v);
+    return /[",\r\n]/.test(s) ? `"${s.replace(/"/g, '""')}"` : s;
+  };
+  return [columns.join(','), ...rows.map(r => columns.map(c => field(r[c])).join(','))].join('\n') + '\n';
+}
+
+// Encodes a key for the request path, leaving the slashes between segments
+function encodeKey(key: string): string {
+  return key.split('/').map(segment => encodeURIComponent(segment)
+    .replace(/[!'()*]/g, c => '%' + c.charCodeAt(0).toString(16).toUpperCase())).join('/');
+}
+
+function sha256Hex(data: string | Buffer): string {
+  return crypto.createHash('sha256').update(data).digest('hex');
+}
+
+function hmac(key: string | Buffer, data: string): Buffer {
+  return crypto.createHmac('sha256', key).update(data).digest();
+}
+
+// Signs a request with AWS Signature Version 4. headers must not include
+// Authorization; the signed headers are added to it, and the Authorization
+// header is returned.
+export function signV4(
+  method: string, url: URL, headers: Record<string, string>, payloadHash: string,
+  creds: { accessKeyId: string; secretAccessKey: string }, region: string, service: string, now: Date
+): string {
+  const amzDate = now.toISOString().replace(/[-:]/g, '').replace(/\.\d+/, '');
+  const dateStamp = amzDate.slice(0, 8);
+  headers['x-amz-date'] = amzDate;
+  headers['x-amz-content-sha256'] = payloadHash;
+
+  const signed: Record<string, string> = { host: url.host };
+  Object.keys(headers).forEach(k => { signed[k.toLowerCase()] = headers[k].trim(); });
+  const names = Object.keys(signed).sort();
+  const query = Array.from(url.searchParams.entries())
+    .sort(([a], [b]) => a < b ? -1 : a > b ? 1 : 0)
+    .map(([k, v]) => `${encodeURIComponent(k)}=${encodeURIComponent(v)}`).join('&');
+  const canonicalRequest = [
+    method,
+    url.pathname,
+    query,
+    names.map(n => `${n}:${signed[n]}\n`).join(''),
+    names.join(';'),
+    payloadHash
+  ].join('\n');
+
+  const scope = `${dateStamp}/${region}/${service}/aws4_request`;
+  const stringToSign = ['AWS4-HMAC-SHA256', amzDate, scope, sha256Hex(canonicalRequest)].join('\n');
+  const key = hmac(hmac(hmac(hmac('AWS4' + creds.secretAccessKey, dateStamp), region), service), 'aws4_request');
+  const signature = crypto.createHmac('sha256', key).update(stringToSign).digest('hex');
+  return `AWS4-HMAC-SHA256 Credential=${creds.accessKeyId}/${scope}, SignedHeaders=${names.join(';')}, Signature=${signature}`;
+}
+
+async function putObject(s3: S3Config, key: string, body: string, type: string) {
+  const base = s3.endpoint.pathname.replace(/\/$/, '');
+  const url = new URL(s3.endpoint.toString());
+  url.pathname = `${base}/${encodeKey(s3.bucket)}/${encodeKey(key)}`;
+
+  const data = Buffer.from(body);
+  const headers: Record<string, string> = { 'content-type': type };
+  if (s3.sessionToken) headers['x-amz-security-token'] = s3.sessionToken;
+  headers.authorization = signV4('PUT', url, headers, sha256Hex(data), s3, s3.region, 's3', new Date());
+
+  await axios.put(url.toString(), data, { headers, timeout: 60000, maxBodyLength: Infinity });
+}
@@ -0,0 +1,238 @@
+// Declarative fleet configuration, for Terraform providers and GitOps tools.
+// Every resource has an ID the caller picks, free-form tags and a spec. PUT
+// creates or replaces a resource and is safe to repeat: the version only
+// moves when the spec or tags actually change, so a tool can tell drift from
+// a no-op.
+//
+//   nodes                - operator intent for a registered (or future) node:
+//                          extra tags and whether it is drained from routing
+//   policies             - an org's split-tunnel policy and ACLs, by org ID
+//   users                - a user's org membership and suspension
+//   maintenance-windows  - times during which matching nodes get no clients
+import sqlite3 from 'sqlite3';
+import { OrgAclRule, OrgPolicy, OrgRole, parseAcls, parsePolicy, validOrgRole } from './orgs';
+
+export type FleetKind = 'nodes' | 'policies' | 'users' | 'maintenance-windows';
+
+export const FLEET_KINDS: FleetKind[] = ['nodes', 'policies', 'users', 'maintenance-windows'];
+
+export interface NodeSpec {
+  drained: boolean;
+}
+
+export interface PolicySpec {
+  policy: OrgPolicy;
+  acls: OrgAclRule[];
+}
+
+export interface UserSpec {
+  // Unset to keep the user out of any org
+  orgId: string | null;
+  orgRole: OrgRole;
+  suspended: boolean;
+}
+
+export interface MaintenanceWindowSpec {
+  // Milliseconds since the epoch
+  start: number;
+  end: number;
+  // Nodes covered: those listed, plus those carrying any of nodeTags
+  nodes: string[];
+  nodeTags: string[];
+}
+
+export type FleetSpec = NodeSpec | PolicySpec | UserSpec | MaintenanceWindowSpec;
+
+export interface FleetResource<S extends FleetSpec = FleetSpec> {
+  kind: FleetKind;
+  id: string;
+  tags: string[];
+  spec: S;
+  version: number;
+  createdAt: number;
+  updatedAt: number;
+}
+
+const MAX_TAGS = 20;
+
+// Keyed by kind, then ID
+const resources: Map<FleetKind, Map<string, FleetResource>> = new Map(FLEET_KINDS.map(k => [k, new Map()]));
+let db: sqlite3.Database;
+
+export function initFleet(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS fleet_resources (
+      kind TEXT NOT NULL,
+      id TEXT NOT NULL,
+      tags TEXT NOT NULL,
+      spec TEXT NOT NULL,
+      version INTEGER NOT NULL,
+      created_at INTEGER NOT NULL,
+      updated_at INTEGER NOT NULL,
+      PRIMARY KEY (kind, id)
+    )`);
+    db.all('SELECT * FROM fleet_resources', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading fleet resources from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        resources.get(row.kind as FleetKind)?.set(row.id, {
+          kind: row.kind,
+          id: row.id,
+          tags: JSON.parse(row.tags),
+          spec: JSON.parse(row.spec),
+          version: row.version,
+          createdAt: row.created_at,
+          updatedAt: row.updated_at
+        });
+      });
+      console.log(`Loaded ${rows.length} fleet resources`);
+    });
+  });
+}
+
+export function validFleetKind(kind: string): kind is FleetKind {
+  return (FLEET_KINDS as string[]).includes(kind);
+}
+
+export function validFleetId(id: string): boolean {
+  return /^[a-zA-Z0-9._@+:-]{1,200}$/.test(id);
+}
+
+export function listFleet(kind: FleetKind, tag?: string): FleetResource[] {
+  const all = Array.from(resources.get(kind)!.values());
+  return tag === undefined ? all : all.filter(r => r.tags.includes(tag));
+}
+
+export function findFleet<S extends FleetSpec>(kind: FleetKind, id: string): FleetResource<S> | undefined {
+  return resources.get(kind)!.get(id) as FleetResource<S> | undefined;
+}
+
+function parseTags(tags: unknown): string[] | string {
+  if (tags === undefined) return [];
+  if (!Array.isArray(tags) || tags.length > MAX_TAGS ||
+      !tags.every(tag => typeof tag === 'string' && /^[a-zA-Z0-9_-]{1,32}$/.test(tag))) {
+    return 'Invalid tags';
+  }
+  return Array.from(new Set(tags as string[])).sort();
+}
+
+function parseTime(value: unknown): number | undefined {
+  const ms = typeof value === 'number' ? value : typeof value === 'string' ? Date.parse(value) : NaN;
+  return Number.isFinite(ms) ? ms : undefined;
+}
+
+// Checks a spec, filling in defaults, and returns it or an error message.
+// Defaults are spelled out so that a repeated PUT compares equal.
+function parseFleetSpec(kind: FleetKind, spec: any): FleetSpec | string {
+  if (typeof spec !== 'object' || spec === null) {
+    return 'spec must be an object';
+  }
+  switch (kind) {
+    case 'nodes': {
+      const drained = spec.drained ?? false;
+      if (typeof drained !== 'boolean') return 'drained must be a boolean';
+      return { drained };
+    }
+    case 'policies': {
+      const policy = parsePolicy(spec.policy ?? {});
+      if (typeof policy === 'string') return policy;
+      const acls = parseAcls(spec.acls ?? []);
+      if (typeof acls === 'string') return acls;
+      return { policy, acls };
+    }
+    case 'users': {
+      const orgId = spec.orgId ?? null;
+      const orgRole = spec.orgRole ?? 'member';
+      const suspended = spec.suspended ?? false;
+      if (orgId !== null && typeof orgId !== 'string') return 'orgId must be a string';
+      if (!validOrgRole(orgRole)) return 'orgRole must be member or admin';
+      if (typeof suspended !== 'boolean') return 'suspended must be a boolean';
+      return { orgId, orgRole, suspended };
+    }
+    case 'maintenance-windows': {
+      const start = parseTime(spec.start);
+      const end = parseTime(spec.end);
+      if (start === undefined || end === undefined || end <= start) {
+        return 'start and end must be times with end after start';
+      }
+      const nodes = spec.nodes ?? [];
+      if (!Array.isArray(nodes) || nodes.length > 1000 || !nodes.every((n: unknown) => typeof n === 'string')) {
+        return 'nodes must be a list of server IDs';
+      }
+      const nodeTags = parseTags(spec.nodeTags);
+      if (typeof nodeTags === 'string') return 'Invalid nodeTags';
+      if (nodes.length === 0 && nodeTags.length === 0) return 'Window covers no nodes';
+      return { start, end, nodes, nodeTags };
+    }
+  }
+}
+
+// Checks a PUT body of tags and spec, returning them or an error message
+export function parseFleetBody(kind: FleetKind, body: any): { tags: string[]; spec: FleetSpec } | string {
+  if (typeof body !== 'object' || body === null) return 'Body must be an object';
+  const tags = parseTags(body.tags);
+  if (typeof tags === 'string') return tags;
+  const spec = parseFleetSpec(kind, body.spec ?? {});
+  if (typeof spec === 'string') return spec;
+  return { tags, spec };
+}
+
+// Creates or replaces a resource, returning it and whether anything changed
+export function putFleet(kind: FleetKind, id: string, tags: string[], spec: FleetSpec): { resource: FleetResource; changed: boolean } {
+  const now = Date.now();
+  const existing = resources.get(kind)!.get(id);
+  if (existing && JSON.stringify(existing.tags) === JSON.stringify(tags) &&
+      JSON.stringify(existing.spec) === JSON.stringify(spec)) {
+    return { resource: existing, changed: false };
+  }
+
+  const resource: FleetResource = {
+    kind,
+    id,
+    tags,
+    spec,
+    version: (existing?.version ?? 0) + 1,
+    createdAt: existing?.createdAt ?? now,
+    updatedAt: now
+  };
+  resources.get(kind)!.set(id, resource);
+  db.run(
+    'INSERT OR REPLACE INTO fleet_resources (kind, id, tags, spec, version, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)',
+    [kind, id, JSON.stringify(tags), JSON.stringify(spec), resource.version, resource.createdAt, resource.updatedAt]
+  );
+  return { resource, changed: true };
+}
+
+export function deleteFleet(kind: FleetKind, id: string): FleetResource | undefined {
+  const existing = resources.get(kind)!.get(id);
+  if (!existing) return undefined;
+  resources.get(kind)!.delete(id);
+  db.run('DELETE FROM fleet_resources WHERE kind = ? AND id = ?', [kind, id]);
+  return existing;
+}
+
+// Tags an operator declared for a node, on top of those it registers with
+export function declaredNodeTags(serverId: string): string[] {
+  return findFleet<NodeSpec>('nodes', serverId)?.tags ?? [];
+}
+
+// Whether a node should get new clients: not drained, and not inside a
+// maintenance window covering it
+export function nodeInService(serverId: string, tags: string[], now = Date.now()): boolean {
+  if (findFleet<NodeSpec>('nodes', serverId)?.spec.drained) return false;
+  return !listFleet('maintenance-windows').some(r => {
+    const w = r.spec as MaintenanceWindowSpec;
+    return now >= w.start && now < w.end && (w.nodes.includes(serverId) || w.nodeTags.some(t => tags.includes(t)));
+  });
+}
+
+export function fleetUserSuspended(user: string): boolean {
+  return findFleet<UserSpec>('users', user)?.spec.suspended ?? false;
+}
+
+export function fleetSuspendedUsers(): string[] {
+  return listFleet('users').filter(r => (r.spec as UserSpec).suspended).map(r => r.id);
+}
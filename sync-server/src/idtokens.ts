@@ -0,0 +1,170 @@
+// ID tokens from an organization's identity provider, accepted as a user
+// credential on the user endpoints the way nodes accept them for tunnels
+// (see jwt.go in the server). OIDC_ISSUER finds its keys through discovery;
+// JWT_JWKS_URL names a JWKS directly, with JWT_ISSUER and JWT_AUDIENCE
+// checked if set. The token's subject is the user.
+import axios from 'axios';
+import crypto from 'crypto';
+
+export interface IdToken {
+  subject: string;
+  expiresAt: number;
+}
+
+interface Provider {
+  issuer: string | null;
+  audience: string | null;
+  keys: KeySet;
+}
+
+// Refreshed hourly, and early when a token names a key we haven't seen
+// (rotation), but never more than once a minute so bogus kids can't be used
+// to hammer the identity provider
+const KEYS_MAX_AGE_MS = 60 * 60 * 1000;
+const KEYS_MIN_REFRESH_MS = 60 * 1000;
+const CLOCK_LEEWAY_SECONDS = 30;
+
+// Which key types may verify which algorithms, so an RSA key can't be used
+// with an algorithm meant for another kind
+const ALGORITHMS: Record<string, { keyType: string; hash: string | null; pss?: boolean }> = {
+  RS256: { keyType: 'rsa', hash: 'sha256' },
+  RS384: { keyType: 'rsa', hash: 'sha384' },
+  RS512: { keyType: 'rsa', hash: 'sha512' },
+  PS256: { keyType: 'rsa', hash: 'sha256', pss: true },
+  PS384: { keyType: 'rsa', hash: 'sha384', pss: true },
+  PS512: { keyType: 'rsa', hash: 'sha512', pss: true },
+  ES256: { keyType: 'ec', hash: 'sha256' },
+  ES384: { keyType: 'ec', hash: 'sha384' },
+  ES512: { keyType: 'ec', hash: 'sha512' },
+  EdDSA: { keyType: 'ed25519', hash: null }
+};
+
+class KeySet {
+  private keys: Map<string, crypto.KeyObject> = new Map();
+  private fetchedAt = 0;
+  private lastAttempt = 0;
+  private refreshing: Promise<void> | null = null;
+
+  constructor(private resolveUrl: () => Promise<string>) {}
+
+  async key(kid: string): Promise<crypto.KeyObject | string> {
+    const stale = Date.now() - this.fetchedAt > KEYS_MAX_AGE_MS;
+    if ((!this.keys.has(kid) || stale) && Date.now() - this.lastAttempt > KEYS_MIN_REFRESH_MS) {
+      this.lastAttempt = Date.now();
+      this.refreshing ??= this.refresh().finally(() => { this.refreshing = null; });
+    }
+    if (this.refreshing) {
+      try {
+        await this.refreshing;
+      } catch (err: any) {
+        console.warn('Fetching JWKS failed:', err.message);
+      }
+    }
+    return this.keys.get(kid) ?? `Unknown signing key "${kid}"`;
+  }
+
+  private async refresh() {
+    const url = await this.resolveUrl();
+    const response = await axios.get(url, { timeout: 10000 });
+    const keys: Map<string, crypto.KeyObject> = new Map();
+    for (const jwk of response.data?.keys ?? []) {
+      if (jwk.use !== undefined && jwk.use !== 'sig') continue;
+      try {
+        keys.set(jwk.kid ?? '', crypto.createPublicKey({ key: jwk, format: 'jwk' }));
+      } catch {
+        // Key types we can't use are skipped
+      }
+    }
+    this.keys = keys;
+    this.fetchedAt = Date.now();
+  }
+}
+
+// Looks up jwks_uri from the issuer's OpenID configuration, caching it once
+// found
+function discoverJwksUrl(issuer: string): () => Promise<string> {
+  let url: string | null = null;
+  return async () => {
+    if (url !== null) return url;
+    const response = await axios.get(`${issuer.replace(/\/$/, '')}/.well-known/openid-configuration`, { timeout: 10000 });
+    if (response.data?.issuer !== issuer || typeof response.data?.jwks_uri !== 'string') {
+      throw new Error('OIDC discovery returned mismatched issuer or no jwks_uri');
+    }
+    url = response.data.jwks_uri as string;
+    return url;
+  };
+}
+
+const providers: Provider[] = [];
+
+export function initIdTokens() {
+  const jwksUrl = process.env.JWT_JWKS_URL;
+  if (jwksUrl) {
+    providers.push({
+      issuer: process.env.JWT_ISSUER || null,
+      audience: process.env.JWT_AUDIENCE || null,
+      keys: new KeySet(async () => jwksUrl)
+    });
+  }
+  const oidcIssuer = process.env.OIDC_ISSUER;
+  if (oidcIssuer) {
+    if (!process.env.OIDC_AUDIENCE) {
+      console.warn('Ignoring OIDC_ISSUER: OIDC_AUDIENCE is required with it');
+    } else {
+      providers.push({ issuer: oidcIssuer, audience: process.env.OIDC_AUDIENCE, keys: new KeySet(discoverJwksUrl(oidcIssuer)) });
+    }
+  }
+}
+
+export function idTokensEnabled(): boolean {
+  return providers.length > 0;
+}
+
+export function looksLikeIdToken(credential: string): boolean {
+  return credential.split('.').length === 3;
+}
+
+function decodePart(part: string): any {
+  try {
+    return JSON.parse(Buffer.from(part, 'base64url').toString());
+  } catch {
+    return undefined;
+  }
+}
+
+// Returns the token if its signature and claims check out now, or why they
+// don't
+export async function verifyIdToken(token: string): Promise<IdToken | string> {
+  const [headerPart, claimsPart, signaturePart] = token.split('.');
+  const header = decodePart(headerPart);
+  const claims = decodePart(claimsPart);
+  if (typeof header !== 'object' || header === null || typeof claims !== 'object' || claims === null) {
+    return 'Malformed token';
+  }
+
+  const provider = providers.find(p => p.issuer === null || p.issuer === claims.iss);
+  if (!provider) return 'Token from an unknown issuer';
+  const algorithm = Object.prototype.hasOwnProperty.call(ALGORITHMS, header.alg) ? ALGORITHMS[header.alg] : undefined;
+  if (!algorithm) return 'Unsupported signing algorithm';
+  const key = await provider.keys.key(typeof header.kid === 'string' ? header.kid : '');
+  if (typeof key === 'string') return key;
+  if (key.asymmetricKeyType !== algorithm.keyType) return 'Signing key does not match the algorithm';
+
+  const verifyKey: crypto.VerifyKeyObjectInput | crypto.KeyObject = algorithm.pss
+    ? { key, padding: crypto.constants.RSA_PKCS1_PSS_PADDING, saltLength: crypto.constants.RSA_PSS_SALTLEN_DIGEST }
+    : algorithm.keyType === 'ec' ? { key, dsaEncoding: 'ieee-p1363' } : key;
+  const signed = Buffer.from(`${headerPart}.${claimsPart}`);
+  if (!crypto.verify(algorithm.hash, signed, verifyKey, Buffer.from(signaturePart, 'base64url'))) {
+    return 'Invalid signature';
+  }
+
+  const now = Math.floor(Date.now() / 1000);
+  if (typeof claims.exp !== 'number' || claims.exp + CLOCK_LEEWAY_SECONDS < now) return 'Token has expired';
+  if (typeof claims.nbf === 'number' && claims.nbf - CLOCK_LEEWAY_SECONDS > now) return 'Token is not valid yet';
+  if (provider.audience !== null) {
+    const audiences = Array.isArray(claims.aud) ? claims.aud : [claims.aud];
+    if (!audiences.includes(provider.audience)) return 'Token is for another audience';
+  }
+  if (typeof claims.sub !== 'string' || claims.sub === '') return 'Token has no subject';
+  return { subject: claims.sub, expiresAt: claims.exp * 1000 };
+}
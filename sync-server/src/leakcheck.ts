@@ -0,0 +1,164 @@
+// Leak check echo endpoints. GET /leakcheck tells a client the address its
+// request came from, so it can compare what the internet sees through the
+// tunnel with what it sees without. With LEAKCHECK_DNS_ZONE set to a zone
+// delegated to this host, the sync server also answers DNS for that zone on
+// UDP port LEAKCHECK_DNS_PORT and remembers which resolvers asked for each
+// name under it: a client looks up <token>.<zone> through the tunnel and
+// then asks GET /leakcheck/dns/<token> which resolvers the query came from.
+// Resolvers are kept in memory for a few minutes only.
+import dgram from 'dgram';
+import net from 'net';
+import { Counter } from './metrics';
+
+interface Lookup {
+  resolvers: Set<string>;
+  at: number;
+}
+
+const LOOKUP_TTL_MS = 5 * 60 * 1000;
+// Tokens remembered at once; lookups of new ones beyond this are not recorded
+const MAX_LOOKUPS = 10000;
+
+// Client-chosen labels, random enough not to collide
+const TOKEN_PATTERN = /^[a-z0-9]{16,63}$/;
+
+const DNS_TYPE_A = 1;
+const DNS_CLASS_IN = 1;
+const DNS_RCODE_FORMERR = 1;
+const DNS_RCODE_REFUSED = 5;
+
+const dnsQueries = new Counter('horsevpn_sync_leakcheck_dns_queries_total', 'DNS queries answered for the leak check zone, by result');
+
+let zone: string | null = null;
+let answer: Buffer | null = null;
+const lookups: Map<string, Lookup> = new Map();
+
+function dnsPortFromEnv(): number {
+  const v = process.env.LEAKCHECK_DNS_PORT;
+  if (v) {
+    const port = parseInt(v, 10);
+    if (port > 0 && port <= 65535) return port;
+    console.warn(`Ignoring invalid LEAKCHECK_DNS_PORT value: ${v}`);
+  }
+  return 53;
+}
+
+// The A record for names in the zone, so lookups succeed; without one they
+// get an empty answer, which is enough to record the resolver
+function dnsAnswerFromEnv(): Buffer | null {
+  const v = process.env.LEAKCHECK_DNS_ANSWER;
+  if (!v) return null;
+  if (net.isIPv4(v)) return Buffer.from(v.split('.').map(o => parseInt(o, 10)));
+  console.warn(`Ignoring invalid LEAKCHECK_DNS_ANSWER value: ${v}`);
+  return null;
+}
+
+export function initLeakcheck() {
+  const v = process.env.LEAKCHECK_DNS_ZONE;
+  if (!v) return;
+  zone = v.toLowerCase().replace(/^\.+|\.+$/g, '');
+  answer = dnsAnswerFromEnv();
+  const port = dnsPortFromEnv();
+
+  const socket = dgram.createSocket('udp4');
+  socket.on('message', (msg, rinfo) => {
+    const reply = answerQuery(msg, rinfo.address);
+    if (reply) socket.send(reply, rinfo.port, rinfo.address);
+  });
+  socket.on('error', err => {
+    console.error(`Leak check DNS on port ${port} failed:`, err.message);
+    zone = null;
+    socket.close();
+  });
+  socket.bind(port, () => {
+    console.log(`Answering leak check DNS for ${zone} on UDP port ${port}`);
+  });
+}
+
+// The zone clients should look names up in, or null if DNS checks are off
+export function leakcheckZone(): string | null {
+  return zone;
+}
+
+// The resolvers that looked up token's name in the last few minutes
+export function resolversFor(token: string): string[] {
+  const lookup = lookups.get(token.toLowerCase());
+  if (!lookup || Date.now() - lookup.at > LOOKUP_TTL_MS) return [];
+  return Array.from(lookup.resolvers);
+}
+
+export function validLeakcheckToken(token: string): boolean {
+  return TOKEN_PATTERN.test(token.toLowerCase());
+}
+
+export function expireLookups() {
+  const cutoff = Date.now() - LOOKUP_TTL_MS;
+  lookups.forEach((lookup, token) => {
+    if (lookup.at < cutoff) lookups.delete(token);
+  });
+}
+
+function recordLookup(token: string, resolver: string) {
+  let lookup = lookups.get(token);
+  if (!lookup) {
+    if (lookups.size >= MAX_LOOKUPS) return;
+    lookup = { resolvers: new Set(), at: Date.now() };
+    lookups.set(token, lookup);
+  }
+  lookup.resolvers.add(resolver.replace(/^::ffff:/, ''));
+}
+
+// The reply to a DNS query, or null if msg is not worth answering
+function answerQuery(msg: Buffer, from: string): Buffer | null {
+  // Header, then one question: labels, a zero byte, type and class
+  if (msg.length < 12 || (msg[2] & 0x80) !== 0 || msg.readUInt16BE(4) !== 1) {
+    return null;
+  }
+  const labels: string[] = [];
+  let offset = 12;
+  while (offset < msg.length && msg[offset] !== 0) {
+    const length = msg[offset];
+    if (length > 63 || offset + 1 + length > msg.length) return reply(msg, msg.length, DNS_RCODE_FORMERR, false);
+    labels.push(msg.toString('latin1', offset + 1, offset + 1 + length).toLowerCase());
+    offset += 1 + length;
+  }
+  const questionEnd = offset + 5;
+  if (questionEnd > msg.length) return reply(msg, msg.length, DNS_RCODE_FORMERR, false);
+  const qtype = msg.readUInt16BE(offset + 1);
+  const qclass = msg.readUInt16BE(offset + 3);
+
+  const name = labels.join('.');
+  if (!zone || (name !== zone && !name.endsWith(`.${zone}`))) {
+    dnsQueries.inc({ result: 'refused' });
+    return reply(msg, questionEnd, DNS_RCODE_REFUSED, false);
+  }
+  const token = labels[0];
+  if (name !== zone && validLeakcheckToken(token)) {
+    recordLookup(token, from);
+    dnsQueries.inc({ result: 'recorded' });
+  } else {
+    dnsQueries.inc({ result: 'ignored' });
+  }
+  return reply(msg, questionEnd, 0, qtype === DNS_TYPE_A && qclass === DNS_CLASS_IN && answer !== null);
+}
+
+function reply(query: Buffer, questionEnd: number, rcode: number, withAnswer: boolean): Buffer {
+  const header = Buffer.alloc(12);
+  query.copy(header, 0, 0, 2);
+  // Response, authoritative, with the query's opcode and recursion desired
+  header[2] = 0x80 | (query[2] & 0x79) | 0x04;
+  header[3] = rcode;
+  header.writeUInt16BE(rcode === DNS_RCODE_FORMERR ? 0 : 1, 4);
+  header.writeUInt16BE(withAnswer ? 1 : 0, 6);
+  const question = rcode === DNS_RCODE_FORMERR ? Buffer.alloc(0) : query.subarray(12, questionEnd);
+  if (!withAnswer || !answer) return Buffer.concat([header, question]);
+  const record = Buffer.alloc(16);
+  // A pointer to the name in the question, then type A, class IN, no caching
+  record.writeUInt16BE(0xc00c, 0);
+  record.writeUInt16BE(DNS_TYPE_A, 2);
+  record.writeUInt16BE(DNS_CLASS_IN, 4);
+  record.writeUInt32BE(0, 6);
+  record.writeUInt16BE(4, 10);
+  answer.copy(record, 12);
+  return Buffer.concat([header, question, record]);
+}
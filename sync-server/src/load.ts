@@ -0,0 +1,146 @@
+// Load reported by nodes, summed per location for autoscalers. Each node
+// instance reports its open tunnels and MAX_TUNNELS every so often; replicas
+// sharing a server ID report under their own instance names. Reports also
+// carry the host's CPU, memory and NIC utilization, and routing avoids nodes
+// whose hosts are saturated.
+import { Gauge } from './metrics';
+
+// Fractions of 1
+export interface HostLoad {
+  cpu: number;
+  memory: number;
+  // Missing when no interface on the host knows its link speed
+  nic?: number;
+}
+
+export interface LoadReport {
+  serverId: string;
+  instance: string;
+  tunnels: number;
+  // 0 when the node has no limit
+  maxTunnels: number;
+  overloaded: boolean;
+  // Missing from nodes that can't read their host's counters
+  host?: HostLoad;
+  at: number;
+}
+
+// Reports older than this no longer count
+const REPORT_TTL_MS = 2 * 60 * 1000;
+
+// Host utilization at which routing avoids a node
+function saturationThresholdFromEnv(): number {
+  const v = process.env.HOST_SATURATION_THRESHOLD;
+  if (v) {
+    const threshold = parseFloat(v);
+    if (threshold > 0 && threshold <= 1) return threshold;
+    console.warn(`Ignoring invalid HOST_SATURATION_THRESHOLD value: ${v}`);
+  }
+  return 0.9;
+}
+
+const SATURATION_THRESHOLD = saturationThresholdFromEnv();
+
+// Keyed by server ID, then instance
+const reports: Map<string, Map<string, LoadReport>> = new Map();
+
+new Gauge('horsevpn_sync_node_host_utilization', 'Host CPU, memory and NIC utilization from node load reports', () =>
+  Array.from(reports.keys()).flatMap(serverId => currentLoad(serverId).flatMap(r => {
+    if (!r.host) return [];
+    const labels = { server_id: serverId, instance: r.instance };
+    const samples: [Record<string, string>, number][] = [
+      [{ ...labels, resource: 'cpu' }, r.host.cpu],
+      [{ ...labels, resource: 'memory' }, r.host.memory]
+    ];
+    if (r.host.nic !== undefined) samples.push([{ ...labels, resource: 'nic' }, r.host.nic]);
+    return samples;
+  })));
+
+export function validHostLoad(host: any): host is HostLoad {
+  // A NIC can look more than full when its link speed is set too low
+  const ratio = (v: unknown) => typeof v === 'number' && Number.isFinite(v) && v >= 0;
+  return typeof host === 'object' && host !== null && ratio(host.cpu) && ratio(host.memory) &&
+    (host.nic === undefined || ratio(host.nic));
+}
+
+export function recordLoad(report: LoadReport) {
+  let instances = reports.get(report.serverId);
+  if (!instances) {
+    instances = new Map();
+    reports.set(report.serverId, instances);
+  }
+  instances.set(report.instance, report);
+}
+
+export function forgetServerLoad(serverId: string) {
+  reports.delete(serverId);
+}
+
+// Fresh reports for a server, dropping stale ones
+export function currentLoad(serverId: string, now = Date.now()): LoadReport[] {
+  const instances = reports.get(serverId);
+  if (!instances) return [];
+  instances.forEach((r, instance) => {
+    if (now - r.at > REPORT_TTL_MS) instances.delete(instance);
+  });
+  return Array.from(instances.values());
+}
+
+// Whether every instance of a server that reports host telemetry is short of
+// CPU, memory or NIC capacity, even if its tunnel count looks fine
+export function hostSaturated(serverId: string, now = Date.now()): boolean {
+  const hosts = currentLoad(serverId, now).flatMap(r => r.host ? [r.host] : []);
+  return hosts.length > 0 && hosts.every(h =>
+    h.cpu >= SATURATION_THRESHOLD || h.memory >= SATURATION_THRESHOLD || (h.nic ?? 0) >= SATURATION_THRESHOLD);
+}
+
+export interface RegionUtilization {
+  location: string;
+  servers: number;
+  // Not drained or in maintenance
+  inService: number;
+  // Node instances with a fresh load report
+  instances: number;
+  tunnels: number;
+  // Sum of MAX_TUNNELS over instances that have one
+  capacity: number;
+  // tunnels / capacity, or null if no instance has a limit
+  utilization: number | null;
+  overloaded: number;
+  // Instances needed to bring utilization to the target, or null without
+  // a capacity to go by
+  desiredInstances: number | null;
+}
+
+export function regionUtilization(location: string, servers: { id: string; inService: boolean }[],
+                                  targetUtilization: number): RegionUtilization {
+  const region: RegionUtilization = {
+    location,
+    servers: servers.length,
+    inService: servers.filter(s => s.inService).length,
+    instances: 0,
+    tunnels: 0,
+    capacity: 0,
+    utilization: null,
+    overloaded: 0,
+    desiredInstances: null
+  };
+  let limited = 0;
+  for (const server of servers) {
+    for (const report of currentLoad(server.id)) {
+      region.instances++;
+      region.tunnels += report.tunnels;
+      if (report.overloaded) region.overloaded++;
+      if (report.maxTunnels > 0) {
+        region.capacity += report.maxTunnels;
+        limited++;
+      }
+    }
+  }
+  if (region.capacity > 0) {
+    region.utilization = region.tunnels / region.capacity;
+    const perInstance = region.capacity / limited;
+    region.desiredInstances = Math.max(1, Math.ceil(region.tunnels / (perInstance * targetUtilization)));
+  }
+  return region;
+}
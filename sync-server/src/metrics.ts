@@ -0,0 +1,96 @@
+// Minimal Prometheus text-format metrics for the sync server.
+// Kept dependency-free so the sync server doesn't need prom-client.
+
+type Labels = Record<string, string>;
+
+interface Metric {
+  render(): string[];
+}
+
+const registry: Metric[] = [];
+
+function labelKey(labels: Labels): string {
+  const keys = Object.keys(labels).sort();
+  if (keys.length === 0) return '';
+  const escape = (v: string) => v.replace(/\\/g, '\\\\').replace(/"/g, '\\"').replace(/\n/g, '\\n');
+  return '{' + keys.map(k => `${k}="${escape(labels[k])}"`).join(',') + '}';
+}
+
+function header(name: string, help: string, type: string): string[] {
+  return [`# HELP ${name} ${help}`, `# TYPE ${name} ${type}`];
+}
+
+export class Counter implements Metric {
+  private values: Map<string, number> = new Map();
+
+  constructor(private name: string, private help: string) {
+    registry.push(this);
+  }
+
+  inc(labels: Labels = {}, value = 1) {
+    const key = labelKey(labels);
+    this.values.set(key, (this.values.get(key) || 0) + value);
+  }
+
+  render(): string[] {
+    const lines = header(this.name, this.help, 'counter');
+    if (this.values.size === 0) {
+      lines.push(`${this.name} 0`);
+    }
+    this.values.forEach((value, key) => lines.push(`${this.name}${key} ${value}`));
+    return lines;
+  }
+}
+
+// Gauges are computed at scrape time so they never drift from the source of truth
+export class Gauge implements Metric {
+  constructor(private name: string, private help: string, private collect: () => Array<[Labels, number]>) {
+    registry.push(this);
+  }
+
+  render(): string[] {
+    const lines = header(this.name, this.help, 'gauge');
+    for (const [labels, value] of this.collect()) {
+      lines.push(`${this.name}${labelKey(labels)} ${value}`);
+    }
+    return lines;
+  }
+}
+
+export class Histogram implements Metric {
+  private counts: number[];
+  private sum = 0;
+  private count = 0;
+
+  constructor(private name: string, private help: string, private buckets: number[]) {
+    this.counts = buckets.map(() => 0);
+    registry.push(this);
+  }
+
+  observe(value: number) {
+    this.buckets.forEach((bound, i) => {
+      if (value <= bound) this.counts[i]++;
+    });
+    this.sum += value;
+    this.count++;
+  }
+
+  // Returns a function that records the seconds elapsed since startTimer was called
+  startTimer(): () => void {
+    const start = process.hrtime.bigint();
+    return () => this.observe(Number(process.hrtime.bigint() - start) / 1e9);
+  }
+
+  render(): string[] {
+    const lines = header(this.name, this.help, 'histogram');
+    this.buckets.forEach((bound, i) => lines.push(`${this.name}_bucket{le="${bound}"} ${this.counts[i]}`));
+    lines.push(`${this.name}_bucket{le="+Inf"} ${this.count}`);
+    lines.push(`${this.name}_sum ${this.sum}`);
+    lines.push(`${this.name}_count ${this.count}`);
+    return lines;
+  }
+}
+
+export function renderMetrics(): string {
+  return registry.map(m => m.render().join('\n')).join('\n') + '\n';
+}
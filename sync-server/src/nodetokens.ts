@@ -0,0 +1,149 @@
+// Node enrollment: operators hand freshly provisioned machines a one-time
+// join token (e.g. through cloud-init), and the node trades it at first boot
+// for its server ID and a long-term node token, so no keys need copying by
+// hand. The node token lets the node register, and re-register after a
+// restart, under its own ID.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface JoinToken {
+  id: string;
+  tokenHash: string;
+  location: string;
+  tags: string[];
+  createdBy: string;
+  expiresAt: number;
+  usedAt: number | null;
+  // The node that used it
+  serverId: string | null;
+}
+
+export const DEFAULT_JOIN_TOKEN_TTL_MS = 60 * 60 * 1000;
+export const MAX_JOIN_TOKEN_TTL_MS = 7 * 24 * 60 * 60 * 1000;
+
+const joinTokens: Map<string, JoinToken> = new Map();
+// Node token hash to server ID
+const nodeTokens: Map<string, string> = new Map();
+let db: sqlite3.Database;
+
+function hashToken(token: string): string {
+  return crypto.createHash('sha256').update(token).digest('hex');
+}
+
+export function initNodeTokens(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS join_tokens (
+      id TEXT PRIMARY KEY,
+      token_hash TEXT NOT NULL UNIQUE,
+      location TEXT NOT NULL,
+      tags TEXT NOT NULL,
+      created_by TEXT NOT NULL,
+      expires_at INTEGER NOT NULL,
+      used_at INTEGER,
+      server_id TEXT
+    )`);
+    db.run(`CREATE TABLE IF NOT EXISTS node_tokens (
+      server_id TEXT PRIMARY KEY,
+      token_hash TEXT NOT NULL UNIQUE,
+      created_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM join_tokens', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading join tokens from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        joinTokens.set(row.id, {
+          id: row.id,
+          tokenHash: row.token_hash,
+          location: row.location,
+          tags: JSON.parse(row.tags),
+          createdBy: row.created_by,
+          expiresAt: row.expires_at,
+          usedAt: row.used_at,
+          serverId: row.server_id
+        });
+      });
+    });
+    db.all('SELECT * FROM node_tokens', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading node tokens from DB:', err);
+        return;
+      }
+      rows.forEach(row => nodeTokens.set(row.token_hash, row.server_id));
+      console.log(`Loaded ${nodeTokens.size} enrolled nodes`);
+    });
+  });
+}
+
+export function listJoinTokens(): JoinToken[] {
+  return Array.from(joinTokens.values());
+}
+
+// Creates a join token, returning it with its secret (only shown this once)
+export function createJoinToken(location: string, tags: string[], ttlMs: number, createdBy: string): { joinToken: JoinToken; token: string } {
+  const token = `hvj_${crypto.randomBytes(24).toString('hex')}`;
+  const joinToken: JoinToken = {
+    id: crypto.randomBytes(8).toString('hex'),
+    tokenHash: hashToken(token),
+    location,
+    tags,
+    createdBy,
+    expiresAt: Date.now() + ttlMs,
+    usedAt: null,
+    serverId: null
+  };
+  joinTokens.set(joinToken.id, joinToken);
+  db.run(
+    'INSERT INTO join_tokens (id, token_hash, location, tags, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)',
+    [joinToken.id, joinToken.tokenHash, location, JSON.stringify(tags), createdBy, joinToken.expiresAt]
+  );
+  return { joinToken, token };
+}
+
+export function deleteJoinToken(id: string): boolean {
+  if (!joinTokens.delete(id)) return false;
+  db.run('DELETE FROM join_tokens WHERE id = ?', [id]);
+  return true;
+}
+
+// Uses up a join token, enrolling a new node. Returns the join token, the
+// node's server ID and its node token, or an error message.
+export function redeemJoinToken(token: string): { joinToken: JoinToken; serverId: string; nodeToken: string } | string {
+  const hash = hashToken(token);
+  const joinToken = Array.from(joinTokens.values()).find(t => t.tokenHash === hash);
+  if (!joinToken) return 'Invalid join token';
+  if (joinToken.usedAt !== null) return 'Join token has already been used';
+  if (joinToken.expiresAt <= Date.now()) return 'Join token has expired';
+
+  const serverId = `node-${crypto.randomBytes(8).toString('hex')}`;
+  const nodeToken = crypto.randomBytes(32).toString('hex');
+  joinToken.usedAt = Date.now();
+  joinToken.serverId = serverId;
+  db.run('UPDATE join_tokens SET used_at = ?, server_id = ? WHERE id = ?', [joinToken.usedAt, serverId, joinToken.id]);
+  nodeTokens.set(hashToken(nodeToken), serverId);
+  db.run('INSERT INTO node_tokens (server_id, token_hash, created_at) VALUES (?, ?, ?)', [serverId, hashToken(nodeToken), Date.now()]);
+  return { joinToken, serverId, nodeToken };
+}
+
+// The server ID a node token was issued to
+export function serverForNodeToken(token: string): string | undefined {
+  return nodeTokens.get(hashToken(token));
+}
+
+export function enrolledNode(serverId: string): boolean {
+  return Array.from(nodeTokens.values()).includes(serverId);
+}
+
+// Forgets a node's token, so it can't register again
+export function revokeNodeToken(serverId: string): boolean {
+  for (const [hash, id] of nodeTokens) {
+    if (id === serverId) {
+      nodeTokens.delete(hash);
+      db.run('DELETE FROM node_tokens WHERE server_id = ?', [serverId]);
+      return true;
+    }
+  }
+  return false;
+}
@@ -0,0 +1,318 @@
+// Organizations: teams of users sharing a session pool and a policy. Org
+// admins manage members and the policy themselves; creating orgs and their
+// limits is up to the operators. The policy is split-tunnel and block rules
+// that members' clients fetch and apply on top of their own settings.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+import net from 'net';
+import { ParentalProfile } from './parentalcontrols';
+
+export type OrgRole = 'member' | 'admin';
+
+export interface OrgPolicy {
+  // Overrides the client's own default when set
+  tunnelByDefault?: boolean;
+  // Sites (and their subdomains) always sent direct, e.g. the intranet
+  direct?: string[];
+  // Sites always sent through the tunnel
+  tunnel?: string[];
+  // Sites members' clients refuse to reach
+  block?: string[];
+}
+
+// Grants users access to internal destinations through the org's private
+// nodes. Nodes deny internal destinations no rule grants, and reserve the
+// destinations a rule names for the users it lists.
+export interface OrgAclRule {
+  // Members the rule grants access to; "*" for every member
+  users: string[];
+  cidrs: string[];
+  hosts: string[];
+  // Empty for every port
+  ports: number[];
+}
+
+export interface Org {
+  id: string;
+  name: string;
+  // Concurrent sessions shared by all members; 0 means unlimited
+  maxSessions: number;
+  policy: OrgPolicy;
+  acls: OrgAclRule[];
+  // Enforced for the members they list on the org's private nodes
+  parentalControls: ParentalProfile[];
+  policyUpdatedAt: number;
+  createdAt: number;
+}
+
+const MAX_POLICY_SITES = 500;
+const MAX_ACL_RULES = 200;
+
+const orgs: Map<string, Org> = new Map();
+// Keyed by user; a user belongs to at most one org
+const members: Map<string, { orgId: string; role: OrgRole }> = new Map();
+let db: sqlite3.Database;
+
+export function initOrgs(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS orgs (
+      id TEXT PRIMARY KEY,
+      name TEXT NOT NULL,
+      max_sessions INTEGER NOT NULL DEFAULT 0,
+      policy TEXT NOT NULL DEFAULT '{}',
+      policy_updated_at INTEGER NOT NULL,
+      created_at INTEGER NOT NULL,
+      acls TEXT NOT NULL DEFAULT '[]',
+      parental_controls TEXT NOT NULL DEFAULT '[]'
+    )`);
+    // Orgs created before ACLs existed lack the column
+    db.run(`ALTER TABLE orgs ADD COLUMN acls TEXT NOT NULL DEFAULT '[]'`, () => {});
+    db.run(`ALTER TABLE orgs ADD COLUMN parental_controls TEXT NOT NULL DEFAULT '[]'`, () => {});
+    db.run(`CREATE TABLE IF NOT EXISTS org_members (
+      user TEXT PRIMARY KEY,
+      org_id TEXT NOT NULL,
+      role TEXT NOT NULL
+    )`);
+    db.all('SELECT * FROM orgs', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading orgs from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        orgs.set(row.id, {
+          id: row.id,
+          name: row.name,
+          maxSessions: row.max_sessions,
+          policy: JSON.parse(row.policy || '{}'),
+          acls: JSON.parse(row.acls || '[]'),
+          parentalControls: JSON.parse(row.parental_controls || '[]'),
+          policyUpdatedAt: row.policy_updated_at,
+          createdAt: row.created_at
+        });
+      });
+      console.log(`Loaded ${orgs.size} organizations`);
+    });
+    db.all('SELECT * FROM org_members', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading org members from DB:', err);
+        return;
+      }
+      rows.forEach(row => members.set(row.user, { orgId: row.org_id, role: row.role }));
+    });
+  });
+}
+
+function saveOrg(org: Org) {
+  db.run(
+    'INSERT OR REPLACE INTO orgs (id, name, max_sessions, policy, policy_updated_at, created_at, acls, parental_controls) VALUES (?, ?, ?, ?, ?, ?, ?, ?)',
+    [org.id, org.name, org.maxSessions, JSON.stringify(org.policy), org.policyUpdatedAt, org.createdAt, JSON.stringify(org.acls),
+      JSON.stringify(org.parentalControls)]
+  );
+}
+
+export function listOrgs(): Org[] {
+  return Array.from(orgs.values());
+}
+
+export function findOrg(id: string): Org | undefined {
+  return orgs.get(id);
+}
+
+export function createOrg(name: string, maxSessions: number): Org {
+  const org: Org = {
+    id: `org-${crypto.randomBytes(8).toString('hex')}`,
+    name,
+    maxSessions,
+    policy: {},
+    acls: [],
+    parentalControls: [],
+    policyUpdatedAt: Date.now(),
+    createdAt: Date.now()
+  };
+  orgs.set(org.id, org);
+  saveOrg(org);
+  return org;
+}
+
+export function updateOrg(id: string, changes: { name?: string; maxSessions?: number }): Org | undefined {
+  const org = orgs.get(id);
+  if (!org) return undefined;
+  if (changes.name !== undefined) org.name = changes.name;
+  if (changes.maxSessions !== undefined) org.maxSessions = changes.maxSessions;
+  saveOrg(org);
+  return org;
+}
+
+export function deleteOrg(id: string): boolean {
+  if (!orgs.delete(id)) return false;
+  members.forEach((m, user) => {
+    if (m.orgId === id) members.delete(user);
+  });
+  db.run('DELETE FROM orgs WHERE id = ?', [id]);
+  db.run('DELETE FROM org_members WHERE org_id = ?', [id]);
+  return true;
+}
+
+export function orgForUser(user: string): { org: Org; role: OrgRole } | undefined {
+  const m = members.get(user);
+  const org = m && orgs.get(m.orgId);
+  return org ? { org, role: m!.role } : undefined;
+}
+
+export function sameOrg(a: string, b: string): boolean {
+  const orgA = members.get(a)?.orgId;
+  return orgA !== undefined && orgA === members.get(b)?.orgId;
+}
+
+export function membersOf(orgId: string): { user: string; role: OrgRole }[] {
+  return Array.from(members.entries())
+    .filter(([, m]) => m.orgId === orgId)
+    .map(([user, m]) => ({ user, role: m.role }));
+}
+
+// Adds a user to an org or changes their role there. Returns an error
+// message if they already belong to another org.
+export function setMember(orgId: string, user: string, role: OrgRole): string | undefined {
+  const current = members.get(user);
+  if (current && current.orgId !== orgId) {
+    return 'User belongs to another organization';
+  }
+  members.set(user, { orgId, role });
+  db.run('INSERT OR REPLACE INTO org_members (user, org_id, role) VALUES (?, ?, ?)', [user, orgId, role]);
+  return undefined;
+}
+
+export function removeMember(orgId: string, user: string): boolean {
+  if (members.get(user)?.orgId !== orgId) return false;
+  members.delete(user);
+  db.run('DELETE FROM org_members WHERE user = ?', [user]);
+  return true;
+}
+
+export function validOrgRole(role: unknown): role is OrgRole {
+  return role === 'member' || role === 'admin';
+}
+
+export function normalizeSite(site: unknown): string | undefined {
+  if (typeof site !== 'string') return undefined;
+  let normalized = site.trim().toLowerCase();
+  if (normalized.startsWith('*.')) normalized = normalized.substring(2);
+  return /^[a-z0-9.-]{1,253}$/.test(normalized) ? normalized : undefined;
+}
+
+// Checks and normalizes a policy, returning it or an error message
+export function parsePolicy(body: any): OrgPolicy | string {
+  if (typeof body !== 'object' || body === null) {
+    return 'Policy must be an object';
+  }
+  const policy: OrgPolicy = {};
+  if (body.tunnelByDefault !== undefined) {
+    if (typeof body.tunnelByDefault !== 'boolean') return 'tunnelByDefault must be a boolean';
+    policy.tunnelByDefault = body.tunnelByDefault;
+  }
+  for (const list of ['direct', 'tunnel', 'block'] as const) {
+    if (body[list] === undefined) continue;
+    if (!Array.isArray(body[list]) || body[list].length > MAX_POLICY_SITES) {
+      return `${list} must be a list of at most ${MAX_POLICY_SITES} sites`;
+    }
+    const sites: string[] = [];
+    for (const site of body[list]) {
+      const normalized = normalizeSite(site);
+      if (!normalized) return `Invalid site in ${list}: ${site}`;
+      sites.push(normalized);
+    }
+    policy[list] = sites;
+  }
+  return policy;
+}
+
+function validCidr(cidr: unknown): cidr is string {
+  if (typeof cidr !== 'string') return false;
+  const [addr, prefix, ...rest] = cidr.split('/');
+  const family = net.isIP(addr);
+  if (family === 0 || rest.length > 0) return false;
+  if (prefix === undefined) return true;
+  const bits = Number(prefix);
+  return /^[0-9]{1,3}$/.test(prefix) && bits <= (family === 4 ? 32 : 128);
+}
+
+// Checks ACL rules, returning them or an error message
+export function parseAcls(body: any): OrgAclRule[] | string {
+  if (!Array.isArray(body) || body.length > MAX_ACL_RULES) {
+    return `ACLs must be a list of at most ${MAX_ACL_RULES} rules`;
+  }
+  const rules: OrgAclRule[] = [];
+  for (const [i, rule] of body.entries()) {
+    if (typeof rule !== 'object' || rule === null) return `Rule ${i} must be an object`;
+    const { users, cidrs = [], hosts = [], ports = [] } = rule;
+    if (!Array.isArray(users) || users.length === 0 ||
+        !users.every((u: unknown) => typeof u === 'string' && u.length > 0 && u.length <= 200)) {
+      return `Rule ${i}: users must be a non-empty list of users or "*"`;
+    }
+    if (!Array.isArray(cidrs) || !cidrs.every(validCidr)) {
+      return `Rule ${i}: invalid cidrs`;
+    }
+    if (!Array.isArray(hosts) || !hosts.every((h: unknown) => normalizeSite(h) === h)) {
+      return `Rule ${i}: hosts must be lowercase hostnames`;
+    }
+    if (cidrs.length === 0 && hosts.length === 0) {
+      return `Rule ${i} names no cidrs or hosts`;
+    }
+    if (!Array.isArray(ports) ||
+        !ports.every((p: unknown) => typeof p === 'number' && Number.isInteger(p) && p >= 1 && p <= 65535)) {
+      return `Rule ${i}: invalid ports`;
+    }
+    rules.push({ users, cidrs, hosts, ports });
+  }
+  return rules;
+}
+
+export function setOrgAcls(orgId: string, acls: OrgAclRule[]): Org | undefined {
+  const org = orgs.get(orgId);
+  if (!org) return undefined;
+  org.acls = acls;
+  saveOrg(org);
+  return org;
+}
+
+// The org's rules as nodes enforce them, with "*" spelled out as the
+// member list
+export function aclsForNodes(orgId: string): OrgAclRule[] {
+  const org = orgs.get(orgId);
+  if (!org) return [];
+  const everyone = membersOf(orgId).map(m => m.user);
+  return org.acls.map(rule => ({
+    ...rule,
+    users: rule.users.includes('*') ? everyone : rule.users
+  }));
+}
+
+export function setOrgParentalControls(orgId: string, profiles: ParentalProfile[]): Org | undefined {
+  const org = orgs.get(orgId);
+  if (!org) return undefined;
+  org.parentalControls = profiles;
+  saveOrg(org);
+  return org;
+}
+
+// The org's profiles as nodes enforce them, with "*" spelled out as the
+// member list
+export function parentalControlsForNodes(orgId: string): ParentalProfile[] {
+  const org = orgs.get(orgId);
+  if (!org) return [];
+  const everyone = membersOf(orgId).map(m => m.user);
+  return org.parentalControls.map(profile => ({
+    ...profile,
+    users: profile.users.includes('*') ? everyone : profile.users
+  }));
+}
+
+export function setOrgPolicy(orgId: string, policy: OrgPolicy): Org | undefined {
+  const org = orgs.get(orgId);
+  if (!org) return undefined;
+  org.policy = policy;
+  org.policyUpdatedAt = Date.now();
+  saveOrg(org);
+  return org;
+}
@@ -0,0 +1,131 @@
+// Parental controls: profiles of time windows in which listed domains, or
+// categories of them, are blocked, e.g. social media from 22:00 to 07:00 on
+// school nights. Clients evaluate a profile from their config bundle or
+// their own settings; org admins can also have the org's private nodes
+// enforce profiles for the members they list, so a managed device can't
+// turn them off.
+import { normalizeSite } from './orgs';
+
+const DAYS = ['sun', 'mon', 'tue', 'wed', 'thu', 'fri', 'sat'];
+
+const MAX_PROFILES = 50;
+const MAX_RULES = 50;
+const MAX_CATEGORIES = 50;
+const MAX_DOMAINS = 2000;
+
+export interface ScheduleRule {
+  // The days a window starts on; empty for every day. A window past
+  // midnight belongs to the day it starts.
+  days: string[];
+  // HH:MM, in the profile's time zone; the window ends before to, and a
+  // window where from equals to lasts all day
+  from: string;
+  to: string;
+  domains: string[];
+  categories: string[];
+}
+
+export interface ParentalProfile {
+  name: string;
+  // Org members the profile applies to on the org's nodes; "*" for every
+  // member. Clients ignore it.
+  users: string[];
+  // IANA time zone nodes evaluate windows in; clients use the device's
+  timezone: string;
+  // Named lists of domains that rules block by name
+  categories: Record<string, string[]>;
+  rules: ScheduleRule[];
+}
+
+function validTime(value: unknown): value is string {
+  return typeof value === 'string' && /^([01][0-9]|2[0-3]):[0-5][0-9]$/.test(value);
+}
+
+function validTimezone(value: string): boolean {
+  try {
+    new Intl.DateTimeFormat('en', { timeZone: value });
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+function parseDomains(list: unknown, name: string): string[] | string {
+  if (!Array.isArray(list) || list.length > MAX_DOMAINS) {
+    return `${name} must be a list of at most ${MAX_DOMAINS} domains`;
+  }
+  const domains: string[] = [];
+  for (const domain of list) {
+    const normalized = normalizeSite(domain);
+    if (!normalized) return `Invalid domain in ${name}: ${domain}`;
+    domains.push(normalized);
+  }
+  return Array.from(new Set(domains));
+}
+
+// Checks one profile, returning it normalized or an error message. Profiles
+// for nodes must name their users.
+export function parseParentalProfile(body: any, needUsers: boolean): ParentalProfile | string {
+  if (typeof body !== 'object' || body === null) return 'Profile must be an object';
+  const { name, users = [], timezone = 'UTC', categories = {}, rules } = body;
+  if (typeof name !== 'string' || !/^[A-Za-z0-9 _-]{1,64}$/.test(name)) {
+    return 'Profile name must be 1 to 64 letters, digits, spaces, dashes or underscores';
+  }
+  if (!Array.isArray(users) || (needUsers && users.length === 0) ||
+      !users.every((u: unknown) => typeof u === 'string' && u.length > 0 && u.length <= 200)) {
+    return `Profile ${name}: users must be a ${needUsers ? 'non-empty ' : ''}list of users or "*"`;
+  }
+  if (typeof timezone !== 'string' || !validTimezone(timezone)) {
+    return `Profile ${name}: unknown timezone ${timezone}`;
+  }
+  if (typeof categories !== 'object' || categories === null || Array.isArray(categories) ||
+      Object.keys(categories).length > MAX_CATEGORIES) {
+    return `Profile ${name}: categories must map at most ${MAX_CATEGORIES} names to domain lists`;
+  }
+  const parsedCategories: Record<string, string[]> = {};
+  for (const [category, list] of Object.entries(categories)) {
+    const domains = parseDomains(list, `category ${category}`);
+    if (typeof domains === 'string') return `Profile ${name}: ${domains}`;
+    parsedCategories[category] = domains;
+  }
+  if (!Array.isArray(rules) || rules.length === 0 || rules.length > MAX_RULES) {
+    return `Profile ${name}: rules must be a list of 1 to ${MAX_RULES} rules`;
+  }
+  const parsedRules: ScheduleRule[] = [];
+  for (const [i, rule] of rules.entries()) {
+    if (typeof rule !== 'object' || rule === null) return `Profile ${name}: rule ${i} must be an object`;
+    const { days = [], from, to, domains = [], categories: ruleCategories = [] } = rule;
+    if (!Array.isArray(days) || !days.every((d: unknown) => typeof d === 'string' && DAYS.includes(d))) {
+      return `Profile ${name}: rule ${i}: days must be a list of ${DAYS.join(', ')}`;
+    }
+    if (!validTime(from) || !validTime(to)) {
+      return `Profile ${name}: rule ${i}: from and to must be times like 22:00`;
+    }
+    const parsedDomains = parseDomains(domains, `rule ${i} domains`);
+    if (typeof parsedDomains === 'string') return `Profile ${name}: ${parsedDomains}`;
+    if (!Array.isArray(ruleCategories) ||
+        !ruleCategories.every((c: unknown) => typeof c === 'string' && c in parsedCategories)) {
+      return `Profile ${name}: rule ${i} names a category the profile doesn't define`;
+    }
+    if (parsedDomains.length === 0 && ruleCategories.length === 0) {
+      return `Profile ${name}: rule ${i} blocks no domains or categories`;
+    }
+    parsedRules.push({ days: Array.from(new Set(days)), from, to, domains: parsedDomains, categories: ruleCategories });
+  }
+  return { name, users, timezone, categories: parsedCategories, rules: parsedRules };
+}
+
+// Checks a list of profiles with distinct names
+export function parseParentalProfiles(body: any, needUsers: boolean): ParentalProfile[] | string {
+  if (!Array.isArray(body) || body.length > MAX_PROFILES) {
+    return `Parental controls must be a list of at most ${MAX_PROFILES} profiles`;
+  }
+  const profiles: ParentalProfile[] = [];
+  for (const item of body) {
+    const profile = parseParentalProfile(item, needUsers);
+    if (typeof profile === 'string') return profile;
+    if (profiles.some(p => p.name === profile.name)) return `Profile ${profile.name} is listed twice`;
+    profiles.push(profile);
+  }
+  return profiles;
+}
@@ -0,0 +1,131 @@
+// Inbound port reservations on exit servers. A user holding a dedicated IP
+// reservation can claim ports on their pinned server; each claim expires and
+// a port can only be held by one user per server at a time.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface PortForward {
+  id: string;
+  user: string;
+  serverId: string;
+  port: number;
+  expiresAt: number;
+}
+
+const PORT_MIN = parseInt(process.env.PORT_FORWARD_MIN || '20000');
+const PORT_MAX = parseInt(process.env.PORT_FORWARD_MAX || '29999');
+const MAX_PER_USER = 5;
+export const DEFAULT_TTL_MS = 24 * 60 * 60 * 1000;
+export const MAX_TTL_MS = 7 * 24 * 60 * 60 * 1000;
+
+const forwards: Map<string, PortForward> = new Map();
+let db: sqlite3.Database;
+
+export function initPortForwards(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS port_forwards (
+      id TEXT PRIMARY KEY,
+      user TEXT NOT NULL,
+      server_id TEXT NOT NULL,
+      port INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM port_forwards', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading port forwards from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        forwards.set(row.id, {
+          id: row.id,
+          user: row.user,
+          serverId: row.server_id,
+          port: row.port,
+          expiresAt: row.expires_at
+        });
+      });
+      expirePortForwards();
+    });
+  });
+}
+
+export function expirePortForwards() {
+  const now = Date.now();
+  forwards.forEach((forward, id) => {
+    if (forward.expiresAt <= now) {
+      forwards.delete(id);
+      db.run('DELETE FROM port_forwards WHERE id = ?', [id]);
+    }
+  });
+}
+
+export function portForwardsForUser(user: string): PortForward[] {
+  expirePortForwards();
+  return Array.from(forwards.values()).filter(f => f.user === user);
+}
+
+export function portForwardsForServer(serverId: string): PortForward[] {
+  expirePortForwards();
+  return Array.from(forwards.values()).filter(f => f.serverId === serverId);
+}
+
+// Claims a port, or returns an error message. When port is undefined a free
+// one is chosen from the configured range.
+export function createPortForward(user: string, serverId: string, port: number | undefined, ttlMs: number): PortForward | string {
+  expirePortForwards();
+
+  if (portForwardsForUser(user).length >= MAX_PER_USER) {
+    return `At most ${MAX_PER_USER} port forwards per user`;
+  }
+
+  const used = new Set(portForwardsForServer(serverId).map(f => f.port));
+  if (port !== undefined) {
+    if (port < PORT_MIN || port > PORT_MAX) {
+      return `Port must be between ${PORT_MIN} and ${PORT_MAX}`;
+    }
+    if (used.has(port)) {
+      return 'Port already reserved on this server';
+    }
+  } else {
+    const free: number[] = [];
+    for (let p = PORT_MIN; p <= PORT_MAX; p++) {
+      if (!used.has(p)) free.push(p);
+    }
+    if (free.length === 0) {
+      return 'No free ports on this server';
+    }
+    port = free[crypto.randomInt(free.length)];
+  }
+
+  const forward: PortForward = {
+    id: crypto.randomBytes(8).toString('hex'),
+    user,
+    serverId,
+    port,
+    expiresAt: Date.now() + ttlMs
+  };
+  forwards.set(forward.id, forward);
+  db.run(
+    'INSERT INTO port_forwards (id, user, server_id, port, expires_at) VALUES (?, ?, ?, ?, ?)',
+    [forward.id, forward.user, forward.serverId, forward.port, forward.expiresAt]
+  );
+  return forward;
+}
+
+export function deletePortForwardsForUser(user: string) {
+  forwards.forEach((forward, id) => {
+    if (forward.user === user) {
+      forwards.delete(id);
+      db.run('DELETE FROM port_forwards WHERE id = ?', [id]);
+    }
+  });
+}
+
+export function deletePortForward(user: string, id: string): boolean {
+  const forward = forwards.get(id);
+  if (!forward || forward.user !== user) return false;
+  forwards.delete(id);
+  db.run('DELETE FROM port_forwards WHERE id = ?', [id]);
+  return true;
+}
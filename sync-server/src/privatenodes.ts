@@ -0,0 +1,104 @@
+// Bring-your-own exit nodes: users enroll nodes they host themselves, and
+// only they are routed to them. Enrolling reserves a server ID and hands out
+// a node token; the node registers under that ID by presenting the token.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+import { sameOrg } from './orgs';
+
+export interface PrivateNode {
+  serverId: string;
+  owner: string;
+  name: string;
+  tokenHash: string;
+  createdAt: number;
+}
+
+const MAX_PER_USER = 5;
+
+const nodes: Map<string, PrivateNode> = new Map();
+let db: sqlite3.Database;
+
+function hashToken(token: string): string {
+  return crypto.createHash('sha256').update(token).digest('hex');
+}
+
+export function initPrivateNodes(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS private_nodes (
+      server_id TEXT PRIMARY KEY,
+      owner TEXT NOT NULL,
+      name TEXT NOT NULL,
+      token_hash TEXT NOT NULL UNIQUE,
+      created_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM private_nodes', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading private nodes from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        nodes.set(row.server_id, {
+          serverId: row.server_id,
+          owner: row.owner,
+          name: row.name,
+          tokenHash: row.token_hash,
+          createdAt: row.created_at
+        });
+      });
+      console.log(`Loaded ${nodes.size} private nodes`);
+    });
+  });
+}
+
+export function findPrivateNode(serverId: string): PrivateNode | undefined {
+  return nodes.get(serverId);
+}
+
+export function findPrivateNodeByToken(token: string): PrivateNode | undefined {
+  const hash = hashToken(token);
+  return Array.from(nodes.values()).find(n => n.tokenHash === hash);
+}
+
+export function privateNodesForUser(owner: string): PrivateNode[] {
+  return Array.from(nodes.values()).filter(n => n.owner === owner);
+}
+
+// Whether user may be routed to (and get tokens for) a server. Public
+// servers are open to everyone; private ones only to their owner and the
+// owner's organization.
+export function canUseServer(serverId: string, user: string | undefined): boolean {
+  const node = nodes.get(serverId);
+  return !node || (user !== undefined && (node.owner === user || sameOrg(node.owner, user)));
+}
+
+// Enrolls a node, returning it with its token (only shown this once), or an
+// error message if the user has too many.
+export function createPrivateNode(owner: string, name: string): { node: PrivateNode; token: string } | string {
+  if (privateNodesForUser(owner).length >= MAX_PER_USER) {
+    return `At most ${MAX_PER_USER} private nodes per user`;
+  }
+
+  const token = crypto.randomBytes(32).toString('hex');
+  const node: PrivateNode = {
+    serverId: `byo-${crypto.randomBytes(8).toString('hex')}`,
+    owner,
+    name,
+    tokenHash: hashToken(token),
+    createdAt: Date.now()
+  };
+  nodes.set(node.serverId, node);
+  db.run(
+    'INSERT INTO private_nodes (server_id, owner, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)',
+    [node.serverId, node.owner, node.name, node.tokenHash, node.createdAt]
+  );
+  return { node, token };
+}
+
+export function deletePrivateNode(owner: string, serverId: string): boolean {
+  const node = nodes.get(serverId);
+  if (!node || node.owner !== owner) return false;
+  nodes.delete(serverId);
+  db.run('DELETE FROM private_nodes WHERE server_id = ?', [serverId]);
+  return true;
+}
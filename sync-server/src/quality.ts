@@ -0,0 +1,76 @@
+// Per-server quality scores built from client-reported telemetry.
+// Samples carry no client identity; only the running averages are kept.
+
+export interface TelemetrySample {
+  connectMs: number;
+  throughputKbps?: number;
+}
+
+interface Quality {
+  latencyMs: number;
+  throughputKbps: number;
+  samples: number;
+  updatedAt: number;
+}
+
+// Weight of a new sample in the moving averages
+const ALPHA = 0.2;
+// Below this many samples a server keeps the neutral score
+const MIN_SAMPLES = 3;
+// Scores decay back to neutral when nobody has reported for this long
+const MAX_AGE_MS = 24 * 60 * 60 * 1000;
+export const NEUTRAL_SCORE = 0.5;
+
+const qualities: Map<string, Quality> = new Map();
+
+export function recordSample(url: string, sample: TelemetrySample) {
+  const existing = qualities.get(url);
+  if (!existing || Date.now() - existing.updatedAt > MAX_AGE_MS) {
+    qualities.set(url, {
+      latencyMs: sample.connectMs,
+      throughputKbps: sample.throughputKbps ?? 0,
+      samples: 1,
+      updatedAt: Date.now()
+    });
+    return;
+  }
+
+  existing.latencyMs += ALPHA * (sample.connectMs - existing.latencyMs);
+  if (sample.throughputKbps !== undefined) {
+    existing.throughputKbps += ALPHA * (sample.throughputKbps - existing.throughputKbps);
+  }
+  existing.samples++;
+  existing.updatedAt = Date.now();
+}
+
+// Returns a score in (0, 1]; higher is better
+export function qualityScore(url: string): number {
+  const q = qualities.get(url);
+  if (!q || q.samples < MIN_SAMPLES || Date.now() - q.updatedAt > MAX_AGE_MS) {
+    return NEUTRAL_SCORE;
+  }
+
+  // 200ms connect time halves the latency score
+  const latencyScore = 1 / (1 + q.latencyMs / 200);
+  // 10 Mbit/s or more is as good as it gets
+  const throughputScore = Math.min(1, q.throughputKbps / 10000);
+  return Math.max(0.01, 0.7 * latencyScore + 0.3 * throughputScore);
+}
+
+export function forgetServer(url: string) {
+  qualities.delete(url);
+}
+
+// Picks one item at random, weighting each by the quality score of its URL
+export function pickWeighted<T extends { url: string }>(candidates: T[], random: () => number = Math.random): T | undefined {
+  if (candidates.length === 0) return undefined;
+
+  const weights = candidates.map(c => qualityScore(c.url));
+  const total = weights.reduce((a, b) => a + b, 0);
+  let r = random() * total;
+  for (let i = 0; i < candidates.length; i++) {
+    r -= weights[i];
+    if (r < 0) return candidates[i];
+  }
+  return candidates[candidates.length - 1];
+}
@@ -0,0 +1,95 @@
+// Dedicated exit reservations: pin a user to one server (and optionally one
+// egress IP on it) so their apparent address stays stable across sessions.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface Reservation {
+  token: string;
+  user: string;
+  serverId: string;
+  egressIp: string | null;
+  createdAt: number;
+}
+
+const reservations: Map<string, Reservation> = new Map();
+let db: sqlite3.Database;
+
+export function initReservations(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS reservations (
+      token TEXT PRIMARY KEY,
+      user TEXT NOT NULL UNIQUE,
+      server_id TEXT NOT NULL,
+      egress_ip TEXT,
+      created_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM reservations', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading reservations from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        reservations.set(row.token, {
+          token: row.token,
+          user: row.user,
+          serverId: row.server_id,
+          egressIp: row.egress_ip,
+          createdAt: row.created_at
+        });
+      });
+      console.log(`Loaded ${reservations.size} dedicated IP reservations`);
+    });
+  });
+}
+
+export function findReservation(token: string): Reservation | undefined {
+  return reservations.get(token);
+}
+
+export function findReservationByUser(user: string): Reservation | undefined {
+  return Array.from(reservations.values()).find(r => r.user === user);
+}
+
+export function reservationsForServer(serverId: string): Reservation[] {
+  return Array.from(reservations.values()).filter(r => r.serverId === serverId);
+}
+
+export function listReservations(): Reservation[] {
+  return Array.from(reservations.values());
+}
+
+// Creates a reservation, or returns an error message if the user already has
+// one or the egress IP is held by someone else. Several users may share a
+// server when no egress IP is pinned, since they'd share its address anyway.
+export function createReservation(user: string, serverId: string, egressIp: string | null): Reservation | string {
+  if (findReservationByUser(user)) {
+    return 'User already has a reservation';
+  }
+  if (egressIp !== null &&
+      Array.from(reservations.values()).some(r => r.serverId === serverId && r.egressIp === egressIp)) {
+    return 'Egress IP already reserved';
+  }
+
+  const reservation: Reservation = {
+    token: crypto.randomBytes(24).toString('hex'),
+    user,
+    serverId,
+    egressIp,
+    createdAt: Date.now()
+  };
+  reservations.set(reservation.token, reservation);
+  db.run(
+    'INSERT INTO reservations (token, user, server_id, egress_ip, created_at) VALUES (?, ?, ?, ?, ?)',
+    [reservation.token, reservation.user, reservation.serverId, reservation.egressIp, reservation.createdAt]
+  );
+  return reservation;
+}
+
+export function deleteReservation(user: string): boolean {
+  const reservation = findReservationByUser(user);
+  if (!reservation) return false;
+  reservations.delete(reservation.token);
+  db.run('DELETE FROM reservations WHERE token = ?', [reservation.token]);
+  return true;
+}
@@ -0,0 +1,63 @@
+// Admin API tokens and the roles they carry. Roles are ordered: each one can
+// do everything the roles below it can.
+//   viewer   - read-only access (reservation listings)
+//   operator - day-to-day changes (issuing and revoking reservations)
+//   admin    - security settings (TOTP enrollment, audit log export)
+import crypto from 'crypto';
+
+export type Role = 'viewer' | 'operator' | 'admin';
+
+const ROLE_RANK: Record<Role, number> = { viewer: 0, operator: 1, admin: 2 };
+
+export interface AdminToken {
+  name: string;
+  role: Role;
+}
+
+interface TokenEntry extends AdminToken {
+  hash: Buffer;
+}
+
+let tokens: TokenEntry[] = [];
+
+function isRole(s: string): s is Role {
+  return Object.prototype.hasOwnProperty.call(ROLE_RANK, s);
+}
+
+function hashToken(token: string): Buffer {
+  return crypto.createHash('sha256').update(token).digest();
+}
+
+// Loads tokens from ADMIN_TOKENS ("name:role:token" entries separated by
+// commas). A plain ADMIN_TOKEN is kept working as a token with the admin role.
+export function loadAdminTokens() {
+  tokens = [];
+  if (process.env.ADMIN_TOKEN) {
+    tokens.push({ name: 'admin', role: 'admin', hash: hashToken(process.env.ADMIN_TOKEN) });
+  }
+
+  for (const entry of (process.env.ADMIN_TOKENS || '').split(',')) {
+    if (entry.trim() === '') continue;
+    const [name, role, ...rest] = entry.trim().split(':');
+    const token = rest.join(':');
+    if (!name || !role || !isRole(role) || token === '') {
+      console.warn(`Ignoring invalid ADMIN_TOKENS entry for "${name || '?'}": expected name:role:token`);
+      continue;
+    }
+    tokens.push({ name, role, hash: hashToken(token) });
+  }
+}
+
+export function adminApiEnabled(): boolean {
+  return tokens.length > 0;
+}
+
+export function findAdminToken(token: string): AdminToken | undefined {
+  const hash = hashToken(token);
+  const match = tokens.find(t => crypto.timingSafeEqual(t.hash, hash));
+  return match ? { name: match.name, role: match.role } : undefined;
+}
+
+export function roleAllows(role: Role, required: Role): boolean {
+  return ROLE_RANK[role] >= ROLE_RANK[required];
+}
@@ -0,0 +1,165 @@
+// SCIM provisioning: an org's identity provider pushes its users to
+// /scim/v2/Users and their horseVPN access follows. Provisioned users join
+// the org; suspended users (active: false) and deprovisioned (deleted) users
+// are locked out of the sync server, and nodes refuse their credentials once
+// they next poll /revoked-devices.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+export interface ScimUser {
+  id: string;
+  orgId: string;
+  userName: string;
+  externalId: string | null;
+  active: boolean;
+  // Set once the identity provider deletes the user; they stay locked out
+  // until provisioned again
+  deletedAt: number | null;
+  createdAt: number;
+  updatedAt: number;
+}
+
+// Keyed by ID
+const users: Map<string, ScimUser> = new Map();
+// Keyed by org ID
+const tokenHashes: Map<string, string> = new Map();
+let db: sqlite3.Database;
+
+function hash(s: string): string {
+  return crypto.createHash('sha256').update(s).digest('hex');
+}
+
+export function initScim(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS scim_users (
+      id TEXT PRIMARY KEY,
+      org_id TEXT NOT NULL,
+      user_name TEXT NOT NULL UNIQUE,
+      external_id TEXT,
+      active INTEGER NOT NULL,
+      deleted_at INTEGER,
+      created_at INTEGER NOT NULL,
+      updated_at INTEGER NOT NULL
+    )`);
+    db.run(`CREATE TABLE IF NOT EXISTS scim_tokens (
+      org_id TEXT PRIMARY KEY,
+      token_hash TEXT NOT NULL UNIQUE,
+      created_at INTEGER NOT NULL
+    )`);
+    db.all('SELECT * FROM scim_users', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading SCIM users from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        users.set(row.id, {
+          id: row.id,
+          orgId: row.org_id,
+          userName: row.user_name,
+          externalId: row.external_id,
+          active: row.active === 1,
+          deletedAt: row.deleted_at,
+          createdAt: row.created_at,
+          updatedAt: row.updated_at
+        });
+      });
+      console.log(`Loaded ${users.size} SCIM users`);
+    });
+    db.all('SELECT * FROM scim_tokens', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading SCIM tokens from DB:', err);
+        return;
+      }
+      rows.forEach(row => tokenHashes.set(row.org_id, row.token_hash));
+    });
+  });
+}
+
+function saveUser(user: ScimUser) {
+  db.run(
+    'INSERT OR REPLACE INTO scim_users (id, org_id, user_name, external_id, active, deleted_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)',
+    [user.id, user.orgId, user.userName, user.externalId, user.active ? 1 : 0, user.deletedAt, user.createdAt, user.updatedAt]
+  );
+}
+
+// Issues the org's SCIM bearer token, replacing any previous one. The token
+// is only returned here.
+export function createScimToken(orgId: string): string {
+  const token = crypto.randomBytes(32).toString('hex');
+  tokenHashes.set(orgId, hash(token));
+  db.run('INSERT OR REPLACE INTO scim_tokens (org_id, token_hash, created_at) VALUES (?, ?, ?)', [orgId, hash(token), Date.now()]);
+  return token;
+}
+
+export function deleteScimToken(orgId: string): boolean {
+  if (!tokenHashes.delete(orgId)) return false;
+  db.run('DELETE FROM scim_tokens WHERE org_id = ?', [orgId]);
+  return true;
+}
+
+export function orgForScimToken(token: string): string | undefined {
+  const h = hash(token);
+  for (const [orgId, tokenHash] of tokenHashes) {
+    if (tokenHash === h) return orgId;
+  }
+  return undefined;
+}
+
+export function scimUsersForOrg(orgId: string): ScimUser[] {
+  return Array.from(users.values()).filter(u => u.orgId === orgId && u.deletedAt === null);
+}
+
+export function findScimUser(orgId: string, id: string): ScimUser | undefined {
+  const user = users.get(id);
+  return user && user.orgId === orgId && user.deletedAt === null ? user : undefined;
+}
+
+function findByUserName(userName: string): ScimUser | undefined {
+  return Array.from(users.values()).find(u => u.userName === userName);
+}
+
+// Provisions a user, or provisions a deprovisioned one again. Returns an
+// error message if the user name is taken.
+export function provisionScimUser(orgId: string, userName: string, externalId: string | null, active: boolean): ScimUser | string {
+  const now = Date.now();
+  let user = findByUserName(userName);
+  if (user && user.orgId !== orgId) {
+    return 'User is provisioned by another organization';
+  }
+  if (user && user.deletedAt === null) {
+    return 'User already exists';
+  }
+  if (user) {
+    Object.assign(user, { externalId, active, deletedAt: null, updatedAt: now });
+  } else {
+    user = { id: crypto.randomUUID(), orgId, userName, externalId, active, deletedAt: null, createdAt: now, updatedAt: now };
+    users.set(user.id, user);
+  }
+  saveUser(user);
+  return user;
+}
+
+export function updateScimUser(user: ScimUser, changes: { active?: boolean; externalId?: string | null }) {
+  if (changes.active !== undefined) user.active = changes.active;
+  if (changes.externalId !== undefined) user.externalId = changes.externalId;
+  user.updatedAt = Date.now();
+  saveUser(user);
+}
+
+export function deprovisionScimUser(user: ScimUser) {
+  user.active = false;
+  user.deletedAt = Date.now();
+  user.updatedAt = user.deletedAt;
+  saveUser(user);
+}
+
+// Whether the identity provider has suspended or deprovisioned the user
+export function userLockedOut(userName: string): boolean {
+  const user = findByUserName(userName);
+  return user !== undefined && !user.active;
+}
+
+export function lockedOutUsers(): string[] {
+  return Array.from(users.values()).filter(u => !u.active).map(u => u.userName);
+}
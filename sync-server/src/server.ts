@@ -6,56 +6,207 @@ import helmet from 'helmet';
 import https from 'https';
 import fs from 'fs';
 import crypto from 'crypto';
+import { Counter, Gauge, Histogram, renderMetrics } from './metrics';
+import { forgetServer, pickWeighted, qualityScore, recordSample } from './quality';
+import { cohortForClient, cohortOfTags, cohortSummary, recordCohortSample, Cohort } from './canary';
+import {
+  createReservation, deleteReservation, findReservation, findReservationByUser, initReservations, listReservations,
+  reservationsForServer, Reservation
+} from './reservations';
+import {
+  createPortForward, deletePortForward, deletePortForwardsForUser, expirePortForwards, initPortForwards,
+  portForwardsForServer, portForwardsForUser, DEFAULT_TTL_MS, MAX_TTL_MS
+} from './portforwards';
+import { exportAudit, initAudit, recordAudit, verifyAudit } from './audit';
+import { adminApiEnabled, findAdminToken, loadAdminTokens, roleAllows, AdminToken, Role } from './roles';
+import { Device, devicesForUser, initDevices, revokeDevice, revokedDeviceIds, touchDevice, validDeviceId } from './devices';
+import {
+  activeSessionCount, evictionsForServer, expireEvictions, forgetServerSessions, startSession, stopSession,
+  MAX_SESSIONS_PER_USER, SESSION_LIMIT_POLICY
+} from './sessions';
+import { initSessionTokens, mintSessionToken, sessionTokenPublicKey } from './sessiontokens';
+import { idTokensEnabled, initIdTokens, looksLikeIdToken, verifyIdToken } from './idtokens';
+import {
+  aclsForNodes, createOrg, deleteOrg, findOrg, listOrgs, membersOf, orgForUser, parseAcls, parsePolicy, removeMember, setMember,
+  parentalControlsForNodes, setOrgAcls, setOrgParentalControls, setOrgPolicy, updateOrg, validOrgRole, initOrgs, Org
+} from './orgs';
+import { parseParentalProfiles } from './parentalcontrols';
+import {
+  canUseServer, createPrivateNode, deletePrivateNode, findPrivateNode, findPrivateNodeByToken, initPrivateNodes,
+  privateNodesForUser, PrivateNode
+} from './privatenodes';
+import {
+  createScimToken, deleteScimToken, deprovisionScimUser, findScimUser, initScim, lockedOutUsers, orgForScimToken,
+  provisionScimUser, scimUsersForOrg, updateScimUser, userLockedOut, ScimUser
+} from './scim';
+import {
+  declaredNodeTags, deleteFleet, findFleet, fleetSuspendedUsers, fleetUserSuspended, initFleet, listFleet, nodeInService,
+  parseFleetBody, putFleet, validFleetId, validFleetKind, FleetKind, FleetResource, PolicySpec, UserSpec
+} from './fleet';
+import {
+  createJoinToken, deleteJoinToken, enrolledNode, initNodeTokens, listJoinTokens, redeemJoinToken, serverForNodeToken,
+  DEFAULT_JOIN_TOKEN_TTL_MS, JoinToken, MAX_JOIN_TOKEN_TTL_MS
+} from './nodetokens';
+import { LoadReport, currentLoad, forgetServerLoad, hostSaturated, recordLoad, regionUtilization, validHostLoad } from './load';
+import { ApiKey, API_KEY_PREFIX, createApiKey, initApiKeys, listApiKeys, revokeApiKey, verifyApiKey } from './apikeys';
+import { forgetSyntheticResult, initSynthetic, runSyntheticProbes, syntheticEnabled, syntheticResults } from './synthetic';
+import { exportsEnabled, initExports, recordLoadUsage, recordSessionEnd, recordSessionStart, runExport } from './exports';
+import {
+  configBundleETag, configBundleFor, deleteConfigBundle, findConfigBundle, initConfigBundles, listConfigBundles, orgScope,
+  parseClientConfig, putConfigBundle, signedConfigBundle, waitForConfigChange, ConfigBundle
+} from './configbundles';
+import {
+  beginEnrollment,
+  confirmEnrollment,
+  disableTotp,
+  initTotp,
+  startStepUpSession,
+  stepUpSessionValid,
+  totpEnabled,
+  verifySecondFactor
+} from './totp';
+import {
+  addTombstone, expireTombstones, findTombstone, forgetTombstone, goneResponse, initTombstones, RemovalReason
+} from './tombstones';
+import { initTelemetry, parseTelemetryReport, recordTelemetry, telemetrySummary } from './telemetry';
+import { announcementView, currentAnnouncement, deleteAnnouncement, initAnnouncements, parseAnnouncement, putAnnouncement } from './announcements';
+import {
+  currentTransparencyStatement, initTransparency, parseTransparencyStatement, putTransparencyStatement, rotateTransparencyKey,
+  signedTransparencyStatement
+} from './transparency';
+import { Server, serverStoreFromEnv } from './serverstore';
+import { expireLookups, initLeakcheck, leakcheckZone, resolversFor, validLeakcheckToken } from './leakcheck';
+import net from 'net';
 
-interface Server {
-  id: string;
-  location: string;
-  url: string;
-  registeredAt: number;
-  lastSeen: number;
+const servers: Map<string, Server> = new Map();
+
+// Prometheus metrics
+new Gauge('horsevpn_sync_registered_servers', 'Registered VPN servers per location', () => {
+  const counts: Map<string, number> = new Map();
+  servers.forEach(server => counts.set(server.location, (counts.get(server.location) || 0) + 1));
+  return Array.from(counts.entries()).map(([location, count]) => [{ location }, count]);
+});
+const routeRequests = new Counter('horsevpn_sync_route_requests_total', 'Route requests by result');
+const routeLatency = new Histogram('horsevpn_sync_route_decision_seconds', 'Time taken to pick a server for a route request',
+  [0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1]);
+const probeFailures = new Counter('horsevpn_sync_probe_failures_total', 'Failed health probes by location');
+const staleExpirations = new Counter('horsevpn_sync_stale_expirations_total', 'Servers removed after failing a health probe');
+const serversRemoved = new Counter('horsevpn_sync_servers_removed_total', 'Servers removed from the catalog, by reason');
+const gcRuns = new Counter('horsevpn_sync_gc_runs_total', 'Passes over the catalog for stale servers and expired tombstones');
+let lastGcAt = 0;
+new Gauge('horsevpn_sync_gc_last_run_timestamp_seconds', 'When the last garbage collection pass ran', () => [[{}, lastGcAt / 1000]]);
+const telemetrySamples = new Counter('horsevpn_sync_telemetry_samples_total', 'Client telemetry samples accepted');
+new Gauge('horsevpn_sync_sessions_active', 'Client sessions reported by nodes', () => [[{}, activeSessionCount()]]);
+const sessionsLimited = new Counter('horsevpn_sync_sessions_limited_total', 'Sessions refused or evicted by the per-user session limit');
+new Gauge('horsevpn_sync_server_quality', 'Quality score derived from client telemetry', () =>
+  Array.from(servers.values()).map(server => [{ server_id: server.id, location: server.location }, qualityScore(server.url)]));
+
+// Utilization autoscalers should aim for, as reported by /autoscaling
+function targetUtilizationFromEnv(): number {
+  const v = process.env.AUTOSCALE_TARGET_UTILIZATION;
+  if (v) {
+    const target = parseFloat(v);
+    if (target > 0 && target <= 1) return target;
+    console.warn(`Ignoring invalid AUTOSCALE_TARGET_UTILIZATION value: ${v}`);
+  }
+  return 0.7;
 }
 
-const servers: Map<string, Server> = new Map();
-const db = new sqlite3.Database('./servers.db');
+const TARGET_UTILIZATION = targetUtilizationFromEnv();
 
-db.run(`CREATE TABLE IF NOT EXISTS servers (
-  id TEXT PRIMARY KEY,
-  location TEXT NOT NULL,
-  url TEXT NOT NULL,
-  registered_at INTEGER NOT NULL,
-  last_seen INTEGER NOT NULL
-)`);
+// Servers that neither pass a health probe nor report load for this long are
+// removed, even if no probe has failed yet
+function staleServerTtlFromEnv(): number {
+  const v = process.env.STALE_SERVER_TTL;
+  if (v) {
+    const secs = parseInt(v, 10);
+    if (!isNaN(secs) && secs >= 60) return secs * 1000;
+    console.warn(`Ignoring invalid STALE_SERVER_TTL value: ${v}`);
+  }
+  return 15 * 60 * 1000;
+}
 
-function loadServersFromDB() {
-  db.all('SELECT * FROM servers', [], (err, rows: any[]) => {
-    if (err) {
-      console.error('Error loading servers from DB:', err);
-      return;
-    }
+const STALE_SERVER_TTL_MS = staleServerTtlFromEnv();
 
-    servers.clear();
-    rows.forEach(row => {
-      servers.set(row.id, {
-        id: row.id,
-        location: row.location,
-        url: row.url,
-        registeredAt: row.registered_at,
-        lastSeen: row.last_seen
-      });
-    });
-    console.log(`Loaded ${servers.size} servers from database`);
+// Servers /route offers after the one it picked, for clients to try in turn
+function routeFallbacksFromEnv(): number {
+  const v = process.env.ROUTE_FALLBACKS;
+  if (v) {
+    const n = parseInt(v, 10);
+    if (!isNaN(n) && n >= 0 && n <= 10) return n;
+    console.warn(`Ignoring invalid ROUTE_FALLBACKS value: ${v}`);
+  }
+  return 2;
+}
+
+const ROUTE_FALLBACKS = routeFallbacksFromEnv();
+
+// Servers loaded from the database may not have been seen for as long as
+// the sync server was down, which isn't their fault
+const startedAt = Date.now();
+
+// Refuse /register from nodes without a node token, so that only nodes
+// enrolled with a join token (or private nodes) can join the catalog
+const REQUIRE_NODE_TOKENS = process.env.REQUIRE_NODE_TOKENS === 'true';
+
+// Public servers grouped by location, for utilization
+function serversByLocation(): Map<string, Server[]> {
+  const byLocation: Map<string, Server[]> = new Map();
+  servers.forEach(server => {
+    if (findPrivateNode(server.id)) return;
+    const list = byLocation.get(server.location) || [];
+    list.push(server);
+    byLocation.set(server.location, list);
   });
+  return byLocation;
 }
 
-function saveServerToDB(server: Server) {
-  db.run(
-    'INSERT OR REPLACE INTO servers (id, location, url, registered_at, last_seen) VALUES (?, ?, ?, ?, ?)',
-    [server.id, server.location, server.url, server.registeredAt, server.lastSeen]
-  );
+function utilizationOf(location: string, list: Server[]) {
+  return regionUtilization(location,
+    list.map(server => ({ id: server.id, inService: nodeInService(server.id, serverTags(server)) })), TARGET_UTILIZATION);
 }
 
-function removeServerFromDB(id: string) {
-  db.run('DELETE FROM servers WHERE id = ?', [id]);
+new Gauge('horsevpn_sync_region_utilization', 'Open tunnels over tunnel capacity per location, from node load reports', () =>
+  Array.from(serversByLocation().entries()).flatMap(([location, list]) => {
+    const utilization = utilizationOf(location, list).utilization;
+    return utilization === null ? [] : [[{ location }, utilization]];
+  }));
+
+const db = new sqlite3.Database('./servers.db');
+const serverStore = serverStoreFromEnv(db);
+
+initReservations(db);
+initPortForwards(db);
+initTotp(db);
+initAudit(db);
+initExports(db);
+initSynthetic(() => Array.from(serversByLocation().values()).flat());
+initLeakcheck();
+loadAdminTokens();
+initSessionTokens();
+initIdTokens();
+initDevices(db);
+initApiKeys(db);
+initPrivateNodes(db);
+initOrgs(db);
+initScim(db);
+initFleet(db);
+initNodeTokens(db);
+initConfigBundles(db);
+initTombstones(db);
+initAnnouncements(db);
+initTelemetry(db);
+initTransparency(db);
+
+async function loadServers() {
+  try {
+    const loaded = await serverStore.load();
+    servers.clear();
+    loaded.forEach(server => servers.set(server.id, server));
+    console.log(`Loaded ${servers.size} servers from the store`);
+  } catch (err) {
+    console.error('Error loading servers from the store:', err);
+  }
 }
 
 async function pingServer(server: Server): Promise<boolean> {
@@ -63,16 +214,22 @@ async function pingServer(server: Server): Promise<boolean> {
     // Try to ping the health endpoint
     const healthUrl = server.url.replace('/ws', '/health').replace('ws://', 'http://').replace('wss://', 'https://');
     const response = await axios.get(healthUrl, { timeout: 5000 });
-    return response.status === 200;
+    if (response.status !== 200) {
+      probeFailures.inc({ location: server.location });
+      return false;
+    }
+    return true;
   } catch (error) {
     console.log(`Server ${server.id} (${server.url}) is not responding`);
+    probeFailures.inc({ location: server.location });
     return false;
   }
 }
 
 async function pushServerListToRoutingServer() {
   try {
-    const serverList = Array.from(servers.values()).map(server => ({
+    const serverList = Array.from(servers.values())
+    .filter(server => !findPrivateNode(server.id) && nodeInService(server.id, serverTags(server))).map(server => ({
       location: server.location,
       url: server.url
     }));
@@ -97,11 +254,11 @@ async function healthCheck() {
     const isAlive = await pingServer(server);
     if (isAlive) {
       server.lastSeen = Date.now();
-      saveServerToDB(server);
+      serverStore.save(server);
     } else {
       console.log(`Removing dead server: ${server.id}`);
-      servers.delete(id);
-      removeServerFromDB(id);
+      staleExpirations.inc();
+      removeServer(server, 'probe_failed', 'health-check');
       serverListChanged = true;
     }
   }
@@ -114,6 +271,44 @@ async function healthCheck() {
   }
 }
 
+// Removes a server from the catalog, leaving a tombstone
+function removeServer(server: Server, reason: RemovalReason, actor: string) {
+  recordAudit('server.removed', actor, { serverId: server.id, location: server.location, url: server.url, reason });
+  const orphaned = reservationsForServer(server.id);
+  if (orphaned.length > 0) {
+    // Reservations are kept so the users get their exit back if the server returns
+    console.warn(`Server ${server.id} held ${orphaned.length} dedicated IP reservation(s); they are unavailable until it re-registers`);
+  }
+  serversRemoved.inc({ reason });
+  forgetServer(server.url);
+  forgetServerSessions(server.id);
+  forgetServerLoad(server.id);
+  forgetSyntheticResult(server.id);
+  servers.delete(server.id);
+  serverStore.remove(server.id);
+  if (!findPrivateNode(server.id)) {
+    addTombstone(server.id, server.location, server.url, reason);
+  }
+}
+
+// Removes servers not seen for STALE_SERVER_TTL and drops old tombstones
+async function collectGarbage() {
+  const cutoff = Date.now() - STALE_SERVER_TTL_MS;
+  let removed = 0;
+  for (const server of Array.from(servers.values())) {
+    if (Math.max(server.lastSeen, startedAt) > cutoff) continue;
+    console.log(`Removing stale server: ${server.id}, last seen ${new Date(server.lastSeen).toISOString()}`);
+    removeServer(server, 'stale', 'gc');
+    removed++;
+  }
+  expireTombstones();
+  gcRuns.inc();
+  lastGcAt = Date.now();
+  if (removed > 0) {
+    await pushServerListToRoutingServer();
+  }
+}
+
 const app = express();
 
 // Security middleware
@@ -133,13 +328,31 @@ app.use(helmet({
   }
 }));
 
-// Rate limiting
+// Rate limiting. Nodes report and poll far more often than the limit
+// allows, so their routes are left to nodeLimiter instead.
+const nodeRoutes = /^\/(sessions\/(start|stop)|servers\/[^/]+\/(heartbeat|load|usage-telemetry|evictions|acls|parental-controls|port-forwards))$/;
+
 const limiter = rateLimit({
   windowMs: 15 * 60 * 1000, // 15 minutes
   max: 100, // limit each IP to 100 requests per windowMs
   message: 'Too many requests from this IP, please try again later.',
   standardHeaders: true,
   legacyHeaders: false,
+  skip: (req: express.Request) => nodeRoutes.test(req.path),
+});
+
+// The same limit on node routes, skipped only by a request with the
+// credential of the node it is about
+const nodeLimiter = rateLimit({
+  windowMs: 15 * 60 * 1000,
+  max: 100,
+  message: 'Too many requests from this IP, please try again later.',
+  standardHeaders: true,
+  legacyHeaders: false,
+  skip: (req: express.Request) => {
+    const server = servers.get(req.params.id ?? req.body?.serverId);
+    return server !== undefined && fromNode(req, server);
+  },
 });
 
 const strictLimiter = rateLimit({
@@ -152,91 +365,1884 @@ const strictLimiter = rateLimit({
 
 app.use(limiter);
 app.use(express.json({ limit: '10mb' }));
+// Identity providers send SCIM requests as application/scim+json
+app.use('/scim', express.json({ type: 'application/scim+json' }));
+
+// Audit log actor for admin API requests
+function adminActor(req: express.Request, res: express.Response): string {
+  const admin = res.locals.admin as AdminToken | undefined;
+  return `${admin ? admin.name : 'unknown'}@${req.ip}`;
+}
+
+// Admin endpoints require a token from ADMIN_TOKENS (or ADMIN_TOKEN) with at
+// least the given role, and are disabled when none is set. Once a token's
+// own TOTP is enrolled, its operator and admin requests also need a step-up
+// session in X-Step-Up (from POST /admin/totp/session), or X-TOTP-Code or
+// X-Recovery-Code for a single request. Viewer tokens are left alone so
+// dashboards keep working. Routes that set up the second factor itself pass
+// stepUp false.
+const requireRole = (role: Role, stepUp = true) => (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  if (!adminApiEnabled()) {
+    return res.status(503).json({ error: 'Admin API disabled' });
+  }
+
+  const authHeader = req.headers.authorization;
+  if (!authHeader || !authHeader.startsWith('Bearer ')) {
+    return res.status(401).json({ error: 'Missing or invalid authorization header' });
+  }
+
+  const admin = findAdminToken(authHeader.substring(7));
+  if (!admin) {
+    recordAudit('admin.auth_failed', adminActor(req, res), { reason: 'invalid token', path: req.path });
+    return res.status(403).json({ error: 'Invalid authentication token' });
+  }
+  res.locals.admin = admin;
+
+  if (!roleAllows(admin.role, role)) {
+    recordAudit('admin.access_denied', adminActor(req, res), { role: admin.role, required: role, path: req.path });
+    return res.status(403).json({ error: `Requires ${role} role` });
+  }
+
+  if (stepUp && totpEnabled(admin.name) && roleAllows(admin.role, 'operator')) {
+    const session = req.header('X-Step-Up');
+    if (session !== undefined) {
+      if (!stepUpSessionValid(admin.name, session)) {
+        return res.status(401).json({ error: 'Step-up session expired or invalid' });
+      }
+      return next();
+    }
+    if (!checkSecondFactor(req, res, admin)) return;
+  }
+
+  next();
+};
+
+// Checks the X-TOTP-Code or X-Recovery-Code of a request whose token has TOTP
+// enrolled, answering it when they're missing or wrong
+function checkSecondFactor(req: express.Request, res: express.Response, admin: AdminToken): boolean {
+  const totpCode = req.header('X-TOTP-Code');
+  const recoveryCode = req.header('X-Recovery-Code');
+  if (totpCode === undefined && recoveryCode === undefined) {
+    res.status(401).json({ error: 'TOTP code or step-up session required' });
+    return false;
+  }
+  if (!verifySecondFactor(admin.name, totpCode, recoveryCode)) {
+    recordAudit('admin.auth_failed', adminActor(req, res), { reason: 'invalid second factor', path: req.path });
+    res.status(403).json({ error: 'Invalid TOTP or recovery code' });
+    return false;
+  }
+  if (totpCode === undefined) {
+    recordAudit('admin.recovery_code_used', adminActor(req, res), { path: req.path });
+  }
+  return true;
+}
+
+// Whether a user is locked out, by their org's identity provider or by the
+// fleet configuration
+function userSuspended(user: string): boolean {
+  return userLockedOut(user) || fleetUserSuspended(user);
+}
+
+// Tags a server registered with plus those declared for it
+function serverTags(server: Server): string[] {
+  const declared = declaredNodeTags(server.id);
+  return declared.length > 0 ? Array.from(new Set([...server.tags, ...declared])) : server.tags;
+}
+
+// The user a bearer credential belongs to: one of their API keys, an ID
+// token from the identity provider, or the token of their dedicated IP
+// reservation. Returns why it isn't valid otherwise.
+async function userForCredential(credential: string): Promise<string | { error: string }> {
+  if (credential.startsWith(API_KEY_PREFIX)) {
+    const key = verifyApiKey(credential);
+    return typeof key === 'string' ? { error: key } : key.user;
+  }
+  if (idTokensEnabled() && looksLikeIdToken(credential)) {
+    const token = await verifyIdToken(credential);
+    return typeof token === 'string' ? { error: token } : token.subject;
+  }
+  const reservation = findReservation(credential);
+  return reservation ? reservation.user : { error: 'Invalid reservation token' };
+}
+
+// User endpoints authenticate with an API key, an ID token or a reservation
+// token. The user's reservation, if they have one, is kept alongside for
+// endpoints that act on the reserved server.
+const authenticateUser = async (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  const authHeader = req.headers.authorization;
+  if (!authHeader || !authHeader.startsWith('Bearer ')) {
+    return res.status(401).json({ error: 'Missing or invalid authorization header' });
+  }
+
+  const user = await userForCredential(authHeader.substring(7));
+  if (typeof user !== 'string') {
+    return res.status(403).json(user);
+  }
+  if (userSuspended(user)) {
+    return res.status(403).json({ error: 'User has been suspended' });
+  }
+
+  res.locals.user = user;
+  res.locals.reservation = findReservationByUser(user);
+  next();
+};
+
+// The user behind an optional credential in the Authorization header, for
+// endpoints that serve anonymous callers too
+async function requestingUser(req: express.Request): Promise<string | undefined> {
+  const authHeader = req.headers.authorization;
+  if (!authHeader || !authHeader.startsWith('Bearer ')) return undefined;
+  const user = await userForCredential(authHeader.substring(7));
+  return typeof user === 'string' && !userSuspended(user) ? user : undefined;
+}
+
+function privateNodeView(node: PrivateNode) {
+  const server = servers.get(node.serverId);
+  return {
+    serverId: node.serverId,
+    name: node.name,
+    createdAt: node.createdAt,
+    online: server !== undefined,
+    location: server?.location,
+    url: server?.url
+  };
+}
+
+function deviceView(device: Device) {
+  return {
+    deviceId: device.deviceId,
+    name: device.name,
+    firstSeen: device.firstSeen,
+    lastSeen: device.lastSeen,
+    revoked: device.revokedAt !== null,
+    revokedAt: device.revokedAt
+  };
+}
+
+function apiKeyView(key: ApiKey) {
+  return {
+    id: key.id,
+    user: key.user,
+    name: key.name,
+    createdAt: key.createdAt,
+    expiresAt: key.expiresAt,
+    revoked: key.revokedAt !== null,
+    revokedAt: key.revokedAt
+  };
+}
+
+function validEndpoint(endpoint: unknown): boolean {
+  if (typeof endpoint !== 'string' || !/^(tls|quic):\/\//.test(endpoint) || endpoint.length > 300) {
+    return false;
+  }
+  try {
+    const parsed = new URL(endpoint);
+    return parsed.hostname.length > 0 && parsed.port.length > 0;
+  } catch {
+    return false;
+  }
+}
 
 // Get server list (for routing server)
 app.get('/list', (req, res) => {
-  const serverList = Array.from(servers.values()).map(server => ({
+  const serverList = Array.from(servers.values()).filter(server => !findPrivateNode(server.id)).map(server => ({
     location: server.location,
-    url: server.url
+    url: server.url,
+    endpoints: server.endpoints,
+    e2eKey: server.e2eKey
   }));
   res.json(serverList);
 });
 
-// Register a new VPN server
-app.post('/register', strictLimiter, async (req, res) => {
-  const { id, location, url } = req.body;
+// Public servers with when they registered and were last seen
+app.get('/servers', (req, res) => {
+  const serverList = Array.from(servers.values()).filter(server => !findPrivateNode(server.id)).map(server => ({
+    id: server.id,
+    location: server.location,
+    url: server.url,
+    tags: server.tags,
+    endpoints: server.endpoints,
+    e2eKey: server.e2eKey,
+    registeredAt: server.registeredAt,
+    lastSeen: server.lastSeen
+  }));
+  res.json(serverList);
+});
 
-  // Input validation
-  if (!id || !location || !url) {
-    return res.status(400).json({ error: 'Missing required fields: id, location, url' });
+// Whether a server from a cached list is still there: 200 with its details,
+// 410 if it was removed recently, 404 if it is unknown
+app.get('/servers/:id', (req, res) => {
+  const server = servers.get(req.params.id);
+  if (server && !findPrivateNode(server.id)) {
+    return res.json({ id: server.id, location: server.location, url: server.url, endpoints: server.endpoints, e2eKey: server.e2eKey });
+  }
+  const tombstone = server ? undefined : findTombstone(req.params.id);
+  if (tombstone) {
+    return res.status(410).json(goneResponse(tombstone, 'servers'));
+  }
+  res.status(404).json({ error: 'Unknown server' });
+});
+
+// Pick a server for a client location. Clients rotating their exit IP pass
+// the IDs or URLs of servers they want to move away from in `exclude`.
+// Callers sending their API key or reservation token as a bearer token may
+// also be routed to their own private nodes, or only to those with
+// `privateOnly`.
+app.post('/route', async (req, res) => {
+  const endTimer = routeLatency.startTimer();
+  const { location, dedicatedIp, allowFallback, privateOnly, serverId } = req.body;
+  const user = await requestingUser(req);
+  const exclude = req.body.exclude ?? [];
+
+  // Users with a dedicated IP reservation always get their pinned server
+  let fallbackReason: string | undefined;
+  if (dedicatedIp !== undefined) {
+    const reservation = typeof dedicatedIp === 'string' ? findReservation(dedicatedIp) : undefined;
+    if (!reservation) {
+      endTimer();
+      routeRequests.inc({ result: 'invalid' });
+      return res.status(403).json({ error: 'Invalid dedicated IP token' });
+    }
+    if (userSuspended(reservation.user)) {
+      endTimer();
+      routeRequests.inc({ result: 'suspended' });
+      return res.status(403).json({ error: 'User has been suspended' });
+    }
+
+    // A drained node or one in maintenance counts as unavailable
+    const pinned = servers.get(reservation.serverId);
+    if (pinned && nodeInService(pinned.id, serverTags(pinned))) {
+      endTimer();
+      routeRequests.inc({ result: 'dedicated' });
+      return res.json({ id: pinned.id, location: pinned.location, url: pinned.url, endpoints: pinned.endpoints, e2eKey: pinned.e2eKey, egressIp: reservation.egressIp, dedicated: true, candidates: [routeCandidate(pinned)] });
+    }
+
+    if (allowFallback !== true) {
+      endTimer();
+      routeRequests.inc({ result: 'dedicated_unavailable' });
+      return res.status(409).json({ error: 'Reserved server is unavailable', serverId: reservation.serverId });
+    }
+    fallbackReason = 'Reserved server is unavailable';
   }
 
-  // Validate ID format (alphanumeric, dash, underscore only)
-  if (!/^[a-zA-Z0-9_-]+$/.test(id)) {
-    return res.status(400).json({ error: 'Invalid server ID format' });
+  // A particular server, e.g. from a client's per-connection routing hint
+  if (serverId !== undefined && !fallbackReason) {
+    if (typeof serverId !== 'string' || serverId.length === 0 || serverId.length > 100) {
+      endTimer();
+      routeRequests.inc({ result: 'invalid' });
+      return res.status(400).json({ error: 'Invalid serverId' });
+    }
+    const server = servers.get(serverId);
+    endTimer();
+    const tombstone = server ? undefined : findTombstone(serverId);
+    if (tombstone) {
+      routeRequests.inc({ result: 'gone' });
+      return res.status(410).json(goneResponse(tombstone, 'route'));
+    }
+    if (!server || !canUseServer(server.id, user) || !nodeInService(server.id, serverTags(server))) {
+      routeRequests.inc({ result: 'no_server' });
+      return res.status(404).json({ error: 'Server not available' });
+    }
+    routeRequests.inc({ result: 'ok' });
+    return res.json({ id: server.id, location: server.location, url: server.url, endpoints: server.endpoints, e2eKey: server.e2eKey, private: findPrivateNode(server.id) !== undefined, candidates: [routeCandidate(server)] });
   }
 
-  // Validate location
   if (typeof location !== 'string' || location.length === 0 || location.length > 100) {
+    endTimer();
+    routeRequests.inc({ result: 'invalid' });
     return res.status(400).json({ error: 'Invalid location' });
   }
 
-  // Validate URL format
-  if (!url.startsWith('wss://') && !url.startsWith('ws://')) {
-    return res.status(400).json({ error: 'Invalid URL: must use ws:// or wss:// protocol' });
+  if (!Array.isArray(exclude) || exclude.length > 20 || !exclude.every(e => typeof e === 'string')) {
+    endTimer();
+    routeRequests.inc({ result: 'invalid' });
+    return res.status(400).json({ error: 'Invalid exclude list' });
+  }
+
+  const wanted = location.toLowerCase();
+  const candidates = Array.from(servers.values()).filter(server =>
+    server.location.toLowerCase() === wanted && !exclude.includes(server.id) && !exclude.includes(server.url) &&
+    canUseServer(server.id, user) && (privateOnly !== true || findPrivateNode(server.id) !== undefined) &&
+    nodeInService(server.id, serverTags(server)));
+
+  const ranked = rankServers(candidates, cohortForClient(req.ip || 'unknown'), 1 + ROUTE_FALLBACKS);
+  const server = ranked[0];
+  endTimer();
+
+  if (!server) {
+    routeRequests.inc({ result: 'no_server' });
+    return res.status(404).json({ error: 'No server available for location' });
+  }
+
+  routeRequests.inc({ result: 'ok' });
+  const isPrivate = findPrivateNode(server.id) !== undefined;
+  const candidateList = ranked.map(routeCandidate);
+  if (fallbackReason) {
+    return res.json({ id: server.id, location: server.location, url: server.url, endpoints: server.endpoints, e2eKey: server.e2eKey, private: isPrivate, dedicated: false, reason: fallbackReason, candidates: candidateList });
+  }
+  res.json({ id: server.id, location: server.location, url: server.url, endpoints: server.endpoints, e2eKey: server.e2eKey, private: isPrivate, candidates: candidateList });
+});
+
+// Up to count servers in the order a client should try them. New tunnels
+// stay off nodes whose hosts are saturated, unless all are, and the
+// client's cohort goes to its own servers when the location has any; each
+// group is in random order weighted by quality.
+function rankServers(candidates: Server[], cohort: Cohort, count: number): Server[] {
+  const unsaturated = (server: Server) => !hostSaturated(server.id);
+  const ownCohort = (server: Server) => cohortOfTags(serverTags(server)) === cohort;
+  const groups = [
+    candidates.filter(s => unsaturated(s) && ownCohort(s)),
+    candidates.filter(s => unsaturated(s) && !ownCohort(s)),
+    candidates.filter(s => !unsaturated(s) && ownCohort(s)),
+    candidates.filter(s => !unsaturated(s) && !ownCohort(s))
+  ];
+  const ranked: Server[] = [];
+  for (const group of groups) {
+    while (group.length > 0 && ranked.length < count) {
+      const server = pickWeighted(group) as Server;
+      ranked.push(server);
+      group.splice(group.indexOf(server), 1);
+    }
+  }
+  return ranked;
+}
+
+// A server as /route lists it among the candidates: where to connect, over
+// which transports, and the key to pin for end-to-end encryption
+function routeCandidate(server: Server) {
+  return { id: server.id, location: server.location, url: server.url, endpoints: server.endpoints, e2eKey: server.e2eKey };
+}
+
+// Anonymous connection quality reports from clients, used to weight routing
+app.post('/telemetry', (req, res) => {
+  const { url, connectMs, throughputKbps } = req.body;
+
+  if (typeof url !== 'string' || typeof connectMs !== 'number') {
+    return res.status(400).json({ error: 'Missing required fields: url, connectMs' });
+  }
+  if (!Number.isFinite(connectMs) || connectMs < 0 || connectMs > 60000) {
+    return res.status(400).json({ error: 'Invalid connectMs' });
+  }
+  if (throughputKbps !== undefined &&
+      (typeof throughputKbps !== 'number' || !Number.isFinite(throughputKbps) || throughputKbps < 0 || throughputKbps > 10_000_000)) {
+    return res.status(400).json({ error: 'Invalid throughputKbps' });
+  }
+
+  // Only accept samples for servers we know about
+  const server = Array.from(servers.values()).find(server => server.url === url);
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+
+  recordSample(url, { connectMs, throughputKbps });
+  recordCohortSample(cohortOfTags(serverTags(server)), connectMs, throughputKbps);
+  telemetrySamples.inc();
+  res.json({ status: 'recorded' });
+});
+
+// TOTP enrollment for the calling token (operator). Each token enrolls its
+// own secret; once confirmed it's needed for that token's requests only.
+app.post('/admin/totp', strictLimiter, requireRole('operator', false), (req, res) => {
+  const admin = res.locals.admin as AdminToken;
+  if (totpEnabled(admin.name)) {
+    return res.status(409).json({ error: 'TOTP already enrolled' });
+  }
+  // Recovery codes are only shown here; just their hashes are stored
+  res.json(beginEnrollment(admin.name));
+});
+
+app.post('/admin/totp/confirm', strictLimiter, requireRole('operator', false), (req, res) => {
+  const admin = res.locals.admin as AdminToken;
+  const { code } = req.body;
+  if (typeof code !== 'string' || !confirmEnrollment(admin.name, code)) {
+    return res.status(400).json({ error: 'Invalid code or no pending enrollment' });
+  }
+  console.log(`TOTP enrolled for admin token ${admin.name}`);
+  recordAudit('totp.enrolled', adminActor(req, res));
+  res.json({ status: 'enrolled' });
+});
+
+// Exchanges a current TOTP (or recovery) code for a step-up session, so the
+// token's next requests don't each need a code
+app.post('/admin/totp/session', strictLimiter, requireRole('operator', false), (req, res) => {
+  const admin = res.locals.admin as AdminToken;
+  if (!totpEnabled(admin.name)) {
+    return res.status(409).json({ error: 'TOTP not enrolled' });
+  }
+  if (!checkSecondFactor(req, res, admin)) return;
+  recordAudit('totp.step_up', adminActor(req, res));
+  res.json(startStepUpSession(admin.name));
+});
+
+app.delete('/admin/totp', requireRole('operator'), (req, res) => {
+  const admin = res.locals.admin as AdminToken;
+  disableTotp(admin.name);
+  console.log(`TOTP disabled for admin token ${admin.name}`);
+  recordAudit('totp.disabled', adminActor(req, res));
+  res.json({ status: 'disabled' });
+});
+
+// Resets another token's TOTP, e.g. after a lost device (admin)
+app.delete('/admin/totp/:name', requireRole('admin'), (req, res) => {
+  if (!disableTotp(req.params.name)) {
+    return res.status(404).json({ error: 'TOTP not enrolled' });
+  }
+  console.log(`TOTP reset for admin token ${req.params.name}`);
+  recordAudit('totp.reset', adminActor(req, res), { credential: req.params.name });
+  res.json({ status: 'disabled' });
+});
+
+// Audit log export (admin). Pages with ?since=<seq>; /audit/verify checks
+// the hash chain end to end.
+app.get('/audit', requireRole('admin'), (req, res) => {
+  const since = parseInt(String(req.query.since ?? '0'), 10);
+  const limit = parseInt(String(req.query.limit ?? '1000'), 10);
+  if (isNaN(since) || since < 0 || isNaN(limit) || limit < 1 || limit > 10000) {
+    return res.status(400).json({ error: 'Invalid since or limit' });
   }
+  exportAudit(since, limit, (err, entries) => {
+    if (err) {
+      console.error('Error exporting audit log:', err);
+      return res.status(500).json({ error: 'Internal server error' });
+    }
+    res.json({ entries, next: entries.length > 0 ? entries[entries.length - 1].seq : since });
+  });
+});
+
+app.get('/audit/verify', requireRole('admin'), (req, res) => {
+  verifyAudit((err, result) => {
+    if (err) {
+      console.error('Error verifying audit log:', err);
+      return res.status(500).json({ error: 'Internal server error' });
+    }
+    res.json({ ...result, valid: result.brokenAt === null });
+  });
+});
 
+// Runs the object storage export now rather than waiting for the next
+// interval (admin)
+app.post('/exports/run', requireRole('admin'), async (req, res) => {
+  if (!exportsEnabled()) {
+    return res.status(404).json({ error: 'Exports are not configured' });
+  }
   try {
-    new URL(url);
-  } catch {
-    return res.status(400).json({ error: 'Invalid URL format' });
+    const keys = await runExport();
+    recordAudit('exports.run', adminActor(req, res), { objects: keys.length });
+    res.json({ keys });
+  } catch (err: any) {
+    console.error('Export failed:', err.message);
+    res.status(502).json({ error: 'Export failed' });
   }
+});
 
-  // Check for duplicate server ID
-  if (servers.has(id)) {
-    return res.status(409).json({ error: 'Server ID already exists' });
+// Latest synthetic probe through each node, and a way to probe now
+app.get('/synthetic', requireRole('viewer'), (req, res) => {
+  if (!syntheticEnabled()) {
+    return res.status(404).json({ error: 'Synthetic probes are not configured' });
   }
+  res.json(syntheticResults());
+});
 
-  // Generate secure server ID if not provided or override insecure ones
-  let secureId = id;
-  if (!id || id.length < 8) {
-    secureId = crypto.randomBytes(16).toString('hex');
+app.post('/synthetic/run', requireRole('operator'), async (req, res) => {
+  if (!syntheticEnabled()) {
+    return res.status(404).json({ error: 'Synthetic probes are not configured' });
   }
+  res.json(await runSyntheticProbes());
+});
 
-  const server: Server = {
-    id: secureId,
-    location,
-    url,
-    registeredAt: Date.now(),
-    lastSeen: Date.now()
+function orgView(org: Org) {
+  return {
+    id: org.id,
+    name: org.name,
+    maxSessions: org.maxSessions,
+    policy: org.policy,
+    policyVersion: org.policyUpdatedAt,
+    createdAt: org.createdAt,
+    members: membersOf(org.id)
   };
+}
 
-  servers.set(secureId, server);
-  saveServerToDB(server);
+function validOrgName(name: unknown): name is string {
+  return typeof name === 'string' && name.length > 0 && name.length <= 100;
+}
 
-  console.log(`Registered new server: ${secureId} at ${location} (${url})`);
+function validMaxSessions(n: unknown): n is number {
+  return typeof n === 'number' && Number.isInteger(n) && n >= 0 && n <= 100000;
+}
 
-  // Push updated server list to routing server
-  await pushServerListToRoutingServer();
+// Organizations (admin). Operators create orgs, set their limits and name
+// their first org admin; org admins take it from there.
+app.get('/orgs', requireRole('viewer'), (req, res) => {
+  res.json(listOrgs().map(orgView));
+});
+
+app.post('/orgs', strictLimiter, requireRole('operator'), (req, res) => {
+  const { name, admin } = req.body;
+  const maxSessions = req.body.maxSessions ?? 0;
+  if (!validOrgName(name)) {
+    return res.status(400).json({ error: 'Invalid name' });
+  }
+  if (!validMaxSessions(maxSessions)) {
+    return res.status(400).json({ error: 'Invalid maxSessions' });
+  }
+  if (admin !== undefined && (typeof admin !== 'string' || admin.length === 0 || admin.length > 200)) {
+    return res.status(400).json({ error: 'Invalid admin' });
+  }
+  if (admin !== undefined && orgForUser(admin)) {
+    return res.status(409).json({ error: 'User belongs to another organization' });
+  }
 
-  res.json({ status: 'registered', serverId: secureId });
+  const org = createOrg(name, maxSessions);
+  if (admin !== undefined) setMember(org.id, admin, 'admin');
+  recordAudit('org.created', adminActor(req, res), { orgId: org.id, name, maxSessions, admin });
+  res.json(orgView(org));
 });
 
-// Health check endpoint for the sync server itself
-app.get('/health', (req, res) => {
-  res.send('OK');
+app.patch('/orgs/:id', requireRole('operator'), (req, res) => {
+  const { name, maxSessions } = req.body;
+  if (name !== undefined && !validOrgName(name)) {
+    return res.status(400).json({ error: 'Invalid name' });
+  }
+  if (maxSessions !== undefined && !validMaxSessions(maxSessions)) {
+    return res.status(400).json({ error: 'Invalid maxSessions' });
+  }
+  const org = updateOrg(req.params.id, { name, maxSessions });
+  if (!org) {
+    return res.status(404).json({ error: 'Organization not found' });
+  }
+  recordAudit('org.updated', adminActor(req, res), { orgId: org.id, name, maxSessions });
+  res.json(orgView(org));
 });
 
-const PORT = parseInt(process.env.PORT || '3001');
-const USE_HTTPS = process.env.USE_HTTPS === 'true';
-const SSL_KEY_PATH = process.env.SSL_KEY_PATH || './ssl/key.pem';
-const SSL_CERT_PATH = process.env.SSL_CERT_PATH || './ssl/cert.pem';
+app.delete('/orgs/:id', requireRole('operator'), (req, res) => {
+  if (!deleteOrg(req.params.id)) {
+    return res.status(404).json({ error: 'Organization not found' });
+  }
+  deleteConfigBundle(orgScope(req.params.id));
+  recordAudit('org.deleted', adminActor(req, res), { orgId: req.params.id });
+  res.json({ status: 'deleted' });
+});
 
-async function startServer() {
-  loadServersFromDB();
+// The caller's organization, for its admins
+const authenticateOrgAdmin = (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  const user = res.locals.user as string;
+  const membership = orgForUser(user);
+  if (!membership || membership.role !== 'admin') {
+    return res.status(403).json({ error: 'Not an organization admin' });
+  }
+  res.locals.org = membership.org;
+  next();
+};
 
-  // Start health checking every 5 minutes
-  setInterval(healthCheck, 5 * 60 * 1000);
+app.get('/org', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  res.json(orgView(res.locals.org as Org));
+});
+
+app.put('/org/policy', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const policy = parsePolicy(req.body);
+  if (typeof policy === 'string') {
+    return res.status(400).json({ error: policy });
+  }
+  setOrgPolicy(org.id, policy);
+  recordAudit('org.policy_updated', `user:${user}`, { orgId: org.id, policy });
+  res.json(orgView(org));
+});
+
+app.get('/org/acls', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  res.json((res.locals.org as Org).acls);
+});
+
+app.put('/org/acls', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const acls = parseAcls(req.body);
+  if (typeof acls === 'string') {
+    return res.status(400).json({ error: acls });
+  }
+  setOrgAcls(org.id, acls);
+  recordAudit('org.acls_updated', `user:${user}`, { orgId: org.id, rules: acls.length });
+  res.json(acls);
+});
+
+app.get('/org/parental-controls', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  res.json((res.locals.org as Org).parentalControls);
+});
+
+app.put('/org/parental-controls', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const profiles = parseParentalProfiles(req.body, true);
+  if (typeof profiles === 'string') {
+    return res.status(400).json({ error: profiles });
+  }
+  setOrgParentalControls(org.id, profiles);
+  recordAudit('org.parental_controls_updated', `user:${user}`, {
+    orgId: org.id,
+    profiles: profiles.map(p => p.name)
+  });
+  res.json(profiles);
+});
+
+app.post('/org/members', strictLimiter, authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const caller = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const { user } = req.body;
+  const role = req.body.role ?? 'member';
+  if (typeof user !== 'string' || user.length === 0 || user.length > 200) {
+    return res.status(400).json({ error: 'Invalid user' });
+  }
+  if (!validOrgRole(role)) {
+    return res.status(400).json({ error: 'Invalid role: must be member or admin' });
+  }
+  const error = setMember(org.id, user, role);
+  if (error) {
+    return res.status(409).json({ error });
+  }
+  recordAudit('org.member_set', `user:${caller}`, { orgId: org.id, user, role });
+  res.json(orgView(org));
+});
+
+app.delete('/org/members/:user', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  if (!removeMember(org.id, req.params.user)) {
+    return res.status(404).json({ error: 'Member not found' });
+  }
+  recordAudit('org.member_removed', `user:${user}`, { orgId: org.id, user: req.params.user });
+  res.json(orgView(org));
+});
+
+// The org's SCIM bearer token, for its identity provider. Issuing a new one
+// replaces the old.
+app.post('/org/scim-token', strictLimiter, authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const token = createScimToken(org.id);
+  recordAudit('token.issued', `user:${user}`, { kind: 'scim', orgId: org.id });
+  res.json({ token });
+});
+
+app.delete('/org/scim-token', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  if (!deleteScimToken(org.id)) {
+    return res.status(404).json({ error: 'No SCIM token' });
+  }
+  recordAudit('token.revoked', `user:${user}`, { kind: 'scim', orgId: org.id });
+  res.json({ status: 'deleted' });
+});
+
+// The policy members' clients apply; 404 for users outside any org
+app.get('/org/policy', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  const membership = orgForUser(user);
+  if (!membership) {
+    return res.status(404).json({ error: 'Not in an organization' });
+  }
+  res.json({ orgId: membership.org.id, name: membership.org.name, policy: membership.org.policy, version: membership.org.policyUpdatedAt });
+});
+
+// Client configuration bundles. Operators manage the global bundle and any
+// org's; org admins manage their own org's through /org/config.
+const MAX_CONFIG_WAIT_SECONDS = 240;
+
+function configBundleView(bundle: ConfigBundle) {
+  return {
+    scope: bundle.scope,
+    version: bundle.version,
+    config: bundle.config,
+    updatedBy: bundle.updatedBy,
+    updatedAt: bundle.updatedAt
+  };
+}
+
+// 'global' or 'org:<id>' for an existing org
+function validConfigScope(scope: string): boolean {
+  return scope === 'global' || (scope.startsWith('org:') && findOrg(scope.substring(4)) !== undefined);
+}
+
+app.get('/config-bundles', requireRole('viewer'), (req, res) => {
+  res.json(listConfigBundles().map(configBundleView));
+});
+
+app.get('/config-bundles/:scope', requireRole('viewer'), (req, res) => {
+  const bundle = findConfigBundle(req.params.scope);
+  if (!bundle) {
+    return res.status(404).json({ error: 'Config bundle not found' });
+  }
+  res.json(configBundleView(bundle));
+});
+
+app.put('/config-bundles/:scope', requireRole('operator'), (req, res) => {
+  const { scope } = req.params;
+  if (!validConfigScope(scope)) {
+    return res.status(400).json({ error: 'Scope must be global or org:<organization ID>' });
+  }
+  const config = parseClientConfig(req.body);
+  if (typeof config === 'string') {
+    return res.status(400).json({ error: config });
+  }
+  const { bundle, changed } = putConfigBundle(scope, config, adminActor(req, res));
+  if (changed) {
+    recordAudit('config.bundle_updated', adminActor(req, res), { scope, version: bundle.version });
+  }
+  res.json(configBundleView(bundle));
+});
+
+app.delete('/config-bundles/:scope', requireRole('operator'), (req, res) => {
+  if (!deleteConfigBundle(req.params.scope)) {
+    return res.status(404).json({ error: 'Config bundle not found' });
+  }
+  recordAudit('config.bundle_deleted', adminActor(req, res), { scope: req.params.scope });
+  res.json({ status: 'deleted' });
+});
+
+// The operator announcement, if any; nodes poll this and pass it on to
+// their clients
+app.get('/announcement', (req, res) => {
+  const announcement = currentAnnouncement();
+  res.json({ announcement: announcement ? announcementView(announcement) : null });
+});
+
+app.put('/announcement', requireRole('operator'), (req, res) => {
+  const parsed = parseAnnouncement(req.body);
+  if (typeof parsed === 'string') {
+    return res.status(400).json({ error: parsed });
+  }
+  const announcement = putAnnouncement(parsed, adminActor(req, res));
+  recordAudit('announcement.updated', adminActor(req, res), { severity: announcement.severity, expiresAt: announcement.expiresAt });
+  res.json(announcement);
+});
+
+app.delete('/announcement', requireRole('operator'), (req, res) => {
+  if (!deleteAnnouncement()) {
+    return res.status(404).json({ error: 'No announcement' });
+  }
+  recordAudit('announcement.deleted', adminActor(req, res));
+  res.json({ status: 'deleted' });
+});
+
+// The operator's signed transparency statement; see transparency.ts
+app.get('/transparency', (req, res) => {
+  const statement = currentTransparencyStatement();
+  if (!statement) {
+    return res.status(404).json({ error: 'No transparency statement' });
+  }
+  const signed = signedTransparencyStatement(statement);
+  if (!signed) {
+    return res.status(503).json({ error: 'Transparency key not loaded' });
+  }
+  res.json(signed);
+});
+
+app.put('/transparency', requireRole('admin'), (req, res) => {
+  const parsed = parseTransparencyStatement(req.body);
+  if (typeof parsed === 'string') {
+    return res.status(400).json({ error: parsed });
+  }
+  const statement = putTransparencyStatement(parsed, adminActor(req, res));
+  recordAudit('transparency.updated', adminActor(req, res), { sequence: statement.sequence, nextUpdate: statement.nextUpdate });
+  res.json({ sequence: statement.sequence, issuedAt: statement.issuedAt, nextUpdate: statement.nextUpdate });
+});
+
+app.post('/transparency/keys/rotate', requireRole('admin'), (req, res) => {
+  const rotated = rotateTransparencyKey();
+  if (!rotated) {
+    return res.status(503).json({ error: 'Transparency key not loaded' });
+  }
+  recordAudit('transparency.key_rotated', adminActor(req, res), { keyId: rotated.id, previous: rotated.previous });
+  res.json({ keyId: rotated.id, publicKey: rotated.publicKey });
+});
+
+app.get('/org/config', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const bundle = findConfigBundle(orgScope((res.locals.org as Org).id));
+  if (!bundle) {
+    return res.status(404).json({ error: 'Config bundle not found' });
+  }
+  res.json(configBundleView(bundle));
+});
+
+app.put('/org/config', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const org = res.locals.org as Org;
+  const config = parseClientConfig(req.body);
+  if (typeof config === 'string') {
+    return res.status(400).json({ error: config });
+  }
+  const { bundle, changed } = putConfigBundle(orgScope(org.id), config, `user:${user}`);
+  if (changed) {
+    recordAudit('config.bundle_updated', `user:${user}`, { scope: bundle.scope, version: bundle.version });
+  }
+  res.json(configBundleView(bundle));
+});
+
+app.delete('/org/config', authenticateUser, authenticateOrgAdmin, (req, res) => {
+  const user = res.locals.user as string;
+  const scope = orgScope((res.locals.org as Org).id);
+  if (!deleteConfigBundle(scope)) {
+    return res.status(404).json({ error: 'Config bundle not found' });
+  }
+  recordAudit('config.bundle_deleted', `user:${user}`, { scope });
+  res.json({ status: 'deleted' });
+});
+
+// The signed bundle for the caller: their org's if it has one, otherwise the
+// global one. Clients send the ETag they hold as If-None-Match; with ?wait=N
+// the request is held for up to N seconds until the bundle changes.
+app.get('/client-config', async (req, res) => {
+  const user = await requestingUser(req);
+  const current = () => configBundleFor(user !== undefined ? orgForUser(user)?.org.id : undefined);
+  const held = req.header('If-None-Match');
+  const wait = Math.min(parseInt(String(req.query.wait ?? '0'), 10) || 0, MAX_CONFIG_WAIT_SECONDS);
+
+  let bundle = current();
+  const deadline = Date.now() + wait * 1000;
+  while (held !== undefined && bundle && configBundleETag(bundle) === held && Date.now() < deadline) {
+    await waitForConfigChange(deadline - Date.now());
+    bundle = current();
+  }
+  if (!bundle) {
+    return res.status(404).json({ error: 'No client configuration' });
+  }
+  res.setHeader('ETag', configBundleETag(bundle));
+  if (configBundleETag(bundle) === held) {
+    return res.status(304).end();
+  }
+  res.json(signedConfigBundle(bundle));
+});
+
+// SCIM 2.0 user provisioning (RFC 7644), authenticated with the org's SCIM
+// token. Only the User resource is supported; userName is the horseVPN user.
+const SCIM_USER_SCHEMA = 'urn:ietf:params:scim:schemas:core:2.0:User';
+
+function scimError(res: express.Response, status: number, detail: string) {
+  res.status(status).type('application/scim+json').json({
+    schemas: ['urn:ietf:params:scim:api:messages:2.0:Error'],
+    status: String(status),
+    detail
+  });
+}
+
+function scimUserView(user: ScimUser) {
+  return {
+    schemas: [SCIM_USER_SCHEMA],
+    id: user.id,
+    externalId: user.externalId ?? undefined,
+    userName: user.userName,
+    active: user.active,
+    meta: {
+      resourceType: 'User',
+      created: new Date(user.createdAt).toISOString(),
+      lastModified: new Date(user.updatedAt).toISOString(),
+      location: `/scim/v2/Users/${user.id}`
+    }
+  };
+}
+
+// Some identity providers send booleans as "True"/"False"
+function scimBoolean(value: unknown): boolean | undefined {
+  if (typeof value === 'boolean') return value;
+  if (typeof value === 'string' && /^(true|false)$/i.test(value)) return value.toLowerCase() === 'true';
+  return undefined;
+}
+
+function validScimExternalId(value: unknown): value is string | null | undefined {
+  return value === undefined || value === null || (typeof value === 'string' && value.length <= 200);
+}
+
+const authenticateScim = (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  const authHeader = req.headers.authorization;
+  const orgId = authHeader && authHeader.startsWith('Bearer ') ? orgForScimToken(authHeader.substring(7)) : undefined;
+  if (!orgId) {
+    return scimError(res, 401, 'Invalid SCIM token');
+  }
+  res.locals.orgId = orgId;
+  next();
+};
+
+const findScimUserParam = (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  const user = findScimUser(res.locals.orgId, req.params.id);
+  if (!user) {
+    return scimError(res, 404, 'User not found');
+  }
+  res.locals.scimUser = user;
+  next();
+};
+
+// Applies a suspension or reactivation to the user's org membership and
+// records it
+function scimActiveChanged(user: ScimUser, req: express.Request) {
+  if (user.active && !orgForUser(user.userName)) {
+    setMember(user.orgId, user.userName, 'member');
+  }
+  recordAudit(user.active ? 'scim.user_activated' : 'scim.user_suspended', `scim:${user.orgId}@${req.ip}`,
+    { orgId: user.orgId, user: user.userName });
+}
+
+app.get('/scim/v2/Users', authenticateScim, (req, res) => {
+  let list = scimUsersForOrg(res.locals.orgId);
+  // Identity providers look users up with filter=userName eq "name"
+  if (typeof req.query.filter === 'string') {
+    const match = /^\s*userName\s+eq\s+"([^"]*)"\s*$/i.exec(req.query.filter);
+    if (!match) {
+      return scimError(res, 400, 'Only userName eq filters are supported');
+    }
+    list = list.filter(u => u.userName === match[1]);
+  }
+  const startIndex = Math.max(1, parseInt(String(req.query.startIndex ?? '1'), 10) || 1);
+  const count = Math.max(0, Math.min(1000, parseInt(String(req.query.count ?? '100'), 10) || 0));
+  const page = list.slice(startIndex - 1, startIndex - 1 + count);
+  res.type('application/scim+json').json({
+    schemas: ['urn:ietf:params:scim:api:messages:2.0:ListResponse'],
+    totalResults: list.length,
+    startIndex,
+    itemsPerPage: page.length,
+    Resources: page.map(scimUserView)
+  });
+});
+
+app.get('/scim/v2/Users/:id', authenticateScim, findScimUserParam, (req, res) => {
+  res.type('application/scim+json').json(scimUserView(res.locals.scimUser));
+});
+
+app.post('/scim/v2/Users', authenticateScim, (req, res) => {
+  const orgId = res.locals.orgId as string;
+  const { userName, externalId } = req.body;
+  const active = req.body.active === undefined ? true : scimBoolean(req.body.active);
+  if (typeof userName !== 'string' || userName.length === 0 || userName.length > 200) {
+    return scimError(res, 400, 'Invalid userName');
+  }
+  if (active === undefined || !validScimExternalId(externalId)) {
+    return scimError(res, 400, 'Invalid active or externalId');
+  }
+  const membership = orgForUser(userName);
+  if (membership && membership.org.id !== orgId) {
+    return scimError(res, 409, 'User belongs to another organization');
+  }
+
+  const user = provisionScimUser(orgId, userName, externalId ?? null, active);
+  if (typeof user === 'string') {
+    return scimError(res, 409, user);
+  }
+  if (!membership) setMember(orgId, userName, 'member');
+  recordAudit('scim.user_provisioned', `scim:${orgId}@${req.ip}`, { orgId, user: userName, active });
+  res.status(201).type('application/scim+json').json(scimUserView(user));
+});
+
+app.put('/scim/v2/Users/:id', authenticateScim, findScimUserParam, (req, res) => {
+  const user = res.locals.scimUser as ScimUser;
+  const { userName, externalId } = req.body;
+  const active = req.body.active === undefined ? true : scimBoolean(req.body.active);
+  if (userName !== undefined && userName !== user.userName) {
+    return scimError(res, 400, 'userName cannot be changed');
+  }
+  if (active === undefined || !validScimExternalId(externalId)) {
+    return scimError(res, 400, 'Invalid active or externalId');
+  }
+
+  const wasActive = user.active;
+  updateScimUser(user, { active, externalId: externalId ?? null });
+  if (user.active !== wasActive) scimActiveChanged(user, req);
+  res.type('application/scim+json').json(scimUserView(user));
+});
+
+app.patch('/scim/v2/Users/:id', authenticateScim, findScimUserParam, (req, res) => {
+  const user = res.locals.scimUser as ScimUser;
+  const operations = req.body.Operations;
+  if (!Array.isArray(operations)) {
+    return scimError(res, 400, 'Missing Operations');
+  }
+
+  // Operations either name a path or carry an object of attributes
+  const changes: { active?: boolean; externalId?: string | null } = {};
+  for (const op of operations) {
+    if (typeof op !== 'object' || op === null || !/^(add|replace)$/i.test(op.op)) {
+      return scimError(res, 400, 'Only add and replace operations are supported');
+    }
+    const attributes = typeof op.path === 'string' ? { [op.path]: op.value } : op.value;
+    if (typeof attributes !== 'object' || attributes === null) {
+      return scimError(res, 400, 'Invalid operation value');
+    }
+    for (const [path, value] of Object.entries(attributes)) {
+      if (path === 'active') {
+        const active = scimBoolean(value);
+        if (active === undefined) return scimError(res, 400, 'Invalid active');
+        changes.active = active;
+      } else if (path === 'externalId') {
+        if (!validScimExternalId(value)) return scimError(res, 400, 'Invalid externalId');
+        changes.externalId = value ?? null;
+      } else {
+        return scimError(res, 400, `Unsupported attribute: ${path}`);
+      }
+    }
+  }
+
+  const wasActive = user.active;
+  updateScimUser(user, changes);
+  if (user.active !== wasActive) scimActiveChanged(user, req);
+  res.type('application/scim+json').json(scimUserView(user));
+});
+
+app.delete('/scim/v2/Users/:id', authenticateScim, findScimUserParam, (req, res) => {
+  const user = res.locals.scimUser as ScimUser;
+  deprovisionScimUser(user);
+  removeMember(user.orgId, user.userName);
+  deleteReservation(user.userName);
+  deletePortForwardsForUser(user.userName);
+  recordAudit('scim.user_deprovisioned', `scim:${user.orgId}@${req.ip}`, { orgId: user.orgId, user: user.userName });
+  res.status(204).end();
+});
+
+// Declarative fleet configuration (admin). Resources are addressed by kind
+// and caller-chosen ID, and PUT is idempotent; see fleet.ts.
+function fleetView(resource: FleetResource) {
+  return {
+    kind: resource.kind,
+    id: resource.id,
+    tags: resource.tags,
+    spec: resource.spec,
+    version: resource.version,
+    createdAt: resource.createdAt,
+    updatedAt: resource.updatedAt
+  };
+}
+
+const validateFleetPath = (req: express.Request, res: express.Response, next: express.NextFunction) => {
+  if (!validFleetKind(req.params.kind)) {
+    return res.status(404).json({ error: 'Unknown resource kind' });
+  }
+  if (req.params.id !== undefined && !validFleetId(req.params.id)) {
+    return res.status(400).json({ error: 'Invalid ID' });
+  }
+  next();
+};
+
+app.get('/fleet/:kind', requireRole('viewer'), validateFleetPath, (req, res) => {
+  const tag = typeof req.query.tag === 'string' ? req.query.tag : undefined;
+  res.json(listFleet(req.params.kind as FleetKind, tag).map(fleetView));
+});
+
+app.get('/fleet/:kind/:id', requireRole('viewer'), validateFleetPath, (req, res) => {
+  const resource = findFleet(req.params.kind as FleetKind, req.params.id);
+  if (!resource) {
+    return res.status(404).json({ error: 'Resource not found' });
+  }
+  res.json(fleetView(resource));
+});
+
+app.put('/fleet/:kind/:id', requireRole('operator'), validateFleetPath, (req, res) => {
+  const kind = req.params.kind as FleetKind;
+  const id = req.params.id;
+  const parsed = parseFleetBody(kind, req.body);
+  if (typeof parsed === 'string') {
+    return res.status(400).json({ error: parsed });
+  }
+
+  // Check references before anything is stored
+  if (kind === 'policies' && !findOrg(id)) {
+    return res.status(404).json({ error: 'Organization not found' });
+  }
+  const previousUser = kind === 'users' ? findFleet<UserSpec>('users', id)?.spec : undefined;
+  if (kind === 'users') {
+    const spec = parsed.spec as UserSpec;
+    if (spec.orgId !== null && !findOrg(spec.orgId)) {
+      return res.status(404).json({ error: 'Organization not found' });
+    }
+    const membership = orgForUser(id);
+    if (spec.orgId !== null && membership && membership.org.id !== spec.orgId && membership.org.id !== previousUser?.orgId) {
+      return res.status(409).json({ error: 'User belongs to another organization' });
+    }
+  }
+
+  const { resource, changed } = putFleet(kind, id, parsed.tags, parsed.spec);
+  if (!changed) {
+    return res.json(fleetView(resource));
+  }
+
+  if (kind === 'policies') {
+    const spec = resource.spec as PolicySpec;
+    setOrgPolicy(id, spec.policy);
+    setOrgAcls(id, spec.acls);
+  } else if (kind === 'users') {
+    const spec = resource.spec as UserSpec;
+    if (previousUser?.orgId && previousUser.orgId !== spec.orgId) {
+      removeMember(previousUser.orgId, id);
+    }
+    if (spec.orgId !== null) {
+      setMember(spec.orgId, id, spec.orgRole);
+    }
+  }
+  recordAudit('fleet.updated', adminActor(req, res), { kind, id, version: resource.version, tags: resource.tags, spec: resource.spec });
+  res.json(fleetView(resource));
+});
+
+app.delete('/fleet/:kind/:id', requireRole('operator'), validateFleetPath, (req, res) => {
+  const kind = req.params.kind as FleetKind;
+  const resource = deleteFleet(kind, req.params.id);
+  if (!resource) {
+    return res.status(404).json({ error: 'Resource not found' });
+  }
+
+  // Undo what the resource applied; nodes and windows only live here
+  if (kind === 'policies' && findOrg(resource.id)) {
+    setOrgPolicy(resource.id, {});
+    setOrgAcls(resource.id, []);
+  } else if (kind === 'users') {
+    const spec = resource.spec as UserSpec;
+    if (spec.orgId !== null) removeMember(spec.orgId, resource.id);
+  }
+  recordAudit('fleet.deleted', adminActor(req, res), { kind, id: resource.id });
+  res.json({ status: 'deleted' });
+});
+
+// Dedicated IP reservations (admin)
+app.get('/reservations', requireRole('viewer'), (req, res) => {
+  res.json(listReservations().map(r => ({
+    user: r.user,
+    serverId: r.serverId,
+    egressIp: r.egressIp,
+    createdAt: r.createdAt,
+    available: servers.has(r.serverId)
+  })));
+});
+
+app.post('/reservations', strictLimiter, requireRole('operator'), (req, res) => {
+  const { user, serverId } = req.body;
+  const egressIp = req.body.egressIp ?? null;
+
+  if (typeof user !== 'string' || user.length === 0 || user.length > 100) {
+    return res.status(400).json({ error: 'Invalid user' });
+  }
+  if (typeof serverId !== 'string' || !servers.has(serverId)) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (egressIp !== null && (typeof egressIp !== 'string' || net.isIP(egressIp) === 0)) {
+    return res.status(400).json({ error: 'Invalid egress IP' });
+  }
+
+  const result = createReservation(user, serverId, egressIp);
+  if (typeof result === 'string') {
+    return res.status(409).json({ error: result });
+  }
+
+  console.log(`Reserved server ${serverId}${egressIp ? ` (${egressIp})` : ''} for ${user}`);
+  recordAudit('token.issued', adminActor(req, res), { kind: 'reservation', user, serverId, egressIp });
+  // The token is only returned here; the user configures it as their dedicated IP key
+  res.json({ user: result.user, serverId: result.serverId, egressIp: result.egressIp, token: result.token });
+});
+
+app.delete('/reservations/:user', requireRole('operator'), (req, res) => {
+  if (!deleteReservation(req.params.user)) {
+    return res.status(404).json({ error: 'No reservation for user' });
+  }
+  deletePortForwardsForUser(req.params.user);
+  console.log(`Released reservation for ${req.params.user}`);
+  recordAudit('token.revoked', adminActor(req, res), { kind: 'reservation', user: req.params.user });
+  res.json({ status: 'deleted' });
+});
+
+// Inbound port forwards on the caller's reserved server
+app.get('/port-forwards', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  res.json(portForwardsForUser(user).map(f => ({ id: f.id, serverId: f.serverId, port: f.port, expiresAt: f.expiresAt })));
+});
+
+app.post('/port-forwards', strictLimiter, authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  const reservation = res.locals.reservation as Reservation | undefined;
+  const { port, ttlSeconds } = req.body;
+
+  if (port !== undefined && (typeof port !== 'number' || !Number.isInteger(port))) {
+    return res.status(400).json({ error: 'Invalid port' });
+  }
+  if (ttlSeconds !== undefined && (typeof ttlSeconds !== 'number' || ttlSeconds <= 0 || ttlSeconds * 1000 > MAX_TTL_MS)) {
+    return res.status(400).json({ error: `ttlSeconds must be between 1 and ${MAX_TTL_MS / 1000}` });
+  }
+  if (!reservation) {
+    return res.status(409).json({ error: 'No dedicated IP reservation' });
+  }
+  if (!servers.has(reservation.serverId)) {
+    return res.status(409).json({ error: 'Reserved server is unavailable' });
+  }
+
+  const ttlMs = ttlSeconds !== undefined ? ttlSeconds * 1000 : DEFAULT_TTL_MS;
+  const result = createPortForward(user, reservation.serverId, port, ttlMs);
+  if (typeof result === 'string') {
+    return res.status(409).json({ error: result });
+  }
+
+  console.log(`Forwarding port ${result.port} on ${result.serverId} for ${result.user}`);
+  recordAudit('port_forward.created', `user:${result.user}`, { id: result.id, serverId: result.serverId, port: result.port });
+  res.json({ id: result.id, serverId: result.serverId, port: result.port, expiresAt: result.expiresAt });
+});
+
+app.delete('/port-forwards/:id', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  if (!deletePortForward(user, req.params.id)) {
+    return res.status(404).json({ error: 'Unknown port forward' });
+  }
+  recordAudit('port_forward.deleted', `user:${user}`, { id: req.params.id });
+  res.json({ status: 'deleted' });
+});
+
+// Exchanges the caller's API key or reservation token for a short-lived token
+// accepted only by the given server (default: the reserved one, which callers
+// without a reservation must name). The client names the device it runs on so
+// the user can revoke it later.
+app.post('/session-tokens', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  const serverId = req.body.serverId ?? (res.locals.reservation as Reservation | undefined)?.serverId;
+  const { deviceId } = req.body;
+  const deviceName = req.body.deviceName ?? '';
+  if (typeof serverId !== 'string' || !servers.has(serverId)) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!canUseServer(serverId, user)) {
+    return res.status(403).json({ error: 'Server is another user\'s private node' });
+  }
+  if (!validDeviceId(deviceId)) {
+    return res.status(400).json({ error: 'Invalid device ID' });
+  }
+  if (typeof deviceName !== 'string' || deviceName.length > 100) {
+    return res.status(400).json({ error: 'Invalid device name' });
+  }
+
+  const device = touchDevice(user, deviceId, deviceName);
+  if (typeof device === 'string') {
+    return res.status(403).json({ error: device });
+  }
+
+  const minted = mintSessionToken(user, deviceId, serverId);
+  recordAudit('token.issued', `user:${user}`, { kind: 'session', serverId, deviceId, sessionId: minted.sessionId });
+  res.json({ token: minted.token, serverId, expiresAt: minted.expiresAt });
+});
+
+app.get('/session-tokens/public-key', (req, res) => {
+  res.json({ alg: 'EdDSA', publicKey: sessionTokenPublicKey() });
+});
+
+// The caller's own exit nodes. Enrolling returns the server ID and node token
+// to start the node with; the token is not shown again.
+app.get('/private-nodes', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  res.json(privateNodesForUser(user).map(privateNodeView));
+});
+
+app.post('/private-nodes', strictLimiter, authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  const name = req.body.name ?? '';
+  if (typeof name !== 'string' || name.length > 100) {
+    return res.status(400).json({ error: 'Invalid name' });
+  }
+
+  const created = createPrivateNode(user, name);
+  if (typeof created === 'string') {
+    return res.status(409).json({ error: created });
+  }
+  recordAudit('private_node.enrolled', `user:${user}`, { serverId: created.node.serverId, name });
+  res.json({ ...privateNodeView(created.node), nodeToken: created.token });
+});
+
+app.delete('/private-nodes/:serverId', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  if (!deletePrivateNode(user, req.params.serverId)) {
+    return res.status(404).json({ error: 'Private node not found' });
+  }
+  const server = servers.get(req.params.serverId);
+  if (server) {
+    forgetServer(server.url);
+    forgetServerSessions(server.id);
+    servers.delete(server.id);
+    serverStore.remove(server.id);
+  }
+  recordAudit('private_node.deleted', `user:${user}`, { serverId: req.params.serverId });
+  res.json({ status: 'deleted' });
+});
+
+// The caller's devices, and revoking one (e.g. a lost laptop)
+app.get('/devices', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  res.json(devicesForUser(user).map(deviceView));
+});
+
+app.delete('/devices/:deviceId', authenticateUser, (req, res) => {
+  const user = res.locals.user as string;
+  if (!revokeDevice(user, req.params.deviceId)) {
+    return res.status(404).json({ error: 'Unknown device' });
+  }
+  console.log(`Revoked device ${req.params.deviceId} of ${user}`);
+  recordAudit('device.revoked', `user:${user}`, { user, deviceId: req.params.deviceId });
+  res.json({ status: 'revoked' });
+});
+
+// Any user's devices (admin)
+app.get('/users/:user/devices', requireRole('viewer'), (req, res) => {
+  res.json(devicesForUser(req.params.user).map(deviceView));
+});
+
+app.delete('/users/:user/devices/:deviceId', requireRole('operator'), (req, res) => {
+  if (!revokeDevice(req.params.user, req.params.deviceId)) {
+    return res.status(404).json({ error: 'Unknown device' });
+  }
+  console.log(`Revoked device ${req.params.deviceId} of ${req.params.user}`);
+  recordAudit('device.revoked', adminActor(req, res), { user: req.params.user, deviceId: req.params.deviceId });
+  res.json({ status: 'revoked' });
+});
+
+// API keys for tunnels (operators issue and revoke them; nodes verify them)
+app.post('/api-keys', strictLimiter, requireRole('operator'), (req, res) => {
+  const { user, name, ttlDays } = req.body;
+  if (typeof user !== 'string' || user.length === 0 || user.length > 200 ||
+      (name !== undefined && (typeof name !== 'string' || name.length > 100)) ||
+      (ttlDays !== undefined && (!Number.isInteger(ttlDays) || ttlDays < 1 || ttlDays > 3650))) {
+    return res.status(400).json({ error: 'Invalid API key request' });
+  }
+  const { key, secret } = createApiKey(user, name || 'unnamed', ttlDays === undefined ? null : ttlDays * 24 * 60 * 60 * 1000);
+  console.log(`Issued API key ${key.id} for ${user}`);
+  recordAudit('api_key.created', adminActor(req, res), { id: key.id, user, expiresAt: key.expiresAt });
+  res.status(201).json({ ...apiKeyView(key), key: secret });
+});
+
+app.get('/api-keys', requireRole('viewer'), (req, res) => {
+  const user = typeof req.query.user === 'string' ? req.query.user : undefined;
+  res.json(listApiKeys(user).map(apiKeyView));
+});
+
+app.delete('/api-keys/:id', requireRole('operator'), (req, res) => {
+  const key = revokeApiKey(req.params.id);
+  if (!key) {
+    return res.status(404).json({ error: 'Unknown API key' });
+  }
+  console.log(`Revoked API key ${key.id} of ${key.user}`);
+  recordAudit('api_key.revoked', adminActor(req, res), { id: key.id, user: key.user });
+  res.json({ status: 'revoked' });
+});
+
+// Nodes check a key presented for a tunnel. Keys are 256-bit random
+// strings, so guessing isn't a concern; suspended users are refused here too.
+app.post('/api-keys/verify', (req, res) => {
+  const { key } = req.body;
+  if (typeof key !== 'string' || !key.startsWith(API_KEY_PREFIX) || key.length > 100) {
+    return res.status(400).json({ error: 'Invalid API key' });
+  }
+  const result = verifyApiKey(key);
+  if (typeof result === 'string') {
+    return res.status(401).json({ error: result });
+  }
+  if (lockedOutUsers().includes(result.user) || fleetSuspendedUsers().includes(result.user)) {
+    return res.status(401).json({ error: 'User has been suspended' });
+  }
+  res.json({ user: result.user, keyId: result.id, expiresAt: result.expiresAt });
+});
+
+// Revoked device IDs and hashed suspended users; nodes poll this and refuse
+// their credentials
+app.get('/revoked-devices', (req, res) => {
+  // Hashed so the list doesn't give away who was suspended
+  const users = Array.from(new Set([...lockedOutUsers(), ...fleetSuspendedUsers()]))
+    .map(user => crypto.createHash('sha256').update(user).digest('hex'));
+  res.json({ deviceIds: revokedDeviceIds(), users });
+});
+
+// Session start/stop reports from nodes, for the per-user session limit.
+// Each node may only report sessions on itself.
+app.post('/sessions/start', nodeLimiter, (req, res) => {
+  const { serverId, sessionId, user } = req.body;
+  if (typeof serverId !== 'string' || typeof sessionId !== 'string' || typeof user !== 'string' ||
+      serverId.length > 100 || !/^[a-f0-9]{8,64}$/.test(sessionId) || user.length === 0 || user.length > 200) {
+    return res.status(400).json({ error: 'Invalid session' });
+  }
+  const server = servers.get(serverId);
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+
+  // Org members share their org's session pool
+  const membership = orgForUser(user);
+  const pool = membership && {
+    members: membersOf(membership.org.id).map(m => m.user),
+    max: membership.org.maxSessions
+  };
+
+  const result = startSession(serverId, sessionId, user, pool);
+  if (!result.allowed) {
+    if (result.limit === 'pool') {
+      sessionsLimited.inc({ policy: 'org-pool' });
+      console.log(`Refused session for ${user} on ${serverId}: ${membership!.org.id} pool of ${membership!.org.maxSessions} is full`);
+      return res.status(429).json({ allowed: false, error: 'Organization session pool is full' });
+    }
+    sessionsLimited.inc({ policy: SESSION_LIMIT_POLICY });
+    console.log(`Refused session for ${user} on ${serverId}: limit of ${MAX_SESSIONS_PER_USER} reached`);
+    return res.status(429).json({ allowed: false, error: 'Too many concurrent sessions' });
+  }
+  result.evicted.forEach(s => {
+    sessionsLimited.inc({ policy: SESSION_LIMIT_POLICY });
+    console.log(`Evicting session ${s.sessionId} of ${user} on ${s.serverId} for a newer one`);
+    recordSessionEnd(s);
+  });
+  if (!result.existing) recordSessionStart(user, serverId);
+  res.json({ allowed: true });
+});
+
+app.post('/sessions/stop', nodeLimiter, (req, res) => {
+  const { serverId, sessionId } = req.body;
+  if (typeof serverId !== 'string' || typeof sessionId !== 'string') {
+    return res.status(400).json({ error: 'Invalid session' });
+  }
+  const server = servers.get(serverId);
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  const session = stopSession(serverId, sessionId);
+  if (session) recordSessionEnd(session);
+  res.json({ status: 'stopped' });
+});
+
+app.get('/servers/:id/evictions', nodeLimiter, (req, res) => {
+  const server = servers.get(req.params.id);
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  res.json({ sessionIds: evictionsForServer(req.params.id) });
+});
+
+// The ACLs a private node enforces: those of its owner's org. They describe
+// internal networks, so only the node itself may fetch them.
+app.get('/servers/:id/acls', nodeLimiter, (req, res) => {
+  const authHeader = req.headers.authorization;
+  const node = authHeader && authHeader.startsWith('Bearer ') ? findPrivateNodeByToken(authHeader.substring(7)) : undefined;
+  if (!node || node.serverId !== req.params.id) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  const membership = orgForUser(node.owner);
+  res.json({ rules: membership ? aclsForNodes(membership.org.id) : [] });
+});
+
+app.get('/servers/:id/parental-controls', nodeLimiter, (req, res) => {
+  const authHeader = req.headers.authorization;
+  const node = authHeader && authHeader.startsWith('Bearer ') ? findPrivateNodeByToken(authHeader.substring(7)) : undefined;
+  if (!node || node.serverId !== req.params.id) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  const membership = orgForUser(node.owner);
+  res.json({ profiles: membership ? parentalControlsForNodes(membership.org.id) : [] });
+});
+
+// The ports a node listens on, and whose multiplexed tunnel each one's
+// connections go to. Only the node itself may ask, since it names users.
+app.get('/servers/:id/port-forwards', nodeLimiter, (req, res) => {
+  const server = servers.get(req.params.id);
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  res.json(portForwardsForServer(server.id).map(f => ({ id: f.id, user: f.user, port: f.port, expiresAt: f.expiresAt })));
+});
+
+// Canary vs stable telemetry comparison (admin)
+app.get('/canary', requireRole('viewer'), (req, res) => {
+  res.json(cohortSummary());
+});
+
+// Prometheus scrape endpoint
+app.get('/metrics', (req, res) => {
+  res.type('text/plain; version=0.0.4').send(renderMetrics());
+});
+
+// Register a new VPN server
+app.post('/register', strictLimiter, async (req, res) => {
+  const { id, location, url } = req.body;
+  const tags = req.body.tags ?? [];
+  const endpoints = req.body.endpoints ?? [];
+  const e2eKey = req.body.e2eKey ?? null;
+
+  // Input validation
+  if (!id || !location || !url) {
+    return res.status(400).json({ error: 'Missing required fields: id, location, url' });
+  }
+
+  // Validate ID format (alphanumeric, dash, underscore only)
+  if (!/^[a-zA-Z0-9_-]+$/.test(id)) {
+    return res.status(400).json({ error: 'Invalid server ID format' });
+  }
+
+  // Validate location
+  if (typeof location !== 'string' || location.length === 0 || location.length > 100) {
+    return res.status(400).json({ error: 'Invalid location' });
+  }
+
+  // Validate URL format
+  if (!url.startsWith('wss://') && !url.startsWith('ws://')) {
+    return res.status(400).json({ error: 'Invalid URL: must use ws:// or wss:// protocol' });
+  }
+
+  try {
+    new URL(url);
+  } catch {
+    return res.status(400).json({ error: 'Invalid URL format' });
+  }
+
+  // Validate tags (short identifiers such as "canary")
+  if (!Array.isArray(tags) || tags.length > 10 ||
+      !tags.every(tag => typeof tag === 'string' && /^[a-zA-Z0-9_-]{1,32}$/.test(tag))) {
+    return res.status(400).json({ error: 'Invalid tags' });
+  }
+
+  // Validate extra transport endpoints (raw TLS, tls://host:port, and QUIC,
+  // quic://host:port)
+  if (!Array.isArray(endpoints) || endpoints.length > 5 || !endpoints.every(validEndpoint)) {
+    return res.status(400).json({ error: 'Invalid endpoints' });
+  }
+
+  // Validate the end-to-end encryption key (32 bytes of X25519, base64)
+  if (e2eKey !== null && (typeof e2eKey !== 'string' || !/^[A-Za-z0-9+/]{43}=$/.test(e2eKey))) {
+    return res.status(400).json({ error: 'Invalid e2eKey' });
+  }
+
+  // Private and enrolled nodes register under their ID with their node
+  // token, and may replace their own earlier registration after a restart
+  const authHeader = req.headers.authorization;
+  let privateNode: PrivateNode | undefined;
+  let credentialed = false;
+  if (authHeader && authHeader.startsWith('Bearer ')) {
+    const token = authHeader.substring(7);
+    privateNode = findPrivateNodeByToken(token);
+    const expectedId = nodeTokenServer(token);
+    if (!expectedId) {
+      return res.status(403).json({ error: 'Invalid node token' });
+    }
+    if (expectedId !== id) {
+      return res.status(400).json({ error: `Node must register as ${expectedId}` });
+    }
+    credentialed = true;
+  } else if (findPrivateNode(id)) {
+    return res.status(403).json({ error: 'Server ID belongs to a private node' });
+  } else if (REQUIRE_NODE_TOKENS) {
+    // Only nodes holding credentials, from a join token or as private
+    // nodes, may register
+    recordAudit('server.register_denied', `node@${req.ip}`, { id, reason: 'no node token' });
+    return res.status(401).json({ error: 'Node token required; enroll the node with a join token' });
+  }
+
+  // Other nodes may replace their own registration, e.g. when their URL
+  // changes, with the registration token it gave them
+  const existing = servers.get(id);
+  const previousToken = req.body.registrationToken;
+  const replacing = existing !== undefined && !credentialed && typeof previousToken === 'string' &&
+    existing.registrationHash !== null && hashRegistrationToken(previousToken) === existing.registrationHash;
+
+  // Check for duplicate server ID
+  if (servers.has(id) && !credentialed && !replacing) {
+    return res.status(409).json({ error: 'Server ID already exists' });
+  }
+
+  // Generate secure server ID if not provided or override insecure ones
+  let secureId = id;
+  if (!id || id.length < 8) {
+    secureId = crypto.randomBytes(16).toString('hex');
+  }
+
+  // Nodes without a node token get a token of their own for heartbeats,
+  // unregistering and replacing the registration
+  const registrationToken = credentialed ? undefined : crypto.randomBytes(32).toString('base64url');
+  const server: Server = {
+    id: secureId,
+    location,
+    url,
+    tags,
+    endpoints,
+    e2eKey,
+    registrationHash: registrationToken === undefined ? null : hashRegistrationToken(registrationToken),
+    registeredAt: Date.now(),
+    lastSeen: Date.now()
+  };
+
+  // A node registering afresh has no sessions yet, whatever we last heard
+  forgetServerSessions(secureId);
+  forgetTombstone(secureId);
+  servers.set(secureId, server);
+  serverStore.save(server);
+
+  recordAudit('server.registered', `node@${req.ip}`, {
+    serverId: secureId, location, url, tags, endpoints, owner: privateNode?.owner
+  });
+  console.log(`Registered new server: ${secureId} at ${location} (${url})${tags.length > 0 ? ` tags: ${tags.join(',')}` : ''}`);
+
+  // Push updated server list to routing server
+  await pushServerListToRoutingServer();
+
+  res.json({ status: 'registered', serverId: secureId, registrationToken });
+});
+
+// A node taking itself out of the catalog, e.g. when shutting down. Clients
+// asking for it get the same 410 as for a node that died.
+app.post('/unregister', strictLimiter, async (req, res) => {
+  const { id } = req.body;
+  const server = typeof id === 'string' ? servers.get(id) : undefined;
+  if (!server) {
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  console.log(`Unregistered server: ${server.id}`);
+  removeServer(server, 'unregistered', `node@${req.ip}`);
+  await pushServerListToRoutingServer();
+  res.json({ status: 'unregistered' });
+});
+
+// Liveness from nodes between health probes. A node told its server is
+// gone (410) or unknown (404) should register again.
+app.post('/servers/:id/heartbeat', nodeLimiter, (req, res) => {
+  const server = servers.get(req.params.id);
+  if (!server) {
+    const tombstone = findTombstone(req.params.id);
+    if (tombstone) {
+      return res.status(410).json(goneResponse(tombstone, 'heartbeat'));
+    }
+    return res.status(404).json({ error: 'Unknown server' });
+  }
+  if (!fromNode(req, server)) {
+    return res.status(403).json({ error: 'Invalid node token' });
+  }
+  server.lastSeen = Date.now();
+  res.json({ status: 'ok' });
+});
+
+function hashRegistrationToken(token: string): string {
+  return crypto.createHash('sha256').update(token).digest('hex');
+}
+
+// Whether a request carries the credential of the node registered as
+// server: its node token if it has one, otherwise its registration token
+function fromNode(req: express.Request, server: Server): boolean {
+  const authHeader = req.headers.authorization;
+  if (!authHeader || !authHeader.startsWith('Bearer ')) return false;
+  const token = authHeader.substring(7);
+  if (findPrivateNode(server.id) !== undefined || enrolledNode(server.id)) {
+    return nodeTokenServer(token) === server.id;
+  }
+  return server.registrationHash !== null && hashRegistrationToken(token) === server.registrationHash;
+}
+
+// The server ID a private or enrolled node's token belongs to
+function nodeTokenServer(token: string): string | undefined {
+  return findPrivateNodeByToken(token)?.serverId ?? serverForNodeToken(token);
+}
+
+// Node enrollment: operators create one-time join tokens, and new nodes
+// trade them for an ID and node token at first boot
+function joinTokenView(t: JoinToken) {
+  return {
+    id: t.id,
+    location: t.location,
+    tags: t.tags,
+    createdBy: t.createdBy,
+    expiresAt: t.expiresAt,
+    used: t.usedAt !== null,
+    usedAt: t.usedAt,
+    serverId: t.serverId
+  };
+}
+
+app.get('/join-tokens', requireRole('viewer'), (req, res) => {
+  res.json(listJoinTokens().map(joinTokenView));
+});
+
+app.post('/join-tokens', strictLimiter, requireRole('operator'), (req, res) => {
+  const { location } = req.body;
+  const tags = req.body.tags ?? [];
+  const ttlMs = req.body.ttlSeconds !== undefined ? req.body.ttlSeconds * 1000 : DEFAULT_JOIN_TOKEN_TTL_MS;
+  if (typeof location !== 'string' || location.length === 0 || location.length > 100) {
+    return res.status(400).json({ error: 'Invalid location' });
+  }
+  if (!Array.isArray(tags) || tags.length > 10 ||
+      !tags.every(tag => typeof tag === 'string' && /^[a-zA-Z0-9_-]{1,32}$/.test(tag))) {
+    return res.status(400).json({ error: 'Invalid tags' });
+  }
+  if (!Number.isInteger(ttlMs) || ttlMs <= 0 || ttlMs > MAX_JOIN_TOKEN_TTL_MS) {
+    return res.status(400).json({ error: `ttlSeconds must be between 1 and ${MAX_JOIN_TOKEN_TTL_MS / 1000}` });
+  }
+
+  const { joinToken, token } = createJoinToken(location, tags, ttlMs, adminActor(req, res));
+  recordAudit('token.issued', adminActor(req, res), { kind: 'join', id: joinToken.id, location, tags, expiresAt: joinToken.expiresAt });
+  // The token is only returned here
+  res.json({ ...joinTokenView(joinToken), token });
+});
+
+app.delete('/join-tokens/:id', requireRole('operator'), (req, res) => {
+  if (!deleteJoinToken(req.params.id)) {
+    return res.status(404).json({ error: 'Join token not found' });
+  }
+  recordAudit('token.revoked', adminActor(req, res), { kind: 'join', id: req.params.id });
+  res.json({ status: 'deleted' });
+});
+
+// First boot of an enrolled node: everything it needs to register and
+// accept session tokens
+app.post('/bootstrap', strictLimiter, (req, res) => {
+  const { token } = req.body;
+  if (typeof token !== 'string') {
+    return res.status(400).json({ error: 'Missing join token' });
+  }
+  const result = redeemJoinToken(token);
+  if (typeof result === 'string') {
+    recordAudit('node.bootstrap_failed', `node@${req.ip}`, { reason: result });
+    return res.status(403).json({ error: result });
+  }
+
+  const { joinToken, serverId, nodeToken } = result;
+  console.log(`Enrolled node ${serverId} at ${joinToken.location} with join token ${joinToken.id}`);
+  recordAudit('node.bootstrapped', `node@${req.ip}`, { serverId, joinTokenId: joinToken.id, location: joinToken.location });
+  res.json({
+    serverId,
+    location: joinToken.location,
+    tags: joinToken.tags,
+    nodeToken,
+    sessionTokenPublicKey: sessionTokenPublicKey()
+  });
+});
+
+// The server a node report is about. The report must carry the node's
+// credential, so nobody else can skew its numbers. Answers and returns
+// undefined if the report can't be taken.
+function reportingServer(req: express.Request, res: express.Response, endpoint: string): Server | undefined {
+  const server = servers.get(req.params.id);
+  if (!server) {
+    const tombstone = findTombstone(req.params.id);
+    if (tombstone) {
+      res.status(410).json(goneResponse(tombstone, endpoint));
+    } else {
+      res.status(404).json({ error: 'Unknown server' });
+    }
+    return undefined;
+  }
+  if (!fromNode(req, server)) {
+    res.status(403).json({ error: 'Invalid node token' });
+    return undefined;
+  }
+  return server;
+}
+
+// Load reports from nodes
+app.post('/servers/:id/load', nodeLimiter, (req, res) => {
+  const { tunnels, maxTunnels, overloaded, host } = req.body;
+  const instance = req.body.instance ?? 'default';
+  const server = reportingServer(req, res, 'load');
+  if (!server) return;
+  if (typeof instance !== 'string' || instance.length === 0 || instance.length > 100 ||
+      !Number.isInteger(tunnels) || tunnels < 0 || !Number.isInteger(maxTunnels) || maxTunnels < 0 ||
+      typeof overloaded !== 'boolean' || (host !== undefined && !validHostLoad(host))) {
+    return res.status(400).json({ error: 'Invalid load report' });
+  }
+
+  const report: LoadReport = {
+    serverId: server.id, instance, tunnels, maxTunnels, overloaded,
+    host: host === undefined ? undefined : { cpu: host.cpu, memory: host.memory, nic: host.nic },
+    at: Date.now()
+  };
+  recordLoad(report);
+  recordLoadUsage(report);
+  server.lastSeen = report.at;
+  res.json({ status: 'ok' });
+});
+
+// Differentially private usage telemetry from nodes; see telemetry.ts
+app.post('/servers/:id/usage-telemetry', nodeLimiter, (req, res) => {
+  const server = reportingServer(req, res, 'usage-telemetry');
+  if (!server) return;
+  const report = parseTelemetryReport(server.id, req.body);
+  if (typeof report === 'string') {
+    return res.status(400).json({ error: report });
+  }
+  recordTelemetry(report);
+  res.json({ status: 'ok' });
+});
+
+// Summed usage telemetry, by default for the last day and the whole fleet.
+// ?since= and ?until= take milliseconds since the epoch, and ?location=
+// narrows it to one location's nodes.
+app.get('/usage-telemetry', requireRole('viewer'), (req, res) => {
+  const until = req.query.until === undefined ? Date.now() : Number(req.query.until);
+  const since = req.query.since === undefined ? until - 24 * 60 * 60 * 1000 : Number(req.query.since);
+  if (!Number.isSafeInteger(since) || !Number.isSafeInteger(until) || since > until) {
+    return res.status(400).json({ error: 'since and until must be times in milliseconds, since first' });
+  }
+  let serverIds: Set<string> | undefined;
+  if (typeof req.query.location === 'string') {
+    const wanted = req.query.location.toLowerCase();
+    serverIds = new Set(Array.from(serversByLocation().entries())
+      .filter(([location]) => location.toLowerCase() === wanted)
+      .flatMap(([, list]) => list.map(server => server.id)));
+  }
+  res.json(telemetrySummary(since, until, serverIds));
+});
+
+// Fleet utilization per location, for autoscalers. desiredInstances is how
+// many node instances would bring a location to AUTOSCALE_TARGET_UTILIZATION.
+app.get('/autoscaling', requireRole('viewer'), (req, res) => {
+  const wanted = typeof req.query.location === 'string' ? req.query.location.toLowerCase() : undefined;
+  const regions = Array.from(serversByLocation().entries())
+    .filter(([location]) => wanted === undefined || location.toLowerCase() === wanted)
+    .map(([location, list]) => ({
+      ...utilizationOf(location, list),
+      nodes: list.map(server => ({ id: server.id, instances: currentLoad(server.id) }))
+    }));
+  res.json({ targetUtilization: TARGET_UTILIZATION, regions });
+});
+
+// Leak check echo: the address this request came from, which through a
+// tunnel should be the node's, and the zone for DNS leak checks
+app.get('/leakcheck', (req, res) => {
+  res.json({ ip: (req.ip || '').replace(/^::ffff:/, ''), dnsZone: leakcheckZone() });
+});
+
+// The resolvers that looked up <token>.<zone> in the last few minutes
+app.get('/leakcheck/dns/:token', (req, res) => {
+  if (!leakcheckZone()) {
+    return res.status(404).json({ error: 'DNS leak checks are not configured' });
+  }
+  if (!validLeakcheckToken(req.params.token)) {
+    return res.status(400).json({ error: 'Invalid token' });
+  }
+  res.json({ resolvers: resolversFor(req.params.token) });
+});
+
+// Health check endpoint for the sync server itself
+app.get('/health', (req, res) => {
+  res.send('OK');
+});
+
+const PORT = parseInt(process.env.PORT || '3001');
+const USE_HTTPS = process.env.USE_HTTPS === 'true';
+const SSL_KEY_PATH = process.env.SSL_KEY_PATH || './ssl/key.pem';
+const SSL_CERT_PATH = process.env.SSL_CERT_PATH || './ssl/cert.pem';
+
+async function startServer() {
+  await loadServers();
+
+  // Start health checking every 5 minutes
+  setInterval(healthCheck, 5 * 60 * 1000);
+
+  // Drop expired port forwards, session evictions, stale servers,
+  // tombstones and leak check lookups every minute
+  setInterval(expirePortForwards, 60 * 1000);
+  setInterval(expireEvictions, 60 * 1000);
+  setInterval(collectGarbage, 60 * 1000);
+  setInterval(expireLookups, 60 * 1000);
 
   if (USE_HTTPS && fs.existsSync(SSL_KEY_PATH) && fs.existsSync(SSL_CERT_PATH)) {
     try {
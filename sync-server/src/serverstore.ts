@@ -0,0 +1,100 @@
+// Where the catalog of registered servers is kept between restarts.
+// SERVER_STORE picks SQLite (the default, in servers.db) or memory, for
+// development and for fleets whose nodes register again whenever the sync
+// server restarts. The catalog itself is always served from memory; the
+// store only has to load it at startup and follow changes.
+import sqlite3 from 'sqlite3';
+
+export interface Server {
+  id: string;
+  location: string;
+  url: string;
+  tags: string[];
+  // Other transports the node serves, e.g. tls://host:port or quic://host:port
+  endpoints: string[];
+  // X25519 public key for end-to-end encrypted tunnels, in base64
+  e2eKey: string | null;
+  // SHA-256 of the token /register gave the node, for nodes without a node
+  // token to prove themselves with
+  registrationHash: string | null;
+  registeredAt: number;
+  // Last passed health probe, heartbeat or load report
+  lastSeen: number;
+}
+
+export interface ServerStore {
+  load(): Promise<Server[]>;
+  save(server: Server): void;
+  remove(id: string): void;
+}
+
+export class MemoryServerStore implements ServerStore {
+  async load(): Promise<Server[]> {
+    return [];
+  }
+
+  save(server: Server) {}
+
+  remove(id: string) {}
+}
+
+export class SqliteServerStore implements ServerStore {
+  constructor(private db: sqlite3.Database) {
+    db.run(`CREATE TABLE IF NOT EXISTS servers (
+      id TEXT PRIMARY KEY,
+      location TEXT NOT NULL,
+      url TEXT NOT NULL,
+      registered_at INTEGER NOT NULL,
+      last_seen INTEGER NOT NULL,
+      tags TEXT NOT NULL DEFAULT '[]',
+      endpoints TEXT NOT NULL DEFAULT '[]',
+      e2e_key TEXT,
+      registration_hash TEXT
+    )`);
+
+    // Databases created before these columns existed lack them; the error
+    // for databases that already have them is expected and ignored
+    db.run(`ALTER TABLE servers ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'`, () => {});
+    db.run(`ALTER TABLE servers ADD COLUMN endpoints TEXT NOT NULL DEFAULT '[]'`, () => {});
+    db.run(`ALTER TABLE servers ADD COLUMN e2e_key TEXT`, () => {});
+    db.run(`ALTER TABLE servers ADD COLUMN registration_hash TEXT`, () => {});
+  }
+
+  load(): Promise<Server[]> {
+    return new Promise((resolve, reject) => {
+      this.db.all('SELECT * FROM servers', [], (err, rows: any[]) => {
+        if (err) return reject(err);
+        resolve(rows.map(row => ({
+          id: row.id,
+          location: row.location,
+          url: row.url,
+          tags: JSON.parse(row.tags || '[]'),
+          endpoints: JSON.parse(row.endpoints || '[]'),
+          e2eKey: row.e2e_key ?? null,
+          registrationHash: row.registration_hash ?? null,
+          registeredAt: row.registered_at,
+          lastSeen: row.last_seen
+        })));
+      });
+    });
+  }
+
+  save(server: Server) {
+    this.db.run(
+      'INSERT OR REPLACE INTO servers (id, location, url, registered_at, last_seen, tags, endpoints, e2e_key, registration_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)',
+      [server.id, server.location, server.url, server.registeredAt, server.lastSeen, JSON.stringify(server.tags),
+        JSON.stringify(server.endpoints), server.e2eKey, server.registrationHash]
+    );
+  }
+
+  remove(id: string) {
+    this.db.run('DELETE FROM servers WHERE id = ?', [id]);
+  }
+}
+
+export function serverStoreFromEnv(db: sqlite3.Database): ServerStore {
+  const v = process.env.SERVER_STORE || 'sqlite';
+  if (v === 'memory') return new MemoryServerStore();
+  if (v !== 'sqlite') console.warn(`Ignoring invalid SERVER_STORE value: ${v}`);
+  return new SqliteServerStore(db);
+}
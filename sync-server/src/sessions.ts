@@ -0,0 +1,146 @@
+// Concurrent session limits. Nodes report when a user's session starts and
+// stops; when a user is at MAX_SESSIONS_PER_USER, SESSION_LIMIT_POLICY decides
+// whether the new session is refused ("reject") or the user's oldest one is
+// evicted ("disconnect-oldest"). Evictions are queued for the owning node to
+// pick up when it polls.
+//
+// Sessions are live state and kept in memory only. After a restart the
+// count starts from zero and fills up again as nodes report new sessions.
+
+export interface Session {
+  serverId: string;
+  sessionId: string;
+  user: string;
+  startedAt: number;
+}
+
+export type SessionLimitPolicy = 'reject' | 'disconnect-oldest';
+
+function maxSessionsFromEnv(): number {
+  const v = process.env.MAX_SESSIONS_PER_USER;
+  if (v) {
+    const n = parseInt(v, 10);
+    if (!isNaN(n) && n >= 0) return n;
+    console.warn(`Ignoring invalid MAX_SESSIONS_PER_USER value: ${v}`);
+  }
+  return 0;
+}
+
+function policyFromEnv(): SessionLimitPolicy {
+  const v = process.env.SESSION_LIMIT_POLICY;
+  if (v === undefined || v === 'reject') return 'reject';
+  if (v === 'disconnect-oldest') return v;
+  console.warn(`Ignoring invalid SESSION_LIMIT_POLICY value: ${v}`);
+  return 'reject';
+}
+
+// 0 means unlimited
+export const MAX_SESSIONS_PER_USER = maxSessionsFromEnv();
+export const SESSION_LIMIT_POLICY = policyFromEnv();
+
+// Evictions a node hasn't fetched within this long are dropped; the node is
+// probably gone and its sessions with it
+const EVICTION_TTL_MS = 5 * 60 * 1000;
+
+const sessions: Map<string, Session> = new Map();
+// Keyed by server ID, then session ID, to the time of eviction
+const evictions: Map<string, Map<string, number>> = new Map();
+
+function sessionKey(serverId: string, sessionId: string): string {
+  return `${serverId}/${sessionId}`;
+}
+
+export function sessionsForUser(user: string): Session[] {
+  return Array.from(sessions.values())
+    .filter(s => s.user === user)
+    .sort((a, b) => a.startedAt - b.startedAt);
+}
+
+export function activeSessionCount(): number {
+  return sessions.size;
+}
+
+// A pool of sessions shared by several users, such as an organization's
+// members; their sessions together may not exceed max
+export interface SessionPool {
+  members: string[];
+  max: number;
+}
+
+// Starts a session, applying the limit and the user's pool if any. Returns
+// whether it was allowed (and if not, which limit refused it) and any
+// sessions evicted to make room. A full pool always refuses: evicting a
+// colleague's session to make room would be rude.
+export function startSession(
+  serverId: string, sessionId: string, user: string, pool?: SessionPool
+): { allowed: boolean; evicted: Session[]; limit?: 'user' | 'pool'; existing?: boolean } {
+  const key = sessionKey(serverId, sessionId);
+  if (sessions.has(key)) {
+    return { allowed: true, evicted: [], existing: true };
+  }
+
+  let evict: Session[] = [];
+  if (MAX_SESSIONS_PER_USER > 0) {
+    const existing = sessionsForUser(user);
+    const excess = existing.length - MAX_SESSIONS_PER_USER + 1;
+    if (excess > 0) {
+      if (SESSION_LIMIT_POLICY === 'reject') {
+        return { allowed: false, evicted: [], limit: 'user' };
+      }
+      evict = existing.slice(0, excess);
+    }
+  }
+
+  if (pool && pool.max > 0) {
+    const inPool = Array.from(sessions.values()).filter(s => pool.members.includes(s.user)).length;
+    if (inPool - evict.length >= pool.max) {
+      return { allowed: false, evicted: [], limit: 'pool' };
+    }
+  }
+
+  evict.forEach(s => {
+    sessions.delete(sessionKey(s.serverId, s.sessionId));
+    let queued = evictions.get(s.serverId);
+    if (!queued) {
+      queued = new Map();
+      evictions.set(s.serverId, queued);
+    }
+    queued.set(s.sessionId, Date.now());
+  });
+
+  sessions.set(key, { serverId, sessionId, user, startedAt: Date.now() });
+  return { allowed: true, evicted: evict };
+}
+
+// Ends a session, returning it if it was known
+export function stopSession(serverId: string, sessionId: string): Session | undefined {
+  const key = sessionKey(serverId, sessionId);
+  const session = sessions.get(key);
+  sessions.delete(key);
+  return session;
+}
+
+// Sessions a node must disconnect. They are repeated on every poll until
+// they expire, so a failed poll loses nothing; nodes ignore IDs they don't
+// have.
+export function evictionsForServer(serverId: string): string[] {
+  return Array.from(evictions.get(serverId)?.keys() ?? []);
+}
+
+// Drops every session of a server, e.g. when it is removed or restarts
+export function forgetServerSessions(serverId: string) {
+  sessions.forEach((session, key) => {
+    if (session.serverId === serverId) sessions.delete(key);
+  });
+  evictions.delete(serverId);
+}
+
+export function expireEvictions() {
+  const cutoff = Date.now() - EVICTION_TTL_MS;
+  evictions.forEach((queued, serverId) => {
+    queued.forEach((at, sessionId) => {
+      if (at < cutoff) queued.delete(sessionId);
+    });
+    if (queued.size === 0) evictions.delete(serverId);
+  });
+}
@@ -0,0 +1,71 @@
+// Short-lived session tokens. Clients exchange their long-lived credential for
+// an Ed25519-signed JWT that only one node accepts, for a few minutes. Nodes
+// check the signature offline against SESSION_TOKEN_PUBLIC_KEYS.
+import crypto from 'crypto';
+import fs from 'fs';
+
+export const SESSION_TOKEN_ISSUER = 'horsevpn-sync';
+
+const KEY_FILE = process.env.SESSION_TOKEN_KEY_FILE || './session-token-key.pem';
+
+function ttlFromEnv(): number {
+  const v = process.env.SESSION_TOKEN_TTL;
+  if (v) {
+    const secs = parseInt(v, 10);
+    if (!isNaN(secs) && secs > 0 && secs <= 3600) return secs;
+    console.warn(`Ignoring invalid SESSION_TOKEN_TTL value: ${v}`);
+  }
+  return 300;
+}
+
+export const SESSION_TOKEN_TTL = ttlFromEnv();
+
+let privateKey: crypto.KeyObject;
+
+// Loads the signing key, generating and saving one on first start
+export function initSessionTokens() {
+  if (fs.existsSync(KEY_FILE)) {
+    privateKey = crypto.createPrivateKey(fs.readFileSync(KEY_FILE));
+  } else {
+    privateKey = crypto.generateKeyPairSync('ed25519').privateKey;
+    fs.writeFileSync(KEY_FILE, privateKey.export({ type: 'pkcs8', format: 'pem' }), { mode: 0o600 });
+    console.log(`Generated session token signing key at ${KEY_FILE}`);
+  }
+  console.log(`Session token public key (set SESSION_TOKEN_PUBLIC_KEYS on nodes): ${sessionTokenPublicKey()}`);
+}
+
+// The raw public key in base64, as nodes expect it
+export function sessionTokenPublicKey(): string {
+  const jwk = crypto.createPublicKey(privateKey).export({ format: 'jwk' });
+  return Buffer.from(jwk.x as string, 'base64url').toString('base64');
+}
+
+// Signs other documents the sync server vouches for, such as client config
+// bundles. Callers prefix the data with a context string of their own.
+export function signWithSyncKey(data: Buffer): Buffer {
+  return crypto.sign(null, data, privateKey);
+}
+
+function base64url(data: string | Buffer): string {
+  return Buffer.from(data).toString('base64url');
+}
+
+// Mints a token for one session of user's device on serverId
+export function mintSessionToken(user: string, deviceId: string, serverId: string): { token: string; sessionId: string; expiresAt: number } {
+  const now = Math.floor(Date.now() / 1000);
+  const sessionId = crypto.randomBytes(12).toString('hex');
+  const header = { alg: 'EdDSA', typ: 'JWT' };
+  const claims = {
+    iss: SESSION_TOKEN_ISSUER,
+    sub: user,
+    aud: serverId,
+    sid: sessionId,
+    did: deviceId,
+    iat: now,
+    exp: now + SESSION_TOKEN_TTL
+  };
+
+  const signingInput = `${base64url(JSON.stringify(header))}.${base64url(JSON.stringify(claims))}`;
+  const signature = crypto.sign(null, Buffer.from(signingInput), privateKey);
+  return { token: `${signingInput}.${base64url(signature)}`, sessionId, expiresAt: claims.exp * 1000 };
+}
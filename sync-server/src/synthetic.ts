@@ -0,0 +1,270 @@
+// Synthetic monitoring. The health check only shows that a node answers
+// /health; it says nothing of whether tunnels through it reach the internet.
+// With SYNTHETIC_TARGET set, every SYNTHETIC_INTERVAL seconds the sync server
+// opens a tunnel through SYNTHETIC_NODES random public nodes to that
+// host:port, as a client would: a WebSocket to /ws with a session token it
+// mints for SYNTHETIC_USER and an X-Destination header. It sends a HEAD
+// request down the tunnel and waits for the first bytes of the answer, so
+// the target should speak plain HTTP. Results are kept in memory, per node,
+// and exposed as metrics and at GET /synthetic.
+import http from 'http';
+import https from 'https';
+import crypto from 'crypto';
+import { Socket } from 'net';
+import { Counter, Gauge, Histogram } from './metrics';
+import { mintSessionToken } from './sessiontokens';
+
+export interface ProbeTarget {
+  id: string;
+  location: string;
+  // The node's WebSocket URL, ws:// or wss://
+  url: string;
+}
+
+export interface ProbeResult {
+  serverId: string;
+  location: string;
+  ok: boolean;
+  // Until the tunnel was open, which includes the node dialing the target
+  connectMs: number | null;
+  // Until the target's first bytes arrived back through the tunnel
+  totalMs: number | null;
+  error: string | null;
+  at: number;
+}
+
+interface SyntheticConfig {
+  host: string;
+  port: number;
+  intervalMs: number;
+  nodesPerRun: number;
+  user: string;
+  origin: string;
+}
+
+const PROBE_TIMEOUT_MS = 10000;
+// Device ID in the probes' session tokens
+const PROBE_DEVICE_ID = 'synthetic-monitor';
+
+const probesTotal = new Counter('horsevpn_sync_synthetic_probes_total', 'Synthetic tunnel probes by location and result');
+const probeLatency = new Histogram('horsevpn_sync_synthetic_latency_seconds', 'Time from opening a synthetic probe tunnel to the target\'s first bytes',
+  [0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10]);
+
+// Keyed by server ID
+const results: Map<string, ProbeResult> = new Map();
+
+new Gauge('horsevpn_sync_synthetic_success', 'Whether the last synthetic probe through a node succeeded', () =>
+  Array.from(results.values()).map(r => [{ server_id: r.serverId, location: r.location }, r.ok ? 1 : 0]));
+
+let config: SyntheticConfig | null = null;
+let listTargets: () => ProbeTarget[] = () => [];
+let running = false;
+
+function syntheticConfigFromEnv(): SyntheticConfig | null {
+  const target = process.env.SYNTHETIC_TARGET;
+  if (!target) return null;
+  const match = /^(.+):(\d+)$/.exec(target);
+  const port = match ? parseInt(match[2], 10) : 0;
+  if (!match || port < 1 || port > 65535) {
+    console.warn(`Ignoring invalid SYNTHETIC_TARGET value: ${target}; synthetic probes are off`);
+    return null;
+  }
+
+  let intervalMs = 60 * 1000;
+  const v = process.env.SYNTHETIC_INTERVAL;
+  if (v) {
+    const n = parseInt(v, 10);
+    if (!isNaN(n) && n >= 10) {
+      intervalMs = n * 1000;
+    } else {
+      console.warn(`Ignoring invalid SYNTHETIC_INTERVAL value: ${v}`);
+    }
+  }
+
+  let nodesPerRun = 3;
+  const nodes = process.env.SYNTHETIC_NODES;
+  if (nodes) {
+    const n = parseInt(nodes, 10);
+    if (!isNaN(n) && n > 0) {
+      nodesPerRun = n;
+    } else {
+      console.warn(`Ignoring invalid SYNTHETIC_NODES value: ${nodes}`);
+    }
+  }
+
+  return {
+    host: match[1].replace(/^\[(.*)\]$/, '$1'),
+    port,
+    intervalMs,
+    nodesPerRun,
+    user: process.env.SYNTHETIC_USER || 'synthetic-monitor',
+    origin: process.env.SYNTHETIC_ORIGIN || 'http://localhost'
+  };
+}
+
+export function initSynthetic(targets: () => ProbeTarget[]) {
+  listTargets = targets;
+  config = syntheticConfigFromEnv();
+  if (config) {
+    console.log(`Probing ${config.nodesPerRun} node(s) through to ${config.host}:${config.port} every ${config.intervalMs / 1000}s`);
+    setInterval(() => {
+      runSyntheticProbes().catch(err => console.error('Synthetic probes failed:', err.message));
+    }, config.intervalMs);
+  }
+}
+
+export function syntheticEnabled(): boolean {
+  return config !== null;
+}
+
+export function syntheticResults(): ProbeResult[] {
+  return Array.from(results.values());
+}
+
+export function forgetSyntheticResult(serverId: string) {
+  results.delete(serverId);
+}
+
+// Probes a random sample of nodes, all at once. Overlapping runs are skipped.
+export async function runSyntheticProbes(): Promise<ProbeResult[]> {
+  if (!config || running) return [];
+  running = true;
+  try {
+    const cfg = config;
+    const sample = listTargets()
+      .map(target => ({ target, order: Math.random() }))
+      .sort((a, b) => a.order - b.order)
+      .slice(0, cfg.nodesPerRun)
+      .map(({ target }) => target);
+    const probed = await Promise.all(sample.map(target => probeNode(cfg, target)));
+    probed.forEach(result => {
+      results.set(result.serverId, result);
+      probesTotal.inc({ location: result.location, result: result.ok ? 'success' : 'failure' });
+      if (result.ok && result.totalMs !== null) probeLatency.observe(result.totalMs / 1000);
+      if (!result.ok) console.log(`Synthetic probe through ${result.serverId} failed: ${result.error}`);
+    });
+    return probed;
+  } finally {
+    running = false;
+  }
+}
+
+async function probeNode(cfg: SyntheticConfig, target: ProbeTarget): Promise<ProbeResult> {
+  const result: ProbeResult = {
+    serverId: target.id, location: target.location, ok: false,
+    connectMs: null, totalMs: null, error: null, at: Date.now()
+  };
+  const start = Date.now();
+  let socket: Socket | null = null;
+  try {
+    socket = await openTunnel(cfg, target);
+    result.connectMs = Date.now() - start;
+    const hostHeader = cfg.host.includes(':') ? `[${cfg.host}]` : cfg.host;
+    socket.write(encodeFrame(Buffer.from(`HEAD / HTTP/1.1\r\nHost: ${hostHeader}\r\nConnection: close\r\n\r\n`)));
+    const reply = await readFirstPayload(socket);
+    if (!reply.toString('latin1').startsWith('HTTP/')) {
+      throw new Error('target did not answer with HTTP');
+    }
+    result.totalMs = Date.now() - start;
+    result.ok = true;
+  } catch (err: any) {
+    result.error = err.message;
+  } finally {
+    socket?.destroy();
+  }
+  return result;
+}
+
+// Opens a tunnel to the target through the node, resolving with the
+// upgraded socket
+function openTunnel(cfg: SyntheticConfig, target: ProbeTarget): Promise<Socket> {
+  return new Promise((resolve, reject) => {
+    let url: URL;
+    try {
+      url = new URL(target.url.replace(/^ws:/, 'http:').replace(/^wss:/, 'https:'));
+    } catch {
+      return reject(new Error(`invalid node URL ${target.url}`));
+    }
+    const hostHeader = cfg.host.includes(':') ? `[${cfg.host}]` : cfg.host;
+    const { token } = mintSessionToken(cfg.user, PROBE_DEVICE_ID, target.id);
+    const request = (url.protocol === 'https:' ? https : http).request(url, {
+      headers: {
+        Connection: 'Upgrade',
+        Upgrade: 'websocket',
+        'Sec-WebSocket-Version': '13',
+        'Sec-WebSocket-Key': crypto.randomBytes(16).toString('base64'),
+        'Sec-WebSocket-Protocol': 'vpn-protocol',
+        Origin: cfg.origin,
+        Authorization: `Bearer ${token}`,
+        'X-Destination': `${hostHeader}:${cfg.port}`
+      },
+      timeout: PROBE_TIMEOUT_MS
+    });
+    request.on('upgrade', (res, socket: Socket, head: Buffer) => {
+      socket.setTimeout(0);
+      if (head.length > 0) socket.unshift(head);
+      resolve(socket);
+    });
+    request.on('response', res => {
+      res.resume();
+      reject(new Error(`node answered ${res.statusCode}`));
+    });
+    request.on('timeout', () => request.destroy(new Error('timed out opening the tunnel')));
+    request.on('error', reject);
+    request.end();
+  });
+}
+
+// Client frames must be masked (RFC 6455 section 5.3)
+function encodeFrame(payload: Buffer): Buffer {
+  const mask = crypto.randomBytes(4);
+  let header: Buffer;
+  if (payload.length < 126) {
+    header = Buffer.from([0x82, 0x80 | payload.length]);
+  } else {
+    header = Buffer.alloc(4);
+    header[0] = 0x82;
+    header[1] = 0x80 | 126;
+    header.writeUInt16BE(payload.length, 2);
+  }
+  const masked = Buffer.alloc(payload.length);
+  for (let i = 0; i < payload.length; i++) masked[i] = payload[i] ^ mask[i % 4];
+  return Buffer.concat([header, mask, masked]);
+}
+
+// Resolves with the payload of the first data frame the node sends
+function readFirstPayload(socket: Socket): Promise<Buffer> {
+  return new Promise((resolve, reject) => {
+    let buffered = Buffer.alloc(0);
+    const timer = setTimeout(() => finish(new Error('timed out waiting for the target')), PROBE_TIMEOUT_MS);
+    const finish = (err: Error | null, payload?: Buffer) => {
+      clearTimeout(timer);
+      socket.removeAllListeners('data');
+      if (err) reject(err); else resolve(payload as Buffer);
+    };
+    socket.on('data', (chunk: Buffer) => {
+      buffered = Buffer.concat([buffered, chunk]);
+      while (buffered.length >= 2) {
+        const opcode = buffered[0] & 0x0f;
+        let length = buffered[1] & 0x7f;
+        let offset = 2;
+        if (length === 126) {
+          if (buffered.length < 4) return;
+          length = buffered.readUInt16BE(2);
+          offset = 4;
+        } else if (length === 127) {
+          if (buffered.length < 10) return;
+          length = Number(buffered.readBigUInt64BE(2));
+          offset = 10;
+        }
+        if (buffered.length < offset + length) return;
+        const payload = buffered.subarray(offset, offset + length);
+        buffered = buffered.subarray(offset + length);
+        if (opcode === 0x8) return finish(new Error('tunnel closed before the target answered'));
+        if ((opcode === 0x1 || opcode === 0x2 || opcode === 0x0) && payload.length > 0) return finish(null, payload);
+      }
+    });
+    socket.on('close', () => finish(new Error('tunnel closed before the target answered')));
+    socket.on('error', err => finish(err));
+  });
+}
@@ -0,0 +1,132 @@
+// Differentially private usage telemetry from nodes running with
+// USAGE_TELEMETRY=private. Each report covers one node instance's period
+// and holds two histograms, of users by bytes carried and by tunnels
+// opened, with noise already added on the node; nothing here ever sees a
+// per-user number. Reports are kept for TELEMETRY_RETENTION_DAYS and
+// summed on request. Sums of noisy counts stay unbiased, and their noise
+// grows only with the square root of the number of reports.
+import sqlite3 from 'sqlite3';
+
+// Upper bounds of the buckets, as the nodes use them; each histogram has
+// one more bucket for everything above the last bound
+export const TELEMETRY_BYTE_BUCKETS = [1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 * (1 << 30)];
+export const TELEMETRY_TUNNEL_BUCKETS = [1, 5, 20, 100];
+
+export interface TelemetryReport {
+  serverId: string;
+  instance: string;
+  periodStart: number;
+  periodEnd: number;
+  epsilon: number;
+  bytes: number[];
+  tunnels: number[];
+}
+
+function retentionFromEnv(): number {
+  const v = process.env.TELEMETRY_RETENTION_DAYS;
+  if (v) {
+    const days = parseInt(v, 10);
+    if (!isNaN(days) && days > 0) return days * 24 * 60 * 60 * 1000;
+    console.warn(`Ignoring invalid TELEMETRY_RETENTION_DAYS value: ${v}`);
+  }
+  return 30 * 24 * 60 * 60 * 1000;
+}
+
+const RETENTION_MS = retentionFromEnv();
+
+let reports: TelemetryReport[] = [];
+let db: sqlite3.Database;
+
+export function initTelemetry(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS usage_telemetry (
+      server_id TEXT NOT NULL,
+      instance TEXT NOT NULL,
+      period_start INTEGER NOT NULL,
+      period_end INTEGER NOT NULL,
+      epsilon REAL NOT NULL,
+      bytes TEXT NOT NULL,
+      tunnels TEXT NOT NULL
+    )`);
+    db.run('DELETE FROM usage_telemetry WHERE period_end < ?', [Date.now() - RETENTION_MS]);
+    db.all('SELECT * FROM usage_telemetry ORDER BY period_end', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading usage telemetry from DB:', err);
+        return;
+      }
+      reports = rows.map(row => ({
+        serverId: row.server_id,
+        instance: row.instance,
+        periodStart: row.period_start,
+        periodEnd: row.period_end,
+        epsilon: row.epsilon,
+        bytes: JSON.parse(row.bytes),
+        tunnels: JSON.parse(row.tunnels)
+      }));
+    });
+  });
+}
+
+function validCounts(counts: unknown, bounds: number[]): counts is number[] {
+  return Array.isArray(counts) && counts.length === bounds.length + 1 &&
+    counts.every(c => Number.isSafeInteger(c));
+}
+
+// Checks a report from a node, returning it or an error message
+export function parseTelemetryReport(serverId: string, body: any): TelemetryReport | string {
+  const { periodStart, periodEnd, epsilon, bytes, tunnels } = body;
+  const instance = body.instance ?? 'default';
+  if (typeof instance !== 'string' || instance.length === 0 || instance.length > 100) {
+    return 'Invalid instance';
+  }
+  if (!Number.isSafeInteger(periodStart) || !Number.isSafeInteger(periodEnd) || periodEnd < periodStart ||
+      periodEnd > Date.now() + 60 * 1000) {
+    return 'Invalid period';
+  }
+  if (typeof epsilon !== 'number' || !(epsilon > 0) || !isFinite(epsilon)) {
+    return 'Invalid epsilon';
+  }
+  if (!validCounts(bytes, TELEMETRY_BYTE_BUCKETS) || !validCounts(tunnels, TELEMETRY_TUNNEL_BUCKETS)) {
+    return 'Histograms must have one count per bucket';
+  }
+  return { serverId, instance, periodStart, periodEnd, epsilon, bytes, tunnels };
+}
+
+export function recordTelemetry(report: TelemetryReport) {
+  const cutoff = Date.now() - RETENTION_MS;
+  reports = reports.filter(r => r.periodEnd >= cutoff);
+  reports.push(report);
+  db.run('DELETE FROM usage_telemetry WHERE period_end < ?', [cutoff]);
+  db.run(
+    'INSERT INTO usage_telemetry (server_id, instance, period_start, period_end, epsilon, bytes, tunnels) VALUES (?, ?, ?, ?, ?, ?, ?)',
+    [report.serverId, report.instance, report.periodStart, report.periodEnd, report.epsilon,
+      JSON.stringify(report.bytes), JSON.stringify(report.tunnels)]
+  );
+}
+
+// The histograms of the reports whose periods ended between since and
+// until, summed, optionally for some servers only. Counts are noisy and
+// can be negative; epsilon is the largest any report spent.
+export function telemetrySummary(since: number, until: number, serverIds?: Set<string>) {
+  const bytes = new Array(TELEMETRY_BYTE_BUCKETS.length + 1).fill(0);
+  const tunnels = new Array(TELEMETRY_TUNNEL_BUCKETS.length + 1).fill(0);
+  let count = 0;
+  let epsilon = 0;
+  for (const r of reports) {
+    if (r.periodEnd < since || r.periodEnd > until) continue;
+    if (serverIds && !serverIds.has(r.serverId)) continue;
+    r.bytes.forEach((c, i) => { bytes[i] += c; });
+    r.tunnels.forEach((c, i) => { tunnels[i] += c; });
+    count++;
+    epsilon = Math.max(epsilon, r.epsilon);
+  }
+  return {
+    since,
+    until,
+    reports: count,
+    epsilon,
+    bytes: { bounds: TELEMETRY_BYTE_BUCKETS, counts: bytes },
+    tunnels: { bounds: TELEMETRY_TUNNEL_BUCKETS, counts: tunnels }
+  };
+}
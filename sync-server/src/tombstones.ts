@@ -0,0 +1,108 @@
+// Tombstones of servers recently removed from the catalog. A client holding
+// an old server list or a server ID would otherwise wait for a dead node to
+// time out; with a tombstone, asking about the server gets a 410 and the
+// client knows to pick another. Tombstones last TOMBSTONE_TTL seconds, and
+// a server that registers again loses its tombstone.
+import sqlite3 from 'sqlite3';
+import { Counter, Gauge } from './metrics';
+
+export type RemovalReason = 'probe_failed' | 'stale' | 'unregistered';
+
+export interface Tombstone {
+  serverId: string;
+  location: string;
+  url: string;
+  removedAt: number;
+  reason: RemovalReason;
+}
+
+function ttlFromEnv(): number {
+  const v = process.env.TOMBSTONE_TTL;
+  if (v) {
+    const secs = parseInt(v, 10);
+    if (!isNaN(secs) && secs >= 0) return secs * 1000;
+    console.warn(`Ignoring invalid TOMBSTONE_TTL value: ${v}`);
+  }
+  return 24 * 60 * 60 * 1000;
+}
+
+const TOMBSTONE_TTL_MS = ttlFromEnv();
+
+const tombstones: Map<string, Tombstone> = new Map();
+let db: sqlite3.Database;
+
+new Gauge('horsevpn_sync_tombstones', 'Tombstones of recently removed servers', () => [[{}, tombstones.size]]);
+const tombstonesExpired = new Counter('horsevpn_sync_tombstones_expired_total', 'Tombstones dropped after TOMBSTONE_TTL');
+const tombstoneHits = new Counter('horsevpn_sync_tombstone_hits_total', 'Requests about removed servers answered with 410, by endpoint');
+
+export function initTombstones(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS tombstones (
+      server_id TEXT PRIMARY KEY,
+      location TEXT NOT NULL,
+      url TEXT NOT NULL,
+      removed_at INTEGER NOT NULL,
+      reason TEXT NOT NULL
+    )`);
+    db.all('SELECT * FROM tombstones', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading tombstones from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        tombstones.set(row.server_id, {
+          serverId: row.server_id,
+          location: row.location,
+          url: row.url,
+          removedAt: row.removed_at,
+          reason: row.reason
+        });
+      });
+    });
+  });
+}
+
+export function addTombstone(serverId: string, location: string, url: string, reason: RemovalReason) {
+  if (TOMBSTONE_TTL_MS === 0) return;
+  const tombstone: Tombstone = { serverId, location, url, removedAt: Date.now(), reason };
+  tombstones.set(serverId, tombstone);
+  db.run(
+    'INSERT OR REPLACE INTO tombstones (server_id, location, url, removed_at, reason) VALUES (?, ?, ?, ?, ?)',
+    [serverId, location, url, tombstone.removedAt, reason]
+  );
+}
+
+export function forgetTombstone(serverId: string) {
+  if (tombstones.delete(serverId)) {
+    db.run('DELETE FROM tombstones WHERE server_id = ?', [serverId]);
+  }
+}
+
+export function findTombstone(serverId: string): Tombstone | undefined {
+  const tombstone = tombstones.get(serverId);
+  if (tombstone && tombstone.removedAt <= Date.now() - TOMBSTONE_TTL_MS) return undefined;
+  return tombstone;
+}
+
+// The 410 body for a removed server, counted against endpoint
+export function goneResponse(tombstone: Tombstone, endpoint: string) {
+  tombstoneHits.inc({ endpoint });
+  return {
+    error: 'Server was removed; pick another',
+    serverId: tombstone.serverId,
+    location: tombstone.location,
+    removedAt: tombstone.removedAt,
+    reason: tombstone.reason
+  };
+}
+
+export function expireTombstones() {
+  const cutoff = Date.now() - TOMBSTONE_TTL_MS;
+  tombstones.forEach((tombstone, serverId) => {
+    if (tombstone.removedAt > cutoff) return;
+    tombstones.delete(serverId);
+    tombstonesExpired.inc();
+  });
+  db.run('DELETE FROM tombstones WHERE removed_at <= ?', [cutoff]);
+}
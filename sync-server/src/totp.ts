@@ -0,0 +1,252 @@
+// TOTP (RFC 6238) second factor for the admin API. Each admin credential
+// (an ADMIN_TOKENS entry, by name) enrolls its own secret and recovery codes.
+// Once confirmed, a current code or a single-use recovery code is exchanged
+// for a short-lived step-up session that covers the credential's requests.
+import sqlite3 from 'sqlite3';
+import crypto from 'crypto';
+
+const STEP_SECONDS = 30;
+const DIGITS = 6;
+// Accept the previous and next step to absorb clock drift
+const WINDOW = 1;
+const RECOVERY_CODES = 10;
+const STEP_UP_MINUTES = parseInt(process.env.ADMIN_STEP_UP_MINUTES || '15', 10);
+
+const BASE32 = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+
+interface TotpState {
+  secret: string;
+  confirmed: boolean;
+  // Highest time step accepted so far; a code can't be replayed
+  lastStep: number;
+}
+
+interface StepUpSession {
+  credential: string;
+  expiresAt: number;
+}
+
+// Keyed by credential name
+const states: Map<string, TotpState> = new Map();
+const recoveryHashes: Map<string, Set<string>> = new Map();
+// Keyed by the SHA-256 of the session token; kept in memory only, so a
+// restart asks for a fresh code
+const stepUpSessions: Map<string, StepUpSession> = new Map();
+let db: sqlite3.Database;
+
+export function initTotp(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS admin_totp_credentials (
+      credential TEXT PRIMARY KEY,
+      secret TEXT NOT NULL,
+      confirmed INTEGER NOT NULL,
+      last_step INTEGER NOT NULL
+    )`);
+    db.run(`CREATE TABLE IF NOT EXISTS admin_credential_recovery_codes (
+      credential TEXT NOT NULL,
+      hash TEXT NOT NULL,
+      PRIMARY KEY (credential, hash)
+    )`);
+    db.all('SELECT * FROM admin_totp_credentials', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading TOTP state from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        states.set(row.credential, { secret: row.secret, confirmed: row.confirmed === 1, lastStep: row.last_step });
+      });
+    });
+    db.all('SELECT credential, hash FROM admin_credential_recovery_codes', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading recovery codes from DB:', err);
+        return;
+      }
+      rows.forEach(row => {
+        if (!recoveryHashes.has(row.credential)) recoveryHashes.set(row.credential, new Set());
+        recoveryHashes.get(row.credential)!.add(row.hash);
+      });
+    });
+  });
+}
+
+// Whether a credential has a confirmed TOTP secret
+export function totpEnabled(credential: string): boolean {
+  const state = states.get(credential);
+  return state !== undefined && state.confirmed;
+}
+
+function base32Encode(buf: Buffer): string {
+  let bits = 0;
+  let value = 0;
+  let out = '';
+  for (const byte of buf) {
+    value = (value << 8) | byte;
+    bits += 8;
+    while (bits >= 5) {
+      out += BASE32[(value >>> (bits - 5)) & 31];
+      bits -= 5;
+    }
+  }
+  if (bits > 0) {
+    out += BASE32[(value << (5 - bits)) & 31];
+  }
+  return out;
+}
+
+function base32Decode(s: string): Buffer {
+  let bits = 0;
+  let value = 0;
+  const out: number[] = [];
+  for (const c of s.replace(/=+$/, '').toUpperCase()) {
+    const idx = BASE32.indexOf(c);
+    if (idx < 0) throw new Error('Invalid base32');
+    value = (value << 5) | idx;
+    bits += 5;
+    if (bits >= 8) {
+      out.push((value >>> (bits - 8)) & 255);
+      bits -= 8;
+    }
+  }
+  return Buffer.from(out);
+}
+
+function codeForStep(secret: string, step: number): string {
+  const counter = Buffer.alloc(8);
+  counter.writeBigUInt64BE(BigInt(step));
+  const hmac = crypto.createHmac('sha1', base32Decode(secret)).update(counter).digest();
+  const offset = hmac[hmac.length - 1] & 0x0f;
+  const binary = hmac.readUInt32BE(offset) & 0x7fffffff;
+  return (binary % 10 ** DIGITS).toString().padStart(DIGITS, '0');
+}
+
+function currentStep(): number {
+  return Math.floor(Date.now() / 1000 / STEP_SECONDS);
+}
+
+function hashRecoveryCode(code: string): string {
+  return crypto.createHash('sha256').update(code.replace(/[\s-]/g, '').toUpperCase()).digest('hex');
+}
+
+function saveState(credential: string, state: TotpState) {
+  db.run(
+    'INSERT OR REPLACE INTO admin_totp_credentials (credential, secret, confirmed, last_step) VALUES (?, ?, ?, ?)',
+    [credential, state.secret, state.confirmed ? 1 : 0, state.lastStep]
+  );
+}
+
+// Checks a code against the credential's enrolled (or pending) secret,
+// rejecting replays
+function checkCode(credential: string, code: string): boolean {
+  const state = states.get(credential);
+  if (!state || !/^\d{6}$/.test(code)) return false;
+
+  const now = currentStep();
+  for (let step = now - WINDOW; step <= now + WINDOW; step++) {
+    if (step <= state.lastStep) continue;
+    const expected = Buffer.from(codeForStep(state.secret, step));
+    if (crypto.timingSafeEqual(expected, Buffer.from(code))) {
+      state.lastStep = step;
+      saveState(credential, state);
+      return true;
+    }
+  }
+  return false;
+}
+
+// Verifies a credential's second factor
+export function verifySecondFactor(credential: string, totpCode: string | undefined, recoveryCode: string | undefined): boolean {
+  if (!totpEnabled(credential)) return false;
+  if (totpCode !== undefined) {
+    return checkCode(credential, totpCode);
+  }
+  if (recoveryCode !== undefined) {
+    const hashes = recoveryHashes.get(credential);
+    const hash = hashRecoveryCode(recoveryCode);
+    if (!hashes || !hashes.has(hash)) return false;
+    // Recovery codes are single use
+    hashes.delete(hash);
+    db.run('DELETE FROM admin_credential_recovery_codes WHERE credential = ? AND hash = ?', [credential, hash]);
+    console.warn(`Admin recovery code used by ${credential}, ${hashes.size} remaining`);
+    return true;
+  }
+  return false;
+}
+
+// Starts a step-up session for a credential that has just presented its
+// second factor
+export function startStepUpSession(credential: string): { session: string; expiresAt: number } {
+  const now = Date.now();
+  stepUpSessions.forEach((session, hash) => {
+    if (session.expiresAt <= now) stepUpSessions.delete(hash);
+  });
+
+  const session = crypto.randomBytes(32).toString('base64url');
+  const expiresAt = now + STEP_UP_MINUTES * 60 * 1000;
+  stepUpSessions.set(crypto.createHash('sha256').update(session).digest('hex'), { credential, expiresAt });
+  return { session, expiresAt };
+}
+
+// Whether a step-up session is live and was started by the credential
+export function stepUpSessionValid(credential: string, session: string): boolean {
+  const hash = crypto.createHash('sha256').update(session).digest('hex');
+  const found = stepUpSessions.get(hash);
+  if (!found) return false;
+  if (found.expiresAt <= Date.now()) {
+    stepUpSessions.delete(hash);
+    return false;
+  }
+  return found.credential === credential;
+}
+
+// Starts enrollment for a credential with a fresh secret and recovery codes.
+// The secret only takes effect once confirmEnrollment is called with a valid
+// code.
+export function beginEnrollment(credential: string): { secret: string; otpauthUri: string; recoveryCodes: string[] } {
+  const secret = base32Encode(crypto.randomBytes(20));
+  const state = { secret, confirmed: false, lastStep: 0 };
+  states.set(credential, state);
+  saveState(credential, state);
+
+  const recoveryCodes: string[] = [];
+  for (let i = 0; i < RECOVERY_CODES; i++) {
+    const raw = base32Encode(crypto.randomBytes(10));
+    recoveryCodes.push(`${raw.slice(0, 4)}-${raw.slice(4, 8)}-${raw.slice(8, 12)}-${raw.slice(12, 16)}`);
+  }
+  const hashes = new Set(recoveryCodes.map(hashRecoveryCode));
+  recoveryHashes.set(credential, hashes);
+  db.serialize(() => {
+    db.run('DELETE FROM admin_credential_recovery_codes WHERE credential = ?', [credential]);
+    hashes.forEach(hash =>
+      db.run('INSERT INTO admin_credential_recovery_codes (credential, hash) VALUES (?, ?)', [credential, hash])
+    );
+  });
+
+  const label = encodeURIComponent(`HorseVPN:${credential}`);
+  const otpauthUri = `otpauth://totp/${label}?secret=${secret}&issuer=HorseVPN&algorithm=SHA1&digits=${DIGITS}&period=${STEP_SECONDS}`;
+  return { secret, otpauthUri, recoveryCodes };
+}
+
+export function confirmEnrollment(credential: string, code: string): boolean {
+  const state = states.get(credential);
+  if (!state || state.confirmed) return false;
+  if (!checkCode(credential, code)) return false;
+  state.confirmed = true;
+  saveState(credential, state);
+  return true;
+}
+
+// Removes a credential's secret and recovery codes, and ends its step-up
+// sessions. Returns false when it had none.
+export function disableTotp(credential: string): boolean {
+  const existed = states.delete(credential);
+  recoveryHashes.delete(credential);
+  stepUpSessions.forEach((session, hash) => {
+    if (session.credential === credential) stepUpSessions.delete(hash);
+  });
+  db.serialize(() => {
+    db.run('DELETE FROM admin_totp_credentials WHERE credential = ?', [credential]);
+    db.run('DELETE FROM admin_credential_recovery_codes WHERE credential = ?', [credential]);
+  });
+  return existed;
+}
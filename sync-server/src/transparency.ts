@@ -0,0 +1,218 @@
+// Transparency statement, also known as a warrant canary: a dated statement
+// from the operator, such as that no warrants or gag orders have been
+// received, which clients can check came from the sync server and notice
+// when it stops being renewed. The text is entirely the operator's; this
+// only numbers, dates and signs it.
+//
+// Statements are signed with an Ed25519 key of their own, kept in the
+// database rather than shared with session tokens, so it can be rotated
+// without touching the nodes. Rotating has the outgoing key sign the new
+// one before its private half is deleted, and the served statement lists
+// every key with those endorsements, so a client pinned to any earlier key
+// can follow the chain to the current one.
+import crypto from 'crypto';
+import sqlite3 from 'sqlite3';
+
+// Prefixed before signing, so neither signature can pass for the other or
+// for anything else the sync server signs
+const STATEMENT_CONTEXT = 'horsevpn-transparency-v1\n';
+const ENDORSEMENT_CONTEXT = 'horsevpn-transparency-key-v1\n';
+
+const MAX_STATEMENT_LENGTH = 10000;
+const DEFAULT_VALIDITY_MS = 30 * 24 * 60 * 60 * 1000;
+const MAX_VALIDITY_MS = 366 * 24 * 60 * 60 * 1000;
+
+export interface TransparencyStatement {
+  statement: string;
+  // Bumped on every update, so clients can refuse an older one
+  sequence: number;
+  issuedAt: number;
+  // When the operator promises the next statement by; a client still
+  // holding this one after then should assume something is wrong
+  nextUpdate: number;
+  updatedBy: string;
+}
+
+interface TransparencyKey {
+  id: string;
+  // Raw public key in base64, as clients pin it
+  publicKey: string;
+  createdAt: number;
+  // Deleted when the key is retired
+  privateKey?: crypto.KeyObject;
+  retiredAt?: number;
+  // The previous key's signature over this one; the first key has none
+  endorsement?: string;
+}
+
+// Oldest first; the last one signs
+let keys: TransparencyKey[] = [];
+let current: TransparencyStatement | undefined;
+let db: sqlite3.Database;
+
+function rawPublicKey(privateKey: crypto.KeyObject): Buffer {
+  const jwk = crypto.createPublicKey(privateKey).export({ format: 'jwk' });
+  return Buffer.from(jwk.x as string, 'base64url');
+}
+
+function newKey(previous?: TransparencyKey): TransparencyKey {
+  const privateKey = crypto.generateKeyPairSync('ed25519').privateKey;
+  const raw = rawPublicKey(privateKey);
+  const key: TransparencyKey = {
+    id: crypto.createHash('sha256').update(raw).digest('hex').slice(0, 16),
+    publicKey: raw.toString('base64'),
+    createdAt: Date.now(),
+    privateKey
+  };
+  if (previous?.privateKey) {
+    key.endorsement = crypto.sign(null, endorsed(key), previous.privateKey).toString('base64');
+  }
+  return key;
+}
+
+// What the previous key signs to vouch for key
+function endorsed(key: TransparencyKey): Buffer {
+  return Buffer.from(`${ENDORSEMENT_CONTEXT}${key.id}\n${key.publicKey}`);
+}
+
+function saveKey(key: TransparencyKey) {
+  db.run(
+    'INSERT OR REPLACE INTO transparency_keys (id, public_key, private_key, created_at, retired_at, endorsement) VALUES (?, ?, ?, ?, ?, ?)',
+    [key.id, key.publicKey, key.privateKey?.export({ type: 'pkcs8', format: 'pem' }) ?? null, key.createdAt,
+      key.retiredAt ?? null, key.endorsement ?? null]
+  );
+}
+
+export function initTransparency(database: sqlite3.Database) {
+  db = database;
+  db.serialize(() => {
+    db.run(`CREATE TABLE IF NOT EXISTS transparency_keys (
+      id TEXT PRIMARY KEY,
+      public_key TEXT NOT NULL,
+      private_key TEXT,
+      created_at INTEGER NOT NULL,
+      retired_at INTEGER,
+      endorsement TEXT
+    )`);
+    // A single row, with id 1
+    db.run(`CREATE TABLE IF NOT EXISTS transparency_statement (
+      id INTEGER PRIMARY KEY CHECK (id = 1),
+      statement TEXT NOT NULL,
+      sequence INTEGER NOT NULL,
+      issued_at INTEGER NOT NULL,
+      next_update INTEGER NOT NULL,
+      updated_by TEXT NOT NULL
+    )`);
+    db.all('SELECT * FROM transparency_keys ORDER BY created_at', [], (err, rows: any[]) => {
+      if (err) {
+        console.error('Error loading transparency keys from DB:', err);
+        return;
+      }
+      keys = rows.map(row => ({
+        id: row.id,
+        publicKey: row.public_key,
+        createdAt: row.created_at,
+        ...(row.private_key !== null && { privateKey: crypto.createPrivateKey(row.private_key) }),
+        ...(row.retired_at !== null && { retiredAt: row.retired_at }),
+        ...(row.endorsement !== null && { endorsement: row.endorsement })
+      }));
+      if (keys.length === 0) {
+        const key = newKey();
+        keys.push(key);
+        saveKey(key);
+        console.log('Generated transparency signing key');
+      }
+      console.log(`Transparency public key (pin in clients with HORSEVPN_TRANSPARENCY_PUBLIC_KEY): ${signingKey()!.publicKey}`);
+    });
+    db.get('SELECT * FROM transparency_statement WHERE id = 1', [], (err, row: any) => {
+      if (err) {
+        console.error('Error loading transparency statement from DB:', err);
+        return;
+      }
+      if (row) {
+        current = {
+          statement: row.statement,
+          sequence: row.sequence,
+          issuedAt: row.issued_at,
+          nextUpdate: row.next_update,
+          updatedBy: row.updated_by
+        };
+      }
+    });
+  });
+}
+
+function signingKey(): TransparencyKey | undefined {
+  return keys[keys.length - 1];
+}
+
+// Checks a statement from the admin API, returning its text and next
+// update or an error message
+export function parseTransparencyStatement(body: any): Pick<TransparencyStatement, 'statement' | 'nextUpdate'> | string {
+  if (typeof body !== 'object' || body === null) {
+    return 'Statement must be an object';
+  }
+  const { statement, nextUpdate = Date.now() + DEFAULT_VALIDITY_MS } = body;
+  if (typeof statement !== 'string' || statement.trim().length === 0 || statement.length > MAX_STATEMENT_LENGTH) {
+    return `statement must be 1 to ${MAX_STATEMENT_LENGTH} characters`;
+  }
+  if (!Number.isSafeInteger(nextUpdate) || nextUpdate <= Date.now() || nextUpdate > Date.now() + MAX_VALIDITY_MS) {
+    return 'nextUpdate must be a time within a year from now, in milliseconds since the epoch';
+  }
+  return { statement: statement.trim(), nextUpdate };
+}
+
+export function currentTransparencyStatement(): TransparencyStatement | undefined {
+  return current;
+}
+
+export function putTransparencyStatement(statement: Pick<TransparencyStatement, 'statement' | 'nextUpdate'>, updatedBy: string): TransparencyStatement {
+  current = { ...statement, sequence: (current?.sequence ?? 0) + 1, issuedAt: Date.now(), updatedBy };
+  db.run(
+    'INSERT OR REPLACE INTO transparency_statement (id, statement, sequence, issued_at, next_update, updated_by) VALUES (1, ?, ?, ?, ?, ?)',
+    [current.statement, current.sequence, current.issuedAt, current.nextUpdate, updatedBy]
+  );
+  return current;
+}
+
+// Replaces the signing key with a new one it endorses, and deletes the old
+// private key. The current statement is signed with the new key from now on.
+export function rotateTransparencyKey(): { id: string; publicKey: string; previous: string } | undefined {
+  const previous = signingKey();
+  if (!previous?.privateKey) return undefined;
+  const key = newKey(previous);
+  previous.retiredAt = key.createdAt;
+  delete previous.privateKey;
+  keys.push(key);
+  db.serialize(() => {
+    saveKey(previous);
+    saveKey(key);
+  });
+  return { id: key.id, publicKey: key.publicKey, previous: previous.id };
+}
+
+// The statement as clients receive it: the signature covers the exact
+// payload bytes, which name the signing key, and keys has what a client
+// pinned to an older key needs to trust that one
+export function signedTransparencyStatement(statement: TransparencyStatement) {
+  const key = signingKey();
+  if (!key?.privateKey) return undefined;
+  const payload = Buffer.from(JSON.stringify({
+    statement: statement.statement,
+    sequence: statement.sequence,
+    issuedAt: statement.issuedAt,
+    nextUpdate: statement.nextUpdate,
+    keyId: key.id
+  }));
+  return {
+    payload: payload.toString('base64'),
+    signature: crypto.sign(null, Buffer.concat([Buffer.from(STATEMENT_CONTEXT), payload]), key.privateKey).toString('base64'),
+    keys: keys.map(k => ({
+      id: k.id,
+      publicKey: k.publicKey,
+      createdAt: k.createdAt,
+      ...(k.retiredAt !== undefined && { retiredAt: k.retiredAt }),
+      ...(k.endorsement !== undefined && { endorsement: k.endorsement })
+    }))
+  };
+}